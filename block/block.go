@@ -26,10 +26,26 @@ func NewBlockSize(bs uint16) (BlockSize, error) {
 		return 0, errors.Wrapf(internalerror.InvalidInput, "mod of %d is not 512", bs)
 	}
 
+	//the portions are shifted by the block size, and the sectors of the drives are power of two
+	if bs&(bs-1) != 0 {
+		return 0, errors.Wrapf(internalerror.InvalidInput, "blocksize %d is not a power of two", bs)
+	}
+
 	return BlockSize(bs), nil
 
 }
 
+//ParseBlockSize parses the block size given by the user, it returns 0 if size is 0, then the sector size is used
+func ParseBlockSize(size uint64) (BlockSize, error) {
+	if size == 0 {
+		return 0, nil
+	}
+	if size > uint64(^uint16(0)) {
+		return 0, errors.Wrapf(internalerror.InvalidInput, "block size %d is too big", size)
+	}
+	return NewBlockSize(uint16(size))
+}
+
 func (bs BlockSize) CeilAlign(position uint64) uint64 {
 	block_size := uint64(bs)
 	return (position + block_size - 1) / block_size * block_size
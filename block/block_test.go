@@ -38,8 +38,33 @@ func TestBlockContains(t *testing.T) {
 
 	bs1024, _ := NewBlockSize(1024)
 	bs512, _ := NewBlockSize(512)
-	bs1536, _ := NewBlockSize(1536)
+	bs1536 := BlockSize(1536)
 	assert.Equal(t, bs.Contains(bs1024), true)
 	assert.Equal(t, bs.Contains(bs512), true)
 	assert.Equal(t, bs.Contains(bs1536), false)
 }
+
+func TestNewBlockSize(t *testing.T) {
+	for _, size := range []uint16{512, 1024, 4096, 32768} {
+		bs, err := NewBlockSize(size)
+		assert.Nil(t, err)
+		assert.Equal(t, size, bs.AsU16())
+	}
+	for _, size := range []uint16{0, 256, 511, 1536, 3072} {
+		_, err := NewBlockSize(size)
+		assert.Error(t, err)
+	}
+}
+
+func TestParseBlockSize(t *testing.T) {
+	bs, err := ParseBlockSize(0)
+	assert.Nil(t, err)
+	assert.Equal(t, BlockSize(0), bs)
+	bs, err = ParseBlockSize(4096)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(4096), bs.AsU16())
+	_, err = ParseBlockSize(1000)
+	assert.Error(t, err)
+	_, err = ParseBlockSize(1 << 16)
+	assert.Error(t, err)
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage"
+	"github.com/thesues/cannyls-go/storage/journal"
+	"github.com/urfave/cli"
+)
+
+/*
+cannyls dumps all the lumps of a storage to a stream, and restores them to another storage,
+so a storage could be moved to a new version or a device of another block size.
+It also verifies and repairs a storage, see Storage.Verify, prints the journal records,
+and watches a running storage through its stats socket, see Storage.EnableStats.
+
+The tar stream has one file for every lump, the name is the lumpid in hex, and the pax
+records are set for the attributes of the lump: EMBEDDED_PAX_KEY if the lump is embedded in
+the journal region, METADATA_PAX_KEY for the metadata in hex, TAG_PAX_KEY for the tag and
+EXPIRE_AT_PAX_KEY for the expire time in unix seconds.
+The jsonl stream has one dumpRecord in every line.
+The expired lumps are not dumped. The markers of the journal are not dumped, because their ids
+could not be kept in another storage.
+*/
+
+const (
+	FORMAT_TAR   = "tar"
+	FORMAT_JSONL = "jsonl"
+
+	EMBEDDED_PAX_KEY  = "CANNYLS.embedded"
+	METADATA_PAX_KEY  = "CANNYLS.metadata"
+	TAG_PAX_KEY       = "CANNYLS.tag"
+	EXPIRE_AT_PAX_KEY = "CANNYLS.expire_at"
+)
+
+//dumpLump is a lump in the dump stream with its attributes
+type dumpLump struct {
+	Id       lump.LumpId
+	Embedded bool
+	Data     []byte
+	//Metadata is nil if the lump is put without metadata
+	Metadata []byte
+	Tag      string
+	//ExpireAt is 0 if the lump has no TTL, otherwise it is in unix seconds
+	ExpireAt int64
+}
+
+type dumpRecord struct {
+	Id       string  `json:"id"`
+	Embedded bool    `json:"embedded,omitempty"`
+	Data     []byte  `json:"data"`
+	Metadata *[]byte `json:"metadata,omitempty"`
+	Tag      string  `json:"tag,omitempty"`
+	ExpireAt int64   `json:"expire_at,omitempty"`
+}
+
+//lumpWriter writes a lump to the dump stream
+type lumpWriter interface {
+	WriteLump(l dumpLump) error
+	Close() error
+}
+
+//lumpReader reads the next lump from the dump stream, it returns io.EOF at the end
+type lumpReader interface {
+	ReadLump() (l dumpLump, err error)
+}
+
+type tarLumpWriter struct {
+	tw *tar.Writer
+}
+
+func (w tarLumpWriter) WriteLump(l dumpLump) error {
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       l.Id.String(),
+		Mode:       0644,
+		Size:       int64(len(l.Data)),
+		ModTime:    time.Now(),
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{},
+	}
+	if l.Embedded {
+		header.PAXRecords[EMBEDDED_PAX_KEY] = "true"
+	}
+	if l.Metadata != nil {
+		header.PAXRecords[METADATA_PAX_KEY] = hex.EncodeToString(l.Metadata)
+	}
+	if l.Tag != "" {
+		header.PAXRecords[TAG_PAX_KEY] = l.Tag
+	}
+	if l.ExpireAt != 0 {
+		header.PAXRecords[EXPIRE_AT_PAX_KEY] = strconv.FormatInt(l.ExpireAt, 10)
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(l.Data)
+	return err
+}
+
+func (w tarLumpWriter) Close() error {
+	return w.tw.Close()
+}
+
+type tarLumpReader struct {
+	tr *tar.Reader
+}
+
+func (r tarLumpReader) ReadLump() (l dumpLump, err error) {
+	header, err := r.tr.Next()
+	if err != nil {
+		return
+	}
+	if l.Id, err = lump.FromString(header.Name); err != nil {
+		return
+	}
+	if header.Size > lump.LARGE_LUMP_MAX_SIZE {
+		return l, fmt.Errorf("lump %s is too big: %d", header.Name, header.Size)
+	}
+	l.Embedded = header.PAXRecords[EMBEDDED_PAX_KEY] == "true"
+	if metadata, ok := header.PAXRecords[METADATA_PAX_KEY]; ok {
+		if l.Metadata, err = hex.DecodeString(metadata); err != nil {
+			return l, fmt.Errorf("invalid metadata of lump %s: %v", header.Name, err)
+		}
+	}
+	l.Tag = header.PAXRecords[TAG_PAX_KEY]
+	if expireAt, ok := header.PAXRecords[EXPIRE_AT_PAX_KEY]; ok {
+		if l.ExpireAt, err = strconv.ParseInt(expireAt, 10, 64); err != nil {
+			return l, fmt.Errorf("invalid expire time of lump %s: %v", header.Name, err)
+		}
+	}
+	l.Data, err = ioutil.ReadAll(r.tr)
+	return
+}
+
+type jsonLumpWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w jsonLumpWriter) WriteLump(l dumpLump) error {
+	record := dumpRecord{Id: l.Id.String(), Embedded: l.Embedded, Data: l.Data, Tag: l.Tag, ExpireAt: l.ExpireAt}
+	if l.Metadata != nil {
+		record.Metadata = &l.Metadata
+	}
+	return w.enc.Encode(record)
+}
+
+func (w jsonLumpWriter) Close() error {
+	return w.w.Flush()
+}
+
+type jsonLumpReader struct {
+	dec *json.Decoder
+}
+
+func (r jsonLumpReader) ReadLump() (l dumpLump, err error) {
+	var record dumpRecord
+	if err = r.dec.Decode(&record); err != nil {
+		return
+	}
+	if l.Id, err = lump.FromString(record.Id); err != nil {
+		return
+	}
+	if uint64(len(record.Data)) > lump.LARGE_LUMP_MAX_SIZE {
+		return l, fmt.Errorf("lump %s is too big: %d", record.Id, len(record.Data))
+	}
+	l.Embedded, l.Data, l.Tag, l.ExpireAt = record.Embedded, record.Data, record.Tag, record.ExpireAt
+	if record.Metadata != nil {
+		l.Metadata = append([]byte{}, *record.Metadata...)
+	}
+	return l, nil
+}
+
+func newLumpWriter(format string, w io.Writer) (lumpWriter, error) {
+	switch format {
+	case FORMAT_TAR:
+		return tarLumpWriter{tw: tar.NewWriter(w)}, nil
+	case FORMAT_JSONL:
+		bw := bufio.NewWriter(w)
+		return jsonLumpWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+}
+
+func newLumpReader(format string, r io.Reader) (lumpReader, error) {
+	switch format {
+	case FORMAT_TAR:
+		return tarLumpReader{tr: tar.NewReader(r)}, nil
+	case FORMAT_JSONL:
+		return jsonLumpReader{dec: json.NewDecoder(bufio.NewReader(r))}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+}
+
+//openStream returns stdin or stdout if path is "" or "-"
+func openStream(path string, write bool) (*os.File, error) {
+	if path == "" || path == "-" {
+		if write {
+			return os.Stdout, nil
+		}
+		return os.Stdin, nil
+	}
+	if write {
+		return os.Create(path)
+	}
+	return os.Open(path)
+}
+
+//dump writes all the lumps in the storage which are not expired at now with their attributes,
+//it returns the number of the lumps and the bytes
+func dump(store *storage.Storage, w lumpWriter, now time.Time) (count uint64, bytes uint64, err error) {
+	iter, err := store.Iterator()
+	if err != nil {
+		return
+	}
+	defer iter.Close()
+	for {
+		entry, ok := iter.Next()
+		if !ok {
+			return
+		}
+		l := dumpLump{Id: entry.Id, Embedded: entry.Embedded}
+		if expireAt, ok := store.ExpireAt(entry.Id); ok {
+			if !now.Before(expireAt) {
+				continue
+			}
+			l.ExpireAt = expireAt.Unix()
+		}
+		if l.Data, err = store.Get(entry.Id); err != nil {
+			return count, bytes, err
+		}
+		//the metadata of a lump without metadata is empty, so the empty metadata is not dumped
+		if metadata, err := store.GetMetadata(entry.Id); err != nil {
+			return count, bytes, err
+		} else if len(metadata) > 0 {
+			l.Metadata = metadata
+		}
+		if l.Tag, err = store.GetTag(entry.Id); err != nil {
+			return count, bytes, err
+		}
+		if err = w.WriteLump(l); err != nil {
+			return count, bytes, err
+		}
+		count++
+		bytes += uint64(len(l.Data))
+	}
+}
+
+//restore puts all the lumps in the stream with their attributes, the embedded lumps are embedded
+//again, the expired lumps are skipped
+func restore(store *storage.Storage, r lumpReader) (count uint64, bytes uint64, err error) {
+	for {
+		l, err := r.ReadLump()
+		if err == io.EOF {
+			return count, bytes, nil
+		}
+		if err != nil {
+			return count, bytes, err
+		}
+		//the TTL is rounded up to seconds, so the lump expires at about the same second
+		ttl := time.Until(time.Unix(l.ExpireAt, 0))
+		if l.ExpireAt != 0 && ttl <= 0 {
+			continue
+		}
+		lumpdata := lump.NewLumpDataAligned(len(l.Data), block.Min())
+		copy(lumpdata.AsBytes(), l.Data)
+		embedded := l.Embedded && len(l.Data) <= lump.MAX_EMBEDDED_SIZE
+		switch {
+		case l.ExpireAt != 0:
+			_, err = store.PutWithTTL(l.Id, lumpdata, ttl)
+		case l.Metadata != nil || l.Tag != "":
+			if embedded {
+				_, err = store.PutEmbedWithTag(l.Id, l.Data, l.Metadata, l.Tag)
+			} else {
+				_, err = store.PutWithTag(l.Id, lumpdata, l.Metadata, l.Tag)
+			}
+		case embedded:
+			_, err = store.PutEmbed(l.Id, l.Data)
+		default:
+			_, err = store.Put(l.Id, lumpdata)
+		}
+		if err != nil {
+			return count, bytes, fmt.Errorf("failed to restore lump %s: %v", l.Id.String(), err)
+		}
+		count++
+		bytes += uint64(len(l.Data))
+	}
+}
+
+func dumpCannyls(c *cli.Context) (err error) {
+	path := c.String("storage")
+	if path == "" {
+		return errors.New("argu storage is empty")
+	}
+	store, err := storage.OpenCannylsStorage(path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	out, err := openStream(c.String("output"), true)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w, err := newLumpWriter(c.String("format"), out)
+	if err != nil {
+		return err
+	}
+
+	count, bytes, err := dump(store, w, time.Now())
+	if err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		if err = out.Sync(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d lumps, %d bytes\n", count, bytes)
+	return nil
+}
+
+func restoreCannyls(c *cli.Context) (err error) {
+	path := c.String("storage")
+	if path == "" {
+		return errors.New("argu storage is empty")
+	}
+	var store *storage.Storage
+	if capacity := c.Uint64("capacity"); capacity > 0 {
+		options := storage.DefaultStorageOptions()
+		if options.File.BlockSize, err = block.ParseBlockSize(c.Uint64("block-size")); err != nil {
+			return err
+		}
+		align := block.Min()
+		if options.File.BlockSize != 0 {
+			align = options.File.BlockSize
+		}
+		store, err = storage.CreateCannylsStorageWithOptions(path, align.CeilAlign(capacity), c.Float64("journal-ratio"), options)
+	} else {
+		store, err = storage.OpenCannylsStorage(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	in, err := openStream(c.String("input"), false)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := newLumpReader(c.String("format"), in)
+	if err != nil {
+		return err
+	}
+
+	count, bytes, err := restore(store, r)
+	if err != nil {
+		return err
+	}
+	if err = store.Sync(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %d lumps, %d bytes\n", count, bytes)
+	return nil
+}
+
+func fsckCannyls(c *cli.Context) (err error) {
+	path := c.String("storage")
+	if path == "" {
+		return errors.New("argu storage is empty")
+	}
+	repair := c.Bool("repair")
+	var store *storage.Storage
+	if repair {
+		store, err = storage.OpenCannylsStorage(path)
+	} else {
+		store, err = storage.OpenReadOnly(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.Verify(storage.VerifyOptions{Deep: c.Bool("deep"), Repair: repair})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("journal records %d, data lumps %d, embedded lumps %d\n",
+		report.JournalRecords, report.DataLumps, report.EmbeddedLumps)
+	unrepaired := 0
+	for _, problem := range report.Problems {
+		if problem.Repaired {
+			fmt.Printf("repaired %s\n", problem)
+		} else {
+			fmt.Printf("%s\n", problem)
+			unrepaired++
+		}
+	}
+	if unrepaired > 0 {
+		return fmt.Errorf("%d problems are found", unrepaired)
+	}
+	return nil
+}
+
+//journalRow is a line of journal-dump, a batch or a transaction has a line for every lump
+type journalRow struct {
+	kind     string
+	id       string
+	portion  string
+	embedded string
+	extra    string
+}
+
+func dataRow(kind string, id lump.LumpId, p portion.DataPortion) journalRow {
+	return journalRow{kind: kind, id: id.String(), portion: fmt.Sprintf("data %d+%d", p.Start.AsU64(), p.Len)}
+}
+
+func embedRow(kind string, id lump.LumpId, data []byte) journalRow {
+	return journalRow{kind: kind, id: id.String(), portion: "journal", embedded: fmt.Sprintf("%d", len(data))}
+}
+
+func metadataExtra(metadata []byte, tag string) string {
+	if tag == "" {
+		return fmt.Sprintf("metadata %d bytes", len(metadata))
+	}
+	return fmt.Sprintf("metadata %d bytes, tag %q", len(metadata), tag)
+}
+
+func journalRows(record journal.JournalRecord) []journalRow {
+	switch r := record.(type) {
+	case journal.PutRecord:
+		return []journalRow{dataRow("put", r.LumpID, r.DataPortion)}
+	case journal.PutWithTTLRecord:
+		row := dataRow("put_ttl", r.LumpID, r.DataPortion)
+		row.extra = "expire at " + time.Unix(int64(r.ExpireAt), 0).Format(time.RFC3339)
+		return []journalRow{row}
+	case journal.PutWithMetadataRecord:
+		row := dataRow("put_meta", r.LumpID, r.DataPortion)
+		row.extra = metadataExtra(r.Metadata, r.LumpTag)
+		return []journalRow{row}
+	case journal.EmbedRecord:
+		return []journalRow{embedRow("embed", r.LumpID, r.Data)}
+	case journal.EmbedWithMetadataRecord:
+		row := embedRow("embed_meta", r.LumpID, r.Data)
+		row.extra = metadataExtra(r.Metadata, r.LumpTag)
+		return []journalRow{row}
+	case journal.OverwriteRecord:
+		return []journalRow{dataRow("overwrite", r.LumpID, r.DataPortion)}
+	case journal.PutDedupRecord:
+		row := dataRow("put_dedup", r.LumpID, r.DataPortion)
+		row.extra = fmt.Sprintf("sha256 %x", r.Hash[:8])
+		return []journalRow{row}
+	case journal.PutExtentsRecord:
+		extra := fmt.Sprintf("%d extents", len(r.Extents))
+		if r.ExpireAt != 0 {
+			extra += ", expire at " + time.Unix(int64(r.ExpireAt), 0).Format(time.RFC3339)
+		}
+		if r.Metadata != nil {
+			extra += ", " + metadataExtra(r.Metadata, r.LumpTag)
+		}
+		rows := []journalRow{{kind: "put_extents", id: r.LumpID.String(), extra: extra}}
+		for _, p := range r.Extents {
+			rows = append(rows, dataRow("  extent", r.LumpID, p))
+		}
+		return rows
+	case journal.DeleteRecord:
+		return []journalRow{{kind: "delete", id: r.LumpID.String()}}
+	case journal.DeleteRange:
+		return []journalRow{{kind: "delete_range", id: r.Start.String() + "-" + r.End.String()}}
+	case journal.PutBatchRecord:
+		rows := []journalRow{{kind: "put_batch", extra: fmt.Sprintf("%d puts", len(r.Puts))}}
+		for _, put := range r.Puts {
+			rows = append(rows, dataRow("  put", put.LumpID, put.DataPortion))
+		}
+		return rows
+	case journal.TransactionRecord:
+		rows := []journalRow{{kind: "transaction", extra: fmt.Sprintf("%d puts, %d deletes", len(r.Puts), len(r.Deletes))}}
+		for _, put := range r.Puts {
+			rows = append(rows, dataRow("  put", put.LumpID, put.DataPortion))
+		}
+		for _, id := range r.Deletes {
+			rows = append(rows, journalRow{kind: "  delete", id: id.String()})
+		}
+		return rows
+	case journal.MarkerRecord:
+		return []journalRow{{kind: "marker", embedded: fmt.Sprintf("%d", len(r.Data)), extra: fmt.Sprintf("marker %d", r.ID)}}
+	case journal.ReleaseMarkerRecord:
+		return []journalRow{{kind: "release_marker", extra: fmt.Sprintf("marker %d", r.ID)}}
+	default:
+		return []journalRow{{kind: fmt.Sprintf("tag %d", record.Tag())}}
+	}
+}
+
+func journalDumpCannyls(c *cli.Context) (err error) {
+	path := c.String("storage")
+	if path == "" {
+		return errors.New("argu storage is empty")
+	}
+	//read only, so GC does not change the journal while it is dumped
+	store, err := storage.OpenReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	filter := c.String("lump")
+	if filter != "" {
+		id, err := lump.FromString(filter)
+		if err != nil {
+			return err
+		}
+		filter = id.String()
+	}
+
+	header := store.Header()
+	snap := store.JournalSnapshot()
+	fmt.Printf("journal region  %d bytes\n", header.JournalRegionSize)
+	fmt.Printf("unreleased head %d\n", snap.UnreleasedHead)
+	fmt.Printf("head            %d\n", snap.Head)
+	fmt.Printf("tail            %d\n", snap.Tail)
+	fmt.Printf("usage           %d bytes, %d records\n", store.Usage().JournalUsage, len(snap.Entries))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POSITION\tSIZE\tTYPE\tLUMP\tPORTION\tEMBEDDED\tEXTRA")
+	for _, entry := range snap.Entries {
+		rows := journalRows(entry.Record)
+		if filter != "" && !journalRowsContain(rows, filter) {
+			continue
+		}
+		for i, row := range rows {
+			position, size := "", ""
+			if i == 0 {
+				position = fmt.Sprintf("%d", entry.Start.AsU64())
+				size = fmt.Sprintf("%d", entry.Record.ExternalSize())
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", position, size, row.kind, row.id, row.portion, row.embedded, row.extra)
+		}
+	}
+	return w.Flush()
+}
+
+func journalRowsContain(rows []journalRow, id string) bool {
+	for _, row := range rows {
+		if row.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func printTop(path string, snapshot storage.StatsSnapshot, prev storage.StatsSnapshot, elapsed time.Duration) {
+	usage := snapshot.Usage
+	//move the cursor home and clear the screen
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("cannyls %s, usage at %s\n\n", path, snapshot.UpdatedAt.Format(time.RFC3339))
+	fmt.Printf("lumps          %d, embedded %d bytes\n", usage.FileCounts, usage.EmbeddedBytes)
+	fmt.Printf("data region    %d / %d bytes used, %.1f%%\n", usage.AllocatedBytes, usage.DataCapacity,
+		percent(usage.AllocatedBytes, usage.DataCapacity))
+	fmt.Printf("largest free   %d bytes, fragmentation %.2f\n", usage.LargestFreeBytes, usage.Fragmentation)
+	fmt.Printf("journal        %d / %d bytes, %.1f%%\n", usage.JournalUsage, usage.JournalCapacity,
+		percent(usage.JournalUsage, usage.JournalCapacity))
+	fmt.Printf("journal syncs  %d, gc %d, throttled %d (%d rejected, %v)\n\n", snapshot.JournalSyncs, snapshot.JournalGCs,
+		snapshot.JournalThrottles, snapshot.JournalThrottleRejections, time.Duration(snapshot.JournalThrottleNanoseconds))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OP\tTOTAL\tFAILURES\tOPS/S\tAVG LATENCY")
+	for _, op := range []string{storage.OP_GET, storage.OP_PUT, storage.OP_PUT_EMBED, storage.OP_DELETE} {
+		stats := snapshot.Ops[op]
+		var rate float64
+		if elapsed > 0 {
+			rate = float64(stats.Count-prev.Ops[op].Count) / elapsed.Seconds()
+		}
+		var avg time.Duration
+		if stats.Count > 0 {
+			avg = time.Duration(stats.TotalNanoseconds / stats.Count)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%v\n", op, stats.Count, stats.Failures, rate, avg)
+	}
+	w.Flush()
+}
+
+func percent(n uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+func topCannyls(c *cli.Context) (err error) {
+	path := c.String("storage")
+	if path == "" {
+		path = c.Args().First()
+	}
+	socket := c.String("socket")
+	if socket == "" {
+		if path == "" {
+			return errors.New("argu storage or socket is empty")
+		}
+		socket = path + ".stats"
+	}
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	var prev storage.StatsSnapshot
+	var prevTime time.Time
+	for i := 0; c.Int("count") == 0 || i < c.Int("count"); i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		snapshot, err := storage.ReadStats(socket)
+		if err != nil {
+			return fmt.Errorf("failed to read stats from %s, is the storage opened with EnableStats? %v", socket, err)
+		}
+		now := time.Now()
+		var elapsed time.Duration
+		if !prevTime.IsZero() {
+			elapsed = now.Sub(prevTime)
+		}
+		printTop(path, snapshot, prev, elapsed)
+		prev, prevTime = snapshot, now
+	}
+	return nil
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "cannyls"
+	app.Usage = "dump, restore, verify and inspect a cannyls storage"
+	app.Commands = []cli.Command{
+		{
+			Name:  "dump",
+			Usage: "dump --storage path [--output file] [--format tar|jsonl]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				cli.StringFlag{Name: "output", Value: "-"},
+				cli.StringFlag{Name: "format", Value: FORMAT_TAR},
+			},
+			Action: dumpCannyls,
+		},
+		{
+			Name:  "restore",
+			Usage: "restore --storage path [--capacity size] [--block-size size] [--input file] [--format tar|jsonl]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				//create a new storage if capacity is not 0
+				cli.Uint64Flag{Name: "capacity"},
+				//the block size of the new storage, a power of two such as 4096
+				cli.Uint64Flag{Name: "block-size"},
+				cli.Float64Flag{Name: "journal-ratio", Value: 0.01},
+				cli.StringFlag{Name: "input", Value: "-"},
+				cli.StringFlag{Name: "format", Value: FORMAT_TAR},
+			},
+			Action: restoreCannyls,
+		},
+		{
+			Name:  "fsck",
+			Usage: "fsck --storage path [--deep] [--repair]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				//read the whole lumps to verify the checksums
+				cli.BoolFlag{Name: "deep"},
+				//delete the broken lumps and rebuild the allocator
+				cli.BoolFlag{Name: "repair"},
+			},
+			Action: fsckCannyls,
+		},
+		{
+			Name:  "journal-dump",
+			Usage: "journal-dump --storage path [--lump id]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				//only the records of the lump(in hex) are shown
+				cli.StringFlag{Name: "lump"},
+			},
+			Action: journalDumpCannyls,
+		},
+		{
+			Name:  "top",
+			Usage: "top <path> [--socket path.stats] [--interval 1s] [--count n]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				//the stats socket of the running storage, it is <path>.stats by default
+				cli.StringFlag{Name: "socket"},
+				cli.DurationFlag{Name: "interval", Value: time.Second},
+				//exit after count refreshes, 0 means never
+				cli.IntFlag{Name: "count"},
+			},
+			Action: topCannyls,
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage"
+)
+
+func lumpid(s string) lump.LumpId {
+	l, _ := lump.FromString(s)
+	return l
+}
+
+func lumpData(size int, seed byte) lump.LumpData {
+	data := lump.NewLumpDataAligned(size, block.Min())
+	for i := range data.AsBytes() {
+		data.AsBytes()[i] = byte(i) + seed
+	}
+	return data
+}
+
+func TestDumpAndRestore(t *testing.T) {
+	store, err := storage.CreateCannylsStorage("tmp1.lusf", 128*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp1.lusf")
+	defer store.Close()
+
+	_, err = store.Put(lumpid("0000"), lumpData(3000, 0))
+	assert.Nil(t, err)
+	_, err = store.PutEmbed(lumpid("0001"), []byte("foo"))
+	assert.Nil(t, err)
+	_, err = store.PutWithTag(lumpid("0002"), lumpData(3000, 2), []byte("meta"), "a")
+	assert.Nil(t, err)
+	_, err = store.PutEmbedWithTag(lumpid("0003"), []byte("bar"), nil, "b")
+	assert.Nil(t, err)
+	_, err = store.PutWithTTL(lumpid("0004"), lumpData(3000, 4), time.Hour)
+	assert.Nil(t, err)
+	_, err = store.PutWithTTL(lumpid("0005"), lumpData(3000, 5), time.Second)
+	assert.Nil(t, err)
+	//a lump larger than a portion is stored in extents
+	large := lumpData(lump.LUMP_MAX_SIZE+5000, 6)
+	_, err = store.Put(lumpid("0006"), large)
+	assert.Nil(t, err)
+	expireAt, _ := store.ExpireAt(lumpid("0004"))
+
+	for _, format := range []string{FORMAT_TAR, FORMAT_JSONL} {
+		buf := new(bytes.Buffer)
+		w, err := newLumpWriter(format, buf)
+		assert.Nil(t, err)
+		//0005 is expired
+		now := time.Now().Add(time.Minute)
+		count, _, err := dump(store, w, now)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Close())
+		assert.Equal(t, uint64(6), count, format)
+
+		restored, err := storage.CreateCannylsStorage("tmp2.lusf", 128*1024*1024, 0.01)
+		assert.Nil(t, err)
+		r, err := newLumpReader(format, bytes.NewReader(buf.Bytes()))
+		assert.Nil(t, err)
+		count, _, err = restore(restored, r)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(6), count, format)
+		assert.Equal(t, []lump.LumpId{lumpid("0000"), lumpid("0001"), lumpid("0002"), lumpid("0003"),
+			lumpid("0004"), lumpid("0006")}, restored.List())
+
+		data, err := restored.Get(lumpid("0000"))
+		assert.Nil(t, err)
+		assert.Equal(t, lumpData(3000, 0).AsBytes(), data)
+		data, err = restored.Get(lumpid("0002"))
+		assert.Nil(t, err)
+		assert.Equal(t, lumpData(3000, 2).AsBytes(), data)
+		metadata, err := restored.GetMetadata(lumpid("0002"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("meta"), metadata)
+		tag, err := restored.GetTag(lumpid("0002"))
+		assert.Nil(t, err)
+		assert.Equal(t, "a", tag)
+
+		//the embedded lumps are embedded again
+		for id, expected := range map[string]string{"0001": "foo", "0003": "bar"} {
+			data, err = restored.Get(lumpid(id))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(expected), data)
+			stat, err := restored.Stat(lumpid(id))
+			assert.Nil(t, err)
+			assert.True(t, stat.Embedded)
+		}
+		tag, err = restored.GetTag(lumpid("0003"))
+		assert.Nil(t, err)
+		assert.Equal(t, "b", tag)
+
+		restoredExpireAt, ok := restored.ExpireAt(lumpid("0004"))
+		assert.True(t, ok)
+		assert.True(t, !restoredExpireAt.Before(expireAt) && restoredExpireAt.Sub(expireAt) <= time.Second)
+		data, err = restored.Get(lumpid("0006"))
+		assert.Nil(t, err)
+		assert.Equal(t, large.AsBytes(), data)
+
+		assert.Nil(t, restored.Close())
+		os.Remove("tmp2.lusf")
+	}
+}
+
+func TestRestoreInvalidStream(t *testing.T) {
+	store, err := storage.CreateCannylsStorage("tmp3.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp3.lusf")
+	defer store.Close()
+
+	_, err = newLumpReader("zip", bytes.NewReader(nil))
+	assert.Error(t, err)
+	for _, format := range []string{FORMAT_TAR, FORMAT_JSONL} {
+		r, err := newLumpReader(format, bytes.NewReader([]byte("{\"id\": \"xyz\"}\n")))
+		assert.Nil(t, err)
+		_, _, err = restore(store, r)
+		assert.Error(t, err, format)
+	}
+}
@@ -19,10 +19,20 @@ import (
 
 func createCannyls(c *cli.Context) error {
 	path := c.String("storage")
-	capactiyBytes := c.Uint64("capacity")
-	capactiyBytes = block.Min().CeilAlign(capactiyBytes)
+	options := storage.DefaultStorageOptions()
+	blockSize, err := block.ParseBlockSize(c.Uint64("block-size"))
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		return err
+	}
+	options.File.BlockSize = blockSize
+	align := block.Min()
+	if blockSize != 0 {
+		align = blockSize
+	}
+	capactiyBytes := align.CeilAlign(c.Uint64("capacity"))
 	fmt.Printf("Creating cannyls <%s>, capacity is <%d>\n", path, capactiyBytes)
-	store, err := storage.CreateCannylsStorage(path, capactiyBytes, 0.01)
+	store, err := storage.CreateCannylsStorageWithOptions(path, capactiyBytes, 0.01, options)
 	if err != nil {
 		fmt.Printf("%+v\n", err)
 		return err
@@ -46,6 +56,10 @@ func printUsage(usage storage.StorageUsage) {
 	fmt.Printf("Min index %d \n", usage.MinIndex)
 	fmt.Printf("Max index %d \n", usage.MaxIndex)
 	fmt.Printf("Free Bytes %s \n", humanize.Bytes(usage.FreeBytes))
+	fmt.Printf("Largest Free %s \n", humanize.Bytes(usage.LargestFreeBytes))
+	fmt.Printf("Fragmentation %.2f \n", usage.Fragmentation)
+	fmt.Printf("Journal Usage %s \n", humanize.Bytes(usage.JournalUsage))
+	fmt.Printf("Embedded Bytes %s \n", humanize.Bytes(usage.EmbeddedBytes))
 	fmt.Printf("Raw Size   %s \n", humanize.Bytes(usage.CurrentFileSize))
 }
 
@@ -123,7 +137,9 @@ func journalGCCannyls(c *cli.Context) (err error) {
 	}
 	defer store.Close()
 
-	store.JournalGC()
+	if err = store.JournalGC(); err != nil {
+		return
+	}
 	fmt.Println("Journal Full GC completed")
 	return
 }
@@ -196,7 +212,9 @@ func benchCannyls(c *cli.Context, read bool) (err error) {
 			}
 		}
 		if sync {
-			store.JournalSync()
+			if err = store.JournalSync(); err != nil {
+				return
+			}
 		}
 
 		if read {
@@ -315,6 +333,43 @@ func readUpData(r io.Reader, lumpdata lump.LumpData) error {
 	}
 }
 
+func resizeJournalCannyls(c *cli.Context) (err error) {
+	path := c.String("storage")
+	size := block.Min().CeilAlign(c.Uint64("size"))
+	fmt.Printf("Resizing the journal region of <%s> to <%d>\n", path, size)
+	if err = storage.ResizeJournal(path, size); err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return
+}
+
+//migrateCannyls copies the lumps into a storage created by Create, such as one with another block size,
+//run it again to resume an interrupted migration
+func migrateCannyls(c *cli.Context) (err error) {
+	src, err := storage.OpenCannylsStorage(c.String("storage"))
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		return err
+	}
+	defer src.Close()
+	dst, err := storage.OpenCannylsStorage(c.String("dest"))
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		return err
+	}
+	defer dst.Close()
+	opts := storage.DefaultMigrateOptions()
+	opts.OnProgress = func(progress storage.MigrateProgress) error {
+		fmt.Printf("%d/%d lumps are migrated, %s, last lump is %s\n", progress.Skipped+progress.Migrated,
+			progress.Total, humanize.Bytes(progress.Bytes), progress.Last.String())
+		return nil
+	}
+	if _, err = storage.Migrate(src, dst, opts); err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return
+}
+
 func main() {
 
 	app := cli.NewApp()
@@ -323,10 +378,12 @@ func main() {
 	app.Commands = []cli.Command{
 		{
 			Name:  "Create",
-			Usage: "Create --storage <path> --capacity <size>",
+			Usage: "Create --storage <path> --capacity <size> [--block-size <size>]",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "storage"},
 				cli.Uint64Flag{Name: "capacity"},
+				//a power of two, such as 4096, the sector size by default
+				cli.Uint64Flag{Name: "block-size"},
 			},
 			Action: createCannyls,
 		},
@@ -382,6 +439,24 @@ func main() {
 			},
 			Action: journalGCCannyls,
 		},
+		{
+			Name:  "ResizeJournal",
+			Usage: "ResizeJournal --storage path --size <size>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				cli.Uint64Flag{Name: "size"},
+			},
+			Action: resizeJournalCannyls,
+		},
+		{
+			Name:  "Migrate",
+			Usage: "Migrate --storage path --dest path",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "storage"},
+				cli.StringFlag{Name: "dest"},
+			},
+			Action: migrateCannyls,
+		},
 		{
 			Name:  "Header",
 			Usage: "Header --storage path --replay <true> ",
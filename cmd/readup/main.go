@@ -165,7 +165,9 @@ func handlePutRequest(store *storage.Storage, request PutRequest) {
 	if err != nil {
 		response.err = err
 	}
-	store.JournalSync()
+	if err = store.JournalSync(); err != nil && response.err == nil {
+		response.err = err
+	}
 
 	select {
 	//timeout
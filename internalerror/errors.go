@@ -2,11 +2,14 @@ package internalerror
 
 import (
 	"errors"
+	"fmt"
+	"reflect"
 )
 
 var (
 	DeviceBusy         = errors.New("Device is busy")
 	DeviceTerminated   = errors.New("Device is terminated")
+	DeviceError        = errors.New("Device error")
 	StorageFull        = errors.New("Storage is full")
 	JournalStorageFull = errors.New("Journal is full")
 	StorageCorrupted   = errors.New("Storage is corrupted")
@@ -14,4 +17,100 @@ var (
 	InconsistentState  = errors.New("Inconsistent state")
 	Other              = errors.New("Unknow error")
 	NoEntries          = errors.New("NoEntries")
+	ReadOnly           = errors.New("Storage is read only")
+	QuotaExceeded      = errors.New("Quota is exceeded")
 )
+
+var (
+	//NoFreeSpace is returned if the data region has no free portion large enough
+	NoFreeSpace = StorageFull
+	//JournalFull is returned if the journal region has no room for a record
+	JournalFull = JournalStorageFull
+)
+
+/*
+IOError is a failed read, write or sync of the underlying device. It matches DeviceError for Is,
+and errors.Cause of it is DeviceError, so it is handled like the other sentinels.
+The error from the os is kept in Err.
+*/
+type IOError struct {
+	Op  string
+	Err error
+}
+
+//NewIOError returns nil if err is nil
+func NewIOError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &IOError{Op: op, Err: err}
+}
+
+func (e *IOError) Error() string {
+	return fmt.Sprintf("device failed to %s: %v", e.Op, e.Err)
+}
+
+//Cause returns DeviceError
+func (e *IOError) Cause() error {
+	return DeviceError
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+func (e *IOError) Is(target error) bool {
+	return target == DeviceError
+}
+
+/*
+Is reports whether err or any error it wraps is target, like errors.Is of the standard library.
+The errors are unwrapped by Unwrap, or by Cause as github.com/pkg/errors does, so it works for
+the errors wrapped by both of them. Callers should use it instead of comparing the messages.
+*/
+func Is(err, target error) bool {
+	for ; err != nil; err = next(err) {
+		if err == target {
+			return true
+		}
+		if e, ok := err.(interface{ Is(error) bool }); ok && e.Is(target) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+As finds the first error in the chain of err which is assignable to the value pointed by target,
+and sets target to it, like errors.As of the standard library. The chain is walked as Is does.
+*/
+func As(err error, target interface{}) bool {
+	value := reflect.ValueOf(target)
+	if target == nil || value.Kind() != reflect.Ptr || value.IsNil() {
+		panic("internalerror: target must be a non-nil pointer")
+	}
+	targetType := value.Type().Elem()
+	for ; err != nil; err = next(err) {
+		if reflect.TypeOf(err).AssignableTo(targetType) {
+			value.Elem().Set(reflect.ValueOf(err))
+			return true
+		}
+		if e, ok := err.(interface{ As(interface{}) bool }); ok && e.As(target) {
+			return true
+		}
+	}
+	return false
+}
+
+//next prefers Unwrap to Cause, because Cause could skip the errors in between
+func next(err error) error {
+	if e, ok := err.(interface{ Unwrap() error }); ok {
+		return e.Unwrap()
+	}
+	if e, ok := err.(interface{ Cause() error }); ok {
+		if cause := e.Cause(); cause != err {
+			return cause
+		}
+	}
+	return nil
+}
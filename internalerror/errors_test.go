@@ -2,8 +2,12 @@ package internalerror
 
 
 import (
-	"testing"
 	"fmt"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 )
 
 
@@ -11,3 +15,21 @@ func TestErrorCode(t *testing.T) {
 	var err error = DeviceBusy;
 	fmt.Printf("%s\n", err.Error())
 }
+
+func TestErrorIsAs(t *testing.T) {
+	err := errors.Wrapf(NoFreeSpace, "failed to alloc %d blocks", 10)
+	assert.True(t, Is(err, StorageFull))
+	assert.False(t, Is(err, JournalFull))
+	assert.False(t, Is(nil, StorageFull))
+
+	ioErr := NewIOError("write", os.ErrClosed)
+	err = errors.Wrap(ioErr, "FileNVM failed to write")
+	assert.True(t, Is(err, DeviceError))
+	assert.True(t, Is(err, os.ErrClosed))
+	assert.Equal(t, DeviceError, errors.Cause(err))
+	var target *IOError
+	assert.True(t, As(err, &target))
+	assert.Equal(t, ioErr, target)
+	assert.False(t, As(errors.Wrap(InvalidInput, "bad"), &target))
+	assert.Nil(t, NewIOError("sync", nil))
+}
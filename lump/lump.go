@@ -1,6 +1,7 @@
 package lump
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"io"
 	"math"
@@ -77,6 +78,13 @@ func EmptyLump() LumpId {
 const (
 	LUMP_MAX_SIZE     = 0xFFFF*(512) - 2
 	MAX_EMBEDDED_SIZE = 0xFFFF
+	MAX_METADATA_SIZE = 0xFF
+	MAX_TAG_SIZE      = 0xFF
+	//a lump larger than a data portion is split into the extents of 0xFFFE blocks of data, there
+	//are at most MAX_LUMP_EXTENTS of them at 512B blocks, so its size and the size on disk still
+	//fit in 32 bits
+	MAX_LUMP_EXTENTS    = 128
+	LARGE_LUMP_MAX_SIZE = 0xFFFE * 512 * MAX_LUMP_EXTENTS
 )
 
 type LumpDataInner int
@@ -99,7 +107,7 @@ type LumpEmbededData struct {
 //TODO, to be aligned at upper
 func NewLumpDataAligned(size int, blockSize block.BlockSize) LumpData {
 
-	if size > LUMP_MAX_SIZE {
+	if size > LARGE_LUMP_MAX_SIZE {
 		return LumpData{
 			Inner: nil,
 		}
@@ -119,3 +127,11 @@ func NewLumpDataWithAb(ab *block.AlignedBytes) LumpData {
 func (l LumpData) AsBytes() []byte {
 	return l.Inner.AsBytes()
 }
+
+//ContentHash is the sha256 of the lump data, the lumps with the same ContentHash share
+//one DataPortion in the content addressed mode, see Storage.SetDedup
+type ContentHash [sha256.Size]byte
+
+func HashContent(data []byte) ContentHash {
+	return sha256.Sum256(data)
+}
@@ -0,0 +1,146 @@
+package lump
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+/*
+IdLayout packs a namespace, a key and a sub id into a LumpId, from the high bits to the low bits:
+
+	| namespace (NamespaceBits) | key (the rest bits) | sub (SubBits) |
+
+so the lumps of a namespace, or the subs of a key, are adjacent in the index, and could be
+listed by Storage.ListPrefix or Storage.ListRange.
+A LumpId of cannyls-go has 64 bits instead of the 128 bits of cannyls, so the parts could not
+have their full widths, the layout chooses them, and Compose fails if a part does not fit.
+*/
+type IdLayout struct {
+	NamespaceBits uint
+	SubBits       uint
+}
+
+//DefaultIdLayout has 65536 namespaces, 2^32 keys in a namespace and 65536 subs of a key
+func DefaultIdLayout() IdLayout {
+	return IdLayout{NamespaceBits: 16, SubBits: 16}
+}
+
+func NewIdLayout(namespaceBits uint, subBits uint) (IdLayout, error) {
+	layout := IdLayout{NamespaceBits: namespaceBits, SubBits: subBits}
+	if err := layout.validate(); err != nil {
+		return IdLayout{}, err
+	}
+	return layout, nil
+}
+
+func (layout IdLayout) validate() error {
+	if layout.NamespaceBits > 32 || layout.SubBits > 32 || layout.NamespaceBits+layout.SubBits > 64 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid layout of %d namespace bits and %d sub bits",
+			layout.NamespaceBits, layout.SubBits)
+	}
+	return nil
+}
+
+func (layout IdLayout) KeyBits() uint {
+	return 64 - layout.NamespaceBits - layout.SubBits
+}
+
+//fits returns true if v has at most bits bits
+func fits(v uint64, bits uint) bool {
+	return bits >= 64 || v>>bits == 0
+}
+
+//shift moves v to the high bits of the bits after the skipped high bits, it is 0 if bits is 0
+func shift(v uint64, skip uint, bits uint) uint64 {
+	if bits == 0 {
+		return 0
+	}
+	return v << (64 - skip - bits)
+}
+
+func mask(bits uint) uint64 {
+	if bits >= 64 {
+		return math.MaxUint64
+	}
+	return 1<<bits - 1
+}
+
+func (layout IdLayout) Compose(namespace uint32, key uint64, sub uint32) (LumpId, error) {
+	if err := layout.validate(); err != nil {
+		return LumpId{}, err
+	}
+	if !fits(uint64(namespace), layout.NamespaceBits) || !fits(key, layout.KeyBits()) || !fits(uint64(sub), layout.SubBits) {
+		return LumpId{}, errors.Wrapf(internalerror.InvalidInput, "namespace %d, key %d or sub %d does not fit %d/%d/%d bits",
+			namespace, key, sub, layout.NamespaceBits, layout.KeyBits(), layout.SubBits)
+	}
+	n := shift(uint64(namespace), 0, layout.NamespaceBits) |
+		shift(key, layout.NamespaceBits, layout.KeyBits()) |
+		uint64(sub)
+	return FromU64(0, n), nil
+}
+
+func (layout IdLayout) Decompose(id LumpId) (namespace uint32, key uint64, sub uint32) {
+	n := id.U64()
+	if layout.NamespaceBits > 0 {
+		namespace = uint32(n >> (64 - layout.NamespaceBits))
+	}
+	if layout.KeyBits() > 0 {
+		key = n >> layout.SubBits & mask(layout.KeyBits())
+	}
+	sub = uint32(n & mask(layout.SubBits))
+	return
+}
+
+/*
+NamespacePrefix returns the prefix and the bits of the lumps in the namespace, they are the
+arguments of Storage.ListPrefix
+*/
+func (layout IdLayout) NamespacePrefix(namespace uint32) (prefix LumpId, bits uint, err error) {
+	if prefix, err = layout.Compose(namespace, 0, 0); err != nil {
+		return
+	}
+	return prefix, layout.NamespaceBits, nil
+}
+
+//KeyPrefix returns the prefix and the bits of all the subs of the key
+func (layout IdLayout) KeyPrefix(namespace uint32, key uint64) (prefix LumpId, bits uint, err error) {
+	if prefix, err = layout.Compose(namespace, key, 0); err != nil {
+		return
+	}
+	return prefix, layout.NamespaceBits + layout.KeyBits(), nil
+}
+
+//NamespaceBounds returns the first and the last lumpid of the namespace, see PrefixBounds
+func (layout IdLayout) NamespaceBounds(namespace uint32) (first LumpId, last LumpId, err error) {
+	prefix, bits, err := layout.NamespacePrefix(namespace)
+	if err != nil {
+		return
+	}
+	first, last = PrefixBounds(prefix, bits)
+	return
+}
+
+//KeyBounds returns the first and the last sub of the key, see PrefixBounds
+func (layout IdLayout) KeyBounds(namespace uint32, key uint64) (first LumpId, last LumpId, err error) {
+	prefix, bits, err := layout.KeyPrefix(namespace, key)
+	if err != nil {
+		return
+	}
+	first, last = PrefixBounds(prefix, bits)
+	return
+}
+
+/*
+PrefixBounds returns the smallest and the biggest lumpids whose high bits are the same as prefix.
+Both are included, the range of Storage.ListRange is [first, last.Inc()), unless last.IsMax(),
+whose range could not be represented, list it by Storage.ListPrefix
+*/
+func PrefixBounds(prefix LumpId, bits uint) (first LumpId, last LumpId) {
+	if bits > 64 {
+		bits = 64
+	}
+	low := mask(64 - bits)
+	return FromU64(0, prefix.U64()&^low), FromU64(0, prefix.U64()|low)
+}
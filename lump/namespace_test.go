@@ -0,0 +1,78 @@
+package lump
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdLayoutCompose(t *testing.T) {
+	layout := DefaultIdLayout()
+	assert.Equal(t, uint(32), layout.KeyBits())
+
+	id, err := layout.Compose(0x12, 0x3456789a, 0xbc)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0x00123456789a00bc), id.U64())
+	namespace, key, sub := layout.Decompose(id)
+	assert.Equal(t, uint32(0x12), namespace)
+	assert.Equal(t, uint64(0x3456789a), key)
+	assert.Equal(t, uint32(0xbc), sub)
+
+	_, err = layout.Compose(0x10000, 0, 0)
+	assert.Error(t, err)
+	_, err = layout.Compose(0, 0x100000000, 0)
+	assert.Error(t, err)
+	_, err = layout.Compose(0, 0, 0x10000)
+	assert.Error(t, err)
+
+	//the key takes all the bits
+	layout, err = NewIdLayout(0, 0)
+	assert.Nil(t, err)
+	id, err = layout.Compose(0, math.MaxUint64, 0)
+	assert.Nil(t, err)
+	assert.True(t, id.IsMax())
+	_, key, _ = layout.Decompose(id)
+	assert.Equal(t, uint64(math.MaxUint64), key)
+
+	layout, err = NewIdLayout(32, 32)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), layout.KeyBits())
+	id, err = layout.Compose(1, 0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1<<32|2), id.U64())
+
+	_, err = NewIdLayout(33, 0)
+	assert.Error(t, err)
+}
+
+func TestIdLayoutBounds(t *testing.T) {
+	layout := DefaultIdLayout()
+	prefix, bits, err := layout.NamespacePrefix(7)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(16), bits)
+	assert.Equal(t, uint64(7)<<48, prefix.U64())
+
+	first, last, err := layout.NamespaceBounds(7)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7)<<48, first.U64())
+	assert.Equal(t, uint64(8)<<48-1, last.U64())
+	assert.Equal(t, uint64(8)<<48, last.Inc().U64())
+
+	first, last, err = layout.KeyBounds(7, 9)
+	assert.Nil(t, err)
+	namespace, key, sub := layout.Decompose(first)
+	assert.Equal(t, []uint64{7, 9, 0}, []uint64{uint64(namespace), key, uint64(sub)})
+	namespace, key, sub = layout.Decompose(last)
+	assert.Equal(t, []uint64{7, 9, 0xffff}, []uint64{uint64(namespace), key, uint64(sub)})
+
+	_, last, err = layout.NamespaceBounds(0xffff)
+	assert.Nil(t, err)
+	assert.True(t, last.IsMax())
+
+	first, last = PrefixBounds(FromU64(0, 5), 0)
+	assert.Equal(t, uint64(0), first.U64())
+	assert.True(t, last.IsMax())
+	first, last = PrefixBounds(FromU64(0, 5), 64)
+	assert.Equal(t, first, last)
+}
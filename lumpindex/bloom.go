@@ -0,0 +1,180 @@
+package lumpindex
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+const (
+	//the filter is sized for at least BLOOM_MIN_CAPACITY lumps, so a small index is not rebuilt often
+	BLOOM_MIN_CAPACITY = 1024
+	BLOOM_MAX_HASHES   = 16
+)
+
+/*
+bloomFilter answers that a lumpid is surely not in the index without searching the tree.
+A deleted lumpid could not be removed from the bits, it is counted in stale, and the filter
+is rebuilt from the tree when there are more stale lumpids than the lumps, or when there are
+more lumps than capacity, so the false positive rate keeps near rate.
+*/
+type bloomFilter struct {
+	rate     float64
+	capacity uint64
+	bits     []uint64
+	hashes   uint64
+	stale    uint64
+	//the lookups answered by the filter, and the lookups which passed it but missed the tree
+	skipped        uint64
+	falsePositives uint64
+}
+
+//BloomStats is the statistics of the bloom filter of the index, see EnableBloomFilter
+type BloomStats struct {
+	Skipped        uint64
+	FalsePositives uint64
+	MemoryUsed     uint64
+}
+
+func newBloomFilter(rate float64, capacity uint64) *bloomFilter {
+	if capacity < BLOOM_MIN_CAPACITY {
+		capacity = BLOOM_MIN_CAPACITY
+	}
+	//m = -n * ln(p) / ln(2)^2, k = m / n * ln(2)
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	words := (m + 63) / 64
+	hashes := uint64(math.Round(float64(words*64) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	} else if hashes > BLOOM_MAX_HASHES {
+		hashes = BLOOM_MAX_HASHES
+	}
+	return &bloomFilter{
+		rate:     rate,
+		capacity: capacity,
+		bits:     make([]uint64, words),
+		hashes:   hashes,
+	}
+}
+
+//mix is the finalizer of splitmix64, the lumpids are often sequential
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+//positions calls f with the bit of each hash, by the double hashing h1 + i * h2
+func (bloom *bloomFilter) positions(k uint64, f func(word uint64, bit uint64) bool) {
+	h1 := mix(k)
+	h2 := mix(h1) | 1
+	m := uint64(len(bloom.bits)) * 64
+	for i := uint64(0); i < bloom.hashes; i++ {
+		p := (h1 + i*h2) % m
+		if !f(p/64, 1<<(p%64)) {
+			return
+		}
+	}
+}
+
+func (bloom *bloomFilter) add(k uint64) {
+	bloom.positions(k, func(word uint64, bit uint64) bool {
+		bloom.bits[word] |= bit
+		return true
+	})
+}
+
+func (bloom *bloomFilter) mayContain(k uint64) bool {
+	contains := true
+	bloom.positions(k, func(word uint64, bit uint64) bool {
+		contains = bloom.bits[word]&bit != 0
+		return contains
+	})
+	return contains
+}
+
+func (bloom *bloomFilter) memoryUsed() uint64 {
+	return uint64(len(bloom.bits)) * 8
+}
+
+/*
+EnableBloomFilter builds a bloom filter of the lumpids in the index, Get and Delete of an absent
+lump return without searching the tree unless it is a false positive, whose rate is about
+falsePositiveRate. The filter takes about -1.44 * log2(falsePositiveRate) bits per lump,
+10 bits for 1%.
+*/
+func (index *LumpIndex) EnableBloomFilter(falsePositiveRate float64) error {
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid false positive rate %f", falsePositiveRate)
+	}
+	index.bloom = newBloomFilter(falsePositiveRate, 0)
+	index.rebuildBloom()
+	return nil
+}
+
+//BloomStats returns the statistics of the bloom filter, ok is false if it is not enabled
+func (index *LumpIndex) BloomStats() (stats BloomStats, ok bool) {
+	if index.bloom == nil {
+		return BloomStats{}, false
+	}
+	return BloomStats{
+		Skipped:        index.bloom.skipped,
+		FalsePositives: index.bloom.falsePositives,
+		MemoryUsed:     index.bloom.memoryUsed(),
+	}, true
+}
+
+//rebuildBloom sizes the filter for twice the lumps, and adds all the lumpids of the tree
+func (index *LumpIndex) rebuildBloom() {
+	old := index.bloom
+	index.bloom = newBloomFilter(old.rate, 2*index.tree.CountAll())
+	index.bloom.skipped, index.bloom.falsePositives = old.skipped, old.falsePositives
+	k, _, ok := index.tree.First(0)
+	for ok {
+		index.bloom.add(k)
+		k, _, ok = index.tree.Next(k)
+	}
+}
+
+//absent returns true if the bloom filter is sure that id is not in the tree
+func (index *LumpIndex) absent(id uint64) bool {
+	if index.bloom == nil {
+		return false
+	}
+	if !index.bloom.mayContain(id) {
+		index.bloom.skipped++
+		return true
+	}
+	return false
+}
+
+//missed is called when the lookup of id passed the bloom filter but id is not in the tree
+func (index *LumpIndex) missed() {
+	if index.bloom != nil {
+		index.bloom.falsePositives++
+	}
+}
+
+func (index *LumpIndex) bloomInserted(id uint64) {
+	if index.bloom == nil {
+		return
+	}
+	index.bloom.add(id)
+	if index.tree.CountAll() > index.bloom.capacity {
+		index.rebuildBloom()
+	}
+}
+
+func (index *LumpIndex) bloomDeleted() {
+	if index.bloom == nil {
+		return
+	}
+	index.bloom.stale++
+	if index.bloom.stale > index.tree.CountAll() && index.bloom.stale > BLOOM_MIN_CAPACITY/2 {
+		index.rebuildBloom()
+	}
+}
@@ -0,0 +1,57 @@
+package lumpindex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func TestLumpIndexBloomFilter(t *testing.T) {
+	index := NewIndex()
+	assert.Error(t, index.EnableBloomFilter(0))
+	assert.Error(t, index.EnableBloomFilter(1))
+	_, ok := index.BloomStats()
+	assert.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		index.InsertJournalPortion(lump.FromU64(0, uint64(i)), portion.NewJournalPortion(uint64(i), 10))
+	}
+	assert.Nil(t, index.EnableBloomFilter(0.01))
+	//the filter grows with the index
+	for i := 100; i < 10000; i++ {
+		index.InsertJournalPortion(lump.FromU64(0, uint64(i)), portion.NewJournalPortion(uint64(i), 10))
+	}
+	for i := 0; i < 10000; i++ {
+		_, err := index.Get(lump.FromU64(0, uint64(i)))
+		assert.Nil(t, err)
+	}
+	for i := 10000; i < 20000; i++ {
+		_, err := index.Get(lump.FromU64(0, uint64(i)))
+		assert.Error(t, err)
+	}
+	stats, ok := index.BloomStats()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10000), stats.Skipped+stats.FalsePositives)
+	assert.True(t, stats.FalsePositives < 300)
+	assert.True(t, stats.MemoryUsed > 0)
+
+	//the deleted lumps are not found after the filter is rebuilt
+	for i := 0; i < 9000; i++ {
+		assert.True(t, index.Delete(lump.FromU64(0, uint64(i))))
+	}
+	assert.False(t, index.Delete(lump.FromU64(0, 1)))
+	index.DeleteRange(lump.FromU64(0, 9000), lump.FromU64(0, 9500))
+	assert.Equal(t, uint64(500), index.Count())
+	for i := 0; i < 9500; i++ {
+		_, err := index.Get(lump.FromU64(0, uint64(i)))
+		assert.Error(t, err)
+	}
+	for i := 9500; i < 10000; i++ {
+		_, err := index.Get(lump.FromU64(0, uint64(i)))
+		assert.Nil(t, err)
+	}
+	stats, _ = index.BloomStats()
+	assert.True(t, stats.Skipped > 18000)
+}
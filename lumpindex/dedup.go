@@ -0,0 +1,95 @@
+package lumpindex
+
+import (
+	"sort"
+
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+The lumps put in the content addressed mode share a DataPortion with the other lumps of the same
+content hash. The number of the lumps referring a portion is its reference count, the portion is
+still used until it is 0, so it must not be released before, see Refs.
+*/
+
+type contentRef struct {
+	hash    lump.ContentHash
+	portion portion.DataPortion
+}
+
+//InsertDataPortionWithHash inserts the lump which shares the portion with the lumps of the same hash
+func (index *LumpIndex) InsertDataPortionWithHash(id lump.LumpId, data portion.DataPortion, hash lump.ContentHash) {
+	index.InsertDataPortion(id, data)
+	if index.hashes == nil {
+		index.hashes = make(map[uint64]contentRef)
+		index.sharers = make(map[portion.DataPortion]map[uint64]struct{})
+		index.contents = make(map[lump.ContentHash]portion.DataPortion)
+	}
+	index.hashes[id.U64()] = contentRef{hash: hash, portion: data}
+	ids, ok := index.sharers[data]
+	if !ok {
+		ids = make(map[uint64]struct{})
+		index.sharers[data] = ids
+	}
+	ids[id.U64()] = struct{}{}
+	//the portion put or moved last is shared by the following puts
+	index.contents[hash] = data
+}
+
+//ContentHash returns the content hash of the lump, ok is false if it is not put in the content addressed mode
+func (index *LumpIndex) ContentHash(id lump.LumpId) (hash lump.ContentHash, ok bool) {
+	if len(index.hashes) == 0 {
+		return hash, false
+	}
+	ref, ok := index.hashes[id.U64()]
+	return ref.hash, ok
+}
+
+//ContentPortion returns the portion of the lumps with the content hash, ok is false if there is none
+func (index *LumpIndex) ContentPortion(hash lump.ContentHash) (p portion.DataPortion, ok bool) {
+	if len(index.contents) == 0 {
+		return p, false
+	}
+	p, ok = index.contents[hash]
+	return
+}
+
+//Refs returns the number of the lumps sharing the portion, it is 0 if the portion is not shared
+func (index *LumpIndex) Refs(p portion.DataPortion) int {
+	return len(index.sharers[p])
+}
+
+//Sharers returns the lumps sharing the portion ordered by lumpid
+func (index *LumpIndex) Sharers(p portion.DataPortion) []lump.LumpId {
+	ids := index.sharers[p]
+	nums := make([]uint64, 0, len(ids))
+	for id := range ids {
+		nums = append(nums, id)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	vec := make([]lump.LumpId, len(nums))
+	for i, n := range nums {
+		vec[i] = lump.FromU64(0, n)
+	}
+	return vec
+}
+
+func (index *LumpIndex) clearHash(id uint64) {
+	if len(index.hashes) == 0 {
+		return
+	}
+	ref, ok := index.hashes[id]
+	if !ok {
+		return
+	}
+	delete(index.hashes, id)
+	if ids := index.sharers[ref.portion]; len(ids) > 1 {
+		delete(ids, id)
+		return
+	}
+	delete(index.sharers, ref.portion)
+	if index.contents[ref.hash] == ref.portion {
+		delete(index.contents, ref.hash)
+	}
+}
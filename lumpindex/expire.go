@@ -0,0 +1,82 @@
+package lumpindex
+
+import (
+	"github.com/google/btree"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+Only the lumps with TTL are in expires, they are ordered by the expire time in
+expireQueue, so the expired lumps are found without scanning the whole index
+*/
+type expireItem struct {
+	expireAt uint64
+	id       uint64
+}
+
+func (item expireItem) Less(than btree.Item) bool {
+	other := than.(expireItem)
+	if item.expireAt != other.expireAt {
+		return item.expireAt < other.expireAt
+	}
+	return item.id < other.id
+}
+
+func (index *LumpIndex) InsertDataPortionWithExpire(id lump.LumpId, data portion.DataPortion, expireAt uint64) {
+	index.InsertDataPortion(id, data)
+	index.setExpire(id.U64(), expireAt)
+}
+
+func (index *LumpIndex) setExpire(id uint64, expireAt uint64) {
+	if index.expires == nil {
+		index.expires = make(map[uint64]uint64)
+		index.expireQueue = btree.New(32)
+	}
+	index.expires[id] = expireAt
+	index.expireQueue.ReplaceOrInsert(expireItem{expireAt: expireAt, id: id})
+}
+
+//ExpireAt returns the expire time of the lump, ok is false if the lump has no TTL
+func (index *LumpIndex) ExpireAt(id lump.LumpId) (expireAt uint64, ok bool) {
+	if len(index.expires) == 0 {
+		return 0, false
+	}
+	expireAt, ok = index.expires[id.U64()]
+	return
+}
+
+//Expired returns at most max lumps which expire at or before now
+func (index *LumpIndex) Expired(now uint64, max int) []lump.LumpId {
+	vec := make([]lump.LumpId, 0)
+	if index.expireQueue == nil {
+		return vec
+	}
+	index.expireQueue.AscendLessThan(expireItem{expireAt: now + 1}, func(i btree.Item) bool {
+		if len(vec) >= max {
+			return false
+		}
+		vec = append(vec, lump.FromU64(0, i.(expireItem).id))
+		return true
+	})
+	return vec
+}
+
+//expiredAt returns true if the lump expires at or before now, nothing is expired if now is 0
+func (index *LumpIndex) expiredAt(id uint64, now uint64) bool {
+	if now == 0 || len(index.expires) == 0 {
+		return false
+	}
+	expireAt, ok := index.expires[id]
+	return ok && expireAt <= now
+}
+
+func (index *LumpIndex) clearExpire(id uint64) {
+	if len(index.expires) == 0 {
+		return
+	}
+	if expireAt, ok := index.expires[id]; ok {
+		delete(index.expires, id)
+		index.expireQueue.Delete(expireItem{expireAt: expireAt, id: id})
+	}
+}
@@ -0,0 +1,107 @@
+package lumpindex
+
+import (
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+A lump larger than the biggest DataPortion spans several portions, its extents. The first extent
+is in the tree as the portion of the lump, so Get returns it, and the whole list is kept here.
+The extents are returned by DataPortions and LumpDataPortions as the portions of the other lumps.
+*/
+
+//InsertDataExtents inserts the lump stored in the extents in order, there is at least one of them
+func (index *LumpIndex) InsertDataExtents(id lump.LumpId, extents []portion.DataPortion) {
+	index.InsertDataPortion(id, extents[0])
+	if len(extents) == 1 {
+		return
+	}
+	if index.extents == nil {
+		index.extents = make(map[uint64][]portion.DataPortion)
+	}
+	index.extents[id.U64()] = extents
+	if index.namespaces != nil {
+		for _, p := range extents[1:] {
+			index.namespaces.add(id.U64(), fromDataPortionToValue(p))
+		}
+	}
+}
+
+//InsertDataExtentsWithAttributes is the same as InsertDataExtents, the lump expires at expireAt
+//unless it is 0, and it has the metadata unless it is nil
+func (index *LumpIndex) InsertDataExtentsWithAttributes(id lump.LumpId, extents []portion.DataPortion, expireAt uint64, metadata []byte) {
+	index.InsertDataExtents(id, extents)
+	if expireAt != 0 {
+		index.setExpire(id.U64(), expireAt)
+	}
+	if metadata != nil {
+		index.setMetadata(id.U64(), metadata)
+	}
+}
+
+//Extents returns the extents of the lump, ok is false if the lump is not stored in several portions
+func (index *LumpIndex) Extents(id lump.LumpId) (extents []portion.DataPortion, ok bool) {
+	if len(index.extents) == 0 {
+		return nil, false
+	}
+	extents, ok = index.extents[id.U64()]
+	return
+}
+
+//HasDataPortion returns true if the portion or any extent of the lump is p
+func (index *LumpIndex) HasDataPortion(id lump.LumpId, p portion.DataPortion) bool {
+	v, ok := index.tree.Get(id.U64())
+	if !ok {
+		return false
+	}
+	current, isDataPortion := fromValueToPortion(v)
+	if !isDataPortion {
+		return false
+	}
+	if current.(portion.DataPortion) == p {
+		return true
+	}
+	extents, _ := index.Extents(id)
+	for _, extent := range extents {
+		if extent == p {
+			return true
+		}
+	}
+	return false
+}
+
+//appendExtents appends the extents of id after the first one to vec
+func (index *LumpIndex) appendExtents(vec []LumpDataPortion, id uint64) []LumpDataPortion {
+	if len(index.extents) == 0 {
+		return vec
+	}
+	extents, ok := index.extents[id]
+	if !ok {
+		return vec
+	}
+	for _, p := range extents[1:] {
+		vec = append(vec, LumpDataPortion{Id: lump.FromU64(0, id), Portion: p})
+	}
+	return vec
+}
+
+func (index *LumpIndex) clearExtents(id uint64) {
+	if len(index.extents) == 0 {
+		return
+	}
+	extents, ok := index.extents[id]
+	if !ok {
+		return
+	}
+	delete(index.extents, id)
+	if index.namespaces != nil {
+		for _, p := range extents[1:] {
+			index.namespaces.remove(id, fromDataPortionToValue(p))
+		}
+	}
+}
+
+func fromDataPortionToValue(p portion.DataPortion) uint64 {
+	return p.Start.AsU64() | uint64(p.Len)<<40 | 1<<63
+}
@@ -0,0 +1,198 @@
+package lumpindex
+
+import (
+	"math"
+
+	"github.com/google/btree"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+IndexIterator walks the index as it was when the iterator was created.
+Before a lump is changed, the index saves its old value into every open iterator
+which has not passed the lump yet(copy on write), so the iterator could be used
+while lumps are put or deleted. The iterator must be closed, or every change
+of the index is copied into it.
+*/
+type IndexIterator struct {
+	index   *LumpIndex
+	last    uint64
+	started bool
+	done    bool
+	//the values of the changed lumps when the iterator was created
+	saved *btree.BTree
+	//load is not nil if the attributes of the changed lumps are saved too, see SnapshotIterator
+	load func(p portion.JournalPortion) ([]byte, error)
+}
+
+type savedValue struct {
+	id      uint64
+	value   uint64
+	present bool
+	//entry is only saved by SnapshotIterator, it is nil if the lump is not present
+	entry *IndexEntry
+}
+
+//IndexEntry is a lump with its attributes, see SnapshotIterator
+type IndexEntry struct {
+	Id      lump.LumpId
+	Portion portion.Portion
+	//Extents is nil unless the lump is stored in several data portions, see extent.go
+	Extents []portion.DataPortion
+	//ExpireAt is 0 if the lump has no TTL
+	ExpireAt uint64
+	Metadata []byte
+	Tag      string
+	//Embedded is the data of the journal portion read before the lump is changed, it is nil if
+	//the lump is not changed after the iterator is created, EmbeddedErr is the error of the read
+	Embedded    []byte
+	EmbeddedErr error
+}
+
+func (item savedValue) Less(than btree.Item) bool {
+	return item.id < than.(savedValue).id
+}
+
+func (index *LumpIndex) Iterator() *IndexIterator {
+	iter := &IndexIterator{
+		index: index,
+		saved: btree.New(32),
+	}
+	if index.iterators == nil {
+		index.iterators = make(map[*IndexIterator]struct{})
+	}
+	index.iterators[iter] = struct{}{}
+	return iter
+}
+
+/*
+SnapshotIterator is the same as Iterator, but the attributes of the lumps are saved with their
+values before they are changed, and NextEntry returns them. The journal portion is gone after the
+lump is changed, so load is called to read its data when it is saved.
+*/
+func (index *LumpIndex) SnapshotIterator(load func(p portion.JournalPortion) ([]byte, error)) *IndexIterator {
+	iter := index.Iterator()
+	iter.load = load
+	return iter
+}
+
+//Next returns the next lump in the iterator, ok is false if there are no more lumps
+func (iter *IndexIterator) Next() (id lump.LumpId, p portion.Portion, ok bool) {
+	id, value, _, ok := iter.next()
+	if !ok {
+		return
+	}
+	p, _ = fromValueToPortion(value)
+	return id, p, true
+}
+
+//NextEntry returns the next lump with its attributes, it is only for SnapshotIterator
+func (iter *IndexIterator) NextEntry() (entry IndexEntry, ok bool) {
+	id, value, saved, ok := iter.next()
+	if !ok {
+		return
+	}
+	if saved != nil {
+		return *saved, true
+	}
+	return iter.index.entry(id.U64(), value), true
+}
+
+//next returns the saved entry of SnapshotIterator if the lump is changed after the iterator is created
+func (iter *IndexIterator) next() (id lump.LumpId, value uint64, entry *IndexEntry, ok bool) {
+	if iter.done {
+		return
+	}
+	var from uint64
+	if iter.started {
+		if iter.last == math.MaxUint64 {
+			iter.Close()
+			return
+		}
+		from = iter.last + 1
+	}
+
+	//the lumps in the tree which are changed after the iterator was created are skipped
+	treeId, treeValue, treeOk := iter.index.tree.First(from)
+	for treeOk && iter.saved.Has(savedValue{id: treeId}) {
+		treeId, treeValue, treeOk = iter.index.tree.Next(treeId)
+	}
+
+	var saved savedValue
+	var savedOk bool
+	iter.saved.AscendGreaterOrEqual(savedValue{id: from}, func(i btree.Item) bool {
+		if v := i.(savedValue); v.present {
+			saved = v
+			savedOk = true
+			return false
+		}
+		return true
+	})
+
+	switch {
+	case savedOk && (!treeOk || saved.id < treeId):
+		iter.last = saved.id
+		value, entry = saved.value, saved.entry
+	case treeOk:
+		iter.last = treeId
+		value = treeValue
+	default:
+		iter.Close()
+		return
+	}
+	iter.started = true
+	return lump.FromU64(0, iter.last), value, entry, true
+}
+
+//entry returns the lump of id with its attributes now, value is its value in the tree
+func (index *LumpIndex) entry(id uint64, value uint64) IndexEntry {
+	lumpid := lump.FromU64(0, id)
+	p, _ := fromValueToPortion(value)
+	entry := IndexEntry{Id: lumpid, Portion: p}
+	entry.Extents, _ = index.Extents(lumpid)
+	entry.ExpireAt, _ = index.ExpireAt(lumpid)
+	entry.Metadata, _ = index.Metadata(lumpid)
+	entry.Tag, _ = index.Tag(lumpid)
+	return entry
+}
+
+//Close releases the saved values, Next returns nothing after Close
+func (iter *IndexIterator) Close() {
+	if iter.done {
+		return
+	}
+	iter.done = true
+	iter.saved = nil
+	delete(iter.index.iterators, iter)
+}
+
+//preserve saves the value of id into the open iterators before it is changed
+func (index *LumpIndex) preserve(id uint64) {
+	if len(index.iterators) == 0 {
+		return
+	}
+	value, present := index.tree.Get(id)
+	//the entry is shared by the snapshot iterators, it is never changed
+	var entry *IndexEntry
+	for iter := range index.iterators {
+		if iter.started && id <= iter.last {
+			continue
+		}
+		if iter.saved.Has(savedValue{id: id}) {
+			continue
+		}
+		saved := savedValue{id: id, value: value, present: present}
+		if iter.load != nil && present {
+			if entry == nil {
+				e := index.entry(id, value)
+				if p, ok := e.Portion.(portion.JournalPortion); ok {
+					e.Embedded, e.EmbeddedErr = iter.load(p)
+				}
+				entry = &e
+			}
+			saved.entry = entry
+		}
+		iter.saved.ReplaceOrInsert(saved)
+	}
+}
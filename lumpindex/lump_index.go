@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 
+	"github.com/google/btree"
 	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/address"
 	"github.com/thesues/cannyls-go/internalerror"
@@ -15,19 +16,106 @@ import (
 var _ = fmt.Println
 
 type LumpIndex struct {
-	tree judy.JudyL
+	tree indexTree
+	kind TreeKind
+	//the lumps with TTL, see expire.go
+	expires     map[uint64]uint64
+	expireQueue *btree.BTree
+	//the user metadata of lumps, see metadata.go
+	metadata map[uint64][]byte
+	//the user tags of lumps and the lumps of each tag, see tag.go
+	tags  map[uint64]string
+	byTag map[string]map[uint64]struct{}
+	//the user markers, see marker.go
+	markers map[uint64][]byte
+	//the content hashes of the lumps, the lumps sharing each portion and the portion of each
+	//content hash, see dedup.go
+	hashes   map[uint64]contentRef
+	sharers  map[portion.DataPortion]map[uint64]struct{}
+	contents map[lump.ContentHash]portion.DataPortion
+	//the extents of the lumps stored in several data portions, see extent.go
+	extents map[uint64][]portion.DataPortion
+	//the open iterators, see iterator.go
+	iterators map[*IndexIterator]struct{}
+	//the sum of the lengths of all the journal portions
+	embeddedBytes uint64
+	//the optional bloom filter of the lumpids, see bloom.go
+	bloom *bloomFilter
+	//the optional bytes used by each namespace, see namespace.go
+	namespaces *namespaceUsage
 }
 
 func NewIndex() *LumpIndex {
-	tree := judy.JudyL{}
+	index, _ := NewIndexWithTree(TREE_JUDY)
+	return index
+}
+
+//NewIndexWithTree creates the index on the tree of kind, see TreeKind
+func NewIndexWithTree(kind TreeKind) (*LumpIndex, error) {
+	if err := kind.Validate(); err != nil {
+		return nil, err
+	}
+	return &LumpIndex{
+		tree: newIndexTree(kind),
+		kind: kind,
+	}, nil
+}
+
+/*
+NewSpilledIndex creates the index on a packedTree whose leaves are spilled to the file at path
+when they take more than limit bytes of memory, see leafPager. The index must be closed to
+remove the file.
+*/
+func NewSpilledIndex(path string, limit uint64) (*LumpIndex, error) {
+	pager, err := newLeafPager(path, limit)
+	if err != nil {
+		return nil, err
+	}
+	tree := newPackedTree()
+	tree.pager = pager
 	return &LumpIndex{
 		tree: tree,
+		kind: TREE_PACKED,
+	}, nil
+}
+
+//Close removes the spill file of the index if there is one
+func (index *LumpIndex) Close() error {
+	if tree, ok := index.tree.(*packedTree); ok && tree.pager != nil {
+		err := tree.pager.close()
+		tree.pager = nil
+		return err
+	}
+	return nil
+}
+
+/*
+Err returns the first io error of the spill file of the index. The index is broken after it,
+because a spilled leaf may not be read back, so the lookups fail with it, and the index must be
+restored from the journal again.
+*/
+func (index *LumpIndex) Err() error {
+	if tree, ok := index.tree.(*packedTree); ok && tree.pager != nil {
+		return tree.pager.err
 	}
+	return nil
+}
+
+//TreeKind returns the kind of the tree of the index
+func (index *LumpIndex) TreeKind() TreeKind {
+	return index.kind
 }
 
 func (index *LumpIndex) Get(id lump.LumpId) (p portion.Portion, err error) {
+	if index.absent(id.U64()) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "failed to get key :%s", id.String())
+	}
 	v, ok := index.tree.Get(id.U64())
+	if err = index.Err(); err != nil {
+		return nil, err
+	}
 	if ok == false {
+		index.missed()
 		return nil, errors.Wrapf(internalerror.InvalidInput, "failed to get key :%s", id.String())
 	}
 
@@ -36,32 +124,95 @@ func (index *LumpIndex) Get(id lump.LumpId) (p portion.Portion, err error) {
 }
 
 func (index *LumpIndex) InsertDataPortion(id lump.LumpId, data portion.DataPortion) {
-	var n uint64 = 0
-	n = data.Start.AsU64() | uint64(data.Len)<<40 | 1<<63
+	n := fromDataPortionToValue(data)
+	index.preserve(id.U64())
+	index.forgetUsage(id.U64())
 	index.tree.Insert(id.U64(), n)
+	if index.namespaces != nil {
+		index.namespaces.add(id.U64(), n)
+	}
+	index.bloomInserted(id.U64())
+	index.clearExpire(id.U64())
+	index.clearMetadata(id.U64())
+	index.clearTag(id.U64())
+	index.clearHash(id.U64())
+	index.clearExtents(id.U64())
 }
 
 func (index *LumpIndex) InsertJournalPortion(id lump.LumpId, data portion.JournalPortion) {
 	var n uint64 = 0
 	n = data.Start.AsU64() | uint64(data.Len)<<40
+	index.preserve(id.U64())
+	index.forgetUsage(id.U64())
+	index.embeddedBytes += uint64(data.Len)
 	index.tree.Insert(id.U64(), n)
+	if index.namespaces != nil {
+		index.namespaces.add(id.U64(), n)
+	}
+	index.bloomInserted(id.U64())
+	index.clearExpire(id.U64())
+	index.clearMetadata(id.U64())
+	index.clearTag(id.U64())
+	index.clearHash(id.U64())
+	index.clearExtents(id.U64())
 }
 
 func (index *LumpIndex) Delete(id lump.LumpId) bool {
-	return index.tree.Delete(id.U64())
+	if index.absent(id.U64()) {
+		return false
+	}
+	//the attributes are saved by preserve before they are cleared
+	index.preserve(id.U64())
+	index.clearExpire(id.U64())
+	index.clearMetadata(id.U64())
+	index.clearTag(id.U64())
+	index.clearHash(id.U64())
+	index.clearExtents(id.U64())
+	index.forgetUsage(id.U64())
+	if !index.tree.Delete(id.U64()) {
+		index.missed()
+		return false
+	}
+	index.bloomDeleted()
+	return true
 }
 
 func (index *LumpIndex) DeleteRange(start lump.LumpId, end lump.LumpId) {
 	indexNum, _, ok := index.tree.First(start.U64())
 	for ok && indexNum < end.U64() {
+		index.preserve(indexNum)
+		index.forgetUsage(indexNum)
 		if rc := index.tree.Delete(indexNum); rc == false {
 			fmt.Printf("index %d\n", indexNum)
 			panic("judy index, delete item when iterating.. should never happen")
 		}
+		index.clearExpire(indexNum)
+		index.clearMetadata(indexNum)
+		index.clearTag(indexNum)
+		index.clearHash(indexNum)
+		index.clearExtents(indexNum)
+		index.bloomDeleted()
 		indexNum, _, ok = index.tree.Next(indexNum)
 	}
 }
 
+//forgetUsage removes the size of the portion of id from embeddedBytes and its namespace
+func (index *LumpIndex) forgetUsage(id uint64) {
+	if v, ok := index.tree.Get(id); ok {
+		if p, isDataPortion := fromValueToPortion(v); !isDataPortion {
+			index.embeddedBytes -= uint64(p.(portion.JournalPortion).Len)
+		}
+		if index.namespaces != nil {
+			index.namespaces.remove(id, v)
+		}
+	}
+}
+
+//EmbeddedBytes returns the size of all the lumps embedded in the journal region
+func (index *LumpIndex) EmbeddedBytes() uint64 {
+	return index.embeddedBytes
+}
+
 func (index *LumpIndex) Min() (id lump.LumpId, ok bool) {
 	var n uint64
 	n, _, ok = index.tree.First(0)
@@ -95,10 +246,17 @@ func (index *LumpIndex) Count() uint64 {
 }
 
 func (index *LumpIndex) List() []lump.LumpId {
+	return index.ListLive(0)
+}
+
+//ListLive is the same as List, but the lumps which expire at or before now are skipped, see ExpireAt
+func (index *LumpIndex) ListLive(now uint64) []lump.LumpId {
 	vec := make([]lump.LumpId, 0, 1024)
 	indexNum, _, ok := index.tree.First(0)
 	for ok {
-		vec = append(vec, lump.FromU64(0, indexNum))
+		if !index.expiredAt(indexNum, now) {
+			vec = append(vec, lump.FromU64(0, indexNum))
+		}
 		indexNum, _, ok = index.tree.Next(indexNum)
 	}
 	return vec
@@ -117,6 +275,9 @@ func (index *LumpIndex) JudyDataPortions() *judy.Judy1 {
 		if p, isDataPortion := fromValueToPortion(value); isDataPortion {
 			judyPoriton = fromDataPortionToJudy(p.(portion.DataPortion))
 			judyPortionArray.Set(judyPoriton)
+			for _, l := range index.appendExtents(nil, indexNum) {
+				judyPortionArray.Set(fromDataPortionToJudy(l.Portion))
+			}
 		}
 		indexNum, value, ok = index.tree.Next(indexNum)
 	}
@@ -137,6 +298,55 @@ func (index *LumpIndex) DataPortions() []portion.DataPortion {
 	for ok {
 		if p, isDataPortion := fromValueToPortion(value); isDataPortion {
 			vec = append(vec, p.(portion.DataPortion))
+			for _, l := range index.appendExtents(nil, indexNum) {
+				vec = append(vec, l.Portion)
+			}
+		}
+		indexNum, value, ok = index.tree.Next(indexNum)
+	}
+	return vec
+}
+
+//LumpDataPortion is a lump stored in the data region
+type LumpDataPortion struct {
+	Id      lump.LumpId
+	Portion portion.DataPortion
+}
+
+//LumpDataPortions returns all the lumps stored in the data region, ordered by lumpid.
+//A lump stored in several extents is returned with each of them in order
+func (index *LumpIndex) LumpDataPortions() []LumpDataPortion {
+	vec := make([]LumpDataPortion, 0, 1024)
+	indexNum, value, ok := index.tree.First(0)
+	for ok {
+		if p, isDataPortion := fromValueToPortion(value); isDataPortion {
+			vec = append(vec, LumpDataPortion{
+				Id:      lump.FromU64(0, indexNum),
+				Portion: p.(portion.DataPortion),
+			})
+			vec = index.appendExtents(vec, indexNum)
+		}
+		indexNum, value, ok = index.tree.Next(indexNum)
+	}
+	return vec
+}
+
+//LumpJournalPortion is a lump embedded in the journal region
+type LumpJournalPortion struct {
+	Id      lump.LumpId
+	Portion portion.JournalPortion
+}
+
+//LumpJournalPortions returns all the embedded lumps, ordered by lumpid
+func (index *LumpIndex) LumpJournalPortions() []LumpJournalPortion {
+	vec := make([]LumpJournalPortion, 0, 1024)
+	indexNum, value, ok := index.tree.First(0)
+	for ok {
+		if p, isDataPortion := fromValueToPortion(value); !isDataPortion {
+			vec = append(vec, LumpJournalPortion{
+				Id:      lump.FromU64(0, indexNum),
+				Portion: p.(portion.JournalPortion),
+			})
 		}
 		indexNum, value, ok = index.tree.Next(indexNum)
 	}
@@ -144,16 +354,67 @@ func (index *LumpIndex) DataPortions() []portion.DataPortion {
 }
 
 func (index *LumpIndex) ListRange(start lump.LumpId, end lump.LumpId) []lump.LumpId {
-	vec := make([]lump.LumpId, 0, 1024)
+	return index.ListRangeLimit(start, end, 0)
+}
+
+//ListRangeLimit returns at most limit lumpids in [start, end), limit <= 0 means no limit
+func (index *LumpIndex) ListRangeLimit(start lump.LumpId, end lump.LumpId, limit int) []lump.LumpId {
+	return index.ListRangeLive(start, end, limit, 0)
+}
+
+//ListRangeLive is the same as ListRangeLimit, but the lumps which expire at or before now are skipped
+func (index *LumpIndex) ListRangeLive(start lump.LumpId, end lump.LumpId, limit int, now uint64) []lump.LumpId {
+	vec := make([]lump.LumpId, 0, listCapacity(limit))
 	indexNum, _, ok := index.tree.First(start.U64())
-	for ok && indexNum < end.U64() {
-		vec = append(vec, lump.FromU64(0, indexNum))
+	for ok && indexNum < end.U64() && (limit <= 0 || len(vec) < limit) {
+		if !index.expiredAt(indexNum, now) {
+			vec = append(vec, lump.FromU64(0, indexNum))
+		}
+		indexNum, _, ok = index.tree.Next(indexNum)
+	}
+	return vec
+}
+
+/*
+ListPrefix returns at most limit lumpids, whose high bits are the same as
+the high bits of prefix, ordered by lumpid. limit <= 0 means no limit
+*/
+func (index *LumpIndex) ListPrefix(prefix lump.LumpId, bits uint, limit int) []lump.LumpId {
+	return index.ListPrefixLive(prefix, bits, limit, 0)
+}
+
+//ListPrefixLive is the same as ListPrefix, but the lumps which expire at or before now are skipped
+func (index *LumpIndex) ListPrefixLive(prefix lump.LumpId, bits uint, limit int, now uint64) []lump.LumpId {
+	if bits > 64 {
+		bits = 64
+	}
+	var mask uint64
+	if bits > 0 {
+		mask = math.MaxUint64 << (64 - bits)
+	}
+	start := prefix.U64() & mask
+	vec := make([]lump.LumpId, 0, listCapacity(limit))
+	indexNum, _, ok := index.tree.First(start)
+	for ok && indexNum&mask == start && (limit <= 0 || len(vec) < limit) {
+		if !index.expiredAt(indexNum, now) {
+			vec = append(vec, lump.FromU64(0, indexNum))
+		}
 		indexNum, _, ok = index.tree.Next(indexNum)
 	}
 	return vec
 }
 
+func listCapacity(limit int) int {
+	if limit > 0 && limit < 1024 {
+		return limit
+	}
+	return 1024
+}
+
 func (index *LumpIndex) MemoryUsed() uint64 {
+	if index.bloom != nil {
+		return index.tree.MemoryUsed() + index.bloom.memoryUsed()
+	}
 	return index.tree.MemoryUsed()
 }
 
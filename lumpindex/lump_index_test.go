@@ -8,6 +8,7 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/portion"
 )
@@ -69,6 +70,24 @@ func TestLumpIndexDelete(t *testing.T) {
 	}
 }
 
+func TestListRangeAndPrefix(t *testing.T) {
+	tree := NewIndex()
+	data := portion.NewJournalPortion(100, 10)
+	for _, c := range []string{"10", "11", "1f", "20", "21", "ffffffffffffffff"} {
+		tree.InsertJournalPortion(lumpid(c), data)
+	}
+
+	assert.Equal(t, []lump.LumpId{lumpid("10"), lumpid("11")}, tree.ListRangeLimit(lumpid("0"), lumpid("30"), 2))
+	//next page
+	assert.Equal(t, []lump.LumpId{lumpid("1f"), lumpid("20")}, tree.ListRangeLimit(lumpid("11").Inc(), lumpid("30"), 2))
+	assert.Equal(t, 5, len(tree.ListRangeLimit(lumpid("0"), lumpid("30"), 0)))
+
+	assert.Equal(t, []lump.LumpId{lumpid("10"), lumpid("11"), lumpid("1f")}, tree.ListPrefix(lumpid("10"), 60, 0))
+	assert.Equal(t, []lump.LumpId{lumpid("20")}, tree.ListPrefix(lumpid("20"), 60, 1))
+	assert.Equal(t, []lump.LumpId{lumpid("ffffffffffffffff")}, tree.ListPrefix(lumpid("f000000000000000"), 4, 0))
+	assert.Equal(t, 6, len(tree.ListPrefix(lumpid("0"), 0, 0)))
+}
+
 //helper
 
 const N int64 = 1000000
@@ -97,3 +116,227 @@ func lumpid(s string) lump.LumpId {
 	l, _ := lump.FromString(s)
 	return l
 }
+
+func TestIteratorSnapshot(t *testing.T) {
+	tree := NewIndex()
+	data := portion.NewDataPortion(100, 10)
+	for _, c := range []string{"10", "20", "30", "40"} {
+		tree.InsertDataPortion(lumpid(c), data)
+	}
+
+	iter := tree.Iterator()
+	id, p, ok := iter.Next()
+	assert.True(t, ok)
+	assert.Equal(t, lumpid("10"), id)
+	assert.Equal(t, data, p)
+
+	//changes after the iterator is created are not seen
+	tree.Delete(lumpid("30"))
+	tree.InsertDataPortion(lumpid("25"), data)
+	tree.InsertJournalPortion(lumpid("40"), portion.NewJournalPortion(0, 1))
+	tree.DeleteRange(lumpid("0"), lumpid("15"))
+
+	ids := []lump.LumpId{}
+	for id, p, ok = iter.Next(); ok; id, p, ok = iter.Next() {
+		ids = append(ids, id)
+		assert.Equal(t, data, p)
+	}
+	assert.Equal(t, []lump.LumpId{lumpid("20"), lumpid("30"), lumpid("40")}, ids)
+	assert.Equal(t, 0, len(tree.iterators))
+
+	//a new iterator sees the changes
+	iter = tree.Iterator()
+	ids = []lump.LumpId{}
+	for id, _, ok = iter.Next(); ok; id, _, ok = iter.Next() {
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []lump.LumpId{lumpid("20"), lumpid("25"), lumpid("40")}, ids)
+}
+
+func TestSnapshotIterator(t *testing.T) {
+	tree := NewIndex()
+	tree.InsertDataPortionWithMetadata(lumpid("10"), portion.NewDataPortion(100, 10), []byte("meta"))
+	tree.SetTag(lumpid("10"), "a")
+	tree.InsertDataPortionWithExpire(lumpid("20"), portion.NewDataPortion(200, 10), 1234)
+	tree.InsertJournalPortion(lumpid("30"), portion.NewJournalPortion(300, 3))
+	extents := []portion.DataPortion{portion.NewDataPortion(400, 10), portion.NewDataPortion(500, 10)}
+	tree.InsertDataExtents(lumpid("40"), extents)
+
+	loaded := 0
+	iter := tree.SnapshotIterator(func(p portion.JournalPortion) ([]byte, error) {
+		loaded++
+		assert.Equal(t, portion.NewJournalPortion(300, 3), p)
+		return []byte("foo"), nil
+	})
+
+	//the attributes are saved before the lumps are changed
+	tree.Delete(lumpid("10"))
+	tree.InsertDataPortion(lumpid("20"), portion.NewDataPortion(600, 10))
+	tree.DeleteRange(lumpid("30"), lumpid("50"))
+	assert.Equal(t, 1, loaded)
+
+	entry, ok := iter.NextEntry()
+	assert.True(t, ok)
+	assert.Equal(t, IndexEntry{Id: lumpid("10"), Portion: portion.NewDataPortion(100, 10), Metadata: []byte("meta"), Tag: "a"}, entry)
+	entry, ok = iter.NextEntry()
+	assert.True(t, ok)
+	assert.Equal(t, IndexEntry{Id: lumpid("20"), Portion: portion.NewDataPortion(200, 10), ExpireAt: 1234}, entry)
+	entry, ok = iter.NextEntry()
+	assert.True(t, ok)
+	assert.Equal(t, IndexEntry{Id: lumpid("30"), Portion: portion.NewJournalPortion(300, 3), Embedded: []byte("foo")}, entry)
+	entry, ok = iter.NextEntry()
+	assert.True(t, ok)
+	assert.Equal(t, IndexEntry{Id: lumpid("40"), Portion: extents[0], Extents: extents}, entry)
+	_, ok = iter.NextEntry()
+	assert.False(t, ok)
+
+	//the unchanged lumps are read from the index
+	iter = tree.SnapshotIterator(nil)
+	entry, ok = iter.NextEntry()
+	assert.True(t, ok)
+	assert.Equal(t, IndexEntry{Id: lumpid("20"), Portion: portion.NewDataPortion(600, 10)}, entry)
+	iter.Close()
+}
+
+func TestLumpIndexTag(t *testing.T) {
+	index := NewIndex()
+	for i := 0; i < 4; i++ {
+		index.InsertDataPortionWithMetadata(lump.FromU64(0, uint64(4-i)), portion.NewDataPortion(uint64(i), 1), nil)
+		index.SetTag(lump.FromU64(0, uint64(4-i)), "a")
+	}
+	index.InsertJournalPortion(lump.FromU64(0, 5), portion.NewJournalPortion(0, 1))
+	index.SetTag(lump.FromU64(0, 5), "b")
+	assert.Equal(t, []lump.LumpId{lump.FromU64(0, 1), lump.FromU64(0, 2), lump.FromU64(0, 3), lump.FromU64(0, 4)}, index.ListByTag("a", 0))
+	assert.Equal(t, 2, len(index.ListByTag("a", 2)))
+
+	//retag, put again, delete
+	index.SetTag(lump.FromU64(0, 1), "b")
+	index.InsertDataPortion(lump.FromU64(0, 2), portion.NewDataPortion(10, 1))
+	index.Delete(lump.FromU64(0, 3))
+	index.DeleteRange(lump.FromU64(0, 5), lump.FromU64(0, 6))
+	assert.Equal(t, []lump.LumpId{lump.FromU64(0, 4)}, index.ListByTag("a", 0))
+	assert.Equal(t, []lump.LumpId{lump.FromU64(0, 1)}, index.ListByTag("b", 0))
+	tag, ok := index.Tag(lump.FromU64(0, 1))
+	assert.True(t, ok)
+	assert.Equal(t, "b", tag)
+	_, ok = index.Tag(lump.FromU64(0, 2))
+	assert.False(t, ok)
+	assert.Equal(t, 0, len(index.ListByTag("c", 0)))
+}
+
+func TestLumpIndexListLive(t *testing.T) {
+	index := NewIndex()
+	for i := 1; i <= 4; i++ {
+		index.InsertDataPortionWithExpire(lump.FromU64(0, uint64(i)), portion.NewDataPortion(uint64(i), 1), uint64(i*10))
+		index.SetTag(lump.FromU64(0, uint64(i)), "a")
+	}
+	index.InsertDataPortion(lump.FromU64(0, 5), portion.NewDataPortion(5, 1))
+	all := []lump.LumpId{lump.FromU64(0, 1), lump.FromU64(0, 2), lump.FromU64(0, 3), lump.FromU64(0, 4), lump.FromU64(0, 5)}
+	assert.Equal(t, all, index.ListLive(0))
+	//1 and 2 are expired at 20
+	assert.Equal(t, all[2:], index.ListLive(20))
+	assert.Equal(t, all[2:4], index.ListRangeLive(lump.FromU64(0, 0), lump.FromU64(0, 10), 2, 20))
+	assert.Equal(t, all[2:], index.ListPrefixLive(lump.FromU64(0, 0), 32, 0, 20))
+	assert.Equal(t, all[3:4], index.ListByTagLive("a", 0, 30))
+	assert.Equal(t, all[:4], index.ListByTag("a", 0))
+}
+
+func TestLumpIndexDedup(t *testing.T) {
+	index := NewIndex()
+	thumbnail := lump.HashContent([]byte("thumbnail"))
+	shared := portion.NewDataPortion(7, 1)
+	for i := 1; i <= 3; i++ {
+		index.InsertDataPortionWithHash(lump.FromU64(0, uint64(i)), shared, thumbnail)
+	}
+	p, ok := index.ContentPortion(thumbnail)
+	assert.True(t, ok)
+	assert.Equal(t, shared, p)
+	assert.Equal(t, 3, index.Refs(shared))
+	assert.Equal(t, []lump.LumpId{lump.FromU64(0, 1), lump.FromU64(0, 2), lump.FromU64(0, 3)}, index.Sharers(shared))
+
+	//put again, delete, delete range
+	index.InsertDataPortion(lump.FromU64(0, 1), portion.NewDataPortion(10, 1))
+	_, ok = index.ContentHash(lump.FromU64(0, 1))
+	assert.False(t, ok)
+	hash, ok := index.ContentHash(lump.FromU64(0, 2))
+	assert.True(t, ok)
+	assert.Equal(t, thumbnail, hash)
+	index.Delete(lump.FromU64(0, 2))
+	assert.Equal(t, 1, index.Refs(shared))
+	index.DeleteRange(lump.FromU64(0, 3), lump.FromU64(0, 4))
+	assert.Equal(t, 0, index.Refs(shared))
+	_, ok = index.ContentPortion(thumbnail)
+	assert.False(t, ok)
+
+	//the lumps of a moved portion
+	index.InsertDataPortionWithHash(lump.FromU64(0, 4), shared, thumbnail)
+	index.InsertDataPortionWithHash(lump.FromU64(0, 5), shared, thumbnail)
+	moved := portion.NewDataPortion(2, 1)
+	index.InsertDataPortionWithHash(lump.FromU64(0, 4), moved, thumbnail)
+	p, _ = index.ContentPortion(thumbnail)
+	assert.Equal(t, moved, p)
+	assert.Equal(t, 1, index.Refs(shared))
+	index.InsertDataPortionWithHash(lump.FromU64(0, 5), moved, thumbnail)
+	assert.Equal(t, 0, index.Refs(shared))
+	assert.Equal(t, 2, index.Refs(moved))
+}
+
+func TestLumpIndexExtents(t *testing.T) {
+	index := NewIndex()
+	extents := []portion.DataPortion{portion.NewDataPortion(10, 0xFFFF), portion.NewDataPortion(0, 2)}
+	index.InsertDataExtents(lump.FromU64(0, 1), extents)
+	index.InsertDataPortion(lump.FromU64(0, 2), portion.NewDataPortion(2, 1))
+	p, err := index.Get(lump.FromU64(0, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, extents[0], p)
+	vec, ok := index.Extents(lump.FromU64(0, 1))
+	assert.True(t, ok)
+	assert.Equal(t, extents, vec)
+	_, ok = index.Extents(lump.FromU64(0, 2))
+	assert.False(t, ok)
+	assert.Equal(t, []portion.DataPortion{portion.NewDataPortion(0, 0), extents[0], extents[1], portion.NewDataPortion(2, 1)},
+		index.DataPortions())
+	assert.Equal(t, []LumpDataPortion{
+		{Id: lump.FromU64(0, 1), Portion: extents[0]},
+		{Id: lump.FromU64(0, 1), Portion: extents[1]},
+		{Id: lump.FromU64(0, 2), Portion: portion.NewDataPortion(2, 1)},
+	}, index.LumpDataPortions())
+	assert.Nil(t, index.TrackNamespaces(16, block.Min()))
+	assert.Equal(t, uint64(0x10001*512), index.LumpBytes(lump.FromU64(0, 1)))
+
+	//put again, delete
+	index.InsertDataPortion(lump.FromU64(0, 1), portion.NewDataPortion(3, 1))
+	_, ok = index.Extents(lump.FromU64(0, 1))
+	assert.False(t, ok)
+	assert.Equal(t, map[uint32]uint64{0: 1024}, index.NamespaceUsage())
+	index.InsertDataExtents(lump.FromU64(0, 2), extents)
+	assert.Equal(t, map[uint32]uint64{0: 512 + 0x10001*512}, index.NamespaceUsage())
+	index.Delete(lump.FromU64(0, 2))
+	_, ok = index.Extents(lump.FromU64(0, 2))
+	assert.False(t, ok)
+	assert.Equal(t, map[uint32]uint64{0: 512}, index.NamespaceUsage())
+}
+
+func TestLumpIndexNamespaceUsage(t *testing.T) {
+	index := NewIndex()
+	index.InsertDataPortion(lump.FromU64(0, 1<<48|1), portion.NewDataPortion(0, 2))
+	assert.Nil(t, index.TrackNamespaces(16, block.Min()))
+	assert.Error(t, index.TrackNamespaces(33, block.Min()))
+	assert.Equal(t, uint(16), index.NamespaceBits())
+	assert.Equal(t, uint32(1), index.NamespaceOf(lump.FromU64(0, 1<<48|1)))
+
+	index.InsertJournalPortion(lump.FromU64(0, 1<<48|2), portion.NewJournalPortion(0, 100))
+	index.InsertDataPortion(lump.FromU64(0, 2<<48), portion.NewDataPortion(2, 1))
+	assert.Equal(t, map[uint32]uint64{1: 1124, 2: 512}, index.NamespaceUsage())
+	assert.Equal(t, uint64(1024), index.LumpBytes(lump.FromU64(0, 1<<48|1)))
+
+	//a lump moved between the regions
+	index.InsertDataPortion(lump.FromU64(0, 1<<48|2), portion.NewDataPortion(3, 1))
+	assert.Equal(t, uint64(1536), index.NamespaceBytes(1))
+	index.Delete(lump.FromU64(0, 1<<48|1))
+	index.DeleteRange(lump.FromU64(0, 2<<48), lump.FromU64(0, 3<<48))
+	assert.Equal(t, map[uint32]uint64{1: 512}, index.NamespaceUsage())
+
+	assert.Nil(t, index.TrackNamespaces(0, block.Min()))
+	assert.Equal(t, 0, len(index.NamespaceUsage()))
+}
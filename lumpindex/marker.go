@@ -0,0 +1,39 @@
+package lumpindex
+
+import "sort"
+
+/*
+The user markers are not lumps, they are kept in the index so they are restored from
+the journal and saved in the checkpoint as the lumps, see storage.WriteMarker
+*/
+
+func (index *LumpIndex) InsertMarker(id uint64, data []byte) {
+	if index.markers == nil {
+		index.markers = make(map[uint64][]byte)
+	}
+	index.markers[id] = data
+}
+
+func (index *LumpIndex) DeleteMarker(id uint64) bool {
+	if _, ok := index.markers[id]; !ok {
+		return false
+	}
+	delete(index.markers, id)
+	return true
+}
+
+//Marker returns the data of the marker, ok is false if it is not written or already released
+func (index *LumpIndex) Marker(id uint64) (data []byte, ok bool) {
+	data, ok = index.markers[id]
+	return
+}
+
+//Markers returns the ids of all the markers in ascending order
+func (index *LumpIndex) Markers() []uint64 {
+	ids := make([]uint64, 0, len(index.markers))
+	for id := range index.markers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
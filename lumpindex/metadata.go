@@ -0,0 +1,39 @@
+package lumpindex
+
+import (
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func (index *LumpIndex) InsertDataPortionWithMetadata(id lump.LumpId, data portion.DataPortion, metadata []byte) {
+	index.InsertDataPortion(id, data)
+	index.setMetadata(id.U64(), metadata)
+}
+
+func (index *LumpIndex) InsertJournalPortionWithMetadata(id lump.LumpId, data portion.JournalPortion, metadata []byte) {
+	index.InsertJournalPortion(id, data)
+	index.setMetadata(id.U64(), metadata)
+}
+
+//Metadata returns the user metadata of the lump, ok is false if the lump has no metadata
+func (index *LumpIndex) Metadata(id lump.LumpId) (metadata []byte, ok bool) {
+	if len(index.metadata) == 0 {
+		return nil, false
+	}
+	metadata, ok = index.metadata[id.U64()]
+	return
+}
+
+func (index *LumpIndex) setMetadata(id uint64, metadata []byte) {
+	if index.metadata == nil {
+		index.metadata = make(map[uint64][]byte)
+	}
+	index.metadata[id] = metadata
+}
+
+func (index *LumpIndex) clearMetadata(id uint64) {
+	if len(index.metadata) == 0 {
+		return
+	}
+	delete(index.metadata, id)
+}
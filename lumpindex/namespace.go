@@ -0,0 +1,121 @@
+package lumpindex
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+namespaceUsage sums the bytes used by the lumps of each namespace, the namespace of a lump is
+the high bits of its lumpid, as lump.IdLayout composes it. A lump in the data region uses its
+blocks, an embedded lump uses its length in the journal region.
+*/
+type namespaceUsage struct {
+	bits      uint
+	blockSize uint64
+	bytes     map[uint32]uint64
+}
+
+//TrackNamespaces starts to sum the bytes used by each namespace of bits bits, 0 stops it
+func (index *LumpIndex) TrackNamespaces(bits uint, blockSize block.BlockSize) error {
+	if bits > 32 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid namespace bits %d", bits)
+	}
+	if bits == 0 {
+		index.namespaces = nil
+		return nil
+	}
+	index.namespaces = &namespaceUsage{
+		bits:      bits,
+		blockSize: uint64(blockSize.AsU16()),
+		bytes:     make(map[uint32]uint64),
+	}
+	k, v, ok := index.tree.First(0)
+	for ok {
+		index.namespaces.add(k, v)
+		for _, l := range index.appendExtents(nil, k) {
+			index.namespaces.add(k, fromDataPortionToValue(l.Portion))
+		}
+		k, v, ok = index.tree.Next(k)
+	}
+	return nil
+}
+
+//NamespaceBits returns the bits of the tracked namespaces, 0 if they are not tracked
+func (index *LumpIndex) NamespaceBits() uint {
+	if index.namespaces == nil {
+		return 0
+	}
+	return index.namespaces.bits
+}
+
+//NamespaceOf returns the namespace of the lumpid, it is 0 if the namespaces are not tracked
+func (index *LumpIndex) NamespaceOf(id lump.LumpId) uint32 {
+	if index.namespaces == nil {
+		return 0
+	}
+	return index.namespaces.of(id.U64())
+}
+
+//NamespaceBytes returns the bytes used by the lumps of the namespace
+func (index *LumpIndex) NamespaceBytes(namespace uint32) uint64 {
+	if index.namespaces == nil {
+		return 0
+	}
+	return index.namespaces.bytes[namespace]
+}
+
+//NamespaceUsage returns the bytes used by each namespace which has lumps
+func (index *LumpIndex) NamespaceUsage() map[uint32]uint64 {
+	usage := make(map[uint32]uint64)
+	if index.namespaces != nil {
+		for namespace, bytes := range index.namespaces.bytes {
+			usage[namespace] = bytes
+		}
+	}
+	return usage
+}
+
+//LumpBytes returns the bytes used by the lump as they are counted in its namespace
+func (index *LumpIndex) LumpBytes(id lump.LumpId) uint64 {
+	if index.namespaces == nil {
+		return 0
+	}
+	v, ok := index.tree.Get(id.U64())
+	if !ok {
+		return 0
+	}
+	size := index.namespaces.size(v)
+	for _, l := range index.appendExtents(nil, id.U64()) {
+		size += index.namespaces.size(fromDataPortionToValue(l.Portion))
+	}
+	return size
+}
+
+func (usage *namespaceUsage) of(id uint64) uint32 {
+	return uint32(id >> (64 - usage.bits))
+}
+
+func (usage *namespaceUsage) size(v uint64) uint64 {
+	p, isDataPortion := fromValueToPortion(v)
+	if isDataPortion {
+		return uint64(p.(portion.DataPortion).Len) * usage.blockSize
+	}
+	return uint64(p.(portion.JournalPortion).Len)
+}
+
+func (usage *namespaceUsage) add(id uint64, v uint64) {
+	usage.bytes[usage.of(id)] += usage.size(v)
+}
+
+func (usage *namespaceUsage) remove(id uint64, v uint64) {
+	namespace := usage.of(id)
+	if bytes := usage.bytes[namespace] - usage.size(v); bytes > 0 {
+		usage.bytes[namespace] = bytes
+	} else {
+		delete(usage.bytes, namespace)
+	}
+}
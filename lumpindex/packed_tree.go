@@ -0,0 +1,338 @@
+package lumpindex
+
+import (
+	"math"
+	"sort"
+	"unsafe"
+)
+
+const (
+	//the max number of entries in a leaf
+	PACKED_LEAF_SIZE = 256
+	//a leaf grows by PACKED_LEAF_GROW entries, so at most PACKED_LEAF_GROW entries are wasted
+	PACKED_LEAF_GROW = 16
+)
+
+/*
+packedLeaf holds at most PACKED_LEAF_SIZE sorted entries. The keys are stored as the differences
+from base in width bytes, so the dense lumpids take 1 or 2 bytes instead of 8. base is not
+bigger than the first key, it is not changed when the first key is deleted.
+*/
+type packedLeaf struct {
+	base   uint64
+	width  int
+	keys   []byte
+	values []uint64
+	//the state of a spilled leaf, see leafPager
+	page leafPage
+}
+
+func keyWidth(delta uint64) int {
+	width := 1
+	for delta >>= 8; delta != 0; delta >>= 8 {
+		width++
+	}
+	return width
+}
+
+func newPackedLeaf(keys []uint64, values []uint64) *packedLeaf {
+	leaf := &packedLeaf{page: leafPage{slot: -1}}
+	leaf.reset(keys, values)
+	return leaf
+}
+
+//reset encodes the sorted keys again, values is copied
+func (leaf *packedLeaf) reset(keys []uint64, values []uint64) {
+	leaf.base, leaf.width = keys[0], keyWidth(keys[len(keys)-1]-keys[0])
+	newValues := make([]uint64, len(values), growTo(len(values)))
+	copy(newValues, values)
+	leaf.values = newValues
+	leaf.keys = make([]byte, len(keys)*leaf.width, growTo(len(keys))*leaf.width)
+	for i, k := range keys {
+		leaf.putKey(i, k)
+	}
+}
+
+func growTo(n int) int {
+	return (n + PACKED_LEAF_GROW - 1) / PACKED_LEAF_GROW * PACKED_LEAF_GROW
+}
+
+func (leaf *packedLeaf) len() int {
+	return len(leaf.values)
+}
+
+func (leaf *packedLeaf) key(i int) uint64 {
+	var delta uint64
+	b := leaf.keys[i*leaf.width : (i+1)*leaf.width]
+	for j := len(b) - 1; j >= 0; j-- {
+		delta = delta<<8 | uint64(b[j])
+	}
+	return leaf.base + delta
+}
+
+func (leaf *packedLeaf) putKey(i int, k uint64) {
+	delta := k - leaf.base
+	b := leaf.keys[i*leaf.width : (i+1)*leaf.width]
+	for j := range b {
+		b[j] = byte(delta)
+		delta >>= 8
+	}
+}
+
+//search returns the index of the first key not less than k
+func (leaf *packedLeaf) search(k uint64) (int, bool) {
+	i := sort.Search(leaf.len(), func(i int) bool { return leaf.key(i) >= k })
+	return i, i < leaf.len() && leaf.key(i) == k
+}
+
+func (leaf *packedLeaf) decode() []uint64 {
+	keys := make([]uint64, leaf.len())
+	for i := range keys {
+		keys[i] = leaf.key(i)
+	}
+	return keys
+}
+
+//insert puts k at i, the keys are encoded again if k does not fit base and width
+func (leaf *packedLeaf) insert(i int, k uint64, v uint64) {
+	if k < leaf.base || keyWidth(k-leaf.base) > leaf.width {
+		keys := leaf.decode()
+		keys = append(keys[:i], append([]uint64{k}, keys[i:]...)...)
+		values := append(leaf.values[:i:i], append([]uint64{v}, leaf.values[i:]...)...)
+		leaf.reset(keys, values)
+		return
+	}
+	n := leaf.len()
+	if n == cap(leaf.values) {
+		values := make([]uint64, n, n+PACKED_LEAF_GROW)
+		copy(values, leaf.values)
+		leaf.values = values
+		keys := make([]byte, n*leaf.width, (n+PACKED_LEAF_GROW)*leaf.width)
+		copy(keys, leaf.keys)
+		leaf.keys = keys
+	}
+	leaf.values = append(leaf.values, 0)
+	copy(leaf.values[i+1:], leaf.values[i:])
+	leaf.values[i] = v
+	leaf.keys = leaf.keys[:(n+1)*leaf.width]
+	copy(leaf.keys[(i+1)*leaf.width:], leaf.keys[i*leaf.width:n*leaf.width])
+	leaf.putKey(i, k)
+}
+
+func (leaf *packedLeaf) remove(i int) {
+	n := leaf.len()
+	copy(leaf.values[i:], leaf.values[i+1:])
+	leaf.values = leaf.values[:n-1]
+	copy(leaf.keys[i*leaf.width:], leaf.keys[(i+1)*leaf.width:])
+	leaf.keys = leaf.keys[:(n-1)*leaf.width]
+	//give back the memory of a shrinking leaf
+	if cap(leaf.values)-leaf.len() >= 2*PACKED_LEAF_GROW {
+		leaf.reset(leaf.decode(), leaf.values)
+	}
+}
+
+func (leaf *packedLeaf) memoryUsed() uint64 {
+	return uint64(unsafe.Sizeof(*leaf)) + uint64(cap(leaf.keys)) + uint64(cap(leaf.values))*8
+}
+
+/*
+packedTree is the index with the least memory, it is a sorted list of the packed leaves,
+an entry takes about 8 bytes of the value and 1 to 8 bytes of the key, depending on how dense
+the lumpids are. The lookups are binary searches, the inserts move at most a leaf.
+If pager is not nil, the leaves are spilled to a file when they take too much memory.
+*/
+type packedTree struct {
+	leaves []*packedLeaf
+	count  uint64
+	pager  *leafPager
+}
+
+func newPackedTree() *packedTree {
+	return &packedTree{}
+}
+
+//leafOf returns the last leaf whose base is not bigger than k, -1 if k is less than all the bases
+func (tree *packedTree) leafOf(k uint64) int {
+	return sort.Search(len(tree.leaves), func(i int) bool { return tree.leaves[i].base > k }) - 1
+}
+
+//leafAt returns the l-th leaf, which is read back if it was spilled
+func (tree *packedTree) leafAt(l int) *packedLeaf {
+	leaf := tree.leaves[l]
+	if tree.pager != nil {
+		tree.pager.load(leaf)
+	}
+	return leaf
+}
+
+func (tree *packedTree) modified(leaf *packedLeaf) {
+	if tree.pager != nil {
+		tree.pager.modified(leaf)
+	}
+}
+
+//done spills the least recently used leaves if the memory limit is exceeded
+func (tree *packedTree) done() {
+	if tree.pager != nil {
+		tree.pager.shrink()
+	}
+}
+
+func (tree *packedTree) Insert(k uint64, v uint64) {
+	defer tree.done()
+	if len(tree.leaves) == 0 {
+		leaf := newPackedLeaf([]uint64{k}, []uint64{v})
+		tree.leaves = []*packedLeaf{leaf}
+		tree.modified(leaf)
+		tree.count++
+		return
+	}
+	l := tree.leafOf(k)
+	if l < 0 {
+		l = 0
+	}
+	leaf := tree.leafAt(l)
+	i, found := leaf.search(k)
+	if found {
+		leaf.values[i] = v
+		tree.modified(leaf)
+		return
+	}
+	tree.count++
+	if leaf.len() < PACKED_LEAF_SIZE {
+		leaf.insert(i, k, v)
+		tree.modified(leaf)
+		return
+	}
+	//the lumpids are usually put in order, the last leaf is not split but followed by a new one
+	if l == len(tree.leaves)-1 && i == leaf.len() {
+		right := newPackedLeaf([]uint64{k}, []uint64{v})
+		tree.insertLeaf(l+1, right)
+		tree.modified(right)
+		return
+	}
+	keys := leaf.decode()
+	half := len(keys) / 2
+	//the right half is copied before the leaf is reset to the left half
+	right := newPackedLeaf(keys[half:], leaf.values[half:])
+	leaf.reset(keys[:half], leaf.values[:half])
+	if i < half {
+		leaf.insert(i, k, v)
+	} else {
+		right.insert(i-half, k, v)
+	}
+	tree.insertLeaf(l+1, right)
+	tree.modified(leaf)
+	tree.modified(right)
+}
+
+func (tree *packedTree) insertLeaf(l int, leaf *packedLeaf) {
+	tree.leaves = append(tree.leaves, nil)
+	copy(tree.leaves[l+1:], tree.leaves[l:])
+	tree.leaves[l] = leaf
+}
+
+func (tree *packedTree) Delete(k uint64) bool {
+	defer tree.done()
+	l := tree.leafOf(k)
+	if l < 0 {
+		return false
+	}
+	leaf := tree.leafAt(l)
+	i, found := leaf.search(k)
+	if !found {
+		return false
+	}
+	tree.count--
+	if leaf.len() > 1 {
+		leaf.remove(i)
+		tree.modified(leaf)
+		return true
+	}
+	if tree.pager != nil {
+		tree.pager.forget(leaf)
+	}
+	copy(tree.leaves[l:], tree.leaves[l+1:])
+	tree.leaves[len(tree.leaves)-1] = nil
+	tree.leaves = tree.leaves[:len(tree.leaves)-1]
+	return true
+}
+
+func (tree *packedTree) Get(k uint64) (uint64, bool) {
+	defer tree.done()
+	l := tree.leafOf(k)
+	if l < 0 {
+		return 0, false
+	}
+	leaf := tree.leafAt(l)
+	if i, found := leaf.search(k); found {
+		return leaf.values[i], true
+	}
+	return 0, false
+}
+
+//First returns the first entry whose key is not less than k
+func (tree *packedTree) First(k uint64) (uint64, uint64, bool) {
+	defer tree.done()
+	l := tree.leafOf(k)
+	if l < 0 {
+		l = 0
+	}
+	for ; l < len(tree.leaves); l++ {
+		leaf := tree.leafAt(l)
+		if i, _ := leaf.search(k); i < leaf.len() {
+			return leaf.key(i), leaf.values[i], true
+		}
+	}
+	return 0, 0, false
+}
+
+//Next returns the first entry whose key is bigger than k
+func (tree *packedTree) Next(k uint64) (uint64, uint64, bool) {
+	if k == math.MaxUint64 {
+		return 0, 0, false
+	}
+	return tree.First(k + 1)
+}
+
+//Last returns the last entry whose key is not bigger than k
+func (tree *packedTree) Last(k uint64) (uint64, uint64, bool) {
+	defer tree.done()
+	for l := tree.leafOf(k); l >= 0; l-- {
+		leaf := tree.leafAt(l)
+		i, found := leaf.search(k)
+		if found {
+			return k, leaf.values[i], true
+		}
+		if i > 0 {
+			return leaf.key(i - 1), leaf.values[i-1], true
+		}
+	}
+	return 0, 0, false
+}
+
+//FirstEmpty returns the first key not less than k which is not in the tree
+func (tree *packedTree) FirstEmpty(k uint64) (uint64, bool) {
+	n, _, ok := tree.First(k)
+	for ok && n == k {
+		if k == math.MaxUint64 {
+			return 0, false
+		}
+		k++
+		n, _, ok = tree.Next(n)
+	}
+	return k, true
+}
+
+func (tree *packedTree) CountAll() uint64 {
+	return tree.count
+}
+
+//MemoryUsed does not count the spilled entries
+func (tree *packedTree) MemoryUsed() uint64 {
+	used := uint64(cap(tree.leaves)) * uint64(unsafe.Sizeof(uintptr(0)))
+	for _, leaf := range tree.leaves {
+		used += leaf.memoryUsed()
+	}
+	return used
+}
@@ -0,0 +1,118 @@
+package lumpindex
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//checkTree compares all the methods of the tree with the sorted keys of the model
+func checkTree(t *testing.T, tree *packedTree, model map[uint64]uint64, probes []uint64) {
+	keys := make([]uint64, 0, len(model))
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	assert.Equal(t, uint64(len(keys)), tree.CountAll())
+
+	var got []uint64
+	k, v, ok := tree.First(0)
+	for ok {
+		assert.Equal(t, model[k], v)
+		got = append(got, k)
+		k, v, ok = tree.Next(k)
+	}
+	assert.Equal(t, len(keys), len(got))
+	assert.True(t, len(got) == 0 || assert.ObjectsAreEqual(keys, got))
+
+	for _, p := range probes {
+		i := sort.Search(len(keys), func(i int) bool { return keys[i] >= p })
+		k, _, ok = tree.First(p)
+		assert.Equal(t, i < len(keys), ok)
+		if ok {
+			assert.Equal(t, keys[i], k)
+		}
+		j := sort.Search(len(keys), func(i int) bool { return keys[i] > p }) - 1
+		k, _, ok = tree.Last(p)
+		assert.Equal(t, j >= 0, ok)
+		if ok {
+			assert.Equal(t, keys[j], k)
+		}
+		_, found := model[p]
+		_, ok = tree.Get(p)
+		assert.Equal(t, found, ok)
+	}
+}
+
+func TestPackedTreeRandom(t *testing.T) {
+	rand.Seed(1)
+	tree := newPackedTree()
+	model := make(map[uint64]uint64)
+	var probes []uint64
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 3000; i++ {
+			var k uint64
+			switch rand.Intn(3) {
+			case 0:
+				k = rand.Uint64()
+			case 1:
+				k = uint64(rand.Intn(5000))
+			default:
+				k = math.MaxUint64 - uint64(rand.Intn(100))
+			}
+			v := rand.Uint64()
+			tree.Insert(k, v)
+			model[k] = v
+			probes = append(probes, k, k+1, k-1)
+		}
+		for k := range model {
+			if rand.Intn(3) == 0 {
+				assert.True(t, tree.Delete(k))
+				delete(model, k)
+			}
+		}
+		assert.False(t, tree.Delete(12345678901))
+		checkTree(t, tree, model, probes[len(probes)-300:])
+	}
+	for k := range model {
+		tree.Delete(k)
+	}
+	assert.Equal(t, 0, len(tree.leaves))
+	_, _, ok := tree.First(0)
+	assert.False(t, ok)
+}
+
+func TestPackedTreeFirstEmpty(t *testing.T) {
+	tree := newPackedTree()
+	for _, k := range []uint64{0, 1, 2, 4, math.MaxUint64} {
+		tree.Insert(k, k)
+	}
+	k, ok := tree.FirstEmpty(0)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), k)
+	k, ok = tree.FirstEmpty(4)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), k)
+	_, ok = tree.FirstEmpty(math.MaxUint64)
+	assert.False(t, ok)
+}
+
+func TestPackedTreeMemory(t *testing.T) {
+	tree := newPackedTree()
+	judyTree := newIndexTree(TREE_JUDY)
+	n := 100000
+	for i := 0; i < n; i++ {
+		tree.Insert(uint64(i)*3+1000000, uint64(i))
+		judyTree.Insert(uint64(i)*3+1000000, uint64(i))
+	}
+	//the keys take 2 bytes, the leaves are full if the lumpids are put in order
+	assert.True(t, tree.MemoryUsed() < uint64(n)*11)
+	assert.True(t, tree.MemoryUsed() < judyTree.MemoryUsed())
+	for i := 0; i < n; i += 2 {
+		tree.Delete(uint64(i)*3 + 1000000)
+	}
+	assert.True(t, tree.MemoryUsed() < uint64(n/2)*13)
+}
@@ -0,0 +1,206 @@
+package lumpindex
+
+import (
+	"container/list"
+	"encoding/binary"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+const (
+	PAGE_HEADER_SIZE = 8
+	//a page holds a full leaf: the header, the keys of at most 8 bytes and the values
+	PAGE_SIZE = PAGE_HEADER_SIZE + PACKED_LEAF_SIZE*16
+)
+
+//leafPage is the state of a leaf of a spilled tree
+type leafPage struct {
+	//the page of the leaf in the spill file, -1 if it was never written
+	slot int64
+	//the entries are in the file only, keys and values are nil
+	spilled bool
+	//the entries in memory are newer than the page
+	dirty bool
+	//the element in leafPager.lru if the leaf is in memory
+	elem *list.Element
+	//the memory of the leaf counted in leafPager.used
+	accounted uint64
+}
+
+/*
+leafPager keeps the leaves of a packedTree under a memory limit, the least recently used leaves
+are written to their pages in the spill file and dropped from memory, and read back when they
+are used again. The bases of the leaves are always in memory, so a lookup reads at most a page.
+
+The spill file is not a part of the storage, the index is restored from the journal or the
+checkpoint when the storage is opened, so the file is truncated when it is created, and removed
+when the index is closed. As the tree methods could not return errors, the first io error of the
+spill file is kept in err, see LumpIndex.Err. The leaves are not spilled after it, and a leaf which
+could not be read back is empty, so the index is broken until it is restored again.
+*/
+type leafPager struct {
+	file  *os.File
+	limit uint64
+	used  uint64
+	//the front is the most recently used leaf
+	lru *list.List
+	//the number of the pages in the file, and the pages of the deleted leaves
+	pages uint64
+	free  []int64
+	buf   []byte
+	err   error
+}
+
+func newLeafPager(path string, limit uint64) (*leafPager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create the index spill file %s", path)
+	}
+	return &leafPager{
+		file:  file,
+		limit: limit,
+		lru:   list.New(),
+		buf:   make([]byte, PAGE_SIZE),
+	}, nil
+}
+
+//load reads the leaf back if it was spilled, and marks it as the most recently used
+func (pager *leafPager) load(leaf *packedLeaf) {
+	if leaf.page.spilled {
+		if err := pager.read(leaf); err != nil {
+			pager.fail(err)
+			leaf.width, leaf.keys, leaf.values = 1, nil, nil
+		}
+		leaf.page.spilled = false
+		leaf.page.dirty = false
+	}
+	if leaf.page.elem == nil {
+		leaf.page.elem = pager.lru.PushFront(leaf)
+		pager.account(leaf)
+	} else {
+		pager.lru.MoveToFront(leaf.page.elem)
+	}
+}
+
+//modified is called after the entries of the leaf are changed
+func (pager *leafPager) modified(leaf *packedLeaf) {
+	pager.load(leaf)
+	leaf.page.dirty = true
+	pager.account(leaf)
+}
+
+func (pager *leafPager) account(leaf *packedLeaf) {
+	pager.used -= leaf.page.accounted
+	leaf.page.accounted = leaf.memoryUsed()
+	pager.used += leaf.page.accounted
+}
+
+//forget is called when the leaf is deleted from the tree, its page is reused
+func (pager *leafPager) forget(leaf *packedLeaf) {
+	if leaf.page.elem != nil {
+		pager.lru.Remove(leaf.page.elem)
+		leaf.page.elem = nil
+		pager.used -= leaf.page.accounted
+		leaf.page.accounted = 0
+	}
+	if leaf.page.slot >= 0 {
+		pager.free = append(pager.free, leaf.page.slot)
+		leaf.page.slot = -1
+	}
+}
+
+//shrink spills the least recently used leaves until the memory is under the limit
+func (pager *leafPager) shrink() {
+	for pager.err == nil && pager.used > pager.limit && pager.lru.Len() > 0 {
+		pager.spill(pager.lru.Back().Value.(*packedLeaf))
+	}
+}
+
+func (pager *leafPager) spill(leaf *packedLeaf) {
+	if leaf.page.dirty || leaf.page.slot < 0 {
+		//the leaf is kept in memory if it could not be written
+		if err := pager.write(leaf); err != nil {
+			pager.fail(err)
+			return
+		}
+		leaf.page.dirty = false
+	}
+	pager.lru.Remove(leaf.page.elem)
+	leaf.page.elem = nil
+	pager.used -= leaf.page.accounted
+	leaf.page.accounted = 0
+	leaf.keys, leaf.values = nil, nil
+	leaf.page.spilled = true
+}
+
+/*
+the layout of a page:
+
+	| width (1) | padding (5) | the number of entries (2) | keys | values |
+*/
+func (pager *leafPager) write(leaf *packedLeaf) error {
+	if leaf.page.slot < 0 {
+		if n := len(pager.free); n > 0 {
+			leaf.page.slot = pager.free[n-1]
+			pager.free = pager.free[:n-1]
+		} else {
+			leaf.page.slot = int64(pager.pages)
+			pager.pages++
+		}
+	}
+	buf := pager.buf
+	for i := range buf[:PAGE_HEADER_SIZE] {
+		buf[i] = 0
+	}
+	buf[0] = byte(leaf.width)
+	binary.LittleEndian.PutUint16(buf[6:], uint16(leaf.len()))
+	offset := PAGE_HEADER_SIZE + copy(buf[PAGE_HEADER_SIZE:], leaf.keys)
+	for _, v := range leaf.values {
+		binary.LittleEndian.PutUint64(buf[offset:], v)
+		offset += 8
+	}
+	_, err := pager.file.WriteAt(buf[:offset], leaf.page.slot*PAGE_SIZE)
+	return internalerror.NewIOError("write the index spill file", err)
+}
+
+func (pager *leafPager) read(leaf *packedLeaf) error {
+	buf := pager.buf
+	if _, err := pager.file.ReadAt(buf[:PAGE_HEADER_SIZE], leaf.page.slot*PAGE_SIZE); err != nil {
+		return internalerror.NewIOError("read the index spill file", err)
+	}
+	width := int(buf[0])
+	n := int(binary.LittleEndian.Uint16(buf[6:]))
+	if width == 0 || width > 8 || n == 0 || n > PACKED_LEAF_SIZE {
+		return internalerror.NewIOError("read the index spill file", errors.Errorf("invalid page %d", leaf.page.slot))
+	}
+	size := n * (width + 8)
+	if _, err := pager.file.ReadAt(buf[:size], leaf.page.slot*PAGE_SIZE+PAGE_HEADER_SIZE); err != nil {
+		return internalerror.NewIOError("read the index spill file", err)
+	}
+	leaf.width = width
+	leaf.keys = make([]byte, n*width, growTo(n)*width)
+	copy(leaf.keys, buf)
+	leaf.values = make([]uint64, n, growTo(n))
+	for i := range leaf.values {
+		leaf.values[i] = binary.LittleEndian.Uint64(buf[n*width+i*8:])
+	}
+	return nil
+}
+
+//fail keeps the first error of the spill file
+func (pager *leafPager) fail(err error) {
+	if pager.err == nil {
+		pager.err = err
+	}
+}
+
+//close removes the spill file
+func (pager *leafPager) close() error {
+	path := pager.file.Name()
+	if err := pager.file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close the index spill file")
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,91 @@
+package lumpindex
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func TestSpilledTree(t *testing.T) {
+	path := "spill.tmp"
+	defer os.Remove(path)
+	index, err := NewSpilledIndex(path, 16<<10)
+	assert.Nil(t, err)
+	tree := index.tree.(*packedTree)
+	pager := tree.pager
+
+	rand.Seed(2)
+	model := make(map[uint64]uint64)
+	var probes []uint64
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20000; i++ {
+			k := uint64(rand.Intn(100000))
+			if rand.Intn(2) == 0 {
+				k = rand.Uint64()
+			}
+			v := rand.Uint64()
+			tree.Insert(k, v)
+			model[k] = v
+			probes = append(probes, k, k+1)
+			assert.True(t, pager.used <= pager.limit)
+		}
+		for k := range model {
+			if rand.Intn(4) == 0 {
+				assert.True(t, tree.Delete(k))
+				delete(model, k)
+			}
+		}
+		checkTree(t, tree, model, probes[len(probes)-500:])
+	}
+	//most leaves are in the file
+	assert.True(t, tree.MemoryUsed() < uint64(len(model))*2)
+	assert.True(t, len(pager.free) > 0 || pager.pages > 0)
+
+	for k := range model {
+		tree.Delete(k)
+	}
+	assert.Equal(t, 0, len(tree.leaves))
+	assert.Equal(t, uint64(0), pager.used)
+	assert.Equal(t, pager.pages, uint64(len(pager.free)))
+
+	assert.Nil(t, index.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSpilledTreeError(t *testing.T) {
+	path := "spill_error.tmp"
+	defer os.Remove(path)
+	index, err := NewSpilledIndex(path, 4<<10)
+	assert.Nil(t, err)
+	tree := index.tree.(*packedTree)
+	for i := 0; i < 10000; i++ {
+		tree.Insert(uint64(i), uint64(i))
+	}
+	assert.Nil(t, index.Err())
+	assert.True(t, tree.leaves[0].page.spilled)
+
+	//a broken page is not read back
+	_, err = tree.pager.file.WriteAt(make([]byte, PAGE_SIZE), tree.leaves[0].page.slot*PAGE_SIZE)
+	assert.Nil(t, err)
+	_, err = index.Get(lump.FromU64(0, 1))
+	assert.True(t, internalerror.Is(err, internalerror.DeviceError))
+	first := index.Err()
+	assert.NotNil(t, first)
+
+	//the leaves are kept in memory if the file could not be written
+	tree.pager.file.Close()
+	for i := 10000; i < 20000; i++ {
+		tree.Insert(uint64(i), uint64(i))
+	}
+	assert.Equal(t, first, index.Err())
+	_, err = index.Get(lump.FromU64(0, 19999))
+	assert.True(t, internalerror.Is(err, internalerror.DeviceError))
+	v, ok := tree.Get(19999)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(19999), v)
+}
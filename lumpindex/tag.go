@@ -0,0 +1,76 @@
+package lumpindex
+
+import (
+	"sort"
+
+	"github.com/thesues/cannyls-go/lump"
+)
+
+//SetTag tags the lump after it is inserted, an empty tag is ignored
+func (index *LumpIndex) SetTag(id lump.LumpId, tag string) {
+	if tag == "" {
+		return
+	}
+	index.clearTag(id.U64())
+	if index.tags == nil {
+		index.tags = make(map[uint64]string)
+		index.byTag = make(map[string]map[uint64]struct{})
+	}
+	index.tags[id.U64()] = tag
+	ids, ok := index.byTag[tag]
+	if !ok {
+		ids = make(map[uint64]struct{})
+		index.byTag[tag] = ids
+	}
+	ids[id.U64()] = struct{}{}
+}
+
+//Tag returns the user tag of the lump, ok is false if the lump is not tagged
+func (index *LumpIndex) Tag(id lump.LumpId) (tag string, ok bool) {
+	if len(index.tags) == 0 {
+		return "", false
+	}
+	tag, ok = index.tags[id.U64()]
+	return
+}
+
+//ListByTag returns at most limit lumpids with the tag ordered by lumpid, limit <= 0 means no limit
+func (index *LumpIndex) ListByTag(tag string, limit int) []lump.LumpId {
+	return index.ListByTagLive(tag, limit, 0)
+}
+
+//ListByTagLive is the same as ListByTag, but the lumps which expire at or before now are skipped
+func (index *LumpIndex) ListByTagLive(tag string, limit int, now uint64) []lump.LumpId {
+	ids := index.byTag[tag]
+	nums := make([]uint64, 0, len(ids))
+	for id := range ids {
+		if !index.expiredAt(id, now) {
+			nums = append(nums, id)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	if limit > 0 && len(nums) > limit {
+		nums = nums[:limit]
+	}
+	vec := make([]lump.LumpId, len(nums))
+	for i, n := range nums {
+		vec[i] = lump.FromU64(0, n)
+	}
+	return vec
+}
+
+func (index *LumpIndex) clearTag(id uint64) {
+	if len(index.tags) == 0 {
+		return
+	}
+	tag, ok := index.tags[id]
+	if !ok {
+		return
+	}
+	delete(index.tags, id)
+	if ids := index.byTag[tag]; len(ids) > 1 {
+		delete(ids, id)
+	} else {
+		delete(index.byTag, tag)
+	}
+}
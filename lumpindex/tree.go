@@ -0,0 +1,44 @@
+package lumpindex
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	judy "github.com/thesues/go-judy"
+)
+
+//indexTree maps the lumpids to the encoded portions, it is implemented by judy.JudyL and packedTree
+type indexTree interface {
+	Insert(k uint64, v uint64)
+	Delete(k uint64) bool
+	Get(k uint64) (uint64, bool)
+	First(k uint64) (uint64, uint64, bool)
+	Next(k uint64) (uint64, uint64, bool)
+	Last(k uint64) (uint64, uint64, bool)
+	FirstEmpty(k uint64) (uint64, bool)
+	CountAll() uint64
+	MemoryUsed() uint64
+}
+
+type TreeKind int
+
+const (
+	//TREE_JUDY is the JudyL array of libjudy, it is the default
+	TREE_JUDY TreeKind = iota
+	//TREE_PACKED is packedTree, it takes less memory if the lumpids are dense, such as the
+	//lumpids put in order, and it is in go heap, so it is freed by go gc
+	TREE_PACKED
+)
+
+func (kind TreeKind) Validate() error {
+	if kind != TREE_JUDY && kind != TREE_PACKED {
+		return errors.Wrapf(internalerror.InvalidInput, "unknown index tree %d", kind)
+	}
+	return nil
+}
+
+func newIndexTree(kind TreeKind) indexTree {
+	if kind == TREE_PACKED {
+		return newPackedTree()
+	}
+	return &judy.JudyL{}
+}
@@ -0,0 +1,105 @@
+/*
+Package metrics exports the metrics of storage to prometheus.
+
+	m, err := metrics.NewStorageMetrics(prometheus.DefaultRegisterer, "cannyls")
+	store.SetObserver(m)
+*/
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+//StorageMetrics implements storage.Observer
+type StorageMetrics struct {
+	latency            *prometheus.HistogramVec
+	failures           *prometheus.CounterVec
+	allocationFailures prometheus.Counter
+	journalGC          prometheus.Counter
+	journalSyncs       prometheus.Counter
+	throttleSeconds    prometheus.Counter
+	throttleRejections prometheus.Counter
+}
+
+//NewStorageMetrics registers the metrics to registerer, all the names are prefixed with namespace
+func NewStorageMetrics(registerer prometheus.Registerer, namespace string) (*StorageMetrics, error) {
+	m := &StorageMetrics{
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "The latency of storage operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"op"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operation_failures_total",
+			Help:      "The number of failed storage operations.",
+		}, []string{"op"}),
+		allocationFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "allocation_failures_total",
+			Help:      "The number of puts failed because the data region is full.",
+		}),
+		journalGC: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "journal_gc_runs_total",
+			Help:      "The number of journal GC runs.",
+		}),
+		journalSyncs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "journal_syncs_total",
+			Help:      "The number of journal syncs.",
+		}),
+		throttleSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "journal_throttle_seconds_total",
+			Help:      "The time the journal appends waited for the GC over the high watermark.",
+		}),
+		throttleRejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "journal_throttle_rejections_total",
+			Help:      "The number of journal appends failed fast over the high watermark.",
+		}),
+	}
+
+	collectors := []prometheus.Collector{m.latency, m.failures, m.allocationFailures, m.journalGC, m.journalSyncs,
+		m.throttleSeconds, m.throttleRejections}
+	for i, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			for _, registered := range collectors[:i] {
+				registerer.Unregister(registered)
+			}
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *StorageMetrics) ObserveOperation(op string, duration time.Duration, err error) {
+	m.latency.WithLabelValues(op).Observe(duration.Seconds())
+	if err == nil {
+		return
+	}
+	m.failures.WithLabelValues(op).Inc()
+	if internalerror.Is(err, internalerror.NoFreeSpace) {
+		m.allocationFailures.Inc()
+	}
+}
+
+func (m *StorageMetrics) ObserveGC() {
+	m.journalGC.Inc()
+}
+
+func (m *StorageMetrics) ObserveSync() {
+	m.journalSyncs.Inc()
+}
+
+func (m *StorageMetrics) ObserveThrottle(duration time.Duration, rejected bool) {
+	m.throttleSeconds.Add(duration.Seconds())
+	if rejected {
+		m.throttleRejections.Inc()
+	}
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage"
+)
+
+func TestStorageMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := NewStorageMetrics(registry, "cannyls")
+	assert.Nil(t, err)
+	//registered twice
+	_, err = NewStorageMetrics(registry, "cannyls")
+	assert.Error(t, err)
+
+	store, err := storage.CreateCannylsStorage("metrics.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("metrics.lusf")
+	assert.Nil(t, store.SetObserver(m))
+
+	id, _ := lump.FromString("0")
+	_, err = store.Put(id, lump.NewLumpDataAligned(100, block.Min()))
+	assert.Nil(t, err)
+	_, err = store.Get(id)
+	assert.Nil(t, err)
+	//too large for the data region
+	_, err = store.Put(id, lump.NewLumpDataAligned(2*1024*1024, block.Min()))
+	assert.Error(t, err)
+	store.Delete(id)
+	_, err = store.Get(id)
+	assert.Error(t, err)
+	assert.Nil(t, store.JournalSync())
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.failures.WithLabelValues(storage.OP_GET)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.failures.WithLabelValues(storage.OP_PUT)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.allocationFailures))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.journalSyncs))
+	store.Close()
+}
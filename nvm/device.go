@@ -0,0 +1,98 @@
+package nvm
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+/*
+OpenBlockDevice opens a raw block device, such as /dev/nvme0n1, as a FileNVM without reading the
+storage header, so it could be formatted by storage.CreateCannylsStorageOnNVM. The capacity is the
+size of the device and the block size is its physical sector size. A block device is never
+truncated, and every I/O must be aligned to the block size.
+*/
+func OpenBlockDevice(path string, options FileOptions) (*FileNVM, error) {
+	if !isBlockDevice(path) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "%s is not a block device", path)
+	}
+	f, directIO, err := openFile(path, os.O_RDWR, options.DirectIO)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open device %s", path)
+	}
+	if err = lockFileWithExclusiveLock(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, blockSize, err := detectBlockSize(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size, err := blockDeviceSize(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileNVM{
+		file:            f,
+		cursor_position: 0,
+		view_start:      0,
+		view_end:        blockSize.FloorAlign(size),
+		splited:         false,
+		bufferedIO:      !directIO,
+		lockMode:        LOCK_EXCLUSIVE,
+		block_size:      blockSize,
+		device:          true,
+	}, nil
+}
+
+func isBlockDevice(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
+
+func isDevice(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
+
+/*
+detectBlockSize returns the logical and physical sector size of a block device, they are
+block.Min() for a regular file. The logical one is the alignment required by O_DIRECT,
+writing less than the physical one makes the drive read-modify-write.
+*/
+func detectBlockSize(f *os.File) (logical block.BlockSize, physical block.BlockSize, err error) {
+	if !isDevice(f) {
+		return block.Min(), block.Min(), nil
+	}
+	logicalSize, physicalSize, err := sectorSize(f)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to get the sector size of %s", f.Name())
+	}
+	if logicalSize > 0xFFFF {
+		return 0, 0, errors.Wrapf(internalerror.InvalidInput, "unsupported sector size %d", logicalSize)
+	}
+	if logical, err = block.NewBlockSize(uint16(logicalSize)); err != nil {
+		return 0, 0, err
+	}
+	//the physical sector size is only a hint
+	physical = logical
+	if physicalSize <= 0xFFFF {
+		if bs, err := block.NewBlockSize(uint16(physicalSize)); err == nil && bs.Contains(logical) {
+			physical = bs
+		}
+	}
+	return logical, physical, nil
+}
+
+//blockDeviceSize returns the size of a block device in bytes
+func blockDeviceSize(f *os.File) (uint64, error) {
+	size, err := deviceBytes(f)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get the size of %s", f.Name())
+	}
+	return size, nil
+}
@@ -0,0 +1,237 @@
+package nvm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+const (
+	//every sector of ENCRYPTION_SECTOR_SIZE bytes is encrypted with its number as the tweak
+	ENCRYPTION_SECTOR_SIZE = 512
+)
+
+//KeyProvider returns the key of EncryptedNVM, 32 bytes for AES-128-XTS or 64 bytes for AES-256-XTS
+type KeyProvider interface {
+	Key() ([]byte, error)
+}
+
+//StaticKey is a KeyProvider which always returns the same key
+type StaticKey []byte
+
+func (key StaticKey) Key() ([]byte, error) {
+	return key, nil
+}
+
+/*
+xtsCipher is AES-XTS of IEEE 1619, the first half of the key encrypts the data and the second
+half encrypts the tweak. The data unit is always a multiple of the AES block, so there is no
+ciphertext stealing.
+*/
+type xtsCipher struct {
+	data  cipher.Block
+	tweak cipher.Block
+}
+
+func newXTSCipher(key []byte) (*xtsCipher, error) {
+	if len(key) != 32 && len(key) != 64 {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "invalid AES-XTS key size %d", len(key))
+	}
+	data, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES-XTS cipher")
+	}
+	tweak, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES-XTS cipher")
+	}
+	return &xtsCipher{data: data, tweak: tweak}, nil
+}
+
+//crypt encrypts or decrypts the data unit src into dst, they could be the same slice
+func (c *xtsCipher) crypt(dst []byte, src []byte, unit uint64, encrypt bool) {
+	var tweak, buf [aes.BlockSize]byte
+	binary.LittleEndian.PutUint64(tweak[:8], unit)
+	c.tweak.Encrypt(tweak[:], tweak[:])
+
+	for i := 0; i < len(src); i += aes.BlockSize {
+		for j := range buf {
+			buf[j] = src[i+j] ^ tweak[j]
+		}
+		if encrypt {
+			c.data.Encrypt(buf[:], buf[:])
+		} else {
+			c.data.Decrypt(buf[:], buf[:])
+		}
+		for j := range buf {
+			dst[i+j] = buf[j] ^ tweak[j]
+		}
+		mulAlpha(&tweak)
+	}
+}
+
+//mulAlpha multiplies the tweak by x in GF(2^128), the tweak is little endian
+func mulAlpha(tweak *[aes.BlockSize]byte) {
+	var carry byte
+	for i := range tweak {
+		next := tweak[i] >> 7
+		tweak[i] = tweak[i]<<1 | carry
+		carry = next
+	}
+	if carry != 0 {
+		tweak[0] ^= 0x87
+	}
+}
+
+/*
+EncryptedNVM encrypts the data written to the inner NonVolatileMemory with AES-XTS, every sector
+of ENCRYPTION_SECTOR_SIZE bytes is tweaked by its offset in the unsplited EncryptedNVM, so the
+same data is encrypted differently in different sectors. The buffers of the caller are never
+changed by Write.
+
+The blocks which are never written are not encrypted zeros, they are read as garbage, but the
+storage never reads the blocks it has not written. EncryptedNVM is not a HolePuncher, because
+a hole would be read as garbage too.
+*/
+type EncryptedNVM struct {
+	inner  NonVolatileMemory
+	cipher *xtsCipher
+	//the offset of inner in the unsplited EncryptedNVM, it is the tweak of the first sector
+	base uint64
+}
+
+//NewEncryptedNVM wraps inner, the key is read from the provider once
+func NewEncryptedNVM(inner NonVolatileMemory, provider KeyProvider) (*EncryptedNVM, error) {
+	key, err := provider.Key()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the encryption key")
+	}
+	if len(key) >= 32 && bytes.Equal(key[:len(key)/2], key[len(key)/2:]) {
+		return nil, errors.Wrap(internalerror.InvalidInput, "the two halves of AES-XTS key must be different")
+	}
+	c, err := newXTSCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedNVM{inner: inner, cipher: c}, nil
+}
+
+//OpenEncryptedNVM wraps inner and reads the storage header, a wrong key fails here
+func OpenEncryptedNVM(inner NonVolatileMemory, provider KeyProvider) (*EncryptedNVM, *StorageHeader, error) {
+	nvm, err := NewEncryptedNVM(inner, provider)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := ReadHeader(nvm)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decrypt storage header, the key may be wrong")
+	}
+	return nvm, header, nil
+}
+
+func (nvm *EncryptedNVM) encrypt(buf []byte, offset uint64) []byte {
+	encrypted := block.NewAlignedBytes(len(buf), nvm.inner.BlockSize()).AsBytes()
+	for i := 0; i < len(buf); i += ENCRYPTION_SECTOR_SIZE {
+		nvm.cipher.crypt(encrypted[i:i+ENCRYPTION_SECTOR_SIZE], buf[i:i+ENCRYPTION_SECTOR_SIZE],
+			(nvm.base+offset+uint64(i))/ENCRYPTION_SECTOR_SIZE, true)
+	}
+	return encrypted
+}
+
+func (nvm *EncryptedNVM) decrypt(buf []byte, offset uint64) {
+	for i := 0; i+ENCRYPTION_SECTOR_SIZE <= len(buf); i += ENCRYPTION_SECTOR_SIZE {
+		nvm.cipher.crypt(buf[i:i+ENCRYPTION_SECTOR_SIZE], buf[i:i+ENCRYPTION_SECTOR_SIZE],
+			(nvm.base+offset+uint64(i))/ENCRYPTION_SECTOR_SIZE, false)
+	}
+}
+
+func checkSectors(length int) error {
+	if length%ENCRYPTION_SECTOR_SIZE != 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "not aligned :%d to the encryption sector", length)
+	}
+	return nil
+}
+
+func (nvm *EncryptedNVM) Read(buf []byte) (int, error) {
+	if err := checkSectors(len(buf)); err != nil {
+		return -1, err
+	}
+	position := nvm.inner.Position()
+	n, err := nvm.inner.Read(buf)
+	if n > 0 {
+		nvm.decrypt(buf[:n], position)
+	}
+	return n, err
+}
+
+func (nvm *EncryptedNVM) Write(buf []byte) (int, error) {
+	if err := checkSectors(len(buf)); err != nil {
+		return -1, err
+	}
+	return nvm.inner.Write(nvm.encrypt(buf, nvm.inner.Position()))
+}
+
+func (nvm *EncryptedNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	if err := checkSectors(len(buf)); err != nil {
+		return 0, err
+	}
+	n, err := nvm.inner.ReadAt(buf, offset)
+	if n > 0 {
+		nvm.decrypt(buf[:n], uint64(offset))
+	}
+	return n, err
+}
+
+func (nvm *EncryptedNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := checkSectors(len(buf)); err != nil {
+		return 0, err
+	}
+	return nvm.inner.WriteAt(nvm.encrypt(buf, uint64(offset)), offset)
+}
+
+//Writev encrypts the buffers into one buffer, a sector may span two buffers
+func (nvm *EncryptedNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	return nvm.WriteAt(Coalesce(bufs, nvm.BlockSize()), offset)
+}
+
+func (nvm *EncryptedNVM) Seek(offset int64, whence int) (int64, error) {
+	return nvm.inner.Seek(offset, whence)
+}
+
+func (nvm *EncryptedNVM) Close() error {
+	return nvm.inner.Close()
+}
+
+func (nvm *EncryptedNVM) Sync() error {
+	return nvm.inner.Sync()
+}
+
+func (nvm *EncryptedNVM) Position() uint64 {
+	return nvm.inner.Position()
+}
+
+func (nvm *EncryptedNVM) Capacity() uint64 {
+	return nvm.inner.Capacity()
+}
+
+func (nvm *EncryptedNVM) BlockSize() block.BlockSize {
+	return nvm.inner.BlockSize()
+}
+
+func (nvm *EncryptedNVM) RawSize() int64 {
+	return nvm.inner.RawSize()
+}
+
+func (nvm *EncryptedNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	left, right, err := nvm.inner.Split(position)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &EncryptedNVM{inner: left, cipher: nvm.cipher, base: nvm.base},
+		&EncryptedNVM{inner: right, cipher: nvm.cipher, base: nvm.base + position}, nil
+}
@@ -0,0 +1,79 @@
+package nvm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+func testKey(a byte, b byte) StaticKey {
+	return StaticKey(append(bytes.Repeat([]byte{a}, 16), bytes.Repeat([]byte{b}, 16)...))
+}
+
+//the vectors of IEEE 1619
+func TestXTSVectors(t *testing.T) {
+	c, err := newXTSCipher(make([]byte, 32))
+	assert.Nil(t, err)
+	buf := make([]byte, 32)
+	c.crypt(buf, buf, 0, true)
+	assert.Equal(t, "917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e", hex.EncodeToString(buf))
+
+	c, err = newXTSCipher(testKey(0x11, 0x22))
+	assert.Nil(t, err)
+	buf = bytes.Repeat([]byte{0x44}, 32)
+	c.crypt(buf, buf, 0x3333333333, true)
+	assert.Equal(t, "c454185e6a16936e39334038acef838bfb186fff7480adc4289382ecd6d394f0", hex.EncodeToString(buf))
+	c.crypt(buf, buf, 0x3333333333, false)
+	assert.Equal(t, bytes.Repeat([]byte{0x44}, 32), buf)
+}
+
+func TestEncryptedNVM(t *testing.T) {
+	inner, _ := New(2048)
+	_, err := NewEncryptedNVM(inner, StaticKey(make([]byte, 16)))
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+	_, err = NewEncryptedNVM(inner, testKey(1, 1))
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	nvm, err := NewEncryptedNVM(inner, testKey(1, 2))
+	assert.Nil(t, err)
+
+	plain := newBuffer(1024, 7)
+	n, err := nvm.WriteAt(plain, 512)
+	assert.Nil(t, err)
+	assert.Equal(t, 1024, n)
+	//the buffer of the caller is not changed
+	assert.Equal(t, newBuffer(1024, 7), plain)
+	//the same data is encrypted differently in every sector
+	assert.NotEqual(t, plain[:512], inner.vec[512:1024])
+	assert.NotEqual(t, inner.vec[512:1024], inner.vec[1024:1536])
+
+	buf := make([]byte, 1024)
+	_, err = nvm.ReadAt(buf, 512)
+	assert.Nil(t, err)
+	assert.Equal(t, plain, buf)
+
+	//the sectors of the splited one are tweaked by the offset in the whole one
+	_, right, err := nvm.Split(1024)
+	assert.Nil(t, err)
+	_, err = right.ReadAt(buf[:512], 0)
+	assert.Nil(t, err)
+	assert.Equal(t, plain[:512], buf[:512])
+	_, err = right.Write(newBuffer(512, 9))
+	assert.Nil(t, err)
+	_, err = nvm.Seek(1024, 0)
+	assert.Nil(t, err)
+	_, err = nvm.Read(buf[:512])
+	assert.Nil(t, err)
+	assert.Equal(t, newBuffer(512, 9), buf[:512])
+
+	//a wrong key reads garbage
+	wrong, err := NewEncryptedNVM(inner, testKey(1, 3))
+	assert.Nil(t, err)
+	_, err = wrong.ReadAt(buf, 512)
+	assert.Nil(t, err)
+	assert.NotEqual(t, plain, buf)
+}
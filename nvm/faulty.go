@@ -0,0 +1,236 @@
+package nvm
+
+import (
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+/*
+FaultPlan is the failures injected by FaultyNVM. The reads and the writes are counted from 1
+by the FaultyNVM and all its splits, Read and ReadAt are reads, Write, WriteAt and Writev are
+writes. 0 means the failure is never injected.
+*/
+type FaultPlan struct {
+	//FailWriteAt fails the FailWriteAt-th write with EIO, nothing is written
+	FailWriteAt int
+	//FailReadAt fails the FailReadAt-th read with EIO
+	FailReadAt int
+	//ShortReadAt reads only the first half of the blocks of the ShortReadAt-th read, the rest of
+	//the buffer is not changed, and io.ErrUnexpectedEOF is returned
+	ShortReadAt int
+	//every LatencyEvery-th read or write sleeps for Latency before it is done
+	LatencyEvery int
+	Latency      time.Duration
+	//SilentAfterFailure drops the writes after the injected write failure, they and the syncs
+	//still succeed, as a device which has lost its cache
+	SilentAfterFailure bool
+}
+
+//faultState is shared by a FaultyNVM and all its splits
+type faultState struct {
+	mutex  sync.Mutex
+	plan   FaultPlan
+	reads  int
+	writes int
+	failed bool
+	sleep  func(time.Duration)
+}
+
+/*
+FaultyNVM wraps another NonVolatileMemory and injects the failures of FaultPlan, so the error
+handling of the applications could be tested against a failing device. It is safe to be used
+by several goroutines if the inner one is.
+*/
+type FaultyNVM struct {
+	inner NonVolatileMemory
+	state *faultState
+}
+
+func NewFaultyNVM(inner NonVolatileMemory, plan FaultPlan) *FaultyNVM {
+	return &FaultyNVM{
+		inner: inner,
+		state: &faultState{plan: plan, sleep: time.Sleep},
+	}
+}
+
+//SetPlan replaces the plan, the reads and the writes are counted from 1 again
+func (nvm *FaultyNVM) SetPlan(plan FaultPlan) {
+	state := nvm.state
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.plan = plan
+	state.reads, state.writes = 0, 0
+	state.failed = false
+}
+
+//Reads returns the number of reads since the plan is set
+func (nvm *FaultyNVM) Reads() int {
+	nvm.state.mutex.Lock()
+	defer nvm.state.mutex.Unlock()
+	return nvm.state.reads
+}
+
+//Writes returns the number of writes since the plan is set
+func (nvm *FaultyNVM) Writes() int {
+	nvm.state.mutex.Lock()
+	defer nvm.state.mutex.Unlock()
+	return nvm.state.writes
+}
+
+//Failed returns true if the write failure is injected
+func (nvm *FaultyNVM) Failed() bool {
+	nvm.state.mutex.Lock()
+	defer nvm.state.mutex.Unlock()
+	return nvm.state.failed
+}
+
+//delay sleeps for the latency of the n-th operation
+func (state *faultState) delay(n int) {
+	if state.plan.LatencyEvery > 0 && n%state.plan.LatencyEvery == 0 {
+		state.sleep(state.plan.Latency)
+	}
+}
+
+//nextRead returns the fault of the next read, fail or short
+func (state *faultState) nextRead() (fail bool, short bool) {
+	state.mutex.Lock()
+	state.reads++
+	n := state.reads
+	plan := state.plan
+	state.mutex.Unlock()
+	state.delay(n)
+	return n == plan.FailReadAt, n == plan.ShortReadAt
+}
+
+//nextWrite returns the fault of the next write, fail or silent
+func (state *faultState) nextWrite() (fail bool, silent bool) {
+	state.mutex.Lock()
+	state.writes++
+	n := state.writes
+	silent = state.failed && state.plan.SilentAfterFailure
+	if n == state.plan.FailWriteAt {
+		fail = true
+		state.failed = true
+	}
+	state.mutex.Unlock()
+	state.delay(n)
+	return
+}
+
+func (nvm *FaultyNVM) read(buf []byte, read func([]byte) (int, error)) (int, error) {
+	fail, short := nvm.state.nextRead()
+	if fail {
+		return 0, errors.Wrap(internalerror.NewIOError("read", syscall.EIO), "injected read failure")
+	}
+	if short {
+		half := int(nvm.inner.BlockSize().FloorAlign(uint64(len(buf) / 2)))
+		n, err := read(buf[:half])
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	return read(buf)
+}
+
+//write skips the silent writes, skip moves the cursor for Write
+func (nvm *FaultyNVM) write(length int, write func() (int, error), skip func() error) (int, error) {
+	fail, silent := nvm.state.nextWrite()
+	if fail {
+		return 0, errors.Wrap(internalerror.NewIOError("write", syscall.EIO), "injected write failure")
+	}
+	if silent {
+		if skip != nil {
+			if err := skip(); err != nil {
+				return 0, err
+			}
+		}
+		return length, nil
+	}
+	return write()
+}
+
+func (nvm *FaultyNVM) Read(buf []byte) (int, error) {
+	return nvm.read(buf, nvm.inner.Read)
+}
+
+func (nvm *FaultyNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	return nvm.read(buf, func(b []byte) (int, error) {
+		return nvm.inner.ReadAt(b, offset)
+	})
+}
+
+func (nvm *FaultyNVM) Write(buf []byte) (int, error) {
+	return nvm.write(len(buf), func() (int, error) {
+		return nvm.inner.Write(buf)
+	}, func() error {
+		_, err := nvm.inner.Seek(int64(len(buf)), io.SeekCurrent)
+		return err
+	})
+}
+
+func (nvm *FaultyNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	return nvm.write(len(buf), func() (int, error) {
+		return nvm.inner.WriteAt(buf, offset)
+	}, nil)
+}
+
+func (nvm *FaultyNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	length := 0
+	for _, buf := range bufs {
+		length += len(buf)
+	}
+	return nvm.write(length, func() (int, error) {
+		return nvm.inner.Writev(bufs, offset)
+	}, nil)
+}
+
+func (nvm *FaultyNVM) Seek(offset int64, whence int) (int64, error) {
+	return nvm.inner.Seek(offset, whence)
+}
+
+func (nvm *FaultyNVM) Close() error {
+	return nvm.inner.Close()
+}
+
+//Sync does nothing after the injected write failure if the writes are silent
+func (nvm *FaultyNVM) Sync() error {
+	nvm.state.mutex.Lock()
+	silent := nvm.state.failed && nvm.state.plan.SilentAfterFailure
+	nvm.state.mutex.Unlock()
+	if silent {
+		return nil
+	}
+	return nvm.inner.Sync()
+}
+
+func (nvm *FaultyNVM) Position() uint64 {
+	return nvm.inner.Position()
+}
+
+func (nvm *FaultyNVM) Capacity() uint64 {
+	return nvm.inner.Capacity()
+}
+
+func (nvm *FaultyNVM) BlockSize() block.BlockSize {
+	return nvm.inner.BlockSize()
+}
+
+func (nvm *FaultyNVM) RawSize() int64 {
+	return nvm.inner.RawSize()
+}
+
+//Split shares the plan and the counters with the splits
+func (nvm *FaultyNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	left, right, err := nvm.inner.Split(position)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &FaultyNVM{inner: left, state: nvm.state}, &FaultyNVM{inner: right, state: nvm.state}, nil
+}
@@ -0,0 +1,75 @@
+package nvm
+
+import (
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+func TestFaultyNVM(t *testing.T) {
+	inner, _ := New(4096)
+	nvm := NewFaultyNVM(inner, FaultPlan{FailWriteAt: 2, FailReadAt: 2, ShortReadAt: 3})
+
+	_, err := nvm.WriteAt(newBuffer(1024, 1), 0)
+	assert.Nil(t, err)
+	_, err = nvm.WriteAt(newBuffer(1024, 2), 1024)
+	assert.True(t, internalerror.Is(err, syscall.EIO))
+	assert.Equal(t, internalerror.DeviceError, errors.Cause(err))
+	assert.True(t, nvm.Failed())
+	//nothing is written by the failed write
+	assert.Equal(t, make([]byte, 1024), inner.vec[1024:2048])
+	_, err = nvm.Writev([][]byte{newBuffer(512, 3), newBuffer(512, 3)}, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, nvm.Writes())
+
+	buf := make([]byte, 1024)
+	_, err = nvm.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, newBuffer(1024, 1), buf)
+	_, err = nvm.ReadAt(buf, 0)
+	assert.True(t, internalerror.Is(err, syscall.EIO))
+	assert.Equal(t, internalerror.DeviceError, errors.Cause(err))
+	buf = make([]byte, 1024)
+	n, err := nvm.ReadAt(buf, 0)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 512, n)
+	assert.Equal(t, newBuffer(1024, 1)[:512], buf[:512])
+	assert.Equal(t, make([]byte, 512), buf[512:])
+	assert.Equal(t, 3, nvm.Reads())
+}
+
+func TestFaultyNVMSilentAfterFailure(t *testing.T) {
+	inner, _ := New(4096)
+	nvm := NewFaultyNVM(inner, FaultPlan{FailWriteAt: 1, SilentAfterFailure: true, LatencyEvery: 2, Latency: time.Second})
+	var slept time.Duration
+	nvm.state.sleep = func(d time.Duration) {
+		slept += d
+	}
+
+	_, err := nvm.Write(newBuffer(512, 1))
+	assert.Error(t, err)
+	//the splits share the plan
+	_, right, err := nvm.Split(1024)
+	assert.Nil(t, err)
+	n, err := right.Write(newBuffer(512, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, 512, n)
+	assert.Equal(t, uint64(512), right.Position())
+	_, err = nvm.WriteAt(newBuffer(512, 3), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, nvm.Sync())
+	assert.Equal(t, make([]byte, 4096), inner.vec)
+	//the second write sleeps
+	assert.Equal(t, time.Second, slept)
+
+	nvm.SetPlan(FaultPlan{})
+	assert.False(t, nvm.Failed())
+	_, err = nvm.WriteAt(newBuffer(512, 3), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, newBuffer(512, 3), inner.vec[:512])
+}
@@ -1,9 +1,11 @@
 package nvm
 
 import (
-	_ "bytes"
+	"bytes"
 	"io"
 	"os"
+	"path/filepath"
+	"syscall"
 
 	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
@@ -17,6 +19,73 @@ type FileNVM struct {
 	view_start      uint64
 	view_end        uint64
 	splited         bool //splited file is not allowd to call file.Close()
+	bufferedIO      bool //the file is opened without O_DIRECT
+	readOnly        bool //the file is opened by OpenReadOnly
+	lockMode        LockMode
+	block_size      block.BlockSize
+	device          bool //the file is a block device, it could not be truncated
+	degraded        bool //the file is on a network filesystem, see NETWORK_FS_DEGRADED
+	preallocate     PreallocateMode
+}
+
+type DirectIOMode int
+
+const (
+	//use O_DIRECT, fall back to buffered I/O if the filesystem(such as tmpfs) rejects it
+	DIRECT_IO_AUTO DirectIOMode = iota
+	//fail if O_DIRECT is not supported
+	DIRECT_IO_ON
+	//always use buffered I/O, the data is durable only after Sync
+	DIRECT_IO_OFF
+)
+
+//NetworkFSMode decides how a file on a network filesystem is used, such as NFS, SMB or 9p
+type NetworkFSMode int
+
+const (
+	/*
+		open the file without O_DIRECT, every write is synced and read back to compare, so a
+		write lost or reordered by the filesystem is returned as StorageCorrupted at once
+	*/
+	NETWORK_FS_DEGRADED NetworkFSMode = iota
+	//fail with InvalidInput
+	NETWORK_FS_REFUSE
+	//use the file as a local one
+	NETWORK_FS_IGNORE
+)
+
+//PreallocateMode decides how the blocks of a new file are allocated, a block device is never preallocated
+type PreallocateMode int
+
+const (
+	//the file grows as it is written, a write could fail with ENOSPC
+	PREALLOCATE_NONE PreallocateMode = iota
+	//the file is truncated to the capacity without allocating blocks, for the dev environments
+	PREALLOCATE_SPARSE
+	//the blocks are allocated by fallocate, the file is zero filled if it is not supported
+	PREALLOCATE_FULL
+	//the file is zero filled, it takes a while for a big file, but every block is written once
+	PREALLOCATE_ZERO
+)
+
+//the size of a write to zero fill the file
+const PREALLOCATE_CHUNK_SIZE = 1024 * 1024
+
+type FileOptions struct {
+	DirectIO DirectIOMode
+	//Preallocate is for a new file and the growth of Resize, the default is PREALLOCATE_NONE
+	Preallocate PreallocateMode
+	//NetworkFS is checked before the file is opened, the default is NETWORK_FS_DEGRADED
+	NetworkFS NetworkFSMode
+	//BlockSize of a new storage, it must be a multiple of the sector size. 0 means the sector size.
+	//An existing storage always uses the block size in its header
+	BlockSize block.BlockSize
+}
+
+func DefaultFileOptions() FileOptions {
+	return FileOptions{
+		DirectIO: DIRECT_IO_AUTO,
+	}
 }
 
 func fileExists(path string) bool {
@@ -28,12 +97,26 @@ func fileExists(path string) bool {
 }
 
 func CreateIfAbsent(path string, capacity uint64) (*FileNVM, error) {
+	return CreateIfAbsentWithOptions(path, capacity, DefaultFileOptions())
+}
+
+/*
+CreateIfAbsentWithOptions creates the file, or opens the block device at path. The block size
+of a block device is its physical sector size, so a 4Kn or 512e drive is written in 4K blocks,
+unless a bigger one is set by options.BlockSize.
+*/
+func CreateIfAbsentWithOptions(path string, capacity uint64, options FileOptions) (*FileNVM, error) {
 
 	if block.Min().IsAligned(capacity) == false {
 		return nil, internalerror.InvalidInput
 	}
+	if options.BlockSize != 0 {
+		if _, err := block.NewBlockSize(options.BlockSize.AsU16()); err != nil {
+			return nil, err
+		}
+	}
 
-	if fileExists(path) {
+	if fileExists(path) && !isBlockDevice(path) {
 		return nil, os.ErrExist
 	}
 	var flags int
@@ -41,7 +124,16 @@ func CreateIfAbsent(path string, capacity uint64) (*FileNVM, error) {
 	var err error
 	flags = os.O_CREATE | os.O_RDWR
 
-	if f, err = openFileWithDirectIO(path, flags, 0755); err != nil {
+	//the file does not exist yet, the filesystem is found by its directory
+	degraded, err := checkNetworkFS(path, filepath.Dir(path), options.NetworkFS)
+	if err != nil {
+		return nil, err
+	}
+	if degraded {
+		options.DirectIO = DIRECT_IO_OFF
+	}
+	var directIO bool
+	if f, directIO, err = openFile(path, flags, options.DirectIO); err != nil {
 		return nil, errors.Wrapf(err, "failed to open file %s\n", path)
 	}
 	/*
@@ -68,8 +160,46 @@ func CreateIfAbsent(path string, capacity uint64) (*FileNVM, error) {
 	*/
 
 	if err = lockFileWithExclusiveLock(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	sector, blockSize, err := detectBlockSize(f)
+	if err != nil {
+		f.Close()
 		return nil, err
 	}
+	if options.BlockSize != 0 {
+		if !options.BlockSize.Contains(sector) {
+			f.Close()
+			return nil, errors.Wrapf(internalerror.InvalidInput,
+				"block size %d is not aligned to the sector size %d of %s", options.BlockSize, sector, path)
+		}
+		blockSize = options.BlockSize
+	}
+	if !blockSize.IsAligned(capacity) {
+		f.Close()
+		return nil, errors.Wrapf(internalerror.InvalidInput, "capacity %d is not aligned to the sector size %d", capacity, blockSize)
+	}
+	device := isDevice(f)
+	if device {
+		size, err := blockDeviceSize(f)
+		if err != nil || capacity > size {
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			return nil, errors.Wrapf(internalerror.InvalidInput, "capacity %d is bigger than the device %s", capacity, path)
+		}
+	}
+
+	if !device {
+		if err = preallocate(f, 0, capacity, options.Preallocate, blockSize); err != nil {
+			f.Close()
+			os.Remove(path)
+			return nil, errors.Wrapf(err, "failed to preallocate %d bytes for %s", capacity, path)
+		}
+	}
 
 	return &FileNVM{
 		file:            f,
@@ -77,14 +207,37 @@ func CreateIfAbsent(path string, capacity uint64) (*FileNVM, error) {
 		view_start:      0,
 		view_end:        capacity,
 		splited:         false,
+		bufferedIO:      !directIO,
+		lockMode:        LOCK_EXCLUSIVE,
+		block_size:      blockSize,
+		device:          device,
+		degraded:        degraded,
+		preallocate:     options.Preallocate,
 	}, nil
 
 }
 
 func Open(path string) (nvm *FileNVM, header *StorageHeader, err error) {
+	return OpenWithOptions(path, DefaultFileOptions())
+}
+
+func OpenWithOptions(path string, options FileOptions) (nvm *FileNVM, header *StorageHeader, err error) {
+	return openWithFlags(path, os.O_RDWR, options)
+}
+
+/*
+OpenReadOnly opens the file with LOCK_SHARED, or LOCK_NONE if it is opened by a writer,
+so it could be opened while another process is writing it, see LockMode. Write returns ReadOnly.
+*/
+func OpenReadOnly(path string) (nvm *FileNVM, header *StorageHeader, err error) {
+	return openWithFlags(path, os.O_RDONLY, DefaultFileOptions())
+}
+
+func openWithFlags(path string, flags int, options FileOptions) (nvm *FileNVM, header *StorageHeader, err error) {
 	var f, parsedFile *os.File
+	var directIO bool
 
-	if parsedFile, err = os.OpenFile(path, os.O_RDWR, 07555); err != nil {
+	if parsedFile, err = os.OpenFile(path, flags, 07555); err != nil {
 		return nil, nil, err
 	}
 	//read the first sector
@@ -98,26 +251,244 @@ func Open(path string) (nvm *FileNVM, header *StorageHeader, err error) {
 	//reopen the file
 	parsedFile.Close()
 
-	if f, err = openFileWithDirectIO(path, os.O_RDWR, 0755); err != nil {
+	degraded, err := checkNetworkFS(path, path, options.NetworkFS)
+	if err != nil {
+		return nil, nil, err
+	}
+	if degraded {
+		options.DirectIO = DIRECT_IO_OFF
+	}
+	if f, directIO, err = openFile(path, flags, options.DirectIO); err != nil {
 		return nil, nil, err
 	}
 
-	if err = lockFileWithExclusiveLock(f); err != nil {
+	readOnly := flags == os.O_RDONLY
+	lockMode := LOCK_EXCLUSIVE
+	if readOnly {
+		lockMode = LOCK_SHARED
+	}
+	if err = lockFile(f, lockMode); err != nil {
+		if !readOnly || errors.Cause(err) != internalerror.DeviceBusy {
+			f.Close()
+			return nil, nil, err
+		}
+		//a writer is running
+		lockMode = LOCK_NONE
+	}
+	//the storage may be created with a bigger block size, but not a smaller one
+	sector, _, err := detectBlockSize(f)
+	if err != nil {
+		f.Close()
 		return nil, nil, err
 	}
-	err = nil
+	if !header.BlockSize.Contains(sector) {
+		f.Close()
+		return nil, nil, errors.Wrapf(internalerror.InvalidInput,
+			"block size %d of the storage is not aligned to the sector size %d", header.BlockSize, sector)
+	}
 	nvm = &FileNVM{
 		file:            f,
 		cursor_position: 0,
 		view_start:      0,
 		view_end:        capacity,
 		splited:         false,
+		bufferedIO:      !directIO,
+		readOnly:        readOnly,
+		lockMode:        lockMode,
+		block_size:      header.BlockSize,
+		device:          isDevice(f),
+		degraded:        degraded,
+		preallocate:     options.Preallocate,
 	}
 	return
 }
 
+//preallocate allocates [from, to) of the file by mode, the bytes already in the file are kept
+func preallocate(f *os.File, from uint64, to uint64, mode PreallocateMode, blockSize block.BlockSize) error {
+	if to <= from {
+		return nil
+	}
+	switch mode {
+	case PREALLOCATE_SPARSE:
+		return f.Truncate(int64(to))
+	case PREALLOCATE_FULL:
+		err := allocate(f, from, to-from)
+		if err == nil || !isDirectIOUnsupported(err) {
+			return err
+		}
+		//the filesystem does not support fallocate
+		return zeroFill(f, from, to, blockSize)
+	case PREALLOCATE_ZERO:
+		return zeroFill(f, from, to, blockSize)
+	}
+	return nil
+}
+
+//zeroFill writes zeros to [from, to) of the file and syncs it, the buffer is aligned for O_DIRECT
+func zeroFill(f *os.File, from uint64, to uint64, blockSize block.BlockSize) error {
+	zeros := block.NewAlignedBytes(PREALLOCATE_CHUNK_SIZE, blockSize).AsBytes()
+	for offset := from; offset < to; {
+		n := util.Min(to-offset, PREALLOCATE_CHUNK_SIZE)
+		if _, err := f.WriteAt(zeros[:n], int64(offset)); err != nil {
+			return internalerror.NewIOError("write", err)
+		}
+		offset += n
+	}
+	return internalerror.NewIOError("sync", f.Sync())
+}
+
+/*
+checkNetworkFS returns true if the file at path should be opened in the degraded mode, dir is
+where the filesystem is looked up. A filesystem which could not be found is taken as a local one.
+*/
+func checkNetworkFS(path string, dir string, mode NetworkFSMode) (degraded bool, err error) {
+	if mode == NETWORK_FS_IGNORE {
+		return false, nil
+	}
+	fs, err := networkFilesystem(dir)
+	if err != nil || fs == "" {
+		return false, nil
+	}
+	if mode == NETWORK_FS_REFUSE {
+		return false, errors.Wrapf(internalerror.InvalidInput, "%s is on the network filesystem %s", path, fs)
+	}
+	return true, nil
+}
+
+/*
+openFile opens the file with O_DIRECT unless mode is DIRECT_IO_OFF. Some filesystems accept
+O_DIRECT in open, but reject the reads, so an aligned block is read to make sure it works.
+*/
+func openFile(path string, flags int, mode DirectIOMode) (f *os.File, directIO bool, err error) {
+	if mode != DIRECT_IO_OFF {
+		if f, err = openFileWithDirectIO(path, flags, 0755); err == nil {
+			if err = probeDirectIO(f); err == nil {
+				return f, true, nil
+			}
+			f.Close()
+		}
+		if mode == DIRECT_IO_ON || !isDirectIOUnsupported(err) {
+			return nil, false, err
+		}
+	}
+	f, err = os.OpenFile(path, flags, 0755)
+	return f, false, err
+}
+
+//the probe is aligned to the biggest common sector size, a 4Kn drive rejects a 512 bytes read
+const DIRECT_IO_PROBE_SIZE = 4096
+
+func probeDirectIO(f *os.File) error {
+	probeSize, _ := block.NewBlockSize(DIRECT_IO_PROBE_SIZE)
+	buf := block.NewAlignedBytes(DIRECT_IO_PROBE_SIZE, probeSize)
+	if _, err := f.ReadAt(buf.AsBytes(), 0); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func isDirectIOUnsupported(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.EINVAL || err == syscall.EOPNOTSUPP
+}
+
+//PunchHole deallocates [offset, offset+length) of the file, the size of file is not changed
+func (nvm *FileNVM) PunchHole(offset uint64, length uint64) error {
+	if !nvm.alignment().IsAligned(offset) || !nvm.alignment().IsAligned(length) {
+		return errors.Wrapf(internalerror.InvalidInput, "not aligned :%d %d, in punch hole", offset, length)
+	}
+	if offset+length > nvm.Capacity() {
+		return errors.Wrapf(internalerror.InvalidInput, "punch hole out of range :%d %d", offset, length)
+	}
+	return punchHole(nvm.file, nvm.view_start+offset, length)
+}
+
+//WillNeed advises the kernel to read [offset, offset+length) of the file into the page cache.
+//The page cache is not used by direct I/O, so it does nothing if the file is opened with O_DIRECT
+func (nvm *FileNVM) WillNeed(offset uint64, length uint64) error {
+	if offset+length > nvm.Capacity() {
+		return errors.Wrapf(internalerror.InvalidInput, "prefetch out of range :%d %d", offset, length)
+	}
+	if !nvm.bufferedIO {
+		return nil
+	}
+	return fadviseWillNeed(nvm.file, nvm.view_start+offset, length)
+}
+
+/*
+CloneTo creates the file at path which shares all the blocks of the file by reflink, it is
+instant whatever the size of the file is. It fails with InvalidInput if the filesystem does not
+support reflink, the file is not copied then. The writes not synced may not be in the clone.
+*/
+func (nvm *FileNVM) CloneTo(path string) (err error) {
+	if nvm.splited || nvm.device {
+		return errors.Wrap(internalerror.InvalidInput, "only a whole file could be cloned")
+	}
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create clone %s", path)
+	}
+	defer func() {
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if err = reflink(dst, nvm.file); err != nil {
+		if isReflinkUnsupported(err) {
+			return errors.Wrapf(internalerror.InvalidInput, "reflink to %s is not supported: %v", path, err)
+		}
+		return errors.Wrapf(err, "failed to clone into %s", path)
+	}
+	return dst.Sync()
+}
+
+//isReflinkUnsupported returns true if the filesystem could not reflink the files
+func isReflinkUnsupported(err error) bool {
+	return err == syscall.EOPNOTSUPP || err == syscall.ENOTTY || err == syscall.EXDEV || err == syscall.EINVAL
+}
+
+//LockMode returns the lock held on the file, the splited FileNVMs share the lock
+func (nvm *FileNVM) LockMode() LockMode {
+	return nvm.lockMode
+}
+
+//ReadOnly returns true if the file is opened by OpenReadOnly
+func (nvm *FileNVM) ReadOnly() bool {
+	return nvm.readOnly
+}
+
+//DirectIO returns false if the file is opened with buffered I/O
+func (nvm *FileNVM) DirectIO() bool {
+	return !nvm.bufferedIO
+}
+
+//Degraded returns true if the file is on a network filesystem and every write is verified, see NETWORK_FS_DEGRADED
+func (nvm *FileNVM) Degraded() bool {
+	return nvm.degraded
+}
+
+//verifyWrite syncs the file and reads buf back from the absolute offset, for the degraded mode
+func (nvm *FileNVM) verifyWrite(buf []byte, offset int64) error {
+	if err := nvm.file.Sync(); err != nil {
+		return errors.Wrap(internalerror.NewIOError("sync", err), "FileNVM failed to sync the write")
+	}
+	written := make([]byte, len(buf))
+	if _, err := nvm.file.ReadAt(written, offset); err != nil && err != io.EOF {
+		return errors.Wrap(internalerror.NewIOError("read", err), "FileNVM failed to read the write back")
+	}
+	if !bytes.Equal(written, buf) {
+		return errors.Wrapf(internalerror.StorageCorrupted, "%d bytes written at %d are not read back", len(buf), offset)
+	}
+	return nil
+}
+
 func (self *FileNVM) Sync() error {
-	return self.file.Sync()
+	return internalerror.NewIOError("sync", self.file.Sync())
 }
 
 func (self *FileNVM) Position() uint64 {
@@ -128,13 +499,59 @@ func (nvm *FileNVM) Capacity() uint64 {
 	return nvm.view_end - nvm.view_start
 }
 
+/*
+Resize moves the end of the view to capacity. The file is extended or truncated if the
+FileNVM is not splited, a splited FileNVM only moves the end of its view, so grow the parent
+first, and shrink it last.
+*/
+func (nvm *FileNVM) Resize(capacity uint64) error {
+	if nvm.readOnly {
+		return errors.Wrap(internalerror.ReadOnly, "FileNVM failed to resize")
+	}
+	if !nvm.alignment().IsAligned(capacity) || capacity == 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid capacity %d in resize", capacity)
+	}
+	end := nvm.view_start + capacity
+	if nvm.device {
+		//a block device is never truncated, it only moves the end of the view
+		if int64(end) > nvm.RawSize() {
+			return errors.Wrapf(internalerror.InvalidInput, "capacity %d is bigger than the device", capacity)
+		}
+	} else if !nvm.splited && end > nvm.view_end && nvm.preallocate != PREALLOCATE_NONE {
+		if err := preallocate(nvm.file, nvm.view_end, end, nvm.preallocate, nvm.block_size); err != nil {
+			return errors.Wrap(err, "FileNVM failed to resize")
+		}
+	} else if !nvm.splited && (end < nvm.view_end || int64(end) > nvm.RawSize()) {
+		if err := nvm.file.Truncate(int64(end)); err != nil {
+			return errors.Wrap(err, "FileNVM failed to resize")
+		}
+	}
+	nvm.view_end = end
+	if nvm.cursor_position > end {
+		nvm.cursor_position = end
+	}
+	return nil
+}
+
 func (nvm *FileNVM) RawSize() int64 {
-	info, _ := nvm.file.Stat()
+	if nvm.device {
+		size, _ := blockDeviceSize(nvm.file)
+		return int64(size)
+	}
+	return fileRawSize(nvm.file)
+}
+
+//fileRawSize returns the size of the file, it is -1 if the file could not be stat, as the RawSize of MemoryNVM
+func fileRawSize(file *os.File) int64 {
+	info, err := file.Stat()
+	if err != nil {
+		return -1
+	}
 	return info.Size()
 }
 
 func (nvm *FileNVM) Split(position uint64) (sp1 NonVolatileMemory, sp2 NonVolatileMemory, err error) {
-	if block.Min().CeilAlign(uint64(position)) != position {
+	if nvm.alignment().CeilAlign(uint64(position)) != position {
 		return nil, nil, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in split", position)
 	}
 
@@ -145,6 +562,12 @@ func (nvm *FileNVM) Split(position uint64) (sp1 NonVolatileMemory, sp2 NonVolati
 		cursor_position: nvm.view_start,
 		view_end:        nvm.view_start + position,
 		splited:         true,
+		bufferedIO:      nvm.bufferedIO,
+		readOnly:        nvm.readOnly,
+		lockMode:        nvm.lockMode,
+		block_size:      nvm.block_size,
+		device:          nvm.device,
+		degraded:        nvm.degraded,
 	}
 
 	rightNVM := &FileNVM{
@@ -153,13 +576,19 @@ func (nvm *FileNVM) Split(position uint64) (sp1 NonVolatileMemory, sp2 NonVolati
 		view_end:        nvm.view_end,
 		cursor_position: leftNVM.view_end,
 		splited:         true,
+		bufferedIO:      nvm.bufferedIO,
+		readOnly:        nvm.readOnly,
+		lockMode:        nvm.lockMode,
+		block_size:      nvm.block_size,
+		device:          nvm.device,
+		degraded:        nvm.degraded,
 	}
 
 	return leftNVM, rightNVM, nil
 }
 
 func (nvm *FileNVM) Seek(offset int64, whence int) (int64, error) {
-	if !block.Min().IsAligned(uint64(offset)) {
+	if !nvm.alignment().IsAligned(uint64(offset)) {
 		return offset, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in seek", offset)
 	}
 
@@ -182,7 +611,7 @@ func (nvm *FileNVM) Seek(offset int64, whence int) (int64, error) {
 func (nvm *FileNVM) Read(buf []byte) (n int, err error) {
 	maxLen := nvm.Capacity() - nvm.Position()
 	bufLen := uint64(len(buf))
-	if !block.Min().IsAligned(uint64(bufLen)) {
+	if !nvm.alignment().IsAligned(uint64(bufLen)) {
 		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, in read", bufLen)
 	}
 
@@ -198,7 +627,7 @@ func (nvm *FileNVM) Read(buf []byte) (n int, err error) {
 		return int(len), nil
 	}
 	if err != nil {
-		return -1, errors.Wrap(err, "FileNVM failed to read")
+		return -1, errors.Wrap(internalerror.NewIOError("read", err), "FileNVM failed to read")
 	}
 	if n < int(len) {
 		//if uint64(n) < len {
@@ -213,10 +642,13 @@ func (nvm *FileNVM) Read(buf []byte) (n int, err error) {
 }
 
 func (nvm *FileNVM) Write(buf []byte) (n int, err error) {
+	if nvm.readOnly {
+		return -1, errors.Wrap(internalerror.ReadOnly, "FileNVM failed to write")
+	}
 	maxLen := nvm.Capacity() - nvm.Position()
 	bufLen := uint64(len(buf))
 
-	if !block.Min().IsAligned(uint64(bufLen)) {
+	if !nvm.alignment().IsAligned(uint64(bufLen)) {
 		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, in write", bufLen)
 	}
 
@@ -224,7 +656,12 @@ func (nvm *FileNVM) Write(buf []byte) (n int, err error) {
 	newPosition := nvm.cursor_position + len
 
 	if n, err = nvm.file.WriteAt(buf[:len], int64(nvm.cursor_position)); err != nil {
-		return -1, errors.Wrap(err, "FileNVM failed to write")
+		return -1, errors.Wrap(internalerror.NewIOError("write", err), "FileNVM failed to write")
+	}
+	if nvm.degraded {
+		if err = nvm.verifyWrite(buf[:len], int64(nvm.cursor_position)); err != nil {
+			return -1, err
+		}
 	}
 
 	nvm.cursor_position = newPosition
@@ -233,6 +670,81 @@ func (nvm *FileNVM) Write(buf []byte) (n int, err error) {
 
 }
 
+func (nvm *FileNVM) ReadAt(buf []byte, offset int64) (n int, err error) {
+	if err = nvm.checkAligned(offset, len(buf)); err != nil {
+		return 0, err
+	}
+	length, err := checkReadAt(nvm, len(buf), offset)
+	if err != nil {
+		return 0, err
+	}
+	n, err = nvm.file.ReadAt(buf[:length], int64(nvm.view_start)+offset)
+	if err != nil && err != io.EOF {
+		return n, errors.Wrap(internalerror.NewIOError("read", err), "FileNVM failed to read")
+	}
+	//the file is not expanded yet, the rest is zero
+	for i := n; i < int(length); i++ {
+		buf[i] = 0
+	}
+	if length < uint64(len(buf)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+func (nvm *FileNVM) WriteAt(buf []byte, offset int64) (n int, err error) {
+	if nvm.readOnly {
+		return 0, errors.Wrap(internalerror.ReadOnly, "FileNVM failed to write")
+	}
+	if err = nvm.checkAligned(offset, len(buf)); err != nil {
+		return 0, err
+	}
+	if err = checkWriteAt(nvm, len(buf), offset); err != nil {
+		return 0, err
+	}
+	if n, err = nvm.file.WriteAt(buf, int64(nvm.view_start)+offset); err != nil {
+		return n, errors.Wrap(internalerror.NewIOError("write", err), "FileNVM failed to write")
+	}
+	if nvm.degraded {
+		if err = nvm.verifyWrite(buf, int64(nvm.view_start)+offset); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+//Writev writes the buffers with one pwritev if it is supported, otherwise they are coalesced
+func (nvm *FileNVM) Writev(bufs [][]byte, offset int64) (n int, err error) {
+	if nvm.readOnly {
+		return 0, errors.Wrap(internalerror.ReadOnly, "FileNVM failed to write")
+	}
+	var total int
+	for _, buf := range bufs {
+		total += len(buf)
+	}
+	if err = nvm.checkAligned(offset, total); err != nil {
+		return 0, err
+	}
+	if err = checkWriteAt(nvm, total, offset); err != nil {
+		return 0, err
+	}
+	//the degraded writes are verified by WriteAt
+	if nvm.degraded {
+		return nvm.WriteAt(Coalesce(bufs, nvm.BlockSize()), offset)
+	}
+	n, ok, err := pwritev(nvm.file, bufs, int64(nvm.view_start)+offset, !nvm.bufferedIO, nvm.block_size)
+	if !ok {
+		return nvm.WriteAt(Coalesce(bufs, nvm.BlockSize()), offset)
+	}
+	if err != nil {
+		return n, errors.Wrap(internalerror.NewIOError("writev", err), "FileNVM failed to writev")
+	}
+	if n != total {
+		return n, errors.Wrap(io.ErrShortWrite, "FileNVM failed to writev")
+	}
+	return n, nil
+}
+
 func (nvm *FileNVM) Close() error {
 	if !nvm.splited {
 		return nvm.file.Close()
@@ -241,6 +753,22 @@ func (nvm *FileNVM) Close() error {
 	}
 }
 
-func (nvm *FileNVM) BlockSize() block.BlockSize {
+//alignment is the block size for a block device, which rejects the I/O smaller than the sector
+func (nvm *FileNVM) alignment() block.BlockSize {
+	if nvm.device {
+		return nvm.block_size
+	}
 	return block.Min()
 }
+
+func (nvm *FileNVM) checkAligned(offset int64, length int) error {
+	if !nvm.alignment().IsAligned(uint64(offset)) || !nvm.alignment().IsAligned(uint64(length)) {
+		return errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, %d to the sector %d", offset, length, nvm.alignment())
+	}
+	return nil
+}
+
+//BlockSize is the physical sector size of a block device, or the block size of the storage
+func (nvm *FileNVM) BlockSize() block.BlockSize {
+	return nvm.block_size
+}
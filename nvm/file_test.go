@@ -8,8 +8,10 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
 )
 
 func TestFileNVMOpen(t *testing.T) {
@@ -204,6 +206,167 @@ func TestFileNVMEXLock(t *testing.T) {
 
 }
 
+func TestFileNVMWritev(t *testing.T) {
+	for _, directIO := range []DirectIOMode{DIRECT_IO_OFF, DIRECT_IO_AUTO} {
+		nvm, err := CreateIfAbsentWithOptions("foo-writev", 2048, FileOptions{DirectIO: directIO})
+		assert.Nil(t, err)
+
+		_, right, err := nvm.Split(512)
+		assert.Nil(t, err)
+		//the file is not extended yet
+		readBuf := alignedWithSize(1536)
+		n, err := right.ReadAt(readBuf, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, arrayWithValueSize(1536, 0), readBuf)
+
+		bufs := [][]byte{alignedWithSize(512), alignedWithSize(1024)}
+		copy(bufs[0], arrayWithValueSize(512, 1))
+		copy(bufs[1], arrayWithValueSize(1024, 2))
+		n, err = right.Writev(bufs, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1536, n)
+		assert.Equal(t, uint64(0), right.Position())
+
+		n, err = right.ReadAt(readBuf, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1536, n)
+		assert.Equal(t, arrayWithValueSize(512, 1), readBuf[:512])
+		assert.Equal(t, arrayWithValueSize(1024, 2), readBuf[512:])
+
+		//an unaligned buffer falls back to a coalesced write
+		n, err = right.Writev([][]byte{arrayWithValueSize(100, 3), arrayWithValueSize(412, 4)}, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 512, n)
+		n, err = right.ReadAt(readBuf[:512], 0)
+		assert.Nil(t, err)
+		assert.Equal(t, arrayWithValueSize(100, 3), readBuf[:100])
+		assert.Equal(t, arrayWithValueSize(412, 4), readBuf[100:512])
+
+		_, err = right.Writev(bufs, 512)
+		assert.Error(t, err)
+		nvm.Close()
+		os.Remove("foo-writev")
+	}
+}
+
+func TestFileNVMNetworkFS(t *testing.T) {
+	fs, err := networkFilesystem(".")
+	assert.Nil(t, err)
+	if fs != "" {
+		t.Skipf("the test runs on the network filesystem %s", fs)
+	}
+	degraded, err := checkNetworkFS("foo-netfs", ".", NETWORK_FS_REFUSE)
+	assert.Nil(t, err)
+	assert.False(t, degraded)
+	//an unknown filesystem is taken as a local one
+	degraded, err = checkNetworkFS("foo-netfs", "no-such-dir", NETWORK_FS_REFUSE)
+	assert.Nil(t, err)
+	assert.False(t, degraded)
+
+	nvm, err := CreateIfAbsentWithOptions("foo-netfs", 2048, DefaultFileOptions())
+	assert.Nil(t, err)
+	defer os.Remove("foo-netfs")
+	assert.False(t, nvm.Degraded())
+
+	//every write of the degraded mode is synced and read back
+	nvm.degraded = true
+	_, right, err := nvm.Split(512)
+	assert.Nil(t, err)
+	assert.True(t, right.(*FileNVM).Degraded())
+	bufs := [][]byte{alignedWithSize(512), alignedWithSize(1024)}
+	copy(bufs[0], arrayWithValueSize(512, 1))
+	copy(bufs[1], arrayWithValueSize(1024, 2))
+	n, err := right.Writev(bufs, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1536, n)
+	n, err = right.Write(alignedWithSize(512))
+	assert.Nil(t, err)
+	assert.Equal(t, 512, n)
+	readBuf := alignedWithSize(1536)
+	_, err = right.ReadAt(readBuf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, arrayWithValueSize(512, 0), readBuf[:512])
+	assert.Equal(t, arrayWithValueSize(1024, 2), readBuf[512:])
+	nvm.Close()
+}
+
+func TestFileNVMPreallocate(t *testing.T) {
+	for _, mode := range []PreallocateMode{PREALLOCATE_NONE, PREALLOCATE_SPARSE, PREALLOCATE_FULL, PREALLOCATE_ZERO} {
+		options := DefaultFileOptions()
+		options.Preallocate = mode
+		nvm, err := CreateIfAbsentWithOptions("foo-prealloc", 4096, options)
+		assert.Nil(t, err)
+		if mode == PREALLOCATE_NONE {
+			assert.True(t, nvm.RawSize() < 4096)
+		} else {
+			assert.Equal(t, int64(4096), nvm.RawSize())
+		}
+		info, err := os.Stat("foo-prealloc")
+		assert.Nil(t, err)
+		assert.Equal(t, nvm.RawSize(), info.Size())
+
+		//the growth of Resize is preallocated too
+		assert.Nil(t, nvm.Resize(8192))
+		if mode != PREALLOCATE_NONE {
+			assert.Equal(t, int64(8192), nvm.RawSize())
+			buf := alignedWithSize(8192)
+			_, err = nvm.ReadAt(buf, 0)
+			assert.Nil(t, err)
+			assert.Equal(t, arrayWithValueSize(8192, 0), buf)
+		}
+		nvm.Close()
+		os.Remove("foo-prealloc")
+	}
+}
+
+func TestFileNVMDetectBlockSize(t *testing.T) {
+	nvm, err := CreateIfAbsent("foo-sector", 1024)
+	assert.Nil(t, err)
+	defer os.Remove("foo-sector")
+	defer nvm.Close()
+	assert.Equal(t, block.Min(), nvm.BlockSize())
+	assert.False(t, isBlockDevice("foo-sector"))
+
+	logical, physical, err := detectBlockSize(nvm.file)
+	assert.Nil(t, err)
+	assert.Equal(t, block.Min(), logical)
+	assert.Equal(t, block.Min(), physical)
+	assert.False(t, isDevice(nvm.file))
+
+	left, _, err := nvm.Split(512)
+	assert.Nil(t, err)
+	assert.Equal(t, block.Min(), left.BlockSize())
+}
+
+func TestOpenBlockDevice(t *testing.T) {
+	f, err := os.Create("foo-device")
+	assert.Nil(t, err)
+	f.Close()
+	defer os.Remove("foo-device")
+	_, err = OpenBlockDevice("foo-device", DefaultFileOptions())
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	//a block device which could be opened, such as a loop device in CI
+	device := os.Getenv("CANNYLS_TEST_DEVICE")
+	if device == "" {
+		return
+	}
+	nvm, err := OpenBlockDevice(device, DefaultFileOptions())
+	assert.Nil(t, err)
+	defer nvm.Close()
+	assert.True(t, nvm.BlockSize().IsAligned(nvm.Capacity()))
+	assert.Equal(t, int64(nvm.Capacity()), nvm.RawSize())
+	assert.Error(t, nvm.Resize(nvm.Capacity()+uint64(nvm.BlockSize())))
+
+	buf := block.NewAlignedBytes(int(nvm.BlockSize()), nvm.BlockSize())
+	_, err = nvm.ReadAt(buf.AsBytes(), int64(nvm.BlockSize()))
+	assert.Nil(t, err)
+	if nvm.BlockSize() != block.Min() {
+		_, err = nvm.ReadAt(buf.AsBytes()[:512], 0)
+		assert.Error(t, err)
+	}
+}
+
 //helper function
 func align(bytes []byte) []byte {
 	ab := block.FromBytes(bytes, block.Min())
@@ -223,3 +386,107 @@ func arrayWithValueSize(size int, value byte) []byte {
 	}
 	return arr
 }
+
+func TestFileNVMBufferedIO(t *testing.T) {
+	nvm, err := CreateIfAbsentWithOptions("foo-buffered", 1024, FileOptions{DirectIO: DIRECT_IO_OFF})
+	assert.Nil(t, err)
+	defer os.Remove("foo-buffered")
+	assert.False(t, nvm.DirectIO())
+
+	data := new(bytes.Buffer)
+	err = DefaultStorageHeader().WriteTo(data)
+	assert.Nil(t, err)
+	nvm.Write(align(data.Bytes()))
+	nvm.Sync()
+	nvm.Close()
+
+	nvm, _, err = OpenWithOptions("foo-buffered", FileOptions{DirectIO: DIRECT_IO_OFF})
+	assert.Nil(t, err)
+	flag, err := fcntl(int(nvm.file.Fd()), syscall.F_GETFL, 0)
+	assert.Nil(t, err)
+	assert.False(t, isDirectIO(flag))
+	_, right, err := nvm.Split(512)
+	assert.Nil(t, err)
+	assert.False(t, right.(*FileNVM).DirectIO())
+	assert.Nil(t, right.(*FileNVM).WillNeed(0, 512))
+	assert.Error(t, right.(*FileNVM).WillNeed(right.Capacity(), 512))
+	nvm.Close()
+
+	//auto mode works on any filesystem
+	nvm, _, err = OpenWithOptions("foo-buffered", DefaultFileOptions())
+	assert.Nil(t, err)
+	flag, err = fcntl(int(nvm.file.Fd()), syscall.F_GETFL, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, nvm.DirectIO(), isDirectIO(flag))
+	nvm.Close()
+}
+
+func TestFileNVMPunchHole(t *testing.T) {
+	nvm, err := CreateIfAbsent("foo-hole", 1<<20)
+	assert.Nil(t, err)
+	defer os.Remove("foo-hole")
+	defer nvm.Close()
+
+	_, err = nvm.Write(align(arrayWithValueSize(1<<20, 1)))
+	assert.Nil(t, err)
+	assert.Nil(t, nvm.Sync())
+
+	assert.Error(t, nvm.PunchHole(1, 512))
+	assert.Error(t, nvm.PunchHole(512, 1<<20))
+
+	var before, after syscall.Stat_t
+	assert.Nil(t, syscall.Stat("foo-hole", &before))
+	if err = nvm.PunchHole(0, 512<<10); err != nil {
+		t.Skipf("punch hole is not supported: %v", err)
+	}
+	assert.Nil(t, syscall.Stat("foo-hole", &after))
+	assert.True(t, after.Blocks < before.Blocks)
+	assert.Equal(t, before.Size, after.Size)
+
+	//the hole is read as zeros
+	readBuf := block.NewAlignedBytes(512, block.Min())
+	nvm.Seek(0, io.SeekStart)
+	_, err = nvm.Read(readBuf.AsBytes())
+	assert.Nil(t, err)
+	assert.Equal(t, arrayWithValueSize(512, 0), readBuf.AsBytes())
+}
+
+func TestFileNVMLockModes(t *testing.T) {
+	nvm, err := CreateIfAbsent("foo-lock", 1024*10)
+	assert.Nil(t, err)
+	defer os.Remove("foo-lock")
+	data := new(bytes.Buffer)
+	err = DefaultStorageHeader().WriteTo(data)
+	assert.Nil(t, err)
+	nvm.Write(align(data.Bytes()))
+	nvm.Sync()
+	nvm.Close()
+
+	//readers share the lock, and keep the writer out
+	reader1, _, err := OpenReadOnly("foo-lock")
+	assert.Nil(t, err)
+	assert.Equal(t, LOCK_SHARED, reader1.LockMode())
+	reader2, _, err := OpenReadOnly("foo-lock")
+	assert.Nil(t, err)
+	assert.Equal(t, LOCK_SHARED, reader2.LockMode())
+	_, _, err = Open("foo-lock")
+	assert.Equal(t, internalerror.DeviceBusy, errors.Cause(err))
+	_, err = reader1.Write(make([]byte, 512))
+	assert.Equal(t, internalerror.ReadOnly, errors.Cause(err))
+	reader1.Close()
+	reader2.Close()
+
+	//one writer
+	writer, _, err := Open("foo-lock")
+	assert.Nil(t, err)
+	assert.Equal(t, LOCK_EXCLUSIVE, writer.LockMode())
+	_, _, err = Open("foo-lock")
+	assert.Equal(t, internalerror.DeviceBusy, errors.Cause(err))
+
+	//readers could still inspect the file without lock
+	reader, _, err := OpenReadOnly("foo-lock")
+	assert.Nil(t, err)
+	assert.Equal(t, LOCK_NONE, reader.LockMode())
+	reader.Close()
+	writer.Close()
+}
@@ -1,6 +1,7 @@
 package nvm
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 	"os"
@@ -66,11 +67,51 @@ func DefaultStorageHeader() *StorageHeader {
 		DataRegionSize:    4096,
 	}
 }
+
+//ReadHeader reads the storage header at the start of nvm, such as a partition of PartitionTable
+func ReadHeader(nvm NonVolatileMemory) (*StorageHeader, error) {
+	buf := block.NewAlignedBytes(int(FULL_HEADER_SIZE), nvm.BlockSize())
+	buf.Align()
+	if _, err := nvm.ReadAt(buf.AsBytes(), 0); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "failed to read storage header")
+	}
+	return ReadFrom(bytes.NewReader(buf.AsBytes()))
+}
+
 func ReadFromFile(f *os.File) (*StorageHeader, error) {
 	return ReadFrom(f)
 }
 
 func ReadFrom(reader io.Reader) (*StorageHeader, error) {
+	return readFrom(reader, checkVersion)
+}
+
+//ReadRustFrom reads the header of a file written by the original cannyls in Rust, see RUST_MAJOR_VERSION
+func ReadRustFrom(reader io.Reader) (*StorageHeader, error) {
+	return readFrom(reader, func(majorVersion, minorVersion uint16) error {
+		if majorVersion != RUST_MAJOR_VERSION || minorVersion != RUST_MINOR_VERSION {
+			return errors.Wrapf(internalerror.InvalidInput, "version %v.%v is not written by cannyls in Rust", majorVersion, minorVersion)
+		}
+		return nil
+	})
+}
+
+//checkVersion accepts the versions which could be upgraded by storage/migrate, and the Rust files
+func checkVersion(majorVersion, minorVersion uint16) error {
+	if majorVersion == RUST_MAJOR_VERSION && minorVersion == RUST_MINOR_VERSION {
+		return nil
+	}
+	if majorVersion < MIN_MAJOR_VERSION || majorVersion > MAJOR_VERSION {
+		return errors.Wrapf(internalerror.InvalidInput, "read major verion not supported: %v", majorVersion)
+	}
+	// minor version, the older versions are upgraded by storage/migrate
+	if majorVersion == MAJOR_VERSION && minorVersion > MINOR_VERSION {
+		return errors.Wrapf(internalerror.InvalidInput, "read minor version %v is newer than %v", minorVersion, MINOR_VERSION)
+	}
+	return nil
+}
+
+func readFrom(reader io.Reader, check func(majorVersion, minorVersion uint16) error) (*StorageHeader, error) {
 
 	//magic number
 	var magicNumber [4]byte
@@ -96,16 +137,15 @@ func ReadFrom(reader io.Reader) (*StorageHeader, error) {
 	var majorVersion uint16
 	if err := binary.Read(reader, binary.BigEndian, &majorVersion); err != nil {
 		return nil, errors.Wrap(internalerror.InvalidInput, "read major vesion failed")
-	} else if majorVersion != MAJOR_VERSION {
-		return nil, errors.Wrapf(internalerror.InvalidInput, "read major verion not match: %v", majorVersion)
 	}
 
 	// minor version
 	var minorVersion uint16
 	if err := binary.Read(reader, binary.BigEndian, &minorVersion); err != nil {
 		return nil, errors.Wrap(internalerror.InvalidInput, "read minor version failed")
-	} else if minorVersion != MINOR_VERSION {
-		return nil, errors.Wrapf(internalerror.InvalidInput, "read minor version not match:%v", minorVersion)
+	}
+	if err := check(majorVersion, minorVersion); err != nil {
+		return nil, err
 	}
 
 	// block size
@@ -211,6 +251,11 @@ func (self *StorageHeader) WriteTo(writer io.Writer) (err error) {
 	return
 }
 
+//IsCurrentVersion returns false if the file must be upgraded by storage/migrate
+func (self *StorageHeader) IsCurrentVersion() bool {
+	return self.MajorVersion == MAJOR_VERSION && self.MinorVersion == MINOR_VERSION
+}
+
 func (self *StorageHeader) RegionSize() uint64 {
 	return self.BlockSize.CeilAlign(uint64(FULL_HEADER_SIZE))
 }
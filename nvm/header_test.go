@@ -1,6 +1,7 @@
 package nvm
 
 import (
+	"bytes"
 	"testing"
 
 	"fmt"
@@ -59,3 +60,31 @@ func TestStorageHeader(t *testing.T) {
 	assert.Equal(t, header.DataRegionSize, otherHeader.DataRegionSize)
 
 }
+
+func TestStorageHeaderVersion(t *testing.T) {
+	header := DefaultStorageHeader()
+	assert.True(t, header.IsCurrentVersion())
+	for _, v := range []struct {
+		major, minor uint16
+		ok           bool
+	}{
+		{MAJOR_VERSION, MINOR_VERSION - 1, true},
+		{MIN_MAJOR_VERSION - 1, MINOR_VERSION, false},
+		//the Rust files are upgraded by storage/lusf.go
+		{RUST_MAJOR_VERSION, RUST_MINOR_VERSION, true},
+		//newer than the code
+		{MAJOR_VERSION, MINOR_VERSION + 1, false},
+		{MAJOR_VERSION + 1, 0, false},
+	} {
+		header.MajorVersion, header.MinorVersion = v.major, v.minor
+		var buf bytes.Buffer
+		assert.Nil(t, header.WriteHeaderRegionTo(&buf))
+		read, err := ReadFrom(&buf)
+		if v.ok {
+			assert.Nil(t, err)
+			assert.False(t, read.IsCurrentVersion())
+		} else {
+			assert.Error(t, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package nvm
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+/*
+The storage files are protected by advisory flock, one writer or many readers:
+
+LOCK_EXCLUSIVE is held by the writer, such as Open and CreateIfAbsent, it fails if the
+file is opened by another writer or locked by readers.
+LOCK_SHARED is held by OpenReadOnly, so the writer could not start while readers are
+inspecting the file. If the file is already opened by a writer, OpenReadOnly reads it
+with LOCK_NONE, the readers may see the changes of the writer.
+
+The locks are released when the file is closed or the process exits.
+*/
+type LockMode int
+
+const (
+	LOCK_NONE LockMode = iota
+	LOCK_SHARED
+	LOCK_EXCLUSIVE
+)
+
+func (mode LockMode) String() string {
+	switch mode {
+	case LOCK_NONE:
+		return "none"
+	case LOCK_SHARED:
+		return "shared"
+	case LOCK_EXCLUSIVE:
+		return "exclusive"
+	default:
+		return "unknown"
+	}
+}
+
+//lockFile does not block, it fails with DeviceBusy if the file is locked by others
+func lockFile(f *os.File, mode LockMode) error {
+	var how int
+	switch mode {
+	case LOCK_NONE:
+		return nil
+	case LOCK_SHARED:
+		how = syscall.LOCK_SH
+	case LOCK_EXCLUSIVE:
+		how = syscall.LOCK_EX
+	default:
+		return errors.Wrapf(internalerror.InvalidInput, "unknown lock mode %d", mode)
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		if mode == LOCK_EXCLUSIVE {
+			return errors.Wrapf(internalerror.DeviceBusy, "%s is opened by another writer or reader", f.Name())
+		}
+		return errors.Wrapf(internalerror.DeviceBusy, "%s is opened by a writer", f.Name())
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to lock %s", f.Name())
+	}
+	return nil
+}
+
+func lockFileWithExclusiveLock(f *os.File) error {
+	return lockFile(f, LOCK_EXCLUSIVE)
+}
@@ -2,6 +2,8 @@ package nvm
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
 
 	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
@@ -28,6 +30,64 @@ func NewFromVec(vec []byte) (*MemoryNVM, error) {
 	return &MemoryNVM{vec: vec, position: 0}, nil
 }
 
+//NewFromFile reads the file written by SaveTo into a new MemoryNVM
+func NewFromFile(path string) (*MemoryNVM, error) {
+	vec, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read memory snapshot %s", path)
+	}
+	if !block.Min().IsAligned(uint64(len(vec))) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "size of memory snapshot %s is not aligned: %d", path, len(vec))
+	}
+	return &MemoryNVM{vec: vec, position: 0}, nil
+}
+
+/*
+SaveTo writes all the bytes of the memory into the file at path, the file is replaced atomically
+by renaming a temporary file, so a crash never leaves a partial snapshot. The file is the raw
+bytes, the snapshot of a storage could also be opened as a file by OpenCannylsStorage.
+*/
+func (memory *MemoryNVM) SaveTo(path string) (err error) {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create memory snapshot %s", tmp)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if _, err = file.Write(memory.vec); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to write memory snapshot %s", tmp)
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to sync memory snapshot %s", tmp)
+	}
+	if err = file.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close memory snapshot %s", tmp)
+	}
+	return os.Rename(tmp, path)
+}
+
+//LoadFrom copies the file written by SaveTo into the memory, the sizes must be the same.
+//The memory is changed in place, so its splits see the loaded bytes too
+func (memory *MemoryNVM) LoadFrom(path string) error {
+	vec, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read memory snapshot %s", path)
+	}
+	if len(vec) != len(memory.vec) {
+		return errors.Wrapf(internalerror.InvalidInput, "size of memory snapshot %s is %d, the memory is %d",
+			path, len(vec), len(memory.vec))
+	}
+	copy(memory.vec, vec)
+	memory.position = 0
+	return nil
+}
+
 func (memory *MemoryNVM) Sync() error {
 	return nil
 }
@@ -99,6 +159,40 @@ func (memory *MemoryNVM) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
+func (memory *MemoryNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	length, err := checkReadAt(memory, len(buf), offset)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(buf[:length], memory.vec[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (memory *MemoryNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := checkWriteAt(memory, len(buf), offset); err != nil {
+		return 0, err
+	}
+	return copy(memory.vec[offset:], buf), nil
+}
+
+func (memory *MemoryNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	var total int
+	for _, buf := range bufs {
+		total += len(buf)
+	}
+	if err := checkWriteAt(memory, total, offset); err != nil {
+		return 0, err
+	}
+	var n int
+	for _, buf := range bufs {
+		n += copy(memory.vec[offset+int64(n):], buf)
+	}
+	return n, nil
+}
+
 func (memory *MemoryNVM) Close() error {
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	_ "fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"os"
 	"testing"
 )
 
@@ -65,3 +66,64 @@ func newBuffer(size int, initial byte) []byte {
 	}
 	return n
 }
+
+func TestMemoryReadAtWriteAt(t *testing.T) {
+	nvm, _ := New(2048)
+	n, err := nvm.WriteAt(newBuffer(512, 1), 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, 512, n)
+	//the cursor is not moved
+	assert.Equal(t, uint64(0), nvm.Position())
+
+	n, err = nvm.Writev([][]byte{newBuffer(512, 2), newBuffer(512, 3)}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1024, n)
+
+	buf := make([]byte, 1536)
+	n, err = nvm.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1536, n)
+	assert.Equal(t, newBuffer(512, 2), buf[:512])
+	assert.Equal(t, newBuffer(512, 3), buf[512:1024])
+	assert.Equal(t, newBuffer(512, 1), buf[1024:])
+
+	//reading over the end is short
+	n, err = nvm.ReadAt(buf, 1024)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1024, n)
+
+	_, err = nvm.WriteAt(newBuffer(1024, 1), 1536)
+	assert.Error(t, err)
+	_, err = nvm.WriteAt(newBuffer(512, 1), 100)
+	assert.Error(t, err)
+}
+
+func TestMemorySaveTo(t *testing.T) {
+	nvm, _ := New(2048)
+	_, err := nvm.WriteAt(newBuffer(1024, 3), 512)
+	assert.Nil(t, err)
+	assert.Nil(t, nvm.SaveTo("memory.snapshot"))
+	defer os.Remove("memory.snapshot")
+	_, err = os.Stat("memory.snapshot.tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	loaded, err := NewFromFile("memory.snapshot")
+	assert.Nil(t, err)
+	assert.Equal(t, nvm.vec, loaded.vec)
+
+	//the splits see the loaded bytes
+	_, right, err := nvm.Split(1024)
+	assert.Nil(t, err)
+	_, err = nvm.WriteAt(newBuffer(1024, 5), 1024)
+	assert.Nil(t, err)
+	assert.Nil(t, nvm.LoadFrom("memory.snapshot"))
+	buf := make([]byte, 512)
+	_, err = right.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, newBuffer(512, 3), buf)
+
+	small, _ := New(512)
+	assert.Error(t, small.LoadFrom("memory.snapshot"))
+	_, err = NewFromFile("memory.absent")
+	assert.Error(t, err)
+}
@@ -0,0 +1,347 @@
+package nvm
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/util"
+)
+
+/*
+MirroredNVM keeps the same data in several NonVolatileMemorys like RAID1, every write goes to
+all the members, and every read goes to one of them in turn.
+
+If hedgeAfter is not 0, a read which does not complete in hedgeAfter is issued again to the
+next member, and the first one to complete is taken, so a slow member does not hold the read.
+A read which fails is issued to the next member at once.
+*/
+type MirroredNVM struct {
+	members         []NonVolatileMemory
+	hedgeAfter      time.Duration
+	cursor_position uint64
+	view_start      uint64
+	view_end        uint64
+	block_size      block.BlockSize
+	splited         bool //splited MirroredNVM is not allowd to close the members
+	//shared by the splited MirroredNVMs
+	shared *mirrorShared
+}
+
+type mirrorShared struct {
+	//the member of the next read
+	next   uint32
+	hedged uint64
+	won    uint64
+}
+
+//HedgeStats is the number of the hedged reads, and how many of them are completed by the hedge first
+type HedgeStats struct {
+	Hedged uint64
+	Won    uint64
+}
+
+//NewMirroredNVM takes over the members, the capacity is the smallest one of them.
+//The members must have the same block size
+func NewMirroredNVM(members []NonVolatileMemory, hedgeAfter time.Duration) (*MirroredNVM, error) {
+	if len(members) == 0 {
+		return nil, errors.Wrap(internalerror.InvalidInput, "no member for MirroredNVM")
+	}
+	if hedgeAfter < 0 {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "invalid hedge latency %v", hedgeAfter)
+	}
+	blockSize, err := membersBlockSize(members)
+	if err != nil {
+		return nil, err
+	}
+	capacity := members[0].Capacity()
+	for _, member := range members[1:] {
+		capacity = util.Min(capacity, member.Capacity())
+	}
+	return &MirroredNVM{
+		members:         members,
+		hedgeAfter:      hedgeAfter,
+		cursor_position: 0,
+		view_start:      0,
+		view_end:        blockSize.FloorAlign(capacity),
+		block_size:      blockSize,
+		splited:         false,
+		shared:          &mirrorShared{},
+	}, nil
+}
+
+//CreateMirroredIfAbsent creates all the member files, each of them has capacity bytes
+func CreateMirroredIfAbsent(paths []string, capacity uint64, hedgeAfter time.Duration) (*MirroredNVM, error) {
+	members := make([]NonVolatileMemory, 0, len(paths))
+	for _, path := range paths {
+		member, err := CreateIfAbsent(path, capacity)
+		if err != nil {
+			closeMembers(members)
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	mirrored, err := NewMirroredNVM(members, hedgeAfter)
+	if err != nil {
+		closeMembers(members)
+		return nil, err
+	}
+	return mirrored, nil
+}
+
+//OpenMirrored opens the member files, they must have the header of the same storage
+func OpenMirrored(paths []string, hedgeAfter time.Duration) (nvm *MirroredNVM, header *StorageHeader, err error) {
+	if len(paths) == 0 {
+		return nil, nil, errors.Wrap(internalerror.InvalidInput, "no member for MirroredNVM")
+	}
+	members := make([]NonVolatileMemory, 0, len(paths))
+	for _, path := range paths {
+		member, memberHeader, err := Open(path)
+		if err != nil {
+			closeMembers(members)
+			return nil, nil, err
+		}
+		members = append(members, member)
+		if header == nil {
+			header = memberHeader
+		} else if !bytes.Equal(header.UUID.Bytes(), memberHeader.UUID.Bytes()) {
+			closeMembers(members)
+			return nil, nil, errors.Wrapf(internalerror.InvalidInput, "%s is not a mirror of %s", path, paths[0])
+		}
+	}
+	if nvm, err = NewMirroredNVM(members, hedgeAfter); err != nil {
+		closeMembers(members)
+		return nil, nil, err
+	}
+	return nvm, header, nil
+}
+
+//HedgeStats returns the stats of all the splited MirroredNVMs
+func (nvm *MirroredNVM) HedgeStats() HedgeStats {
+	return HedgeStats{
+		Hedged: atomic.LoadUint64(&nvm.shared.hedged),
+		Won:    atomic.LoadUint64(&nvm.shared.won),
+	}
+}
+
+func (nvm *MirroredNVM) Sync() error {
+	for _, member := range nvm.members {
+		if err := member.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nvm *MirroredNVM) Position() uint64 {
+	return nvm.cursor_position - nvm.view_start
+}
+
+func (nvm *MirroredNVM) Capacity() uint64 {
+	return nvm.view_end - nvm.view_start
+}
+
+func (nvm *MirroredNVM) RawSize() int64 {
+	var size int64
+	for _, member := range nvm.members {
+		size += member.RawSize()
+	}
+	return size
+}
+
+//BlockSize is the block size of the members
+func (nvm *MirroredNVM) BlockSize() block.BlockSize {
+	return nvm.block_size
+}
+
+func (nvm *MirroredNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	if block.Min().CeilAlign(uint64(position)) != position {
+		return nil, nil, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in split", position)
+	}
+
+	leftNVM := &MirroredNVM{
+		members:         nvm.members,
+		hedgeAfter:      nvm.hedgeAfter,
+		view_start:      nvm.view_start,
+		cursor_position: nvm.view_start,
+		view_end:        nvm.view_start + position,
+		block_size:      nvm.block_size,
+		splited:         true,
+		shared:          nvm.shared,
+	}
+
+	rightNVM := &MirroredNVM{
+		members:         nvm.members,
+		hedgeAfter:      nvm.hedgeAfter,
+		view_start:      leftNVM.view_end,
+		view_end:        nvm.view_end,
+		cursor_position: leftNVM.view_end,
+		block_size:      nvm.block_size,
+		splited:         true,
+		shared:          nvm.shared,
+	}
+	return leftNVM, rightNVM, nil
+}
+
+func (nvm *MirroredNVM) Seek(offset int64, whence int) (int64, error) {
+	if !block.Min().IsAligned(uint64(offset)) {
+		return offset, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in seek", offset)
+	}
+
+	abs, err := ConvertToOffset(nvm, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	if abs > int64(nvm.Capacity()) || abs < 0 {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "seek abs is wrong %d in seek", abs)
+	}
+
+	nvm.cursor_position = nvm.view_start + uint64(abs)
+	return offset, nil
+}
+
+func (nvm *MirroredNVM) Read(buf []byte) (n int, err error) {
+	if !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d", len(buf))
+	}
+	len := util.Min(nvm.Capacity()-nvm.Position(), uint64(len(buf)))
+	if n, err = nvm.ReadAt(buf[:len], int64(nvm.Position())); err != nil {
+		return -1, err
+	}
+	nvm.cursor_position += len
+	return n, nil
+}
+
+func (nvm *MirroredNVM) Write(buf []byte) (n int, err error) {
+	if !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d", len(buf))
+	}
+	len := util.Min(nvm.Capacity()-nvm.Position(), uint64(len(buf)))
+	if n, err = nvm.WriteAt(buf[:len], int64(nvm.Position())); err != nil {
+		return -1, err
+	}
+	nvm.cursor_position += len
+	return n, nil
+}
+
+type mirrorRead struct {
+	buf []byte
+	err error
+	//the read is issued because the first one is too slow
+	hedge bool
+}
+
+//readMember reads into a new buffer, because the slower read may still be running after ReadAt returns
+func (nvm *MirroredNVM) readMember(member int, length int, offset uint64, hedge bool, done chan<- mirrorRead) {
+	buf := block.NewAlignedBytes(length, block.Min()).AsBytes()
+	_, err := nvm.members[member].ReadAt(buf, int64(offset))
+	done <- mirrorRead{buf: buf, err: errors.Wrap(err, "MirroredNVM failed to read"), hedge: hedge}
+}
+
+func (nvm *MirroredNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	length, err := checkReadAt(nvm, len(buf), offset)
+	if err != nil {
+		return 0, err
+	}
+	first := int(atomic.AddUint32(&nvm.shared.next, 1) % uint32(len(nvm.members)))
+	if nvm.hedgeAfter > 0 && len(nvm.members) > 1 {
+		err = nvm.hedgedReadAt(buf[:length], nvm.view_start+uint64(offset), first)
+	} else {
+		err = nvm.failoverReadAt(buf[:length], nvm.view_start+uint64(offset), first)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if length < uint64(len(buf)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+//failoverReadAt reads from the members one by one until one of them succeeds
+func (nvm *MirroredNVM) failoverReadAt(buf []byte, position uint64, first int) (err error) {
+	for i := range nvm.members {
+		member := nvm.members[(first+i)%len(nvm.members)]
+		if _, err = member.ReadAt(buf, int64(position)); err == nil {
+			return nil
+		}
+	}
+	return errors.Wrap(err, "MirroredNVM failed to read")
+}
+
+//hedgedReadAt issues the read to the next member if the first one is slower than hedgeAfter or fails
+func (nvm *MirroredNVM) hedgedReadAt(buf []byte, position uint64, first int) (err error) {
+	//buffered, so the slower reads never block
+	done := make(chan mirrorRead, len(nvm.members))
+	issued, pending := 0, 0
+	issue := func(hedge bool) {
+		go nvm.readMember((first+issued)%len(nvm.members), len(buf), position, hedge, done)
+		issued++
+		pending++
+	}
+	issue(false)
+
+	timer := time.NewTimer(nvm.hedgeAfter)
+	defer timer.Stop()
+	hedgeTimer := timer.C
+	for pending > 0 {
+		select {
+		case result := <-done:
+			pending--
+			if result.err == nil {
+				copy(buf, result.buf)
+				if result.hedge {
+					atomic.AddUint64(&nvm.shared.won, 1)
+				}
+				return nil
+			}
+			err = result.err
+			if issued < len(nvm.members) {
+				issue(false)
+			}
+		case <-hedgeTimer:
+			//only hedge once
+			hedgeTimer = nil
+			if issued < len(nvm.members) {
+				atomic.AddUint64(&nvm.shared.hedged, 1)
+				issue(true)
+			}
+		}
+	}
+	return err
+}
+
+func (nvm *MirroredNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := checkWriteAt(nvm, len(buf), offset); err != nil {
+		return 0, err
+	}
+	for _, member := range nvm.members {
+		if _, err := member.WriteAt(buf, int64(nvm.view_start)+offset); err != nil {
+			return 0, errors.Wrap(err, "MirroredNVM failed to write")
+		}
+	}
+	return len(buf), nil
+}
+
+//Writev coalesces the buffers once, instead of in every member
+func (nvm *MirroredNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	return nvm.WriteAt(Coalesce(bufs, block.Min()), offset)
+}
+
+func (nvm *MirroredNVM) Close() error {
+	if nvm.splited {
+		return nil
+	}
+	var err error
+	for _, member := range nvm.members {
+		if e := member.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package nvm
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+)
+
+//slowNVM delays every read, or fails it
+type slowNVM struct {
+	NonVolatileMemory
+	delay time.Duration
+	fail  bool
+}
+
+func (slow *slowNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	time.Sleep(slow.delay)
+	if slow.fail {
+		return 0, errors.New("broken member")
+	}
+	return slow.NonVolatileMemory.ReadAt(buf, offset)
+}
+
+func TestMirroredNVMReadWrite(t *testing.T) {
+	m0, _ := New(4096)
+	//the bigger member only uses 4096 bytes
+	m1, _ := New(8192)
+
+	_, err := NewMirroredNVM(nil, 0)
+	assert.Error(t, err)
+
+	//the members of another block size are rejected
+	bs, _ := block.NewBlockSize(4096)
+	big, err := CreateIfAbsentWithOptions("mirrored-4k", 8192, FileOptions{BlockSize: bs})
+	assert.Nil(t, err)
+	defer os.Remove("mirrored-4k")
+	_, err = NewMirroredNVM([]NonVolatileMemory{m0, big}, 0)
+	assert.Error(t, err)
+	big.Close()
+
+	nvm, err := NewMirroredNVM([]NonVolatileMemory{m0, m1}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4096), nvm.Capacity())
+
+	data := make([]byte, 1024)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+	nvm.Seek(512, os.SEEK_SET)
+	n, err := nvm.Writev([][]byte{data[:512], data[512:]}, 512)
+	assert.Nil(t, err)
+	assert.Equal(t, 1024, n)
+	assert.Equal(t, data, m0.AsBytes()[512:1536])
+	assert.Equal(t, data, m1.AsBytes()[512:1536])
+
+	_, right, err := nvm.Split(512)
+	assert.Nil(t, err)
+	//read from both members in turn
+	for i := 0; i < 2; i++ {
+		readbuf := make([]byte, 1024)
+		n, err = right.ReadAt(readbuf, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 1024, n)
+		assert.Equal(t, data, readbuf)
+	}
+
+	//not aligned
+	_, err = right.Write([]byte("foo"))
+	assert.Error(t, err)
+}
+
+func TestMirroredNVMHedge(t *testing.T) {
+	m0, _ := New(4096)
+	m1, _ := New(4096)
+	slow := &slowNVM{NonVolatileMemory: m0, delay: 200 * time.Millisecond}
+
+	nvm, err := NewMirroredNVM([]NonVolatileMemory{slow, m1}, 10*time.Millisecond)
+	assert.Nil(t, err)
+	data := make([]byte, 512)
+	data[0] = 'x'
+	_, err = nvm.WriteAt(data, 0)
+	assert.Nil(t, err)
+
+	//one of the two reads goes to the slow member first, and is hedged
+	for i := 0; i < 2; i++ {
+		readbuf := make([]byte, 512)
+		start := time.Now()
+		_, err = nvm.ReadAt(readbuf, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, data, readbuf)
+		assert.True(t, time.Since(start) < 150*time.Millisecond)
+	}
+	assert.Equal(t, HedgeStats{Hedged: 1, Won: 1}, nvm.HedgeStats())
+}
+
+func TestMirroredNVMFailover(t *testing.T) {
+	m0, _ := New(4096)
+	m1, _ := New(4096)
+	broken := &slowNVM{NonVolatileMemory: m0, fail: true}
+
+	data := make([]byte, 512)
+	data[0] = 'x'
+	for _, hedgeAfter := range []time.Duration{0, time.Second} {
+		nvm, err := NewMirroredNVM([]NonVolatileMemory{broken, m1}, hedgeAfter)
+		assert.Nil(t, err)
+		_, err = nvm.WriteAt(data, 0)
+		assert.Nil(t, err)
+		for i := 0; i < 2; i++ {
+			readbuf := make([]byte, 512)
+			_, err = nvm.ReadAt(readbuf, 0)
+			assert.Nil(t, err)
+			assert.Equal(t, data, readbuf)
+		}
+		assert.Equal(t, uint64(0), nvm.HedgeStats().Hedged)
+	}
+
+	//all the members fail
+	nvm, _ := NewMirroredNVM([]NonVolatileMemory{broken}, 0)
+	_, err := nvm.ReadAt(make([]byte, 512), 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,261 @@
+// +build linux darwin
+
+package nvm
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/util"
+)
+
+type MmapFlushPolicy int
+
+const (
+	//msync the whole mapping when Sync is called, this is the same as FileNVM
+	MMAP_FLUSH_ON_SYNC MmapFlushPolicy = iota
+	//msync the written pages after every write, Sync does nothing more
+	MMAP_FLUSH_ON_WRITE
+)
+
+//the mapping and the policy are shared by the splited MmapNVMs
+type mmapFile struct {
+	file      *os.File
+	data      []byte
+	policy    MmapFlushPolicy
+	blockSize block.BlockSize
+}
+
+func (mfile *mmapFile) msync(start uint64, end uint64) error {
+	pageSize := uint64(os.Getpagesize())
+	start = start / pageSize * pageSize
+	if end <= start {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&mfile.data[start])),
+		uintptr(end-start), syscall.MS_SYNC)
+	if errno != 0 {
+		return errors.Wrap(errno, "MmapNVM failed to msync")
+	}
+	return nil
+}
+
+/*
+MmapNVM maps the whole storage file, Read is just a memcpy from the mapping.
+Write copies into the mapping, when the data reach the disk depends on MmapFlushPolicy
+*/
+type MmapNVM struct {
+	mfile           *mmapFile
+	cursor_position uint64
+	view_start      uint64
+	view_end        uint64
+	splited         bool //splited file is not allowd to unmap
+}
+
+//OpenMmap opens an existing storage file like Open, and maps it
+func OpenMmap(path string, policy MmapFlushPolicy) (nvm *MmapNVM, header *StorageHeader, err error) {
+	var f *os.File
+
+	if f, err = os.OpenFile(path, os.O_RDWR, 0755); err != nil {
+		return nil, nil, err
+	}
+	if header, err = ReadFromFile(f); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if err = lockFileWithExclusiveLock(f); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	capacity := header.StorageSize()
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	//touching the pages beyond the end of file causes SIGBUS
+	if uint64(info.Size()) < capacity {
+		if err = f.Truncate(int64(capacity)); err != nil {
+			f.Close()
+			return nil, nil, errors.Wrap(err, "failed to expand the file")
+		}
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(capacity), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "failed to mmap")
+	}
+
+	nvm = &MmapNVM{
+		mfile: &mmapFile{
+			file:      f,
+			data:      data,
+			policy:    policy,
+			blockSize: header.BlockSize,
+		},
+		cursor_position: 0,
+		view_start:      0,
+		view_end:        capacity,
+		splited:         false,
+	}
+	return nvm, header, nil
+}
+
+//SetFlushPolicy changes the policy of all the splited MmapNVMs
+func (nvm *MmapNVM) SetFlushPolicy(policy MmapFlushPolicy) {
+	nvm.mfile.policy = policy
+}
+
+func (nvm *MmapNVM) Sync() error {
+	if nvm.mfile.policy != MMAP_FLUSH_ON_SYNC {
+		return nil
+	}
+	return nvm.mfile.msync(nvm.view_start, nvm.view_end)
+}
+
+func (nvm *MmapNVM) Position() uint64 {
+	return nvm.cursor_position - nvm.view_start
+}
+
+func (nvm *MmapNVM) Capacity() uint64 {
+	return nvm.view_end - nvm.view_start
+}
+
+func (nvm *MmapNVM) RawSize() int64 {
+	return fileRawSize(nvm.mfile.file)
+}
+
+//BlockSize is the block size in the storage header
+func (nvm *MmapNVM) BlockSize() block.BlockSize {
+	return nvm.mfile.blockSize
+}
+
+func (nvm *MmapNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	if block.Min().CeilAlign(uint64(position)) != position {
+		return nil, nil, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in split", position)
+	}
+
+	leftNVM := &MmapNVM{
+		mfile:           nvm.mfile,
+		view_start:      nvm.view_start,
+		cursor_position: nvm.view_start,
+		view_end:        nvm.view_start + position,
+		splited:         true,
+	}
+
+	rightNVM := &MmapNVM{
+		mfile:           nvm.mfile,
+		view_start:      leftNVM.view_end,
+		view_end:        nvm.view_end,
+		cursor_position: leftNVM.view_end,
+		splited:         true,
+	}
+	return leftNVM, rightNVM, nil
+}
+
+func (nvm *MmapNVM) Seek(offset int64, whence int) (int64, error) {
+	if !block.Min().IsAligned(uint64(offset)) {
+		return offset, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in seek", offset)
+	}
+
+	abs, err := ConvertToOffset(nvm, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	if abs > int64(nvm.Capacity()) || abs < 0 {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "seek abs is wrong %d in seek", abs)
+	}
+
+	nvm.cursor_position = nvm.view_start + uint64(abs)
+	return offset, nil
+}
+
+func (nvm *MmapNVM) Read(buf []byte) (n int, err error) {
+	maxLen := nvm.Capacity() - nvm.Position()
+	bufLen := uint64(len(buf))
+	if !block.Min().IsAligned(uint64(bufLen)) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, in read", bufLen)
+	}
+
+	len := util.Min(maxLen, bufLen)
+	copy(buf[:len], nvm.mfile.data[nvm.cursor_position:])
+	nvm.cursor_position += len
+	return int(len), nil
+}
+
+func (nvm *MmapNVM) Write(buf []byte) (n int, err error) {
+	maxLen := nvm.Capacity() - nvm.Position()
+	bufLen := uint64(len(buf))
+
+	if !block.Min().IsAligned(uint64(bufLen)) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, in write", bufLen)
+	}
+
+	len := util.Min(maxLen, bufLen)
+	start := nvm.cursor_position
+	copy(nvm.mfile.data[start:start+len], buf)
+
+	if nvm.mfile.policy == MMAP_FLUSH_ON_WRITE {
+		if err = nvm.mfile.msync(start, start+len); err != nil {
+			return -1, err
+		}
+	}
+
+	nvm.cursor_position += len
+	return int(len), nil
+}
+
+func (nvm *MmapNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	length, err := checkReadAt(nvm, len(buf), offset)
+	if err != nil {
+		return 0, err
+	}
+	start := nvm.view_start + uint64(offset)
+	copy(buf[:length], nvm.mfile.data[start:start+length])
+	if length < uint64(len(buf)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+func (nvm *MmapNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	return nvm.Writev([][]byte{buf}, offset)
+}
+
+func (nvm *MmapNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	var total int
+	for _, buf := range bufs {
+		total += len(buf)
+	}
+	if err := checkWriteAt(nvm, total, offset); err != nil {
+		return 0, err
+	}
+	start := nvm.view_start + uint64(offset)
+	position := start
+	for _, buf := range bufs {
+		position += uint64(copy(nvm.mfile.data[position:], buf))
+	}
+	if nvm.mfile.policy == MMAP_FLUSH_ON_WRITE {
+		if err := nvm.mfile.msync(start, position); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func (nvm *MmapNVM) Close() error {
+	if !nvm.splited {
+		syscall.Munmap(nvm.mfile.data)
+		return nvm.mfile.file.Close()
+	} else {
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+// +build linux darwin
+
+package nvm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMmapNVMReadWrite(t *testing.T) {
+	file, err := CreateIfAbsent("mmap-test.lusf", 10*1024)
+	assert.Nil(t, err)
+	defer os.Remove("mmap-test.lusf")
+
+	header := DefaultStorageHeader()
+	header.DataRegionSize = 8 * 1024
+	buf := new(bytes.Buffer)
+	assert.Nil(t, header.WriteTo(buf))
+	_, err = file.Write(align(buf.Bytes()))
+	assert.Nil(t, err)
+	file.Close()
+
+	nvm, header, err := OpenMmap("mmap-test.lusf", MMAP_FLUSH_ON_WRITE)
+	assert.Nil(t, err)
+	capacity := header.StorageSize()
+	assert.Equal(t, capacity, nvm.Capacity())
+	assert.Equal(t, int64(capacity), nvm.RawSize())
+
+	_, right, err := nvm.Split(1024)
+	assert.Nil(t, err)
+	n, err := right.Write(align([]byte("foo")))
+	assert.Nil(t, err)
+	assert.Equal(t, 512, n)
+
+	nvm.SetFlushPolicy(MMAP_FLUSH_ON_SYNC)
+	_, err = right.Write(align([]byte("bar")))
+	assert.Nil(t, err)
+	assert.Nil(t, right.Sync())
+
+	right.Seek(0, os.SEEK_SET)
+	readbuf := make([]byte, 1024)
+	n, err = right.Read(readbuf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1024, n)
+	assert.Equal(t, []byte("foo"), readbuf[:3])
+	assert.Equal(t, []byte("bar"), readbuf[512:515])
+
+	//not aligned
+	_, err = right.Write([]byte("foo"))
+	assert.Error(t, err)
+	nvm.Close()
+
+	//the data is visible to FileNVM
+	fileNVM, _, err := Open("mmap-test.lusf")
+	assert.Nil(t, err)
+	fileNVM.Seek(1024, os.SEEK_SET)
+	readbuf = alignedWithSize(512)
+	_, err = fileNVM.Read(readbuf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), readbuf[:3])
+	fileNVM.Close()
+}
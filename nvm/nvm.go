@@ -1,15 +1,27 @@
 package nvm
 
 import (
-	"errors"
 	"io"
+	"syscall"
 
+	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
 )
 
+/*
+NonVolatileMemory is the device of the storage. ReadAt, WriteAt and Writev do not use or move
+the cursor, so they could be used without Seek. ReadAt returns io.EOF if it reads beyond the capacity,
+WriteAt and Writev fail if they write beyond it. The offset and the length must be aligned to BlockSize,
+the length of a single buffer of Writev need not be aligned, but the total length must be.
+*/
 type NonVolatileMemory interface {
 	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
 	io.Closer
+	//Writev writes all the buffers at offset as if they were one buffer
+	Writev(bufs [][]byte, offset int64) (int, error)
 	Sync() error
 	Position() uint64
 	Capacity() uint64
@@ -18,13 +30,65 @@ type NonVolatileMemory interface {
 	RawSize() int64
 }
 
+//HolePuncher is implemented by the NonVolatileMemory which could return
+//the space of the released blocks to the filesystem, such as a sparse file
+type HolePuncher interface {
+	//PunchHole fails with an error of IsPunchHoleUnsupported if the filesystem could not do it
+	PunchHole(offset uint64, length uint64) error
+}
+
+//IsPunchHoleUnsupported returns true if the error of PunchHole means the filesystem never punches holes
+func IsPunchHoleUnsupported(err error) bool {
+	err = errors.Cause(err)
+	return err == syscall.EOPNOTSUPP || err == syscall.ENOSYS
+}
+
+//Prefetcher is implemented by the NonVolatileMemory which could read ahead the bytes
+//expected to be read soon, it is only a hint
+type Prefetcher interface {
+	WillNeed(offset uint64, length uint64) error
+}
+
+//Resizer is implemented by the NonVolatileMemory whose capacity could be changed online
+type Resizer interface {
+	Resize(capacity uint64) error
+}
+
+//Cloner is implemented by the NonVolatileMemory which could be copied by the reflink of the
+//filesystem, the copy shares the blocks until either of them is written
+type Cloner interface {
+	CloneTo(path string) error
+}
+
 var (
 	MAGIC_NUMBER = [4]byte{'l', 'u', 's', 'f'}
 )
 
+/*
+The version of the on disk format. Bump MINOR_VERSION if the format is changed, and register
+a migration from the previous version in storage/migrate, the older files are upgraded when
+they are opened. Bump MAJOR_VERSION if the header itself is changed.
+The files newer than the code are rejected
+*/
+const (
+	MAJOR_VERSION uint16 = 2
+	MINOR_VERSION uint16 = 4
+	//MIN_MAJOR_VERSION is the oldest major version whose header could be read
+	MIN_MAJOR_VERSION uint16 = 2
+)
+
+/*
+The version of the files written by the original cannyls in Rust. Its header is the same as ours,
+but its lump ids are 128 bit and it only knows the basic records, so the files are upgraded in
+place when they are opened, or copied by storage.ImportLusf. Storage.ExportLusf writes them, see
+storage/lusf.go
+*/
+const (
+	RUST_MAJOR_VERSION uint16 = 1
+	RUST_MINOR_VERSION uint16 = 1
+)
+
 const (
-	MAJOR_VERSION           uint16 = 2
-	MINOR_VERSION           uint16 = 1
 	MAX_JOURNAL_REGION_SIZE uint64 = (1 << 40) - 1
 	MAX_DATA_REGION_SIZE    uint64 = MAX_JOURNAL_REGION_SIZE * uint64(block.MIN)
 )
@@ -43,3 +107,46 @@ func ConvertToOffset(nvm NonVolatileMemory, offset int64, whence int) (int64, er
 	}
 	return abs, nil
 }
+
+//checkReadAt returns the length which could be read at offset, it is less than length at the end of nvm
+func checkReadAt(nvm NonVolatileMemory, length int, offset int64) (uint64, error) {
+	if !block.Min().IsAligned(uint64(length)) || !block.Min().IsAligned(uint64(offset)) {
+		return 0, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, %d in read", offset, length)
+	}
+	if offset < 0 || uint64(offset) > nvm.Capacity() {
+		return 0, errors.Wrapf(internalerror.InvalidInput, "read offset is wrong %d", offset)
+	}
+	if nvm.Capacity()-uint64(offset) < uint64(length) {
+		return nvm.Capacity() - uint64(offset), nil
+	}
+	return uint64(length), nil
+}
+
+//checkWriteAt fails if [offset, offset+length) is not aligned or not in nvm
+func checkWriteAt(nvm NonVolatileMemory, length int, offset int64) error {
+	if !block.Min().IsAligned(uint64(length)) || !block.Min().IsAligned(uint64(offset)) {
+		return errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, %d in write", offset, length)
+	}
+	if offset < 0 || uint64(offset)+uint64(length) > nvm.Capacity() {
+		return errors.Wrapf(internalerror.InvalidInput, "write %d bytes at %d is out of range", length, offset)
+	}
+	return nil
+}
+
+//Coalesce copies the buffers into one aligned buffer, it is used by Writev of the NonVolatileMemory
+//which could not write many buffers at once. A single buffer is returned as is
+func Coalesce(bufs [][]byte, blockSize block.BlockSize) []byte {
+	if len(bufs) == 1 {
+		return bufs[0]
+	}
+	var total int
+	for _, buf := range bufs {
+		total += len(buf)
+	}
+	coalesced := block.NewAlignedBytes(total, blockSize).AsBytes()
+	var n int
+	for _, buf := range bufs {
+		n += copy(coalesced[n:], buf)
+	}
+	return coalesced
+}
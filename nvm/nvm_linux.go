@@ -8,6 +8,9 @@ import (
 	"strings"
 	"syscall"
 	"fmt"
+	"unsafe"
+
+	"github.com/thesues/cannyls-go/block"
 )
 
 // OpenFile is a modified version of os.OpenFile which sets O_DIRECT
@@ -15,8 +18,32 @@ func openFileWithDirectIO(name string, flag int, perm os.FileMode) (file *os.Fil
 	return os.OpenFile(name, syscall.O_DIRECT|flag, perm)
 }
 
-func lockFileWithExclusiveLock(f *os.File) error {
-	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x1
+	FALLOC_FL_PUNCH_HOLE = 0x2
+)
+
+func punchHole(f *os.File, offset uint64, length uint64) error {
+	return syscall.Fallocate(int(f.Fd()), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, int64(offset), int64(length))
+}
+
+//FICLONE is _IOW(0x94, 9, int) of linux/fs.h, it is supported by XFS, Btrfs and OCFS2
+const FICLONE = 0x40049409
+
+func reflink(dst *os.File, src *os.File) error {
+	if _, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), FICLONE, src.Fd()); e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
+const POSIX_FADV_WILLNEED = 3
+
+func fadviseWillNeed(f *os.File, offset uint64, length uint64) error {
+	if _, _, e1 := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(offset), uintptr(length), POSIX_FADV_WILLNEED, 0, 0); e1 != 0 {
+		return e1
+	}
+	return nil
 }
 
 // copy-paste from src/pkg/syscall/zsyscall_linux_amd64.go
@@ -33,6 +60,34 @@ func isDirectIO(val int) bool {
 	return (val & syscall.O_DIRECT) != 0
 }
 
+const (
+	BLKSSZGET    = 0x1268
+	BLKPBSZGET   = 0x127b
+	BLKGETSIZE64 = 0x80081272
+)
+
+//deviceBytes returns the size of the block device
+func deviceBytes(f *os.File) (uint64, error) {
+	var size uint64
+	if _, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); e1 != 0 {
+		return 0, e1
+	}
+	return size, nil
+}
+
+//sectorSize returns the logical and physical sector size of the block device
+func sectorSize(f *os.File) (logical uint32, physical uint32, err error) {
+	var size int32
+	if _, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), BLKSSZGET, uintptr(unsafe.Pointer(&size))); e1 != 0 {
+		return 0, 0, e1
+	}
+	logical = uint32(size)
+	if _, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), BLKPBSZGET, uintptr(unsafe.Pointer(&size))); e1 != 0 {
+		return 0, 0, e1
+	}
+	return logical, uint32(size), nil
+}
+
 func isExclusiveLock(path string, flags int) bool {
 	cmdBinary := fmt.Sprintf("/usr/bin/bash -c '/usr/bin/flock -e -n %s -c echo'", path)
 	parts := strings.Fields(cmdBinary)
@@ -44,3 +99,76 @@ func isExclusiveLock(path string, flags int) bool {
 	}
 
 }
+
+//IOV_MAX of linux
+const MAX_IOVECS = 1024
+
+//pwritev writes all the buffers with one syscall, ok is false if they could not be written by pwritev.
+//O_DIRECT requires every buffer is aligned to the sector in memory and in length
+func pwritev(f *os.File, bufs [][]byte, offset int64, directIO bool, sector block.BlockSize) (n int, ok bool, err error) {
+	if len(bufs) > MAX_IOVECS {
+		return 0, false, nil
+	}
+	iovecs := make([]syscall.Iovec, 0, len(bufs))
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+		if directIO && (!sector.IsAligned(uint64(len(buf))) ||
+			!sector.IsAligned(uint64(uintptr(unsafe.Pointer(&buf[0]))))) {
+			return 0, false, nil
+		}
+		iovec := syscall.Iovec{Base: &buf[0]}
+		iovec.SetLen(len(buf))
+		iovecs = append(iovecs, iovec)
+	}
+	if len(iovecs) == 0 {
+		return 0, true, nil
+	}
+	for {
+		r0, _, e1 := syscall.Syscall6(syscall.SYS_PWRITEV, f.Fd(), uintptr(unsafe.Pointer(&iovecs[0])),
+			uintptr(len(iovecs)), uintptr(offset), uintptr(uint64(offset)>>32), 0)
+		if e1 == syscall.EINTR {
+			continue
+		}
+		if e1 != 0 {
+			return int(r0), true, e1
+		}
+		return int(r0), true, nil
+	}
+}
+
+//the f_type of statfs of the network filesystems, see man 2 statfs
+var networkFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x01021997: "9p",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x517B:     "smb",
+	0x564C:     "ncp",
+	0x73757245: "coda",
+	0x00C36400: "ceph",
+	0x0BD00BD0: "lustre",
+	0x47504653: "gpfs",
+	//most of the FUSE filesystems are remote, such as sshfs and s3fs
+	0x65735546: "fuse",
+}
+
+//networkFilesystem returns the name of the filesystem of path if it is a network one, or ""
+func networkFilesystem(path string) (string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return "", err
+	}
+	return networkFilesystems[uint32(stat.Type)], nil
+}
+
+//allocate allocates the blocks of [offset, offset+length) of the file, the file grows if it is smaller
+func allocate(f *os.File, offset uint64, length uint64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()), 0, int64(offset), int64(length))
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
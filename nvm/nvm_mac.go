@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"unsafe"
+
+	"github.com/thesues/cannyls-go/block"
 )
 
 var _ = fmt.Printf
@@ -36,8 +39,19 @@ func openFileWithDirectIO(name string, flag int, perm os.FileMode) (file *os.Fil
 	return
 }
 
-func lockFileWithExclusiveLock(f *os.File) error {
-	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+//TODO: F_PUNCHHOLE of APFS
+func punchHole(f *os.File, offset uint64, length uint64) error {
+	return syscall.EOPNOTSUPP
+}
+
+//TODO: clonefile of APFS, it creates the file itself
+func reflink(dst *os.File, src *os.File) error {
+	return syscall.EOPNOTSUPP
+}
+
+//TODO: F_RDADVISE
+func fadviseWillNeed(f *os.File, offset uint64, length uint64) error {
+	return nil
 }
 
 // copy-paste from src/pkg/syscall/zsyscall_linux_amd64.go
@@ -50,6 +64,40 @@ func fcntl(fd int, cmd int, arg int) (val int, err error) {
 	return
 }
 
+/*
+The following constants come from
+https://github.com/apple/darwin-xnu/blob/master/bsd/sys/disk.h
+*/
+const (
+	DKIOCGETBLOCKSIZE         = 0x40046418
+	DKIOCGETBLOCKCOUNT        = 0x40086419
+	DKIOCGETPHYSICALBLOCKSIZE = 0x4004644d
+)
+
+//deviceBytes returns the size of the block device, which is the number of logical blocks
+func deviceBytes(f *os.File) (uint64, error) {
+	var blockSize uint32
+	var count uint64
+	if _, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), DKIOCGETBLOCKSIZE, uintptr(unsafe.Pointer(&blockSize))); e1 != 0 {
+		return 0, e1
+	}
+	if _, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), DKIOCGETBLOCKCOUNT, uintptr(unsafe.Pointer(&count))); e1 != 0 {
+		return 0, e1
+	}
+	return count * uint64(blockSize), nil
+}
+
+//sectorSize returns the logical and physical sector size of the block device
+func sectorSize(f *os.File) (logical uint32, physical uint32, err error) {
+	if _, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), DKIOCGETBLOCKSIZE, uintptr(unsafe.Pointer(&logical))); e1 != 0 {
+		return 0, 0, e1
+	}
+	if _, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), DKIOCGETPHYSICALBLOCKSIZE, uintptr(unsafe.Pointer(&physical))); e1 != 0 {
+		return 0, 0, e1
+	}
+	return logical, physical, nil
+}
+
 /*
 The following constant comes from
 https://github.com/apple/darwin-xnu/blob/master/bsd/sys/fcntl.h#L162
@@ -65,3 +113,43 @@ https://github.com/apple/darwin-xnu/blob/master/bsd/sys/fcntl.h#L133
 func isExclusiveLock(path string, val int) bool {
 	return (val & 0x4000) != 0
 }
+
+//pwritev is not used on darwin, the buffers are coalesced
+func pwritev(f *os.File, bufs [][]byte, offset int64, directIO bool, sector block.BlockSize) (n int, ok bool, err error) {
+	return 0, false, nil
+}
+
+//the f_fstypename of statfs of the network filesystems
+var networkFilesystems = map[string]bool{
+	"nfs":     true,
+	"smbfs":   true,
+	"afpfs":   true,
+	"webdav":  true,
+	"cifs":    true,
+	"osxfuse": true,
+	"macfuse": true,
+}
+
+//networkFilesystem returns the name of the filesystem of path if it is a network one, or ""
+func networkFilesystem(path string) (string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return "", err
+	}
+	var name []byte
+	for _, c := range stat.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	if !networkFilesystems[string(name)] {
+		return "", nil
+	}
+	return string(name), nil
+}
+
+//TODO: F_PREALLOCATE, the file is zero filled instead
+func allocate(f *os.File, offset uint64, length uint64) error {
+	return syscall.EOPNOTSUPP
+}
@@ -0,0 +1,493 @@
+package nvm
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/util"
+)
+
+const (
+	//an object is uploaded in 2 parts, S3 requires every part except the last is at least 5MB
+	DEFAULT_OBJECT_SIZE   = 16 << 20
+	DEFAULT_PART_SIZE     = 8 << 20
+	DEFAULT_CACHE_OBJECTS = 16
+)
+
+var (
+	//ObjectStore returns ErrNoSuchKey if the object is never written
+	ErrNoSuchKey = errors.New("no such key")
+)
+
+/*
+ObjectStore is the subset of S3 API used by ObjectNVM, an S3 client could implement
+it with GetObject(Range: bytes=offset-end), PutObject and the multipart upload API.
+*/
+type ObjectStore interface {
+	//GetRange fills buf with the bytes from offset of the object
+	GetRange(key string, offset uint64, buf []byte) error
+	Put(key string, data []byte) error
+	CreateMultipartUpload(key string) (uploadId string, err error)
+	//partNumber starts from 1
+	UploadPart(key string, uploadId string, partNumber int, data []byte) error
+	CompleteMultipartUpload(key string, uploadId string) error
+	AbortMultipartUpload(key string, uploadId string) error
+}
+
+type ObjectNVMOptions struct {
+	//the bytes of every object, it must be aligned to block size
+	ObjectSize uint64
+	//objects bigger than PartSize are uploaded with multipart
+	PartSize uint64
+	//the max number of objects in the local write-back cache
+	CacheObjects int
+	//BlockSize of the address space, 0 means block.Min(). OpenObjectNVM uses the block size in the storage header
+	BlockSize block.BlockSize
+}
+
+func DefaultObjectNVMOptions() ObjectNVMOptions {
+	return ObjectNVMOptions{
+		ObjectSize:   DEFAULT_OBJECT_SIZE,
+		PartSize:     DEFAULT_PART_SIZE,
+		CacheObjects: DEFAULT_CACHE_OBJECTS,
+	}
+}
+
+type cachedObject struct {
+	index uint64
+	data  []byte
+	dirty bool
+}
+
+//objectBackend is shared by the splited ObjectNVMs, the mutex guards the cache for concurrent ReadAt
+type objectBackend struct {
+	mutex   sync.Mutex
+	store   ObjectStore
+	prefix  string
+	options ObjectNVMOptions
+	cache   map[uint64]*list.Element
+	lru     *list.List
+	//the size of the whole address space, which is not changed by Split
+	capacity uint64
+}
+
+func (backend *objectBackend) key(index uint64) string {
+	return fmt.Sprintf("%s/%016x", backend.prefix, index)
+}
+
+//load returns the whole object, it is cached and the write-back cache may be flushed
+func (backend *objectBackend) load(index uint64) (*cachedObject, error) {
+	if elem, ok := backend.cache[index]; ok {
+		backend.lru.MoveToFront(elem)
+		return elem.Value.(*cachedObject), nil
+	}
+
+	data := make([]byte, backend.options.ObjectSize)
+	if err := backend.store.GetRange(backend.key(index), 0, data); err != nil && errors.Cause(err) != ErrNoSuchKey {
+		return nil, errors.Wrapf(err, "failed to get object %s", backend.key(index))
+	}
+
+	for backend.lru.Len() >= backend.options.CacheObjects {
+		oldest := backend.lru.Back()
+		if err := backend.upload(oldest.Value.(*cachedObject)); err != nil {
+			return nil, err
+		}
+		backend.lru.Remove(oldest)
+		delete(backend.cache, oldest.Value.(*cachedObject).index)
+	}
+
+	object := &cachedObject{index: index, data: data}
+	backend.cache[index] = backend.lru.PushFront(object)
+	return object, nil
+}
+
+//readRange does not fill the cache, a ranged GET is enough
+func (backend *objectBackend) readRange(index uint64, offset uint64, buf []byte) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if elem, ok := backend.cache[index]; ok {
+		backend.lru.MoveToFront(elem)
+		copy(buf, elem.Value.(*cachedObject).data[offset:])
+		return nil
+	}
+	err := backend.store.GetRange(backend.key(index), offset, buf)
+	if errors.Cause(err) == ErrNoSuchKey {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return nil
+	}
+	return errors.Wrapf(err, "failed to get object %s", backend.key(index))
+}
+
+func (backend *objectBackend) upload(object *cachedObject) (err error) {
+	if !object.dirty {
+		return nil
+	}
+	key := backend.key(object.index)
+	if uint64(len(object.data)) <= backend.options.PartSize {
+		if err = backend.store.Put(key, object.data); err != nil {
+			return errors.Wrapf(err, "failed to put object %s", key)
+		}
+		object.dirty = false
+		return nil
+	}
+
+	uploadId, err := backend.store.CreateMultipartUpload(key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create multipart upload %s", key)
+	}
+	partNumber := 1
+	for start := uint64(0); start < uint64(len(object.data)); start += backend.options.PartSize {
+		end := util.Min(start+backend.options.PartSize, uint64(len(object.data)))
+		if err = backend.store.UploadPart(key, uploadId, partNumber, object.data[start:end]); err != nil {
+			backend.store.AbortMultipartUpload(key, uploadId)
+			return errors.Wrapf(err, "failed to upload part %d of %s", partNumber, key)
+		}
+		partNumber++
+	}
+	if err = backend.store.CompleteMultipartUpload(key, uploadId); err != nil {
+		return errors.Wrapf(err, "failed to complete multipart upload %s", key)
+	}
+	object.dirty = false
+	return nil
+}
+
+func (backend *objectBackend) flush() error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	for elem := backend.lru.Back(); elem != nil; elem = elem.Prev() {
+		if err := backend.upload(elem.Value.(*cachedObject)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ObjectNVM stores the address space as fixed size objects, the object i holds
+the bytes [i*ObjectSize, (i+1)*ObjectSize).
+Writes are cached locally and uploaded when the object is evicted or Sync is called,
+so the data which is not synced is lost if the process crashes, just like page cache.
+*/
+type ObjectNVM struct {
+	backend         *objectBackend
+	cursor_position uint64
+	view_start      uint64
+	view_end        uint64
+	splited         bool //splited ObjectNVM does not flush the cache on close
+}
+
+//CreateObjectNVM uses the objects under the prefix as a new NonVolatileMemory
+func CreateObjectNVM(store ObjectStore, prefix string, capacity uint64, options ObjectNVMOptions) (*ObjectNVM, error) {
+	if options.BlockSize == 0 {
+		options.BlockSize = block.Min()
+	} else if _, err := block.NewBlockSize(options.BlockSize.AsU16()); err != nil {
+		return nil, err
+	}
+	if !options.BlockSize.IsAligned(capacity) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "not aligned capacity :%d", capacity)
+	}
+	if options.ObjectSize == 0 || !options.BlockSize.IsAligned(options.ObjectSize) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "not aligned object size :%d", options.ObjectSize)
+	}
+	if options.PartSize == 0 || options.CacheObjects <= 0 {
+		return nil, errors.Wrap(internalerror.InvalidInput, "invalid ObjectNVMOptions")
+	}
+
+	return &ObjectNVM{
+		backend: &objectBackend{
+			store:    store,
+			prefix:   prefix,
+			options:  options,
+			cache:    make(map[uint64]*list.Element),
+			lru:      list.New(),
+			capacity: capacity,
+		},
+		cursor_position: 0,
+		view_start:      0,
+		view_end:        capacity,
+		splited:         false,
+	}, nil
+}
+
+//OpenObjectNVM reads the storage header from the first object
+func OpenObjectNVM(store ObjectStore, prefix string, options ObjectNVMOptions) (*ObjectNVM, *StorageHeader, error) {
+	buf := make([]byte, block.Min().CeilAlign(uint64(FULL_HEADER_SIZE)))
+	first := (&objectBackend{prefix: prefix}).key(0)
+	if err := store.GetRange(first, 0, buf); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read storage header")
+	}
+	header, err := ReadFrom(bytes.NewReader(buf))
+	if err != nil {
+		return nil, nil, err
+	}
+	options.BlockSize = header.BlockSize
+	nvm, err := CreateObjectNVM(store, prefix, header.StorageSize(), options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nvm, header, nil
+}
+
+//Sync uploads all the dirty objects, not only the objects in this view
+func (nvm *ObjectNVM) Sync() error {
+	return nvm.backend.flush()
+}
+
+func (nvm *ObjectNVM) Position() uint64 {
+	return nvm.cursor_position - nvm.view_start
+}
+
+func (nvm *ObjectNVM) Capacity() uint64 {
+	return nvm.view_end - nvm.view_start
+}
+
+//RawSize is the size of the address space, the objects never written are not stored at all
+func (nvm *ObjectNVM) RawSize() int64 {
+	return int64(nvm.backend.capacity)
+}
+
+//BlockSize is the block size of ObjectNVMOptions
+func (nvm *ObjectNVM) BlockSize() block.BlockSize {
+	return nvm.backend.options.BlockSize
+}
+
+func (nvm *ObjectNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	if block.Min().CeilAlign(uint64(position)) != position {
+		return nil, nil, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in split", position)
+	}
+
+	leftNVM := &ObjectNVM{
+		backend:         nvm.backend,
+		view_start:      nvm.view_start,
+		cursor_position: nvm.view_start,
+		view_end:        nvm.view_start + position,
+		splited:         true,
+	}
+
+	rightNVM := &ObjectNVM{
+		backend:         nvm.backend,
+		view_start:      leftNVM.view_end,
+		view_end:        nvm.view_end,
+		cursor_position: leftNVM.view_end,
+		splited:         true,
+	}
+	return leftNVM, rightNVM, nil
+}
+
+func (nvm *ObjectNVM) Seek(offset int64, whence int) (int64, error) {
+	if !block.Min().IsAligned(uint64(offset)) {
+		return offset, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in seek", offset)
+	}
+
+	abs, err := ConvertToOffset(nvm, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	if abs > int64(nvm.Capacity()) || abs < 0 {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "seek abs is wrong %d in seek", abs)
+	}
+
+	nvm.cursor_position = nvm.view_start + uint64(abs)
+	return offset, nil
+}
+
+//eachObject calls f for every part of buf at position, which is in one object
+func (nvm *ObjectNVM) eachObject(buf []byte, position uint64, f func(index uint64, offset uint64, part []byte) error) error {
+	objectSize := nvm.backend.options.ObjectSize
+	var done uint64
+	for done < uint64(len(buf)) {
+		offset := (position + done) % objectSize
+		chunk := util.Min(objectSize-offset, uint64(len(buf))-done)
+		if err := f((position+done)/objectSize, offset, buf[done:done+chunk]); err != nil {
+			return err
+		}
+		done += chunk
+	}
+	return nil
+}
+
+func (nvm *ObjectNVM) writeObject(index uint64, offset uint64, part []byte) error {
+	nvm.backend.mutex.Lock()
+	defer nvm.backend.mutex.Unlock()
+	object, err := nvm.backend.load(index)
+	if err != nil {
+		return err
+	}
+	copy(object.data[offset:], part)
+	object.dirty = true
+	return nil
+}
+
+func (nvm *ObjectNVM) Read(buf []byte) (n int, err error) {
+	if !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d", len(buf))
+	}
+	len := util.Min(nvm.Capacity()-nvm.Position(), uint64(len(buf)))
+	if err = nvm.eachObject(buf[:len], nvm.cursor_position, nvm.backend.readRange); err != nil {
+		return -1, err
+	}
+	nvm.cursor_position += len
+	return int(len), nil
+}
+
+func (nvm *ObjectNVM) Write(buf []byte) (n int, err error) {
+	if !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d", len(buf))
+	}
+	len := util.Min(nvm.Capacity()-nvm.Position(), uint64(len(buf)))
+	if err = nvm.eachObject(buf[:len], nvm.cursor_position, nvm.writeObject); err != nil {
+		return -1, err
+	}
+	nvm.cursor_position += len
+	return int(len), nil
+}
+
+func (nvm *ObjectNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	length, err := checkReadAt(nvm, len(buf), offset)
+	if err != nil {
+		return 0, err
+	}
+	if err = nvm.eachObject(buf[:length], nvm.view_start+uint64(offset), nvm.backend.readRange); err != nil {
+		return 0, err
+	}
+	if length < uint64(len(buf)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+func (nvm *ObjectNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := checkWriteAt(nvm, len(buf), offset); err != nil {
+		return 0, err
+	}
+	if err := nvm.eachObject(buf, nvm.view_start+uint64(offset), nvm.writeObject); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (nvm *ObjectNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	return nvm.WriteAt(Coalesce(bufs, nvm.BlockSize()), offset)
+}
+
+//Close flushes the cache
+func (nvm *ObjectNVM) Close() error {
+	if !nvm.splited {
+		return nvm.backend.flush()
+	} else {
+		return nil
+	}
+}
+
+/*
+MemoryObjectStore is an ObjectStore in memory, it is used for test
+*/
+type MemoryObjectStore struct {
+	sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextId  int
+	//the number of the completed multipart uploads
+	multiparts int
+}
+
+func NewMemoryObjectStore() *MemoryObjectStore {
+	return &MemoryObjectStore{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (store *MemoryObjectStore) GetRange(key string, offset uint64, buf []byte) error {
+	store.Lock()
+	defer store.Unlock()
+	object, ok := store.objects[key]
+	if !ok {
+		return ErrNoSuchKey
+	}
+	if offset+uint64(len(buf)) > uint64(len(object)) {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid range of %s", key)
+	}
+	copy(buf, object[offset:])
+	return nil
+}
+
+func (store *MemoryObjectStore) Put(key string, data []byte) error {
+	store.Lock()
+	defer store.Unlock()
+	store.objects[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (store *MemoryObjectStore) CreateMultipartUpload(key string) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+	store.nextId++
+	uploadId := fmt.Sprintf("%s-%d", key, store.nextId)
+	store.uploads[uploadId] = make(map[int][]byte)
+	return uploadId, nil
+}
+
+func (store *MemoryObjectStore) UploadPart(key string, uploadId string, partNumber int, data []byte) error {
+	store.Lock()
+	defer store.Unlock()
+	parts, ok := store.uploads[uploadId]
+	if !ok {
+		return errors.Wrapf(internalerror.InvalidInput, "no such upload %s", uploadId)
+	}
+	parts[partNumber] = append([]byte(nil), data...)
+	return nil
+}
+
+func (store *MemoryObjectStore) CompleteMultipartUpload(key string, uploadId string) error {
+	store.Lock()
+	defer store.Unlock()
+	parts, ok := store.uploads[uploadId]
+	if !ok {
+		return errors.Wrapf(internalerror.InvalidInput, "no such upload %s", uploadId)
+	}
+	numbers := make([]int, 0, len(parts))
+	for number := range parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	var object []byte
+	for _, number := range numbers {
+		object = append(object, parts[number]...)
+	}
+	store.objects[key] = object
+	delete(store.uploads, uploadId)
+	store.multiparts++
+	return nil
+}
+
+func (store *MemoryObjectStore) AbortMultipartUpload(key string, uploadId string) error {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.uploads, uploadId)
+	return nil
+}
+
+//Len returns the number of objects
+func (store *MemoryObjectStore) Len() int {
+	store.Lock()
+	defer store.Unlock()
+	return len(store.objects)
+}
+
+//Multiparts returns the number of the objects uploaded with multipart
+func (store *MemoryObjectStore) Multiparts() int {
+	store.Lock()
+	defer store.Unlock()
+	return store.multiparts
+}
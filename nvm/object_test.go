@@ -0,0 +1,71 @@
+package nvm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectNVMReadWrite(t *testing.T) {
+	store := NewMemoryObjectStore()
+	options := ObjectNVMOptions{ObjectSize: 2048, PartSize: 1024, CacheObjects: 2}
+	nvm, err := CreateObjectNVM(store, "foo", 8192, options)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8192), nvm.RawSize())
+
+	//never written
+	readbuf := make([]byte, 1024)
+	_, err = nvm.Read(readbuf)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 1024), readbuf)
+
+	//write across object 0 and 1
+	nvm.Seek(1536, os.SEEK_SET)
+	data := arrayWithValueSize(1024, 'x')
+	n, err := nvm.Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 1024, n)
+	assert.Equal(t, 0, store.Len())
+
+	//object 0 is evicted and uploaded with multipart
+	nvm.Seek(4096, os.SEEK_SET)
+	_, err = nvm.Write(arrayWithValueSize(512, 'y'))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, 1, store.Multiparts())
+
+	nvm.Seek(1536, os.SEEK_SET)
+	_, err = nvm.Read(readbuf)
+	assert.Nil(t, err)
+	assert.Equal(t, data, readbuf)
+
+	assert.Nil(t, nvm.Close())
+	assert.Equal(t, 3, store.Len())
+
+	//not aligned
+	_, err = nvm.Write([]byte("foo"))
+	assert.Error(t, err)
+}
+
+func TestObjectNVMDefaultOptions(t *testing.T) {
+	options := DefaultObjectNVMOptions()
+	assert.True(t, options.ObjectSize > options.PartSize)
+	assert.Equal(t, uint64(0), options.ObjectSize%options.PartSize)
+
+	store := NewMemoryObjectStore()
+	nvm, err := CreateObjectNVM(store, "foo", 2*options.ObjectSize, options)
+	assert.Nil(t, err)
+	_, right, err := nvm.Split(options.ObjectSize)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*options.ObjectSize), right.RawSize())
+	_, err = right.Write(arrayWithValueSize(512, 'x'))
+	assert.Nil(t, err)
+	assert.Nil(t, nvm.Sync())
+	assert.Equal(t, 1, store.Multiparts())
+
+	readbuf := make([]byte, 512)
+	assert.Nil(t, store.GetRange("foo/0000000000000001", 0, readbuf))
+	assert.Equal(t, arrayWithValueSize(512, 'x'), readbuf)
+	assert.Nil(t, nvm.Close())
+}
@@ -0,0 +1,219 @@
+package nvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+var (
+	PARTITION_MAGIC = [4]byte{'l', 's', 'p', 't'}
+)
+
+const (
+	PARTITION_TABLE_VERSION uint16 = 1
+	//the partition table takes the first PARTITION_TABLE_SIZE bytes, or a block if it is bigger.
+	//The partitions are aligned to the size of the table
+	PARTITION_TABLE_SIZE    = 4096
+	MAX_PARTITIONS          = 64
+	MAX_PARTITION_NAME_SIZE = 40
+	PARTITION_ENTRY_SIZE    = MAX_PARTITION_NAME_SIZE + 16
+)
+
+var partitionTable = crc32.MakeTable(crc32.Castagnoli)
+
+//Partition is an entry of PartitionTable, Offset and Size are in bytes
+type Partition struct {
+	Name   string
+	Offset uint64
+	Size   uint64
+}
+
+/*
+PartitionTable divides one NonVolatileMemory, such as a file or a block device, into the
+partitions, each of them is a NonVolatileMemory which could host its own Storage, so many small
+storages share a file descriptor. The table is in the first block:
+
+	| PARTITION_MAGIC | version (2) | count (2) | name (40) | offset (8) | size (8) | ... | crc32c (4) |
+
+the integers are big endian, the crc32c of all the bytes before it is at the end of the block.
+The table is rewritten and synced as a whole, a torn table fails the checksum.
+PartitionTable is not thread safe, but the partitions could be used in parallel if the inner
+NonVolatileMemory could.
+*/
+type PartitionTable struct {
+	inner      NonVolatileMemory
+	size       uint64
+	partitions []Partition
+}
+
+func partitionTableSize(inner NonVolatileMemory) uint64 {
+	return inner.BlockSize().CeilAlign(PARTITION_TABLE_SIZE)
+}
+
+//CreatePartitionTable writes an empty table to inner, the old partitions are lost
+func CreatePartitionTable(inner NonVolatileMemory) (*PartitionTable, error) {
+	table := &PartitionTable{inner: inner, size: partitionTableSize(inner)}
+	if inner.Capacity() < table.size {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "capacity %d is smaller than the partition table", inner.Capacity())
+	}
+	if err := table.write(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+//OpenPartitionTable reads the table written by CreatePartitionTable
+func OpenPartitionTable(inner NonVolatileMemory) (*PartitionTable, error) {
+	table := &PartitionTable{inner: inner, size: partitionTableSize(inner)}
+	buf := block.NewAlignedBytes(int(table.size), inner.BlockSize())
+	buf.Align()
+	if _, err := inner.ReadAt(buf.AsBytes(), 0); err != nil {
+		return nil, errors.Wrap(err, "failed to read partition table")
+	}
+	if err := table.decode(buf.AsBytes()); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func (table *PartitionTable) decode(buf []byte) error {
+	if !bytes.Equal(buf[:4], PARTITION_MAGIC[:]) {
+		return errors.Wrap(internalerror.StorageCorrupted, "invalid magic number of partition table")
+	}
+	end := len(buf) - 4
+	if crc32.Checksum(buf[:end], partitionTable) != binary.BigEndian.Uint32(buf[end:]) {
+		return errors.Wrap(internalerror.StorageCorrupted, "checksum of partition table is mismatched")
+	}
+	if version := binary.BigEndian.Uint16(buf[4:]); version != PARTITION_TABLE_VERSION {
+		return errors.Wrapf(internalerror.StorageCorrupted, "unknown partition table version %d", version)
+	}
+	count := int(binary.BigEndian.Uint16(buf[6:]))
+	if count > MAX_PARTITIONS {
+		return errors.Wrapf(internalerror.StorageCorrupted, "too many partitions %d", count)
+	}
+	table.partitions = make([]Partition, count)
+	for i := range table.partitions {
+		entry := buf[8+i*PARTITION_ENTRY_SIZE:]
+		table.partitions[i] = Partition{
+			Name:   string(bytes.TrimRight(entry[:MAX_PARTITION_NAME_SIZE], "\x00")),
+			Offset: binary.BigEndian.Uint64(entry[MAX_PARTITION_NAME_SIZE:]),
+			Size:   binary.BigEndian.Uint64(entry[MAX_PARTITION_NAME_SIZE+8:]),
+		}
+	}
+	return nil
+}
+
+func (table *PartitionTable) write() error {
+	buf := block.NewAlignedBytes(int(table.size), table.inner.BlockSize())
+	buf.Align()
+	b := buf.AsBytes()
+	copy(b, PARTITION_MAGIC[:])
+	binary.BigEndian.PutUint16(b[4:], PARTITION_TABLE_VERSION)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(table.partitions)))
+	for i, p := range table.partitions {
+		entry := b[8+i*PARTITION_ENTRY_SIZE:]
+		copy(entry[:MAX_PARTITION_NAME_SIZE], p.Name)
+		binary.BigEndian.PutUint64(entry[MAX_PARTITION_NAME_SIZE:], p.Offset)
+		binary.BigEndian.PutUint64(entry[MAX_PARTITION_NAME_SIZE+8:], p.Size)
+	}
+	end := len(b) - 4
+	binary.BigEndian.PutUint32(b[end:], crc32.Checksum(b[:end], partitionTable))
+	if _, err := table.inner.WriteAt(b, 0); err != nil {
+		return errors.Wrap(err, "failed to write partition table")
+	}
+	return table.inner.Sync()
+}
+
+//Partitions returns the partitions ordered by offset
+func (table *PartitionTable) Partitions() []Partition {
+	return append([]Partition{}, table.partitions...)
+}
+
+func (table *PartitionTable) find(name string) (int, bool) {
+	for i, p := range table.partitions {
+		if p.Name == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+/*
+Create adds a partition of at least size bytes, the size is aligned to the table size.
+It takes the first free space which is big enough, the space of the removed partitions is reused.
+*/
+func (table *PartitionTable) Create(name string, size uint64) (NonVolatileMemory, error) {
+	if len(name) == 0 || len(name) > MAX_PARTITION_NAME_SIZE {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "invalid partition name %q", name)
+	}
+	if _, ok := table.find(name); ok {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "partition %s already exists", name)
+	}
+	if len(table.partitions) >= MAX_PARTITIONS {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "too many partitions %d", len(table.partitions))
+	}
+	if size == 0 {
+		return nil, errors.Wrap(internalerror.InvalidInput, "partition size is 0")
+	}
+	size = (size + table.size - 1) / table.size * table.size
+
+	offset := table.size
+	for _, p := range table.partitions {
+		if p.Offset-offset >= size {
+			break
+		}
+		offset = p.Offset + p.Size
+	}
+	if offset+size > table.inner.Capacity() {
+		return nil, errors.Wrapf(internalerror.StorageFull, "no space for partition %s of %d bytes", name, size)
+	}
+	table.partitions = append(table.partitions, Partition{Name: name, Offset: offset, Size: size})
+	sort.Slice(table.partitions, func(i, j int) bool { return table.partitions[i].Offset < table.partitions[j].Offset })
+	if err := table.write(); err != nil {
+		i, _ := table.find(name)
+		table.partitions = append(table.partitions[:i], table.partitions[i+1:]...)
+		return nil, err
+	}
+	return table.Open(name)
+}
+
+//Open returns the partition, it is a split of the inner NonVolatileMemory, closing it does not close the inner one
+func (table *PartitionTable) Open(name string) (NonVolatileMemory, error) {
+	i, ok := table.find(name)
+	if !ok {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "partition %s does not exist", name)
+	}
+	p := table.partitions[i]
+	_, right, err := table.inner.Split(p.Offset)
+	if err != nil {
+		return nil, err
+	}
+	partition, _, err := right.Split(p.Size)
+	return partition, err
+}
+
+//Remove deletes the partition from the table, the storage on it must be closed
+func (table *PartitionTable) Remove(name string) error {
+	i, ok := table.find(name)
+	if !ok {
+		return errors.Wrapf(internalerror.InvalidInput, "partition %s does not exist", name)
+	}
+	removed := table.partitions[i]
+	table.partitions = append(table.partitions[:i], table.partitions[i+1:]...)
+	if err := table.write(); err != nil {
+		table.partitions = append(table.partitions[:i], append([]Partition{removed}, table.partitions[i:]...)...)
+		return err
+	}
+	return nil
+}
+
+//Close closes the inner NonVolatileMemory, all the partitions must not be used any more
+func (table *PartitionTable) Close() error {
+	return table.inner.Close()
+}
@@ -0,0 +1,61 @@
+package nvm
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+func TestPartitionTable(t *testing.T) {
+	inner, _ := New(64 * 1024)
+	_, err := OpenPartitionTable(inner)
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+
+	table, err := CreatePartitionTable(inner)
+	assert.Nil(t, err)
+	a, err := table.Create("a", 5000)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8192), a.Capacity())
+	b, err := table.Create("b", 4096)
+	assert.Nil(t, err)
+	_, err = table.Create("a", 4096)
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+	_, err = table.Create("c", 64*1024)
+	assert.Equal(t, internalerror.StorageFull, errors.Cause(err))
+
+	//the partitions do not overlap
+	_, err = a.WriteAt(newBuffer(8192, 1), 0)
+	assert.Nil(t, err)
+	_, err = b.WriteAt(newBuffer(4096, 2), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, newBuffer(8192, 1), inner.vec[4096:12288])
+	assert.Equal(t, newBuffer(4096, 2), inner.vec[12288:16384])
+
+	//the space of the removed partition is reused
+	assert.Nil(t, table.Remove("a"))
+	_, err = table.Create("c", 4096)
+	assert.Nil(t, err)
+	assert.Equal(t, []Partition{
+		{Name: "c", Offset: 4096, Size: 4096},
+		{Name: "b", Offset: 12288, Size: 4096},
+	}, table.Partitions())
+
+	reopened, err := OpenPartitionTable(inner)
+	assert.Nil(t, err)
+	assert.Equal(t, table.Partitions(), reopened.Partitions())
+	b, err = reopened.Open("b")
+	assert.Nil(t, err)
+	buf := make([]byte, 4096)
+	_, err = b.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, newBuffer(4096, 2), buf)
+	_, err = reopened.Open("a")
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	//a torn table fails the checksum
+	inner.vec[8] ^= 0xff
+	_, err = OpenPartitionTable(inner)
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+}
@@ -0,0 +1,413 @@
+package nvm
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/util"
+)
+
+const (
+	DEFAULT_STRIPE_SIZE = 1 << 20
+	//the superblock is in the last block of every member file
+	STRIPED_SUPERBLOCK_SIZE = 512
+)
+
+/*
+Member superblock, written by CreateStripedIfAbsent and checked by OpenStriped, so a member
+opened with another stripe size, or in another order, is rejected
+
+| "lstr"(4 bytes) | stripe size(8 bytes) | member count(2 bytes) | member index(2 bytes) | padding |
+*/
+var (
+	STRIPED_SUPERBLOCK_MAGIC = [4]byte{'l', 's', 't', 'r'}
+)
+
+/*
+StripedNVM spreads one logical address space across several NonVolatileMemorys like RAID0.
+
+logical:  | stripe 0 | stripe 1 | stripe 2 | stripe 3 | ...
+member 0: | stripe 0 | stripe 2 | ...
+member 1: | stripe 1 | stripe 3 | ...
+
+The storage header is always in the first stripe of member 0.
+*/
+type StripedNVM struct {
+	members         []NonVolatileMemory
+	stripeSize      uint64
+	cursor_position uint64
+	view_start      uint64
+	view_end        uint64
+	block_size      block.BlockSize
+	splited         bool //splited StripedNVM is not allowd to close the members
+}
+
+//NewStripedNVM takes over the members, every member uses the same number of stripes,
+//so the extra space of the bigger members is wasted. The members must have the same block size
+func NewStripedNVM(members []NonVolatileMemory, stripeSize uint64) (*StripedNVM, error) {
+	if len(members) == 0 {
+		return nil, errors.Wrap(internalerror.InvalidInput, "no member for StripedNVM")
+	}
+	blockSize, err := membersBlockSize(members)
+	if err != nil {
+		return nil, err
+	}
+	if stripeSize == 0 || !blockSize.IsAligned(stripeSize) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "not aligned stripe size :%d", stripeSize)
+	}
+
+	memberCapacity := members[0].Capacity()
+	for _, member := range members[1:] {
+		memberCapacity = util.Min(memberCapacity, member.Capacity())
+	}
+	stripesPerMember := memberCapacity / stripeSize
+	if stripesPerMember == 0 {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "member is smaller than stripe size :%d", stripeSize)
+	}
+
+	return &StripedNVM{
+		members:         members,
+		stripeSize:      stripeSize,
+		cursor_position: 0,
+		view_start:      0,
+		view_end:        stripesPerMember * stripeSize * uint64(len(members)),
+		block_size:      blockSize,
+		splited:         false,
+	}, nil
+}
+
+//CreateStripedIfAbsent creates all the member files, each of them has memberCapacity bytes,
+//the last STRIPED_SUPERBLOCK_SIZE bytes of them are the member superblock
+func CreateStripedIfAbsent(paths []string, memberCapacity uint64, stripeSize uint64) (*StripedNVM, error) {
+	if memberCapacity <= STRIPED_SUPERBLOCK_SIZE {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "member capacity %d is too small", memberCapacity)
+	}
+	members := make([]NonVolatileMemory, 0, len(paths))
+	for i, path := range paths {
+		member, err := CreateIfAbsent(path, memberCapacity)
+		if err != nil {
+			closeMembers(members)
+			return nil, err
+		}
+		members = append(members, member)
+		if err = writeStripedSuperblock(member, stripeSize, len(paths), i); err != nil {
+			closeMembers(members)
+			return nil, err
+		}
+	}
+	striped, err := NewStripedNVM(members, stripeSize)
+	if err != nil {
+		closeMembers(members)
+		return nil, err
+	}
+	return striped, nil
+}
+
+//OpenStriped opens the member files in the same order as they are created
+func OpenStriped(paths []string, stripeSize uint64) (nvm *StripedNVM, header *StorageHeader, err error) {
+	if len(paths) == 0 {
+		return nil, nil, errors.Wrap(internalerror.InvalidInput, "no member for StripedNVM")
+	}
+	if stripeSize == 0 || !block.Min().IsAligned(stripeSize) {
+		return nil, nil, errors.Wrapf(internalerror.InvalidInput, "not aligned stripe size :%d", stripeSize)
+	}
+
+	var parsedFile *os.File
+	if parsedFile, err = os.OpenFile(paths[0], os.O_RDWR, 0755); err != nil {
+		return nil, nil, err
+	}
+	header, err = ReadFromFile(parsedFile)
+	parsedFile.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//the number of stripes which every member must have
+	stripes := (header.StorageSize() + stripeSize - 1) / stripeSize
+	stripesPerMember := (stripes + uint64(len(paths)) - 1) / uint64(len(paths))
+
+	members := make([]NonVolatileMemory, 0, len(paths))
+	for i, path := range paths {
+		var f *os.File
+		var directIO bool
+		if f, directIO, err = openFile(path, os.O_RDWR, DIRECT_IO_AUTO); err != nil {
+			closeMembers(members)
+			return nil, nil, err
+		}
+		if err = lockFileWithExclusiveLock(f); err != nil {
+			f.Close()
+			closeMembers(members)
+			return nil, nil, err
+		}
+		member := &FileNVM{
+			file:            f,
+			cursor_position: 0,
+			view_start:      0,
+			view_end:        0,
+			splited:         false,
+			bufferedIO:      !directIO,
+			lockMode:        LOCK_EXCLUSIVE,
+			block_size:      header.BlockSize,
+		}
+		members = append(members, member)
+		if err = checkStripedSuperblock(member, stripeSize, len(paths), i); err != nil {
+			closeMembers(members)
+			return nil, nil, errors.Wrapf(err, "bad member %s", path)
+		}
+		if member.view_end < stripesPerMember*stripeSize {
+			closeMembers(members)
+			return nil, nil, errors.Wrapf(internalerror.InvalidInput, "member %s is too small", path)
+		}
+		member.view_end = stripesPerMember * stripeSize
+	}
+
+	if nvm, err = NewStripedNVM(members, stripeSize); err != nil {
+		closeMembers(members)
+		return nil, nil, err
+	}
+	return nvm, header, nil
+}
+
+//writeStripedSuperblock writes the superblock at the end of member, and hides it from the stripes
+func writeStripedSuperblock(member *FileNVM, stripeSize uint64, count int, index int) error {
+	ab := block.NewAlignedBytes(STRIPED_SUPERBLOCK_SIZE, block.Min())
+	ab.Align()
+	buf := ab.AsBytes()
+	copy(buf[:4], STRIPED_SUPERBLOCK_MAGIC[:])
+	binary.BigEndian.PutUint64(buf[4:12], stripeSize)
+	binary.BigEndian.PutUint16(buf[12:14], uint16(count))
+	binary.BigEndian.PutUint16(buf[14:16], uint16(index))
+	offset := member.Capacity() - STRIPED_SUPERBLOCK_SIZE
+	if _, err := member.WriteAt(buf, int64(offset)); err != nil {
+		return errors.Wrap(err, "failed to write the striped superblock")
+	}
+	member.view_end = member.view_start + offset
+	return nil
+}
+
+//checkStripedSuperblock reads the superblock at the end of the member file, and sets the capacity
+//of member to the space before it
+func checkStripedSuperblock(member *FileNVM, stripeSize uint64, count int, index int) error {
+	size := member.RawSize()
+	if size < 2*STRIPED_SUPERBLOCK_SIZE {
+		return errors.Wrapf(internalerror.InvalidInput, "member of %d bytes has no striped superblock", size)
+	}
+	offset := block.Min().FloorAlign(uint64(size)) - STRIPED_SUPERBLOCK_SIZE
+	member.view_end = offset + STRIPED_SUPERBLOCK_SIZE
+	ab := block.NewAlignedBytes(STRIPED_SUPERBLOCK_SIZE, block.Min())
+	ab.Align()
+	buf := ab.AsBytes()
+	if _, err := member.ReadAt(buf, int64(offset)); err != nil {
+		return errors.Wrap(err, "failed to read the striped superblock")
+	}
+	member.view_end = offset
+
+	var magic [4]byte
+	copy(magic[:], buf[:4])
+	if magic != STRIPED_SUPERBLOCK_MAGIC {
+		return errors.Wrap(internalerror.InvalidInput, "no striped superblock")
+	}
+	if saved := binary.BigEndian.Uint64(buf[4:12]); saved != stripeSize {
+		return errors.Wrapf(internalerror.InvalidInput, "stripe size %d does not match %d in the superblock", stripeSize, saved)
+	}
+	savedCount, savedIndex := binary.BigEndian.Uint16(buf[12:14]), binary.BigEndian.Uint16(buf[14:16])
+	if int(savedCount) != count || int(savedIndex) != index {
+		return errors.Wrapf(internalerror.InvalidInput, "member %d of %d is opened as %d of %d", savedIndex, savedCount, index, count)
+	}
+	return nil
+}
+
+//membersBlockSize returns the block size of the members, it fails if they do not have the same one
+func membersBlockSize(members []NonVolatileMemory) (block.BlockSize, error) {
+	blockSize := members[0].BlockSize()
+	for _, member := range members[1:] {
+		if member.BlockSize() != blockSize {
+			return 0, errors.Wrapf(internalerror.InvalidInput,
+				"block size %d of a member does not match %d", member.BlockSize(), blockSize)
+		}
+	}
+	return blockSize, nil
+}
+
+func closeMembers(members []NonVolatileMemory) {
+	for _, member := range members {
+		member.Close()
+	}
+}
+
+//locate returns the member and the offset in the member of the logical position,
+//and how many bytes are left in this stripe
+func (nvm *StripedNVM) locate(position uint64) (int, uint64, uint64) {
+	stripe := position / nvm.stripeSize
+	inStripe := position % nvm.stripeSize
+	member := int(stripe % uint64(len(nvm.members)))
+	memberOffset := (stripe/uint64(len(nvm.members)))*nvm.stripeSize + inStripe
+	return member, memberOffset, nvm.stripeSize - inStripe
+}
+
+func (nvm *StripedNVM) Sync() error {
+	for _, member := range nvm.members {
+		if err := member.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nvm *StripedNVM) Position() uint64 {
+	return nvm.cursor_position - nvm.view_start
+}
+
+func (nvm *StripedNVM) Capacity() uint64 {
+	return nvm.view_end - nvm.view_start
+}
+
+func (nvm *StripedNVM) RawSize() int64 {
+	var size int64
+	for _, member := range nvm.members {
+		size += member.RawSize()
+	}
+	return size
+}
+
+//BlockSize is the block size of the members
+func (nvm *StripedNVM) BlockSize() block.BlockSize {
+	return nvm.block_size
+}
+
+func (nvm *StripedNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	if block.Min().CeilAlign(uint64(position)) != position {
+		return nil, nil, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in split", position)
+	}
+
+	leftNVM := &StripedNVM{
+		members:         nvm.members,
+		stripeSize:      nvm.stripeSize,
+		view_start:      nvm.view_start,
+		cursor_position: nvm.view_start,
+		view_end:        nvm.view_start + position,
+		block_size:      nvm.block_size,
+		splited:         true,
+	}
+
+	rightNVM := &StripedNVM{
+		members:         nvm.members,
+		stripeSize:      nvm.stripeSize,
+		view_start:      leftNVM.view_end,
+		view_end:        nvm.view_end,
+		cursor_position: leftNVM.view_end,
+		block_size:      nvm.block_size,
+		splited:         true,
+	}
+	return leftNVM, rightNVM, nil
+}
+
+func (nvm *StripedNVM) Seek(offset int64, whence int) (int64, error) {
+	if !block.Min().IsAligned(uint64(offset)) {
+		return offset, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in seek", offset)
+	}
+
+	abs, err := ConvertToOffset(nvm, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	if abs > int64(nvm.Capacity()) || abs < 0 {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "seek abs is wrong %d in seek", abs)
+	}
+
+	nvm.cursor_position = nvm.view_start + uint64(abs)
+	return offset, nil
+}
+
+//eachStripe calls f for every part of buf at position, which is in one stripe
+func (nvm *StripedNVM) eachStripe(buf []byte, position uint64, f func(member NonVolatileMemory, part []byte, memberOffset uint64) error) error {
+	var done uint64
+	for done < uint64(len(buf)) {
+		member, memberOffset, left := nvm.locate(position + done)
+		chunk := util.Min(left, uint64(len(buf))-done)
+		if err := f(nvm.members[member], buf[done:done+chunk], memberOffset); err != nil {
+			return err
+		}
+		done += chunk
+	}
+	return nil
+}
+
+func (nvm *StripedNVM) Read(buf []byte) (n int, err error) {
+	if !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d", len(buf))
+	}
+	len := util.Min(nvm.Capacity()-nvm.Position(), uint64(len(buf)))
+	if n, err = nvm.ReadAt(buf[:len], int64(nvm.Position())); err != nil {
+		return -1, err
+	}
+	nvm.cursor_position += len
+	return n, nil
+}
+
+func (nvm *StripedNVM) Write(buf []byte) (n int, err error) {
+	if !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d", len(buf))
+	}
+	len := util.Min(nvm.Capacity()-nvm.Position(), uint64(len(buf)))
+	if n, err = nvm.WriteAt(buf[:len], int64(nvm.Position())); err != nil {
+		return -1, err
+	}
+	nvm.cursor_position += len
+	return n, nil
+}
+
+func (nvm *StripedNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	length, err := checkReadAt(nvm, len(buf), offset)
+	if err != nil {
+		return 0, err
+	}
+	err = nvm.eachStripe(buf[:length], nvm.view_start+uint64(offset), func(member NonVolatileMemory, part []byte, memberOffset uint64) error {
+		_, err := member.ReadAt(part, int64(memberOffset))
+		return errors.Wrap(err, "StripedNVM failed to read")
+	})
+	if err != nil {
+		return 0, err
+	}
+	if length < uint64(len(buf)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+func (nvm *StripedNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := checkWriteAt(nvm, len(buf), offset); err != nil {
+		return 0, err
+	}
+	err := nvm.eachStripe(buf, nvm.view_start+uint64(offset), func(member NonVolatileMemory, part []byte, memberOffset uint64) error {
+		_, err := member.WriteAt(part, int64(memberOffset))
+		return errors.Wrap(err, "StripedNVM failed to write")
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+//Writev coalesces the buffers, because they are split by the stripes
+func (nvm *StripedNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	return nvm.WriteAt(Coalesce(bufs, nvm.BlockSize()), offset)
+}
+
+func (nvm *StripedNVM) Close() error {
+	if nvm.splited {
+		return nil
+	}
+	var err error
+	for _, member := range nvm.members {
+		if e := member.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
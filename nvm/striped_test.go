@@ -0,0 +1,85 @@
+package nvm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripedNVMReadWrite(t *testing.T) {
+	m0, _ := New(4096)
+	m1, _ := New(4096)
+	//the bigger member only uses 4096 bytes
+	m2, _ := New(8192)
+
+	_, err := NewStripedNVM([]NonVolatileMemory{m0, m1}, 100)
+	assert.Error(t, err)
+
+	nvm, err := NewStripedNVM([]NonVolatileMemory{m0, m1, m2}, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3*4096), nvm.Capacity())
+
+	//write across stripe 0, 1, 2 and 3
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+	nvm.Seek(512, os.SEEK_SET)
+	n, err := nvm.Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 4096, n)
+	assert.Equal(t, uint64(4608), nvm.Position())
+
+	assert.Equal(t, byte(0), m0.AsBytes()[512])
+	assert.Equal(t, byte(1), m1.AsBytes()[0])
+	assert.Equal(t, byte(2), m1.AsBytes()[512])
+	assert.Equal(t, byte(4), m2.AsBytes()[512])
+	assert.Equal(t, byte(5), m0.AsBytes()[1024])
+
+	_, right, err := nvm.Split(512)
+	assert.Nil(t, err)
+	readbuf := make([]byte, 4096)
+	n, err = right.Read(readbuf)
+	assert.Nil(t, err)
+	assert.Equal(t, 4096, n)
+	assert.Equal(t, data, readbuf)
+
+	//not aligned
+	_, err = right.Write([]byte("foo"))
+	assert.Error(t, err)
+}
+
+func TestStripedNVMSuperblock(t *testing.T) {
+	paths := []string{"striped-0.lusf", "striped-1.lusf"}
+	nvm, err := CreateStripedIfAbsent(paths, 64*1024, 4096)
+	assert.Nil(t, err)
+	for _, path := range paths {
+		defer os.Remove(path)
+	}
+	//the last block of every member is the superblock
+	assert.Equal(t, uint64(2*15*4096), nvm.Capacity())
+
+	header := DefaultStorageHeader()
+	header.JournalRegionSize = 4096
+	header.DataRegionSize = 64 * 1024
+	buf := new(bytes.Buffer)
+	assert.Nil(t, header.WriteHeaderRegionTo(buf))
+	_, err = nvm.WriteAt(buf.Bytes(), 0)
+	assert.Nil(t, err)
+	nvm.Close()
+
+	//another stripe size
+	_, _, err = OpenStriped(paths, 8192)
+	assert.Error(t, err)
+	//another order
+	_, _, err = OpenStriped([]string{paths[1], paths[0]}, 4096)
+	assert.Error(t, err)
+	_, _, err = OpenStriped(paths[:1], 4096)
+	assert.Error(t, err)
+
+	nvm, _, err = OpenStriped(paths, 4096)
+	assert.Nil(t, err)
+	nvm.Close()
+}
@@ -0,0 +1,498 @@
+// +build linux
+
+package nvm
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/util"
+)
+
+/*
+A minimal io_uring binding, only READ, WRITE and FSYNC are used.
+The layouts of the structs come from include/uapi/linux/io_uring.h
+*/
+
+const (
+	sys_IO_URING_SETUP = 425
+	sys_IO_URING_ENTER = 426
+
+	iORING_OFF_SQ_RING = 0
+	iORING_OFF_CQ_RING = 0x8000000
+	iORING_OFF_SQES    = 0x10000000
+
+	iORING_ENTER_GETEVENTS = 1
+
+	iORING_OP_FSYNC = 3
+	iORING_OP_READ  = 22
+	iORING_OP_WRITE = 23
+
+	DEFAULT_URING_ENTRIES = 256
+)
+
+type sqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type cqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        sqringOffsets
+	cqOff        cqringOffsets
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type uring struct {
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqesMem []byte
+
+	sqHead    *uint32
+	sqTail    *uint32
+	sqMask    uint32
+	sqEntries uint32
+	sqArray   []uint32
+	sqes      []uringSQE
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []uringCQE
+
+	//the split UringNVMs share the same ring
+	mutex sync.Mutex
+}
+
+type uringRequest struct {
+	opcode uint8
+	offset uint64
+	buf    []byte
+	result int32
+}
+
+func newUring(entries uint32) (*uring, error) {
+	var params uringParams
+	fd, _, errno := syscall.Syscall(sys_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "io_uring_setup failed")
+	}
+	ring := &uring{fd: int(fd)}
+
+	var err error
+	sqRingSize := int(params.sqOff.array + params.sqEntries*4)
+	if ring.sqRing, err = syscall.Mmap(ring.fd, iORING_OFF_SQ_RING, sqRingSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		ring.close()
+		return nil, errors.Wrap(err, "mmap sq ring failed")
+	}
+	cqRingSize := int(params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	if ring.cqRing, err = syscall.Mmap(ring.fd, iORING_OFF_CQ_RING, cqRingSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		ring.close()
+		return nil, errors.Wrap(err, "mmap cq ring failed")
+	}
+	sqesSize := int(params.sqEntries * uint32(unsafe.Sizeof(uringSQE{})))
+	if ring.sqesMem, err = syscall.Mmap(ring.fd, iORING_OFF_SQES, sqesSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		ring.close()
+		return nil, errors.Wrap(err, "mmap sqes failed")
+	}
+
+	sq := unsafe.Pointer(&ring.sqRing[0])
+	ring.sqHead = (*uint32)(unsafe.Pointer(uintptr(sq) + uintptr(params.sqOff.head)))
+	ring.sqTail = (*uint32)(unsafe.Pointer(uintptr(sq) + uintptr(params.sqOff.tail)))
+	ring.sqMask = *(*uint32)(unsafe.Pointer(uintptr(sq) + uintptr(params.sqOff.ringMask)))
+	ring.sqEntries = params.sqEntries
+	ring.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(uintptr(sq) + uintptr(params.sqOff.array)))[:params.sqEntries:params.sqEntries]
+	ring.sqes = (*[1 << 20]uringSQE)(unsafe.Pointer(&ring.sqesMem[0]))[:params.sqEntries:params.sqEntries]
+
+	cq := unsafe.Pointer(&ring.cqRing[0])
+	ring.cqHead = (*uint32)(unsafe.Pointer(uintptr(cq) + uintptr(params.cqOff.head)))
+	ring.cqTail = (*uint32)(unsafe.Pointer(uintptr(cq) + uintptr(params.cqOff.tail)))
+	ring.cqMask = *(*uint32)(unsafe.Pointer(uintptr(cq) + uintptr(params.cqOff.ringMask)))
+	ring.cqes = (*[1 << 20]uringCQE)(unsafe.Pointer(uintptr(cq) + uintptr(params.cqOff.cqes)))[:params.cqEntries:params.cqEntries]
+
+	return ring, nil
+}
+
+func (ring *uring) close() error {
+	if ring.sqesMem != nil {
+		syscall.Munmap(ring.sqesMem)
+	}
+	if ring.cqRing != nil {
+		syscall.Munmap(ring.cqRing)
+	}
+	if ring.sqRing != nil {
+		syscall.Munmap(ring.sqRing)
+	}
+	return syscall.Close(ring.fd)
+}
+
+func (ring *uring) enter(toSubmit uint32, minComplete uint32) error {
+	for {
+		_, _, errno := syscall.Syscall6(sys_IO_URING_ENTER, uintptr(ring.fd), uintptr(toSubmit),
+			uintptr(minComplete), iORING_ENTER_GETEVENTS, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errors.Wrap(errno, "io_uring_enter failed")
+		}
+		return nil
+	}
+}
+
+//submitAndWait submits all the requests and waits for their completion,
+//the results are saved in requests[i].result
+func (ring *uring) submitAndWait(fd int, requests []uringRequest) error {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	for len(requests) > 0 {
+		batch := requests
+		if uint32(len(batch)) > ring.sqEntries {
+			batch = batch[:ring.sqEntries]
+		}
+
+		tail := atomic.LoadUint32(ring.sqTail)
+		for i := range batch {
+			index := tail & ring.sqMask
+			sqe := &ring.sqes[index]
+			*sqe = uringSQE{
+				opcode:   batch[i].opcode,
+				fd:       int32(fd),
+				off:      batch[i].offset,
+				userData: uint64(i),
+			}
+			if len(batch[i].buf) > 0 {
+				sqe.addr = uint64(uintptr(unsafe.Pointer(&batch[i].buf[0])))
+				sqe.len = uint32(len(batch[i].buf))
+			}
+			ring.sqArray[index] = index
+			tail++
+		}
+		atomic.StoreUint32(ring.sqTail, tail)
+
+		if err := ring.enter(uint32(len(batch)), uint32(len(batch))); err != nil {
+			return err
+		}
+
+		completed := 0
+		for completed < len(batch) {
+			head := atomic.LoadUint32(ring.cqHead)
+			cqTail := atomic.LoadUint32(ring.cqTail)
+			if head == cqTail {
+				if err := ring.enter(0, 1); err != nil {
+					return err
+				}
+				continue
+			}
+			for ; head != cqTail; head++ {
+				cqe := ring.cqes[head&ring.cqMask]
+				batch[cqe.userData].result = cqe.res
+				completed++
+			}
+			atomic.StoreUint32(ring.cqHead, head)
+		}
+		//the kernel has finished with the buffers
+		runtime.KeepAlive(batch)
+		requests = requests[len(batch):]
+	}
+	return nil
+}
+
+/*
+UringNVM is the same as FileNVM, but reads and writes are submitted through io_uring.
+ReadBatch submits many reads with one syscall.
+*/
+type UringNVM struct {
+	file            *os.File
+	ring            *uring
+	cursor_position uint64
+	view_start      uint64
+	view_end        uint64
+	block_size      block.BlockSize
+	splited         bool //splited file is not allowd to close the file and the ring
+}
+
+//OpenUring opens an existing storage file like Open
+func OpenUring(path string, entries uint32) (nvm *UringNVM, header *StorageHeader, err error) {
+	fileNVM, header, err := Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nvm, err = NewUringNVM(fileNVM, entries); err != nil {
+		fileNVM.Close()
+		return nil, nil, err
+	}
+	return nvm, header, nil
+}
+
+//NewUringNVM takes over the file of FileNVM, the FileNVM should not be used any more
+func NewUringNVM(fileNVM *FileNVM, entries uint32) (*UringNVM, error) {
+	ring, err := newUring(entries)
+	if err != nil {
+		return nil, err
+	}
+	return &UringNVM{
+		file:            fileNVM.file,
+		ring:            ring,
+		cursor_position: fileNVM.cursor_position,
+		view_start:      fileNVM.view_start,
+		view_end:        fileNVM.view_end,
+		block_size:      fileNVM.block_size,
+		splited:         fileNVM.splited,
+	}, nil
+}
+
+func (nvm *UringNVM) Sync() error {
+	requests := []uringRequest{{opcode: iORING_OP_FSYNC}}
+	if err := nvm.ring.submitAndWait(int(nvm.file.Fd()), requests); err != nil {
+		return err
+	}
+	if requests[0].result < 0 {
+		return errors.Wrap(syscall.Errno(-requests[0].result), "UringNVM failed to sync")
+	}
+	return nil
+}
+
+func (nvm *UringNVM) Position() uint64 {
+	return nvm.cursor_position - nvm.view_start
+}
+
+func (nvm *UringNVM) Capacity() uint64 {
+	return nvm.view_end - nvm.view_start
+}
+
+func (nvm *UringNVM) RawSize() int64 {
+	return fileRawSize(nvm.file)
+}
+
+//BlockSize is the block size of the FileNVM, see FileNVM.BlockSize
+func (nvm *UringNVM) BlockSize() block.BlockSize {
+	return nvm.block_size
+}
+
+func (nvm *UringNVM) Split(position uint64) (NonVolatileMemory, NonVolatileMemory, error) {
+	if block.Min().CeilAlign(uint64(position)) != position {
+		return nil, nil, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in split", position)
+	}
+
+	leftNVM := &UringNVM{
+		file:            nvm.file,
+		ring:            nvm.ring,
+		view_start:      nvm.view_start,
+		cursor_position: nvm.view_start,
+		view_end:        nvm.view_start + position,
+		block_size:      nvm.block_size,
+		splited:         true,
+	}
+
+	rightNVM := &UringNVM{
+		file:            nvm.file,
+		ring:            nvm.ring,
+		view_start:      leftNVM.view_end,
+		view_end:        nvm.view_end,
+		cursor_position: leftNVM.view_end,
+		block_size:      nvm.block_size,
+		splited:         true,
+	}
+	return leftNVM, rightNVM, nil
+}
+
+func (nvm *UringNVM) Seek(offset int64, whence int) (int64, error) {
+	if !block.Min().IsAligned(uint64(offset)) {
+		return offset, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d in seek", offset)
+	}
+
+	abs, err := ConvertToOffset(nvm, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	if abs > int64(nvm.Capacity()) || abs < 0 {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "seek abs is wrong %d in seek", abs)
+	}
+
+	nvm.cursor_position = nvm.view_start + uint64(abs)
+	return offset, nil
+}
+
+func (nvm *UringNVM) Read(buf []byte) (n int, err error) {
+	requests := []UringReadRequest{{Offset: nvm.Position(), Buf: buf}}
+	if err = nvm.ReadBatch(requests); err != nil {
+		return -1, err
+	}
+	n = len(requests[0].Buf)
+	nvm.cursor_position += uint64(n)
+	return n, nil
+}
+
+//UringReadRequest reads len(Buf) bytes at Offset, Offset is relative to the start of the UringNVM.
+//After ReadBatch, Buf is truncated to the length which is read
+type UringReadRequest struct {
+	Offset uint64
+	Buf    []byte
+}
+
+//ReadBatch submits all the reads together, it does not change the cursor position
+func (nvm *UringNVM) ReadBatch(reads []UringReadRequest) error {
+	requests := make([]uringRequest, len(reads))
+	for i, read := range reads {
+		bufLen := uint64(len(read.Buf))
+		if !block.Min().IsAligned(bufLen) || !block.Min().IsAligned(read.Offset) {
+			return errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, %d in read", read.Offset, bufLen)
+		}
+		if read.Offset > nvm.Capacity() {
+			return errors.Wrapf(internalerror.InvalidInput, "read offset is wrong %d", read.Offset)
+		}
+		len := util.Min(nvm.Capacity()-read.Offset, bufLen)
+		requests[i] = uringRequest{
+			opcode: iORING_OP_READ,
+			offset: nvm.view_start + read.Offset,
+			buf:    read.Buf[:len],
+		}
+	}
+
+	if err := nvm.ring.submitAndWait(int(nvm.file.Fd()), requests); err != nil {
+		return err
+	}
+
+	for i := range requests {
+		if requests[i].result < 0 {
+			return errors.Wrap(syscall.Errno(-requests[i].result), "UringNVM failed to read")
+		}
+		//the file is not expanded yet, like FileNVM, the rest is zero
+		buf := requests[i].buf
+		for j := int(requests[i].result); j < len(buf); j++ {
+			buf[j] = 0
+		}
+		reads[i].Buf = buf
+	}
+	return nil
+}
+
+func (nvm *UringNVM) Write(buf []byte) (n int, err error) {
+	if !block.Min().IsAligned(uint64(len(buf))) {
+		return -1, errors.Wrapf(internalerror.InvalidInput, "not aligned :%d, in write", len(buf))
+	}
+	maxLen := nvm.Capacity() - nvm.Position()
+	len := util.Min(maxLen, uint64(len(buf)))
+	if n, err = nvm.WriteAt(buf[:len], int64(nvm.Position())); err != nil {
+		return -1, err
+	}
+	nvm.cursor_position += len
+	return n, nil
+}
+
+//ReadAt is a ReadBatch of one read
+func (nvm *UringNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	length, err := checkReadAt(nvm, len(buf), offset)
+	if err != nil {
+		return 0, err
+	}
+	if err = nvm.ReadBatch([]UringReadRequest{{Offset: uint64(offset), Buf: buf[:length]}}); err != nil {
+		return 0, err
+	}
+	if length < uint64(len(buf)) {
+		return int(length), io.EOF
+	}
+	return int(length), nil
+}
+
+func (nvm *UringNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := checkWriteAt(nvm, len(buf), offset); err != nil {
+		return 0, err
+	}
+	requests := []uringRequest{{
+		opcode: iORING_OP_WRITE,
+		offset: nvm.view_start + uint64(offset),
+		buf:    buf,
+	}}
+	if err := nvm.ring.submitAndWait(int(nvm.file.Fd()), requests); err != nil {
+		return 0, err
+	}
+	if requests[0].result < 0 {
+		return 0, errors.Wrap(syscall.Errno(-requests[0].result), "UringNVM failed to write")
+	}
+	if int(requests[0].result) != len(buf) {
+		return int(requests[0].result), errors.Wrap(io.ErrShortWrite, "UringNVM failed to write")
+	}
+	return len(buf), nil
+}
+
+//Writev coalesces the buffers into one write request
+func (nvm *UringNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	return nvm.WriteAt(Coalesce(bufs, nvm.BlockSize()), offset)
+}
+
+func (nvm *UringNVM) Close() error {
+	if !nvm.splited {
+		//the file is closed even if the ring is not, the first error is returned
+		err := nvm.ring.close()
+		if closeErr := nvm.file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	} else {
+		return nil
+	}
+}
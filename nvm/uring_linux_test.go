@@ -0,0 +1,78 @@
+// +build linux
+
+package nvm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+)
+
+func TestUringNVMReadWrite(t *testing.T) {
+	file, err := CreateIfAbsent("uring-test.lusf", 10*1024)
+	assert.Nil(t, err)
+	defer os.Remove("uring-test.lusf")
+
+	nvm, err := NewUringNVM(file, 8)
+	if err != nil {
+		//io_uring is not supported or disabled
+		file.Close()
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	defer nvm.Close()
+
+	n, err := nvm.Write(align([]byte("foo")))
+	assert.Nil(t, err)
+	assert.Equal(t, 512, n)
+	assert.Equal(t, uint64(512), nvm.Position())
+	assert.Nil(t, nvm.Sync())
+
+	_, right, err := nvm.Split(1024)
+	assert.Nil(t, err)
+	right.Seek(512, os.SEEK_SET)
+	_, err = right.Write(align([]byte("bar")))
+	assert.Nil(t, err)
+
+	nvm.Seek(0, os.SEEK_SET)
+	buf := alignedWithSize(512)
+	_, err = nvm.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), buf[:3])
+
+	//more reads than the entries of the ring
+	reads := make([]UringReadRequest, 20)
+	for i := range reads {
+		reads[i] = UringReadRequest{Offset: 1536, Buf: alignedWithSize(512)}
+	}
+	reads[0].Offset = 0
+	assert.Nil(t, nvm.ReadBatch(reads))
+	assert.Equal(t, []byte("foo"), reads[0].Buf[:3])
+	for _, read := range reads[1:] {
+		assert.Equal(t, []byte("bar"), read.Buf[:3])
+	}
+
+	//not aligned
+	err = nvm.ReadBatch([]UringReadRequest{{Offset: 1, Buf: alignedWithSize(512)}})
+	assert.Error(t, err)
+}
+
+func TestUringNVMBlockSize(t *testing.T) {
+	bs, _ := block.NewBlockSize(4096)
+	file, err := CreateIfAbsentWithOptions("uring-4k.lusf", 16*1024, FileOptions{BlockSize: bs})
+	assert.Nil(t, err)
+	defer os.Remove("uring-4k.lusf")
+
+	nvm, err := NewUringNVM(file, 8)
+	if err != nil {
+		file.Close()
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	defer nvm.Close()
+	assert.Equal(t, bs, nvm.BlockSize())
+	left, right, err := nvm.Split(8192)
+	assert.Nil(t, err)
+	assert.Equal(t, bs, left.BlockSize())
+	assert.Equal(t, bs, right.BlockSize())
+}
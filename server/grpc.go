@@ -0,0 +1,147 @@
+package server
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. lump.proto
+
+import (
+	"bytes"
+	"context"
+	"math"
+
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//GRPCServer implements LumpServiceServer on an AsyncStorage, as Server does for HTTP
+type GRPCServer struct {
+	async *storage.AsyncStorage
+}
+
+//NewGRPCServer returns the service of async, async is not closed by the server
+func NewGRPCServer(async *storage.AsyncStorage) *GRPCServer {
+	return &GRPCServer{async: async}
+}
+
+/*
+RegisterGRPC registers the LumpService of async to s. The lumps larger than the 4MB default
+of grpc.MaxRecvMsgSize and grpc.MaxSendMsgSize need larger limits on both sides.
+*/
+func RegisterGRPC(s *grpc.Server, async *storage.AsyncStorage) {
+	RegisterLumpServiceServer(s, NewGRPCServer(async))
+}
+
+func (server *GRPCServer) Put(ctx context.Context, request *PutRequest) (*PutResponse, error) {
+	id, err := lump.FromString(request.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if uint64(len(request.Data)) > lump.LARGE_LUMP_MAX_SIZE {
+		return nil, status.Errorf(codes.InvalidArgument, "lump data is larger than %d bytes", lump.LARGE_LUMP_MAX_SIZE)
+	}
+	//the data is read by the worker as the body of a put of Server, instead of copied into aligned bytes
+	result := server.async.Do(ctx, true, func(store *storage.Storage) storage.AsyncResult {
+		updated, err := store.PutReader(id, bytes.NewReader(request.Data), uint64(len(request.Data)))
+		return storage.AsyncResult{Updated: updated, Err: err}
+	})
+	if result.Err != nil {
+		return nil, grpcError(result.Err, codes.InvalidArgument)
+	}
+	return &PutResponse{Updated: result.Updated}, nil
+}
+
+func (server *GRPCServer) Get(ctx context.Context, request *GetRequest) (*GetResponse, error) {
+	id, err := lump.FromString(request.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	data, err := server.async.GetContext(ctx, id)
+	if err != nil {
+		//the lumpid is valid, so InvalidInput means it is not found or expired
+		return nil, grpcError(err, codes.NotFound)
+	}
+	return &GetResponse{Data: data}, nil
+}
+
+func (server *GRPCServer) Delete(ctx context.Context, request *DeleteRequest) (*DeleteResponse, error) {
+	id, err := lump.FromString(request.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	deleted, err := server.async.DeleteContext(ctx, id)
+	if err != nil {
+		return nil, grpcError(err, codes.InvalidArgument)
+	}
+	if !deleted {
+		return nil, status.Errorf(codes.NotFound, "lump %s is not found", id.String())
+	}
+	return &DeleteResponse{}, nil
+}
+
+func (server *GRPCServer) List(ctx context.Context, request *ListRequest) (*ListResponse, error) {
+	start, end := lump.FromU64(0, 0), lump.FromU64(0, math.MaxUint64)
+	limit := LIST_DEFAULT_LIMIT
+	var err error
+	if request.Start != "" {
+		if start, err = lump.FromString(request.Start); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if request.End != "" {
+		if end, err = lump.FromString(request.End); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if request.Limit != 0 {
+		limit = int(request.Limit)
+	}
+	ids, err := server.async.ListRangeContext(ctx, start, end, limit)
+	if err != nil {
+		return nil, grpcError(err, codes.InvalidArgument)
+	}
+	response := &ListResponse{Ids: make([]string, len(ids))}
+	for i, id := range ids {
+		response.Ids[i] = id.String()
+	}
+	return response, nil
+}
+
+func (server *GRPCServer) Stat(ctx context.Context, request *StatRequest) (*StatResponse, error) {
+	id, err := lump.FromString(request.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	stat, err := server.async.StatContext(ctx, id)
+	if err != nil {
+		return nil, grpcError(err, codes.NotFound)
+	}
+	return &StatResponse{
+		Size:       stat.Size,
+		SizeOnDisk: stat.SizeOnDisk,
+		Embedded:   stat.Embedded,
+		Offset:     stat.Offset,
+	}, nil
+}
+
+//grpcError maps the errors of the storage to the codes as writeError, InvalidInput is invalidInput
+func grpcError(err error, invalidInput codes.Code) error {
+	code := codes.Internal
+	switch {
+	case err == context.Canceled:
+		code = codes.Canceled
+	case err == context.DeadlineExceeded:
+		code = codes.DeadlineExceeded
+	case internalerror.Is(err, internalerror.InvalidInput):
+		code = invalidInput
+	case internalerror.Is(err, internalerror.NoFreeSpace), internalerror.Is(err, internalerror.JournalFull),
+		internalerror.Is(err, internalerror.QuotaExceeded):
+		code = codes.ResourceExhausted
+	case internalerror.Is(err, internalerror.DeviceBusy), internalerror.Is(err, internalerror.DeviceTerminated):
+		code = codes.Unavailable
+	case internalerror.Is(err, internalerror.ReadOnly):
+		code = codes.FailedPrecondition
+	}
+	return status.Error(code, err.Error())
+}
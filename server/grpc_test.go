@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCServer(t *testing.T) {
+	store, err := storage.CreateCannylsStorage("grpc.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("grpc.lusf")
+	async, err := storage.NewAsyncStorage(store, 16)
+	assert.Nil(t, err)
+	defer async.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer()
+	RegisterGRPC(s, async)
+	go s.Serve(listener)
+	defer s.Stop()
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := NewLumpServiceClient(conn)
+	ctx := context.Background()
+
+	put, err := client.Put(ctx, &PutRequest{Id: "a", Data: []byte("hello cannyls")})
+	assert.Nil(t, err)
+	assert.False(t, put.Updated)
+	_, err = client.Put(ctx, &PutRequest{Id: "b", Data: []byte("world")})
+	assert.Nil(t, err)
+	put, err = client.Put(ctx, &PutRequest{Id: "b", Data: []byte("WORLD")})
+	assert.Nil(t, err)
+	assert.True(t, put.Updated)
+	_, err = client.Put(ctx, &PutRequest{Id: "xyz", Data: []byte("bad id")})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	get, err := client.Get(ctx, &GetRequest{Id: "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello cannyls"), get.Data)
+	_, err = client.Get(ctx, &GetRequest{Id: "c"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	stat, err := client.Stat(ctx, &StatRequest{Id: "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5), stat.Size)
+	_, err = client.Stat(ctx, &StatRequest{Id: "c"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.List(ctx, &ListRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, list.Ids)
+	list, err = client.List(ctx, &ListRequest{Start: "b", Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b"}, list.Ids)
+
+	_, err = client.Delete(ctx, &DeleteRequest{Id: "a"})
+	assert.Nil(t, err)
+	_, err = client.Delete(ctx, &DeleteRequest{Id: "a"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,289 @@
+/*
+Package server serves the lumps of a storage over HTTP and gRPC, so cannyls could run as a standalone node.
+
+	async, err := storage.NewAsyncStorage(store, 1024)
+	http.ListenAndServe(":8081", server.New(async))
+
+The lumpids in the paths are hex, as lump.FromString parses them.
+
+	PUT    /lumps/{id}                      put the body as the lump data, Content-Length is required
+	GET    /lumps/{id}                      read the lump data, a Range header reads a part of it
+	HEAD   /lumps/{id}                      the size of the lump data in Content-Length
+	DELETE /lumps/{id}                      delete the lump
+	GET    /stat/{id}                       the storage.LumpStat in JSON
+	GET    /lumps?start={id}&end={id}&limit={n}  the lumpids in [start, end), one per line
+
+The same operations are served over gRPC by the LumpService of lump.proto, see GRPCServer.
+
+	s := grpc.NewServer()
+	server.RegisterGRPC(s, async)
+	s.Serve(listener)
+
+The requests are run by the worker of AsyncStorage, a request is aborted if its client is gone
+before the worker picks it up. The body of a put is streamed into the storage by the worker, so a
+lump of up to lump.LARGE_LUMP_MAX_SIZE bytes is put without being buffered, see Storage.PutReader.
+*/
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage"
+)
+
+const (
+	//LIST_DEFAULT_LIMIT is the limit of a list without the limit parameter
+	LIST_DEFAULT_LIMIT = 1000
+)
+
+//Server is an http.Handler, see the package document for the routes
+type Server struct {
+	async *storage.AsyncStorage
+	mux   *http.ServeMux
+}
+
+//New returns the handler of async, async is not closed by the server
+func New(async *storage.AsyncStorage) *Server {
+	server := &Server{async: async, mux: http.NewServeMux()}
+	server.mux.HandleFunc("/lumps/", server.handleLump)
+	server.mux.HandleFunc("/lumps", server.handleList)
+	server.mux.HandleFunc("/stat/", server.handleStat)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+func (server *Server) handleLump(w http.ResponseWriter, r *http.Request) {
+	id, err := lump.FromString(strings.TrimPrefix(r.URL.Path, "/lumps/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		server.put(w, r, id)
+	case http.MethodGet:
+		server.get(w, r, id)
+	case http.MethodHead:
+		server.head(w, r, id)
+	case http.MethodDelete:
+		server.delete(w, r, id)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (server *Server) put(w http.ResponseWriter, r *http.Request, id lump.LumpId) {
+	//the body is streamed, so its size must be known before it is read
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+	if uint64(r.ContentLength) > lump.LARGE_LUMP_MAX_SIZE {
+		http.Error(w, fmt.Sprintf("lump data is larger than %d bytes", lump.LARGE_LUMP_MAX_SIZE), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := &bodyReader{reader: r.Body}
+	result := server.async.Do(r.Context(), true, func(store *storage.Storage) storage.AsyncResult {
+		updated, err := store.PutReader(id, body, uint64(r.ContentLength))
+		return storage.AsyncResult{Updated: updated, Err: err}
+	})
+	if result.Err != nil {
+		if body.err != nil {
+			http.Error(w, body.err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeError(w, result.Err, http.StatusBadRequest)
+		return
+	}
+	if result.Updated {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+//bodyReader keeps the error of reading the request body, which is the fault of the client, e.g. a short body
+type bodyReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (server *Server) get(w http.ResponseWriter, r *http.Request, id lump.LumpId) {
+	reader, stat, err := server.async.GetReaderContext(r.Context(), id)
+	if err != nil {
+		//the lumpid is valid, so InvalidInput means it is not found or expired
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	//ServeContent handles the Range header
+	http.ServeContent(w, r, "", time.Time{}, &lumpReader{reader: reader, size: int64(stat.Size)})
+}
+
+/*
+lumpReader seeks over the reader of a lump for ServeContent, the reader is not seekable, so a seek
+forward skips the data in the next Read, and only the data up to the end of a range is read.
+*/
+type lumpReader struct {
+	reader io.Reader
+	size   int64
+	//offset is the offset of reader, position is where the next Read starts
+	offset   int64
+	position int64
+}
+
+func (r *lumpReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.position
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.position = offset
+	return offset, nil
+}
+
+func (r *lumpReader) Read(p []byte) (int, error) {
+	if r.position < r.offset {
+		return 0, errors.New("lump data could not be read backward")
+	}
+	if r.position > r.offset {
+		skipped, err := io.CopyN(ioutil.Discard, r.reader, r.position-r.offset)
+		r.offset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	r.position = r.offset
+	return n, err
+}
+
+func (server *Server) head(w http.ResponseWriter, r *http.Request, id lump.LumpId) {
+	stat, err := server.async.StatContext(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatUint(uint64(stat.Size), 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (server *Server) delete(w http.ResponseWriter, r *http.Request, id lump.LumpId) {
+	deleted, err := server.async.DeleteContext(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !deleted {
+		http.Error(w, fmt.Sprintf("lump %s is not found", id.String()), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleStat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := lump.FromString(strings.TrimPrefix(r.URL.Path, "/stat/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stat, err := server.async.StatContext(r.Context(), id)
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stat)
+}
+
+func (server *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	start, end := lump.FromU64(0, 0), lump.FromU64(0, math.MaxUint64)
+	limit := LIST_DEFAULT_LIMIT
+	var err error
+	if s := query.Get("start"); s != "" {
+		if start, err = lump.FromString(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("end"); s != "" {
+		if end, err = lump.FromString(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %s", s), http.StatusBadRequest)
+			return
+		}
+	}
+	ids, err := server.async.ListRangeContext(r.Context(), start, end, limit)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for _, id := range ids {
+		fmt.Fprintln(w, id.String())
+	}
+}
+
+//writeError maps the errors of the storage to the status codes, InvalidInput is invalidInput
+func writeError(w http.ResponseWriter, err error, invalidInput int) {
+	status := http.StatusInternalServerError
+	switch {
+	case internalerror.Is(err, internalerror.InvalidInput):
+		status = invalidInput
+	case internalerror.Is(err, internalerror.NoFreeSpace), internalerror.Is(err, internalerror.JournalFull),
+		internalerror.Is(err, internalerror.QuotaExceeded):
+		status = http.StatusInsufficientStorage
+	case internalerror.Is(err, internalerror.DeviceBusy):
+		status = http.StatusTooManyRequests
+	case internalerror.Is(err, internalerror.ReadOnly), internalerror.Is(err, internalerror.DeviceTerminated):
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
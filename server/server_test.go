@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage"
+)
+
+func do(t *testing.T, method string, url string, body string, header http.Header) (*http.Response, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range header {
+		request.Header[k] = v
+	}
+	response, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	assert.Nil(t, err)
+	return response, string(data)
+}
+
+func TestServer(t *testing.T) {
+	store, err := storage.CreateCannylsStorage("server.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("server.lusf")
+	async, err := storage.NewAsyncStorage(store, 16)
+	assert.Nil(t, err)
+	defer async.Close()
+	ts := httptest.NewServer(New(async))
+	defer ts.Close()
+
+	response, _ := do(t, http.MethodPut, ts.URL+"/lumps/a", "hello cannyls", nil)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, _ = do(t, http.MethodPut, ts.URL+"/lumps/b", "world", nil)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, _ = do(t, http.MethodPut, ts.URL+"/lumps/b", "WORLD", nil)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, _ = do(t, http.MethodPut, ts.URL+"/lumps/xyz", "bad id", nil)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response, body := do(t, http.MethodGet, ts.URL+"/lumps/a", "", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "hello cannyls", body)
+	response, body = do(t, http.MethodGet, ts.URL+"/lumps/a", "", http.Header{"Range": {"bytes=6-"}})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "cannyls", body)
+	response, body = do(t, http.MethodGet, ts.URL+"/lumps/a", "", http.Header{"Range": {"bytes=2-4"}})
+	assert.Equal(t, http.StatusPartialContent, response.StatusCode)
+	assert.Equal(t, "llo", body)
+	response, _ = do(t, http.MethodGet, ts.URL+"/lumps/a", "", http.Header{"Range": {"bytes=20-"}})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, response.StatusCode)
+	response, _ = do(t, http.MethodGet, ts.URL+"/lumps/c", "", nil)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, _ = do(t, http.MethodHead, ts.URL+"/lumps/b", "", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, int64(5), response.ContentLength)
+	response, body = do(t, http.MethodGet, ts.URL+"/stat/a", "", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	var stat storage.LumpStat
+	assert.Nil(t, json.Unmarshal([]byte(body), &stat))
+	assert.Equal(t, uint32(13), stat.Size)
+
+	response, body = do(t, http.MethodGet, ts.URL+"/lumps", "", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "a\nb\n", body)
+	_, body = do(t, http.MethodGet, ts.URL+"/lumps?start=b&limit=10", "", nil)
+	assert.Equal(t, "b\n", body)
+	response, _ = do(t, http.MethodGet, ts.URL+"/lumps?limit=0", "", nil)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response, _ = do(t, http.MethodDelete, ts.URL+"/lumps/a", "", nil)
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, _ = do(t, http.MethodDelete, ts.URL+"/lumps/a", "", nil)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	response, _ = do(t, http.MethodPost, ts.URL+"/lumps/a", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+}
+
+func TestServerLargeLump(t *testing.T) {
+	store, err := storage.CreateCannylsStorage("server_large.lusf", 128*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("server_large.lusf")
+	async, err := storage.NewAsyncStorage(store, 16)
+	assert.Nil(t, err)
+	defer async.Close()
+	ts := httptest.NewServer(New(async))
+	defer ts.Close()
+
+	//the lump is streamed into extents
+	large := make([]byte, lump.LUMP_MAX_SIZE+5000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	response, _ := do(t, http.MethodPut, ts.URL+"/lumps/a", string(large), nil)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	response, _ = do(t, http.MethodHead, ts.URL+"/lumps/a", "", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, int64(len(large)), response.ContentLength)
+	response, body := do(t, http.MethodGet, ts.URL+"/lumps/a", "", nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.True(t, bytes.Equal(large, []byte(body)))
+
+	//a body of unknown size is chunked
+	request, err := http.NewRequest(http.MethodPut, ts.URL+"/lumps/b", ioutil.NopCloser(strings.NewReader("chunked")))
+	assert.Nil(t, err)
+	response, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusLengthRequired, response.StatusCode)
+}
@@ -0,0 +1,279 @@
+/*
+Package shardedstorage spreads the lumps over several storages, so the puts and gets of different
+lumps run on several cores, instead of the one worker of a single AsyncStorage.
+
+	sharded, err := shardedstorage.Create(shardedstorage.Paths("/data/lumps", 8), 64<<30, 0.01, 1024)
+	...
+	updated, err := sharded.Put(ctx, id, data)
+
+A lump is stored in the shard of ShardOf, every shard is a Storage in its own file, owned by
+an AsyncStorage. The shards must be opened in the same order with the same number, or the lumps
+are not found, because the lumpids are not moved between the shards.
+*/
+package shardedstorage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage"
+)
+
+const (
+	//FOR_EACH_PAGE_SIZE is the number of lumpids read from every shard at once by ForEach
+	FOR_EACH_PAGE_SIZE = 1024
+)
+
+type ShardedStorage struct {
+	shards []*storage.AsyncStorage
+}
+
+//Paths returns the paths of n shards, base.0, base.1 and so on
+func Paths(base string, n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("%s.%d", base, i)
+	}
+	return paths
+}
+
+/*
+ShardOf returns the shard of the lump in n shards. The lumpid is mixed by the multiplier of
+fibonacci hashing, so the sequential lumpids are spread evenly. It must never be changed
+*/
+func ShardOf(id lump.LumpId, n int) int {
+	return int((id.U64() * 0x9E3779B97F4A7C15 >> 32) % uint64(n))
+}
+
+/*
+New shards the lumps over the storages, every storage is owned by an AsyncStorage with queueSize,
+so it must not be used after that, see storage.NewAsyncStorage. If a shard fails to start, the
+storages of the started shards are closed
+*/
+func New(stores []*storage.Storage, queueSize int) (*ShardedStorage, error) {
+	if len(stores) == 0 {
+		return nil, errors.Wrap(internalerror.InvalidInput, "no shard")
+	}
+	sharded := &ShardedStorage{shards: make([]*storage.AsyncStorage, len(stores))}
+	for i, store := range stores {
+		async, err := storage.NewAsyncStorage(store, queueSize)
+		if err != nil {
+			for _, shard := range sharded.shards[:i] {
+				shard.Close()
+			}
+			return nil, errors.Wrapf(err, "failed to start shard %d", i)
+		}
+		sharded.shards[i] = async
+	}
+	return sharded, nil
+}
+
+//Create creates a storage of capacity bytes for every path, see storage.CreateCannylsStorage
+func Create(paths []string, capacity uint64, journalRatio float64, queueSize int) (*ShardedStorage, error) {
+	return build(paths, queueSize, func(path string) (*storage.Storage, error) {
+		return storage.CreateCannylsStorage(path, capacity, journalRatio)
+	})
+}
+
+//Open opens the storages of the paths, they must be in the order of Create
+func Open(paths []string, queueSize int) (*ShardedStorage, error) {
+	return build(paths, queueSize, storage.OpenCannylsStorage)
+}
+
+func build(paths []string, queueSize int, open func(path string) (*storage.Storage, error)) (*ShardedStorage, error) {
+	stores := make([]*storage.Storage, 0, len(paths))
+	for _, path := range paths {
+		store, err := open(path)
+		if err != nil {
+			for _, opened := range stores {
+				opened.Close()
+			}
+			return nil, errors.Wrapf(err, "failed to open shard %s", path)
+		}
+		stores = append(stores, store)
+	}
+	sharded, err := New(stores, queueSize)
+	if err != nil {
+		//the started shards are closed by New already
+		for _, store := range stores {
+			store.Close()
+		}
+		return nil, err
+	}
+	return sharded, nil
+}
+
+//Shards returns the number of the shards
+func (sharded *ShardedStorage) Shards() int {
+	return len(sharded.shards)
+}
+
+func (sharded *ShardedStorage) shard(id lump.LumpId) *storage.AsyncStorage {
+	return sharded.shards[ShardOf(id, len(sharded.shards))]
+}
+
+//Put is the same as storage.AsyncStorage.PutContext on the shard of the lump
+func (sharded *ShardedStorage) Put(ctx context.Context, id lump.LumpId, data lump.LumpData) (updated bool, err error) {
+	return sharded.shard(id).PutContext(ctx, id, data)
+}
+
+//Get is the same as storage.AsyncStorage.GetContext on the shard of the lump
+func (sharded *ShardedStorage) Get(ctx context.Context, id lump.LumpId) ([]byte, error) {
+	return sharded.shard(id).GetContext(ctx, id)
+}
+
+//Delete is the same as storage.AsyncStorage.DeleteContext on the shard of the lump
+func (sharded *ShardedStorage) Delete(ctx context.Context, id lump.LumpId) (deleted bool, err error) {
+	return sharded.shard(id).DeleteContext(ctx, id)
+}
+
+//Stat is the same as storage.AsyncStorage.StatContext on the shard of the lump
+func (sharded *ShardedStorage) Stat(ctx context.Context, id lump.LumpId) (storage.LumpStat, error) {
+	return sharded.shard(id).StatContext(ctx, id)
+}
+
+//each runs f for every shard concurrently, and returns the first error
+func (sharded *ShardedStorage) each(f func(i int, shard *storage.AsyncStorage) error) error {
+	errs := make([]error, len(sharded.shards))
+	var wg sync.WaitGroup
+	for i, shard := range sharded.shards {
+		wg.Add(1)
+		go func(i int, shard *storage.AsyncStorage) {
+			defer wg.Done()
+			errs[i] = f(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ListRange returns at most limit lumpids in [start, end) of all the shards ordered by lumpid,
+limit <= 0 means no limit, see storage.Storage.ListRange
+*/
+func (sharded *ShardedStorage) ListRange(ctx context.Context, start, end lump.LumpId, limit int) ([]lump.LumpId, error) {
+	lists := make([][]lump.LumpId, len(sharded.shards))
+	err := sharded.each(func(i int, shard *storage.AsyncStorage) (err error) {
+		lists[i], err = shard.ListRangeContext(ctx, start, end, limit)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return merge(lists, limit), nil
+}
+
+//List returns the lumpids of all the shards ordered by lumpid
+func (sharded *ShardedStorage) List(ctx context.Context) ([]lump.LumpId, error) {
+	return sharded.ListRange(ctx, lump.FromU64(0, 0), lump.FromU64(0, math.MaxUint64), 0)
+}
+
+/*
+ForEach calls f with the lumpids of all the shards ordered by lumpid until it returns false,
+the shards are read by pages of FOR_EACH_PAGE_SIZE, so the lumps put or deleted meanwhile
+may or may not be seen. The lumpid math.MaxUint64 is never seen, as storage.Storage.ListRange
+*/
+func (sharded *ShardedStorage) ForEach(ctx context.Context, f func(id lump.LumpId) bool) error {
+	start, end := lump.FromU64(0, 0), lump.FromU64(0, math.MaxUint64)
+	for {
+		ids, err := sharded.ListRange(ctx, start, end, FOR_EACH_PAGE_SIZE)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if !f(id) {
+				return nil
+			}
+		}
+		if len(ids) < FOR_EACH_PAGE_SIZE {
+			return nil
+		}
+		start = ids[len(ids)-1].Inc()
+	}
+}
+
+//merge merges the sorted lists, and keeps at most limit lumpids, limit <= 0 means no limit
+func merge(lists [][]lump.LumpId, limit int) []lump.LumpId {
+	total := 0
+	for _, list := range lists {
+		total += len(list)
+	}
+	if limit > 0 && total > limit {
+		total = limit
+	}
+	merged := make([]lump.LumpId, 0, total)
+	//the shards are a few, so the smallest head is found by a linear scan
+	for len(merged) < total {
+		min := -1
+		for i, list := range lists {
+			if len(list) > 0 && (min < 0 || list[0].U64() < lists[min][0].U64()) {
+				min = i
+			}
+		}
+		merged = append(merged, lists[min][0])
+		lists[min] = lists[min][1:]
+	}
+	return merged
+}
+
+/*
+Usage returns the usage of every shard, and the total of them. In the total, the capacities and the
+bytes are summed, LargestFreeBytes is the largest of the shards, and Fragmentation is the average of
+the shards weighted by their FreeBytes, because a lump could only be put into the free space of its shard
+*/
+func (sharded *ShardedStorage) Usage(ctx context.Context) (total storage.StorageUsage, shards []storage.StorageUsage, err error) {
+	shards = make([]storage.StorageUsage, len(sharded.shards))
+	err = sharded.each(func(i int, shard *storage.AsyncStorage) error {
+		return shard.Do(ctx, false, func(store *storage.Storage) storage.AsyncResult {
+			shards[i] = store.Usage()
+			return storage.AsyncResult{}
+		}).Err
+	})
+	if err != nil {
+		return total, nil, err
+	}
+	total.MinIndex, total.MaxIndex = -1, -1
+	var fragmentedBytes float64
+	for _, usage := range shards {
+		total.JournalCapacity += usage.JournalCapacity
+		total.DataCapacity += usage.DataCapacity
+		total.FileCounts += usage.FileCounts
+		total.FreeBytes += usage.FreeBytes
+		total.CurrentFileSize += usage.CurrentFileSize
+		total.AllocatedBytes += usage.AllocatedBytes
+		total.JournalUsage += usage.JournalUsage
+		total.EmbeddedBytes += usage.EmbeddedBytes
+		if usage.LargestFreeBytes > total.LargestFreeBytes {
+			total.LargestFreeBytes = usage.LargestFreeBytes
+		}
+		//the indexes are -1 if the shard is empty
+		if usage.MinIndex >= 0 && (total.MinIndex < 0 || usage.MinIndex < total.MinIndex) {
+			total.MinIndex = usage.MinIndex
+		}
+		if usage.MaxIndex > total.MaxIndex {
+			total.MaxIndex = usage.MaxIndex
+		}
+		fragmentedBytes += usage.Fragmentation * float64(usage.FreeBytes)
+	}
+	if total.FreeBytes > 0 {
+		total.Fragmentation = fragmentedBytes / float64(total.FreeBytes)
+	}
+	return total, shards, nil
+}
+
+//Close closes all the shards, and returns the first error
+func (sharded *ShardedStorage) Close() error {
+	return sharded.each(func(i int, shard *storage.AsyncStorage) error {
+		return shard.Close()
+	})
+}
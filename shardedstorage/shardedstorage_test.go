@@ -0,0 +1,104 @@
+package shardedstorage
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func lumpData(size int, value byte) lump.LumpData {
+	data := lump.NewLumpDataAligned(size, block.Min())
+	for i := range data.AsBytes() {
+		data.AsBytes()[i] = value
+	}
+	return data
+}
+
+func TestShardOf(t *testing.T) {
+	counts := make([]int, 4)
+	for i := uint64(0); i < 1000; i++ {
+		counts[ShardOf(lump.FromU64(0, i), 4)]++
+	}
+	for _, count := range counts {
+		assert.True(t, count > 200 && count < 300)
+	}
+}
+
+func TestShardedStorage(t *testing.T) {
+	paths := Paths("sharded.lusf", 4)
+	assert.Equal(t, "sharded.lusf.3", paths[3])
+	sharded, err := Create(paths, 1024*1024, 0.05, 64)
+	assert.Nil(t, err)
+	for _, path := range paths {
+		defer os.Remove(path)
+	}
+	assert.Equal(t, 4, sharded.Shards())
+	ctx := context.Background()
+
+	//the shards are written concurrently
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 100; i += 4 {
+				_, err := sharded.Put(ctx, lump.FromU64(0, uint64(i)), lumpData(100, byte(i)))
+				assert.Nil(t, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	data, err := sharded.Get(ctx, lump.FromU64(0, 42))
+	assert.Nil(t, err)
+	assert.Equal(t, lumpData(100, 42).AsBytes(), data)
+	stat, err := sharded.Stat(ctx, lump.FromU64(0, 42))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(100), stat.Size)
+	deleted, err := sharded.Delete(ctx, lump.FromU64(0, 0))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+
+	ids, err := sharded.List(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 99, len(ids))
+	for i, id := range ids {
+		assert.Equal(t, uint64(i+1), id.U64())
+	}
+	ids, err = sharded.ListRange(ctx, lump.FromU64(0, 10), lump.FromU64(0, 50), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []lump.LumpId{lump.FromU64(0, 10), lump.FromU64(0, 11), lump.FromU64(0, 12),
+		lump.FromU64(0, 13), lump.FromU64(0, 14)}, ids)
+	seen := 0
+	assert.Nil(t, sharded.ForEach(ctx, func(id lump.LumpId) bool {
+		seen++
+		return id.U64() < 20
+	}))
+	assert.Equal(t, 20, seen)
+
+	total, shards, err := sharded.Usage(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(shards))
+	assert.Equal(t, uint64(99), total.FileCounts)
+	assert.Equal(t, int64(1), total.MinIndex)
+	assert.Equal(t, int64(99), total.MaxIndex)
+	assert.Equal(t, shards[0].DataCapacity*4, total.DataCapacity)
+	for _, usage := range shards {
+		assert.True(t, usage.FileCounts > 0)
+	}
+	assert.Nil(t, sharded.Close())
+
+	sharded, err = Open(paths, 64)
+	assert.Nil(t, err)
+	defer sharded.Close()
+	ids, err = sharded.List(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 99, len(ids))
+	_, err = Open(Paths("no-such-shard", 2), 64)
+	assert.Error(t, err)
+}
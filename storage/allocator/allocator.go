@@ -13,13 +13,38 @@ import (
 	"github.com/thesues/cannyls-go/util"
 )
 
+/*
+DataPortionAlloc manages the free blocks of the data region, the storage is not thread safe,
+so it is never called concurrently. Register a Factory to use a custom allocator,
+see StorageOptions.Allocator
+*/
 type DataPortionAlloc interface {
 	Display()
+	//Allocate returns StorageFull if there is no free portion large enough
 	Allocate(size uint16) (free portion.DataPortion, err error)
+	//Release panics if the portion overlaps a free portion
 	Release(p portion.DataPortion)
+	//RestoreFromIndex marks the space not used by the portions as free
 	RestoreFromIndex(blockSize block.BlockSize, capacityInByte uint64, vec []portion.DataPortion)
+	//Grow adds the space between the old and the new capacity as free portions
+	Grow(blockSize block.BlockSize, oldCapacityInByte uint64, newCapacityInByte uint64)
+	//Shrink removes the free space beyond the new capacity, the portions in use are not changed
+	Shrink(blockSize block.BlockSize, newCapacityInByte uint64)
 	MemoryUsed() uint64
 	FreeCount() uint64
+	//LargestFree returns the number of blocks in the largest free portion
+	LargestFree() uint64
+}
+
+/*
+FreeListAllocator could list and load its free portions, so the storage saves them
+in a checkpoint, and loads them instead of calling RestoreFromIndex when it is opened
+*/
+type FreeListAllocator interface {
+	//ForEachFree calls f with the start and the length of every free portion in blocks
+	ForEachFree(f func(start uint64, len uint64))
+	//AddFree marks the blocks as free, they are merged with the adjacent free portions
+	AddFree(start uint64, len uint64)
 }
 
 //TODO: Use ceph bitmap algorithm
@@ -27,12 +52,21 @@ type BtreeDataPortionAlloc struct {
 	sizeToFree *btree.BTree
 	endToFree  *btree.BTree
 	freeCount  uint64
+	policy     AllocationPolicy
+	cursor     uint64 //the end of the last allocated portion, used by POLICY_NEXT_FIT
 }
 
 func (alloc *BtreeDataPortionAlloc) FreeCount() uint64 {
 	return alloc.freeCount
 }
 
+func (alloc *BtreeDataPortionAlloc) LargestFree() uint64 {
+	if item := alloc.sizeToFree.Max(); item != nil {
+		return uint64(portion.FreePortion(item.(portion.SizeBasedPortion)).Len())
+	}
+	return 0
+}
+
 func NewBtreeAlloc() *BtreeDataPortionAlloc {
 	freeList := btree.NewFreeList(32)
 	return &BtreeDataPortionAlloc{
@@ -82,31 +116,71 @@ func (alloc *BtreeDataPortionAlloc) Display() {
 	return
 }
 
+func (alloc *BtreeDataPortionAlloc) SetPolicy(policy AllocationPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	alloc.policy = policy
+	return nil
+}
+
+func (alloc *BtreeDataPortionAlloc) Policy() AllocationPolicy {
+	return alloc.policy
+}
+
 func (alloc *BtreeDataPortionAlloc) Allocate(size uint16) (free portion.DataPortion, err error) {
-	var isAllocated = false
+	p, ok := alloc.findFree(size)
+	if ok {
+		alloc.deleteFreePortion(p)
+		p, free = p.SlicePart(size)
+		if p.Len() > 0 {
+			alloc.addFreePortion(p)
+		}
+		alloc.cursor = free.End()
+		return free, nil
+	} else {
+		return portion.DataPortion{},
+			errors.Wrap(internalerror.StorageFull, "failed to alloc portion from in-memory allocator")
+	}
+}
+
+func (alloc *BtreeDataPortionAlloc) findFree(size uint16) (found portion.FreePortion, ok bool) {
+	switch alloc.policy {
+	case POLICY_FIRST_FIT:
+		return alloc.firstFit(0, size)
+	case POLICY_NEXT_FIT:
+		if found, ok = alloc.firstFit(alloc.cursor, size); ok {
+			return
+		}
+		return alloc.firstFit(0, size)
+	}
 	start := portion.SizeBasedPortion(portion.NewFreePortion(
 		address.AddressFromU32(0), uint32(size)))
-	//loop over the btree, and find the first free portion, and slice the portion from the original part, and return
+	//loop over the btree, and find the first free portion which is large enough
 	alloc.sizeToFree.AscendGreaterOrEqual(start, func(a btree.Item) bool {
 		p := portion.FreePortion(a.(portion.SizeBasedPortion))
 		if p.Len() >= uint32(size) {
-			alloc.deleteFreePortion(p)
-			p, free = p.SlicePart(size)
-			if p.Len() > 0 {
-				alloc.addFreePortion(p)
-			}
-			isAllocated = true
+			found, ok = p, true
 			return false
 		}
 		return true
 	})
+	return
+}
 
-	if isAllocated {
-		return free, nil
-	} else {
-		return portion.DataPortion{},
-			errors.Wrap(internalerror.StorageFull, "failed to alloc portion from in-memory allocator")
-	}
+//firstFit returns the first free portion starting from the address which could hold the size
+func (alloc *BtreeDataPortionAlloc) firstFit(from uint64, size uint16) (found portion.FreePortion, ok bool) {
+	//the free portions do not overlap, so they are sorted by start too
+	start := portion.EndBasedPortion(portion.NewFreePortion(address.AddressFromU64(from+1), 0))
+	alloc.endToFree.AscendGreaterOrEqual(start, func(a btree.Item) bool {
+		p := portion.FreePortion(a.(portion.EndBasedPortion))
+		if p.Start().AsU64() >= from && p.Len() >= uint32(size) {
+			found, ok = p, true
+			return false
+		}
+		return true
+	})
+	return
 }
 
 func (alloc *BtreeDataPortionAlloc) Release(p portion.DataPortion) {
@@ -207,3 +281,43 @@ func (alloc *BtreeDataPortionAlloc) RestoreFromIndex(blockSize block.BlockSize,
 	}
 
 }
+
+func (alloc *BtreeDataPortionAlloc) Grow(blockSize block.BlockSize, oldCapacityInByte uint64, newCapacityInByte uint64) {
+	start := oldCapacityInByte / uint64(blockSize.AsU16())
+	alloc.AddFree(start, newCapacityInByte/uint64(blockSize.AsU16())-start)
+}
+
+func (alloc *BtreeDataPortionAlloc) ForEachFree(f func(start uint64, len uint64)) {
+	alloc.endToFree.Ascend(func(a btree.Item) bool {
+		p := portion.FreePortion(a.(portion.EndBasedPortion))
+		f(p.Start().AsU64(), uint64(p.Len()))
+		return true
+	})
+}
+
+func (alloc *BtreeDataPortionAlloc) AddFree(start uint64, len uint64) {
+	end := start + len
+	for start < end {
+		size := util.Min(0xFFFFFF, end-start)
+		free := portion.NewFreePortion(address.AddressFromU64(start), uint32(size))
+		alloc.addFreePortion(alloc.mergeFreePortions(free))
+		start += size
+	}
+}
+
+func (alloc *BtreeDataPortionAlloc) Shrink(blockSize block.BlockSize, newCapacityInByte uint64) {
+	end := newCapacityInByte / uint64(blockSize.AsU16())
+	var beyond []portion.FreePortion
+	//the free portions are sorted by end
+	search := portion.EndBasedPortion(portion.NewFreePortion(address.AddressFromU64(end+1), 0))
+	alloc.endToFree.AscendGreaterOrEqual(search, func(a btree.Item) bool {
+		beyond = append(beyond, portion.FreePortion(a.(portion.EndBasedPortion)))
+		return true
+	})
+	for _, p := range beyond {
+		alloc.deleteFreePortion(p)
+		if p.Start().AsU64() < end {
+			alloc.addFreePortion(portion.NewFreePortion(p.Start(), uint32(end-p.Start().AsU64())))
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/portion"
 )
@@ -100,6 +101,60 @@ func DoTestAllocateRelease(t *testing.T, alloc DataPortionAlloc) {
 	alloc.Display()
 }
 
+func TestAllocateBTreeGrow(t *testing.T) {
+	alloc := BuildBtreeDataPortionAlloc(24)
+	DoTestAllocateGrow(t, alloc)
+}
+func TestAllocateJudyGrow(t *testing.T) {
+	alloc := BuildJudyAlloc(24)
+	DoTestAllocateGrow(t, alloc)
+}
+
+func DoTestAllocateGrow(t *testing.T, alloc DataPortionAlloc) {
+	p, err := alloc.Allocate(20)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(0, 20), p)
+	_, err = alloc.Allocate(10)
+	assert.Error(t, err)
+
+	alloc.Grow(block.Min(), 24*512, 40*512)
+	assert.Equal(t, uint64(20), alloc.FreeCount())
+	//the new space is merged with the free tail
+	assert.Equal(t, uint64(20), alloc.LargestFree())
+	p, err = alloc.Allocate(20)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(20, 20), p)
+	assert.Equal(t, uint64(0), alloc.FreeCount())
+}
+
+func TestAllocateBTreeShrink(t *testing.T) {
+	alloc := BuildBtreeDataPortionAlloc(24)
+	DoTestAllocateShrink(t, alloc)
+}
+func TestAllocateJudyShrink(t *testing.T) {
+	alloc := BuildJudyAlloc(24)
+	DoTestAllocateShrink(t, alloc)
+}
+
+func DoTestAllocateShrink(t *testing.T, alloc DataPortionAlloc) {
+	_, err := alloc.Allocate(4)
+	assert.Nil(t, err)
+	p, err := alloc.Allocate(4)
+	assert.Nil(t, err)
+	alloc.Release(fportion(0, 4))
+
+	//[0, 4) is kept, [8, 24) is dropped
+	alloc.Shrink(block.Min(), 6*512)
+	assert.Equal(t, uint64(4), alloc.FreeCount())
+	//the released portion is merged into [0, 8), then trimmed
+	alloc.Release(p)
+	alloc.Shrink(block.Min(), 6*512)
+	assert.Equal(t, uint64(6), alloc.FreeCount())
+	assert.Equal(t, uint64(6), alloc.LargestFree())
+	_, err = alloc.Allocate(7)
+	assert.Error(t, err)
+}
+
 func fportion(addr uint64, size uint16) portion.DataPortion {
 	return portion.NewDataPortion(addr, size)
 }
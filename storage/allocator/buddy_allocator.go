@@ -0,0 +1,217 @@
+package allocator
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/address"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/go-judy"
+)
+
+//the address of data portion is 40bit
+const MAX_BUDDY_ORDER = 40
+
+/*
+BuddyPortionAlloc is a buddy system allocator, every free block has 2^order blocks
+and starts at a multiple of its size, the free blocks of each order are stored in a set.
+Allocate splits the smallest free block which could hold the portion, and the unused
+tail of the block is released at once, so a portion is not rounded up on disk, but
+every portion starts at an aligned address, and a released portion is merged with
+its buddies. Both Allocate and Release are O(log n)
+*/
+type BuddyPortionAlloc struct {
+	freeBlocks [MAX_BUDDY_ORDER + 1]judy.Judy1
+	freeCount  uint64
+}
+
+func NewBuddyAlloc() *BuddyPortionAlloc {
+	return &BuddyPortionAlloc{}
+}
+
+func BuildBuddyAlloc(capacitySector uint64) *BuddyPortionAlloc {
+	alloc := NewBuddyAlloc()
+	alloc.releaseRange(0, capacitySector)
+	return alloc
+}
+
+//ceilOrder returns the smallest order whose block could hold size blocks
+func ceilOrder(size uint64) uint {
+	var order uint
+	for (uint64(1) << order) < size {
+		order++
+	}
+	return order
+}
+
+func (alloc *BuddyPortionAlloc) addBlock(start uint64, order uint) {
+	alloc.freeBlocks[order].Set(start)
+	alloc.freeCount += uint64(1) << order
+}
+
+func (alloc *BuddyPortionAlloc) deleteBlock(start uint64, order uint) {
+	alloc.freeBlocks[order].Unset(start)
+	alloc.freeCount -= uint64(1) << order
+}
+
+//releaseBlock merges the block with its free buddies
+func (alloc *BuddyPortionAlloc) releaseBlock(start uint64, order uint) {
+	for order < MAX_BUDDY_ORDER {
+		buddy := start ^ (uint64(1) << order)
+		if !alloc.freeBlocks[order].Test(buddy) {
+			break
+		}
+		alloc.deleteBlock(buddy, order)
+		if buddy < start {
+			start = buddy
+		}
+		order++
+	}
+	alloc.addBlock(start, order)
+}
+
+//releaseRange splits [start, end) into the largest aligned blocks and releases them
+func (alloc *BuddyPortionAlloc) releaseRange(start uint64, end uint64) {
+	for start < end {
+		var order uint
+		for order < MAX_BUDDY_ORDER &&
+			start&((uint64(1)<<(order+1))-1) == 0 && start+(uint64(1)<<(order+1)) <= end {
+			order++
+		}
+		alloc.releaseBlock(start, order)
+		start += uint64(1) << order
+	}
+}
+
+//isOverlapedRange returns true if any free block overlaps [start, end)
+func (alloc *BuddyPortionAlloc) isOverlapedRange(start uint64, end uint64) bool {
+	for order := uint(0); order <= MAX_BUDDY_ORDER; order++ {
+		size := uint64(1) << order
+		//a free block contains start
+		if alloc.freeBlocks[order].Test(start &^ (size - 1)) {
+			return true
+		}
+		//a free block starts in the range
+		if index, ok := alloc.freeBlocks[order].First(start); ok && index < end {
+			return true
+		}
+	}
+	return false
+}
+
+func (alloc *BuddyPortionAlloc) Allocate(size uint16) (free portion.DataPortion, err error) {
+	order := ceilOrder(uint64(size))
+	for found := order; found <= MAX_BUDDY_ORDER; found++ {
+		start, ok := alloc.freeBlocks[found].First(0)
+		if !ok {
+			continue
+		}
+		alloc.deleteBlock(start, found)
+		//split the block until it is the smallest one holding the portion
+		for found > order {
+			found--
+			alloc.addBlock(start+(uint64(1)<<found), found)
+		}
+		alloc.releaseRange(start+uint64(size), start+(uint64(1)<<order))
+		return portion.DataPortion{Start: address.AddressFromU64(start), Len: size}, nil
+	}
+	return portion.DataPortion{}, errors.Wrap(internalerror.StorageFull, "failed to alloc portion from buddy allocator")
+}
+
+func (alloc *BuddyPortionAlloc) Release(p portion.DataPortion) {
+	if alloc.isOverlapedRange(p.Start.AsU64(), p.End()) {
+		panic("allocate failed to allocate an overlap poriton")
+	}
+	alloc.releaseRange(p.Start.AsU64(), p.End())
+}
+
+//RestoreFromIndex does not depend on the allocator which allocated the portions
+func (alloc *BuddyPortionAlloc) RestoreFromIndex(blockSize block.BlockSize,
+	capacityInByte uint64, vec []portion.DataPortion) {
+	sort.Slice(vec, func(i, j int) bool {
+		return vec[i].Start < vec[j].Start
+	})
+
+	var head uint64
+	for _, p := range vec {
+		alloc.releaseRange(head, p.Start.AsU64())
+		head = p.End()
+	}
+	alloc.releaseRange(head, capacityInByte/uint64(blockSize.AsU16()))
+}
+
+func (alloc *BuddyPortionAlloc) Grow(blockSize block.BlockSize, oldCapacityInByte uint64, newCapacityInByte uint64) {
+	alloc.releaseRange(oldCapacityInByte/uint64(blockSize.AsU16()), newCapacityInByte/uint64(blockSize.AsU16()))
+}
+
+func (alloc *BuddyPortionAlloc) ForEachFree(f func(start uint64, len uint64)) {
+	for order := range alloc.freeBlocks {
+		index, ok := alloc.freeBlocks[order].First(0)
+		for ok {
+			f(index, uint64(1)<<uint(order))
+			index, ok = alloc.freeBlocks[order].Next(index)
+		}
+	}
+}
+
+func (alloc *BuddyPortionAlloc) AddFree(start uint64, len uint64) {
+	alloc.releaseRange(start, start+len)
+}
+
+func (alloc *BuddyPortionAlloc) Shrink(blockSize block.BlockSize, newCapacityInByte uint64) {
+	end := newCapacityInByte / uint64(blockSize.AsU16())
+	var crossing []uint64
+	for order := uint(0); order <= MAX_BUDDY_ORDER; order++ {
+		size := uint64(1) << order
+		var from uint64
+		if end >= size {
+			from = end - size + 1
+		}
+		for index, ok := alloc.freeBlocks[order].First(from); ok; index, ok = alloc.freeBlocks[order].First(from) {
+			alloc.deleteBlock(index, order)
+			if index < end {
+				crossing = append(crossing, index)
+			}
+		}
+	}
+	//at most one block crosses the end
+	for _, start := range crossing {
+		alloc.releaseRange(start, end)
+	}
+}
+
+func (alloc *BuddyPortionAlloc) MemoryUsed() uint64 {
+	var used uint64
+	for order := range alloc.freeBlocks {
+		used += alloc.freeBlocks[order].MemoryUsed()
+	}
+	return used
+}
+
+func (alloc *BuddyPortionAlloc) FreeCount() uint64 {
+	return alloc.freeCount
+}
+
+//LargestFree returns the size of the largest free block, the adjacent blocks are not merged
+func (alloc *BuddyPortionAlloc) LargestFree() uint64 {
+	for order := MAX_BUDDY_ORDER; order >= 0; order-- {
+		if _, ok := alloc.freeBlocks[order].First(0); ok {
+			return uint64(1) << uint(order)
+		}
+	}
+	return 0
+}
+
+func (alloc *BuddyPortionAlloc) Display() {
+	fmt.Printf("==Free Blocks==\n")
+	for order := range alloc.freeBlocks {
+		index, ok := alloc.freeBlocks[order].First(0)
+		for ok {
+			fmt.Printf("Block Order: %d, Start %d, End: %d\n", order, index, index+(uint64(1)<<uint(order)))
+			index, ok = alloc.freeBlocks[order].Next(index)
+		}
+	}
+}
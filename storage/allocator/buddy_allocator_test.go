@@ -0,0 +1,88 @@
+package allocator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func TestAllocateBuddy(t *testing.T) {
+	alloc := BuildBuddyAlloc(24)
+	assert.Equal(t, uint64(24), alloc.FreeCount())
+	assert.Equal(t, uint64(16), alloc.LargestFree())
+
+	p0, err := alloc.Allocate(10)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(0, 10), p0)
+	assert.Equal(t, uint64(14), alloc.FreeCount())
+
+	//the tail of the first block is used
+	p1, err := alloc.Allocate(3)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(12, 3), p1)
+	p2, err := alloc.Allocate(8)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(16, 8), p2)
+	_, err = alloc.Allocate(4)
+	assert.Error(t, err)
+
+	alloc.Release(p1)
+	alloc.Release(p0)
+	alloc.Release(p2)
+	//the buddies are merged
+	assert.Equal(t, uint64(24), alloc.FreeCount())
+	assert.Equal(t, uint64(16), alloc.LargestFree())
+	p, err := alloc.Allocate(16)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(0, 16), p)
+}
+
+func TestAllocateBuddyShouldPanic(t *testing.T) {
+	alloc := BuildBuddyAlloc(24)
+	DoTestAllocateShouldPanic(t, alloc)
+	p, err := alloc.Allocate(4)
+	assert.Nil(t, err)
+	alloc.Release(p)
+	assert.Panics(t, func() {
+		alloc.Release(fportion(2, 4))
+	})
+}
+
+func TestAllocateBuddyRelease(t *testing.T) {
+	alloc := BuildBuddyAlloc(419431)
+	DoTestAllocateRelease(t, alloc)
+	assert.Equal(t, uint64(419431), alloc.FreeCount())
+}
+
+func TestAllocateBuddyRestore(t *testing.T) {
+	//the portions are not aligned if they are allocated by another allocator
+	alloc := NewBuddyAlloc()
+	alloc.RestoreFromIndex(block.Min(), 24*512, []portion.DataPortion{fportion(9, 2), fportion(1, 3)})
+	assert.Equal(t, uint64(19), alloc.FreeCount())
+	assert.Equal(t, uint64(8), alloc.LargestFree())
+
+	alloc.Release(fportion(1, 3))
+	alloc.Release(fportion(9, 2))
+	assert.Equal(t, uint64(24), alloc.FreeCount())
+	assert.Equal(t, uint64(16), alloc.LargestFree())
+}
+
+func TestAllocateBuddyResize(t *testing.T) {
+	alloc := BuildBuddyAlloc(24)
+	//the smallest free block is split
+	p, err := alloc.Allocate(2)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(16, 2), p)
+
+	alloc.Shrink(block.Min(), 20*512)
+	assert.Equal(t, uint64(18), alloc.FreeCount())
+	_, err = alloc.Allocate(17)
+	assert.Error(t, err)
+
+	alloc.Grow(block.Min(), 20*512, 32*512)
+	alloc.Release(p)
+	assert.Equal(t, uint64(32), alloc.FreeCount())
+	assert.Equal(t, uint64(32), alloc.LargestFree())
+}
@@ -0,0 +1,92 @@
+package allocator
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+//FreeExtent is a free portion of the data region, the offset and the length are in blocks
+type FreeExtent struct {
+	Offset uint64 `json:"offset"`
+	Length uint64 `json:"length"`
+}
+
+/*
+DumpFreeList returns the free portions of alloc sorted by the offset, so the external tools could
+visualize the fragmentation over time. The portions are reported as the allocator keeps them, the
+adjacent blocks of the buddy allocator are not merged. It returns InvalidInput if alloc could not
+list its free portions, see FreeListAllocator
+*/
+func DumpFreeList(alloc DataPortionAlloc) ([]FreeExtent, error) {
+	freeList, ok := alloc.(FreeListAllocator)
+	if !ok {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "allocator %T could not list its free portions", alloc)
+	}
+	extents := make([]FreeExtent, 0, 64)
+	freeList.ForEachFree(func(start uint64, len uint64) {
+		extents = append(extents, FreeExtent{Offset: start, Length: len})
+	})
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i].Offset < extents[j].Offset
+	})
+	return extents, nil
+}
+
+/*
+OccupancyHistogram splits the capacityInBlocks blocks into buckets of the same size, and returns
+the ratio of the blocks in use of every bucket, from 0 (all free) to 1 (all in use).
+extents must be sorted by the offset, as DumpFreeList returns them
+*/
+func OccupancyHistogram(extents []FreeExtent, capacityInBlocks uint64, buckets int) []float64 {
+	if buckets <= 0 || capacityInBlocks == 0 {
+		return nil
+	}
+	if uint64(buckets) > capacityInBlocks {
+		buckets = int(capacityInBlocks)
+	}
+	histogram := make([]float64, buckets)
+	i := 0
+	for b := 0; b < buckets; b++ {
+		start := capacityInBlocks * uint64(b) / uint64(buckets)
+		end := capacityInBlocks * uint64(b+1) / uint64(buckets)
+		//skip the extents before the bucket, an extent could span several buckets
+		for i < len(extents) && extents[i].Offset+extents[i].Length <= start {
+			i++
+		}
+		var free uint64
+		for j := i; j < len(extents) && extents[j].Offset < end; j++ {
+			from, to := extents[j].Offset, extents[j].Offset+extents[j].Length
+			if from < start {
+				from = start
+			}
+			if to > end {
+				to = end
+			}
+			free += to - from
+		}
+		histogram[b] = 1 - float64(free)/float64(end-start)
+	}
+	return histogram
+}
+
+//the characters of RenderOccupancy, from all free to all in use
+const OCCUPANCY_LEVELS = " .:-=+*#%@"
+
+//RenderOccupancy renders the histogram as one character per bucket, see OCCUPANCY_LEVELS
+func RenderOccupancy(histogram []float64) string {
+	var sb strings.Builder
+	last := len(OCCUPANCY_LEVELS) - 1
+	for _, ratio := range histogram {
+		level := int(ratio*float64(last) + 0.5)
+		if level < 0 {
+			level = 0
+		} else if level > last {
+			level = last
+		}
+		sb.WriteByte(OCCUPANCY_LEVELS[level])
+	}
+	return sb.String()
+}
@@ -0,0 +1,33 @@
+package allocator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+func TestDumpFreeList(t *testing.T) {
+	for _, alloc := range []DataPortionAlloc{BuildBtreeDataPortionAlloc(100), BuildJudyAlloc(100)} {
+		buildFragmented(t, alloc)
+		extents, err := DumpFreeList(alloc)
+		assert.Nil(t, err)
+		assert.Equal(t, []FreeExtent{{10, 20}, {40, 5}, {50, 50}}, extents)
+
+		histogram := OccupancyHistogram(extents, 100, 4)
+		assert.Equal(t, []float64{0.4, 0.6, 0, 0}, histogram)
+		assert.Equal(t, "=+  ", RenderOccupancy(histogram))
+	}
+
+	buddy := BuildBuddyAlloc(64)
+	_, err := buddy.Allocate(16)
+	assert.Nil(t, err)
+	extents, err := DumpFreeList(buddy)
+	assert.Nil(t, err)
+	assert.Equal(t, []FreeExtent{{16, 16}, {32, 32}}, extents)
+	assert.Equal(t, "+ ", RenderOccupancy(OccupancyHistogram(extents, 64, 2)))
+	assert.Equal(t, 64, len(OccupancyHistogram(extents, 64, 100)))
+
+	_, err = DumpFreeList(nil)
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+}
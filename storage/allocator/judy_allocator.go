@@ -20,6 +20,8 @@ type JudyPortionAlloc struct {
 	startBasedTree judy.Judy1
 	sizeBasedTree  judy.Judy1
 	freeCount      uint64
+	policy         AllocationPolicy
+	cursor         uint64 //the end of the last allocated portion, used by POLICY_NEXT_FIT
 }
 
 type JudyPortion uint64
@@ -159,32 +161,81 @@ func (alloc *JudyPortionAlloc) Display() {
 	}
 }
 
-func (alloc *JudyPortionAlloc) Allocate(size uint16) (free portion.DataPortion, err error) {
+func (alloc *JudyPortionAlloc) SetPolicy(policy AllocationPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	alloc.policy = policy
+	return nil
+}
 
-	//loop over the ordered set , and find the first free portion, and slice the portion from the original part, and return
-	start := uint64(size) << 40
-	index, ok := alloc.sizeBasedTree.First(start)
+func (alloc *JudyPortionAlloc) Policy() AllocationPolicy {
+	return alloc.policy
+}
+
+func (alloc *JudyPortionAlloc) Allocate(size uint16) (free portion.DataPortion, err error) {
+	p, ok := alloc.findFree(size)
 	if ok {
-		p := fromSizebasedToJudy(index)
-		//p.Len() is 24bit, size is 16bit, so convert both to 32bit to compare
-		if p.Len() >= uint32(size) {
-			alloc.deletePortion(p)
-			p, free = p.SlicePart(size)
-			if p.Len() > 0 {
-				alloc.addPortion(p)
-			}
-			return free, nil
+		alloc.deletePortion(p)
+		p, free = p.SlicePart(size)
+		if p.Len() > 0 {
+			alloc.addPortion(p)
 		}
+		alloc.cursor = free.End()
+		return free, nil
 	}
 
 	return portion.DataPortion{}, errors.Wrap(internalerror.StorageFull, "failed to alloc portion from in-memory allocator")
 
 }
 
+func (alloc *JudyPortionAlloc) findFree(size uint16) (JudyPortion, bool) {
+	switch alloc.policy {
+	case POLICY_FIRST_FIT:
+		return alloc.firstFit(0, size)
+	case POLICY_NEXT_FIT:
+		if p, ok := alloc.firstFit(alloc.cursor, size); ok {
+			return p, true
+		}
+		return alloc.firstFit(0, size)
+	default:
+		//loop over the ordered set , and find the first free portion, and slice the portion from the original part, and return
+		index, ok := alloc.sizeBasedTree.First(uint64(size) << 40)
+		if ok {
+			p := fromSizebasedToJudy(index)
+			//p.Len() is 24bit, size is 16bit, so convert both to 32bit to compare
+			if p.Len() >= uint32(size) {
+				return p, true
+			}
+		}
+		return 0, false
+	}
+}
+
+//firstFit returns the first free portion starting from the address which could hold the size
+func (alloc *JudyPortionAlloc) firstFit(from uint64, size uint16) (JudyPortion, bool) {
+	index, ok := alloc.startBasedTree.First(uint64(newJudyPortion(address.AddressFromU64(from), 0)))
+	for ok {
+		p := JudyPortion(index)
+		if p.Len() >= uint32(size) {
+			return p, true
+		}
+		index, ok = alloc.startBasedTree.Next(index)
+	}
+	return 0, false
+}
+
 func (alloc *JudyPortionAlloc) FreeCount() uint64 {
 	return alloc.freeCount
 }
 
+func (alloc *JudyPortionAlloc) LargestFree() uint64 {
+	if index, ok := alloc.sizeBasedTree.Last(math.MaxUint64); ok {
+		return uint64(fromSizebasedToJudy(index).Len())
+	}
+	return 0
+}
+
 func (alloc *JudyPortionAlloc) deletePortion(p JudyPortion) {
 	alloc.startBasedTree.Unset(uint64(p))
 	alloc.sizeBasedTree.Unset(uint64(p.ToSizeBasedUint64()))
@@ -313,3 +364,44 @@ func (alloc *JudyPortionAlloc) RestoreFromIndex(blockSize block.BlockSize,
 	}
 
 }
+
+func (alloc *JudyPortionAlloc) Grow(blockSize block.BlockSize, oldCapacityInByte uint64, newCapacityInByte uint64) {
+	start := oldCapacityInByte / uint64(blockSize.AsU16())
+	alloc.AddFree(start, newCapacityInByte/uint64(blockSize.AsU16())-start)
+}
+
+func (alloc *JudyPortionAlloc) ForEachFree(f func(start uint64, len uint64)) {
+	index, ok := alloc.startBasedTree.First(0)
+	for ok {
+		p := JudyPortion(index)
+		f(p.Start().AsU64(), uint64(p.Len()))
+		index, ok = alloc.startBasedTree.Next(index)
+	}
+}
+
+func (alloc *JudyPortionAlloc) AddFree(start uint64, len uint64) {
+	end := start + len
+	for start < end {
+		size := util.Min(0xFFFFFF, end-start)
+		free := newJudyPortion(address.AddressFromU64(start), uint32(size))
+		alloc.addPortion(alloc.mergeFreePortions(free))
+		start += size
+	}
+}
+
+func (alloc *JudyPortionAlloc) Shrink(blockSize block.BlockSize, newCapacityInByte uint64) {
+	end := newCapacityInByte / uint64(blockSize.AsU16())
+	search := newJudyPortion(address.AddressFromU64(end), 0)
+	//the portion crosses the new end
+	if index, ok := alloc.startBasedTree.Prev(uint64(search)); ok {
+		p := JudyPortion(index)
+		if p.End().AsU64() > end {
+			alloc.deletePortion(p)
+			alloc.addPortion(newJudyPortion(p.Start(), uint32(end-p.Start().AsU64())))
+		}
+	}
+	//the portions start beyond the new end
+	for index, ok := alloc.startBasedTree.First(uint64(search)); ok; index, ok = alloc.startBasedTree.First(uint64(search)) {
+		alloc.deletePortion(JudyPortion(index))
+	}
+}
@@ -0,0 +1,47 @@
+package allocator
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+//AllocationPolicy decides which free portion is used by Allocate
+type AllocationPolicy int
+
+const (
+	//the smallest free portion which could hold the size, the default
+	POLICY_BEST_FIT AllocationPolicy = iota
+	//the free portion with the lowest address which could hold the size
+	POLICY_FIRST_FIT
+	//like POLICY_FIRST_FIT, but search from the end of the last allocated portion, and wrap around
+	POLICY_NEXT_FIT
+)
+
+func (policy AllocationPolicy) String() string {
+	switch policy {
+	case POLICY_BEST_FIT:
+		return "best-fit"
+	case POLICY_FIRST_FIT:
+		return "first-fit"
+	case POLICY_NEXT_FIT:
+		return "next-fit"
+	default:
+		return fmt.Sprintf("AllocationPolicy(%d)", int(policy))
+	}
+}
+
+func (policy AllocationPolicy) validate() error {
+	if policy < POLICY_BEST_FIT || policy > POLICY_NEXT_FIT {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid allocation policy %d", int(policy))
+	}
+	return nil
+}
+
+//PolicyAllocator is implemented by the DataPortionAlloc which supports more than one AllocationPolicy,
+//such as JudyPortionAlloc and BtreeDataPortionAlloc
+type PolicyAllocator interface {
+	SetPolicy(policy AllocationPolicy) error
+	Policy() AllocationPolicy
+}
@@ -0,0 +1,131 @@
+package allocator
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func TestAllocatePolicyJudy(t *testing.T) {
+	DoTestAllocatePolicy(t, func() PolicyDataPortionAlloc { return BuildJudyAlloc(100) })
+}
+
+func TestAllocatePolicyBTree(t *testing.T) {
+	DoTestAllocatePolicy(t, func() PolicyDataPortionAlloc { return BuildBtreeDataPortionAlloc(100) })
+}
+
+type PolicyDataPortionAlloc interface {
+	DataPortionAlloc
+	PolicyAllocator
+}
+
+//the free portions are [10, 30), [40, 45), [50, 100)
+func buildFragmented(t *testing.T, alloc DataPortionAlloc) {
+	_, err := alloc.Allocate(10)
+	assert.Nil(t, err)
+	p1, err := alloc.Allocate(20)
+	assert.Nil(t, err)
+	_, err = alloc.Allocate(10)
+	assert.Nil(t, err)
+	p3, err := alloc.Allocate(5)
+	assert.Nil(t, err)
+	_, err = alloc.Allocate(5)
+	assert.Nil(t, err)
+	alloc.Release(p1)
+	alloc.Release(p3)
+}
+
+func DoTestAllocatePolicy(t *testing.T, build func() PolicyDataPortionAlloc) {
+	alloc := build()
+	assert.Equal(t, POLICY_BEST_FIT, alloc.Policy())
+	err := alloc.SetPolicy(AllocationPolicy(10))
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+	buildFragmented(t, alloc)
+	p, err := alloc.Allocate(5)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(40, 5), p)
+
+	alloc = build()
+	assert.Nil(t, alloc.SetPolicy(POLICY_FIRST_FIT))
+	buildFragmented(t, alloc)
+	p, err = alloc.Allocate(5)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(10, 5), p)
+	p, err = alloc.Allocate(21)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(50, 21), p)
+
+	alloc = build()
+	assert.Nil(t, alloc.SetPolicy(POLICY_NEXT_FIT))
+	buildFragmented(t, alloc)
+	//the search starts from the end of the last allocated portion
+	p, err = alloc.Allocate(5)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(50, 5), p)
+	p, err = alloc.Allocate(40)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(55, 40), p)
+	//wrap around
+	p, err = alloc.Allocate(6)
+	assert.Nil(t, err)
+	assert.Equal(t, fportion(10, 6), p)
+}
+
+func benchmarkAllocatePolicy(b *testing.B, alloc PolicyDataPortionAlloc, policy AllocationPolicy) {
+	if err := alloc.SetPolicy(policy); err != nil {
+		b.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	var live []portion.DataPortion
+	failures := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		//mixed small and large lumps, release a random one when it is full
+		size := uint16(1 + rng.Intn(8))
+		if rng.Intn(4) == 0 {
+			size = uint16(128 + rng.Intn(2048))
+		}
+		p, err := alloc.Allocate(size)
+		for err != nil && len(live) > 0 {
+			failures++
+			n := rng.Intn(len(live))
+			alloc.Release(live[n])
+			live[n] = live[len(live)-1]
+			live = live[:len(live)-1]
+			p, err = alloc.Allocate(size)
+		}
+		live = append(live, p)
+	}
+	b.StopTimer()
+	//more failures means the free space is more fragmented
+	b.Logf("%s: %d allocations, %d failures, largest free %d of %d",
+		policy, b.N, failures, alloc.LargestFree(), alloc.FreeCount())
+}
+
+func BenchmarkAllocateJudyBestFit(b *testing.B) {
+	benchmarkAllocatePolicy(b, BuildJudyAlloc(1<<20), POLICY_BEST_FIT)
+}
+
+func BenchmarkAllocateJudyFirstFit(b *testing.B) {
+	benchmarkAllocatePolicy(b, BuildJudyAlloc(1<<20), POLICY_FIRST_FIT)
+}
+
+func BenchmarkAllocateJudyNextFit(b *testing.B) {
+	benchmarkAllocatePolicy(b, BuildJudyAlloc(1<<20), POLICY_NEXT_FIT)
+}
+
+func BenchmarkAllocateBTreeBestFit(b *testing.B) {
+	benchmarkAllocatePolicy(b, BuildBtreeDataPortionAlloc(1<<20), POLICY_BEST_FIT)
+}
+
+func BenchmarkAllocateBTreeFirstFit(b *testing.B) {
+	benchmarkAllocatePolicy(b, BuildBtreeDataPortionAlloc(1<<20), POLICY_FIRST_FIT)
+}
+
+func BenchmarkAllocateBTreeNextFit(b *testing.B) {
+	benchmarkAllocatePolicy(b, BuildBtreeDataPortionAlloc(1<<20), POLICY_NEXT_FIT)
+}
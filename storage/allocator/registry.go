@@ -0,0 +1,75 @@
+package allocator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+const (
+	ALLOCATOR_JUDY  = "judy"
+	ALLOCATOR_BTREE = "btree"
+	ALLOCATOR_BUDDY = "buddy"
+	//DEFAULT_ALLOCATOR is used if no allocator is named
+	DEFAULT_ALLOCATOR = ALLOCATOR_JUDY
+)
+
+/*
+Factory returns an empty allocator, the storage calls RestoreFromIndex on it
+with the data portions in the index when it is opened.
+*/
+type Factory func() DataPortionAlloc
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Factory)
+)
+
+func init() {
+	Register(ALLOCATOR_JUDY, func() DataPortionAlloc { return NewJudyAlloc() })
+	Register(ALLOCATOR_BTREE, func() DataPortionAlloc { return NewBtreeAlloc() })
+	Register(ALLOCATOR_BUDDY, func() DataPortionAlloc { return NewBuddyAlloc() })
+}
+
+//Register makes an allocator available by the name, it panics if the name is registered twice,
+//so call it in the init function of the package providing the allocator
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if factory == nil {
+		panic("allocator: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("allocator: Register called twice for %s", name))
+	}
+	registry[name] = factory
+}
+
+//New returns an empty allocator by the name, an empty name means DEFAULT_ALLOCATOR
+func New(name string) (DataPortionAlloc, error) {
+	if name == "" {
+		name = DEFAULT_ALLOCATOR
+	}
+	registryLock.RLock()
+	factory, ok := registry[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "unknown allocator %s", name)
+	}
+	return factory(), nil
+}
+
+//Names returns the names of the registered allocators in order
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
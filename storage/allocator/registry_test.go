@@ -0,0 +1,48 @@
+package allocator
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+type countingAlloc struct {
+	*BtreeDataPortionAlloc
+	allocated int
+}
+
+func (alloc *countingAlloc) Allocate(size uint16) (free portion.DataPortion, err error) {
+	alloc.allocated++
+	return alloc.BtreeDataPortionAlloc.Allocate(size)
+}
+
+func TestAllocatorRegistry(t *testing.T) {
+	alloc, err := New("")
+	assert.Nil(t, err)
+	_, ok := alloc.(*JudyPortionAlloc)
+	assert.True(t, ok)
+	alloc, err = New(ALLOCATOR_BTREE)
+	assert.Nil(t, err)
+	_, ok = alloc.(*BtreeDataPortionAlloc)
+	assert.True(t, ok)
+	_, err = New("nonexistent")
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	Register("counting", func() DataPortionAlloc {
+		return &countingAlloc{BtreeDataPortionAlloc: NewBtreeAlloc()}
+	})
+	assert.Panics(t, func() {
+		Register("counting", func() DataPortionAlloc { return NewBtreeAlloc() })
+	})
+	assert.Equal(t, []string{ALLOCATOR_BTREE, ALLOCATOR_BUDDY, "counting", ALLOCATOR_JUDY}, Names())
+
+	alloc, err = New("counting")
+	assert.Nil(t, err)
+	alloc.Grow(block.Min(), 0, 24*512)
+	DoTestAllocate(t, alloc)
+	assert.Equal(t, 7, alloc.(*countingAlloc).allocated)
+}
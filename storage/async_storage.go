@@ -0,0 +1,689 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+const (
+	//if there is no request in SIDE_JOB_INTERVAL, the worker runs side job once
+	SIDE_JOB_INTERVAL = 3 * time.Second
+	//at most PRIORITY_HIGH_BURST queued high priority requests run before a batch request
+	PRIORITY_HIGH_BURST = 16
+	//ASYNC_READERS is the number of the readers of AsyncStorage, which read the lump data of the Gets in parallel
+	ASYNC_READERS = 4
+)
+
+/*
+Priority orders the requests queued in AsyncStorage, a request of the *Context methods has the
+priority of WithPriority, the other requests are PRIORITY_HIGH.
+*/
+type Priority int
+
+const (
+	//PRIORITY_HIGH is for the latency sensitive requests, it is the default
+	PRIORITY_HIGH Priority = iota
+	//PRIORITY_BATCH is for the bulk work such as restores, it runs when no high priority request is queued
+	PRIORITY_BATCH
+)
+
+type priorityKey struct{}
+
+//WithPriority returns a context whose requests have the priority
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+//PriorityOf returns the priority of the context, PRIORITY_HIGH if it is not set
+func PriorityOf(ctx context.Context) Priority {
+	if priority, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return priority
+	}
+	return PRIORITY_HIGH
+}
+
+/*
+AsyncStorage owns a Storage, all the operations are sent to a worker goroutine and
+executed one by one, because Storage itself is not thread safe.
+Callers get a Future immediately, and they could wait on it, or select on Done()
+
+The lump data of GetAsync and GetContext is read by a pool of ASYNC_READERS readers over the NVM:
+the worker looks the lump up in order with the other requests, and hands the read to a reader, so
+the reads wait for the disk in parallel. The worker waits for the reads in flight before it runs a
+write or a side job, so the portions being read are never released or overwritten. The observer of
+the storage could be called by the readers, see Storage.SetObserver.
+
+The AsyncStorage owns the storage until it is closed, the methods of the storage called out of
+the worker fail with DeviceBusy, see Do to run the methods without an async version. The getters
+without an error result, such as Usage and List, are submitted to the worker instead.
+
+The journal gc yields to the queued high priority reads, so a Get of an embedded lump is not
+blocked by a long gc, see Storage.SetJournalGcYield. The reads are still run in the order they
+are queued with the writes, the first write queued stops the yield until the gc is done.
+*/
+type AsyncStorage struct {
+	store    *Storage
+	requests chan asyncRequest
+	//batchRequests is the queue of PRIORITY_BATCH
+	batchRequests chan asyncRequest
+	stop          chan struct{}
+	finished      chan struct{}
+	mutex         sync.RWMutex
+	closed        bool
+	//groupCommit is nil if the writes are not synced by the worker
+	groupCommit *GroupCommitOptions
+	//depth of the nested exec calls, it is only used by the worker
+	depth int
+	//reads is the queue of the readers, it is closed when the worker is finished
+	reads chan func()
+	//inflight counts the reads queued or running in the readers
+	inflight sync.WaitGroup
+}
+
+/*
+GroupCommitOptions makes the writes of AsyncStorage durable. The futures of the writes
+are completed after the journal is synced, and the sync is shared by the writes which
+are executed in Window, or at most MaxRecords writes.
+*/
+type GroupCommitOptions struct {
+	Window     time.Duration
+	MaxRecords int
+}
+
+func (options GroupCommitOptions) validate() error {
+	if options.Window <= 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid group commit window %v", options.Window)
+	}
+	if options.MaxRecords <= 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid group commit records %d", options.MaxRecords)
+	}
+	return nil
+}
+
+type AsyncResult struct {
+	Data    []byte
+	Updated bool
+	Err     error
+	//read is set if the result is read by a reader, see ASYNC_READERS
+	read func() AsyncResult
+}
+
+type Future struct {
+	done   chan struct{}
+	result AsyncResult
+}
+
+func newFuture() *Future {
+	return &Future{
+		done: make(chan struct{}),
+	}
+}
+
+func (f *Future) complete(result AsyncResult) {
+	f.result = result
+	close(f.done)
+}
+
+//Done is closed when the result is ready
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+//Wait blocks until the result is ready
+func (f *Future) Wait() AsyncResult {
+	<-f.done
+	return f.result
+}
+
+type asyncRequest struct {
+	run    func(store *Storage) AsyncResult
+	future *Future
+	//write requests wait for the group commit
+	write bool
+}
+
+type pendingCommit struct {
+	future *Future
+	result AsyncResult
+}
+
+/*
+NewAsyncStorage starts the worker, queueSize is the max number of pending requests.
+It fails if the storage is closed or owned by another AsyncStorage
+*/
+func NewAsyncStorage(store *Storage, queueSize int) (*AsyncStorage, error) {
+	return newAsyncStorage(store, queueSize, nil)
+}
+
+//NewAsyncStorageWithGroupCommit is the same as NewAsyncStorage, but the writes are group committed
+func NewAsyncStorageWithGroupCommit(store *Storage, queueSize int, options GroupCommitOptions) (*AsyncStorage, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return newAsyncStorage(store, queueSize, &options)
+}
+
+func newAsyncStorage(store *Storage, queueSize int, groupCommit *GroupCommitOptions) (*AsyncStorage, error) {
+	if atomic.LoadInt32(&store.closed) == 1 {
+		return nil, errors.Wrap(internalerror.DeviceTerminated, "storage is closed")
+	}
+	if !atomic.CompareAndSwapInt32(&store.owned, 0, 1) {
+		return nil, errors.Wrap(internalerror.InvalidInput, "storage is owned by another AsyncStorage")
+	}
+	async := &AsyncStorage{
+		store:         store,
+		requests:      make(chan asyncRequest, queueSize),
+		batchRequests: make(chan asyncRequest, queueSize),
+		stop:          make(chan struct{}),
+		finished:      make(chan struct{}),
+		groupCommit:   groupCommit,
+		reads:         make(chan func(), queueSize),
+	}
+	store.owner.Store(async)
+	for i := 0; i < ASYNC_READERS; i++ {
+		go async.read()
+	}
+	go async.work()
+	return async, nil
+}
+
+//exec runs f as the owner of the storage, it is only called by the worker, and could be nested
+func (async *AsyncStorage) exec(f func()) {
+	if async.depth == 0 {
+		atomic.StoreInt32(&async.store.executing, 1)
+	}
+	async.depth++
+	defer func() {
+		async.depth--
+		if async.depth == 0 {
+			atomic.StoreInt32(&async.store.executing, 0)
+		}
+	}()
+	f()
+}
+
+//read runs the reads handed by the worker, until the worker is finished
+func (async *AsyncStorage) read() {
+	for read := range async.reads {
+		read()
+	}
+}
+
+//readLater hands the read of the result to a reader, it is read by the worker if the readers are busy
+func (async *AsyncStorage) readLater(future *Future, read func() AsyncResult) {
+	async.inflight.Add(1)
+	select {
+	case async.reads <- func() {
+		defer async.inflight.Done()
+		future.complete(read())
+	}:
+	default:
+		defer async.inflight.Done()
+		async.exec(func() {
+			future.complete(read())
+		})
+	}
+}
+
+func (async *AsyncStorage) work() {
+	defer close(async.finished)
+	defer func() {
+		//the storage is closed after the reads in flight
+		close(async.reads)
+		async.inflight.Wait()
+	}()
+	var pending []pendingCommit
+	//commitTimer is nil if nothing is pending
+	var commitTimer <-chan time.Time
+	run := func(request asyncRequest) {
+		//a write never runs with the reads of the readers, the nested reads of the gc yield are not handed to them
+		if request.write {
+			async.inflight.Wait()
+		}
+		nested := async.depth > 0
+		var result AsyncResult
+		async.exec(func() {
+			result = request.run(async.store)
+			if result.read != nil && nested {
+				result = result.read()
+			}
+		})
+		if result.read != nil {
+			async.readLater(request.future, result.read)
+			return
+		}
+		if async.groupCommit == nil || !request.write || result.Err != nil {
+			request.future.complete(result)
+			return
+		}
+		pending = append(pending, pendingCommit{future: request.future, result: result})
+		if len(pending) == 1 {
+			commitTimer = time.After(async.groupCommit.Window)
+		}
+		if len(pending) >= async.groupCommit.MaxRecords {
+			pending, commitTimer = async.commit(pending), nil
+		}
+	}
+	//deferred is the write taken from the queue by the gc yield, it runs after the gc
+	var deferred *asyncRequest
+	runDeferred := func() {
+		for deferred != nil {
+			request := *deferred
+			deferred = nil
+			run(request)
+		}
+	}
+	//runQueued runs a queued high priority request, it returns false if there is none
+	runQueued := func() bool {
+		runDeferred()
+		select {
+		case request := <-async.requests:
+			run(request)
+			return true
+		default:
+			return false
+		}
+	}
+	//the yield is set on the journal, so it is cleared even if the index is broken
+	async.exec(func() {
+		async.store.journalRegion.SetGcYield(func() {
+			for deferred == nil {
+				select {
+				case request := <-async.requests:
+					if request.write {
+						deferred = &request
+					} else {
+						run(request)
+					}
+				default:
+					return
+				}
+			}
+		})
+	})
+	defer async.exec(func() { async.store.journalRegion.SetGcYield(nil) })
+	sideJob := time.NewTimer(SIDE_JOB_INTERVAL)
+	defer sideJob.Stop()
+	for {
+		runDeferred()
+		select {
+		case request := <-async.requests:
+			run(request)
+		case request := <-async.batchRequests:
+			//the queued high priority requests run first
+			for i := 0; i < PRIORITY_HIGH_BURST && runQueued(); i++ {
+			}
+			run(request)
+		case <-commitTimer:
+			pending, commitTimer = async.commit(pending), nil
+		case <-async.stop:
+			//nothing is queued after stop, so the queues are drained, the high priority first
+			for runQueued() {
+			}
+			for drained := false; !drained; {
+				select {
+				case request := <-async.batchRequests:
+					run(request)
+					runDeferred()
+				default:
+					drained = true
+				}
+			}
+			async.commit(pending)
+			return
+		case <-sideJob.C:
+			//the failures are counted in SideJobStats
+			async.inflight.Wait()
+			async.exec(func() { async.store.RunSideJobOnce() })
+			sideJob.Reset(SIDE_JOB_INTERVAL)
+			continue
+		}
+		//the timer is restarted after each request, see SIDE_JOB_INTERVAL
+		if !sideJob.Stop() {
+			<-sideJob.C
+		}
+		sideJob.Reset(SIDE_JOB_INTERVAL)
+	}
+}
+
+//commit syncs the journal, and completes the pending writes, they fail if it is not synced
+func (async *AsyncStorage) commit(pending []pendingCommit) []pendingCommit {
+	if len(pending) == 0 {
+		return pending
+	}
+	var err error
+	async.exec(func() { err = async.store.JournalSync() })
+	for _, p := range pending {
+		//the writes are not durable if the journal is not synced
+		if err != nil && p.result.Err == nil {
+			p.result.Err = err
+		}
+		p.future.complete(p.result)
+	}
+	return pending[:0]
+}
+
+//submit never blocks, if the queue is full, the future fails with DeviceBusy
+func (async *AsyncStorage) submit(run func(store *Storage) AsyncResult) *Future {
+	return async.submitRequest(run, false, PRIORITY_HIGH)
+}
+
+//submitWrite is the same as submit, but the future waits for the group commit
+func (async *AsyncStorage) submitWrite(run func(store *Storage) AsyncResult) *Future {
+	return async.submitRequest(run, true, PRIORITY_HIGH)
+}
+
+func (async *AsyncStorage) queue(priority Priority) chan asyncRequest {
+	if priority == PRIORITY_BATCH {
+		return async.batchRequests
+	}
+	return async.requests
+}
+
+func (async *AsyncStorage) submitRequest(run func(store *Storage) AsyncResult, write bool, priority Priority) *Future {
+	future := newFuture()
+	async.mutex.RLock()
+	defer async.mutex.RUnlock()
+	if async.closed {
+		future.complete(AsyncResult{Err: internalerror.DeviceTerminated})
+		return future
+	}
+	select {
+	case async.queue(priority) <- asyncRequest{run: run, future: future, write: write}:
+	default:
+		future.complete(AsyncResult{Err: internalerror.DeviceBusy})
+	}
+	return future
+}
+
+/*
+submitContext blocks until the request is queued or ctx is done, and waits for its result.
+The request is queued by the priority of ctx, see WithPriority.
+The worker skips the request if ctx is done before it runs, but a request which is already
+running could not be aborted, so a write may be stored even if ctx.Err() is returned.
+*/
+func (async *AsyncStorage) submitContext(ctx context.Context, run func(store *Storage) AsyncResult, write bool) AsyncResult {
+	if err := ctx.Err(); err != nil {
+		return AsyncResult{Err: err}
+	}
+	future := newFuture()
+	request := asyncRequest{
+		run: func(store *Storage) AsyncResult {
+			if err := ctx.Err(); err != nil {
+				return AsyncResult{Err: err}
+			}
+			return run(store)
+		},
+		future: future,
+		write:  write,
+	}
+
+	async.mutex.RLock()
+	if async.closed {
+		async.mutex.RUnlock()
+		return AsyncResult{Err: internalerror.DeviceTerminated}
+	}
+	select {
+	case async.queue(PriorityOf(ctx)) <- request:
+		async.mutex.RUnlock()
+	case <-ctx.Done():
+		async.mutex.RUnlock()
+		return AsyncResult{Err: ctx.Err()}
+	}
+
+	select {
+	case <-future.Done():
+		return future.Wait()
+	case <-ctx.Done():
+		return AsyncResult{Err: ctx.Err()}
+	}
+}
+
+/*
+Do runs f with the storage in the worker, and waits for its result like PutContext. It is the way to
+call the methods of Storage without an async version, f must not keep the storage after it returns.
+If write is false, f must not modify the storage, because it could run between the steps of the
+journal gc, and the result is not delayed by the group commit.
+*/
+func (async *AsyncStorage) Do(ctx context.Context, write bool, f func(store *Storage) AsyncResult) AsyncResult {
+	return async.submitContext(ctx, f, write)
+}
+
+/*
+CreateSnapshot is the same as Storage.CreateSnapshot, but the other requests are not blocked by it:
+the snapshot is opened and closed by the write requests, and each chunk of it is read by a request
+with the priority of ctx, see Snapshot.WriteTo. w is written and the background bandwidth is waited
+for out of the worker. The snapshot is closed even if ctx is done.
+*/
+func (async *AsyncStorage) CreateSnapshot(ctx context.Context, w io.Writer) error {
+	//the snapshot must be closed if it is opened, so the open and the close are not canceled
+	background := WithPriority(context.Background(), PriorityOf(ctx))
+	var snapshot *Snapshot
+	result := async.Do(background, true, func(store *Storage) AsyncResult {
+		var err error
+		snapshot, err = store.OpenSnapshot()
+		return AsyncResult{Err: err}
+	})
+	if result.Err != nil {
+		return result.Err
+	}
+	defer async.Do(background, true, func(store *Storage) AsyncResult {
+		snapshot.Close()
+		return AsyncResult{}
+	})
+	snapshot.run = func(f func()) error {
+		return async.Do(ctx, false, func(store *Storage) AsyncResult {
+			f()
+			return AsyncResult{}
+		}).Err
+	}
+	_, err := snapshot.WriteTo(w)
+	return err
+}
+
+/*
+GetReaderContext is the same as Storage.GetReader, but the reader could be used after the lump is
+changed: the lump data is pinned until the reader is closed, see DataRegion.Pin, and each Read of it
+is run by a request with the priority of ctx, like CreateSnapshot. stat is the LumpStat of the lump
+the reader reads. The reader must be closed, and it is closed even if ctx is done.
+*/
+func (async *AsyncStorage) GetReaderContext(ctx context.Context, lumpid lump.LumpId) (io.ReadCloser, LumpStat, error) {
+	//the lump data must be unpinned if it is pinned, so the open and the close are not canceled
+	background := WithPriority(context.Background(), PriorityOf(ctx))
+	reader := &asyncReader{async: async, ctx: ctx, background: background}
+	var stat LumpStat
+	result := async.Do(background, true, func(store *Storage) AsyncResult {
+		var err error
+		if stat, err = store.Stat(lumpid); err != nil {
+			return AsyncResult{Err: err}
+		}
+		if reader.reader, err = store.GetReader(lumpid); err != nil {
+			return AsyncResult{Err: err}
+		}
+		store.dataRegion.Pin()
+		return AsyncResult{}
+	})
+	if result.Err != nil {
+		return nil, LumpStat{}, result.Err
+	}
+	return reader, stat, nil
+}
+
+//asyncReader is the reader of GetReaderContext
+type asyncReader struct {
+	async      *AsyncStorage
+	ctx        context.Context
+	background context.Context
+	reader     io.ReadCloser
+	closed     bool
+}
+
+func (reader *asyncReader) Read(p []byte) (int, error) {
+	if reader.closed {
+		return 0, errors.Wrap(internalerror.InvalidInput, "reader is closed")
+	}
+	//the worker could still run the read after ctx is done, so it does not read into p
+	buf := make([]byte, len(p))
+	var n int
+	var err error
+	result := reader.async.Do(reader.ctx, false, func(store *Storage) AsyncResult {
+		n, err = reader.reader.Read(buf)
+		return AsyncResult{}
+	})
+	if result.Err != nil {
+		return 0, result.Err
+	}
+	return copy(p, buf[:n]), err
+}
+
+//Close unpins the lump data, see GetReaderContext
+func (reader *asyncReader) Close() error {
+	if reader.closed {
+		return nil
+	}
+	reader.closed = true
+	var err error
+	result := reader.async.Do(reader.background, true, func(store *Storage) AsyncResult {
+		err = reader.reader.Close()
+		store.dataRegion.Unpin()
+		return AsyncResult{}
+	})
+	if result.Err != nil {
+		return result.Err
+	}
+	return err
+}
+
+//PutContext is the same as Storage.Put, it waits for a free slot in the queue instead of failing with DeviceBusy,
+//and returns ctx.Err() if ctx is done before the put is completed
+func (async *AsyncStorage) PutContext(ctx context.Context, lumpid lump.LumpId, lumpdata lump.LumpData) (updated bool, err error) {
+	result := async.submitContext(ctx, func(store *Storage) AsyncResult {
+		updated, err := store.Put(lumpid, lumpdata)
+		return AsyncResult{Updated: updated, Err: err}
+	}, true)
+	return result.Updated, result.Err
+}
+
+//GetContext is the same as Storage.Get, see PutContext. The lump data is read by a reader, see ASYNC_READERS
+func (async *AsyncStorage) GetContext(ctx context.Context, lumpid lump.LumpId) ([]byte, error) {
+	result := async.submitContext(ctx, getRequest(lumpid), false)
+	return result.Data, result.Err
+}
+
+//getRequest looks the lump up in the worker, and its data is read by a reader
+func getRequest(lumpid lump.LumpId) func(store *Storage) AsyncResult {
+	return func(store *Storage) AsyncResult {
+		read := store.getLater(lumpid)
+		return AsyncResult{read: func() AsyncResult {
+			data, err := read()
+			return AsyncResult{Data: data, Err: err}
+		}}
+	}
+}
+
+//DeleteContext is the same as Storage.Delete, see PutContext
+func (async *AsyncStorage) DeleteContext(ctx context.Context, lumpid lump.LumpId) (updated bool, err error) {
+	result := async.submitContext(ctx, func(store *Storage) AsyncResult {
+		updated, err := store.Delete(lumpid)
+		return AsyncResult{Updated: updated, Err: err}
+	}, true)
+	return result.Updated, result.Err
+}
+
+//StatContext is the same as Storage.Stat, see PutContext
+func (async *AsyncStorage) StatContext(ctx context.Context, lumpid lump.LumpId) (LumpStat, error) {
+	//stat is only read if the request is completed by the worker
+	var stat LumpStat
+	result := async.submitContext(ctx, func(store *Storage) AsyncResult {
+		var err error
+		stat, err = store.Stat(lumpid)
+		return AsyncResult{Err: err}
+	}, false)
+	if result.Err != nil {
+		return LumpStat{}, result.Err
+	}
+	return stat, nil
+}
+
+//ListRangeContext is the same as Storage.ListRange, see PutContext
+func (async *AsyncStorage) ListRangeContext(ctx context.Context, start, end lump.LumpId, limit int) ([]lump.LumpId, error) {
+	//ids is only read if the request is completed by the worker
+	var ids []lump.LumpId
+	result := async.submitContext(ctx, func(store *Storage) AsyncResult {
+		ids = store.ListRange(start, end, limit)
+		return AsyncResult{}
+	}, false)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return ids, nil
+}
+
+func (async *AsyncStorage) PutAsync(lumpid lump.LumpId, lumpdata lump.LumpData) *Future {
+	return async.submitWrite(func(store *Storage) AsyncResult {
+		updated, err := store.Put(lumpid, lumpdata)
+		return AsyncResult{Updated: updated, Err: err}
+	})
+}
+
+func (async *AsyncStorage) PutEmbedAsync(lumpid lump.LumpId, data []byte) *Future {
+	return async.submitWrite(func(store *Storage) AsyncResult {
+		updated, err := store.PutEmbed(lumpid, data)
+		return AsyncResult{Updated: updated, Err: err}
+	})
+}
+
+//PutIfAbsentAsync runs PutIfAbsent in the worker, Updated of the result is true if the lump is stored
+func (async *AsyncStorage) PutIfAbsentAsync(lumpid lump.LumpId, lumpdata lump.LumpData) *Future {
+	return async.submitWrite(func(store *Storage) AsyncResult {
+		stored, err := store.PutIfAbsent(lumpid, lumpdata)
+		return AsyncResult{Updated: stored, Err: err}
+	})
+}
+
+//CompareAndSwapAsync runs CompareAndSwap in the worker, Updated of the result is true if the lump is swapped
+func (async *AsyncStorage) CompareAndSwapAsync(lumpid lump.LumpId, expectedCRC uint32, lumpdata lump.LumpData) *Future {
+	return async.submitWrite(func(store *Storage) AsyncResult {
+		swapped, err := store.CompareAndSwap(lumpid, expectedCRC, lumpdata)
+		return AsyncResult{Updated: swapped, Err: err}
+	})
+}
+
+//GetAsync is the same as Storage.Get, the lump data is read by a reader, see ASYNC_READERS
+func (async *AsyncStorage) GetAsync(lumpid lump.LumpId) *Future {
+	return async.submit(getRequest(lumpid))
+}
+
+func (async *AsyncStorage) DeleteAsync(lumpid lump.LumpId) *Future {
+	return async.submitWrite(func(store *Storage) AsyncResult {
+		updated, err := store.Delete(lumpid)
+		return AsyncResult{Updated: updated, Err: err}
+	})
+}
+
+/*
+Close stops accepting the requests, they fail with DeviceTerminated, runs the requests still in
+the queue, and closes the storage, see Storage.Close. It returns the error of Storage.Close.
+*/
+func (async *AsyncStorage) Close() error {
+	async.mutex.Lock()
+	if async.closed {
+		async.mutex.Unlock()
+		return nil
+	}
+	async.closed = true
+	async.mutex.Unlock()
+
+	close(async.stop)
+	<-async.finished
+	async.store.owner.Store((*AsyncStorage)(nil))
+	atomic.StoreInt32(&async.store.owned, 0)
+	return async.store.Close()
+}
@@ -0,0 +1,514 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+func TestAsyncStorageWork(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+
+	async, err := NewAsyncStorage(storage, 16)
+	assert.Nil(t, err)
+
+	put := async.PutAsync(lumpid("00"), zeroedData(1000))
+	embed := async.PutEmbedAsync(lumpid("11"), []byte("hello"))
+	get := async.GetAsync(lumpid("11"))
+
+	assert.Nil(t, put.Wait().Err)
+	assert.Nil(t, embed.Wait().Err)
+	<-get.Done()
+	assert.Nil(t, get.Wait().Err)
+	assert.Equal(t, []byte("hello"), get.Wait().Data)
+
+	result := async.DeleteAsync(lumpid("00")).Wait()
+	assert.Nil(t, result.Err)
+	assert.True(t, result.Updated)
+
+	result = async.GetAsync(lumpid("00")).Wait()
+	assert.Error(t, result.Err)
+
+	async.Close()
+	result = async.GetAsync(lumpid("11")).Wait()
+	assert.Equal(t, internalerror.DeviceTerminated, result.Err)
+}
+
+func TestAsyncStoragePutIfAbsent(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp15.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp15.lusf")
+
+	async, err := NewAsyncStorage(storage, 16)
+	assert.Nil(t, err)
+	defer async.Close()
+
+	futures := make([]*Future, 8)
+	for i := range futures {
+		futures[i] = async.PutIfAbsentAsync(lumpid("00"), zeroedData(100))
+	}
+	stored := 0
+	for _, f := range futures {
+		result := f.Wait()
+		assert.Nil(t, result.Err)
+		if result.Updated {
+			stored++
+		}
+	}
+	assert.Equal(t, 1, stored)
+}
+
+func TestAsyncStorageGroupCommit(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp17.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp17.lusf")
+
+	_, err = NewAsyncStorageWithGroupCommit(storage, 16, GroupCommitOptions{Window: 0, MaxRecords: 4})
+	assert.Error(t, err)
+
+	async, err := NewAsyncStorageWithGroupCommit(storage, 16, GroupCommitOptions{Window: time.Hour, MaxRecords: 4})
+	assert.Nil(t, err)
+
+	futures := make([]*Future, 0, 4)
+	for i := 0; i < 3; i++ {
+		futures = append(futures, async.PutAsync(lumpidnum(i), zeroedData(100)))
+	}
+	//reads are not delayed
+	assert.Nil(t, async.GetAsync(lumpidnum(0)).Wait().Err)
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+			t.Fatal("write is completed before the group commit")
+		default:
+		}
+	}
+
+	//the 4th write commits all of them
+	futures = append(futures, async.PutAsync(lumpidnum(3), zeroedData(100)))
+	for _, f := range futures {
+		assert.Nil(t, f.Wait().Err)
+	}
+
+	//the pending writes are committed on close
+	last := async.DeleteAsync(lumpidnum(0))
+	async.Close()
+	assert.True(t, last.Wait().Updated)
+}
+
+func TestAsyncStorageGroupCommitWindow(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp18.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp18.lusf")
+
+	async, err := NewAsyncStorageWithGroupCommit(storage, 16, GroupCommitOptions{Window: time.Millisecond, MaxRecords: 64})
+	assert.Nil(t, err)
+	defer async.Close()
+
+	select {
+	case <-async.PutAsync(lumpid("00"), zeroedData(100)).Done():
+	case <-time.After(time.Second):
+		t.Fatal("write is not committed after the window")
+	}
+}
+
+func TestAsyncStorageContext(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp37.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp37.lusf")
+
+	async, err := NewAsyncStorage(storage, 1)
+	assert.Nil(t, err)
+	//block the worker
+	started := make(chan struct{})
+	block := make(chan struct{})
+	blocked := async.submit(func(store *Storage) AsyncResult {
+		close(started)
+		<-block
+		return AsyncResult{}
+	})
+	<-started
+
+	//queued, but not run before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = async.PutContext(ctx, lumpid("01"), zeroedData(100))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	//the queue is full
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = async.PutContext(ctx, lumpid("02"), zeroedData(100))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = async.GetContext(canceled, lumpid("01"))
+	assert.Equal(t, context.Canceled, err)
+
+	close(block)
+	blocked.Wait()
+	//the expired put is skipped
+	_, err = async.GetContext(context.Background(), lumpid("01"))
+	assert.Error(t, err)
+
+	updated, err := async.PutContext(context.Background(), lumpid("03"), zeroedData(100))
+	assert.Nil(t, err)
+	assert.False(t, updated)
+	data, err := async.GetContext(context.Background(), lumpid("03"))
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(data))
+	updated, err = async.DeleteContext(context.Background(), lumpid("03"))
+	assert.Nil(t, err)
+	assert.True(t, updated)
+
+	async.Close()
+	_, err = async.GetContext(context.Background(), lumpid("03"))
+	assert.Equal(t, internalerror.DeviceTerminated, err)
+}
+
+func TestAsyncStoragePriority(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp52.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp52.lusf")
+
+	assert.Equal(t, PRIORITY_HIGH, PriorityOf(context.Background()))
+	batch := WithPriority(context.Background(), PRIORITY_BATCH)
+	assert.Equal(t, PRIORITY_BATCH, PriorityOf(batch))
+
+	async, err := NewAsyncStorage(storage, 64)
+	assert.Nil(t, err)
+	started := make(chan struct{})
+	block := make(chan struct{})
+	blocked := async.submit(func(store *Storage) AsyncResult {
+		close(started)
+		<-block
+		return AsyncResult{}
+	})
+	<-started
+
+	//the worker is the only writer of order
+	var order []int
+	record := func(n int) func(store *Storage) AsyncResult {
+		return func(store *Storage) AsyncResult {
+			order = append(order, n)
+			return AsyncResult{}
+		}
+	}
+	var futures []*Future
+	futures = append(futures, async.submitRequest(record(-1), false, PRIORITY_BATCH))
+	for i := 0; i < PRIORITY_HIGH_BURST+2; i++ {
+		futures = append(futures, async.submitRequest(record(i), false, PRIORITY_HIGH))
+	}
+	close(block)
+	blocked.Wait()
+	for _, f := range futures {
+		f.Wait()
+	}
+	//the queued high priority requests run before the batch request
+	assert.Equal(t, PRIORITY_HIGH_BURST+3, len(order))
+	for i, n := range order {
+		if n == -1 {
+			assert.True(t, i >= PRIORITY_HIGH_BURST)
+		}
+	}
+
+	_, err = async.PutContext(batch, lumpid("01"), zeroedData(100))
+	assert.Nil(t, err)
+	data, err := async.GetContext(batch, lumpid("01"))
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(data))
+	async.Close()
+}
+
+func TestAsyncStorageCloseDrain(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp58.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp58.lusf")
+
+	async, err := NewAsyncStorage(storage, 64)
+	assert.Nil(t, err)
+	started := make(chan struct{})
+	block := make(chan struct{})
+	async.submit(func(store *Storage) AsyncResult {
+		close(started)
+		<-block
+		return AsyncResult{}
+	})
+	<-started
+
+	var futures []*Future
+	for i := 0; i < 8; i++ {
+		futures = append(futures, async.PutAsync(lumpidnum(i), zeroedData(100)))
+	}
+	futures = append(futures, async.submitRequest(func(store *Storage) AsyncResult {
+		_, err := store.Delete(lumpidnum(0))
+		return AsyncResult{Err: err}
+	}, true, PRIORITY_BATCH))
+	closed := make(chan error)
+	go func() {
+		closed <- async.Close()
+	}()
+	//the requests are rejected after Close
+	for {
+		async.mutex.RLock()
+		closing := async.closed
+		async.mutex.RUnlock()
+		if closing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, internalerror.DeviceTerminated, async.GetAsync(lumpidnum(1)).Wait().Err)
+
+	//the queued requests are drained before the storage is closed
+	close(block)
+	assert.Nil(t, <-closed)
+	for _, f := range futures {
+		assert.Nil(t, f.Wait().Err)
+	}
+
+	storage, err = OpenCannylsStorage("tmp58.lusf")
+	assert.Nil(t, err)
+	defer storage.Close()
+	assert.Equal(t, []lump.LumpId{lumpidnum(1), lumpidnum(2), lumpidnum(3), lumpidnum(4),
+		lumpidnum(5), lumpidnum(6), lumpidnum(7)}, storage.List())
+}
+
+func TestAsyncStorageReadDuringGC(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp63.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp63.lusf")
+	async, err := NewAsyncStorage(storage, 64)
+	assert.Nil(t, err)
+	defer async.Close()
+	_, err = async.PutContext(context.Background(), lumpidnum(1000), zeroedData(100))
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			data, err := async.GetContext(context.Background(), lumpidnum(1000))
+			if !assert.Nil(t, err) || !assert.Equal(t, 100, len(data)) {
+				return
+			}
+		}
+	}()
+	//the journal is collected again and again, the reads are served by the yield of the gc
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, async.PutEmbedAsync(lumpidnum(i%50), []byte{byte(i)}).Wait().Err)
+	}
+	<-done
+	for i := 0; i < 50; i++ {
+		data, err := async.GetContext(context.Background(), lumpidnum(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{byte(1950 + i)}, data)
+	}
+}
+
+func TestAsyncStorageOwnership(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp64.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp64.lusf")
+	async, err := NewAsyncStorage(storage, 16)
+	assert.Nil(t, err)
+	_, err = NewAsyncStorageWithGroupCommit(storage, 16, GroupCommitOptions{Window: time.Millisecond, MaxRecords: 4})
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+
+	//the storage is only called by the worker
+	_, err = storage.Put(lumpidnum(1), zeroedData(100))
+	assert.True(t, internalerror.Is(err, internalerror.DeviceBusy))
+	result := async.Do(context.Background(), true, func(store *Storage) AsyncResult {
+		updated, err := store.Put(lumpidnum(1), zeroedData(100))
+		return AsyncResult{Updated: updated, Err: err}
+	})
+	assert.Nil(t, result.Err)
+	var ids []lump.LumpId
+	result = async.Do(context.Background(), false, func(store *Storage) AsyncResult {
+		ids = store.List()
+		_, err := store.Get(lumpidnum(1))
+		return AsyncResult{Err: err}
+	})
+	assert.Nil(t, result.Err)
+	assert.Equal(t, []lump.LumpId{lumpidnum(1)}, ids)
+
+	assert.Nil(t, async.Close())
+	_, err = storage.Put(lumpidnum(2), zeroedData(100))
+	assert.True(t, internalerror.Is(err, internalerror.DeviceTerminated))
+}
+
+func TestAsyncStorageOwnedEntryPoints(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp72.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp72.lusf")
+	_, err = storage.Put(lumpidnum(1), zeroedData(100))
+	assert.Nil(t, err)
+	async, err := NewAsyncStorage(storage, 16)
+	assert.Nil(t, err)
+
+	id := lumpidnum(1)
+	calls := map[string]func() error{
+		"Stat":           func() error { _, err := storage.Stat(id); return err },
+		"GetReader":      func() error { _, err := storage.GetReader(id); return err },
+		"GetMulti":       func() error { _, err := storage.GetMulti([]lump.LumpId{id}); return err },
+		"Prefetch":       func() error { return storage.Prefetch([]lump.LumpId{id}) },
+		"CreateSnapshot": func() error { return storage.CreateSnapshot(ioutil.Discard) },
+		"GetMetadata":    func() error { _, err := storage.GetMetadata(id); return err },
+		"GetTag":         func() error { _, err := storage.GetTag(id); return err },
+		"Iterator":       func() error { _, err := storage.Iterator(); return err },
+		"Begin":          func() error { _, err := storage.Begin(); return err },
+		"ScrubOnce":      func() error { _, _, err := storage.ScrubOnce(1); return err },
+		"JournalGC":      storage.JournalGC,
+		"JournalSync":    storage.JournalSync,
+		"JournalCursor":  func() error { _, err := storage.JournalCursor(); return err },
+		"SetDedup":       func() error { return storage.SetDedup(true) },
+		"SetBandwidth":   func() error { return storage.SetBackgroundBandwidth(1024) },
+		"Sync":           func() error { return storage.Sync() },
+		"SyncAsync":      func() error { return <-storage.SyncAsync() },
+		"RunSideJobOnce": storage.RunSideJobOnce,
+		"Put":            func() error { _, err := storage.Put(id, zeroedData(100)); return err },
+		"Delete":         func() error { _, err := storage.Delete(id); return err },
+	}
+	for name, call := range calls {
+		assert.True(t, internalerror.Is(call(), internalerror.DeviceBusy), name)
+	}
+	assert.True(t, internalerror.Is(storage.Close(), internalerror.DeviceBusy))
+	//the getters are submitted to the worker
+	assert.Equal(t, []lump.LumpId{id}, storage.List())
+	assert.Equal(t, []lump.LumpId{id}, storage.ListRange(lumpidnum(0), lumpidnum(10), 10))
+	assert.Equal(t, uint64(1), storage.Usage().FileCounts)
+
+	//the worker still owns a working storage
+	data, err := async.GetContext(context.Background(), id)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(data))
+
+	assert.Nil(t, async.Close())
+	for name, call := range calls {
+		assert.True(t, internalerror.Is(call(), internalerror.DeviceTerminated), name)
+	}
+	assert.Nil(t, storage.List())
+	assert.Equal(t, StorageUsage{}, storage.Usage())
+	_, err = NewAsyncStorage(storage, 16)
+	assert.True(t, internalerror.Is(err, internalerror.DeviceTerminated))
+}
+
+//gatedNVM blocks the reads while the gate is open, it tells the reads which are blocked
+type gatedNVM struct {
+	nvm.NonVolatileMemory
+	gate *readGate
+}
+
+type readGate struct {
+	open    int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (gated *gatedNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	if atomic.LoadInt32(&gated.gate.open) == 1 {
+		gated.gate.entered <- struct{}{}
+		<-gated.gate.release
+	}
+	return gated.NonVolatileMemory.ReadAt(buf, offset)
+}
+
+func (gated *gatedNVM) Split(position uint64) (nvm.NonVolatileMemory, nvm.NonVolatileMemory, error) {
+	left, right, err := gated.NonVolatileMemory.Split(position)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &gatedNVM{left, gated.gate}, &gatedNVM{right, gated.gate}, nil
+}
+
+func TestAsyncStorageReaders(t *testing.T) {
+	memory, err := nvm.New(4 * 1024 * 1024)
+	assert.Nil(t, err)
+	gate := &readGate{entered: make(chan struct{}, ASYNC_READERS), release: make(chan struct{})}
+	storage, err := CreateCannylsStorageOnNVM(&gatedNVM{memory, gate}, 0.1)
+	assert.Nil(t, err)
+	for i := 0; i < ASYNC_READERS; i++ {
+		_, err = storage.Put(lumpidnum(i), filledData(10000, byte('a'+i)))
+		assert.Nil(t, err)
+	}
+	async, err := NewAsyncStorage(storage, 16)
+	assert.Nil(t, err)
+
+	//all the readers wait for the disk at the same time
+	atomic.StoreInt32(&gate.open, 1)
+	var gets []*Future
+	for i := 0; i < ASYNC_READERS; i++ {
+		gets = append(gets, async.GetAsync(lumpidnum(i)))
+	}
+	for i := 0; i < ASYNC_READERS; i++ {
+		select {
+		case <-gate.entered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d reads are in flight", i)
+		}
+	}
+
+	//the write waits for the reads, which get the old data
+	put := async.PutAsync(lumpidnum(0), filledData(10000, 'z'))
+	select {
+	case <-put.Done():
+		t.Fatal("the write runs with the reads")
+	case <-time.After(50 * time.Millisecond):
+	}
+	atomic.StoreInt32(&gate.open, 0)
+	close(gate.release)
+	for i, get := range gets {
+		result := get.Wait()
+		assert.Nil(t, result.Err)
+		assert.Equal(t, filledData(10000, byte('a'+i)).AsBytes(), result.Data)
+	}
+	assert.Nil(t, put.Wait().Err)
+	data, err := async.GetContext(context.Background(), lumpidnum(0))
+	assert.Nil(t, err)
+	assert.Equal(t, filledData(10000, 'z').AsBytes(), data)
+	assert.Nil(t, async.Close())
+}
+
+func TestAsyncStorageGetReader(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp91.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp91.lusf")
+	async, err := NewAsyncStorage(storage, 16)
+	assert.Nil(t, err)
+	defer async.Close()
+	old := thumbnailData(10000, 1)
+	_, err = async.PutContext(context.Background(), lumpidnum(1), old)
+	assert.Nil(t, err)
+	free := storage.Usage().FreeBytes
+
+	//the reader reads the old data after the lump is overwritten and deleted
+	reader, stat, err := async.GetReaderContext(context.Background(), lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(10000), stat.Size)
+	_, err = async.PutContext(context.Background(), lumpidnum(1), thumbnailData(10000, 2))
+	assert.Nil(t, err)
+	_, err = async.DeleteContext(context.Background(), lumpidnum(1))
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, old.AsBytes(), data)
+
+	//the old data is freed by Close
+	assert.True(t, storage.Usage().FreeBytes < free+uint64(stat.SizeOnDisk))
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, free+uint64(stat.SizeOnDisk), storage.Usage().FreeBytes)
+	_, err = reader.Read(make([]byte, 1))
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+	_, _, err = async.GetReaderContext(context.Background(), lumpidnum(1))
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+}
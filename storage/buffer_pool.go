@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+const (
+	//the capacity of the buffers in the pool i is POOLED_BUFFER_MIN_SIZE << i
+	POOLED_BUFFER_MIN_SIZE = 4096
+	POOLED_BUFFER_CLASSES  = 14
+)
+
+//bufferPools keeps the aligned buffers of GetPooled, a buffer is put into the pool of the biggest class it could hold
+var bufferPools [POOLED_BUFFER_CLASSES]sync.Pool
+
+/*
+PooledBuffer is the lump data returned by GetPooled, the aligned buffer is reused by the
+later GetPooled after it is released. It starts with one reference, Retain adds one and
+Release drops one, the buffer must not be used after the last Release.
+*/
+type PooledBuffer struct {
+	ab   *block.AlignedBytes
+	size uint32
+	refs int32
+}
+
+//bufferClass returns the smallest class whose buffers could hold capacity bytes,
+//it is POOLED_BUFFER_CLASSES if the buffer is too big to be pooled
+func bufferClass(capacity uint64) int {
+	if capacity <= POOLED_BUFFER_MIN_SIZE {
+		return 0
+	}
+	return bits.Len64((capacity - 1) / POOLED_BUFFER_MIN_SIZE)
+}
+
+//newPooledBuffer returns a buffer of capacity bytes, the capacity is aligned to the block size
+func newPooledBuffer(capacity uint32, blockSize block.BlockSize) *PooledBuffer {
+	class := bufferClass(uint64(capacity))
+	if class < POOLED_BUFFER_CLASSES {
+		if ab, ok := bufferPools[class].Get().(*block.AlignedBytes); ok && ab.BlockSize() == blockSize {
+			ab.Resize(capacity)
+			return &PooledBuffer{ab: ab, size: capacity, refs: 1}
+		}
+		//allocate the whole class, so the buffer could be reused by any lump of the class
+		ab := block.NewAlignedBytes(POOLED_BUFFER_MIN_SIZE<<uint(class), blockSize)
+		ab.Resize(capacity)
+		return &PooledBuffer{ab: ab, size: capacity, refs: 1}
+	}
+	return &PooledBuffer{ab: block.NewAlignedBytes(int(capacity), blockSize), size: capacity, refs: 1}
+}
+
+//AsBytes returns the lump data, it is valid until the last Release
+func (buf *PooledBuffer) AsBytes() []byte {
+	return buf.ab.AsBytes()[:buf.size]
+}
+
+func (buf *PooledBuffer) Len() uint32 {
+	return buf.size
+}
+
+//LumpData wraps the buffer without copy, it is valid until the last Release
+func (buf *PooledBuffer) LumpData() lump.LumpData {
+	ab := *buf.ab
+	ab.Truncate(buf.size)
+	return lump.NewLumpDataWithAb(&ab)
+}
+
+//Retain adds a reference, the buffer is shared until every reference is released
+func (buf *PooledBuffer) Retain() {
+	if atomic.AddInt32(&buf.refs, 1) <= 1 {
+		panic("retain a released PooledBuffer")
+	}
+}
+
+//Release drops a reference, the buffer goes back to the pool when the last one is dropped
+func (buf *PooledBuffer) Release() {
+	refs := atomic.AddInt32(&buf.refs, -1)
+	if refs < 0 {
+		panic("release a released PooledBuffer")
+	}
+	if refs > 0 {
+		return
+	}
+	ab := buf.ab
+	buf.ab = nil
+	class := bufferClass(ab.Capacity())
+	//only a full buffer of its class is pooled, a smaller one could not hold every lump of the class
+	if class < POOLED_BUFFER_CLASSES && ab.Capacity() == POOLED_BUFFER_MIN_SIZE<<uint(class) {
+		bufferPools[class].Put(ab)
+	}
+}
@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+type CachePolicy int
+
+const (
+	//CACHE_LRU evicts the least recently used lump
+	CACHE_LRU CachePolicy = iota
+	//CACHE_ARC is the adaptive replacement cache, a scan of cold lumps does not flush the hot ones
+	CACHE_ARC
+)
+
+func (policy CachePolicy) String() string {
+	switch policy {
+	case CACHE_LRU:
+		return "lru"
+	case CACHE_ARC:
+		return "arc"
+	default:
+		return fmt.Sprintf("unknown cache policy %d", int(policy))
+	}
+}
+
+func (policy CachePolicy) validate() error {
+	if policy != CACHE_LRU && policy != CACHE_ARC {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid cache policy %d", int(policy))
+	}
+	return nil
+}
+
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   uint64 `json:"entries"`
+	//the bytes of the cached lump data
+	Bytes    uint64 `json:"bytes"`
+	Capacity uint64 `json:"capacity"`
+}
+
+type cacheEntry struct {
+	key uint64
+	//the entry is stale if the version is changed, such as the length of the portion
+	version uint64
+	data    []byte
+	//the size of data, it is kept after a ghost entry drops data
+	size uint64
+	//the list of cachePolicy which holds the entry
+	owner *list.List
+}
+
+//cachePolicy keeps the entries in at most capacity bytes
+type cachePolicy interface {
+	get(key uint64) *cacheEntry
+	//add returns the number of evicted entries
+	add(entry *cacheEntry) int
+	remove(key uint64)
+	size() (entries uint64, bytes uint64)
+}
+
+/*
+readCache keeps the lump data in memory, such as the data portions keyed by their start and
+versioned by their length. The entry is removed when the lump is released, and its version
+is checked on get, so a stale entry is never returned. It is safe for concurrent use,
+because the Gets of DataRegion run in parallel.
+*/
+type readCache struct {
+	mutex     sync.Mutex
+	policy    cachePolicy
+	capacity  uint64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newReadCache(capacity uint64, policy CachePolicy) *readCache {
+	cache := &readCache{capacity: capacity}
+	switch policy {
+	case CACHE_ARC:
+		cache.policy = newArcCache(capacity)
+	default:
+		cache.policy = newLruCache(capacity)
+	}
+	return cache
+}
+
+//get returns the cached lump data, it must not be modified
+func (cache *readCache) get(key uint64, version uint64) ([]byte, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := cache.policy.get(key)
+	if entry == nil || entry.version != version {
+		cache.misses++
+		return nil, false
+	}
+	cache.hits++
+	return entry.data, true
+}
+
+func (cache *readCache) add(key uint64, version uint64, data []byte) {
+	if uint64(len(data)) > cache.capacity {
+		return
+	}
+	entry := &cacheEntry{
+		key:     key,
+		version: version,
+		data:    data,
+		size:    uint64(len(data)),
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.evictions += uint64(cache.policy.add(entry))
+}
+
+func (cache *readCache) remove(key uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.policy.remove(key)
+}
+
+func (cache *readCache) stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entries, bytes := cache.policy.size()
+	return CacheStats{
+		Hits:      cache.hits,
+		Misses:    cache.misses,
+		Evictions: cache.evictions,
+		Entries:   entries,
+		Bytes:     bytes,
+		Capacity:  cache.capacity,
+	}
+}
+
+//entryList is a list of entries with the total bytes of their data
+type entryList struct {
+	*list.List
+	bytes uint64
+}
+
+func newEntryList() *entryList {
+	return &entryList{List: list.New()}
+}
+
+func (l *entryList) pushFront(entry *cacheEntry) *list.Element {
+	entry.owner = l.List
+	l.bytes += entry.size
+	return l.PushFront(entry)
+}
+
+func (l *entryList) remove(elem *list.Element) *cacheEntry {
+	entry := l.List.Remove(elem).(*cacheEntry)
+	l.bytes -= entry.size
+	return entry
+}
+
+type lruCache struct {
+	capacity uint64
+	entries  map[uint64]*list.Element
+	lru      *entryList
+}
+
+func newLruCache(capacity uint64) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		entries:  make(map[uint64]*list.Element),
+		lru:      newEntryList(),
+	}
+}
+
+func (cache *lruCache) get(key uint64) *cacheEntry {
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	cache.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+func (cache *lruCache) add(entry *cacheEntry) (evicted int) {
+	cache.remove(entry.key)
+	cache.entries[entry.key] = cache.lru.pushFront(entry)
+	for cache.lru.bytes > cache.capacity {
+		oldest := cache.lru.remove(cache.lru.Back())
+		delete(cache.entries, oldest.key)
+		evicted++
+	}
+	return evicted
+}
+
+func (cache *lruCache) remove(key uint64) {
+	if elem, ok := cache.entries[key]; ok {
+		cache.lru.remove(elem)
+		delete(cache.entries, key)
+	}
+}
+
+func (cache *lruCache) size() (uint64, uint64) {
+	return uint64(len(cache.entries)), cache.lru.bytes
+}
+
+/*
+arcCache is the adaptive replacement cache weighted by bytes. t1 holds the entries used once
+and t2 holds the entries used more than once, b1 and b2 are the ghosts evicted from them, which
+only keep the size of the data. A hit in b1 grows target, the bytes kept for t1, and a hit in
+b2 shrinks it, so the cache adapts between recency and frequency.
+*/
+type arcCache struct {
+	capacity uint64
+	target   uint64
+	entries  map[uint64]*list.Element
+	t1, t2   *entryList
+	b1, b2   *entryList
+}
+
+func newArcCache(capacity uint64) *arcCache {
+	return &arcCache{
+		capacity: capacity,
+		entries:  make(map[uint64]*list.Element),
+		t1:       newEntryList(),
+		t2:       newEntryList(),
+		b1:       newEntryList(),
+		b2:       newEntryList(),
+	}
+}
+
+func (cache *arcCache) listOf(entry *cacheEntry) *entryList {
+	for _, l := range []*entryList{cache.t1, cache.t2, cache.b1, cache.b2} {
+		if entry.owner == l.List {
+			return l
+		}
+	}
+	panic("never here")
+}
+
+func (cache *arcCache) isGhost(l *entryList) bool {
+	return l == cache.b1 || l == cache.b2
+}
+
+func (cache *arcCache) get(key uint64) *cacheEntry {
+	elem, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	l := cache.listOf(entry)
+	if cache.isGhost(l) {
+		return nil
+	}
+	l.remove(elem)
+	cache.entries[key] = cache.t2.pushFront(entry)
+	return entry
+}
+
+func (cache *arcCache) add(entry *cacheEntry) (evicted int) {
+	size := entry.size
+	target := cache.t1
+	if elem, ok := cache.entries[entry.key]; ok {
+		old := elem.Value.(*cacheEntry)
+		switch cache.listOf(old) {
+		case cache.b1:
+			cache.target = minU64(cache.capacity, cache.target+cache.delta(size, cache.b2.bytes, cache.b1.bytes))
+			target = cache.t2
+		case cache.b2:
+			delta := cache.delta(size, cache.b1.bytes, cache.b2.bytes)
+			if delta > cache.target {
+				delta = cache.target
+			}
+			cache.target -= delta
+			target = cache.t2
+		}
+		cache.remove(entry.key)
+	}
+	cache.entries[entry.key] = target.pushFront(entry)
+	for cache.t1.bytes+cache.t2.bytes > cache.capacity {
+		cache.replace()
+		evicted++
+	}
+	cache.trimGhosts()
+	return evicted
+}
+
+//delta is the size scaled by the ratio of the other ghost list to the hit one
+func (cache *arcCache) delta(size uint64, other uint64, hit uint64) uint64 {
+	if hit == 0 || other <= hit {
+		return size
+	}
+	return size * (other / hit)
+}
+
+//replace evicts the least recently used entry of t1 or t2 into its ghost list
+func (cache *arcCache) replace() {
+	from, ghost := cache.t2, cache.b2
+	if cache.t1.Len() > 0 && (cache.t1.bytes > cache.target || cache.t2.Len() == 0) {
+		from, ghost = cache.t1, cache.b1
+	}
+	entry := from.remove(from.Back())
+	entry.data = nil
+	cache.entries[entry.key] = ghost.pushFront(entry)
+}
+
+//trimGhosts keeps every ghost list in capacity bytes
+func (cache *arcCache) trimGhosts() {
+	for _, ghost := range []*entryList{cache.b1, cache.b2} {
+		for ghost.bytes > cache.capacity {
+			oldest := ghost.remove(ghost.Back())
+			delete(cache.entries, oldest.key)
+		}
+	}
+}
+
+func (cache *arcCache) remove(key uint64) {
+	if elem, ok := cache.entries[key]; ok {
+		cache.listOf(elem.Value.(*cacheEntry)).remove(elem)
+		delete(cache.entries, key)
+	}
+}
+
+func (cache *arcCache) size() (uint64, uint64) {
+	return uint64(cache.t1.Len() + cache.t2.Len()), cache.t1.bytes + cache.t2.bytes
+}
+
+func minU64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
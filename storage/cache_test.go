@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/storage/allocator"
+)
+
+func TestLruCache(t *testing.T) {
+	cache := newReadCache(300, CACHE_LRU)
+	for i := uint64(0); i < 3; i++ {
+		cache.add(i, 1, make([]byte, 100))
+	}
+	_, ok := cache.get(0, 1)
+	assert.True(t, ok)
+	//1 is the least recently used one
+	cache.add(3, 1, make([]byte, 100))
+	_, ok = cache.get(1, 1)
+	assert.False(t, ok)
+	_, ok = cache.get(0, 1)
+	assert.True(t, ok)
+
+	//the length of the portion is checked
+	_, ok = cache.get(0, 2)
+	assert.False(t, ok)
+
+	//too large to cache
+	cache.add(4, 1, make([]byte, 400))
+	_, ok = cache.get(4, 1)
+	assert.False(t, ok)
+
+	cache.remove(0)
+	stats := cache.stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(3), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(2), stats.Entries)
+	assert.Equal(t, uint64(200), stats.Bytes)
+}
+
+func TestArcCache(t *testing.T) {
+	cache := newReadCache(400, CACHE_ARC)
+	//0 and 1 are hot
+	for i := uint64(0); i < 2; i++ {
+		cache.add(i, 1, make([]byte, 100))
+		_, ok := cache.get(i, 1)
+		assert.True(t, ok)
+	}
+	//a scan of cold lumps
+	for i := uint64(100); i < 110; i++ {
+		cache.add(i, 1, make([]byte, 100))
+	}
+	for i := uint64(0); i < 2; i++ {
+		_, ok := cache.get(i, 1)
+		assert.True(t, ok)
+	}
+	stats := cache.stats()
+	assert.True(t, stats.Bytes <= 400)
+	assert.Equal(t, uint64(4), stats.Entries)
+
+	//a ghost is not a hit, it goes to t2 when it is added again
+	_, ok := cache.get(100, 1)
+	assert.False(t, ok)
+	cache.add(100, 1, make([]byte, 100))
+	_, ok = cache.get(100, 1)
+	assert.True(t, ok)
+	assert.True(t, cache.stats().Bytes <= 400)
+
+	cache.remove(100)
+	_, ok = cache.get(100, 1)
+	assert.False(t, ok)
+}
+
+func TestDataRegionCache(t *testing.T) {
+	var capacity_bytes uint32 = 1024 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	nvm, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	region := NewDataRegion(alloc, nvm)
+	err = region.SetCache(1024, CachePolicy(100))
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+	assert.Nil(t, region.SetCache(64*1024, CACHE_ARC))
+
+	put_lump_data := lump.NewLumpDataAligned(3, block.Min())
+	copy(put_lump_data.AsBytes(), []byte("foo"))
+	p, err := region.Put(put_lump_data)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		get_lump_data, err := region.Get(p)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("foo"), get_lump_data.AsBytes())
+		//modifying the returned data does not change the cache
+		get_lump_data.AsBytes()[0] = 'x'
+	}
+	reader, err := region.GetReader(p)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), data)
+	stats := region.CacheStats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Entries)
+
+	//the released portion is reused by another lump
+	region.Release(p)
+	assert.Equal(t, uint64(0), region.CacheStats().Entries)
+	put_lump_data = lump.NewLumpDataAligned(3, block.Min())
+	copy(put_lump_data.AsBytes(), []byte("bar"))
+	p2, err := region.Put(put_lump_data)
+	assert.Nil(t, err)
+	assert.Equal(t, p, p2)
+	get_lump_data, err := region.Get(p2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), get_lump_data.AsBytes())
+
+	assert.Nil(t, region.SetCache(0, CACHE_LRU))
+	assert.Equal(t, CacheStats{}, region.CacheStats())
+}
+
+func TestStorageEmbedCache(t *testing.T) {
+	nvm, err := nvm.New(1024 * 1024)
+	assert.Nil(t, err)
+	store, err := CreateCannylsStorageOnNVM(nvm, 0.5)
+	assert.Nil(t, err)
+	err = store.SetEmbedCache(1024, EmbedCachePolicy(100))
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	assert.Nil(t, store.SetEmbedCache(1024, EMBED_CACHE_ON_READ))
+	_, err = store.PutEmbed(lumpidnum(1), []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), store.EmbedCacheStats().Entries)
+	for i := 0; i < 2; i++ {
+		data, err := store.Get(lumpidnum(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("foo"), data)
+		//modifying the returned data does not change the cache
+		data[0] = 'x'
+	}
+	stats := store.EmbedCacheStats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+
+	//overwriting and deleting drop the cached data
+	_, err = store.PutEmbed(lumpidnum(1), []byte("bar"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), store.EmbedCacheStats().Entries)
+	data, err := store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), data)
+	_, err = store.Delete(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), store.EmbedCacheStats().Entries)
+
+	assert.Nil(t, store.SetEmbedCache(1024, EMBED_CACHE_WRITE_THROUGH))
+	buf := []byte("baz")
+	_, err = store.PutEmbedWithMetadata(lumpidnum(2), buf, []byte("meta"))
+	assert.Nil(t, err)
+	buf[0] = 'x'
+	reader, err := store.GetReader(lumpidnum(2))
+	assert.Nil(t, err)
+	data, err = ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("baz"), data)
+	stats = store.EmbedCacheStats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(0), stats.Misses)
+
+	_, err = store.DeleteRange(lumpidnum(0), lumpidnum(10))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), store.EmbedCacheStats().Entries)
+}
@@ -0,0 +1,619 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/allocator"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+/*
+Checkpoint format, all the integers are big endian
+
+| "lckp" | version(2 bytes) | UUID(16 bytes) | data_region_size(8 bytes) |
+| journal position(8 bytes) | journal sequence(4 bytes) |
+| tag(1 byte) | lumpid(8 bytes) | start(8 bytes) | len(2 bytes) | expire_at(8 bytes), hash(32 bytes), metadata_len(4 bytes) or count(2 bytes) | metadata or extents | ...
+| CHECKPOINT_TAG_LUMP_TAG | lumpid(8 bytes) | len(4 bytes) | tag | ...
+| CHECKPOINT_TAG_MARKER | id(8 bytes) | len(4 bytes) | data | ...
+| CHECKPOINT_TAG_FREE | start(8 bytes) | len(8 bytes) | ...
+| CHECKPOINT_TAG_END | count(8 bytes) | crc32c of all the bytes above(4 bytes) |
+
+expire_at is only written for CHECKPOINT_TAG_DATA_WITH_TTL, hash is only written for
+CHECKPOINT_TAG_DATA_WITH_HASH, the content hash of a lump sharing its portion, see SetDedup.
+metadata is only written for the tags with metadata. The extents of CHECKPOINT_TAG_DATA_EXTENTS
+are the start(8 bytes) and the len(2 bytes) of the extents after the first one of a lump stored
+in several portions, count is the number of them, see extent.go. CHECKPOINT_TAG_DATA_EXTENTS_WITH_TTL
+and CHECKPOINT_TAG_DATA_EXTENTS_WITH_METADATA have the count and the extents after the expire_at
+or the metadata.
+The count of CHECKPOINT_TAG_END is the number of the lumps.
+The user tag of a lump follows the lump, it is not counted.
+*/
+
+var (
+	CHECKPOINT_MAGIC = [4]byte{'l', 'c', 'k', 'p'}
+)
+
+const (
+	CHECKPOINT_VERSION uint16 = 1
+	//performance related
+	CHECKPOINT_LUMPS_IN_SIDE_JOB = 4096
+
+	CHECKPOINT_TAG_END                 = 0
+	CHECKPOINT_TAG_DATA                = 1
+	CHECKPOINT_TAG_DATA_WITH_TTL       = 2
+	CHECKPOINT_TAG_DATA_WITH_METADATA  = 3
+	CHECKPOINT_TAG_EMBED               = 4
+	CHECKPOINT_TAG_EMBED_WITH_METADATA = 5
+	CHECKPOINT_TAG_FREE                = 6
+	CHECKPOINT_TAG_MARKER              = 7
+	CHECKPOINT_TAG_LUMP_TAG            = 8
+	CHECKPOINT_TAG_DATA_WITH_HASH      = 9
+	CHECKPOINT_TAG_DATA_EXTENTS        = 10
+	//the lumps in extents with TTL or metadata
+	CHECKPOINT_TAG_DATA_EXTENTS_WITH_TTL      = 11
+	CHECKPOINT_TAG_DATA_EXTENTS_WITH_METADATA = 12
+)
+
+type freeRange struct {
+	start  uint64
+	length uint64
+}
+
+type checkpoint struct {
+	index    *lumpindex.LumpIndex
+	position uint64
+	seq      uint32
+	free     []freeRange
+}
+
+//Recovery returns how the index is restored when the storage is opened
+func (store *Storage) Recovery() Recovery {
+	return store.recovery
+}
+
+/*
+WriteCheckpoint saves the index and the free portions of the allocator into StorageOptions.Checkpoint,
+with the position of the journal after syncing it. When the storage is opened, they are loaded
+from the checkpoint, and only the journal records after the position are replayed.
+The checkpoint is written to a temporary file and renamed, so a crash leaves the old one.
+A checkpoint being written by RunSideJobOnce is dropped, see StorageOptions.CheckpointInterval.
+*/
+func (store *Storage) WriteCheckpoint() (err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	if store.checkpointPath == "" {
+		return errors.Wrap(internalerror.InvalidInput, "checkpoint is not enabled")
+	}
+	store.abortCheckpoint()
+	job, err := store.startCheckpoint()
+	if err != nil {
+		return err
+	}
+	for done := false; !done && err == nil; {
+		done, err = store.writeCheckpointLump(job)
+	}
+	if err == nil {
+		err = store.finishCheckpoint(job)
+	}
+	if err != nil {
+		job.abort()
+	}
+	return err
+}
+
+/*
+checkpointJob is a checkpoint being written. The lumps are walked by an iterator of the index,
+and each of them is written as it is when it is reached, so the lumps changed after the journal
+position could be newer than the position, the records after the position are replayed on them
+when the storage is opened, and give the same index. The lumps deleted before they are reached
+are skipped. The free portions are written at last, they are only used if no record is replayed.
+*/
+type checkpointJob struct {
+	file     *os.File
+	tmpPath  string
+	writer   *bufio.Writer
+	hash     hash.Hash32
+	out      io.Writer
+	written  countingWriter
+	iter     *lumpindex.IndexIterator
+	position uint64
+	seq      uint32
+	count    uint64
+}
+
+type countingWriter uint64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+//startCheckpoint syncs the journal and writes the header of the checkpoint into the temporary file
+func (store *Storage) startCheckpoint() (job *checkpointJob, err error) {
+	//the records before the position must be durable
+	if err = store.journalRegion.SyncChecked(); err != nil {
+		return nil, err
+	}
+	job = &checkpointJob{tmpPath: store.checkpointPath + ".tmp", hash: crc32.New(castagnoliTable)}
+	job.position, job.seq = store.journalRegion.Position()
+	if job.file, err = os.OpenFile(job.tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); err != nil {
+		return nil, errors.Wrap(err, "failed to create checkpoint")
+	}
+	job.writer = bufio.NewWriter(job.file)
+	job.out = io.MultiWriter(job.writer, job.hash, &job.written)
+
+	if err = writeAll(job.out, CHECKPOINT_MAGIC, CHECKPOINT_VERSION, store.storageHeader.UUID.Bytes(),
+		store.storageHeader.DataRegionSize, job.position, job.seq); err != nil {
+		job.abort()
+		return nil, errors.Wrap(err, "failed to write checkpoint")
+	}
+	job.iter = store.index.Iterator()
+	return job, nil
+}
+
+//writeCheckpointLump writes the next lump of the index, done is true if there are no more lumps
+func (store *Storage) writeCheckpointLump(job *checkpointJob) (done bool, err error) {
+	for {
+		id, _, ok := job.iter.Next()
+		if !ok {
+			return true, nil
+		}
+		//the lump is written as it is now, it is skipped if it is deleted after the iterator is created
+		p, err := store.index.Get(id)
+		if err != nil {
+			continue
+		}
+		if err = store.writeCheckpointEntry(job.out, id, p); err != nil {
+			return false, errors.Wrap(err, "failed to write checkpoint")
+		}
+		job.count++
+		return false, nil
+	}
+}
+
+//finishCheckpoint writes the markers, the free portions and the end of the checkpoint, and renames it
+func (store *Storage) finishCheckpoint(job *checkpointJob) (err error) {
+	err = store.writeCheckpointEnd(job)
+	if err == nil {
+		err = job.writer.Flush()
+	}
+	if err == nil {
+		err = job.file.Sync()
+	}
+	closeErr := job.file.Close()
+	job.file = nil
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write checkpoint")
+	}
+	if err = os.Rename(job.tmpPath, store.checkpointPath); err != nil {
+		return errors.Wrap(err, "failed to rename checkpoint")
+	}
+	store.lastCheckpoint = store.clock()
+	return nil
+}
+
+func (store *Storage) writeCheckpointEnd(job *checkpointJob) (err error) {
+	for _, id := range store.index.Markers() {
+		data, _ := store.index.Marker(id)
+		if err = writeAll(job.out, uint8(CHECKPOINT_TAG_MARKER), id, uint32(len(data)), data); err != nil {
+			return err
+		}
+	}
+
+	//the portions pinned by a snapshot are not free yet, without the free portions the allocator
+	//is rebuilt from the index when the checkpoint is loaded
+	if freeList, ok := store.alloc.(allocator.FreeListAllocator); ok && !store.dataRegion.Pinned() {
+		freeList.ForEachFree(func(start uint64, len uint64) {
+			if err == nil {
+				err = writeAll(job.out, uint8(CHECKPOINT_TAG_FREE), start, len)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = writeAll(job.out, uint8(CHECKPOINT_TAG_END), job.count); err != nil {
+		return err
+	}
+	//the checksum itself is not a part of the checksum
+	return binary.Write(job.writer, binary.BigEndian, job.hash.Sum32())
+}
+
+//abort closes the iterator and removes the temporary file, the old checkpoint is kept
+func (job *checkpointJob) abort() {
+	if job.iter != nil {
+		job.iter.Close()
+	}
+	if job.file != nil {
+		job.file.Close()
+		job.file = nil
+	}
+	os.Remove(job.tmpPath)
+}
+
+//abortCheckpoint drops the checkpoint being written by RunSideJobOnce
+func (store *Storage) abortCheckpoint() {
+	if store.checkpointJob != nil {
+		store.checkpointJob.abort()
+		store.checkpointJob = nil
+	}
+}
+
+/*
+runCheckpoint writes the checkpoint of RunSideJobOnce incrementally, at most
+CHECKPOINT_LUMPS_IN_SIDE_JOB lumps each time, its writes are charged to the background bandwidth.
+A new checkpoint is started after CheckpointInterval since the last one is written.
+*/
+func (store *Storage) runCheckpoint() (err error) {
+	job := store.checkpointJob
+	if job == nil {
+		if store.checkpointInterval <= 0 || store.clock().Sub(store.lastCheckpoint) < store.checkpointInterval {
+			return nil
+		}
+		if !store.backgroundReady() {
+			return nil
+		}
+		if job, err = store.startCheckpoint(); err != nil {
+			return err
+		}
+		store.chargeBackground(uint64(job.written))
+		store.checkpointJob = job
+	}
+	defer func() {
+		if err != nil {
+			store.abortCheckpoint()
+		}
+	}()
+	for i := 0; i < CHECKPOINT_LUMPS_IN_SIDE_JOB && store.backgroundReady(); i++ {
+		var done bool
+		written := job.written
+		done, err = store.writeCheckpointLump(job)
+		store.chargeBackground(uint64(job.written - written))
+		if err != nil {
+			return err
+		}
+		if done {
+			written = job.written
+			err = store.finishCheckpoint(job)
+			store.chargeBackground(uint64(job.written - written))
+			if err != nil {
+				return err
+			}
+			job.iter.Close()
+			store.checkpointJob = nil
+			return nil
+		}
+	}
+	return nil
+}
+
+func (store *Storage) writeCheckpointEntry(out io.Writer, id lump.LumpId, p portion.Portion) (err error) {
+	var tag uint8
+	var start uint64
+	var length uint16
+	var extra []interface{}
+	metadata, hasMetadata := store.index.Metadata(id)
+	switch v := p.(type) {
+	case portion.DataPortion:
+		start, length = v.Start.AsU64(), v.Len
+		extents, inExtents := store.index.Extents(id)
+		if expireAt, ok := store.index.ExpireAt(id); ok {
+			tag = CHECKPOINT_TAG_DATA_WITH_TTL
+			if inExtents {
+				tag = CHECKPOINT_TAG_DATA_EXTENTS_WITH_TTL
+			}
+			extra = []interface{}{expireAt}
+		} else if hasMetadata {
+			tag = CHECKPOINT_TAG_DATA_WITH_METADATA
+			if inExtents {
+				tag = CHECKPOINT_TAG_DATA_EXTENTS_WITH_METADATA
+			}
+			extra = []interface{}{uint32(len(metadata)), metadata}
+		} else if hash, ok := store.index.ContentHash(id); ok {
+			tag = CHECKPOINT_TAG_DATA_WITH_HASH
+			extra = []interface{}{hash}
+		} else if inExtents {
+			tag = CHECKPOINT_TAG_DATA_EXTENTS
+		} else {
+			tag = CHECKPOINT_TAG_DATA
+		}
+		if inExtents {
+			extra = append(extra, uint16(len(extents)-1))
+			for _, extent := range extents[1:] {
+				extra = append(extra, extent.Start.AsU64(), extent.Len)
+			}
+		}
+	case portion.JournalPortion:
+		start, length = v.Start.AsU64(), v.Len
+		if hasMetadata {
+			tag = CHECKPOINT_TAG_EMBED_WITH_METADATA
+			extra = []interface{}{uint32(len(metadata)), metadata}
+		} else {
+			tag = CHECKPOINT_TAG_EMBED
+		}
+	default:
+		panic("never here")
+	}
+	if err = writeAll(out, append([]interface{}{tag, id.U64(), start, length}, extra...)...); err != nil {
+		return err
+	}
+	if lumpTag, ok := store.index.Tag(id); ok {
+		return writeAll(out, uint8(CHECKPOINT_TAG_LUMP_TAG), id.U64(), uint32(len(lumpTag)), []byte(lumpTag))
+	}
+	return nil
+}
+
+func writeAll(out io.Writer, values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Write(out, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//readCheckpoint loads the checkpoint of the storage, it fails if the checkpoint is corrupted or of another storage
+func readCheckpoint(path string, header *nvm.StorageHeader, options StorageOptions) (ckpt *checkpoint, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := crc32.New(castagnoliTable)
+	in := io.TeeReader(bufio.NewReader(f), hash)
+
+	var magic [4]byte
+	if _, err = io.ReadFull(in, magic[:]); err != nil {
+		return nil, errors.Wrap(err, "failed to read checkpoint magic")
+	}
+	if magic != CHECKPOINT_MAGIC {
+		return nil, errors.Wrap(internalerror.InvalidInput, "not a checkpoint")
+	}
+	var version uint16
+	var uuid [16]byte
+	var dataRegionSize uint64
+	index, err := options.newIndex()
+	if err != nil {
+		return nil, err
+	}
+	//the index is closed to remove its spill file if the checkpoint is not used
+	defer func() {
+		if err != nil {
+			index.Close()
+		}
+	}()
+	ckpt = &checkpoint{index: index}
+	if err = readAll(in, &version, &uuid, &dataRegionSize, &ckpt.position, &ckpt.seq); err != nil {
+		return nil, err
+	}
+	if version != CHECKPOINT_VERSION {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "unknown checkpoint version %d", version)
+	}
+	if !bytes.Equal(uuid[:], header.UUID.Bytes()) || dataRegionSize != header.DataRegionSize {
+		return nil, errors.Wrap(internalerror.InvalidInput, "checkpoint is of another storage")
+	}
+
+	var restored uint64
+	for {
+		var tag uint8
+		if err = readAll(in, &tag); err != nil {
+			return nil, err
+		}
+		switch tag {
+		case CHECKPOINT_TAG_END:
+			var count uint64
+			if err = readAll(in, &count); err != nil {
+				return nil, err
+			}
+			if count != restored {
+				return nil, errors.Wrapf(internalerror.StorageCorrupted, "checkpoint has %d lumps, but %d are restored", count, restored)
+			}
+			//the checksum itself is not a part of the checksum
+			expected := hash.Sum32()
+			var sum uint32
+			if err = readAll(in, &sum); err != nil {
+				return nil, err
+			}
+			if sum != expected {
+				return nil, errors.Wrap(internalerror.StorageCorrupted, "checkpoint checksum mismatch")
+			}
+			return ckpt, nil
+		case CHECKPOINT_TAG_FREE:
+			var free freeRange
+			if err = readAll(in, &free.start, &free.length); err != nil {
+				return nil, err
+			}
+			ckpt.free = append(ckpt.free, free)
+		case CHECKPOINT_TAG_MARKER:
+			var id uint64
+			var length uint32
+			if err = readAll(in, &id, &length); err != nil {
+				return nil, err
+			}
+			if length > lump.MAX_EMBEDDED_SIZE {
+				return nil, errors.Wrapf(internalerror.StorageCorrupted, "marker %d is too large: %d", id, length)
+			}
+			data := make([]byte, length)
+			if _, err = io.ReadFull(in, data); err != nil {
+				return nil, errors.Wrap(err, "failed to read checkpoint")
+			}
+			ckpt.index.InsertMarker(id, data)
+		case CHECKPOINT_TAG_LUMP_TAG:
+			var id uint64
+			var length uint32
+			if err = readAll(in, &id, &length); err != nil {
+				return nil, err
+			}
+			if length > lump.MAX_TAG_SIZE {
+				return nil, errors.Wrapf(internalerror.StorageCorrupted, "tag of lump %d is too large: %d", id, length)
+			}
+			lumpTag := make([]byte, length)
+			if _, err = io.ReadFull(in, lumpTag); err != nil {
+				return nil, errors.Wrap(err, "failed to read checkpoint")
+			}
+			ckpt.index.SetTag(lump.FromU64(0, id), string(lumpTag))
+		default:
+			if err = readCheckpointLump(in, tag, ckpt.index); err != nil {
+				return nil, err
+			}
+			restored++
+		}
+	}
+}
+
+func readCheckpointLump(in io.Reader, tag uint8, index *lumpindex.LumpIndex) (err error) {
+	var id, start uint64
+	var length uint16
+	if err = readAll(in, &id, &start, &length); err != nil {
+		return err
+	}
+	lumpid := lump.FromU64(0, id)
+	dataPortion := portion.NewDataPortion(start, length)
+	journalPortion := portion.NewJournalPortion(start, length)
+
+	var expireAt uint64
+	var hash lump.ContentHash
+	var metadata []byte
+	var extents []portion.DataPortion
+	switch tag {
+	case CHECKPOINT_TAG_DATA_WITH_TTL, CHECKPOINT_TAG_DATA_EXTENTS_WITH_TTL:
+		err = readAll(in, &expireAt)
+	case CHECKPOINT_TAG_DATA_WITH_HASH:
+		err = readAll(in, &hash)
+	case CHECKPOINT_TAG_DATA_WITH_METADATA, CHECKPOINT_TAG_EMBED_WITH_METADATA, CHECKPOINT_TAG_DATA_EXTENTS_WITH_METADATA:
+		var metadataLen uint32
+		if err = readAll(in, &metadataLen); err != nil {
+			return err
+		}
+		metadata = make([]byte, metadataLen)
+		_, err = io.ReadFull(in, metadata)
+	}
+	if err != nil {
+		return err
+	}
+	switch tag {
+	case CHECKPOINT_TAG_DATA_EXTENTS, CHECKPOINT_TAG_DATA_EXTENTS_WITH_TTL, CHECKPOINT_TAG_DATA_EXTENTS_WITH_METADATA:
+		var count uint16
+		if err = readAll(in, &count); err != nil {
+			return err
+		}
+		if count == 0 || count >= lump.MAX_LUMP_EXTENTS {
+			return errors.Wrapf(internalerror.StorageCorrupted, "lump %d has %d more extents", id, count)
+		}
+		extents = append(make([]portion.DataPortion, 0, count+1), dataPortion)
+		for i := 0; i < int(count) && err == nil; i++ {
+			var extentStart uint64
+			var extentLength uint16
+			err = readAll(in, &extentStart, &extentLength)
+			extents = append(extents, portion.NewDataPortion(extentStart, extentLength))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	switch tag {
+	case CHECKPOINT_TAG_DATA:
+		index.InsertDataPortion(lumpid, dataPortion)
+	case CHECKPOINT_TAG_DATA_WITH_TTL:
+		index.InsertDataPortionWithExpire(lumpid, dataPortion, expireAt)
+	case CHECKPOINT_TAG_DATA_WITH_METADATA:
+		index.InsertDataPortionWithMetadata(lumpid, dataPortion, metadata)
+	case CHECKPOINT_TAG_DATA_WITH_HASH:
+		index.InsertDataPortionWithHash(lumpid, dataPortion, hash)
+	case CHECKPOINT_TAG_DATA_EXTENTS:
+		index.InsertDataExtents(lumpid, extents)
+	case CHECKPOINT_TAG_DATA_EXTENTS_WITH_TTL:
+		index.InsertDataExtentsWithAttributes(lumpid, extents, expireAt, nil)
+	case CHECKPOINT_TAG_DATA_EXTENTS_WITH_METADATA:
+		index.InsertDataExtentsWithAttributes(lumpid, extents, 0, metadata)
+	case CHECKPOINT_TAG_EMBED:
+		index.InsertJournalPortion(lumpid, journalPortion)
+	case CHECKPOINT_TAG_EMBED_WITH_METADATA:
+		index.InsertJournalPortionWithMetadata(lumpid, journalPortion, metadata)
+	default:
+		return errors.Wrapf(internalerror.StorageCorrupted, "unknown checkpoint tag %d", tag)
+	}
+	return nil
+}
+
+func readAll(in io.Reader, values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Read(in, binary.BigEndian, v); err != nil {
+			return errors.Wrap(err, "failed to read checkpoint")
+		}
+	}
+	return nil
+}
+
+//Recovery is how the index is restored when the storage is opened, see Storage.Recovery
+type Recovery struct {
+	//Clean is true if the storage was closed cleanly, see Close
+	Clean bool
+	//Checkpoint is true if the index is loaded from the checkpoint
+	Checkpoint bool
+	//FastPath is true if the journal is not read, because it was closed cleanly after the checkpoint
+	FastPath bool
+	//Replayed is the number of the replayed journal records
+	Replayed int
+	Duration time.Duration
+}
+
+/*
+restoreIndex loads the index from the checkpoint and replays the journal records after it,
+the whole journal is replayed if the checkpoint is missing, corrupted or already released.
+free is the free portions in the checkpoint, it is nil if any record is replayed after it,
+because the free portions are changed by them.
+*/
+func restoreIndex(journalRegion *journal.JournalRegion, header *nvm.StorageHeader,
+	options StorageOptions) (index *lumpindex.LumpIndex, free []freeRange, recovery Recovery, err error) {
+	start := time.Now()
+	defer func() {
+		recovery.Duration = time.Since(start)
+	}()
+	recovery.Clean = journalRegion.Clean()
+	if path := options.Checkpoint; path != "" {
+		ckpt, err := readCheckpoint(path, header, options)
+		if err == nil {
+			fastPath := journalRegion.CleanAt(ckpt.position, ckpt.seq)
+			var replayed int
+			if replayed, err = journalRegion.RestoreIndexSince(ckpt.index, ckpt.position, ckpt.seq); err == nil {
+				fmt.Printf("%d journal records are replayed after the checkpoint\n", replayed)
+				if replayed == 0 {
+					free = ckpt.free
+				}
+				recovery.Checkpoint, recovery.FastPath, recovery.Replayed = true, fastPath, replayed
+				return ckpt.index, free, recovery, nil
+			}
+			ckpt.index.Close()
+		}
+		if !os.IsNotExist(err) {
+			fmt.Printf("checkpoint %s is not used: %v\n", path, err)
+		}
+	}
+	if index, err = options.newIndex(); err != nil {
+		return nil, nil, recovery, err
+	}
+	recovery.Replayed = journalRegion.RestoreIndex(index)
+	return index, nil, recovery, nil
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+func TestStorageCheckpoint(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp27.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp27.lusf")
+	defer os.Remove("tmp27.ckpt")
+	store.Close()
+
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp27.ckpt"
+	store, err = OpenCannylsStorageWithOptions("tmp27.lusf", options)
+	assert.Nil(t, err)
+	_, err = store.Put(lumpid("0000"), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = store.PutWithTTL(lumpid("0001"), zeroedData(1000), time.Hour)
+	assert.Nil(t, err)
+	_, err = store.PutWithMetadata(lumpid("0002"), zeroedData(3000), []byte("meta"))
+	assert.Nil(t, err)
+	_, err = store.PutEmbed(lumpid("0003"), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = store.PutEmbedWithMetadata(lumpid("0004"), []byte("world"), []byte("meta"))
+	assert.Nil(t, err)
+	_, err = store.Put(lumpid("0005"), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = store.Delete(lumpid("0005"))
+	assert.Nil(t, err)
+	usage := store.Usage()
+	//the checkpoint is written by Close
+	store.Close()
+
+	check := func(store *Storage) {
+		assert.Equal(t, 5, len(store.List()))
+		assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+		assert.Equal(t, usage.EmbeddedBytes, store.Usage().EmbeddedBytes)
+		_, ok := store.index.ExpireAt(lumpid("0001"))
+		assert.True(t, ok)
+		metadata, err := store.GetMetadata(lumpid("0002"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("meta"), metadata)
+		metadata, err = store.GetMetadata(lumpid("0004"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("meta"), metadata)
+		data, err := store.Get(lumpid("0003"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hello"), data)
+		data, err = store.Get(lumpid("0002"))
+		assert.Nil(t, err)
+		assert.Equal(t, 3000, len(data))
+	}
+	store, err = OpenCannylsStorageWithOptions("tmp27.lusf", options)
+	assert.Nil(t, err)
+	check(store)
+
+	//the records after the checkpoint are replayed, the storage is not closed
+	assert.Nil(t, store.WriteCheckpoint())
+	_, err = store.Put(lumpid("0006"), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = store.Delete(lumpid("0000"))
+	assert.Nil(t, err)
+	usage = store.Usage()
+	assert.Nil(t, store.JournalSync())
+	store.innerNVM.Close()
+
+	store, err = OpenCannylsStorageWithOptions("tmp27.lusf", options)
+	assert.Nil(t, err)
+	_, err = store.Get(lumpid("0000"))
+	assert.Error(t, err)
+	_, err = store.Get(lumpid("0006"))
+	assert.Nil(t, err)
+	assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+
+	//the index is loaded from the checkpoint instead of the journal:
+	//the lump removed from the index only is not in the checkpoint
+	store.index.Delete(lumpid("0006"))
+	assert.Nil(t, store.WriteCheckpoint())
+	store.Close()
+	store, err = OpenCannylsStorageWithOptions("tmp27.lusf", options)
+	assert.Nil(t, err)
+	_, err = store.Get(lumpid("0006"))
+	assert.Error(t, err)
+	store.Close()
+
+	//a corrupted checkpoint is not used
+	buf, err := ioutil.ReadFile("tmp27.ckpt")
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xFF
+	assert.Nil(t, ioutil.WriteFile("tmp27.ckpt", buf, 0644))
+	store, err = OpenCannylsStorageWithOptions("tmp27.lusf", options)
+	assert.Nil(t, err)
+	_, err = store.Get(lumpid("0006"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(store.List()))
+	store.Close()
+}
+
+func TestStorageCheckpointInterval(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp28.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp28.lusf")
+	defer os.Remove("tmp28.ckpt")
+	store.Close()
+
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp28.ckpt"
+	options.CheckpointInterval = time.Minute
+	store, err = OpenCannylsStorageWithOptions("tmp28.lusf", options)
+	assert.Nil(t, err)
+	defer store.Close()
+	now := time.Now()
+	store.clock = func() time.Time { return now }
+
+	store.RunSideJobOnce()
+	assert.FileExists(t, "tmp28.ckpt")
+	os.Remove("tmp28.ckpt")
+	store.RunSideJobOnce()
+	_, err = os.Stat("tmp28.ckpt")
+	assert.True(t, os.IsNotExist(err))
+
+	now = now.Add(time.Minute)
+	store.RunSideJobOnce()
+	assert.FileExists(t, "tmp28.ckpt")
+}
+
+func TestStorageCheckpointInSideJob(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp86.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp86.lusf")
+	defer os.Remove("tmp86.ckpt")
+	store.Close()
+
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp86.ckpt"
+	options.CheckpointInterval = time.Minute
+	store, err = OpenCannylsStorageWithOptions("tmp86.lusf", options)
+	assert.Nil(t, err)
+	now := time.Now()
+	store.clock = func() time.Time { return now }
+	for i := 0; i < 20; i++ {
+		_, err = store.Put(lumpidnum(i), zeroedData(1000))
+		assert.Nil(t, err)
+	}
+
+	//the header and a few lumps are written before the bucket is in debt,
+	//the journal gc of RunSideJobOnce is throttled too, so the checkpoint runs alone
+	assert.Nil(t, store.SetBackgroundBandwidth(100))
+	assert.Nil(t, store.runCheckpoint())
+	assert.NotNil(t, store.checkpointJob)
+	assert.True(t, store.checkpointJob.count > 0)
+	assert.True(t, store.checkpointJob.count < 20)
+	assert.FileExists(t, "tmp86.ckpt.tmp")
+	_, err = os.Stat("tmp86.ckpt")
+	assert.True(t, os.IsNotExist(err))
+
+	//the lumps changed while the checkpoint is written are replayed
+	_, err = store.Delete(lumpidnum(0))
+	assert.Nil(t, err)
+	_, err = store.Delete(lumpidnum(19))
+	assert.Nil(t, err)
+	_, err = store.PutEmbed(lumpidnum(1), []byte("changed"))
+	assert.Nil(t, err)
+	_, err = store.Put(lumpidnum(20), zeroedData(1000))
+	assert.Nil(t, err)
+	assert.Nil(t, store.SetBackgroundBandwidth(0))
+	assert.Nil(t, store.RunSideJobOnce())
+	assert.Nil(t, store.checkpointJob)
+	assert.FileExists(t, "tmp86.ckpt")
+	_, err = os.Stat("tmp86.ckpt.tmp")
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, SideJobStats{}, store.SideJobStats())
+
+	usage := store.Usage()
+	assert.Nil(t, store.JournalSync())
+	store.index.Close()
+	store.innerNVM.Close()
+	store, err = OpenCannylsStorageWithOptions("tmp86.lusf", options)
+	assert.Nil(t, err)
+	assert.True(t, store.Recovery().Checkpoint)
+	assert.True(t, store.Recovery().Replayed > 0)
+	assert.Equal(t, 19, len(store.List()))
+	assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+	_, err = store.Get(lumpidnum(0))
+	assert.Error(t, err)
+	data, err := store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("changed"), data)
+	_, err = store.Get(lumpidnum(20))
+	assert.Nil(t, err)
+
+	//WriteCheckpoint drops the checkpoint being written
+	store.clock = func() time.Time { return now }
+	assert.Nil(t, store.SetBackgroundBandwidth(100))
+	assert.Nil(t, store.runCheckpoint())
+	assert.NotNil(t, store.checkpointJob)
+	assert.Nil(t, store.WriteCheckpoint())
+	assert.Nil(t, store.checkpointJob)
+	_, err = os.Stat("tmp86.ckpt.tmp")
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, store.Close())
+
+	//the failures are counted
+	options.Checkpoint = "nonexistent/tmp86.ckpt"
+	store, err = OpenCannylsStorageWithOptions("tmp86.lusf", options)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Error(t, store.RunSideJobOnce())
+	stats := store.SideJobStats()
+	assert.Equal(t, uint64(1), stats.CheckpointFailures)
+	assert.NotEqual(t, "", stats.LastError)
+	assert.Nil(t, store.checkpointJob)
+}
+
+func TestStorageCloseClean(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp57.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp57.lusf")
+	defer os.Remove("tmp57.ckpt")
+	assert.Nil(t, store.Close())
+
+	var events []journal.RestoreProgress
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp57.ckpt"
+	options.Journal.OnRestoreProgress = func(progress journal.RestoreProgress) {
+		events = append(events, progress)
+	}
+	store, err = OpenCannylsStorageWithOptions("tmp57.lusf", options)
+	assert.Nil(t, err)
+	//there is no checkpoint yet
+	recovery := store.Recovery()
+	assert.True(t, recovery.Clean)
+	assert.False(t, recovery.Checkpoint)
+	assert.False(t, recovery.FastPath)
+	for i := 0; i < 10; i++ {
+		_, err = store.Put(lumpidnum(i), zeroedData(1000))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, store.Close())
+	assert.Nil(t, store.Close())
+	_, err = store.Put(lumpidnum(10), zeroedData(1000))
+	assert.Equal(t, internalerror.DeviceTerminated, errors.Cause(err))
+	_, err = store.Get(lumpidnum(0))
+	assert.Equal(t, internalerror.DeviceTerminated, errors.Cause(err))
+
+	//the journal is not read after the clean close
+	events = nil
+	store, err = OpenCannylsStorageWithOptions("tmp57.lusf", options)
+	assert.Nil(t, err)
+	assert.True(t, store.journalRegion.Clean())
+	assert.Equal(t, []journal.RestoreProgress{{Done: true}}, events)
+	assert.Equal(t, uint64(10), store.index.Count())
+	recovery = store.Recovery()
+	assert.True(t, recovery.Clean && recovery.Checkpoint && recovery.FastPath)
+	assert.Equal(t, 0, recovery.Replayed)
+
+	//the mark is cleared by the next put, the put is replayed after a crash
+	_, err = store.Put(lumpidnum(10), zeroedData(1000))
+	assert.Nil(t, err)
+	assert.False(t, store.journalRegion.Clean())
+	assert.Nil(t, store.JournalSync())
+	store.index.Close()
+	store.innerNVM.Close()
+
+	events = nil
+	store, err = OpenCannylsStorageWithOptions("tmp57.lusf", options)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.False(t, store.journalRegion.Clean())
+	assert.Equal(t, uint64(11), store.index.Count())
+	assert.True(t, events[len(events)-1].Entries > 0)
+	recovery = store.Recovery()
+	assert.False(t, recovery.Clean)
+	assert.True(t, recovery.Checkpoint)
+	assert.False(t, recovery.FastPath)
+	assert.Equal(t, events[len(events)-1].Entries, recovery.Replayed)
+}
+
+func TestStorageCheckpointSyncFailure(t *testing.T) {
+	memory, err := nvm.New(1024 * 1024)
+	assert.Nil(t, err)
+	faulty := nvm.NewFaultyNVM(memory, nvm.FaultPlan{})
+	header, err := initializeNVM(faulty, 0.1)
+	assert.Nil(t, err)
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp96.ckpt"
+	defer os.Remove("tmp96.ckpt")
+	store, err := OpenCannylsStorageOnNVM(faulty, &header, options)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Nil(t, store.SetPanicFree(true))
+
+	//the record is only buffered, so the checkpoint syncs it and fails
+	_, err = store.PutWithOptions(lumpid("0000"), zeroedData(1000), PutOptions{SyncJournal: false})
+	assert.Nil(t, err)
+	faulty.SetPlan(nvm.FaultPlan{FailWriteAt: 1})
+	assert.NotPanics(t, func() { err = store.WriteCheckpoint() })
+	assert.Error(t, err)
+	_, err = os.Stat("tmp96.ckpt")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+/*
+Clone creates a copy of the storage at path by the reflink of the filesystem, such as XFS or Btrfs,
+and opens it by OpenReadOnly. The storage is synced first, so the clone has all the lumps written
+before Clone. The copy shares the blocks with the storage until either of them is written, so it
+is created instantly whatever the size of the storage is, for the analytical jobs which read a
+point-in-time view of the lumps while the storage is written.
+It fails with InvalidInput if the storage is not on a whole file or the filesystem does not
+support reflink, nothing is copied then. The clone has the same UUID as the storage, it should
+only be opened read only, and removed when it is not used.
+*/
+func (store *Storage) Clone(path string) (*Storage, error) {
+	if err := store.checkOpen(); err != nil {
+		return nil, err
+	}
+	cloner, ok := store.innerNVM.(nvm.Cloner)
+	if !ok {
+		return nil, errors.Wrap(internalerror.InvalidInput, "the nvm could not be cloned")
+	}
+	if err := store.Sync(); err != nil {
+		return nil, err
+	}
+	if err := cloner.CloneTo(path); err != nil {
+		return nil, err
+	}
+	return OpenReadOnly(path)
+}
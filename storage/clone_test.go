@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+func TestStorageClone(t *testing.T) {
+	memory, err := nvm.New(1024 * 1024)
+	assert.Nil(t, err)
+	inMemory, err := CreateCannylsStorageOnNVM(memory, 0.5)
+	assert.Nil(t, err)
+	_, err = inMemory.Clone("tmp81.lusf")
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+	inMemory.Close()
+
+	store, err := CreateCannylsStorage("tmp82.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp82.lusf")
+	defer store.Close()
+	_, err = store.Put(lumpid("0000"), thumbnailData(3000, 1))
+	assert.Nil(t, err)
+	_, err = store.PutEmbed(lumpid("0001"), []byte("hello"))
+	assert.Nil(t, err)
+
+	clone, err := store.Clone("tmp81.lusf")
+	if internalerror.Is(err, internalerror.InvalidInput) {
+		//nothing is left
+		_, statErr := os.Stat("tmp81.lusf")
+		assert.True(t, os.IsNotExist(statErr))
+		t.Skipf("reflink is not supported: %v", err)
+	}
+	assert.Nil(t, err)
+	defer os.Remove("tmp81.lusf")
+	defer clone.Close()
+	assert.True(t, clone.ReadOnly())
+
+	//the clone is not changed by the writes of the storage
+	_, err = store.Put(lumpid("0000"), thumbnailData(3000, 2))
+	assert.Nil(t, err)
+	_, err = store.Delete(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.JournalSync())
+	data, err := clone.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, thumbnailData(3000, 1).AsBytes(), data)
+	data, err = clone.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	_, err = store.Clone("tmp81.lusf")
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+type CompressionCodec uint8
+
+const (
+	COMPRESSION_NONE CompressionCodec = iota
+	//COMPRESSION_LZ4 is the LZ4 block format, it is fast enough for every Put
+	COMPRESSION_LZ4
+	//COMPRESSION_DEFLATE is slower than LZ4, but it compresses much better
+	COMPRESSION_DEFLATE
+)
+
+const (
+	//the lumps smaller than COMPRESSION_MIN_SIZE are never compressed, they could not save a block
+	COMPRESSION_MIN_SIZE = 1024
+)
+
+func (codec CompressionCodec) String() string {
+	switch codec {
+	case COMPRESSION_NONE:
+		return "none"
+	case COMPRESSION_LZ4:
+		return "lz4"
+	case COMPRESSION_DEFLATE:
+		return "deflate"
+	default:
+		return fmt.Sprintf("unknown compression codec %d", int(codec))
+	}
+}
+
+func (codec CompressionCodec) validate() error {
+	if codec > COMPRESSION_DEFLATE {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid compression codec %d", int(codec))
+	}
+	return nil
+}
+
+func (codec CompressionCodec) compress(data []byte) ([]byte, error) {
+	switch codec {
+	case COMPRESSION_LZ4:
+		return lz4Compress(data), nil
+	case COMPRESSION_DEFLATE:
+		var buf bytes.Buffer
+		writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err = writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return data, nil
+	}
+}
+
+//decompress decompresses src into dst, dst must be exactly the size of the decompressed data
+func (codec CompressionCodec) decompress(src []byte, dst []byte) error {
+	switch codec {
+	case COMPRESSION_LZ4:
+		return lz4Decompress(src, dst)
+	case COMPRESSION_DEFLATE:
+		reader := flate.NewReader(bytes.NewReader(src))
+		defer reader.Close()
+		if _, err := io.ReadFull(reader, dst); err != nil {
+			return errors.Wrapf(internalerror.StorageCorrupted, "corrupted deflate stream: %v", err)
+		}
+		return nil
+	default:
+		return errors.Wrapf(internalerror.StorageCorrupted, "unknown compression codec %d", int(codec))
+	}
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func compressionInputs() [][]byte {
+	random := make([]byte, 10000)
+	rand.Read(random)
+	return [][]byte{
+		{},
+		[]byte("foo"),
+		bytes.Repeat([]byte("a"), 100000),
+		bytes.Repeat([]byte("cannyls lump data "), 1000),
+		random,
+		append(bytes.Repeat([]byte{0}, 5000), random[:5000]...),
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	for _, data := range compressionInputs() {
+		compressed := lz4Compress(data)
+		decompressed := make([]byte, len(data))
+		assert.Nil(t, lz4Decompress(compressed, decompressed))
+		assert.Equal(t, data, decompressed)
+	}
+	compressed := lz4Compress(bytes.Repeat([]byte("a"), 100000))
+	assert.True(t, len(compressed) < 1000)
+
+	//the size is wrong
+	assert.Error(t, lz4Decompress(compressed, make([]byte, 99999)))
+	//the block is truncated
+	assert.Error(t, lz4Decompress(compressed[:len(compressed)/2], make([]byte, 100000)))
+	//the offset is out of the decompressed data
+	assert.Error(t, lz4Decompress([]byte{0x10, 'a', 0xFF, 0x00}, make([]byte, 5)))
+}
+
+func TestCompressionCodec(t *testing.T) {
+	for _, codec := range []CompressionCodec{COMPRESSION_LZ4, COMPRESSION_DEFLATE} {
+		for _, data := range compressionInputs() {
+			compressed, err := codec.compress(data)
+			assert.Nil(t, err)
+			decompressed := make([]byte, len(data))
+			assert.Nil(t, codec.decompress(compressed, decompressed))
+			assert.Equal(t, data, decompressed)
+		}
+	}
+	assert.Equal(t, "lz4", COMPRESSION_LZ4.String())
+	assert.Error(t, CompressionCodec(9).validate())
+	assert.Error(t, COMPRESSION_DEFLATE.decompress([]byte("bad"), make([]byte, 10)))
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"hash/crc32"
+
+	"github.com/thesues/cannyls-go/lump"
+)
+
+//LumpCRC returns the CRC32C of lump data, which is the expected value of CompareAndSwap
+func LumpCRC(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoliTable)
+}
+
+/*
+PutIfAbsent puts the lump only if the lumpid is not used, an expired lump is absent.
+stored is false if the lump exists, and nothing is written.
+Storage is not thread safe, use AsyncStorage.PutIfAbsentAsync for multiple writers.
+*/
+func (store *Storage) PutIfAbsent(lumpid lump.LumpId, lumpdata lump.LumpData) (stored bool, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	if _, err = store.index.Get(lumpid); err == nil && !store.isExpired(lumpid) {
+		return false, nil
+	}
+	if _, err = store.Put(lumpid, lumpdata); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+CompareAndSwap puts the lump only if the CRC32C of the current lump data is expectedCRC.
+swapped is false if the lump does not exist or its data is changed, and nothing is written.
+*/
+func (store *Storage) CompareAndSwap(lumpid lump.LumpId, expectedCRC uint32, lumpdata lump.LumpData) (swapped bool, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	if _, err = store.index.Get(lumpid); err != nil || store.isExpired(lumpid) {
+		return false, nil
+	}
+	current, err := store.Get(lumpid)
+	if err != nil {
+		return false, err
+	}
+	if LumpCRC(current) != expectedCRC {
+		return false, nil
+	}
+	if _, err = store.Put(lumpid, lumpdata); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+CorruptLumpError is returned by Get, GetPooled and GetReader if the lump in the data region is
+broken, such as an impossible padding in its trailer or a mismatched checksum. errors.Cause of it
+is internalerror.StorageCorrupted, use internalerror.As to get it from a wrapped error.
+The lump could be dropped by RepairLump.
+*/
+type CorruptLumpError struct {
+	Id      lump.LumpId
+	Portion portion.DataPortion
+	Err     error
+}
+
+func (e *CorruptLumpError) Error() string {
+	return fmt.Sprintf("lump %s in %s is corrupted: %v", e.Id.String(), e.Portion.Display(), e.Err)
+}
+
+//Cause returns internalerror.StorageCorrupted
+func (e *CorruptLumpError) Cause() error {
+	return errors.Cause(e.Err)
+}
+
+func (e *CorruptLumpError) Unwrap() error {
+	return e.Err
+}
+
+//Is makes internalerror.Is and errors.Is match internalerror.StorageCorrupted
+func (e *CorruptLumpError) Is(target error) bool {
+	return target == internalerror.StorageCorrupted
+}
+
+//corruptLump returns a CorruptLumpError if err is caused by the broken lump data
+func corruptLump(id lump.LumpId, p portion.DataPortion, err error) error {
+	if !internalerror.Is(err, internalerror.StorageCorrupted) {
+		return err
+	}
+	return &CorruptLumpError{Id: id, Portion: p, Err: err}
+}
+
+/*
+RepairLump drops the lump if its data portion is broken, it returns false if the lump is fine or
+does not exist. The blocks of the portion are zeroed and released, unless they are beyond the data
+region or used by another lump too, then they are left as they are. All the extents of a lump in
+several portions are dropped if any of them is broken. The delete is journaled.
+Only the lumps in the data region could be repaired.
+*/
+func (store *Storage) RepairLump(lumpid lump.LumpId) (repaired bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return false, nil
+	}
+	dataPortion, ok := p.(portion.DataPortion)
+	if !ok {
+		return false, errors.Wrapf(internalerror.InvalidInput, "lump %s is not in the data region", lumpid.String())
+	}
+	capacity := store.storageHeader.DataRegionSize / uint64(store.dataRegion.block_size.AsU16())
+	if _, err = store.verifyLump(lumpid, dataPortion); err == nil {
+		return false, nil
+	}
+	//a lump in several extents is dropped with all of them
+	var owned []portion.DataPortion
+	for _, extent := range store.extentsOf(lumpid, dataPortion) {
+		if extent.Len > 0 && extent.End() <= capacity && !store.overlapsOther(lumpid, extent) {
+			owned = append(owned, extent)
+		}
+	}
+
+	if err = store.dropLump(lumpid); err != nil {
+		return false, err
+	}
+	for _, extent := range owned {
+		offset, length := extent.ShiftBlockToBytes(store.dataRegion.block_size)
+		zeros := block.NewAlignedBytes(int(length), store.dataRegion.block_size)
+		if _, err = store.dataRegion.nvm.WriteAt(zeros.AsBytes(), int64(offset)); err != nil {
+			//the lump is dropped, the blocks are leaked until the storage is opened again
+			return true, errors.Wrapf(err, "failed to zero %s", extent.Display())
+		}
+		store.dataRegion.Release(extent)
+	}
+	return true, nil
+}
+
+//overlapsOther returns true if any block of the portion is used by another lump
+func (store *Storage) overlapsOther(lumpid lump.LumpId, p portion.DataPortion) bool {
+	for _, l := range store.index.LumpDataPortions() {
+		if l.Id != lumpid && l.Portion.Start.AsU64() < p.End() && p.Start.AsU64() < l.Portion.End() {
+			return true
+		}
+	}
+	return false
+}
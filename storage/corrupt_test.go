@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func TestStorageRepairLump(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp59.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp59.lusf")
+
+	for i := 0; i < 2; i++ {
+		_, err = store.Put(lumpidnum(i), filledData(1000, byte('a'+i)))
+		assert.Nil(t, err)
+	}
+	_, err = store.PutEmbed(lumpidnum(2), []byte("embedded"))
+	assert.Nil(t, err)
+	p, err := store.index.Get(lumpidnum(0))
+	assert.Nil(t, err)
+	broken := p.(portion.DataPortion)
+
+	//the padding of lump 0 is larger than a block
+	blockSize := int64(store.dataRegion.block_size.AsU16())
+	last := make([]byte, blockSize)
+	last[blockSize-2], last[blockSize-1] = 0x0f, 0xff
+	_, err = store.dataRegion.nvm.WriteAt(last, int64(broken.End())*blockSize-blockSize)
+	assert.Nil(t, err)
+
+	_, err = store.Get(lumpidnum(0))
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+	corrupt, ok := err.(*CorruptLumpError)
+	assert.True(t, ok)
+	assert.Equal(t, lumpidnum(0), corrupt.Id)
+	assert.Equal(t, broken, corrupt.Portion)
+	_, err = store.GetReader(lumpidnum(0))
+	_, ok = err.(*CorruptLumpError)
+	assert.True(t, ok)
+	assert.True(t, internalerror.Is(errors.Wrap(err, "wrapped"), internalerror.StorageCorrupted))
+	assert.True(t, internalerror.As(errors.Wrap(err, "wrapped"), &corrupt))
+
+	//only the broken lumps in the data region are repaired
+	repaired, err := store.RepairLump(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.False(t, repaired)
+	_, err = store.RepairLump(lumpidnum(2))
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	free := store.alloc.FreeCount()
+	repaired, err = store.RepairLump(lumpidnum(0))
+	assert.Nil(t, err)
+	assert.True(t, repaired)
+	assert.Equal(t, free+uint64(broken.Len), store.alloc.FreeCount())
+	zeroed := make([]byte, blockSize)
+	_, err = store.dataRegion.nvm.ReadAt(zeroed, int64(broken.End())*blockSize-blockSize)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, blockSize), zeroed)
+	repaired, err = store.RepairLump(lumpidnum(0))
+	assert.Nil(t, err)
+	assert.False(t, repaired)
+
+	//the drop is journaled
+	store.Close()
+	store, err = OpenCannylsStorage("tmp59.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	_, err = store.Get(lumpidnum(0))
+	assert.Error(t, err)
+	data, err := store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, byte('b'), data[0])
+}
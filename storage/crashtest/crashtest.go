@@ -0,0 +1,266 @@
+/*
+Package crashtest checks that a storage recovers from crashes at any point.
+
+RecordingNVM wraps a NonVolatileMemory and records all the writes and syncs of a
+workload. A Crash describes what reaches the disk: the writes before the last sync
+are persisted, every write after it may be lost, torn at a sector boundary, or
+persisted, in any order. Run replays random crashes into memory images, opens the
+storage on them and calls a Checker to verify the invariants of the workload.
+
+	mem, _ := nvm.New(capacity)
+	store, _ := storage.CreateCannylsStorageOnNVM(mem, 0.01)
+	store.Close()
+	recording, _ := crashtest.Wrap(mem)
+	header, _ := nvm.ReadFrom(bytes.NewReader(mem.AsBytes()))
+	store, _ = storage.OpenCannylsStorageOnNVM(recording, header, storage.DefaultStorageOptions())
+	//run the workload, remember what is synced with recording.Log().Syncs()
+	err := crashtest.Run(recording.Log(), 100, rand.New(rand.NewSource(1)), storage.DefaultStorageOptions(), check)
+*/
+package crashtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/storage"
+)
+
+//Write is a recorded write, Offset is from the start of the wrapped NonVolatileMemory
+type Write struct {
+	Offset uint64
+	Data   []byte
+}
+
+//Log is shared by a RecordingNVM and all its splits
+type Log struct {
+	base   []byte
+	writes []Write
+	//syncs[i] is the number of writes before the i-th sync
+	syncs []int
+}
+
+//Writes returns the number of recorded writes
+func (log *Log) Writes() int {
+	return len(log.writes)
+}
+
+//Syncs returns the number of completed syncs, Crash.Syncs is compared with it
+func (log *Log) Syncs() int {
+	return len(log.syncs)
+}
+
+/*
+Crash is the state of the disk after a crash.
+The first Synced writes are persisted, Persisted[i] is how many sectors of the
+write Synced+i reach the disk, 0 means it is lost. Syncs completed before the crash.
+*/
+type Crash struct {
+	Writes    int
+	Synced    int
+	Syncs     int
+	Persisted []int
+}
+
+func (crash Crash) String() string {
+	return fmt.Sprintf("crash after %d writes, %d syncs, %d writes synced, unsynced sectors %v",
+		crash.Writes, crash.Syncs, crash.Synced, crash.Persisted)
+}
+
+//CrashAt returns the crash after n writes, which persists all the writes
+func (log *Log) CrashAt(n int) Crash {
+	crash := Crash{Writes: n}
+	for _, s := range log.syncs {
+		if s > n {
+			break
+		}
+		crash.Synced = s
+		crash.Syncs++
+	}
+	for _, w := range log.writes[crash.Synced:n] {
+		crash.Persisted = append(crash.Persisted, sectors(w))
+	}
+	return crash
+}
+
+//RandomCrash returns a crash at a random write, each unsynced write is lost, torn or persisted
+func (log *Log) RandomCrash(rng *rand.Rand) Crash {
+	crash := log.CrashAt(rng.Intn(len(log.writes) + 1))
+	for i, n := range crash.Persisted {
+		switch rng.Intn(3) {
+		case 0:
+			crash.Persisted[i] = 0
+		case 1:
+			crash.Persisted[i] = rng.Intn(n + 1)
+		}
+	}
+	return crash
+}
+
+//Image returns the content of the disk after crash
+func (log *Log) Image(crash Crash) []byte {
+	image := append([]byte{}, log.base...)
+	for _, w := range log.writes[:crash.Synced] {
+		copy(image[w.Offset:], w.Data)
+	}
+	sectorSize := int(block.Min().AsU16())
+	for i, n := range crash.Persisted {
+		w := log.writes[crash.Synced+i]
+		length := n * sectorSize
+		if length > len(w.Data) {
+			length = len(w.Data)
+		}
+		copy(image[w.Offset:], w.Data[:length])
+	}
+	return image
+}
+
+func sectors(w Write) int {
+	sectorSize := int(block.Min().AsU16())
+	return (len(w.Data) + sectorSize - 1) / sectorSize
+}
+
+//RecordingNVM records the writes and syncs to the inner NonVolatileMemory
+type RecordingNVM struct {
+	inner nvm.NonVolatileMemory
+	log   *Log
+	//the start of inner in the wrapped NonVolatileMemory
+	offset uint64
+}
+
+//Wrap records the writes to inner from now on, the current content of inner is the base of the crash images
+func Wrap(inner nvm.NonVolatileMemory) (*RecordingNVM, error) {
+	position := inner.Position()
+	if _, err := inner.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	base := make([]byte, inner.Capacity())
+	if _, err := io.ReadFull(inner, base); err != nil {
+		return nil, errors.Wrap(err, "failed to read the base image")
+	}
+	if _, err := inner.Seek(int64(position), io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &RecordingNVM{inner: inner, log: &Log{base: base}}, nil
+}
+
+func (recording *RecordingNVM) Log() *Log {
+	return recording.log
+}
+
+func (recording *RecordingNVM) Read(buf []byte) (int, error) {
+	return recording.inner.Read(buf)
+}
+
+func (recording *RecordingNVM) Write(buf []byte) (int, error) {
+	offset := recording.offset + recording.inner.Position()
+	n, err := recording.inner.Write(buf)
+	if n > 0 {
+		recording.log.writes = append(recording.log.writes, Write{Offset: offset, Data: append([]byte{}, buf[:n]...)})
+	}
+	return n, err
+}
+
+func (recording *RecordingNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	return recording.inner.ReadAt(buf, offset)
+}
+
+func (recording *RecordingNVM) WriteAt(buf []byte, offset int64) (int, error) {
+	n, err := recording.inner.WriteAt(buf, offset)
+	if n > 0 {
+		recording.log.writes = append(recording.log.writes,
+			Write{Offset: recording.offset + uint64(offset), Data: append([]byte{}, buf[:n]...)})
+	}
+	return n, err
+}
+
+//Writev is recorded as one write, as pwritev
+func (recording *RecordingNVM) Writev(bufs [][]byte, offset int64) (int, error) {
+	return recording.WriteAt(nvm.Coalesce(bufs, recording.BlockSize()), offset)
+}
+
+func (recording *RecordingNVM) Seek(offset int64, whence int) (int64, error) {
+	return recording.inner.Seek(offset, whence)
+}
+
+func (recording *RecordingNVM) Close() error {
+	return recording.inner.Close()
+}
+
+//Sync is a barrier of all the writes, as fsync of the whole file
+func (recording *RecordingNVM) Sync() error {
+	if err := recording.inner.Sync(); err != nil {
+		return err
+	}
+	recording.log.syncs = append(recording.log.syncs, len(recording.log.writes))
+	return nil
+}
+
+func (recording *RecordingNVM) Position() uint64 {
+	return recording.inner.Position()
+}
+
+func (recording *RecordingNVM) Capacity() uint64 {
+	return recording.inner.Capacity()
+}
+
+func (recording *RecordingNVM) BlockSize() block.BlockSize {
+	return recording.inner.BlockSize()
+}
+
+func (recording *RecordingNVM) RawSize() int64 {
+	return recording.inner.RawSize()
+}
+
+func (recording *RecordingNVM) Split(position uint64) (nvm.NonVolatileMemory, nvm.NonVolatileMemory, error) {
+	left, right, err := recording.inner.Split(position)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &RecordingNVM{inner: left, log: recording.log, offset: recording.offset},
+		&RecordingNVM{inner: right, log: recording.log, offset: recording.offset + position}, nil
+}
+
+//Recover opens the storage on a crash image, a panic while restoring is returned as StorageCorrupted
+func Recover(image []byte, options storage.StorageOptions) (store *storage.Storage, err error) {
+	header, err := nvm.ReadFrom(bytes.NewReader(image))
+	if err != nil {
+		return nil, err
+	}
+	memory, err := nvm.NewFromVec(image)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			store = nil
+			err = errors.Wrapf(internalerror.StorageCorrupted, "panic in recovery: %v", r)
+		}
+	}()
+	return storage.OpenCannylsStorageOnNVM(memory, header, options)
+}
+
+//Checker verifies the storage recovered from crash
+type Checker func(store *storage.Storage, crash Crash) error
+
+//Run checks rounds random crashes of log, it returns the first failure with its Crash
+func Run(log *Log, rounds int, rng *rand.Rand, options storage.StorageOptions, check Checker) error {
+	for i := 0; i < rounds; i++ {
+		crash := log.RandomCrash(rng)
+		store, err := Recover(log.Image(crash), options)
+		if err != nil {
+			return errors.Wrapf(err, "failed to recover from %s", crash)
+		}
+		err = check(store, crash)
+		store.Close()
+		if err != nil {
+			return errors.Wrapf(err, "check failed for %s", crash)
+		}
+	}
+	return nil
+}
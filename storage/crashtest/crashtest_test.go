@@ -0,0 +1,181 @@
+package crashtest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/storage"
+)
+
+func TestLogImage(t *testing.T) {
+	memory, err := nvm.New(4096)
+	assert.Nil(t, err)
+	recording, err := Wrap(memory)
+	assert.Nil(t, err)
+	_, right, err := recording.Split(1024)
+	assert.Nil(t, err)
+
+	_, err = right.Write(bytes.Repeat([]byte{1}, 1024))
+	assert.Nil(t, err)
+	assert.Nil(t, recording.Sync())
+	_, err = right.Write(bytes.Repeat([]byte{2}, 1024))
+	assert.Nil(t, err)
+
+	log := recording.Log()
+	assert.Equal(t, 2, log.Writes())
+	assert.Equal(t, 1, log.Syncs())
+
+	crash := log.CrashAt(2)
+	assert.Equal(t, Crash{Writes: 2, Synced: 1, Syncs: 1, Persisted: []int{2}}, crash)
+	image := log.Image(crash)
+	assert.Equal(t, byte(1), image[1024])
+	assert.Equal(t, byte(2), image[2048])
+
+	//the second write is torn after its first sector
+	crash.Persisted[0] = 1
+	image = log.Image(crash)
+	assert.Equal(t, byte(2), image[2048])
+	assert.Equal(t, byte(0), image[2048+512])
+}
+
+func TestStorageCrashRecovery(t *testing.T) {
+	memory, err := nvm.New(1024 * 1024)
+	assert.Nil(t, err)
+	store, err := storage.CreateCannylsStorageOnNVM(memory, 0.01)
+	assert.Nil(t, err)
+	store.Close()
+
+	recording, err := Wrap(memory)
+	assert.Nil(t, err)
+	header, err := nvm.ReadFrom(bytes.NewReader(memory.AsBytes()))
+	assert.Nil(t, err)
+	store, err = storage.OpenCannylsStorageOnNVM(recording, header, storage.DefaultStorageOptions())
+	assert.Nil(t, err)
+
+	//the lumps are overwritten again and again, so the journal wraps many times
+	//durableAt[i] is the number of syncs after which the i-th put is durable
+	const puts, slots = 400, 20
+	durableAt := make([]int, puts)
+	for i := 0; i < puts; i++ {
+		id := lump.FromU64(0, uint64(i%slots))
+		if i%3 == 0 {
+			_, err = store.PutEmbed(id, []byte(fmt.Sprintf("embed-%d", i)))
+		} else {
+			data := lump.NewLumpDataAligned(600, block.Min())
+			copy(data.AsBytes(), fmt.Sprintf("data-%d", i))
+			_, err = store.Put(id, data)
+		}
+		assert.Nil(t, err)
+		durableAt[i] = recording.Log().Syncs() + 1
+		if i%16 == 15 {
+			assert.Nil(t, store.JournalSync())
+		}
+	}
+	store.Close()
+
+	expected := func(i int) []byte {
+		if i%3 == 0 {
+			return []byte(fmt.Sprintf("embed-%d", i))
+		}
+		return []byte(fmt.Sprintf("data-%d", i))
+	}
+	check := func(store *storage.Storage, crash Crash) error {
+		for slot := 0; slot < slots; slot++ {
+			//the last durable put of the slot, the later puts may be persisted or not
+			durable := -1
+			for i := slot; i < puts; i += slots {
+				if durableAt[i] <= crash.Syncs {
+					durable = i
+				}
+			}
+			data, err := store.Get(lump.FromU64(0, uint64(slot)))
+			if durable < 0 {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("synced put %d is lost: %v", durable, err)
+			}
+			if bytes.HasPrefix(data, expected(durable)) {
+				continue
+			}
+			//the journal record of an unsynced put may reach the disk without its data
+			if durable+slots >= puts {
+				return fmt.Errorf("synced put %d is overwritten by %q", durable, data[:16])
+			}
+		}
+		//the recovered storage is writable
+		_, err := store.PutEmbed(lump.FromU64(0, slots), []byte("after crash"))
+		return err
+	}
+	err = Run(recording.Log(), 200, rand.New(rand.NewSource(1)), storage.DefaultStorageOptions(), check)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestStorageCompactionCrashRecovery(t *testing.T) {
+	memory, err := nvm.New(1024 * 1024)
+	assert.Nil(t, err)
+	store, err := storage.CreateCannylsStorageOnNVM(memory, 0.01)
+	assert.Nil(t, err)
+	store.Close()
+
+	recording, err := Wrap(memory)
+	assert.Nil(t, err)
+	header, err := nvm.ReadFrom(bytes.NewReader(memory.AsBytes()))
+	assert.Nil(t, err)
+	store, err = storage.OpenCannylsStorageOnNVM(recording, header, storage.DefaultStorageOptions())
+	assert.Nil(t, err)
+
+	const lumps = 40
+	for i := 0; i < lumps; i++ {
+		data := lump.NewLumpDataAligned(600, block.Min())
+		copy(data.AsBytes(), fmt.Sprintf("data-%d", i))
+		_, err = store.Put(lump.FromU64(0, uint64(i)), data)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < lumps; i += 2 {
+		_, err = store.Delete(lump.FromU64(0, uint64(i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, store.Sync())
+	durable := recording.Log().Syncs()
+
+	//the old portions of the moved lumps are reused by the next puts
+	moved, err := store.CompactDataRegion(lumps)
+	assert.Nil(t, err)
+	assert.True(t, moved > 0)
+	for i := lumps; i < 2*lumps; i++ {
+		data := lump.NewLumpDataAligned(600, block.Min())
+		copy(data.AsBytes(), fmt.Sprintf("new-%d", i))
+		_, err = store.Put(lump.FromU64(0, uint64(i)), data)
+		assert.Nil(t, err)
+	}
+	store.Close()
+
+	check := func(store *storage.Storage, crash Crash) error {
+		if crash.Syncs < durable {
+			return nil
+		}
+		for i := 1; i < lumps; i += 2 {
+			data, err := store.Get(lump.FromU64(0, uint64(i)))
+			if err != nil {
+				return fmt.Errorf("lump %d is lost: %v", i, err)
+			}
+			if !bytes.HasPrefix(data, []byte(fmt.Sprintf("data-%d", i))) {
+				return fmt.Errorf("lump %d is overwritten by %q", i, data[:16])
+			}
+		}
+		return nil
+	}
+	err = Run(recording.Log(), 200, rand.New(rand.NewSource(1)), storage.DefaultStorageOptions(), check)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
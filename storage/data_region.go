@@ -1,11 +1,18 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"sort"
 
+	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
-	_ "github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/nvm"
 	"github.com/thesues/cannyls-go/portion"
@@ -14,21 +21,317 @@ import (
 )
 
 const (
-	LUMP_DATA_TRAILER_SIZE = 2
+	LUMP_DATA_TRAILER_SIZE  = 2
+	LUMP_DATA_CHECKSUM_SIZE = 4
+	//the highest bit of the padding size tells whether the CRC32C exists
+	CHECKSUM_FLAG = 0x8000
+	//the second highest bit tells whether the lump data is compressed
+	COMPRESSED_FLAG = 0x4000
+	//the codec(1 byte) and the size of the decompressed lump data(4 bytes)
+	LUMP_DATA_COMPRESSION_SIZE = 5
+	//the padding size in the trailer is PADDING_EXTENDED if the padding is not less than a block,
+	//such as the space reserved by PutWithCapacity, the real padding size is in the 4 bytes before
+	PADDING_EXTENDED                = 0x3FFF
+	LUMP_DATA_EXTENDED_PADDING_SIZE = 4
+	//PutReader writes at most STREAM_CHUNK_SIZE bytes to nvm at a time
+	STREAM_CHUNK_SIZE = 1 << 20
+	//GetMulti reads at most MULTI_GET_MAX_READ bytes at a time, unless a lump is bigger
+	MULTI_GET_MAX_READ = 4 << 20
 )
 
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 type DataRegion struct {
 	allocator  allocator.DataPortionAlloc
 	nvm        nvm.NonVolatileMemory
 	block_size block.BlockSize
+	checksum   bool
+	punchHoles bool
+	//the released portions to punch after the journal is synced, see PunchReleased
+	punches      []pendingPunch
+	journalSyncs func() uint64
+	//panicFree turns the panics in reading a portion into errors, see SetPanicFree
+	panicFree bool
+	cache     *readCache
+	//the codec of the new lumps
+	compression CompressionCodec
+	//pins is the number of the open snapshots, the portions released while it is not 0 are kept
+	//in pinned until the last snapshot is closed, see Pin
+	pins   int
+	pinned []portion.DataPortion
 }
 
 func NewDataRegion(alloc allocator.DataPortionAlloc, nvm nvm.NonVolatileMemory) *DataRegion {
 	return &DataRegion{
 		allocator:  alloc,
 		nvm:        nvm,
-		block_size: block.Min(),
+		block_size: nvm.BlockSize(),
+	}
+}
+
+//Sync syncs the nvm of the data region, it could run in parallel with Put
+func (region *DataRegion) Sync() error {
+	return region.nvm.Sync()
+}
+
+//SetChecksum decides whether new lumps are written with a CRC32C.
+//Lumps are verified on Get if they have a CRC32C, no matter what the setting is
+func (region *DataRegion) SetChecksum(checksum bool) {
+	region.checksum = checksum
+}
+
+/*
+SetPanicFree makes the reads of a portion return StorageCorrupted instead of panicking, if a
+broken portion or trailer leads to a bad slice or an assertion of the lower layers. It is for
+the servers shared by many users, where a corrupt lump should not take down the whole process.
+It is off by default, so the bugs are not hidden in the tests.
+*/
+func (region *DataRegion) SetPanicFree(enable bool) {
+	region.panicFree = enable
+}
+
+//recoverPanic must be deferred directly, it sets err if there is a panic and panicFree is set
+func (region *DataRegion) recoverPanic(what string, err *error) {
+	if !region.panicFree {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = errors.Wrapf(internalerror.StorageCorrupted, "panic in reading %s: %v", what, r)
+	}
+}
+
+//SetPunchHoles decides whether the released portions are deallocated in the file, journalSyncs
+//returns the number of the completed syncs of the journal, see PunchReleased.
+//It is ignored if the nvm is not a nvm.HolePuncher
+func (region *DataRegion) SetPunchHoles(punch bool, journalSyncs func() uint64) {
+	_, ok := region.nvm.(nvm.HolePuncher)
+	region.punchHoles = punch && ok
+	region.journalSyncs = journalSyncs
+	if !region.punchHoles {
+		region.punches = nil
+	}
+}
+
+//pendingPunch is a released portion, it is punched after the journal has synced more than syncs times
+type pendingPunch struct {
+	portion portion.DataPortion
+	syncs   uint64
+}
+
+/*
+PunchReleased punches the holes of the portions released before the last sync of the journal,
+so the records releasing them are durable, and a crash never restores a lump whose data is
+punched. The portions allocated again are not punched. The filesystem which does not support it
+disables the punching, other errors are returned, and the failed portion is not punched again.
+*/
+func (region *DataRegion) PunchReleased() error {
+	if len(region.punches) == 0 {
+		return nil
+	}
+	journalSyncs := region.journalSyncs()
+	for len(region.punches) > 0 && region.punches[0].syncs < journalSyncs {
+		p := region.punches[0].portion
+		region.punches = region.punches[1:]
+		offset, len := p.ShiftBlockToBytes(region.block_size)
+		if err := region.nvm.(nvm.HolePuncher).PunchHole(offset, uint64(len)); err != nil {
+			if nvm.IsPunchHoleUnsupported(err) {
+				region.SetPunchHoles(false, nil)
+				return nil
+			}
+			return errors.Wrapf(err, "failed to punch hole of %s", p.Display())
+		}
+	}
+	if len(region.punches) == 0 {
+		//the backing array is not kept forever
+		region.punches = nil
+	}
+	return nil
+}
+
+//allocated drops the part of the pending punches in the newly allocated portion
+func (region *DataRegion) allocated(p portion.DataPortion) {
+	if len(region.punches) == 0 {
+		return
+	}
+	start, end := p.Start.AsU64(), p.End()
+	punches := region.punches[:0]
+	for _, punch := range region.punches {
+		pStart, pEnd := punch.portion.Start.AsU64(), punch.portion.End()
+		if pEnd <= start || end <= pStart {
+			punches = append(punches, punch)
+			continue
+		}
+		if pStart < start {
+			punches = append(punches, pendingPunch{portion.NewDataPortion(pStart, uint16(start-pStart)), punch.syncs})
+		}
+		if end < pEnd {
+			punches = append(punches, pendingPunch{portion.NewDataPortion(end, uint16(pEnd-end)), punch.syncs})
+		}
+	}
+	region.punches = punches
+}
+
+//SetCache keeps at most size bytes of lump data read by Get in memory, 0 disables the cache
+func (region *DataRegion) SetCache(size uint64, policy CachePolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	if size == 0 {
+		region.cache = nil
+		return nil
+	}
+	region.cache = newReadCache(size, policy)
+	return nil
+}
+
+//CacheStats returns the statistics of the cache, it is zero if the cache is disabled
+func (region *DataRegion) CacheStats() CacheStats {
+	if region.cache == nil {
+		return CacheStats{}
+	}
+	return region.cache.stats()
+}
+
+/*
+SetCompression compresses the lumps put later with codec, a lump is stored as is if it
+does not save a block. The padding size must be less than COMPRESSED_FLAG, so the block
+size could not be bigger than it.
+*/
+func (region *DataRegion) SetCompression(codec CompressionCodec) error {
+	if err := codec.validate(); err != nil {
+		return err
+	}
+	if codec != COMPRESSION_NONE && uint32(region.block_size.AsU16()) > COMPRESSED_FLAG {
+		return errors.Wrapf(internalerror.InvalidInput, "block size %d is too big for compression", region.block_size)
+	}
+	region.compression = codec
+	return nil
+}
+
+//trailerSize is the size of the trailer(compression + checksum + padding size) for new lumps
+func (region *DataRegion) trailerSize(codec CompressionCodec) uint32 {
+	size := uint32(LUMP_DATA_TRAILER_SIZE)
+	if region.checksum {
+		size += LUMP_DATA_CHECKSUM_SIZE
+	}
+	if codec != COMPRESSION_NONE {
+		size += LUMP_DATA_COMPRESSION_SIZE
+	}
+	return size
+}
+
+//EstimateSize returns the bytes taken by a lump of size bytes with reserve bytes reserved if it is not compressed
+func (region *DataRegion) EstimateSize(size uint64, reserve uint32) uint64 {
+	if reserve == 0 && !region.FitsPortion(size) {
+		//every extent but the last one takes 0xFFFF blocks with its trailer, see PutExtents
+		full := size / uint64(region.ExtentSize())
+		rest := size % uint64(region.ExtentSize())
+		total := full * 0xFFFF * uint64(region.block_size.AsU16())
+		if rest > 0 {
+			total += region.block_size.CeilAlign(rest + uint64(region.trailerSize(COMPRESSION_NONE)))
+		}
+		return total
+	}
+	return region.block_size.CeilAlign(size + uint64(region.trailerSize(COMPRESSION_NONE)) + uint64(reserve))
+}
+
+//lumpTrailer is decoded from the tail of a data portion
+type lumpTrailer struct {
+	//size is the number of bytes stored in the portion
+	size        uint32
+	hasChecksum bool
+	//sum is the CRC32C of the decompressed lump data
+	sum   uint32
+	codec CompressionCodec
+	//rawSize is the size of the decompressed lump data, it is size if the lump is not compressed
+	rawSize uint32
+	padding uint32
+	//extended is true if the padding is PADDING_EXTENDED
+	extended bool
+}
+
+//encodeTrailer writes the trailer at the end of buf, the padding is extended if extended is true,
+//the LUMP_DATA_EXTENDED_PADDING_SIZE bytes are not counted in padding_len
+func (region *DataRegion) encodeTrailer(buf []byte, padding_len uint32, sum uint32, codec CompressionCodec, rawSize uint32, extended bool) {
+	n := len(buf) - LUMP_DATA_TRAILER_SIZE
+	trailer := uint16(padding_len)
+	if extended {
+		trailer = PADDING_EXTENDED
+	}
+	if region.checksum {
+		n -= LUMP_DATA_CHECKSUM_SIZE
+		binary.BigEndian.PutUint32(buf[n:], sum)
+		trailer |= CHECKSUM_FLAG
+	}
+	if codec != COMPRESSION_NONE {
+		n -= LUMP_DATA_COMPRESSION_SIZE
+		buf[n] = byte(codec)
+		binary.BigEndian.PutUint32(buf[n+1:], rawSize)
+		trailer |= COMPRESSED_FLAG
+	}
+	if extended {
+		n -= LUMP_DATA_EXTENDED_PADDING_SIZE
+		binary.BigEndian.PutUint32(buf[n:], padding_len)
+	}
+	util.PutUINT16(buf[len(buf)-LUMP_DATA_TRAILER_SIZE:], trailer)
+}
+
+//decodeTrailer parses the tail of a data portion, and returns the size of lump data
+func decodeTrailer(buf []byte, length uint32) (t lumpTrailer, err error) {
+	n := len(buf) - LUMP_DATA_TRAILER_SIZE
+	if n < 0 {
+		return t, errors.Wrapf(internalerror.StorageCorrupted, "data trailer of %d bytes is too short", len(buf))
+	}
+	trailer := util.GetUINT16(buf[n:])
+	t.padding = uint32(trailer &^ (CHECKSUM_FLAG | COMPRESSED_FLAG))
+	overhead := uint64(LUMP_DATA_TRAILER_SIZE)
+	if trailer&CHECKSUM_FLAG != 0 {
+		t.hasChecksum = true
+		n -= LUMP_DATA_CHECKSUM_SIZE
+		t.sum = binary.BigEndian.Uint32(buf[n:])
+		overhead += LUMP_DATA_CHECKSUM_SIZE
+	}
+	if trailer&COMPRESSED_FLAG != 0 {
+		n -= LUMP_DATA_COMPRESSION_SIZE
+		t.codec = CompressionCodec(buf[n])
+		t.rawSize = binary.BigEndian.Uint32(buf[n+1:])
+		overhead += LUMP_DATA_COMPRESSION_SIZE
+		if t.codec == COMPRESSION_NONE || t.codec.validate() != nil || t.rawSize > lump.LUMP_MAX_SIZE {
+			return t, errors.Wrapf(internalerror.StorageCorrupted, "bad compression codec %d of %d bytes", t.codec, t.rawSize)
+		}
+	}
+	if t.padding == PADDING_EXTENDED {
+		t.extended = true
+		n -= LUMP_DATA_EXTENDED_PADDING_SIZE
+		if n < 0 {
+			return t, errors.Wrapf(internalerror.StorageCorrupted, "bad data trailer %x", trailer)
+		}
+		t.padding = binary.BigEndian.Uint32(buf[n:])
+		overhead += LUMP_DATA_EXTENDED_PADDING_SIZE
+	}
+	overhead += uint64(t.padding)
+	if overhead > uint64(length) {
+		return t, errors.Wrapf(internalerror.StorageCorrupted, "bad data trailer %x", trailer)
+	}
+	t.size = length - uint32(overhead)
+	if t.codec == COMPRESSION_NONE {
+		t.rawSize = t.size
+	}
+	return t, nil
+}
+
+//compress returns the lump data to store, it is compressed only if a block is saved
+func (region *DataRegion) compress(payload []byte) ([]byte, CompressionCodec) {
+	codec := region.compression
+	if codec == COMPRESSION_NONE || len(payload) < COMPRESSION_MIN_SIZE {
+		return payload, COMPRESSION_NONE
+	}
+	compressed, err := codec.compress(payload)
+	if err != nil || region.shiftBlockSize(uint32(len(compressed))+region.trailerSize(codec)) >=
+		region.shiftBlockSize(uint32(len(payload))+region.trailerSize(COMPRESSION_NONE)) {
+		return payload, COMPRESSION_NONE
 	}
+	return compressed, codec
 }
 
 func (region *DataRegion) shiftBlockSize(size uint32) uint32 {
@@ -46,68 +349,809 @@ func (region *DataRegion) shiftBlockSize(size uint32) uint32 {
       +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
       |                         Padding (Variable)
       +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-      |         Padding size          |
+      |    Codec      |     Size of Decompressed Lump Data (Optional)
+      +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+                      |
+      +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+      |                   CRC32C of Lump Data (Optional)              |
+      +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+      |C|Z|     Padding size          |
       +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+C: CRC32C flag, if it is set, the 4 bytes before padding size is the CRC32C
+Z: compressed flag, if it is set, the lump data is compressed by the codec, the CRC32C is of
+the decompressed lump data
 */
 
-//WARNING: this PUT would CHANGE (data *lump.LumpData),
+//Put writes the lump data and its trailer to a newly allocated portion, data is not changed.
+//The aligned part of data is written as is, only the last block is copied to append the trailer
 func (region *DataRegion) Put(data lump.LumpData) (portion.DataPortion, error) {
-	//
-	size := data.Inner.Len() + LUMP_DATA_TRAILER_SIZE
+	return region.PutWithCapacity(data, 0)
+}
 
-	//Aligned
-	data.Inner.AlignResize(size)
+//PutWithCapacity is the same as Put, but at least reserve more bytes are allocated after the lump
+//data, so the lump could be overwritten by a bigger one in place, see Overwrite
+func (region *DataRegion) PutWithCapacity(data lump.LumpData, reserve uint32) (portion.DataPortion, error) {
+	return region.putBytes(data.AsBytes(), reserve)
+}
 
-	trailer_offset := data.Inner.Len() - LUMP_DATA_TRAILER_SIZE
-	padding_len := data.Inner.Len() - size
+func (region *DataRegion) putBytes(raw []byte, reserve uint32) (portion.DataPortion, error) {
+	bufs, blocks, err := region.encode(raw, reserve, 0)
+	if err != nil {
+		return portion.DataPortion{}, err
+	}
+
+	data_portion, err := region.allocator.Allocate(blocks)
+	if err != nil {
+		return portion.DataPortion{}, err
+	}
+	region.allocated(data_portion)
 
-	if padding_len >= uint32(data.Inner.BlockSize().AsU16()) {
-		panic("data region put's align is wrong")
+	offset, _ := data_portion.ShiftBlockToBytes(region.block_size)
+	if _, err = region.nvm.Writev(bufs, int64(offset)); err != nil {
+		region.allocator.Release(data_portion)
+		return portion.DataPortion{}, err
 	}
-	util.PutUINT16(data.Inner.AsBytes()[trailer_offset:], uint16(padding_len))
 
-	required_blocks := region.shiftBlockSize(data.Inner.Len())
-	data_portion, err := region.allocator.Allocate(uint16(required_blocks))
+	return data_portion, err
+}
+
+//ExtentSize returns the size of the lump data in each extent of a lump larger than a portion but
+//the last one, see PutExtents. It is aligned to blocks, so the extents are written from the aligned
+//lump data as is
+func (region *DataRegion) ExtentSize() uint32 {
+	return (0xFFFF - 1) * uint32(region.block_size.AsU16())
+}
+
+//FitsPortion returns true if the lump of size bytes could be put into one portion
+func (region *DataRegion) FitsPortion(size uint64) bool {
+	return region.block_size.CeilAlign(size+uint64(region.trailerSize(COMPRESSION_NONE))) <= 0xFFFF*uint64(region.block_size.AsU16())
+}
+
+/*
+PutExtents splits the lump data into the extents of ExtentSize bytes, the last one has the rest,
+and writes each of them to a new portion as Put, so every extent has its own trailer. The portions
+are returned in the order of the data, they are released if any of them could not be written.
+*/
+func (region *DataRegion) PutExtents(data lump.LumpData) ([]portion.DataPortion, error) {
+	raw := data.AsBytes()
+	size := int(region.ExtentSize())
+	count := (len(raw) + size - 1) / size
+	if uint64(len(raw)) > lump.LARGE_LUMP_MAX_SIZE || count > lump.MAX_LUMP_EXTENTS {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "lump size %d is too big", len(raw))
+	}
+	extents := make([]portion.DataPortion, 0, count)
+	for offset := 0; offset < len(raw); offset += size {
+		end := offset + size
+		if end > len(raw) {
+			end = len(raw)
+		}
+		extent, err := region.putBytes(raw[offset:end], 0)
+		if err != nil {
+			for _, p := range extents {
+				region.Release(p)
+			}
+			return nil, err
+		}
+		extents = append(extents, extent)
+	}
+	return extents, nil
+}
+
+//PutReaderExtents is PutReader of a lump which may not fit in a portion, it is streamed into
+//the extents of ExtentSize bytes as PutExtents does, a lump fitting in a portion has one extent
+func (region *DataRegion) PutReaderExtents(reader io.Reader, size uint64) ([]portion.DataPortion, error) {
+	extentSize := uint64(region.ExtentSize())
+	if size > lump.LARGE_LUMP_MAX_SIZE || (size+extentSize-1)/extentSize > lump.MAX_LUMP_EXTENTS {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "lump size %d is too big", size)
+	}
+	if region.FitsPortion(size) {
+		p, err := region.PutReader(reader, size)
+		if err != nil {
+			return nil, err
+		}
+		return []portion.DataPortion{p}, nil
+	}
+	var extents []portion.DataPortion
+	for written := uint64(0); written < size; written += extentSize {
+		extent, err := region.PutReader(reader, util.Min(extentSize, size-written))
+		if err != nil {
+			for _, p := range extents {
+				region.Release(p)
+			}
+			return nil, err
+		}
+		extents = append(extents, extent)
+	}
+	return extents, nil
+}
 
+/*
+Overwrite writes the lump data into the portion of the old lump data, if the encoded data fits
+in it and no snapshot is open, otherwise ok is false and nothing is written. The portion is kept, the rest of it is the
+padding. A crash during the write could leave the portion torn, neither the old data nor the
+new data, it is found by Verify if the checksum is enabled.
+*/
+func (region *DataRegion) Overwrite(old portion.DataPortion, data lump.LumpData) (ok bool, err error) {
+	defer region.recoverPanic(old.Display(), &err)
+	//the old lump data may be read by a snapshot
+	if region.pins > 0 {
+		return false, nil
+	}
+	bufs, blocks, err := region.encode(data.AsBytes(), 0, old.Len)
+	if err != nil || blocks != old.Len {
+		return false, err
+	}
+	if region.cache != nil {
+		region.cache.remove(old.Start.AsU64())
+	}
+	offset, _ := old.ShiftBlockToBytes(region.block_size)
+	if _, err = region.nvm.Writev(bufs, int64(offset)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+encode returns the buffers of the lump data and its trailer, and the number of the blocks of them.
+At least reserve bytes are padded after the lump data, and the buffers take at least minBlocks.
+*/
+func (region *DataRegion) encode(raw []byte, reserve uint32, minBlocks uint16) (bufs [][]byte, blocks uint16, err error) {
+	var sum uint32
+	if region.checksum {
+		sum = crc32.Checksum(raw, castagnoliTable)
+	}
+	payload, codec := region.compress(raw)
+	size := uint32(len(payload)) + region.trailerSize(codec)
+
+	required_blocks := region.shiftBlockSize(size)
+	if required_blocks > 0xFFFF {
+		return nil, 0, errors.Wrapf(internalerror.InvalidInput, "lump size %d is too big", len(raw))
+	}
+	if reserve > 0 {
+		reserved := region.block_size.CeilAlign(uint64(size)+uint64(reserve)) / uint64(region.block_size.AsU16())
+		if reserved > 0xFFFF {
+			return nil, 0, errors.Wrapf(internalerror.InvalidInput, "lump size %d with %d reserved bytes is too big", len(raw), reserve)
+		}
+		required_blocks = uint32(reserved)
+	}
+	if required_blocks < uint32(minBlocks) {
+		required_blocks = uint32(minBlocks)
+	}
+
+	total := required_blocks * uint32(region.block_size.AsU16())
+	padding_len := total - size
+	extended := padding_len >= uint32(region.block_size.AsU16()) || padding_len >= PADDING_EXTENDED
+	if extended {
+		padding_len -= LUMP_DATA_EXTENDED_PADDING_SIZE
+	}
+	full := uint32(region.block_size.FloorAlign(uint64(len(payload))))
+	tail := block.NewAlignedBytes(int(total-full), region.block_size).AsBytes()
+	copy(tail, payload[full:])
+	region.encodeTrailer(tail, padding_len, sum, codec, uint32(len(raw)), extended)
+
+	bufs = [][]byte{tail}
+	if full > 0 {
+		bufs = [][]byte{payload[:full], tail}
+	}
+	return bufs, uint16(required_blocks), nil
+}
+
+//PutReader reads exactly size bytes from reader and streams them to the data region
+//chunk by chunk, the whole payload is never buffered in memory.
+//The on disk format is the same as Put, but the lump is never compressed
+func (region *DataRegion) PutReader(reader io.Reader, size uint64) (portion.DataPortion, error) {
+	if !region.FitsPortion(size) {
+		return portion.DataPortion{}, errors.Wrapf(internalerror.InvalidInput, "lump size %d is too big", size)
+	}
+
+	total := region.block_size.CeilAlign(size + uint64(region.trailerSize(COMPRESSION_NONE)))
+	padding_len := total - size - uint64(region.trailerSize(COMPRESSION_NONE))
+	//the padding of the blocks bigger than PADDING_EXTENDED may not fit in the trailer, as encode
+	extended := padding_len >= uint64(region.block_size.AsU16()) || padding_len >= PADDING_EXTENDED
+	if extended {
+		padding_len -= LUMP_DATA_EXTENDED_PADDING_SIZE
+	}
+
+	required_blocks := region.shiftBlockSize(uint32(total))
+	if required_blocks > 0xFFFF {
+		return portion.DataPortion{}, errors.Wrapf(internalerror.InvalidInput, "lump size %d is too big", size)
+	}
+	data_portion, err := region.allocator.Allocate(uint16(required_blocks))
 	if err != nil {
 		return portion.DataPortion{}, err
 	}
+	region.allocated(data_portion)
+
+	offset, _ := data_portion.ShiftBlockToBytes(region.block_size)
+
+	chunk := block.NewAlignedBytes(int(util.Min(STREAM_CHUNK_SIZE, total)), region.block_size)
+	hash := crc32.New(castagnoliTable)
+	var written uint64
+	for written < total {
+		n := util.Min(STREAM_CHUNK_SIZE, total-written)
+		chunk.Resize(uint32(n))
+		buf := chunk.AsBytes()
+
+		//payload bytes in this chunk, the rest is padding
+		var payload uint64
+		if size > written {
+			payload = util.Min(n, size-written)
+		}
+		if _, err = io.ReadFull(reader, buf[:payload]); err != nil {
+			region.allocator.Release(data_portion)
+			return portion.DataPortion{}, errors.Wrap(err, "failed to read lump data")
+		}
+		hash.Write(buf[:payload])
+		for i := payload; i < n; i++ {
+			buf[i] = 0
+		}
+
+		//the trailer is always in the last chunk
+		if written+n == total {
+			region.encodeTrailer(buf, uint32(padding_len), hash.Sum32(), COMPRESSION_NONE, 0, extended)
+		}
+
+		if _, err = region.nvm.WriteAt(buf, int64(offset+written)); err != nil {
+			region.allocator.Release(data_portion)
+			return portion.DataPortion{}, err
+		}
+		written += n
+	}
 
-	offset, len := data_portion.ShiftBlockToBytes(region.block_size)
-	if len != data.Inner.Len() {
-		panic(fmt.Sprintf("should be the same in data_region put userdata:%d , diskdata:%d",
-			data.Inner.Len(), len))
-		//FIXME
+	return data_portion, nil
+}
+
+//MoveForward copies the portion into a newly allocated portion in front of it.
+//The on disk bytes are copied as is, so the trailer and the checksum are kept.
+//ok is false if there is no free space before the portion
+func (region *DataRegion) MoveForward(old portion.DataPortion) (moved portion.DataPortion, ok bool, err error) {
+	moved, err = region.allocator.Allocate(old.Len)
+	if err != nil {
+		//no space is not an error for moving
+		return portion.DataPortion{}, false, nil
 	}
-	if _, err = region.nvm.Seek(int64(offset), io.SeekStart); err != nil {
-		return data_portion, err
+	if moved.Start >= old.Start {
+		region.allocator.Release(moved)
+		return portion.DataPortion{}, false, nil
 	}
-	if _, err = region.nvm.Write(data.Inner.AsBytes()); err != nil {
-		return data_portion, err
+	region.allocated(moved)
+
+	if err = region.copyPortion(old, moved); err != nil {
+		region.allocator.Release(moved)
+		return portion.DataPortion{}, false, err
 	}
+	return moved, true, nil
+}
 
-	return data_portion, err
+//copyPortion copies the on disk bytes of the portion from to the portion to, they have the same length
+func (region *DataRegion) copyPortion(from portion.DataPortion, to portion.DataPortion) (err error) {
+	defer region.recoverPanic(from.Display(), &err)
+	offset, len := from.ShiftBlockToBytes(region.block_size)
+	ab := block.NewAlignedBytes(int(len), region.block_size)
+	if _, err = region.nvm.ReadAt(ab.AsBytes(), int64(offset)); err != nil {
+		return err
+	}
+
+	offset, _ = to.ShiftBlockToBytes(region.block_size)
+	_, err = region.nvm.WriteAt(ab.AsBytes(), int64(offset))
+	return err
+}
+
+/*
+Pin keeps the lump data of the portions in use until Unpin, so a snapshot could read them after
+the lumps are changed: the released portions are not freed, and Overwrite writes nothing.
+*/
+func (region *DataRegion) Pin() {
+	region.pins++
+}
+
+//Unpin frees the portions released since the first Pin, after it is called as many times as Pin
+func (region *DataRegion) Unpin() {
+	region.pins--
+	if region.pins > 0 {
+		return
+	}
+	for _, p := range region.pinned {
+		region.release(p)
+	}
+	region.pinned = nil
+}
+
+//Pinned returns true if there is any open snapshot, see Pin
+func (region *DataRegion) Pinned() bool {
+	return region.pins > 0
+}
+
+//pinnedBlocks returns the number of the blocks released but not freed because of Pin
+func (region *DataRegion) pinnedBlocks() (blocks uint64) {
+	for _, p := range region.pinned {
+		blocks += uint64(p.Len)
+	}
+	return
 }
 
 func (region *DataRegion) Release(portion portion.DataPortion) {
-	region.allocator.Release(portion)
+	if region.pins > 0 {
+		region.pinned = append(region.pinned, portion)
+		return
+	}
+	region.release(portion)
 }
 
-func (region *DataRegion) Get(portion portion.DataPortion) (lump.LumpData, error) {
-	offset, len := portion.ShiftBlockToBytes(region.block_size)
+func (region *DataRegion) release(portion portion.DataPortion) {
+	region.allocator.Release(portion)
+	if region.cache != nil {
+		region.cache.remove(portion.Start.AsU64())
+	}
+	//the hole is punched after the next journal sync
+	if region.punchHoles {
+		region.punches = append(region.punches, pendingPunch{portion, region.journalSyncs()})
+	}
+}
 
-	if _, err := region.nvm.Seek(int64(offset), io.SeekStart); err != nil {
+//Get reads the portion with ReadAt, which does not share the cursor of nvm, so Get, GetReader
+//and Size could be called in parallel. They must not run with Put or Release
+func (region *DataRegion) Get(portion portion.DataPortion) (_ lump.LumpData, err error) {
+	defer region.recoverPanic(portion.Display(), &err)
+	if region.cache != nil {
+		if data, ok := region.cache.get(portion.Start.AsU64(), uint64(portion.Len)); ok {
+			//the cached data is never modified by the caller
+			lumpData := lump.NewLumpDataAligned(len(data), region.block_size)
+			copy(lumpData.AsBytes(), data)
+			return lumpData, nil
+		}
+	}
+	_, length := portion.ShiftBlockToBytes(region.block_size)
+	ab := block.NewAlignedBytes(int(length), region.block_size)
+	var decompressed *block.AlignedBytes
+	data, err := region.readPortion(portion, ab.AsBytes(), func(size uint32) []byte {
+		decompressed = block.NewAlignedBytes(int(size), region.block_size)
+		return decompressed.AsBytes()
+	})
+	if err != nil {
 		return lump.LumpData{}, err
 	}
+	if decompressed != nil {
+		ab = decompressed
+	} else {
+		ab.Resize(uint32(len(data)))
+	}
+	if region.cache != nil {
+		region.cache.add(portion.Start.AsU64(), uint64(portion.Len), append([]byte{}, ab.AsBytes()...))
+	}
+	return lump.NewLumpDataWithAb(ab), nil
+}
 
-	ab := block.NewAlignedBytes(int(len), region.block_size)
+//GetPooled is the same as Get, but the lump data is read into a PooledBuffer, the caller must release it
+func (region *DataRegion) GetPooled(portion portion.DataPortion) (_ *PooledBuffer, err error) {
+	defer region.recoverPanic(portion.Display(), &err)
+	_, length := portion.ShiftBlockToBytes(region.block_size)
+	buf := newPooledBuffer(length, region.block_size)
+	if region.cache != nil {
+		if data, ok := region.cache.get(portion.Start.AsU64(), uint64(portion.Len)); ok {
+			if uint32(copy(buf.AsBytes(), data)) < uint32(len(data)) {
+				//a compressed lump may be bigger than its portion
+				buf.Release()
+				buf = newPooledBuffer(uint32(len(data)), region.block_size)
+				copy(buf.AsBytes(), data)
+			}
+			buf.size = uint32(len(data))
+			return buf, nil
+		}
+	}
+	var decompressed *PooledBuffer
+	data, err := region.readPortion(portion, buf.AsBytes(), func(size uint32) []byte {
+		decompressed = newPooledBuffer(size, region.block_size)
+		return decompressed.AsBytes()
+	})
+	if decompressed != nil {
+		buf.Release()
+		buf = decompressed
+	}
+	if err != nil {
+		buf.Release()
+		return nil, err
+	}
+	buf.size = uint32(len(data))
+	if region.cache != nil {
+		region.cache.add(portion.Start.AsU64(), uint64(portion.Len), append([]byte{}, buf.AsBytes()...))
+	}
+	return buf, nil
+}
 
-	if _, err := region.nvm.Read(ab.AsBytes()); err != nil {
+//GetExtents reads the lump data of the extents of a lump into one buffer, see PutExtents
+func (region *DataRegion) GetExtents(extents []portion.DataPortion) (lump.LumpData, error) {
+	var ab *block.AlignedBytes
+	err := region.readExtents(extents, func(size uint32) []byte {
+		ab = block.NewAlignedBytes(int(size), region.block_size)
+		return ab.AsBytes()
+	})
+	if err != nil {
 		return lump.LumpData{}, err
 	}
+	return lump.NewLumpDataWithAb(ab), nil
+}
 
-	padding_size := uint32(util.GetUINT16(ab.AsBytes()[ab.Len()-2:]))
+//GetPooledExtents is the same as GetExtents, but the lump data is read into a PooledBuffer
+func (region *DataRegion) GetPooledExtents(extents []portion.DataPortion) (*PooledBuffer, error) {
+	var buf *PooledBuffer
+	err := region.readExtents(extents, func(size uint32) []byte {
+		buf = newPooledBuffer(size, region.block_size)
+		return buf.AsBytes()
+	})
+	if err != nil {
+		if buf != nil {
+			buf.Release()
+		}
+		return nil, err
+	}
+	return buf, nil
+}
 
-	ab.Resize(ab.Len() - padding_size - LUMP_DATA_TRAILER_SIZE)
-	return lump.NewLumpDataWithAb(ab), nil
+//readExtents reads the sizes of the extents from their trailers, and then the extents one by one
+//into the buffer of their total size returned by alloc, so at most one extent is buffered more
+func (region *DataRegion) readExtents(extents []portion.DataPortion, alloc func(size uint32) []byte) (err error) {
+	defer region.recoverPanic(fmt.Sprintf("%d extents", len(extents)), &err)
+	sizes := make([]uint32, len(extents))
+	var total uint64
+	for i, p := range extents {
+		if sizes[i], err = region.Size(p); err != nil {
+			return err
+		}
+		total += uint64(sizes[i])
+	}
+	if total > lump.LARGE_LUMP_MAX_SIZE {
+		return errors.Wrapf(internalerror.StorageCorrupted, "%d extents have %d bytes", len(extents), total)
+	}
+	buf := alloc(uint32(total))
+	for i, p := range extents {
+		data, err := region.Get(p)
+		if err != nil {
+			return err
+		}
+		if len(data.AsBytes()) != int(sizes[i]) {
+			return errors.Wrapf(internalerror.StorageCorrupted, "the size of %s is changed", p.Display())
+		}
+		buf = buf[copy(buf, data.AsBytes()):]
+	}
+	return nil
+}
+
+/*
+readPortion reads the whole portion into buf and verifies it, the lump data is returned.
+It is buf[:size] if the lump is not compressed, otherwise it is decompressed into the buffer
+returned by decompressed.
+*/
+func (region *DataRegion) readPortion(portion portion.DataPortion, buf []byte,
+	decompressed func(size uint32) []byte) ([]byte, error) {
+	offset, _ := portion.ShiftBlockToBytes(region.block_size)
+	if _, err := region.nvm.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	return region.decodePortion(portion, buf, decompressed)
+}
+
+//decodePortion verifies the bytes of the portion already read into buf, see readPortion
+func (region *DataRegion) decodePortion(portion portion.DataPortion, buf []byte,
+	decompressed func(size uint32) []byte) ([]byte, error) {
+	_, length := portion.ShiftBlockToBytes(region.block_size)
+	trailer, err := decodeTrailer(buf[:length], length)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad trailer of %s", portion.Display())
+	}
+	if err = region.checkPadding(trailer, portion); err != nil {
+		return nil, err
+	}
+	data := buf[:trailer.size]
+	if trailer.codec != COMPRESSION_NONE {
+		raw := decompressed(trailer.rawSize)
+		if err = trailer.codec.decompress(data, raw); err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress %s", portion.Display())
+		}
+		data = raw
+	}
+	if trailer.hasChecksum && crc32.Checksum(data, castagnoliTable) != trailer.sum {
+		return nil, errors.Wrapf(internalerror.StorageCorrupted, "checksum mismatch for %s", portion.Display())
+	}
+	return data, nil
+}
+
+/*
+GetMulti reads the lump data of all the portions, the result is in the order of portions.
+The portions not in the cache are read in the order of their offsets, and the adjacent ones are
+read by one ReadAt of at most MULTI_GET_MAX_READ bytes, so it takes much less seeks than Get
+one by one. The lump data of a read share a buffer.
+*/
+func (region *DataRegion) GetMulti(portions []portion.DataPortion) (_ [][]byte, err error) {
+	defer region.recoverPanic(fmt.Sprintf("%d portions", len(portions)), &err)
+	result := make([][]byte, len(portions))
+	order := make([]int, 0, len(portions))
+	for i, p := range portions {
+		if region.cache != nil {
+			if data, ok := region.cache.get(p.Start.AsU64(), uint64(p.Len)); ok {
+				result[i] = append([]byte{}, data...)
+				continue
+			}
+		}
+		order = append(order, i)
+	}
+	blockSize := uint64(region.block_size.AsU16())
+	for _, run := range splitRuns(portions, order, MULTI_GET_MAX_READ/blockSize) {
+		buf := block.NewAlignedBytes(int((run.end-run.start)*blockSize), region.block_size).AsBytes()
+		if _, err := region.nvm.ReadAt(buf, int64(run.start*blockSize)); err != nil {
+			return nil, err
+		}
+		for _, i := range run.members {
+			p := portions[i]
+			offset := (p.Start.AsU64() - run.start) * blockSize
+			data, err := region.decodePortion(p, buf[offset:offset+uint64(p.Len)*blockSize], func(size uint32) []byte {
+				return make([]byte, size)
+			})
+			if err != nil {
+				return nil, err
+			}
+			result[i] = data
+			if region.cache != nil {
+				region.cache.add(p.Start.AsU64(), uint64(p.Len), append([]byte{}, data...))
+			}
+		}
+	}
+	return result, nil
+}
+
+//portionRun is the adjacent portions read at once, [start, end) are in blocks
+type portionRun struct {
+	start   uint64
+	end     uint64
+	members []int
+}
+
+//splitRuns sorts the portions of order by offset, and splits them into the runs of at most maxBlocks
+func splitRuns(portions []portion.DataPortion, order []int, maxBlocks uint64) []portionRun {
+	sort.Slice(order, func(i, j int) bool { return portions[order[i]].Start < portions[order[j]].Start })
+	var runs []portionRun
+	for _, i := range order {
+		p := portions[i]
+		start, end := p.Start.AsU64(), p.Start.AsU64()+uint64(p.Len)
+		if n := len(runs); n > 0 {
+			run := &runs[n-1]
+			//a portion read twice is in the same run
+			runEnd := run.end
+			if end > runEnd {
+				runEnd = end
+			}
+			if start <= run.end && runEnd-run.start <= maxBlocks {
+				run.end = runEnd
+				run.members = append(run.members, i)
+				continue
+			}
+		}
+		runs = append(runs, portionRun{start: start, end: end, members: []int{i}})
+	}
+	return runs
+}
+
+/*
+Prefetch hints that the portions would be read soon. They are read into the cache if it is
+enabled, otherwise the nvm reads them ahead if it is a nvm.Prefetcher, such as a FileNVM
+opened without direct I/O. The adjacent portions are merged as GetMulti does.
+*/
+func (region *DataRegion) Prefetch(portions []portion.DataPortion) error {
+	if region.cache != nil {
+		_, err := region.GetMulti(portions)
+		return err
+	}
+	prefetcher, ok := region.nvm.(nvm.Prefetcher)
+	if !ok {
+		return nil
+	}
+	order := make([]int, len(portions))
+	for i := range order {
+		order[i] = i
+	}
+	blockSize := uint64(region.block_size.AsU16())
+	for _, run := range splitRuns(portions, order, MULTI_GET_MAX_READ/blockSize) {
+		if err := prefetcher.WillNeed(run.start*blockSize, (run.end-run.start)*blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//GetReader returns a reader over the lump data of the portion.
+//A cached lump is read from memory, otherwise only the last block is read here to find the padding size,
+//the data is read chunk by chunk when the reader is consumed. A compressed lump is read and
+//decompressed at once.
+func (region *DataRegion) GetReader(portion portion.DataPortion) (_ io.ReadCloser, err error) {
+	defer region.recoverPanic(portion.Display(), &err)
+	if region.cache != nil {
+		if data, ok := region.cache.get(portion.Start.AsU64(), uint64(portion.Len)); ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	offset, _ := portion.ShiftBlockToBytes(region.block_size)
+	trailer, err := region.readTrailer(portion)
+	if err != nil {
+		return nil, err
+	}
+	if trailer.codec != COMPRESSION_NONE {
+		data, err := region.Get(portion)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data.AsBytes())), nil
+	}
+
+	reader := &dataPortionReader{
+		region:    region,
+		portion:   portion,
+		offset:    offset,
+		remaining: uint64(trailer.size),
+	}
+	if trailer.hasChecksum {
+		reader.hash = crc32.New(castagnoliTable)
+		reader.sum = trailer.sum
+	}
+	return reader, nil
+}
+
+//GetExtentsReader returns a reader over the extents of a lump, each of them is read by GetReader
+//when the previous one is read up
+func (region *DataRegion) GetExtentsReader(extents []portion.DataPortion) io.ReadCloser {
+	return &extentsReader{region: region, extents: extents}
+}
+
+//Size returns the size of lump data in the portion, only the last block is read
+func (region *DataRegion) Size(portion portion.DataPortion) (_ uint32, err error) {
+	defer region.recoverPanic(portion.Display(), &err)
+	trailer, err := region.readTrailer(portion)
+	return trailer.rawSize, err
+}
+
+//Verify checks the trailer of the portion is sane, the whole portion is read to verify the checksum if deep
+func (region *DataRegion) Verify(portion portion.DataPortion, deep bool) (err error) {
+	defer region.recoverPanic(portion.Display(), &err)
+	_, err = region.readTrailer(portion)
+	if err != nil {
+		return err
+	}
+	if !deep {
+		return nil
+	}
+	_, length := portion.ShiftBlockToBytes(region.block_size)
+	buf := block.NewAlignedBytes(int(length), region.block_size)
+	_, err = region.readPortion(portion, buf.AsBytes(), func(size uint32) []byte {
+		return make([]byte, size)
+	})
+	return err
+}
+
+func (region *DataRegion) readTrailer(portion portion.DataPortion) (lumpTrailer, error) {
+	offset, len := portion.ShiftBlockToBytes(region.block_size)
+	blockSize := uint64(region.block_size.AsU16())
+
+	lastBlock := block.NewAlignedBytes(int(blockSize), region.block_size)
+	if _, err := region.nvm.ReadAt(lastBlock.AsBytes(), int64(offset+uint64(len)-blockSize)); err != nil {
+		return lumpTrailer{}, err
+	}
+	trailer, err := decodeTrailer(lastBlock.AsBytes(), len)
+	if err != nil {
+		return trailer, err
+	}
+	return trailer, region.checkPadding(trailer, portion)
+}
+
+//checkPadding returns an error if the padding is impossible for Put, which pads the lump to the next block, unless the padding is extended
+func (region *DataRegion) checkPadding(trailer lumpTrailer, portion portion.DataPortion) error {
+	if !trailer.extended && trailer.padding >= uint32(region.block_size.AsU16()) {
+		return errors.Wrapf(internalerror.StorageCorrupted, "bad padding %d for %s", trailer.padding, portion.Display())
+	}
+	return nil
+}
+
+type extentsReader struct {
+	region  *DataRegion
+	extents []portion.DataPortion
+	//current is the reader of the extent being read, it is nil before the next extent
+	current io.ReadCloser
+}
+
+func (reader *extentsReader) Read(p []byte) (int, error) {
+	for {
+		if reader.current == nil {
+			if len(reader.extents) == 0 {
+				return 0, io.EOF
+			}
+			current, err := reader.region.GetReader(reader.extents[0])
+			if err != nil {
+				return 0, err
+			}
+			reader.current = current
+			reader.extents = reader.extents[1:]
+		}
+		n, err := reader.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		reader.current.Close()
+		reader.current = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (reader *extentsReader) Close() error {
+	reader.extents = nil
+	if reader.current == nil {
+		return nil
+	}
+	err := reader.current.Close()
+	reader.current = nil
+	return err
+}
+
+type dataPortionReader struct {
+	region    *DataRegion
+	portion   portion.DataPortion
+	offset    uint64
+	remaining uint64
+	buf       *block.AlignedBytes
+	pending   []byte
+	closed    bool
+	//hash is nil if the lump has no checksum
+	hash hash.Hash32
+	sum  uint32
+}
+
+func (reader *dataPortionReader) Read(p []byte) (_ int, err error) {
+	defer reader.region.recoverPanic(reader.portion.Display(), &err)
+	if reader.closed {
+		return 0, errors.Wrap(internalerror.InvalidInput, "read on closed reader")
+	}
+	if len(reader.pending) == 0 {
+		if reader.remaining == 0 {
+			//all the data is read, verify it
+			if reader.hash != nil && reader.hash.Sum32() != reader.sum {
+				return 0, errors.Wrapf(internalerror.StorageCorrupted, "checksum mismatch for %s", reader.portion.Display())
+			}
+			return 0, io.EOF
+		}
+		if err := reader.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+func (reader *dataPortionReader) fill() error {
+	region := reader.region
+	chunk := util.Min(STREAM_CHUNK_SIZE, region.block_size.CeilAlign(reader.remaining))
+	if reader.buf == nil {
+		reader.buf = block.NewAlignedBytes(int(chunk), region.block_size)
+	}
+	reader.buf.Resize(uint32(chunk))
+
+	if _, err := region.nvm.ReadAt(reader.buf.AsBytes(), int64(reader.offset)); err != nil {
+		return err
+	}
+
+	payload := util.Min(chunk, reader.remaining)
+	reader.pending = reader.buf.AsBytes()[:payload]
+	if reader.hash != nil {
+		reader.hash.Write(reader.pending)
+	}
+	reader.offset += chunk
+	reader.remaining -= payload
+	return nil
+}
+
+func (reader *dataPortionReader) Close() error {
+	reader.closed = true
+	reader.buf = nil
+	reader.pending = nil
+	return nil
 }
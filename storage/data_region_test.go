@@ -1,13 +1,22 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/portion"
 	"github.com/thesues/cannyls-go/storage/allocator"
 )
 
@@ -29,3 +38,553 @@ func TestDataRegion(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []byte("foo"), get_lump_data.AsBytes())
 }
+
+func TestDataRegionPutKeepsData(t *testing.T) {
+	var capacity_bytes uint32 = 64 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	nvm, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	region := NewDataRegion(alloc, nvm)
+
+	for _, size := range []int{0, 3, 510, 512, 1024, 5000} {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		put_lump_data := lump.NewLumpDataAligned(size, block.Min())
+		copy(put_lump_data.AsBytes(), payload)
+		p, err := region.Put(put_lump_data)
+		assert.Nil(t, err)
+		//the data could be put again
+		assert.Equal(t, payload, put_lump_data.AsBytes())
+
+		get_lump_data, err := region.Get(p)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, get_lump_data.AsBytes())
+	}
+}
+
+func TestDataRegionPutReader(t *testing.T) {
+	var capacity_bytes uint32 = 4 * 1024 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	nvm, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	region := NewDataRegion(alloc, nvm)
+
+	//bigger than one chunk, and not aligned
+	payload := make([]byte, STREAM_CHUNK_SIZE+1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	p, err := region.PutReader(bytes.NewReader(payload), uint64(len(payload)))
+	assert.Nil(t, err)
+
+	get_lump_data, err := region.Get(p)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, get_lump_data.AsBytes())
+
+	reader, err := region.GetReader(p)
+	assert.Nil(t, err)
+	read_data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, read_data)
+	assert.Nil(t, reader.Close())
+	_, err = reader.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	//reader is shorter than size, the portion is released
+	free := alloc.FreeCount()
+	_, err = region.PutReader(bytes.NewReader([]byte("foo")), 1024)
+	assert.Error(t, err)
+	assert.Equal(t, free, alloc.FreeCount())
+}
+
+//bigBlockNVM is a MemoryNVM with a bigger block size
+type bigBlockNVM struct {
+	nvm.NonVolatileMemory
+	blockSize block.BlockSize
+}
+
+func (big *bigBlockNVM) BlockSize() block.BlockSize {
+	return big.blockSize
+}
+
+func TestDataRegionPutReaderBigBlocks(t *testing.T) {
+	var capacity_bytes uint32 = 4 * 1024 * 1024
+	for _, bs := range []uint16{16384, 32768} {
+		blockSize, err := block.NewBlockSize(bs)
+		assert.Nil(t, err)
+		alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(bs))
+		inner, err := nvm.New(uint64(capacity_bytes))
+		assert.Nil(t, err)
+		region := NewDataRegion(alloc, &bigBlockNVM{NonVolatileMemory: inner, blockSize: blockSize})
+
+		//the padding of the small lumps is more than PADDING_EXTENDED with 32K blocks
+		for _, size := range []int{0, 100, int(bs) - 6, int(bs) + 1} {
+			payload := make([]byte, size)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			p, err := region.PutReader(bytes.NewReader(payload), uint64(len(payload)))
+			if !assert.Nil(t, err) {
+				continue
+			}
+			get_lump_data, err := region.Get(p)
+			assert.Nil(t, err, "block size %d, lump size %d", bs, size)
+			assert.Equal(t, payload, get_lump_data.AsBytes())
+		}
+	}
+}
+
+func TestDataRegionChecksum(t *testing.T) {
+	var capacity_bytes uint32 = 4 * 1024 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	nvm, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	region := NewDataRegion(alloc, nvm)
+
+	//lump without checksum
+	plain := lump.NewLumpDataAligned(3, block.Min())
+	copy(plain.AsBytes(), []byte("foo"))
+	plainPortion, err := region.Put(plain)
+	assert.Nil(t, err)
+
+	region.SetChecksum(true)
+	//510 bytes does not fit into one block with the checksum
+	data := lump.NewLumpDataAligned(510, block.Min())
+	for i := range data.AsBytes() {
+		data.AsBytes()[i] = 'x'
+	}
+	p, err := region.Put(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(2), p.Len)
+
+	get_lump_data, err := region.Get(p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(510), get_lump_data.Inner.Len())
+
+	//old lumps are still readable
+	get_lump_data, err = region.Get(plainPortion)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), get_lump_data.AsBytes())
+
+	payload := make([]byte, 3000)
+	streamed, err := region.PutReader(bytes.NewReader(payload), uint64(len(payload)))
+	assert.Nil(t, err)
+	reader, err := region.GetReader(streamed)
+	assert.Nil(t, err)
+	read_data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, read_data)
+
+	//corrupt the data
+	offset, _ := p.ShiftBlockToBytes(block.Min())
+	nvm.AsBytes()[offset] = 'y'
+	_, err = region.Get(p)
+	assert.Error(t, err)
+
+	offset, _ = streamed.ShiftBlockToBytes(block.Min())
+	nvm.AsBytes()[offset] = 1
+	reader, err = region.GetReader(streamed)
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+}
+
+func TestDataRegionConcurrentGet(t *testing.T) {
+	var capacity_bytes uint32 = 1024 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	file, err := nvm.CreateIfAbsent("tmp31.lusf", uint64(capacity_bytes))
+	assert.Nil(t, err)
+	defer os.Remove("tmp31.lusf")
+	defer file.Close()
+	region := NewDataRegion(alloc, file)
+	assert.Nil(t, region.SetCache(16*1024, CACHE_LRU))
+
+	var portions []portion.DataPortion
+	for i := 0; i < 32; i++ {
+		data := lump.NewLumpDataAligned(1000+i, block.Min())
+		for j := range data.AsBytes() {
+			data.AsBytes()[j] = byte(i)
+		}
+		p, err := region.Put(data)
+		assert.Nil(t, err)
+		portions = append(portions, p)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for round := 0; round < 20; round++ {
+				i := (g*7 + round) % len(portions)
+				data, err := region.Get(portions[i])
+				assert.Nil(t, err)
+				assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1000+i), data.AsBytes())
+				size, err := region.Size(portions[i])
+				assert.Nil(t, err)
+				assert.Equal(t, uint32(1000+i), size)
+			}
+		}(g)
+	}
+	wg.Wait()
+	stats := region.CacheStats()
+	assert.Equal(t, uint64(8*20), stats.Hits+stats.Misses)
+}
+
+func TestDataRegionGetPooled(t *testing.T) {
+	var capacity_bytes uint32 = 64 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	nvm, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	region := NewDataRegion(alloc, nvm)
+	region.SetChecksum(true)
+
+	put_lump_data := lump.NewLumpDataAligned(5000, block.Min())
+	for i := range put_lump_data.AsBytes() {
+		put_lump_data.AsBytes()[i] = byte(i)
+	}
+	p, err := region.Put(put_lump_data)
+	assert.Nil(t, err)
+
+	buf, err := region.GetPooled(p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5000), buf.Len())
+	assert.Equal(t, put_lump_data.AsBytes(), buf.AsBytes())
+	assert.Equal(t, put_lump_data.AsBytes(), buf.LumpData().AsBytes())
+
+	//shared by two users
+	buf.Retain()
+	buf.Release()
+	assert.Equal(t, put_lump_data.AsBytes(), buf.AsBytes())
+	buf.Release()
+	assert.Panics(t, func() { buf.Release() })
+
+	small := lump.NewLumpDataAligned(3, block.Min())
+	copy(small.AsBytes(), []byte("foo"))
+	p, err = region.Put(small)
+	assert.Nil(t, err)
+	buf, err = region.GetPooled(p)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), buf.AsBytes())
+	buf.Release()
+}
+
+func TestBufferClass(t *testing.T) {
+	assert.Equal(t, 0, bufferClass(512))
+	assert.Equal(t, 0, bufferClass(POOLED_BUFFER_MIN_SIZE))
+	assert.Equal(t, 1, bufferClass(POOLED_BUFFER_MIN_SIZE+512))
+	assert.Equal(t, 2, bufferClass(POOLED_BUFFER_MIN_SIZE*4))
+	assert.Equal(t, POOLED_BUFFER_CLASSES-1, bufferClass(lump.LUMP_MAX_SIZE+2))
+}
+
+func TestDataRegionCompression(t *testing.T) {
+	var capacity_bytes uint32 = 4 * 1024 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	nvm, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	region := NewDataRegion(alloc, nvm)
+	assert.Error(t, region.SetCompression(CompressionCodec(9)))
+
+	compressible := bytes.Repeat([]byte("cannyls "), 8192)
+	random := make([]byte, 8192)
+	rand.Read(random)
+
+	for _, codec := range []CompressionCodec{COMPRESSION_LZ4, COMPRESSION_DEFLATE} {
+		for _, checksum := range []bool{false, true} {
+			assert.Nil(t, region.SetCompression(codec))
+			region.SetChecksum(checksum)
+
+			put_lump_data := lump.NewLumpDataAligned(len(compressible), block.Min())
+			copy(put_lump_data.AsBytes(), compressible)
+			p, err := region.Put(put_lump_data)
+			assert.Nil(t, err)
+			assert.True(t, p.Len < 16)
+			assert.Equal(t, compressible, put_lump_data.AsBytes())
+
+			get_lump_data, err := region.Get(p)
+			assert.Nil(t, err)
+			assert.Equal(t, compressible, get_lump_data.AsBytes())
+			size, err := region.Size(p)
+			assert.Nil(t, err)
+			assert.Equal(t, uint32(len(compressible)), size)
+			reader, err := region.GetReader(p)
+			assert.Nil(t, err)
+			read_data, err := ioutil.ReadAll(reader)
+			assert.Nil(t, err)
+			assert.Equal(t, compressible, read_data)
+			buf, err := region.GetPooled(p)
+			assert.Nil(t, err)
+			assert.Equal(t, compressible, buf.AsBytes())
+			buf.Release()
+
+			//incompressible data is stored as is
+			put_lump_data = lump.NewLumpDataAligned(len(random), block.Min())
+			copy(put_lump_data.AsBytes(), random)
+			p, err = region.Put(put_lump_data)
+			assert.Nil(t, err)
+			assert.True(t, p.Len > 16)
+			get_lump_data, err = region.Get(p)
+			assert.Nil(t, err)
+			assert.Equal(t, random, get_lump_data.AsBytes())
+		}
+	}
+
+	//the lumps put before are still readable without compression
+	assert.Nil(t, region.SetCompression(COMPRESSION_LZ4))
+	put_lump_data := lump.NewLumpDataAligned(len(compressible), block.Min())
+	copy(put_lump_data.AsBytes(), compressible)
+	p, err := region.Put(put_lump_data)
+	assert.Nil(t, err)
+	assert.Nil(t, region.SetCompression(COMPRESSION_NONE))
+	get_lump_data, err := region.Get(p)
+	assert.Nil(t, err)
+	assert.Equal(t, compressible, get_lump_data.AsBytes())
+
+	//corrupt the compressed data
+	offset, _ := p.ShiftBlockToBytes(block.Min())
+	nvm.AsBytes()[offset] = 0xFF
+	_, err = region.Get(p)
+	assert.Error(t, err)
+}
+
+func TestDataRegionPutWithCapacity(t *testing.T) {
+	var capacity_bytes uint32 = 1024 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	nvm, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	region := NewDataRegion(alloc, nvm)
+	region.SetChecksum(true)
+
+	data := func(size int) lump.LumpData {
+		d := lump.NewLumpDataAligned(size, block.Min())
+		for i := range d.AsBytes() {
+			d.AsBytes()[i] = byte(i)
+		}
+		return d
+	}
+	//the padding is extended, even bigger than 0x3FFF
+	p, err := region.PutWithCapacity(data(100), 20000)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(40), p.Len)
+	got, err := region.Get(p)
+	assert.Nil(t, err)
+	assert.Equal(t, data(100).AsBytes(), got.AsBytes())
+	assert.Nil(t, region.Verify(p, true))
+	size, err := region.Size(p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(100), size)
+
+	//the reserved space is used by Overwrite
+	for _, n := range []int{1000, 20000, 0} {
+		ok, err := region.Overwrite(p, data(n))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		got, err = region.Get(p)
+		assert.Nil(t, err)
+		assert.Equal(t, data(n).AsBytes(), got.AsBytes())
+		assert.Nil(t, region.Verify(p, true))
+	}
+	ok, err := region.Overwrite(p, data(21000))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, err = region.PutWithCapacity(data(100), 0xFFFF*512)
+	assert.Error(t, err)
+}
+
+//countingNVM counts the reads
+type countingNVM struct {
+	nvm.NonVolatileMemory
+	reads int
+}
+
+func (counting *countingNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	counting.reads++
+	return counting.NonVolatileMemory.ReadAt(buf, offset)
+}
+
+func TestDataRegionGetMulti(t *testing.T) {
+	var capacity_bytes uint32 = 1024 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	inner, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	counting := &countingNVM{NonVolatileMemory: inner}
+	region := NewDataRegion(alloc, counting)
+	region.SetChecksum(true)
+
+	var portions []portion.DataPortion
+	var payloads [][]byte
+	for i := 0; i < 10; i++ {
+		payload := make([]byte, 100*i+1)
+		for j := range payload {
+			payload[j] = byte(i + j)
+		}
+		data := lump.NewLumpDataAligned(len(payload), block.Min())
+		copy(data.AsBytes(), payload)
+		p, err := region.Put(data)
+		assert.Nil(t, err)
+		portions = append(portions, p)
+		payloads = append(payloads, payload)
+	}
+	//a gap splits the lumps into two reads
+	region.Release(portions[5])
+	portions = append(portions[:5], portions[6:]...)
+	payloads = append(payloads[:5], payloads[6:]...)
+
+	//random order with a duplicate
+	order := []int{7, 0, 3, 8, 1, 3, 6, 2, 5, 4}
+	query := make([]portion.DataPortion, len(order))
+	for i, o := range order {
+		query[i] = portions[o]
+	}
+	counting.reads = 0
+	result, err := region.GetMulti(query)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, counting.reads)
+	for i, o := range order {
+		assert.Equal(t, payloads[o], result[i])
+	}
+
+	result, err = region.GetMulti(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(result))
+}
+
+func TestDataRegionPrefetch(t *testing.T) {
+	var capacity_bytes uint32 = 1024 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	inner, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	counting := &countingNVM{NonVolatileMemory: inner}
+	region := NewDataRegion(alloc, counting)
+
+	var portions []portion.DataPortion
+	for i := 0; i < 4; i++ {
+		data := lump.NewLumpDataAligned(1000, block.Min())
+		p, err := region.Put(data)
+		assert.Nil(t, err)
+		portions = append(portions, p)
+	}
+	//without the cache, the memory nvm could not read ahead
+	counting.reads = 0
+	assert.Nil(t, region.Prefetch(portions))
+	assert.Equal(t, 0, counting.reads)
+
+	assert.Nil(t, region.SetCache(64*1024, CACHE_LRU))
+	assert.Nil(t, region.Prefetch(portions))
+	assert.Equal(t, 1, counting.reads)
+	for _, p := range portions {
+		_, err := region.Get(p)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, counting.reads)
+}
+
+//panickyNVM panics on ReadAt, as a lower layer failing an assertion on a broken portion
+type panickyNVM struct {
+	nvm.NonVolatileMemory
+}
+
+func (panicky *panickyNVM) ReadAt(buf []byte, offset int64) (int, error) {
+	panic("assertion failed")
+}
+
+func TestDataRegionPanicFree(t *testing.T) {
+	var capacity_bytes uint32 = 64 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	inner, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	region := NewDataRegion(alloc, inner)
+	data := lump.NewLumpDataAligned(100, block.Min())
+	p, err := region.Put(data)
+	assert.Nil(t, err)
+
+	//an empty portion is rejected without panic
+	_, err = region.Get(portion.DataPortion{Start: p.Start, Len: 0})
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+
+	region = NewDataRegion(alloc, &panickyNVM{NonVolatileMemory: inner})
+	assert.Panics(t, func() { region.Get(p) })
+	region.SetPanicFree(true)
+	_, err = region.Get(p)
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+	_, err = region.GetPooled(p)
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+	_, err = region.GetMulti([]portion.DataPortion{p})
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+	_, err = region.GetReader(p)
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(region.Verify(p, true)))
+}
+
+type punchingNVM struct {
+	nvm.NonVolatileMemory
+	punched []uint64
+	err     error
+}
+
+func (punching *punchingNVM) PunchHole(offset uint64, length uint64) error {
+	if punching.err != nil {
+		return punching.err
+	}
+	punching.punched = append(punching.punched, offset)
+	return nil
+}
+
+func TestDataRegionPunchReleased(t *testing.T) {
+	var capacity_bytes uint32 = 64 * 1024
+	alloc := allocator.BuildJudyAlloc(capacity_bytes / uint32(512))
+	inner, err := nvm.New(uint64(capacity_bytes))
+	assert.Nil(t, err)
+	punching := &punchingNVM{NonVolatileMemory: inner}
+	region := NewDataRegion(alloc, punching)
+	var syncs uint64
+	region.SetPunchHoles(true, func() uint64 { return syncs })
+
+	var portions []portion.DataPortion
+	for i := 0; i < 4; i++ {
+		p, err := region.Put(lump.NewLumpDataAligned(1000, block.Min()))
+		assert.Nil(t, err)
+		portions = append(portions, p)
+	}
+	offset := func(p portion.DataPortion) uint64 {
+		offset, _ := p.ShiftBlockToBytes(region.block_size)
+		return offset
+	}
+
+	//the holes are not punched before the journal is synced
+	region.Release(portions[0])
+	region.Release(portions[1])
+	assert.Nil(t, region.PunchReleased())
+	assert.Equal(t, 0, len(punching.punched))
+
+	//the portion allocated again is not punched
+	syncs++
+	region.Release(portions[2])
+	p, err := region.Put(lump.NewLumpDataAligned(1000, block.Min()))
+	assert.Nil(t, err)
+	assert.Equal(t, portions[0], p)
+	assert.Nil(t, region.PunchReleased())
+	assert.Equal(t, []uint64{offset(portions[1])}, punching.punched)
+	syncs++
+	assert.Nil(t, region.PunchReleased())
+	assert.Equal(t, []uint64{offset(portions[1]), offset(portions[2])}, punching.punched)
+
+	//the other errors are returned, and the punching goes on
+	syncs++
+	region.Release(portions[3])
+	region.Release(p)
+	syncs++
+	punching.err = syscall.EIO
+	assert.Error(t, region.PunchReleased())
+	assert.True(t, region.punchHoles)
+	assert.Equal(t, 1, len(region.punches))
+
+	//the filesystem not supporting it disables the punching
+	punching.err = syscall.EOPNOTSUPP
+	assert.Nil(t, region.PunchReleased())
+	assert.False(t, region.punchHoles)
+	assert.Equal(t, 0, len(region.punches))
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+SetDedup enables the content addressed mode of Put: the lumps with the same data share one data
+portion, which is written by the first of them, and released when the last of them is deleted or
+put again. The data is identified by its sha256, see lump.HashContent, so it is not compared.
+Every put is journaled as a PutDedupRecord with the hash, the reference counts of the portions are
+restored from these records when the storage is opened, whether the mode is enabled or not.
+Only Put, PutWithOptions and Update into the data region are deduplicated, the embedded lumps,
+the lumps with TTL, metadata or a tag, the lumps in several extents, and the lumps of PutBatch,
+PutReader, PutWithCapacity and the transactions have their own portions. It takes precedence over
+SetOverwriteInPlace, a shared lump is never overwritten in place.
+*/
+func (store *Storage) SetDedup(dedup bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.dedup = dedup
+	return nil
+}
+
+//putDedup puts the lump into the portion of the lumps with the same data, or into a new portion
+func (store *Storage) putDedup(lumpid lump.LumpId, lumpdata lump.LumpData, timing *PutTiming,
+	options PutOptions) (updated bool, err error) {
+	hash := lump.HashContent(lumpdata.AsBytes())
+	if current, ok := store.index.ContentHash(lumpid); ok && current == hash {
+		//the same data is put again
+		return true, nil
+	}
+	if err = store.checkQuota(lumpid, store.dataRegion.EstimateSize(uint64(len(lumpdata.AsBytes())), 0)); err != nil {
+		return
+	}
+	if updated, err = store.deleteIfExist(lumpid, false); err != nil {
+		return
+	}
+
+	dataPortion, shared := store.index.ContentPortion(hash)
+	if !shared {
+		start := time.Now()
+		dataPortion, err = store.dataRegion.Put(lumpdata)
+		timing.DataWrite = time.Since(start)
+		if err != nil {
+			return
+		}
+	}
+	start := time.Now()
+	//the index is updated by journal
+	err = store.journalRegion.RecordPutDedup(store.index, lumpid, dataPortion, hash, options.SyncJournal)
+	timing.JournalAppend = time.Since(start)
+	if err != nil && !shared {
+		//revert the dataPortion
+		store.dataRegion.Release(dataPortion)
+	}
+	return
+}
+
+//releasePortion releases the portion of a removed lump, unless it is still shared by other lumps
+func (store *Storage) releasePortion(p portion.DataPortion) {
+	if store.index.Refs(p) == 0 {
+		store.dataRegion.Release(p)
+	}
+}
+
+//releasePortions is releasePortion of every portion, a portion shared by several removed lumps is released once
+func (store *Storage) releasePortions(portions []portion.DataPortion) {
+	released := make(map[portion.DataPortion]bool, len(portions))
+	for _, p := range portions {
+		if !released[p] {
+			released[p] = true
+			store.releasePortion(p)
+		}
+	}
+}
+
+//lumpsByPortion returns the lumps in the data region as LumpDataPortions, but a shared portion
+//is returned once with one of its lumps, the others are moved with it by recordMoves
+func (store *Storage) lumpsByPortion() []lumpindex.LumpDataPortion {
+	lumps := store.index.LumpDataPortions()
+	var seen map[portion.DataPortion]bool
+	vec := lumps[:0]
+	for _, l := range lumps {
+		if store.index.Refs(l.Portion) > 0 {
+			if seen == nil {
+				seen = make(map[portion.DataPortion]bool)
+			}
+			if seen[l.Portion] {
+				continue
+			}
+			seen[l.Portion] = true
+		}
+		vec = append(vec, l)
+	}
+	return vec
+}
+
+//recordMoves journals the new portion of the moved lump and the other lumps sharing its old portion,
+//old may be any extent of the lump
+func (store *Storage) recordMoves(lumpid lump.LumpId, old, newPortion portion.DataPortion) error {
+	if store.index.Refs(old) == 0 {
+		if extents, ok := store.index.Extents(lumpid); ok {
+			return store.recordExtentMove(lumpid, extents, old, newPortion)
+		}
+		return store.recordMove(lumpid, newPortion)
+	}
+	for _, id := range store.index.Sharers(old) {
+		if err := store.recordMove(id, newPortion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func thumbnailData(size int, seed byte) lump.LumpData {
+	data := zeroedData(size)
+	for i := range data.AsBytes() {
+		data.AsBytes()[i] = seed + byte(i)
+	}
+	return data
+}
+
+func dataPortionOf(t *testing.T, store *Storage, id lump.LumpId) portion.DataPortion {
+	p, err := store.index.Get(id)
+	assert.Nil(t, err)
+	dataPortion, ok := p.(portion.DataPortion)
+	assert.True(t, ok)
+	return dataPortion
+}
+
+func TestStorageDedup(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp78.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp78.lusf")
+	defer os.Remove("tmp78.ckpt")
+	free := store.Usage().FreeBytes
+	assert.Nil(t, store.SetDedup(true))
+
+	for _, id := range []string{"0000", "0001", "0002"} {
+		updated, err := store.Put(lumpid(id), thumbnailData(3000, 1))
+		assert.Nil(t, err)
+		assert.False(t, updated)
+	}
+	_, err = store.Put(lumpid("0003"), thumbnailData(3000, 2))
+	assert.Nil(t, err)
+	shared := dataPortionOf(t, store, lumpid("0000"))
+	assert.Equal(t, shared, dataPortionOf(t, store, lumpid("0001")))
+	assert.Equal(t, 3, store.index.Refs(shared))
+	//two portions of 3000 bytes are allocated
+	used := free - store.Usage().FreeBytes
+	assert.Equal(t, 2*uint64(shared.SizeOnDisk(store.dataRegion.block_size)), used)
+	//the same data again
+	updated, err := store.Put(lumpid("0001"), thumbnailData(3000, 1))
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	assert.Equal(t, 3, store.index.Refs(shared))
+
+	//the portion is released when the last lump is deleted or put again
+	_, err = store.Delete(lumpid("0000"))
+	assert.Nil(t, err)
+	data, err := store.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, thumbnailData(3000, 1).AsBytes(), data)
+	_, err = store.DeleteRange(lumpid("0001"), lumpid("0002"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, store.index.Refs(shared))
+	assert.Equal(t, used, free-store.Usage().FreeBytes)
+	_, err = store.Put(lumpid("0002"), thumbnailData(3000, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, store.index.Refs(shared))
+	assert.Equal(t, used/2, free-store.Usage().FreeBytes)
+
+	//the references are restored from the journal
+	for _, id := range []string{"0004", "0005"} {
+		_, err = store.Put(lumpid(id), thumbnailData(5000, 3))
+		assert.Nil(t, err)
+	}
+	_, err = store.Put(lumpid("0006"), zeroedData(3000))
+	assert.Nil(t, err)
+	usage := store.Usage()
+	assert.Nil(t, store.Close())
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp78.ckpt"
+	options.Dedup = true
+	store, err = OpenCannylsStorageWithOptions("tmp78.lusf", options)
+	assert.Nil(t, err)
+	assert.False(t, store.Recovery().Checkpoint)
+	assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+	assert.Equal(t, 2, store.index.Refs(dataPortionOf(t, store, lumpid("0002"))))
+
+	//and from the checkpoint
+	assert.Nil(t, store.Close())
+	store, err = OpenCannylsStorageWithOptions("tmp78.lusf", options)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.True(t, store.Recovery().Checkpoint)
+	assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+	shared = dataPortionOf(t, store, lumpid("0004"))
+	assert.Equal(t, 2, store.index.Refs(shared))
+	_, err = store.Put(lumpid("0007"), thumbnailData(5000, 3))
+	assert.Nil(t, err)
+	assert.Equal(t, shared, dataPortionOf(t, store, lumpid("0007")))
+
+	//a shared portion is moved with all of its lumps
+	for _, id := range []string{"0002", "0003", "0006"} {
+		_, err = store.Delete(lumpid(id))
+		assert.Nil(t, err)
+	}
+	_, err = store.CompactDataRegion(10)
+	assert.Nil(t, err)
+	moved := dataPortionOf(t, store, lumpid("0004"))
+	assert.NotEqual(t, shared, moved)
+	assert.Equal(t, 3, store.index.Refs(moved))
+	for _, id := range []string{"0004", "0005", "0007"} {
+		assert.Equal(t, moved, dataPortionOf(t, store, lumpid(id)))
+		data, err = store.Get(lumpid(id))
+		assert.Nil(t, err)
+		assert.Equal(t, thumbnailData(5000, 3).AsBytes(), data)
+	}
+	report, err := store.Verify(VerifyOptions{Deep: true})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean(), "%v", report.Problems)
+
+	//a shared lump is never overwritten in place
+	assert.Nil(t, store.SetDedup(false))
+	assert.Nil(t, store.SetOverwriteInPlace(true))
+	_, err = store.Put(lumpid("0004"), thumbnailData(5000, 4))
+	assert.Nil(t, err)
+	assert.NotEqual(t, moved, dataPortionOf(t, store, lumpid("0004")))
+	data, err = store.Get(lumpid("0005"))
+	assert.Nil(t, err)
+	assert.Equal(t, thumbnailData(5000, 3).AsBytes(), data)
+
+	//Update shares the portion as Put does
+	assert.Nil(t, store.SetDedup(true))
+	_, err = store.Update(lumpid("0008"), thumbnailData(5000, 3))
+	assert.Nil(t, err)
+	assert.Equal(t, moved, dataPortionOf(t, store, lumpid("0008")))
+	assert.Equal(t, 3, store.index.Refs(moved))
+}
+
+func TestStorageReplicateDedup(t *testing.T) {
+	primary, err := CreateCannylsStorage("tmp79.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp79.lusf")
+	defer primary.Close()
+	backup, err := CreateCannylsStorage("tmp80.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp80.lusf")
+	defer backup.Close()
+
+	assert.Nil(t, primary.SetDedup(true))
+	cursor, err := primary.JournalCursor()
+	assert.Nil(t, err)
+	for _, id := range []string{"0000", "0001"} {
+		_, err = primary.Put(lumpid(id), thumbnailData(3000, 1))
+		assert.Nil(t, err)
+	}
+	records, _, err := primary.ReplicateJournalSince(cursor, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	for _, record := range records {
+		applied, err := backup.ApplyJournalRecord(record)
+		assert.Nil(t, err)
+		assert.True(t, applied)
+		applied, err = backup.ApplyJournalRecord(record)
+		assert.Nil(t, err)
+		assert.False(t, applied)
+	}
+	assert.Equal(t, 2, backup.index.Refs(dataPortionOf(t, backup, lumpid("0001"))))
+}
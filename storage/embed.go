@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+EmbedCachePolicy decides when the data of embedded lumps is cached, see StorageOptions.EmbedCacheSize.
+There is no write-back policy, because PutEmbed is durable only after the journal record is appended.
+*/
+type EmbedCachePolicy int
+
+const (
+	//EMBED_CACHE_ON_READ caches the data when the embedded lump is read from the journal region
+	EMBED_CACHE_ON_READ EmbedCachePolicy = iota
+	//EMBED_CACHE_WRITE_THROUGH also caches the data when the lump is embedded
+	EMBED_CACHE_WRITE_THROUGH
+)
+
+func (policy EmbedCachePolicy) String() string {
+	switch policy {
+	case EMBED_CACHE_ON_READ:
+		return "on-read"
+	case EMBED_CACHE_WRITE_THROUGH:
+		return "write-through"
+	default:
+		return fmt.Sprintf("unknown embed cache policy %d", int(policy))
+	}
+}
+
+func (policy EmbedCachePolicy) validate() error {
+	if policy != EMBED_CACHE_ON_READ && policy != EMBED_CACHE_WRITE_THROUGH {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid embed cache policy %d", int(policy))
+	}
+	return nil
+}
+
+//SetEmbedCache keeps at most size bytes of the embedded lumps in memory, 0 disables the cache
+func (store *Storage) SetEmbedCache(size uint64, policy EmbedCachePolicy) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	store.embedCachePolicy = policy
+	if size == 0 {
+		store.embedCache = nil
+		return nil
+	}
+	store.embedCache = newReadCache(size, CACHE_LRU)
+	return nil
+}
+
+//EmbedCacheStats returns the statistics of the cache of embedded lumps, it is zero if the cache is disabled
+func (store *Storage) EmbedCacheStats() (stats CacheStats) {
+	store.view(func() {
+		stats = store.embedCacheStats()
+	})
+	return
+}
+
+func (store *Storage) embedCacheStats() CacheStats {
+	if store.embedCache == nil {
+		return CacheStats{}
+	}
+	return store.embedCache.stats()
+}
+
+//embedVersion changes if the lump is embedded again or moved by journal GC
+func embedVersion(p portion.JournalPortion) uint64 {
+	return p.Start.AsU64()<<16 | uint64(p.Len)
+}
+
+//getEmbedded returns the data of the embedded lump, it must not be modified
+func (store *Storage) getEmbedded(lumpid lump.LumpId, p portion.JournalPortion) ([]byte, error) {
+	if store.embedCache != nil {
+		if data, ok := store.embedCache.get(lumpid.U64(), embedVersion(p)); ok {
+			return data, nil
+		}
+	}
+	data, err := store.journalRegion.GetEmbededData(p)
+	if err != nil {
+		return nil, err
+	}
+	if store.embedCache != nil {
+		store.embedCache.add(lumpid.U64(), embedVersion(p), data)
+	}
+	return data, nil
+}
+
+//cacheEmbedded caches the data just embedded if the policy is EMBED_CACHE_WRITE_THROUGH
+func (store *Storage) cacheEmbedded(lumpid lump.LumpId, data []byte) {
+	if store.embedCache == nil || store.embedCachePolicy != EMBED_CACHE_WRITE_THROUGH {
+		return
+	}
+	if p, err := store.index.Get(lumpid); err == nil {
+		if v, ok := p.(portion.JournalPortion); ok {
+			store.embedCache.add(lumpid.U64(), embedVersion(v), append([]byte{}, data...))
+		}
+	}
+}
+
+//uncacheEmbedded drops the cached data of the deleted or overwritten lump
+func (store *Storage) uncacheEmbedded(lumpid lump.LumpId) {
+	if store.embedCache != nil {
+		store.embedCache.remove(lumpid.U64())
+	}
+}
+
+func (store *Storage) shouldEmbed(size uint64) bool {
+	return size <= uint64(store.embedThreshold) && store.embedThreshold > 0
+}
+
+/*
+RehomeLumps moves the embedded lumps larger than EmbedThreshold into the data region,
+and moves the lumps in the data region not larger than EmbedThreshold into the journal region.
+The lumps with TTL are kept in the data region, because the TTL is only journaled with a put.
+It returns the number of moved lumps.
+*/
+func (store *Storage) RehomeLumps() (moved int, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	iter := store.index.Iterator()
+	defer iter.Close()
+	for id, p, ok := iter.Next(); ok; id, p, ok = iter.Next() {
+		rehomed, err := store.rehome(id, p)
+		if err != nil {
+			return moved, err
+		}
+		if rehomed {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+/*
+Rehome moves the lump to where a Put of its data would write it now, as RehomeLumps does for
+all the lumps. A rewritten lump is already put on the right side of EmbedThreshold, Rehome is
+for the lumps written by PutBatch, PutEmbed, PutWithCapacity or with another EmbedThreshold.
+moved is false if the lump does not exist or is already in the right region.
+*/
+func (store *Storage) Rehome(lumpid lump.LumpId) (moved bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return false, nil
+	}
+	return store.rehome(lumpid, p)
+}
+
+func (store *Storage) rehome(id lump.LumpId, p portion.Portion) (bool, error) {
+	switch v := p.(type) {
+	case portion.JournalPortion:
+		if !store.shouldEmbed(uint64(v.Len)) {
+			return store.moveToDataRegion(id, v)
+		}
+	case portion.DataPortion:
+		//the lump is larger than the threshold if its last block is full
+		blockSize := uint32(store.dataRegion.block_size.AsU16())
+		if v.SizeOnDisk(store.dataRegion.block_size) <= uint32(store.embedThreshold)+blockSize {
+			return store.moveToJournalRegion(id, v)
+		}
+	}
+	return false, nil
+}
+
+func (store *Storage) moveToDataRegion(id lump.LumpId, p portion.JournalPortion) (bool, error) {
+	data, err := store.journalRegion.GetEmbededData(p)
+	if err != nil {
+		return false, err
+	}
+	lumpdata := lump.NewLumpDataAligned(len(data), store.dataRegion.block_size)
+	copy(lumpdata.AsBytes(), data)
+	if metadata, ok := store.index.Metadata(id); ok {
+		tag, _ := store.index.Tag(id)
+		_, err = store.PutWithTag(id, lumpdata, metadata, tag)
+	} else {
+		_, err = store.Put(id, lumpdata)
+	}
+	return err == nil, err
+}
+
+func (store *Storage) moveToJournalRegion(id lump.LumpId, p portion.DataPortion) (bool, error) {
+	if _, ok := store.index.ExpireAt(id); ok {
+		return false, nil
+	}
+	size, err := store.dataRegion.Size(p)
+	if err != nil || !store.shouldEmbed(uint64(size)) {
+		return false, err
+	}
+	lumpdata, err := store.dataRegion.Get(p)
+	if err != nil {
+		return false, err
+	}
+	if metadata, ok := store.index.Metadata(id); ok {
+		tag, _ := store.index.Tag(id)
+		_, err = store.PutEmbedWithTag(id, lumpdata.AsBytes(), metadata, tag)
+	} else {
+		_, err = store.PutEmbed(id, lumpdata.AsBytes())
+	}
+	return err == nil, err
+}
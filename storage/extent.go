@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+A lump which does not fit in a data portion, whose length is 16 bits of blocks, is put into several
+portions, its extents, see DataRegion.PutExtents. So a lump of up to lump.LARGE_LUMP_MAX_SIZE bytes
+could be put without chunking it in the application. It is journaled as a PutExtentsRecord, the
+index keeps the extents and the first one is the portion of the lump. The TTL, the metadata and
+the tag of a lump in extents are journaled in the same record. Only the lumps of PutBatch,
+PutWithCapacity and the transactions are limited to a portion. A lump in extents is never
+deduplicated, overwritten in place or exported to the lusf files of the original cannyls.
+*/
+
+//putExtents puts the lump into new extents, and releases the old portions
+func (store *Storage) putExtents(lumpid lump.LumpId, lumpdata lump.LumpData, timing *PutTiming,
+	options PutOptions) (updated bool, err error) {
+	return store.writeExtents(lumpid, lumpdata, timing, func(extents []portion.DataPortion) error {
+		return store.journalRegion.RecordPutExtents(store.index, lumpid, extents, options.SyncJournal)
+	})
+}
+
+//putExtentsWithAttributes is the same as putExtents, the lump expires at expireAt unless it is 0,
+//and it has the metadata unless it is nil, and the tag
+func (store *Storage) putExtentsWithAttributes(lumpid lump.LumpId, lumpdata lump.LumpData, expireAt uint64,
+	metadata []byte, tag string) (updated bool, err error) {
+	return store.writeExtents(lumpid, lumpdata, &PutTiming{}, func(extents []portion.DataPortion) error {
+		return store.journalRegion.RecordPutExtentsWithAttributes(store.index, lumpid, extents, expireAt, metadata, tag)
+	})
+}
+
+//writeExtents writes the lump data into new extents, which are journaled by record
+func (store *Storage) writeExtents(lumpid lump.LumpId, lumpdata lump.LumpData, timing *PutTiming,
+	record func([]portion.DataPortion) error) (updated bool, err error) {
+	if err = store.checkQuota(lumpid, store.dataRegion.EstimateSize(uint64(len(lumpdata.AsBytes())), 0)); err != nil {
+		return
+	}
+	if updated, err = store.deleteIfExist(lumpid, false); err != nil {
+		return
+	}
+
+	start := time.Now()
+	extents, err := store.dataRegion.PutExtents(lumpdata)
+	timing.DataWrite = time.Since(start)
+	if err != nil {
+		return
+	}
+	start = time.Now()
+	//the index is updated by journal
+	err = record(extents)
+	timing.JournalAppend = time.Since(start)
+	if err != nil {
+		//revert the extents
+		for _, p := range extents {
+			store.dataRegion.Release(p)
+		}
+	}
+	return
+}
+
+//extentsOf returns the portions of the lump in the data region whose first portion is p
+func (store *Storage) extentsOf(lumpid lump.LumpId, p portion.DataPortion) []portion.DataPortion {
+	if extents, ok := store.index.Extents(lumpid); ok {
+		return extents
+	}
+	return []portion.DataPortion{p}
+}
+
+//getData reads the lump data of the lump in the data region whose first portion is p
+func (store *Storage) getData(lumpid lump.LumpId, p portion.DataPortion) ([]byte, error) {
+	return store.dataReader(lumpid, p)()
+}
+
+//dataReader looks the extents of the lump up, the returned read only reads the data region
+func (store *Storage) dataReader(lumpid lump.LumpId, p portion.DataPortion) func() ([]byte, error) {
+	extents, inExtents := store.index.Extents(lumpid)
+	return func() ([]byte, error) {
+		var lumpdata lump.LumpData
+		var err error
+		if inExtents {
+			lumpdata, err = store.dataRegion.GetExtents(extents)
+		} else {
+			lumpdata, err = store.dataRegion.Get(p)
+		}
+		if err != nil {
+			return nil, corruptLump(lumpid, p, err)
+		}
+		return lumpdata.AsBytes(), nil
+	}
+}
+
+//recordExtentMove journals the extents of the lump with old replaced by the moved portion,
+//its TTL, metadata and tag are kept
+func (store *Storage) recordExtentMove(lumpid lump.LumpId, extents []portion.DataPortion, old, newPortion portion.DataPortion) error {
+	moved := make([]portion.DataPortion, len(extents))
+	for i, p := range extents {
+		if p == old {
+			p = newPortion
+		}
+		moved[i] = p
+	}
+	expireAt, metadata, tag := store.attributesOf(lumpid)
+	return store.journalRegion.RecordPutExtentsWithAttributes(store.index, lumpid, moved, expireAt, metadata, tag)
+}
+
+//attributesOf returns the TTL, the metadata and the tag of the lump, expireAt is 0 and metadata is nil if it has none
+func (store *Storage) attributesOf(lumpid lump.LumpId) (expireAt uint64, metadata []byte, tag string) {
+	expireAt, _ = store.index.ExpireAt(lumpid)
+	metadata, _ = store.index.Metadata(lumpid)
+	tag, _ = store.index.Tag(lumpid)
+	return
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func TestStorageExtents(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp83.lusf", 128*1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp83.lusf")
+	defer os.Remove("tmp83.ckpt")
+	free := store.Usage().FreeBytes
+	extentSize := int(store.dataRegion.ExtentSize())
+	assert.True(t, store.dataRegion.FitsPortion(uint64(extentSize)))
+	assert.False(t, store.dataRegion.FitsPortion(uint64(extentSize+5000)))
+
+	//a lump of a whole portion in front of the lump in extents
+	_, err = store.Put(lumpid("0000"), thumbnailData(extentSize, 1))
+	assert.Nil(t, err)
+	_, ok := store.index.Extents(lumpid("0000"))
+	assert.False(t, ok)
+	large := thumbnailData(extentSize+5000, 2)
+	_, err = store.Put(lumpid("0001"), large)
+	assert.Nil(t, err)
+	_, err = store.Put(lumpid("0002"), thumbnailData(3000, 3))
+	assert.Nil(t, err)
+	extents, ok := store.index.Extents(lumpid("0001"))
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(extents))
+	assert.Equal(t, extents[0], dataPortionOf(t, store, lumpid("0001")))
+
+	data, err := store.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, large.AsBytes(), data)
+	buf, err := store.GetPooled(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, large.AsBytes(), buf.AsBytes())
+	buf.Release()
+	reader, err := store.GetReader(lumpid("0001"))
+	assert.Nil(t, err)
+	data, err = ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, large.AsBytes(), data)
+	stat, err := store.Stat(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(extentSize+5000), stat.Size)
+	multi, err := store.GetMulti([]lump.LumpId{lumpid("0002"), lumpid("0001")})
+	assert.Nil(t, err)
+	assert.Equal(t, thumbnailData(3000, 3).AsBytes(), multi[0])
+	assert.Equal(t, large.AsBytes(), multi[1])
+	assert.Nil(t, store.Prefetch([]lump.LumpId{lumpid("0001")}))
+
+	//the extents are restored from the journal and the checkpoint
+	usage := store.Usage()
+	assert.Nil(t, store.Close())
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp83.ckpt"
+	for _, fromCheckpoint := range []bool{false, true} {
+		store, err = OpenCannylsStorageWithOptions("tmp83.lusf", options)
+		assert.Nil(t, err)
+		assert.Equal(t, fromCheckpoint, store.Recovery().Checkpoint)
+		assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+		restored, ok := store.index.Extents(lumpid("0001"))
+		assert.True(t, ok)
+		assert.Equal(t, extents, restored)
+		if !fromCheckpoint {
+			assert.Nil(t, store.Close())
+		}
+	}
+	defer store.Close()
+
+	//the extents are moved by compaction one by one
+	_, err = store.Delete(lumpid("0000"))
+	assert.Nil(t, err)
+	moved, err := store.CompactDataRegion(10)
+	assert.Nil(t, err)
+	assert.True(t, moved > 0)
+	compacted, ok := store.index.Extents(lumpid("0001"))
+	assert.True(t, ok)
+	assert.NotEqual(t, extents, compacted)
+	assert.Equal(t, compacted[0], dataPortionOf(t, store, lumpid("0001")))
+	data, err = store.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, large.AsBytes(), data)
+	report, err := store.Verify(VerifyOptions{Deep: true})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean(), "%v", report.Problems)
+	assert.Equal(t, 2, report.DataLumps)
+
+	//a lump in extents is never overwritten in place
+	assert.Nil(t, store.SetOverwriteInPlace(true))
+	large = thumbnailData(extentSize+5000, 4)
+	updated, err := store.Put(lumpid("0001"), large)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	data, err = store.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, large.AsBytes(), data)
+
+	//a small lump replaces the extents
+	_, err = store.Put(lumpid("0001"), thumbnailData(3000, 5))
+	assert.Nil(t, err)
+	_, ok = store.index.Extents(lumpid("0001"))
+	assert.False(t, ok)
+	report, err = store.Verify(VerifyOptions{Deep: true})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean(), "%v", report.Problems)
+
+	//all the extents are released by delete
+	_, err = store.Put(lumpid("0001"), large)
+	assert.Nil(t, err)
+	for _, id := range []string{"0001", "0002"} {
+		_, err = store.Delete(lumpid(id))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, free, store.Usage().FreeBytes)
+}
+
+func TestStorageExtentsWithAttributes(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp93.lusf", 256*1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp93.lusf")
+	defer os.Remove("tmp93.ckpt")
+	extentSize := int(store.dataRegion.ExtentSize())
+
+	//the lumps larger than a portion keep their metadata, tag and TTL
+	_, err = store.Put(lumpid("0000"), thumbnailData(extentSize, 1))
+	assert.Nil(t, err)
+	tagged := thumbnailData(extentSize+5000, 2)
+	_, err = store.PutWithTag(lumpid("0001"), tagged, []byte("meta"), "shard-1")
+	assert.Nil(t, err)
+	expiring := thumbnailData(2*extentSize+5000, 3)
+	_, err = store.PutWithTTL(lumpid("0002"), expiring, time.Hour)
+	assert.Nil(t, err)
+	expireAt, _ := store.ExpireAt(lumpid("0002"))
+
+	check := func(store *Storage) {
+		extents, ok := store.index.Extents(lumpid("0001"))
+		assert.True(t, ok)
+		assert.Equal(t, 2, len(extents))
+		data, err := store.Get(lumpid("0001"))
+		assert.Nil(t, err)
+		assert.Equal(t, tagged.AsBytes(), data)
+		metadata, err := store.GetMetadata(lumpid("0001"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("meta"), metadata)
+		assert.Equal(t, []lump.LumpId{lumpid("0001")}, store.ListByTag("shard-1", 0))
+
+		extents, ok = store.index.Extents(lumpid("0002"))
+		assert.True(t, ok)
+		assert.Equal(t, 3, len(extents))
+		data, err = store.Get(lumpid("0002"))
+		assert.Nil(t, err)
+		assert.Equal(t, expiring.AsBytes(), data)
+		restored, ok := store.ExpireAt(lumpid("0002"))
+		assert.True(t, ok)
+		assert.Equal(t, expireAt, restored)
+	}
+	check(store)
+
+	//the attributes are restored from the journal and the checkpoint
+	assert.Nil(t, store.Close())
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp93.ckpt"
+	for _, fromCheckpoint := range []bool{false, true} {
+		store, err = OpenCannylsStorageWithOptions("tmp93.lusf", options)
+		assert.Nil(t, err)
+		assert.Equal(t, fromCheckpoint, store.Recovery().Checkpoint)
+		check(store)
+		if !fromCheckpoint {
+			assert.Nil(t, store.Close())
+		}
+	}
+	defer store.Close()
+
+	//and kept when the extents are moved by compaction
+	_, err = store.Delete(lumpid("0000"))
+	assert.Nil(t, err)
+	moved, err := store.CompactDataRegion(10)
+	assert.Nil(t, err)
+	assert.True(t, moved > 0)
+	check(store)
+	assert.Nil(t, store.JournalGC())
+	check(store)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestStoragePutReaderExtents(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp88.lusf", 128*1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp88.lusf")
+	extentSize := int(store.dataRegion.ExtentSize())
+
+	old := thumbnailData(3000, 1)
+	_, err = store.Put(lumpid("0001"), old)
+	assert.Nil(t, err)
+	usage := store.Usage()
+
+	//the old lump is kept if the stream fails after some extents are written
+	large := thumbnailData(2*extentSize+5000, 2)
+	failing := io.MultiReader(bytes.NewReader(large.AsBytes()[:extentSize+100]), failingReader{})
+	_, err = store.PutReader(lumpid("0001"), failing, uint64(len(large.AsBytes())))
+	assert.Error(t, err)
+	data, err := store.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, old.AsBytes(), data)
+	assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+
+	//the lump is streamed into extents, and replaces the old one
+	updated, err := store.PutReader(lumpid("0001"), bytes.NewReader(large.AsBytes()), uint64(len(large.AsBytes())))
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	extents, ok := store.index.Extents(lumpid("0001"))
+	assert.True(t, ok)
+	assert.Equal(t, 3, len(extents))
+	data, err = store.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, large.AsBytes(), data)
+
+	//a small lump is streamed into one portion
+	_, err = store.PutReader(lumpid("0001"), bytes.NewReader(old.AsBytes()), uint64(len(old.AsBytes())))
+	assert.Nil(t, err)
+	_, ok = store.index.Extents(lumpid("0001"))
+	assert.False(t, ok)
+	assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+
+	//the extents are journaled
+	_, err = store.PutReader(lumpid("0002"), bytes.NewReader(large.AsBytes()), uint64(len(large.AsBytes())))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+	store, err = OpenCannylsStorage("tmp88.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	data, err = store.Get(lumpid("0002"))
+	assert.Nil(t, err)
+	assert.Equal(t, large.AsBytes(), data)
+	data, err = store.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, old.AsBytes(), data)
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+//PutTiming splits the time of a put into writing the data region and appending the journal
+type PutTiming struct {
+	DataWrite     time.Duration
+	JournalAppend time.Duration
+}
+
+/*
+Hooks lets the application trace the storage, for example to emit spans.
+OnPutStart and OnPutEnd wrap Put, PutReader and PutEmbed, the JournalAppend of PutTiming
+includes the journal syncs, which are also reported by OnJournalSync.
+Storage is not thread safe, the hooks are called in the goroutine of the operation.
+*/
+type Hooks interface {
+	journal.Hooks
+	OnPutStart(id lump.LumpId, size int)
+	OnPutEnd(id lump.LumpId, timing PutTiming, err error)
+}
+
+//NopHooks does nothing, embed it to implement only some of the hooks
+type NopHooks struct{}
+
+func (NopHooks) OnPutStart(id lump.LumpId, size int)                   {}
+func (NopHooks) OnPutEnd(id lump.LumpId, timing PutTiming, err error)  {}
+func (NopHooks) OnJournalSync(start time.Time, duration time.Duration) {}
+func (NopHooks) OnGC(start time.Time, duration time.Duration)          {}
+
+//SetHooks sets the hooks of the storage and its journal, nil means no hooks
+func (store *Storage) SetHooks(hooks Hooks) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.hooks = hooks
+	if hooks == nil {
+		store.journalRegion.SetHooks(nil)
+	} else {
+		store.journalRegion.SetHooks(hooks)
+	}
+	return nil
+}
+
+//tracePut calls OnPutStart, the returned function calls OnPutEnd, so it is used as defer store.tracePut(...)()
+func (store *Storage) tracePut(lumpid lump.LumpId, size int, timing *PutTiming, err *error) func() {
+	if store.hooks == nil {
+		return func() {}
+	}
+	store.hooks.OnPutStart(lumpid, size)
+	return func() {
+		store.hooks.OnPutEnd(lumpid, *timing, *err)
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+type recordingHooks struct {
+	NopHooks
+	started []lump.LumpId
+	ended   []PutTiming
+	syncs   int
+}
+
+func (hooks *recordingHooks) OnPutStart(id lump.LumpId, size int) {
+	hooks.started = append(hooks.started, id)
+}
+
+func (hooks *recordingHooks) OnPutEnd(id lump.LumpId, timing PutTiming, err error) {
+	hooks.ended = append(hooks.ended, timing)
+}
+
+func (hooks *recordingHooks) OnJournalSync(start time.Time, duration time.Duration) {
+	hooks.syncs++
+}
+
+func TestStorageHooks(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp22.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp22.lusf")
+
+	hooks := &recordingHooks{}
+	assert.Nil(t, storage.SetHooks(hooks))
+
+	_, err = storage.Put(lumpid("0000"), zeroedData(100))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("0001"), []byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.JournalSync())
+
+	assert.Equal(t, []lump.LumpId{lumpid("0000"), lumpid("0001")}, hooks.started)
+	assert.Equal(t, 2, len(hooks.ended))
+	assert.True(t, hooks.ended[0].DataWrite > 0)
+	assert.Equal(t, time.Duration(0), hooks.ended[1].DataWrite)
+	assert.True(t, hooks.syncs >= 1)
+
+	assert.Nil(t, storage.SetHooks(nil))
+	_, err = storage.Put(lumpid("0002"), zeroedData(100))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(hooks.started))
+	storage.Close()
+}
+
+func TestStoragePutWithOptions(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp33.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp33.lusf")
+	//sync every record
+	assert.Nil(t, storage.SetJournalSyncInterval(0))
+	storage.embedThreshold = 64
+
+	hooks := &recordingHooks{}
+	assert.Nil(t, storage.SetHooks(hooks))
+	relaxed := PutOptions{SyncJournal: false}
+	_, err = storage.PutWithOptions(lumpid("0000"), zeroedData(100), relaxed)
+	assert.Nil(t, err)
+	_, err = storage.PutWithOptions(lumpid("0001"), zeroedData(10), relaxed)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, hooks.syncs)
+
+	_, err = storage.PutWithOptions(lumpid("0002"), zeroedData(100), DefaultPutOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, hooks.syncs)
+	storage.Close()
+
+	storage, err = OpenCannylsStorage("tmp33.lusf")
+	assert.Nil(t, err)
+	for _, id := range []string{"0000", "0001", "0002"} {
+		data, err := storage.Get(lumpid(id))
+		assert.Nil(t, err)
+		assert.NotEqual(t, 0, len(data))
+	}
+	storage.Close()
+}
+
+func TestStorageSync(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp34.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp34.lusf")
+
+	hooks := &recordingHooks{}
+	assert.Nil(t, storage.SetHooks(hooks))
+	relaxed := PutOptions{SyncJournal: false}
+	_, err = storage.PutWithOptions(lumpid("0000"), zeroedData(100), relaxed)
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Sync())
+	assert.Equal(t, 1, hooks.syncs)
+
+	_, err = storage.PutWithOptions(lumpid("0001"), zeroedData(100), relaxed)
+	assert.Nil(t, err)
+	done := storage.SyncAsync()
+	//the storage could be written before the sync completes
+	_, err = storage.PutWithOptions(lumpid("0002"), zeroedData(100), relaxed)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	storage.Close()
+
+	storage, err = OpenCannylsStorage("tmp34.lusf")
+	assert.Nil(t, err)
+	_, err = storage.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	storage.Close()
+}
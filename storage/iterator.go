@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+type LumpEntry struct {
+	Id lump.LumpId
+	//the size on disk, the data portion is aligned to blocks
+	Size uint32
+	//Embedded is true if the lump is stored in the journal region
+	Embedded bool
+}
+
+//StorageIterator yields the lumps ordered by lumpid, see Storage.Iterator
+type StorageIterator struct {
+	iter      *lumpindex.IndexIterator
+	blockSize block.BlockSize
+}
+
+/*
+Iterator returns the lumps in the storage when it is called, the Puts and Deletes
+after that are not seen by the iterator. The iterator must be closed when it is not used.
+*/
+func (store *Storage) Iterator() (*StorageIterator, error) {
+	if err := store.checkOpen(); err != nil {
+		return nil, err
+	}
+	return &StorageIterator{
+		iter:      store.index.Iterator(),
+		blockSize: store.dataRegion.block_size,
+	}, nil
+}
+
+//Next returns the next lump, ok is false if there are no more lumps
+func (iter *StorageIterator) Next() (entry LumpEntry, ok bool) {
+	id, p, ok := iter.iter.Next()
+	if !ok {
+		return
+	}
+	_, embedded := p.(portion.JournalPortion)
+	return LumpEntry{
+		Id:       id,
+		Size:     p.SizeOnDisk(iter.blockSize),
+		Embedded: embedded,
+	}, true
+}
+
+func (iter *StorageIterator) Close() {
+	iter.iter.Close()
+}
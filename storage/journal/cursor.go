@@ -0,0 +1,130 @@
+package journal
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/address"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+/*
+JournalCursor is a position in the stream of journal records.
+Offset grows monotonically, it is seq * capacity + position in the ring, where seq is the sequence
+stamped in the records of the lap, so a cursor is still valid after the journal is opened again,
+if its records are not released. Epoch is in the journal header, it is chosen when the journal is
+created, the cursors of another journal are rejected. The journals whose records are not stamped
+get a new epoch every time they are opened, see JournalHeaderRegion.
+*/
+type JournalCursor struct {
+	Epoch  uint64
+	Offset uint64
+}
+
+//absolute returns the offset in memory, the laps are counted from the lap of head when the journal is opened
+func (journal *JournalRegion) absolute(laps uint64, position uint64) uint64 {
+	return laps*journal.ring.Capacity() + position
+}
+
+//cursorOffset returns the Offset of JournalCursor of the offset in memory
+func (journal *JournalRegion) cursorOffset(offset uint64) uint64 {
+	return uint64(journal.seqBase)*journal.ring.Capacity() + offset
+}
+
+//memoryOffset returns the offset in memory of the Offset of JournalCursor, ok is false if it is before the lap of head
+func (journal *JournalRegion) memoryOffset(cursorOffset uint64) (offset uint64, ok bool) {
+	base := uint64(journal.seqBase) * journal.ring.Capacity()
+	if cursorOffset < base {
+		return 0, false
+	}
+	return cursorOffset - base, true
+}
+
+/*
+Cursor returns the position where the next record will be appended, and starts tailing.
+While tailing, GC does not release the records after the cursor last passed to ReadSince,
+so a slow reader may fill the journal, call StopTailing if the reader is gone.
+*/
+func (journal *JournalRegion) Cursor() JournalCursor {
+	offset := journal.absolute(journal.ring.tailLaps, journal.ring.tail)
+	if !journal.tailing {
+		journal.tailing = true
+		journal.shipped = offset
+	}
+	return JournalCursor{Epoch: journal.epoch, Offset: journal.cursorOffset(offset)}
+}
+
+func (journal *JournalRegion) StopTailing() {
+	journal.tailing = false
+}
+
+//retainForTailing returns the position and its sequence which could be released instead of head
+func (journal *JournalRegion) retainForTailing(head uint64, seq uint32) (uint64, uint32) {
+	if !journal.tailing {
+		return head, seq
+	}
+	//head is always a position of ring.head
+	if journal.shipped < journal.absolute(journal.ring.headLaps, head) {
+		return journal.shipped % journal.ring.Capacity(), journal.seqAt(journal.shipped)
+	}
+	return head, seq
+}
+
+//seqAt returns the sequence of the record at offset, the offset is not before the tail when the journal is opened
+func (journal *JournalRegion) seqAt(offset uint64) uint32 {
+	return journal.seqBase + uint32(offset/journal.ring.Capacity())
+}
+
+/*
+ReadSince returns at most max records appended after cursor, and the cursor after them.
+The records moved by GC are appended again, so a record may be returned more than once.
+It fails with InvalidInput if the cursor is from another epoch or it is already released.
+*/
+func (journal *JournalRegion) ReadSince(cursor JournalCursor, max int) ([]JournalEntry, JournalCursor, error) {
+	ring := journal.ring
+	if cursor.Epoch != journal.epoch {
+		return nil, cursor, errors.Wrap(internalerror.InvalidInput, "journal cursor is from another epoch")
+	}
+	offset, ok := journal.memoryOffset(cursor.Offset)
+	if !ok || offset < journal.absolute(ring.releasedLaps, ring.unreleasedHead) ||
+		offset > journal.absolute(ring.tailLaps, ring.tail) {
+		return nil, cursor, errors.Wrapf(internalerror.InvalidInput, "journal cursor %d is released", cursor.Offset)
+	}
+
+	//the records before cursor are shipped
+	if journal.tailing && offset > journal.shipped {
+		journal.shipped = offset
+	}
+
+	laps := offset / ring.Capacity()
+	position := offset % ring.Capacity()
+	if _, err := ring.nvm.Seek(int64(position), io.SeekStart); err != nil {
+		return nil, cursor, err
+	}
+
+	entries := make([]JournalEntry, 0, 16)
+	for len(entries) < max {
+		record, _, err := ring.readRecord(ring.nvm)
+		if err != nil {
+			return nil, cursor, err
+		}
+		switch record.(type) {
+		case GoToFront:
+			laps++
+			position = 0
+			if _, err := ring.nvm.Seek(0, io.SeekStart); err != nil {
+				return nil, cursor, err
+			}
+			continue
+		case EndOfRecords:
+			return entries, JournalCursor{Epoch: journal.epoch, Offset: journal.cursorOffset(journal.absolute(laps, position))}, nil
+		}
+		entry := JournalEntry{
+			Start:  address.AddressFromU64(position),
+			Record: record,
+		}
+		entries = append(entries, entry)
+		position = entry.End()
+	}
+	return entries, JournalCursor{Epoch: journal.epoch, Offset: journal.cursorOffset(journal.absolute(laps, position))}, nil
+}
@@ -1,14 +1,36 @@
 package journal
 
 import (
+	"encoding/binary"
+
 	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/nvm"
 	"github.com/thesues/cannyls-go/util"
-	"io"
+)
+
+/*
+Journal header, in the first sector of the journal region
+
+| head(8 bytes) | "stmp"(4 bytes) | sequence of the record at head(4 bytes) |
+| "cln!"(4 bytes) | tail(8 bytes) | sequence of the tail(4 bytes) |
+| "epch"(4 bytes) | epoch(8 bytes) | padding |
+
+The journals created before the records are stamped have no "stmp", their records
+are never stamped, see JournalRingBuffer.stamped.
+"cln!" is written by MarkClean after the records are synced when the storage is closed,
+it is cleared by the next write of the header, which is before the next append.
+"epch" is the Epoch of JournalCursor, it is chosen when the journal is created, and only
+written in the stamped journals. The stamped journals created before it get an epoch when
+they are opened, it is written with the next header.
+*/
+var (
+	JOURNAL_STAMP_MAGIC = [4]byte{'s', 't', 'm', 'p'}
+	JOURNAL_CLEAN_MAGIC = [4]byte{'c', 'l', 'n', '!'}
+	JOURNAL_EPOCH_MAGIC = [4]byte{'e', 'p', 'c', 'h'}
 )
 
 func NewJournalHeadRegion(nvm nvm.NonVolatileMemory) *JournalHeaderRegion {
-	ab := block.NewAlignedBytes(int(block.MIN), block.Min())
+	ab := block.NewAlignedBytes(int(nvm.BlockSize().AsU16()), nvm.BlockSize())
 	ab.Align()
 	return &JournalHeaderRegion{
 		nvm: nvm,
@@ -17,32 +39,106 @@ func NewJournalHeadRegion(nvm nvm.NonVolatileMemory) *JournalHeaderRegion {
 }
 
 type JournalHeaderRegion struct {
-	nvm nvm.NonVolatileMemory
-	ab  *block.AlignedBytes
+	nvm     nvm.NonVolatileMemory
+	ab      *block.AlignedBytes
+	stamped bool
+	//the head and the sequence on the disk
+	head uint64
+	seq  uint32
+	//clean is true if the header has the clean mark of tail and tailSeq
+	clean   bool
+	tail    uint64
+	tailSeq uint32
+	//epoch is 0 if the header has no epoch
+	epoch uint64
 }
 
-func (headerRegion *JournalHeaderRegion) WriteTo(head uint64) (err error) {
-	buf := headerRegion.ab.AsBytes()
+func encodeJournalHeader(buf []byte, head uint64, stamped bool, seq uint32, epoch uint64) {
+	for i := range buf[:44] {
+		buf[i] = 0
+	}
 	util.PutUINT64(buf[:8], head)
-	if _, err = headerRegion.nvm.Seek(0, io.SeekStart); err != nil {
-		return
+	if stamped {
+		copy(buf[8:12], JOURNAL_STAMP_MAGIC[:])
+		binary.BigEndian.PutUint32(buf[12:16], seq)
+		copy(buf[32:36], JOURNAL_EPOCH_MAGIC[:])
+		util.PutUINT64(buf[36:44], epoch)
 	}
-	if _, err = headerRegion.nvm.Write(buf); err != nil {
+}
+
+//WriteTo writes the head, the clean mark is cleared
+func (headerRegion *JournalHeaderRegion) WriteTo(head uint64, seq uint32) (err error) {
+	buf := headerRegion.ab.AsBytes()
+	encodeJournalHeader(buf, head, headerRegion.stamped, seq, headerRegion.epoch)
+	if err = headerRegion.write(buf); err != nil {
 		return
 	}
+	headerRegion.head, headerRegion.seq = head, seq
+	headerRegion.clean = false
+	return nil
+}
+
+//MarkClean writes the clean mark with the tail of the synced records, the journal must be stamped
+func (headerRegion *JournalHeaderRegion) MarkClean(tail uint64, tailSeq uint32) error {
+	buf := headerRegion.ab.AsBytes()
+	encodeJournalHeader(buf, headerRegion.head, headerRegion.stamped, headerRegion.seq, headerRegion.epoch)
+	copy(buf[16:20], JOURNAL_CLEAN_MAGIC[:])
+	util.PutUINT64(buf[20:28], tail)
+	binary.BigEndian.PutUint32(buf[28:32], tailSeq)
+	if err := headerRegion.write(buf); err != nil {
+		return err
+	}
+	headerRegion.clean, headerRegion.tail, headerRegion.tailSeq = true, tail, tailSeq
+	return nil
+}
 
+func (headerRegion *JournalHeaderRegion) write(buf []byte) error {
+	if _, err := headerRegion.nvm.WriteAt(buf, 0); err != nil {
+		return err
+	}
 	return headerRegion.nvm.Sync()
 }
 
-func (headerRegion *JournalHeaderRegion) ReadFrom() (head uint64, err error) {
+func (headerRegion *JournalHeaderRegion) ReadFrom() (head uint64, seq uint32, err error) {
 	head = 0
 	buf := headerRegion.ab.AsBytes()
-	if _, err = headerRegion.nvm.Seek(0, io.SeekStart); err != nil {
-		return
-	}
-	if _, err = headerRegion.nvm.Read(buf); err != nil {
+	if _, err = headerRegion.nvm.ReadAt(buf, 0); err != nil {
 		return
 	}
 	head = util.GetUINT64(buf[:8])
-	return head, nil
+	headerRegion.stamped = string(buf[8:12]) == string(JOURNAL_STAMP_MAGIC[:])
+	if headerRegion.stamped {
+		seq = binary.BigEndian.Uint32(buf[12:16])
+	}
+	headerRegion.head, headerRegion.seq = head, seq
+	headerRegion.clean = headerRegion.stamped && string(buf[16:20]) == string(JOURNAL_CLEAN_MAGIC[:])
+	if headerRegion.clean {
+		headerRegion.tail = util.GetUINT64(buf[20:28])
+		headerRegion.tailSeq = binary.BigEndian.Uint32(buf[28:32])
+	}
+	headerRegion.epoch = 0
+	if headerRegion.stamped && string(buf[32:36]) == string(JOURNAL_EPOCH_MAGIC[:]) {
+		headerRegion.epoch = util.GetUINT64(buf[36:44])
+	}
+	return head, seq, nil
+}
+
+//Epoch returns the epoch in the header, it is 0 if there is none
+func (headerRegion *JournalHeaderRegion) Epoch() uint64 {
+	return headerRegion.epoch
+}
+
+//setEpoch sets the epoch written with the next header of a stamped journal
+func (headerRegion *JournalHeaderRegion) setEpoch(epoch uint64) {
+	headerRegion.epoch = epoch
+}
+
+//Clean returns the tail of the clean mark, ok is false if there is no mark
+func (headerRegion *JournalHeaderRegion) Clean() (tail uint64, tailSeq uint32, ok bool) {
+	return headerRegion.tail, headerRegion.tailSeq, headerRegion.clean
+}
+
+//Stamped returns true if the records are stamped, it is known after ReadFrom
+func (headerRegion *JournalHeaderRegion) Stamped() bool {
+	return headerRegion.stamped
 }
@@ -10,10 +10,46 @@ import (
 func TestJournalHeaderRegion(t *testing.T) {
 	f, _ := nvm.New(1024)
 	region := NewJournalHeadRegion(f)
-	region.WriteTo(1234)
+	region.WriteTo(1234, 5)
 
-	head, err := region.ReadFrom()
+	//the journal is not stamped
+	head, seq, err := region.ReadFrom()
 	assert.Nil(t, err)
 	assert.Equal(t, uint64(1234), head)
+	assert.Equal(t, uint32(0), seq)
+	assert.False(t, region.Stamped())
 
+	region.stamped = true
+	region.WriteTo(1234, 5)
+	region = NewJournalHeadRegion(f)
+	head, seq, err = region.ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1234), head)
+	assert.Equal(t, uint32(5), seq)
+	assert.True(t, region.Stamped())
+	assert.Equal(t, uint64(0), region.Epoch())
+	region.setEpoch(42)
+	_, _, clean := region.Clean()
+	assert.False(t, clean)
+	assert.Nil(t, region.MarkClean(4321, 6))
+	region = NewJournalHeadRegion(f)
+	head, seq, err = region.ReadFrom()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1234), head)
+	assert.Equal(t, uint32(5), seq)
+	tail, tailSeq, clean := region.Clean()
+	assert.True(t, clean)
+	assert.Equal(t, uint64(4321), tail)
+	assert.Equal(t, uint32(6), tailSeq)
+
+	//the mark is cleared by the next write
+	region.WriteTo(2345, 5)
+	region = NewJournalHeadRegion(f)
+	_, _, err = region.ReadFrom()
+	assert.Nil(t, err)
+	_, _, clean = region.Clean()
+	assert.False(t, clean)
+
+	//the epoch is kept by both writes
+	assert.Equal(t, uint64(42), region.Epoch())
 }
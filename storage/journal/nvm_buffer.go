@@ -79,13 +79,9 @@ func (jb *JournalNvmBuffer) Read(buf []byte) (n int, err error) {
 	jb.readBuf.AlignResize(uint32(readBufEnd - readBufStart))
 
 	//fmt.Printf("len: ", jb.readBuf.Len())
-	//Seek the aligned sector and read from disk
-	if _, err := jb.nvm.Seek(int64(readBufStart), io.SeekStart); err != nil {
-		return -1, err
-	}
-
-	innerReadSize, err := jb.nvm.Read(jb.readBuf.AsBytes())
-	if err != nil {
+	//read the aligned sectors from disk
+	innerReadSize, err := jb.nvm.ReadAt(jb.readBuf.AsBytes(), int64(readBufStart))
+	if err != nil && err != io.EOF {
 		return -1, err
 	}
 
@@ -137,8 +133,9 @@ func (jb *JournalNvmBuffer) Write(buf []byte) (n int, err error) {
 			jb.writeBufOffset = jb.nvm.BlockSize().FloorAlign(jb.position)
 			//fmt.Printf("update buf offset to %d", jb.position)
 			jb.writeBuf.AlignResize(uint32(jb.nvm.BlockSize().AsU16())) //resize to a sector
-			jb.nvm.Seek(int64(jb.writeBufOffset), io.SeekStart)
-			jb.nvm.Read(jb.writeBuf.AsBytes())
+			if _, err := jb.nvm.ReadAt(jb.writeBuf.AsBytes(), int64(jb.writeBufOffset)); err != nil && err != io.EOF {
+				return 0, err
+			}
 		}
 
 		//call
@@ -146,6 +143,39 @@ func (jb *JournalNvmBuffer) Write(buf []byte) (n int, err error) {
 	}
 }
 
+//ReadAt reads at offset through the buffer, the position is not changed
+func (jb *JournalNvmBuffer) ReadAt(buf []byte, offset int64) (int, error) {
+	position := jb.position
+	defer func() { jb.position = position }()
+	if _, err := jb.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return jb.Read(buf)
+}
+
+//WriteAt writes at offset through the buffer, the position is not changed
+func (jb *JournalNvmBuffer) WriteAt(buf []byte, offset int64) (int, error) {
+	position := jb.position
+	defer func() { jb.position = position }()
+	if _, err := jb.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return jb.Write(buf)
+}
+
+//Writev copies every buffer into the write buffer, so they are flushed at once
+func (jb *JournalNvmBuffer) Writev(bufs [][]byte, offset int64) (int, error) {
+	var total int
+	for _, buf := range bufs {
+		n, err := jb.WriteAt(buf, offset+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
 func (jb *JournalNvmBuffer) Close() error {
 	return jb.Sync()
 }
@@ -165,10 +195,7 @@ func (jb *JournalNvmBuffer) flushWriteBuffer() error {
 	}
 
 	//fmt.Println("FLUSH DATA")
-	if _, err := jb.nvm.Seek(int64(jb.writeBufOffset), io.SeekStart); err != nil {
-		return err
-	}
-	if _, err := jb.nvm.Write(jb.writeBuf.AsBytes()); err != nil {
+	if _, err := jb.nvm.WriteAt(jb.writeBuf.AsBytes(), int64(jb.writeBufOffset)); err != nil {
 		return err
 	}
 
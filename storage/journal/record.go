@@ -1,6 +1,7 @@
 package journal
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash/adler32"
@@ -17,12 +18,26 @@ import (
 var _ = fmt.Println
 
 const (
-	TAG_END_OF_RECORDS byte = 0
-	TAG_GO_TO_FRONT    byte = 1
-	TAG_PUT            byte = 3
-	TAG_EMBED          byte = 4
-	TAG_DELETE         byte = 5
-	TAG_DELETE_RANGE   byte = 6
+	TAG_END_OF_RECORDS  byte = 0
+	TAG_GO_TO_FRONT     byte = 1
+	TAG_PUT             byte = 3
+	TAG_EMBED           byte = 4
+	TAG_DELETE          byte = 5
+	TAG_DELETE_RANGE    byte = 6
+	TAG_PUT_BATCH       byte = 7
+	TAG_PUT_WITH_TTL    byte = 8
+	TAG_PUT_WITH_META   byte = 9
+	TAG_EMBED_WITH_META byte = 10
+	TAG_MARKER          byte = 11
+	TAG_RELEASE_MARKER  byte = 12
+	TAG_TRANSACTION     byte = 13
+	//the records with metadata and a user tag, see LumpTag
+	TAG_PUT_WITH_META_AND_TAG   byte = 14
+	TAG_EMBED_WITH_META_AND_TAG byte = 15
+	TAG_OVERWRITE               byte = 16
+	TAG_PUT_DEDUP               byte = 17
+	TAG_PUT_EXTENTS             byte = 18
+	TAG_PUT_EXTENTS_WITH_ATTRS  byte = 19
 )
 const (
 	RECORD_HEADER_SIZE   = 1 + 4 // TAG size + Checksum size
@@ -31,6 +46,17 @@ const (
 	PORTION_SIZE         = 5
 	END_OF_RECORDS_SIZE  = 1 + 4 //Tag Size + Checksum size //GO_TO_FRONT and END_OF_RECORD
 	EMBEDDED_DATA_OFFSET = RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE
+	COUNT_SIZE           = 2
+	MAX_PUT_BATCH_COUNT  = 0xFFFF
+	EXPIRE_SIZE          = 8
+	METADATA_LENGTH_SIZE = 1
+	METADATA_FLAG_SIZE   = 1
+	MARKER_ID_SIZE       = 8
+	//the max number of puts or deletes in a transaction
+	MAX_TRANSACTION_COUNT = 0xFFFF
+	CONTENT_HASH_SIZE     = 32 //sha256, see lump.ContentHash
+	//the max number of the extents of a lump, see lump.MAX_LUMP_EXTENTS
+	MAX_EXTENTS_COUNT = lump.MAX_LUMP_EXTENTS
 )
 
 type JournalRecord interface {
@@ -61,6 +87,93 @@ type DeleteRange struct {
 	End   lump.LumpId
 }
 
+//PutBatchRecord holds several puts which are committed to the journal as one entry
+type PutBatchRecord struct {
+	Puts []PutRecord
+}
+
+//PutWithTTLRecord is a put, the lump expires at ExpireAt(unix seconds)
+type PutWithTTLRecord struct {
+	LumpID      lump.LumpId
+	DataPortion portion.DataPortion
+	ExpireAt    uint64
+}
+
+/*
+PutWithMetadataRecord is a put with user metadata, the metadata is kept in the index.
+LumpTag is the user tag of the lump, it follows the metadata, and the record is written
+with TAG_PUT_WITH_META_AND_TAG if it is not empty
+*/
+type PutWithMetadataRecord struct {
+	LumpID      lump.LumpId
+	DataPortion portion.DataPortion
+	Metadata    []byte
+	LumpTag     string
+}
+
+//EmbedWithMetadataRecord is an embed with user metadata, the metadata and the tag follow the data,
+//so the data is at EMBEDDED_DATA_OFFSET as EmbedRecord
+type EmbedWithMetadataRecord struct {
+	LumpID   lump.LumpId
+	Data     []byte
+	Metadata []byte
+	LumpTag  string
+}
+
+//MarkerRecord is an opaque user marker, it is kept by GC until a ReleaseMarkerRecord of the same ID
+type MarkerRecord struct {
+	ID   uint64
+	Data []byte
+}
+
+type ReleaseMarkerRecord struct {
+	ID uint64
+}
+
+//TransactionRecord holds the puts and the deletes of a transaction, they are restored all or nothing.
+//A lump is either put or deleted in a transaction
+type TransactionRecord struct {
+	Puts    []PutRecord
+	Deletes []lump.LumpId
+}
+
+/*
+OverwriteRecord is written when the lump data is overwritten in its own DataPortion, see
+Storage.SetOverwriteInPlace. The index is not changed, so it is replayed as nothing and it is
+garbage as soon as it is written, the PutRecord of the portion is still live. It is journaled
+to sync the overwrite as a Put, and to be sent to the backups by the replication.
+*/
+type OverwriteRecord struct {
+	LumpID      lump.LumpId
+	DataPortion portion.DataPortion
+}
+
+/*
+PutDedupRecord is a put in the content addressed mode, see Storage.SetDedup. The lumps with the
+same Hash share the DataPortion, so the reference count of the portion is the number of the live
+PutDedupRecords of it, it is restored from them and the portion is released at zero.
+*/
+type PutDedupRecord struct {
+	LumpID      lump.LumpId
+	DataPortion portion.DataPortion
+	Hash        lump.ContentHash
+}
+
+/*
+PutExtentsRecord is a put of a lump larger than a DataPortion, its data is split into the Extents
+in order, see Storage.Put. The record is live as long as the lump has the same extents.
+The lump expires at ExpireAt(unix seconds) unless it is 0, it has the Metadata unless it is nil,
+and LumpTag is its user tag. The record is written with TAG_PUT_EXTENTS_WITH_ATTRS if the lump
+has any of them, they follow the extents then.
+*/
+type PutExtentsRecord struct {
+	LumpID   lump.LumpId
+	Extents  []portion.DataPortion
+	ExpireAt uint64
+	Metadata []byte
+	LumpTag  string
+}
+
 type JournalEntry struct {
 	Start  address.Address
 	Record JournalRecord
@@ -260,15 +373,487 @@ func (record DeleteRange) Tag() byte {
 	return TAG_DELETE_RANGE
 }
 
+//
+
+func (record PutBatchRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + COUNT_SIZE + uint32(len(record.Puts))*(LUMPID_SIZE+LENGTH_SIZE+PORTION_SIZE)
+}
+
+func (record PutBatchRecord) WriteTo(w io.Writer) error {
+	if err := writeRecordHeader(record, w); err != nil {
+		return err
+	}
+	var count [2]byte
+	util.PutUINT16(count[:], uint16(len(record.Puts)))
+	if _, err := w.Write(count[:]); err != nil {
+		return err
+	}
+	for _, put := range record.Puts {
+		if _, err := put.LumpID.Write(w); err != nil {
+			return err
+		}
+		offset, len := put.DataPortion.AsInts()
+		var buf [7]byte
+		util.PutUINT16(buf[:2], len)
+		util.PutUINT40(buf[2:], offset)
+		if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (record PutBatchRecord) Tag() byte {
+	return TAG_PUT_BATCH
+}
+
+func (record PutBatchRecord) CheckSum() uint32 {
+	var tag = []byte{TAG_PUT_BATCH}
+	hash := adler32.New()
+	hash.Write(tag)
+	var count [2]byte
+	util.PutUINT16(count[:], uint16(len(record.Puts)))
+	hash.Write(count[:])
+	for _, put := range record.Puts {
+		put.LumpID.Write(hash)
+		offset, len := put.DataPortion.AsInts()
+		var buf [7]byte
+		util.PutUINT16(buf[:2], len)
+		util.PutUINT40(buf[2:], offset)
+		hash.Write(buf[:])
+	}
+	return hash.Sum32()
+}
+
+//
+
+func (record PutWithTTLRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE + EXPIRE_SIZE
+}
+
+func (record PutWithTTLRecord) encodeBody() []byte {
+	offset, len := record.DataPortion.AsInts()
+	//len + offset + expire is 15 bytes
+	var buf [15]byte
+	util.PutUINT16(buf[:2], len)
+	util.PutUINT40(buf[2:7], offset)
+	binary.BigEndian.PutUint64(buf[7:], record.ExpireAt)
+	return buf[:]
+}
+
+func (record PutWithTTLRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	if _, err := record.LumpID.Write(writer); err != nil {
+		return err
+	}
+	if _, err := writer.Write(record.encodeBody()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (record PutWithTTLRecord) Tag() byte {
+	return TAG_PUT_WITH_TTL
+}
+
+func (record PutWithTTLRecord) CheckSum() uint32 {
+	var tag = []byte{TAG_PUT_WITH_TTL}
+	hash := adler32.New()
+	hash.Write(tag)
+	record.LumpID.Write(hash)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
+//
+
+func (record PutWithMetadataRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE + METADATA_LENGTH_SIZE + uint32(len(record.Metadata)) +
+		lumpTagSize(record.LumpTag)
+}
+
+func (record PutWithMetadataRecord) encodeBody() []byte {
+	metadataLen := uint8(len(record.Metadata))
+	offset, len := record.DataPortion.AsInts()
+	//len + offset + length of metadata is 8 bytes
+	var buf [8]byte
+	util.PutUINT16(buf[:2], len)
+	util.PutUINT40(buf[2:7], offset)
+	buf[7] = metadataLen
+	return appendLumpTag(append(buf[:], record.Metadata...), record.LumpTag)
+}
+
+func (record PutWithMetadataRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	if _, err := record.LumpID.Write(writer); err != nil {
+		return err
+	}
+	if _, err := writer.Write(record.encodeBody()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (record PutWithMetadataRecord) Tag() byte {
+	if record.LumpTag != "" {
+		return TAG_PUT_WITH_META_AND_TAG
+	}
+	return TAG_PUT_WITH_META
+}
+
+func (record PutWithMetadataRecord) CheckSum() uint32 {
+	var tag = []byte{record.Tag()}
+	hash := adler32.New()
+	hash.Write(tag)
+	record.LumpID.Write(hash)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
+//
+
+func (record EmbedWithMetadataRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + uint32(len(record.Data)) + METADATA_LENGTH_SIZE + uint32(len(record.Metadata)) +
+		lumpTagSize(record.LumpTag)
+}
+
+func (record EmbedWithMetadataRecord) encodeBody() []byte {
+	buf := make([]byte, 0, LENGTH_SIZE+len(record.Data)+METADATA_LENGTH_SIZE+len(record.Metadata))
+	var lenBuf [2]byte
+	util.PutUINT16(lenBuf[:], uint16(len(record.Data)))
+	buf = append(buf, lenBuf[:]...)
+	buf = append(buf, record.Data...)
+	buf = append(buf, uint8(len(record.Metadata)))
+	return appendLumpTag(append(buf, record.Metadata...), record.LumpTag)
+}
+
+func (record EmbedWithMetadataRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	if _, err := record.LumpID.Write(writer); err != nil {
+		return err
+	}
+	if _, err := writer.Write(record.encodeBody()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (record EmbedWithMetadataRecord) Tag() byte {
+	if record.LumpTag != "" {
+		return TAG_EMBED_WITH_META_AND_TAG
+	}
+	return TAG_EMBED_WITH_META
+}
+
+func (record EmbedWithMetadataRecord) CheckSum() uint32 {
+	var tag = []byte{record.Tag()}
+	hash := adler32.New()
+	hash.Write(tag)
+	record.LumpID.Write(hash)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
+//
+
+func (record MarkerRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + MARKER_ID_SIZE + LENGTH_SIZE + uint32(len(record.Data))
+}
+
+func (record MarkerRecord) encodeBody() []byte {
+	buf := make([]byte, MARKER_ID_SIZE+LENGTH_SIZE, MARKER_ID_SIZE+LENGTH_SIZE+len(record.Data))
+	binary.BigEndian.PutUint64(buf, record.ID)
+	util.PutUINT16(buf[MARKER_ID_SIZE:], uint16(len(record.Data)))
+	return append(buf, record.Data...)
+}
+
+func (record MarkerRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	_, err := writer.Write(record.encodeBody())
+	return err
+}
+
+func (record MarkerRecord) Tag() byte {
+	return TAG_MARKER
+}
+
+func (record MarkerRecord) CheckSum() uint32 {
+	var tag = []byte{TAG_MARKER}
+	hash := adler32.New()
+	hash.Write(tag)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
+//
+
+func (record ReleaseMarkerRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + MARKER_ID_SIZE
+}
+
+func (record ReleaseMarkerRecord) encodeBody() []byte {
+	var buf [MARKER_ID_SIZE]byte
+	binary.BigEndian.PutUint64(buf[:], record.ID)
+	return buf[:]
+}
+
+func (record ReleaseMarkerRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	_, err := writer.Write(record.encodeBody())
+	return err
+}
+
+func (record ReleaseMarkerRecord) Tag() byte {
+	return TAG_RELEASE_MARKER
+}
+
+func (record ReleaseMarkerRecord) CheckSum() uint32 {
+	var tag = []byte{TAG_RELEASE_MARKER}
+	hash := adler32.New()
+	hash.Write(tag)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
+//
+
+func (record TransactionRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + COUNT_SIZE + uint32(len(record.Puts))*(LUMPID_SIZE+LENGTH_SIZE+PORTION_SIZE) +
+		COUNT_SIZE + uint32(len(record.Deletes))*LUMPID_SIZE
+}
+
+//encodeBody is the puts as PutBatchRecord followed by the count of deletes and their lumpids
+func (record TransactionRecord) encodeBody() []byte {
+	var buf bytes.Buffer
+	var count [2]byte
+	util.PutUINT16(count[:], uint16(len(record.Puts)))
+	buf.Write(count[:])
+	for _, put := range record.Puts {
+		put.LumpID.Write(&buf)
+		offset, len := put.DataPortion.AsInts()
+		var p [7]byte
+		util.PutUINT16(p[:2], len)
+		util.PutUINT40(p[2:], offset)
+		buf.Write(p[:])
+	}
+	util.PutUINT16(count[:], uint16(len(record.Deletes)))
+	buf.Write(count[:])
+	for _, id := range record.Deletes {
+		id.Write(&buf)
+	}
+	return buf.Bytes()
+}
+
+func (record TransactionRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	_, err := writer.Write(record.encodeBody())
+	return err
+}
+
+func (record TransactionRecord) Tag() byte {
+	return TAG_TRANSACTION
+}
+
+func (record TransactionRecord) CheckSum() uint32 {
+	var tag = []byte{TAG_TRANSACTION}
+	hash := adler32.New()
+	hash.Write(tag)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
+//
+
+func (record OverwriteRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE
+}
+
+func (record OverwriteRecord) encodeBody() []byte {
+	offset, len := record.DataPortion.AsInts()
+	var buf [7]byte
+	util.PutUINT16(buf[:2], len)
+	util.PutUINT40(buf[2:], offset)
+	return buf[:]
+}
+
+func (record OverwriteRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	if _, err := record.LumpID.Write(writer); err != nil {
+		return err
+	}
+	if _, err := writer.Write(record.encodeBody()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (record OverwriteRecord) Tag() byte {
+	return TAG_OVERWRITE
+}
+
+func (record OverwriteRecord) CheckSum() uint32 {
+	var tag = []byte{TAG_OVERWRITE}
+	hash := adler32.New()
+	hash.Write(tag)
+	record.LumpID.Write(hash)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
+//
+
+func (record PutDedupRecord) ExternalSize() uint32 {
+	return RECORD_HEADER_SIZE + LUMPID_SIZE + LENGTH_SIZE + PORTION_SIZE + CONTENT_HASH_SIZE
+}
+
+func (record PutDedupRecord) encodeBody() []byte {
+	offset, len := record.DataPortion.AsInts()
+	//len + offset + hash is 39 bytes
+	var buf [LENGTH_SIZE + PORTION_SIZE + CONTENT_HASH_SIZE]byte
+	util.PutUINT16(buf[:2], len)
+	util.PutUINT40(buf[2:7], offset)
+	copy(buf[7:], record.Hash[:])
+	return buf[:]
+}
+
+func (record PutDedupRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	if _, err := record.LumpID.Write(writer); err != nil {
+		return err
+	}
+	if _, err := writer.Write(record.encodeBody()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (record PutDedupRecord) Tag() byte {
+	return TAG_PUT_DEDUP
+}
+
+func (record PutDedupRecord) CheckSum() uint32 {
+	var tag = []byte{TAG_PUT_DEDUP}
+	hash := adler32.New()
+	hash.Write(tag)
+	record.LumpID.Write(hash)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
+//
+
+func (record PutExtentsRecord) ExternalSize() uint32 {
+	size := RECORD_HEADER_SIZE + LUMPID_SIZE + COUNT_SIZE + uint32(len(record.Extents))*(LENGTH_SIZE+PORTION_SIZE)
+	if record.hasAttributes() {
+		size += EXPIRE_SIZE + METADATA_FLAG_SIZE + METADATA_LENGTH_SIZE + uint32(len(record.Metadata)) +
+			METADATA_LENGTH_SIZE + uint32(len(record.LumpTag))
+	}
+	return size
+}
+
+func (record PutExtentsRecord) hasAttributes() bool {
+	return record.ExpireAt != 0 || record.Metadata != nil || record.LumpTag != ""
+}
+
+/*
+encodeBody is the count of the extents followed by the len and the offset of each. The attributes
+follow them: expire_at(8 bytes), metadata_flag(1 byte), which is 1 if the lump has metadata,
+metadata_len(1 byte), metadata, tag_len(1 byte) and the tag
+*/
+func (record PutExtentsRecord) encodeBody() []byte {
+	buf := make([]byte, COUNT_SIZE+len(record.Extents)*(LENGTH_SIZE+PORTION_SIZE))
+	util.PutUINT16(buf[:COUNT_SIZE], uint16(len(record.Extents)))
+	for i, extent := range record.Extents {
+		offset, len := extent.AsInts()
+		b := buf[COUNT_SIZE+i*(LENGTH_SIZE+PORTION_SIZE):]
+		util.PutUINT16(b[:2], len)
+		util.PutUINT40(b[2:7], offset)
+	}
+	if !record.hasAttributes() {
+		return buf
+	}
+	var attrs [EXPIRE_SIZE + METADATA_FLAG_SIZE + METADATA_LENGTH_SIZE]byte
+	binary.BigEndian.PutUint64(attrs[:EXPIRE_SIZE], record.ExpireAt)
+	if record.Metadata != nil {
+		attrs[EXPIRE_SIZE] = 1
+	}
+	attrs[EXPIRE_SIZE+METADATA_FLAG_SIZE] = uint8(len(record.Metadata))
+	buf = append(append(buf, attrs[:]...), record.Metadata...)
+	buf = append(buf, uint8(len(record.LumpTag)))
+	return append(buf, record.LumpTag...)
+}
+
+func (record PutExtentsRecord) WriteTo(writer io.Writer) error {
+	if err := writeRecordHeader(record, writer); err != nil {
+		return err
+	}
+	if _, err := record.LumpID.Write(writer); err != nil {
+		return err
+	}
+	if _, err := writer.Write(record.encodeBody()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (record PutExtentsRecord) Tag() byte {
+	if record.hasAttributes() {
+		return TAG_PUT_EXTENTS_WITH_ATTRS
+	}
+	return TAG_PUT_EXTENTS
+}
+
+func (record PutExtentsRecord) CheckSum() uint32 {
+	var tag = []byte{record.Tag()}
+	hash := adler32.New()
+	hash.Write(tag)
+	record.LumpID.Write(hash)
+	hash.Write(record.encodeBody())
+	return hash.Sum32()
+}
+
 /*
 All the io.Read() should be io.ReadExact(), which means in parser, we
 expect read up 10 bytes, It must return 10 bytes, no more no less.
 */
 func ReadRecordFrom(reader io.Reader) (JournalRecord, error) {
-	checksum, tag, err := readRecordHeader(reader)
+	record, stamp, err := readStampedRecordFrom(reader)
 	if err != nil {
 		return nil, err
 	}
+	if stamp != 0 {
+		return nil, errors.Wrapf(internalerror.StorageCorrupted,
+			"tag: %d, on checksum disk: %d , computed %d, mem: %+v", record.Tag(), record.CheckSum()^stamp, record.CheckSum(), record)
+	}
+	return record, nil
+}
+
+/*
+The records of a stamped journal are written with the sequence of the ring lap,
+which is xored into the checksum, so the stale records of the previous laps do not
+match. readStampedRecordFrom returns the stamp, the caller checks it is expected.
+*/
+func readStampedRecordFrom(reader io.Reader) (JournalRecord, uint32, error) {
+	checksum, tag, err := readRecordHeader(reader)
+	if err != nil {
+		return nil, 0, err
+	}
 	var record JournalRecord
 	var lumpID, start, end lump.LumpId
 
@@ -279,11 +864,11 @@ func ReadRecordFrom(reader io.Reader) (JournalRecord, error) {
 		record = GoToFront{}
 	case TAG_PUT:
 		if lumpID, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		var buf [7]byte
 		if _, err := io.ReadFull(reader, buf[:]); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		dataLen := util.GetUINT16(buf[:2])
 		dataOffset := util.GetUINT40(buf[2:])
@@ -291,46 +876,286 @@ func ReadRecordFrom(reader io.Reader) (JournalRecord, error) {
 		record = PutRecord{LumpID: lumpID, DataPortion: portion}
 	case TAG_EMBED:
 		if lumpID, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		var dataLenBuf [2]byte
 		if _, err := io.ReadFull(reader, dataLenBuf[:]); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		dataLen := binary.BigEndian.Uint16(dataLenBuf[:])
 
 		data := make([]byte, dataLen)
 		if _, err = io.ReadFull(reader, data); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		record = EmbedRecord{LumpID: lumpID, Data: data}
 	case TAG_DELETE:
 		if lumpID, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		record = DeleteRecord{LumpID: lumpID}
 	case TAG_DELETE_RANGE:
 		if start, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		if end, err = readLumpId(reader); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		record = DeleteRange{Start: start, End: end}
+	case TAG_PUT_BATCH:
+		var countBuf [2]byte
+		if _, err := io.ReadFull(reader, countBuf[:]); err != nil {
+			return nil, 0, err
+		}
+		count := util.GetUINT16(countBuf[:])
+		puts := make([]PutRecord, count)
+		for i := range puts {
+			if lumpID, err = readLumpId(reader); err != nil {
+				return nil, 0, err
+			}
+			var buf [7]byte
+			if _, err := io.ReadFull(reader, buf[:]); err != nil {
+				return nil, 0, err
+			}
+			dataLen := util.GetUINT16(buf[:2])
+			dataOffset := util.GetUINT40(buf[2:])
+			puts[i] = PutRecord{LumpID: lumpID, DataPortion: portion.NewDataPortion(dataOffset, dataLen)}
+		}
+		record = PutBatchRecord{Puts: puts}
+	case TAG_PUT_WITH_TTL:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, 0, err
+		}
+		var buf [15]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, 0, err
+		}
+		dataLen := util.GetUINT16(buf[:2])
+		dataOffset := util.GetUINT40(buf[2:7])
+		record = PutWithTTLRecord{
+			LumpID:      lumpID,
+			DataPortion: portion.NewDataPortion(dataOffset, dataLen),
+			ExpireAt:    binary.BigEndian.Uint64(buf[7:]),
+		}
+	case TAG_PUT_WITH_META, TAG_PUT_WITH_META_AND_TAG:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, 0, err
+		}
+		var buf [8]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, 0, err
+		}
+		dataLen := util.GetUINT16(buf[:2])
+		dataOffset := util.GetUINT40(buf[2:7])
+		metadata, err := readMetadata(reader, buf[7])
+		if err != nil {
+			return nil, 0, err
+		}
+		lumpTag, err := readLumpTag(reader, tag)
+		if err != nil {
+			return nil, 0, err
+		}
+		record = PutWithMetadataRecord{
+			LumpID:      lumpID,
+			DataPortion: portion.NewDataPortion(dataOffset, dataLen),
+			Metadata:    metadata,
+			LumpTag:     lumpTag,
+		}
+	case TAG_EMBED_WITH_META, TAG_EMBED_WITH_META_AND_TAG:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, 0, err
+		}
+		var dataLenBuf [2]byte
+		if _, err := io.ReadFull(reader, dataLenBuf[:]); err != nil {
+			return nil, 0, err
+		}
+		//data and the length of metadata
+		data := make([]byte, binary.BigEndian.Uint16(dataLenBuf[:])+METADATA_LENGTH_SIZE)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, 0, err
+		}
+		metadata, err := readMetadata(reader, data[len(data)-1])
+		if err != nil {
+			return nil, 0, err
+		}
+		lumpTag, err := readLumpTag(reader, tag)
+		if err != nil {
+			return nil, 0, err
+		}
+		record = EmbedWithMetadataRecord{LumpID: lumpID, Data: data[:len(data)-1], Metadata: metadata, LumpTag: lumpTag}
+	case TAG_MARKER:
+		var buf [MARKER_ID_SIZE + LENGTH_SIZE]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, 0, err
+		}
+		data := make([]byte, util.GetUINT16(buf[MARKER_ID_SIZE:]))
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, 0, err
+		}
+		record = MarkerRecord{ID: binary.BigEndian.Uint64(buf[:MARKER_ID_SIZE]), Data: data}
+	case TAG_TRANSACTION:
+		var countBuf [2]byte
+		if _, err := io.ReadFull(reader, countBuf[:]); err != nil {
+			return nil, 0, err
+		}
+		puts := make([]PutRecord, util.GetUINT16(countBuf[:]))
+		for i := range puts {
+			if lumpID, err = readLumpId(reader); err != nil {
+				return nil, 0, err
+			}
+			var buf [7]byte
+			if _, err := io.ReadFull(reader, buf[:]); err != nil {
+				return nil, 0, err
+			}
+			dataLen := util.GetUINT16(buf[:2])
+			dataOffset := util.GetUINT40(buf[2:])
+			puts[i] = PutRecord{LumpID: lumpID, DataPortion: portion.NewDataPortion(dataOffset, dataLen)}
+		}
+		if _, err := io.ReadFull(reader, countBuf[:]); err != nil {
+			return nil, 0, err
+		}
+		deletes := make([]lump.LumpId, util.GetUINT16(countBuf[:]))
+		for i := range deletes {
+			if deletes[i], err = readLumpId(reader); err != nil {
+				return nil, 0, err
+			}
+		}
+		record = TransactionRecord{Puts: puts, Deletes: deletes}
+	case TAG_RELEASE_MARKER:
+		var buf [MARKER_ID_SIZE]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, 0, err
+		}
+		record = ReleaseMarkerRecord{ID: binary.BigEndian.Uint64(buf[:])}
+	case TAG_OVERWRITE:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, 0, err
+		}
+		var buf [7]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, 0, err
+		}
+		dataLen := util.GetUINT16(buf[:2])
+		dataOffset := util.GetUINT40(buf[2:])
+		record = OverwriteRecord{LumpID: lumpID, DataPortion: portion.NewDataPortion(dataOffset, dataLen)}
+	case TAG_PUT_DEDUP:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, 0, err
+		}
+		var buf [LENGTH_SIZE + PORTION_SIZE + CONTENT_HASH_SIZE]byte
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return nil, 0, err
+		}
+		put := PutDedupRecord{LumpID: lumpID}
+		put.DataPortion = portion.NewDataPortion(util.GetUINT40(buf[2:7]), util.GetUINT16(buf[:2]))
+		copy(put.Hash[:], buf[7:])
+		record = put
+	case TAG_PUT_EXTENTS, TAG_PUT_EXTENTS_WITH_ATTRS:
+		if lumpID, err = readLumpId(reader); err != nil {
+			return nil, 0, err
+		}
+		var countBuf [COUNT_SIZE]byte
+		if _, err := io.ReadFull(reader, countBuf[:]); err != nil {
+			return nil, 0, err
+		}
+		count := util.GetUINT16(countBuf[:])
+		if count == 0 || count > MAX_EXTENTS_COUNT {
+			return nil, 0, errors.Wrapf(internalerror.StorageCorrupted, "invalid count of extents %d", count)
+		}
+		extents := make([]portion.DataPortion, count)
+		for i := range extents {
+			var buf [LENGTH_SIZE + PORTION_SIZE]byte
+			if _, err := io.ReadFull(reader, buf[:]); err != nil {
+				return nil, 0, err
+			}
+			extents[i] = portion.NewDataPortion(util.GetUINT40(buf[2:]), util.GetUINT16(buf[:2]))
+		}
+		put := PutExtentsRecord{LumpID: lumpID, Extents: extents}
+		if tag == TAG_PUT_EXTENTS_WITH_ATTRS {
+			var buf [EXPIRE_SIZE + METADATA_FLAG_SIZE + METADATA_LENGTH_SIZE]byte
+			if _, err := io.ReadFull(reader, buf[:]); err != nil {
+				return nil, 0, err
+			}
+			put.ExpireAt = binary.BigEndian.Uint64(buf[:EXPIRE_SIZE])
+			metadata, err := readMetadata(reader, buf[EXPIRE_SIZE+METADATA_FLAG_SIZE])
+			if err != nil {
+				return nil, 0, err
+			}
+			if buf[EXPIRE_SIZE] != 0 {
+				put.Metadata = metadata
+			}
+			var length [METADATA_LENGTH_SIZE]byte
+			if _, err := io.ReadFull(reader, length[:]); err != nil {
+				return nil, 0, err
+			}
+			lumpTag, err := readMetadata(reader, length[0])
+			if err != nil {
+				return nil, 0, err
+			}
+			put.LumpTag = string(lumpTag)
+		}
+		record = put
 	default:
-		panic("read tag error")
+		return nil, 0, errors.Wrapf(internalerror.StorageCorrupted, "unknown tag %d", tag)
 	}
 
-	if checksum != record.CheckSum() {
-		return nil, errors.Wrapf(internalerror.StorageCorrupted,
-			"tag: %d, on checksum disk: %d , computed %d, mem: %+v", tag, checksum, record.CheckSum(), record)
-	}
+	return record, checksum ^ record.CheckSum(), nil
+}
 
-	return record, nil
+//writeStampedRecord writes the record with the stamp xored into its checksum
+func writeStampedRecord(record JournalRecord, writer io.Writer, stamp uint32) error {
+	if stamp == 0 {
+		return record.WriteTo(writer)
+	}
+	var buf bytes.Buffer
+	if err := record.WriteTo(&buf); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[:4], binary.BigEndian.Uint32(b[:4])^stamp)
+	_, err := writer.Write(b)
+	return err
 }
 
 //helper
+func readMetadata(reader io.Reader, length uint8) ([]byte, error) {
+	metadata := make([]byte, length)
+	if _, err := io.ReadFull(reader, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+//lumpTagSize is the length byte and the tag, a record without tag does not have them
+func lumpTagSize(lumpTag string) uint32 {
+	if lumpTag == "" {
+		return 0
+	}
+	return METADATA_LENGTH_SIZE + uint32(len(lumpTag))
+}
+
+func appendLumpTag(buf []byte, lumpTag string) []byte {
+	if lumpTag == "" {
+		return buf
+	}
+	buf = append(buf, uint8(len(lumpTag)))
+	return append(buf, lumpTag...)
+}
+
+//readLumpTag reads the user tag of the records with TAG_*_WITH_META_AND_TAG
+func readLumpTag(reader io.Reader, tag byte) (string, error) {
+	if tag != TAG_PUT_WITH_META_AND_TAG && tag != TAG_EMBED_WITH_META_AND_TAG {
+		return "", nil
+	}
+	var length [1]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return "", err
+	}
+	lumpTag, err := readMetadata(reader, length[0])
+	return string(lumpTag), err
+}
+
 func readLumpId(reader io.Reader) (lump.LumpId, error) {
 	//64bit
 	var buf [8]byte
@@ -40,6 +40,84 @@ func TestRecordWork(t *testing.T) {
 			Start: lumpID("123A"),
 			End:   lumpID("456B"),
 		},
+		PutBatchRecord{
+			Puts: []PutRecord{
+				{LumpID: lumpID("0A"), DataPortion: portion.NewDataPortion(0, 10)},
+				{LumpID: lumpID("0B"), DataPortion: portion.NewDataPortion((1<<40)-1, 0xFFFF)},
+			},
+		},
+		PutWithTTLRecord{
+			LumpID:      lumpID("0C"),
+			DataPortion: portion.NewDataPortion(512, 10),
+			ExpireAt:    1234567890,
+		},
+		PutWithMetadataRecord{
+			LumpID:      lumpID("0D"),
+			DataPortion: portion.NewDataPortion(1024, 10),
+			Metadata:    []byte("text/plain"),
+		},
+		EmbedWithMetadataRecord{
+			LumpID:   lumpID("0E"),
+			Data:     []byte("2222"),
+			Metadata: make([]byte, lump.MAX_METADATA_SIZE),
+		},
+		PutWithMetadataRecord{
+			LumpID:      lumpID("0F"),
+			DataPortion: portion.NewDataPortion(2048, 10),
+			Metadata:    []byte{},
+			LumpTag:     "tenant-1",
+		},
+		EmbedWithMetadataRecord{
+			LumpID:   lumpID("10"),
+			Data:     []byte("3333"),
+			Metadata: []byte("meta"),
+			LumpTag:  string(make([]byte, lump.MAX_TAG_SIZE)),
+		},
+		MarkerRecord{
+			ID:   42,
+			Data: []byte("replicated up to 1234"),
+		},
+		MarkerRecord{
+			ID:   1<<64 - 1,
+			Data: []byte{},
+		},
+		ReleaseMarkerRecord{
+			ID: 42,
+		},
+		TransactionRecord{
+			Puts: []PutRecord{
+				{LumpID: lumpID("0A"), DataPortion: portion.NewDataPortion(0, 10)},
+			},
+			Deletes: []lump.LumpId{lumpID("0B"), lumpID("0C")},
+		},
+		TransactionRecord{
+			Puts:    []PutRecord{},
+			Deletes: []lump.LumpId{lumpID("0D")},
+		},
+		OverwriteRecord{
+			LumpID:      lumpID("0E"),
+			DataPortion: portion.NewDataPortion(7, 3),
+		},
+		PutDedupRecord{
+			LumpID:      lumpID("0F"),
+			DataPortion: portion.NewDataPortion(1<<39, 0xFFFF),
+			Hash:        lump.HashContent([]byte("thumbnail")),
+		},
+		PutExtentsRecord{
+			LumpID:  lumpID("10"),
+			Extents: []portion.DataPortion{portion.NewDataPortion(1<<39, 0xFFFF), portion.NewDataPortion(3, 10)},
+		},
+		PutExtentsRecord{
+			LumpID:   lumpID("11"),
+			Extents:  []portion.DataPortion{portion.NewDataPortion(0, 0xFFFF), portion.NewDataPortion(0xFFFF, 1)},
+			ExpireAt: 1563937200,
+		},
+		PutExtentsRecord{
+			LumpID:   lumpID("12"),
+			Extents:  []portion.DataPortion{portion.NewDataPortion(0, 0xFFFF), portion.NewDataPortion(0xFFFF, 1)},
+			Metadata: []byte{},
+			LumpTag:  "shard-1",
+		},
 	}
 	var _ = fmt.Printf
 	var _ = hex.Dump
@@ -48,6 +126,7 @@ func TestRecordWork(t *testing.T) {
 
 	for _, c := range cases {
 		c.WriteTo(buf)
+		assert.Equal(t, int(c.ExternalSize()), buf.Len())
 		c0, err := ReadRecordFrom(buf)
 		assert.Nil(t, err)
 		assert.Equal(t, c, c0)
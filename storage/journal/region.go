@@ -1,11 +1,14 @@
 package journal
 
 import (
-	"encoding/binary"
+	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"time"
 
 	"github.com/phf/go-queue/queue"
+	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/lump"
@@ -16,31 +19,238 @@ import (
 
 const (
 	GC_COUNT_IN_SIDE_JOB = 64
+	//the gc yields after every GC_YIELD_INTERVAL entries are read into the gc queue, see SetGcYield
+	GC_YIELD_INTERVAL = 64
 	//performance related
-	GC_QUEUE_SIZE = 0x2000
-	SYNC_INTERVAL = 0x2000
+	GC_QUEUE_SIZE    = 0x2000
+	SYNC_INTERVAL    = 0x2000
+	GC_TRIGGER_RATIO = 0.5
+	//the gc budget of an append is up to GC_PACING_GAIN+1 times its size when the ring is full
+	GC_PACING_GAIN = 4
+	//the unpaid gc budget is capped, so a burst of appends does not stall the following ones
+	GC_PACING_MAX_DEBT = 0x10000
 )
 
+type JournalRegionOptions struct {
+	//the max number of entries loaded into gc queue at once
+	GcBatchSize int
+	//gc after append starts when the usage of the ring is more than GcTriggerRatio * capacity
+	GcTriggerRatio float64
+	//sync the ring after SyncInterval records are appended
+	SyncInterval int
+	//OnRestoreProgress is called while the index is restored from the records when the storage
+	//is opened, nil means no progress is reported
+	OnRestoreProgress func(RestoreProgress)
+	//an append is throttled when the usage of the ring is more than HighWatermark * capacity,
+	//0 means never, see SetThrottle
+	HighWatermark float64
+	//ThrottleFailFast makes the throttled append return JournalFull instead of waiting for the gc
+	ThrottleFailFast bool
+	//GcTargetFreeRatio paces the gc after append to keep the free ratio of the ring around it,
+	//instead of collecting one entry per append above GcTriggerRatio. 0 means no pacing, see SetGcPacing
+	GcTargetFreeRatio float64
+}
+
+//RestoreProgress is reported after every RESTORE_BATCH_SIZE records are restored, see JournalRegionOptions
+type RestoreProgress struct {
+	//ReplayedBytes of the ring are read, out of TotalBytes, which is the ring from where the restore
+	//starts to the head. The records usually end before TotalBytes, then ReplayedBytes jumps to it with Done
+	ReplayedBytes uint64
+	TotalBytes    uint64
+	//Entries is the number of the restored records
+	Entries int
+	Done    bool
+}
+
+func DefaultJournalRegionOptions() JournalRegionOptions {
+	return JournalRegionOptions{
+		GcBatchSize:    GC_QUEUE_SIZE,
+		GcTriggerRatio: GC_TRIGGER_RATIO,
+		SyncInterval:   SYNC_INTERVAL,
+	}
+}
+
+func (options JournalRegionOptions) validate() error {
+	if options.GcBatchSize <= 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid gc batch size %d", options.GcBatchSize)
+	}
+	if options.GcTriggerRatio <= 0 || options.GcTriggerRatio > 1 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid gc trigger ratio %f", options.GcTriggerRatio)
+	}
+	if options.SyncInterval < 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid sync interval %d", options.SyncInterval)
+	}
+	if options.HighWatermark < 0 || options.HighWatermark > 1 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid high watermark %f", options.HighWatermark)
+	}
+	if options.GcTargetFreeRatio < 0 || options.GcTargetFreeRatio >= 1 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid gc target free ratio %f", options.GcTargetFreeRatio)
+	}
+	return nil
+}
+
 type JournalRegion struct {
 	headerRegion  *JournalHeaderRegion
 	ring          *JournalRingBuffer
 	gcQueue       *queue.Queue
 	syncCountDown int
+	//the number of the completed syncs, see Syncs
+	syncs         uint64
 	gcAfterAppend bool
+	options       JournalRegionOptions
+	epoch         uint64
+	tailing       bool
+	shipped       uint64
+	//the sequence of the records at offset 0 of JournalCursor, see seqAt
+	seqBase uint32
+	//the bytes of the gc budget not paid by the previous appends, see pacedGC
+	gcDebt   uint64
+	observer Observer
+	hooks    Hooks
+	limiter  Limiter
+	yield    func()
+}
+
+//Observer is notified when the journal is collected or synced, see package metrics
+type Observer interface {
+	ObserveGC()
+	ObserveSync()
+	//ObserveThrottle is called after an append is throttled, rejected is true if it fails fast
+	ObserveThrottle(duration time.Duration, rejected bool)
+}
+
+//SetObserver sets the observer, nil means no observer
+func (journal *JournalRegion) SetObserver(observer Observer) {
+	journal.observer = observer
+}
+
+//Hooks is called with the start time and the duration of journal syncs and GC runs, see storage.Hooks
+type Hooks interface {
+	OnJournalSync(start time.Time, duration time.Duration)
+	OnGC(start time.Time, duration time.Duration)
+}
+
+//SetHooks sets the hooks, nil means no hooks
+func (journal *JournalRegion) SetHooks(hooks Hooks) {
+	journal.hooks = hooks
+}
+
+/*
+Limiter throttles the gc of RunSideJobOnce, the gc after append is never throttled, because
+the journal would be full without it.
+*/
+type Limiter interface {
+	//Ready returns false if the side job should not read or write now
+	Ready() bool
+	//Charge counts the bytes read or written by the side job
+	Charge(n uint64)
+}
+
+//SetLimiter sets the limiter of the side job, nil means no limit
+func (journal *JournalRegion) SetLimiter(limiter Limiter) {
+	journal.limiter = limiter
+}
+
+/*
+SetGcYield sets f which is called between the steps of the gc, so a long gc does not block the
+reads of the caller, the storage is not thread safe, so f is called in the goroutine of the gc.
+f could read the index and the embedded data, which are consistent at the steps, but it must not
+append, delete or run the gc. nil means no yield
+*/
+func (journal *JournalRegion) SetGcYield(f func()) {
+	journal.yield = f
+}
+
+func (journal *JournalRegion) yieldGC() {
+	if journal.yield != nil {
+		journal.yield()
+	}
+}
+
+func (journal *JournalRegion) ready() bool {
+	return journal.limiter == nil || journal.limiter.Ready()
+}
+
+func (journal *JournalRegion) charge(n uint64) {
+	if journal.limiter != nil {
+		journal.limiter.Charge(n)
+	}
 }
 
 func (journal *JournalRegion) SetAutomaticGcMode(gc bool) {
 	journal.gcAfterAppend = gc
 }
 
+func (journal *JournalRegion) Options() JournalRegionOptions {
+	return journal.options
+}
+
+func (journal *JournalRegion) SetGcBatchSize(size int) error {
+	options := journal.options
+	options.GcBatchSize = size
+	return journal.setOptions(options)
+}
+
+func (journal *JournalRegion) SetGcTriggerRatio(ratio float64) error {
+	options := journal.options
+	options.GcTriggerRatio = ratio
+	return journal.setOptions(options)
+}
+
+func (journal *JournalRegion) SetSyncInterval(interval int) error {
+	options := journal.options
+	options.SyncInterval = interval
+	return journal.setOptions(options)
+}
+
+/*
+SetThrottle makes the appends wait for the gc when the usage of the ring is more than
+highWatermark * capacity, the gc runs in the append until the usage is below it, or a whole
+batch of the gc queue frees nothing because all the records are live. If failFast is set, the
+append returns JournalFull at once instead. 0 disables the throttle.
+*/
+func (journal *JournalRegion) SetThrottle(highWatermark float64, failFast bool) error {
+	options := journal.options
+	options.HighWatermark = highWatermark
+	options.ThrottleFailFast = failFast
+	return journal.setOptions(options)
+}
+
+/*
+SetGcPacing replaces the fixed gc after append with a pacing controller, which keeps the free
+ratio of the ring around targetFreeRatio. Below the target every append is followed by the gc
+of its own size, plus up to GC_PACING_GAIN times of it in proportion to how far the free ratio is
+below the target, so the gc follows the write rate instead of the sawtooth of the fixed batches.
+Above the target nothing is collected. 0 disables the pacing.
+*/
+func (journal *JournalRegion) SetGcPacing(targetFreeRatio float64) error {
+	options := journal.options
+	options.GcTargetFreeRatio = targetFreeRatio
+	if err := journal.setOptions(options); err != nil {
+		return err
+	}
+	journal.gcDebt = 0
+	return nil
+}
+
+func (journal *JournalRegion) setOptions(options JournalRegionOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+	journal.options = options
+	//a shorter interval takes effect immediately
+	if journal.syncCountDown > options.SyncInterval {
+		journal.syncCountDown = options.SyncInterval
+	}
+	return nil
+}
+
 func InitialJournalRegion(writer io.Writer, sector block.BlockSize) {
-	//journal header, in sector one
-	padding := sector.AsU16() - 8
-	var buf = make([]byte, padding)
+	//journal header, in sector one, the new journals are stamped
+	var buf = make([]byte, sector.AsU16())
+	encodeJournalHeader(buf, 0, true, 0, newEpoch())
 	writer.Write(buf)
 
-	binary.Write(writer, binary.BigEndian, uint64(0))
-
 	//first record in sector two
 	r := EndOfRecords{}
 	if err := r.WriteTo(writer); err != nil {
@@ -49,6 +259,13 @@ func InitialJournalRegion(writer io.Writer, sector block.BlockSize) {
 }
 
 func OpenJournalRegion(nvm nvm.NonVolatileMemory) (*JournalRegion, error) {
+	return OpenJournalRegionWithOptions(nvm, DefaultJournalRegionOptions())
+}
+
+func OpenJournalRegionWithOptions(nvm nvm.NonVolatileMemory, options JournalRegionOptions) (*JournalRegion, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
 
 	blockSize := nvm.BlockSize()
 
@@ -58,7 +275,7 @@ func OpenJournalRegion(nvm nvm.NonVolatileMemory) (*JournalRegion, error) {
 	}
 
 	headerRegion := NewJournalHeadRegion(headerNVM)
-	header, err := headerRegion.ReadFrom()
+	header, seq, err := headerRegion.ReadFrom()
 	if err != nil {
 		return nil, err
 	}
@@ -67,56 +284,269 @@ func OpenJournalRegion(nvm nvm.NonVolatileMemory) (*JournalRegion, error) {
 	//if
 	ringBuffer := NewJournalNvmBuffer(ringNVM)
 	ring := NewJournalRingBuffer(ringBuffer, header)
+	ring.setSeq(headerRegion.Stamped(), seq)
 	//else
 	//ring := NewJournalRingBuffer(ringNVM, header)
 
+	//the laps of an unstamped journal are not known after reopen, so its cursors are dropped
+	epoch := headerRegion.Epoch()
+	if epoch == 0 {
+		epoch = newEpoch()
+		headerRegion.setEpoch(epoch)
+	}
+
 	q := queue.New()
 	q.Init()
 	return &JournalRegion{
 		headerRegion:  headerRegion,
 		ring:          ring,
 		gcQueue:       q,
-		syncCountDown: SYNC_INTERVAL,
+		syncCountDown: options.SyncInterval,
 		gcAfterAppend: true,
+		options:       options,
+		epoch:         epoch,
+		seqBase:       seq,
 	}, nil
 }
 
-func (journal *JournalRegion) RestoreIndex(index *lumpindex.LumpIndex) {
-	var entry JournalEntry
-	var err error
-	iter := journal.ring.BufferedIter()
+//newEpoch returns the epoch of a new journal, it is never 0
+func newEpoch() uint64 {
+	return uint64(time.Now().UnixNano()) | 1
+}
+
+//RestoreIndex replays all the records into the index, it returns the number of replayed records
+func (journal *JournalRegion) RestoreIndex(index *lumpindex.LumpIndex) int {
+	return journal.restoreIndexFrom(index, journal.ring.BufferedIter())
+}
+
+/*
+Position returns the position where the next record will be appended and its sequence.
+If the index is saved after Sync, it could be restored by RestoreIndexSince with them,
+the records before the position are not replayed.
+*/
+func (journal *JournalRegion) Position() (position uint64, seq uint32) {
+	return journal.ring.tail, journal.ring.tailSeq
+}
+
+/*
+RestoreIndexSince replays the records after the position returned by Position into the index,
+which must be the index when Position was called. It returns the number of replayed records.
+It fails with InvalidInput and nothing is replayed if the position is already released by GC,
+or the journal is not stamped, so the position could not be checked. Call it instead of RestoreIndex.
+*/
+func (journal *JournalRegion) RestoreIndexSince(index *lumpindex.LumpIndex, position uint64, seq uint32) (int, error) {
+	ring := journal.ring
+	if position >= ring.Capacity() || !ring.stamped {
+		return 0, errors.Wrapf(internalerror.InvalidInput, "journal position %d could not be restored", position)
+	}
+	//the position is in the same lap of the head, or in the next lap before the head
+	var laps uint64
+	switch {
+	case seq == ring.headSeq && position >= ring.head:
+	case seq == ring.headSeq+1 && position < ring.head:
+		laps = 1
+	default:
+		return 0, errors.Wrapf(internalerror.InvalidInput,
+			"journal position %d of sequence %d is released, the head is %d of sequence %d", position, seq, ring.head, ring.headSeq)
+	}
+	ring.tail = position
+	ring.tailSeq = seq
+	ring.tailLaps = laps
+	//the journal is closed cleanly at the position, there is no record to replay
+	if journal.CleanAt(position, seq) {
+		if progress := journal.options.OnRestoreProgress; progress != nil {
+			progress(RestoreProgress{Done: true})
+		}
+		journal.seqBase = ring.tailSeq - uint32(ring.tailLaps)
+		return 0, nil
+	}
+	return journal.restoreIndexFrom(index, ring.bufferedIterFrom(position)), nil
+}
+
+/*
+MarkClean syncs the records, and marks the journal header clean with the position of the tail,
+so RestoreIndexSince from the same position skips reading the journal. The mark is cleared
+before the next record is appended. It does nothing if the journal is not stamped.
+*/
+func (journal *JournalRegion) MarkClean() error {
+	if err := journal.SyncChecked(); err != nil {
+		return err
+	}
+	if !journal.ring.stamped {
+		return nil
+	}
+	return journal.headerRegion.MarkClean(journal.ring.tail, journal.ring.tailSeq)
+}
+
+//Clean returns true if the journal header is marked clean
+func (journal *JournalRegion) Clean() bool {
+	_, _, clean := journal.headerRegion.Clean()
+	return clean
+}
+
+//CleanAt returns true if the journal header is marked clean at the position returned by Position
+func (journal *JournalRegion) CleanAt(position uint64, seq uint32) bool {
+	tail, tailSeq, clean := journal.headerRegion.Clean()
+	return clean && tail == position && tailSeq == seq
+}
+
+//RESTORE_BATCH_SIZE is the number of the parsed records sent to the index at once while restoring
+const RESTORE_BATCH_SIZE = 1024
+
+type restoreBatch struct {
+	entries []JournalEntry
+	err     error
+	//replayed is the bytes read from the start of the restore after the entries
+	replayed uint64
+}
+
+/*
+restoreIndexFrom parses the records in another goroutine and updates the index in this one,
+so parsing and inserting run in a pipeline. The ring is only changed by the parsing goroutine
+until it closes the channel.
+*/
+func (journal *JournalRegion) restoreIndexFrom(index *lumpindex.LumpIndex, iter BufferedIter) (replayed int) {
+	capacity := journal.ring.Capacity()
+	//the ring from the tail to the head, the whole ring if they are the same
+	total := capacity - (journal.ring.tail+capacity-journal.ring.head)%capacity
+	batches := make(chan restoreBatch, 4)
+	go journal.parseRecords(iter, batches)
+	defer func() {
+		//the parsing goroutine must be done if the index fails to be restored
+		for range batches {
+		}
+		//this iter has more than one goroutine to read data from nvm
+		//It must be sure all the goroutines are closed before normal operations
+		iter.Close()
+	}()
+
+	progress := journal.options.OnRestoreProgress
+	for batch := range batches {
+		for _, entry := range batch.entries {
+			restoreEntry(index, entry)
+			replayed++
+		}
+		if batch.err != nil {
+			panic(fmt.Sprintf("Can not restore journal :%v", batch.err))
+		}
+		if progress != nil {
+			replayedBytes := batch.replayed
+			if replayedBytes > total {
+				replayedBytes = total
+			}
+			progress(RestoreProgress{ReplayedBytes: replayedBytes, TotalBytes: total, Entries: replayed})
+		}
+	}
+	if progress != nil {
+		progress(RestoreProgress{ReplayedBytes: total, TotalBytes: total, Entries: replayed, Done: true})
+	}
+	journal.seqBase = journal.ring.tailSeq - uint32(journal.ring.tailLaps)
+	return replayed
+}
+
+func (journal *JournalRegion) parseRecords(iter BufferedIter, batches chan<- restoreBatch) {
+	defer close(batches)
+	ring := journal.ring
+	start, laps := ring.tail, ring.tailLaps
+	replayed := func() uint64 {
+		return (ring.tailLaps-laps)*ring.Capacity() + ring.tail - start
+	}
+	batch := make([]JournalEntry, 0, RESTORE_BATCH_SIZE)
 	for {
-		entry, err = iter.PopFront()
+		entry, err := iter.PopFront()
 		if err != nil {
-			if err != internalerror.NoEntries {
-				panic(fmt.Sprintf("Can not restore journal :%v", err))
+			if err == internalerror.NoEntries {
+				break
 			}
-			break
+			if isTornRecord(err) {
+				//the records after the last sync may be torn by a crash, they are not acknowledged,
+				//so the journal ends here, and the next append overwrites them. The stale records
+				//of the previous laps are rejected by their stamps, so they end the journal too
+				fmt.Printf("journal is truncated at %d: %v\n", journal.ring.tail, err)
+				journal.ring.truncateTail()
+				break
+			}
+			batches <- restoreBatch{entries: batch, err: err, replayed: replayed()}
+			return
+		}
+		batch = append(batch, entry)
+		if len(batch) == RESTORE_BATCH_SIZE {
+			batches <- restoreBatch{entries: batch, replayed: replayed()}
+			batch = make([]JournalEntry, 0, RESTORE_BATCH_SIZE)
 		}
-		switch record := entry.Record.(type) {
-		case PutRecord:
-			index.InsertDataPortion(record.LumpID, record.DataPortion)
-		case EmbedRecord:
-			portionOnJournal := portion.NewJournalPortion(entry.Start.AsU64()+EMBEDDED_DATA_OFFSET, uint16(len(record.Data)))
-			index.InsertJournalPortion(record.LumpID, portionOnJournal)
-		case DeleteRange:
-			index.DeleteRange(record.Start, record.End)
-		case DeleteRecord:
-			index.Delete(record.LumpID)
-		case EndOfRecords, GoToFront:
-			panic("read out an unexpected record")
-		default:
-			panic("never be here")
+	}
+	if len(batch) > 0 {
+		batches <- restoreBatch{entries: batch, replayed: replayed()}
+	}
+}
+
+func restoreEntry(index *lumpindex.LumpIndex, entry JournalEntry) {
+	switch record := entry.Record.(type) {
+	case PutRecord:
+		index.InsertDataPortion(record.LumpID, record.DataPortion)
+	case PutBatchRecord:
+		for _, put := range record.Puts {
+			index.InsertDataPortion(put.LumpID, put.DataPortion)
 		}
+	case PutWithTTLRecord:
+		index.InsertDataPortionWithExpire(record.LumpID, record.DataPortion, record.ExpireAt)
+	case PutWithMetadataRecord:
+		index.InsertDataPortionWithMetadata(record.LumpID, record.DataPortion, record.Metadata)
+		index.SetTag(record.LumpID, record.LumpTag)
+	case EmbedRecord:
+		portionOnJournal := portion.NewJournalPortion(entry.Start.AsU64()+EMBEDDED_DATA_OFFSET, uint16(len(record.Data)))
+		index.InsertJournalPortion(record.LumpID, portionOnJournal)
+	case EmbedWithMetadataRecord:
+		portionOnJournal := portion.NewJournalPortion(entry.Start.AsU64()+EMBEDDED_DATA_OFFSET, uint16(len(record.Data)))
+		index.InsertJournalPortionWithMetadata(record.LumpID, portionOnJournal, record.Metadata)
+		index.SetTag(record.LumpID, record.LumpTag)
+	case DeleteRange:
+		index.DeleteRange(record.Start, record.End)
+	case DeleteRecord:
+		index.Delete(record.LumpID)
+	case TransactionRecord:
+		applyTransaction(index, record)
+	case MarkerRecord:
+		index.InsertMarker(record.ID, record.Data)
+	case ReleaseMarkerRecord:
+		index.DeleteMarker(record.ID)
+	case OverwriteRecord:
+		//the lump data is overwritten in the same portion, the index is not changed
+	case PutDedupRecord:
+		index.InsertDataPortionWithHash(record.LumpID, record.DataPortion, record.Hash)
+	case PutExtentsRecord:
+		index.InsertDataExtentsWithAttributes(record.LumpID, record.Extents, record.ExpireAt, record.Metadata)
+		index.SetTag(record.LumpID, record.LumpTag)
+	case EndOfRecords, GoToFront:
+		panic("read out an unexpected record")
+	default:
+		panic("never be here")
+	}
+}
+
+func applyTransaction(index *lumpindex.LumpIndex, tx TransactionRecord) {
+	for _, id := range tx.Deletes {
+		index.Delete(id)
+	}
+	for _, put := range tx.Puts {
+		index.InsertDataPortion(put.LumpID, put.DataPortion)
 	}
-	//this iter has more than one goroutine to read data from nvm
-	//It must be sure all the goroutines are closed before normal operations
-	iter.Close()
+}
+
+func isTornRecord(err error) bool {
+	return internalerror.Is(err, internalerror.StorageCorrupted) || internalerror.Is(err, io.EOF) ||
+		internalerror.Is(err, io.ErrUnexpectedEOF)
 }
 
 func (journal *JournalRegion) append(index *lumpindex.LumpIndex, record JournalRecord) error {
 	var err error
 	var embeded portion.JournalPortion
+	//the records after the clean tail are not replayed until the mark is cleared
+	if _, _, clean := journal.headerRegion.Clean(); clean {
+		if err = journal.headerRegion.WriteTo(journal.headerRegion.head, journal.headerRegion.seq); err != nil {
+			return err
+		}
+	}
 	if embeded, err = journal.ring.Enqueue(record); err != nil {
 		return err
 	}
@@ -125,21 +555,146 @@ func (journal *JournalRegion) append(index *lumpindex.LumpIndex, record JournalR
 	switch v := record.(type) {
 	case EmbedRecord:
 		index.InsertJournalPortion(v.LumpID, embeded)
+	case EmbedWithMetadataRecord:
+		index.InsertJournalPortionWithMetadata(v.LumpID, embeded, v.Metadata)
+		index.SetTag(v.LumpID, v.LumpTag)
+	case PutBatchRecord:
+		for _, put := range v.Puts {
+			index.InsertDataPortion(put.LumpID, put.DataPortion)
+		}
+	case PutWithTTLRecord:
+		index.InsertDataPortionWithExpire(v.LumpID, v.DataPortion, v.ExpireAt)
+	case PutWithMetadataRecord:
+		index.InsertDataPortionWithMetadata(v.LumpID, v.DataPortion, v.Metadata)
+		index.SetTag(v.LumpID, v.LumpTag)
+	case TransactionRecord:
+		applyTransaction(index, v)
+	case PutDedupRecord:
+		index.InsertDataPortionWithHash(v.LumpID, v.DataPortion, v.Hash)
+	case PutExtentsRecord:
+		index.InsertDataExtentsWithAttributes(v.LumpID, v.Extents, v.ExpireAt, v.Metadata)
+		index.SetTag(v.LumpID, v.LumpTag)
+	case MarkerRecord:
+		index.InsertMarker(v.ID, v.Data)
+	case ReleaseMarkerRecord:
+		//before GC after append, so the marker is not kept again
+		index.DeleteMarker(v.ID)
 	}
 	return nil
 }
 
-func (journal *JournalRegion) appendWithGC(index *lumpindex.LumpIndex, record JournalRecord) (err error) {
+func (journal *JournalRegion) appendWithGC(index *lumpindex.LumpIndex, record JournalRecord) error {
+	return journal.appendWithGCAndSync(index, record, true)
+}
+
+//appendWithGCAndSync does not count the record for SyncInterval if sync is false,
+//it is durable after the next Sync
+func (journal *JournalRegion) appendWithGCAndSync(index *lumpindex.LumpIndex, record JournalRecord, sync bool) (err error) {
+	if err = journal.throttle(index); err != nil {
+		return err
+	}
 	if err = journal.append(index, record); err != nil {
 		return err
 	}
 	if journal.gcAfterAppend {
-		journal.gcOnce(index)
+		if journal.options.GcTargetFreeRatio > 0 {
+			journal.pacedGC(index, uint64(record.ExternalSize()))
+		} else {
+			journal.gcOnce(index)
+		}
+	}
+	if sync {
+		journal.trySync()
 	}
-	journal.trySync()
 	return
 }
 
+func (journal *JournalRegion) overHighWatermark() bool {
+	return journal.options.HighWatermark > 0 &&
+		float64(journal.ring.Usage()) > float64(journal.ring.Capacity())*journal.options.HighWatermark
+}
+
+//Admit returns JournalFull if the next append would fail fast, see SetThrottle. It is checked
+//before the index is changed for a record, so a rejected append does not leave the change unjournaled
+func (journal *JournalRegion) Admit() error {
+	if !journal.options.ThrottleFailFast || !journal.overHighWatermark() {
+		return nil
+	}
+	if journal.observer != nil {
+		journal.observer.ObserveThrottle(0, true)
+	}
+	return errors.Wrapf(internalerror.JournalFull, "journal usage %d is over the high watermark", journal.ring.Usage())
+}
+
+//throttle runs the gc before an append if the ring is over the high watermark, see SetThrottle
+func (journal *JournalRegion) throttle(index *lumpindex.LumpIndex) error {
+	if !journal.overHighWatermark() {
+		return nil
+	}
+	if journal.options.ThrottleFailFast {
+		return journal.Admit()
+	}
+	start := time.Now()
+	//the bytes of the collected entries are released by the next fillGCQueue
+	lastUsage := uint64(math.MaxUint64)
+	for journal.overHighWatermark() {
+		if journal.gcQueue.Len() == 0 {
+			journal.fillGCQueue()
+			if journal.gcQueue.Len() == 0 || journal.ring.Usage() >= lastUsage {
+				break
+			}
+			lastUsage = journal.ring.Usage()
+			continue
+		}
+		journal.gcOnce(index)
+		journal.yieldGC()
+	}
+	if journal.observer != nil {
+		journal.observer.ObserveThrottle(time.Since(start), false)
+	}
+	return nil
+}
+
+func (journal *JournalRegion) freeRatio() float64 {
+	return 1 - float64(journal.ring.Usage())/float64(journal.ring.Capacity())
+}
+
+//pacedGC collects the budget of an append of appended bytes, see SetGcPacing
+func (journal *JournalRegion) pacedGC(index *lumpindex.LumpIndex, appended uint64) {
+	target := journal.options.GcTargetFreeRatio
+	free := journal.freeRatio()
+	if free >= target {
+		journal.gcDebt = 0
+		return
+	}
+	journal.gcDebt += uint64(float64(appended) * (1 + GC_PACING_GAIN*(target-free)/target))
+	if journal.gcDebt > GC_PACING_MAX_DEBT {
+		journal.gcDebt = GC_PACING_MAX_DEBT
+	}
+	//the queue is filled at most once, the live entries appended again are not read in the same call
+	filled := false
+	for journal.gcDebt > 0 {
+		if journal.gcQueue.Len() == 0 {
+			if filled || journal.freeRatio() >= target {
+				break
+			}
+			filled = true
+			journal.payDebt(journal.fillGCQueue())
+			continue
+		}
+		journal.payDebt(journal.gcOnce(index))
+		journal.yieldGC()
+	}
+}
+
+func (journal *JournalRegion) payDebt(n uint64) {
+	if n > journal.gcDebt {
+		journal.gcDebt = 0
+	} else {
+		journal.gcDebt -= n
+	}
+}
+
 func (Journal *JournalRegion) isGarbage(index *lumpindex.LumpIndex, entry JournalEntry) bool {
 	var dataPortion portion.DataPortion
 	var journalPortion portion.JournalPortion
@@ -157,7 +712,70 @@ func (Journal *JournalRegion) isGarbage(index *lumpindex.LumpIndex, entry Journa
 			return true
 		}
 
+		//the lump is put again with TTL, metadata, content hash or extents at the same portion
+		if _, ok = index.ExpireAt(v.LumpID); ok {
+			return true
+		}
+		if _, ok = index.Metadata(v.LumpID); ok {
+			return true
+		}
+		if _, ok = index.ContentHash(v.LumpID); ok {
+			return true
+		}
+		if _, ok = index.Extents(v.LumpID); ok {
+			return true
+		}
 		return dataPortion != v.DataPortion
+	case PutWithTTLRecord:
+		if p, err = index.Get(v.LumpID); err != nil {
+			return true
+		}
+		if dataPortion, ok = p.(portion.DataPortion); !ok || dataPortion != v.DataPortion {
+			return true
+		}
+		expireAt, _ := index.ExpireAt(v.LumpID)
+		return expireAt != v.ExpireAt
+	case PutWithMetadataRecord:
+		if p, err = index.Get(v.LumpID); err != nil {
+			return true
+		}
+		if dataPortion, ok = p.(portion.DataPortion); !ok || dataPortion != v.DataPortion {
+			return true
+		}
+		metadata, ok := index.Metadata(v.LumpID)
+		lumpTag, _ := index.Tag(v.LumpID)
+		return !ok || !bytes.Equal(metadata, v.Metadata) || lumpTag != v.LumpTag
+	case PutDedupRecord:
+		if p, err = index.Get(v.LumpID); err != nil {
+			return true
+		}
+		if dataPortion, ok = p.(portion.DataPortion); !ok || dataPortion != v.DataPortion {
+			return true
+		}
+		hash, ok := index.ContentHash(v.LumpID)
+		return !ok || hash != v.Hash
+	case PutExtentsRecord:
+		extents, ok := index.Extents(v.LumpID)
+		if !ok || len(extents) != len(v.Extents) {
+			return true
+		}
+		for i := range extents {
+			if extents[i] != v.Extents[i] {
+				return true
+			}
+		}
+		//the lump is put again at the same extents with other attributes
+		expireAt, _ := index.ExpireAt(v.LumpID)
+		metadata, hasMetadata := index.Metadata(v.LumpID)
+		lumpTag, _ := index.Tag(v.LumpID)
+		return expireAt != v.ExpireAt || hasMetadata != (v.Metadata != nil) || !bytes.Equal(metadata, v.Metadata) ||
+			lumpTag != v.LumpTag
+	case PutBatchRecord:
+		//a batch is garbage only if all of its puts are garbage
+		return len(Journal.livePuts(index, v)) == 0
+	case TransactionRecord:
+		//the deletes are garbage as DeleteRecord
+		return len(Journal.livePuts(index, PutBatchRecord{Puts: v.Puts})) == 0
 	case EmbedRecord:
 		//not found in current index, is garbage
 		if p, err = index.Get(v.LumpID); err != nil {
@@ -173,14 +791,37 @@ func (Journal *JournalRegion) isGarbage(index *lumpindex.LumpIndex, entry Journa
 		} else {
 			return true
 		}
-	default: /*delete, delete range are garbage*/
+	case EmbedWithMetadataRecord:
+		if p, err = index.Get(v.LumpID); err != nil {
+			return true
+		}
+		if journalPortion, ok = p.(portion.JournalPortion); !ok {
+			return true
+		}
+		return journalPortion.Start != entry.Start+EMBEDDED_DATA_OFFSET || int(journalPortion.Len) != len(v.Data)
+	case MarkerRecord:
+		data, ok := index.Marker(v.ID)
+		return !ok || !bytes.Equal(data, v.Data)
+	default: /*delete, delete range, release marker are garbage*/
 		return true
 	}
 }
 
-func (journal *JournalRegion) gcOnce(index *lumpindex.LumpIndex) {
-	if journal.gcQueue.Len() == 0 && journal.ring.Capacity() < journal.ring.Usage()*2 {
-		journal.fillGCQueue()
+//livePuts returns the puts in the batch which are still referenced by the index
+func (journal *JournalRegion) livePuts(index *lumpindex.LumpIndex, batch PutBatchRecord) []PutRecord {
+	puts := make([]PutRecord, 0, len(batch.Puts))
+	for _, put := range batch.Puts {
+		if journal.isGarbage(index, JournalEntry{Record: put}) == false {
+			puts = append(puts, put)
+		}
+	}
+	return puts
+}
+
+//gcOnce appends the first live entry of the gc queue again, it returns the bytes read and written
+func (journal *JournalRegion) gcOnce(index *lumpindex.LumpIndex) (n uint64) {
+	if journal.gcQueue.Len() == 0 && float64(journal.ring.Usage()) > float64(journal.ring.Capacity())*journal.options.GcTriggerRatio {
+		n += journal.fillGCQueue()
 	}
 
 	for {
@@ -189,7 +830,16 @@ func (journal *JournalRegion) gcOnce(index *lumpindex.LumpIndex) {
 
 			if journal.isGarbage(index, entry) == false {
 				record := entry.Record
+				//only keep the live part of a batch, the stale puts
+				//must not be replayed after their newer records
+				switch v := record.(type) {
+				case PutBatchRecord:
+					record = PutBatchRecord{Puts: journal.livePuts(index, v)}
+				case TransactionRecord:
+					record = PutBatchRecord{Puts: journal.livePuts(index, PutBatchRecord{Puts: v.Puts})}
+				}
 				journal.append(index, record)
+				n += uint64(record.ExternalSize())
 				goto ENDFOR
 			}
 
@@ -212,20 +862,31 @@ ENDFOR:
 			journal.ring.ReleaseBytesUntil(head)
 		}
 	*/
-
+	return
 }
 
+//writeUnusedJournalHeader is called with ring.head
 func (journal *JournalRegion) writeUnusedJournalHeader(head uint64) {
-	journal.headerRegion.WriteTo(head)
-	journal.ring.ReleaseBytesUntil(head)
+	head, seq := journal.retainForTailing(head, journal.ring.headSeq)
+	journal.headerRegion.WriteTo(head, seq)
+	journal.ring.releaseBytesUntil(head, seq)
 }
 
-func (journal *JournalRegion) fillGCQueue() {
+//fillGCQueue returns the bytes of the entries read into the gc queue
+func (journal *JournalRegion) fillGCQueue() (n uint64) {
 
 	var err error
 	if journal.ring.isEmpty() {
 		return
 	}
+	if journal.observer != nil {
+		journal.observer.ObserveGC()
+	}
+	if journal.hooks != nil {
+		defer func(start time.Time) {
+			journal.hooks.OnGC(start, time.Since(start))
+		}(time.Now())
+	}
 
 	if err = journal.ring.Flush(); err != nil {
 		panic(fmt.Sprintf("fillGCQueue %+v", err))
@@ -235,7 +896,7 @@ func (journal *JournalRegion) fillGCQueue() {
 	var i int
 	i = 0
 	iter := journal.ring.DequeueIter()
-	for i < GC_QUEUE_SIZE {
+	for i < journal.options.GcBatchSize {
 		entry, err := iter.PopFront()
 		//fmt.Printf("read entry: %+v, err: %+v\n", entry, err)
 		if err == internalerror.NoEntries {
@@ -245,16 +906,56 @@ func (journal *JournalRegion) fillGCQueue() {
 			panic(fmt.Sprintf("Journal failed to read entries %+v", err))
 		}
 		journal.gcQueue.PushBack(entry)
+		n += entry.End() - entry.Start.AsU64()
 		i++
+		//the embedded data is read by ReadAt, it does not move the cursor of iter
+		if i%GC_YIELD_INTERVAL == 0 {
+			journal.yieldGC()
+		}
+	}
+	return
+}
+
+/*
+Flush writes the buffered records to the nvm without sync, they are durable after the
+returned function is called. The function only syncs the nvm, it could be called in another
+goroutine while the journal is appended.
+*/
+func (journal *JournalRegion) Flush() (sync func() error, err error) {
+	if err = journal.ring.Flush(); err != nil {
+		return nil, err
 	}
+	return journal.ring.SyncFlushed, nil
 }
 
+//Sync syncs the ring, it panics if the sync fails, see SyncChecked
 func (journal *JournalRegion) Sync() {
-	var err error
-	if err = journal.ring.Sync(); err != nil {
+	if err := journal.SyncChecked(); err != nil {
 		panic(fmt.Sprintf("journal sync failed: %v", err))
 	}
-	journal.syncCountDown = SYNC_INTERVAL
+}
+
+//SyncChecked is the same as Sync, but the error of the sync is returned
+func (journal *JournalRegion) SyncChecked() error {
+	start := time.Now()
+	if err := journal.ring.Sync(); err != nil {
+		return err
+	}
+	journal.syncCountDown = journal.options.SyncInterval
+	journal.syncs++
+	if journal.observer != nil {
+		journal.observer.ObserveSync()
+	}
+	if journal.hooks != nil {
+		journal.hooks.OnJournalSync(start, time.Since(start))
+	}
+	return nil
+}
+
+//Syncs returns the number of the syncs completed by Sync, the records appended before
+//Syncs returns n are durable once it returns more than n
+func (journal *JournalRegion) Syncs() uint64 {
+	return journal.syncs
 }
 
 func (journal *JournalRegion) trySync() {
@@ -265,6 +966,35 @@ func (journal *JournalRegion) trySync() {
 	}
 }
 
+//WARNING: this will update the INDEX, because the expire time is kept in index
+func (journal *JournalRegion) RecordPutWithTTL(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion, expireAt uint64) error {
+	record := PutWithTTLRecord{
+		LumpID:      id,
+		DataPortion: data,
+		ExpireAt:    expireAt,
+	}
+	return journal.appendWithGC(index, record)
+}
+
+//WARNING: this will update the INDEX, because the metadata is kept in index
+func (journal *JournalRegion) RecordPutWithMetadata(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion, metadata []byte) error {
+	return journal.RecordPutWithTag(index, id, data, metadata, "")
+}
+
+//WARNING: this will update the INDEX, the lump is tagged if lumpTag is not empty
+func (journal *JournalRegion) RecordPutWithTag(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion, metadata []byte, lumpTag string) error {
+	if len(metadata) > lump.MAX_METADATA_SIZE || len(lumpTag) > lump.MAX_TAG_SIZE {
+		return internalerror.InvalidInput
+	}
+	record := PutWithMetadataRecord{
+		LumpID:      id,
+		DataPortion: data,
+		Metadata:    metadata,
+		LumpTag:     lumpTag,
+	}
+	return journal.appendWithGC(index, record)
+}
+
 //Write Journal, Update Index
 func (journal *JournalRegion) RecordPut(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion) error {
 	record := PutRecord{
@@ -274,6 +1004,94 @@ func (journal *JournalRegion) RecordPut(index *lumpindex.LumpIndex, id lump.Lump
 	return journal.appendWithGC(index, record)
 }
 
+//RecordPutRelaxed is the same as RecordPut, but it never syncs the ring, the record may be lost on crash
+func (journal *JournalRegion) RecordPutRelaxed(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion) error {
+	record := PutRecord{
+		LumpID:      id,
+		DataPortion: data,
+	}
+	return journal.appendWithGCAndSync(index, record, false)
+}
+
+//RecordOverwrite journals the overwrite of the lump data in its own portion, the index is not changed.
+//It is synced as RecordPut if sync is true, otherwise as RecordPutRelaxed
+func (journal *JournalRegion) RecordOverwrite(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion, sync bool) error {
+	record := OverwriteRecord{
+		LumpID:      id,
+		DataPortion: data,
+	}
+	return journal.appendWithGCAndSync(index, record, sync)
+}
+
+//WARNING: this will update the INDEX, the portion is shared by the lumps with the same hash.
+//It is synced as RecordPut if sync is true, otherwise as RecordPutRelaxed
+func (journal *JournalRegion) RecordPutDedup(index *lumpindex.LumpIndex, id lump.LumpId, data portion.DataPortion, hash lump.ContentHash, sync bool) error {
+	record := PutDedupRecord{
+		LumpID:      id,
+		DataPortion: data,
+		Hash:        hash,
+	}
+	return journal.appendWithGCAndSync(index, record, sync)
+}
+
+//WARNING: this will update the INDEX, the lump is stored in the extents in order.
+//It is synced as RecordPut if sync is true, otherwise as RecordPutRelaxed
+func (journal *JournalRegion) RecordPutExtents(index *lumpindex.LumpIndex, id lump.LumpId, extents []portion.DataPortion, sync bool) error {
+	if len(extents) == 0 || len(extents) > MAX_EXTENTS_COUNT {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid count of extents %d", len(extents))
+	}
+	record := PutExtentsRecord{
+		LumpID:  id,
+		Extents: extents,
+	}
+	return journal.appendWithGCAndSync(index, record, sync)
+}
+
+//WARNING: this will update the INDEX, the lump stored in the extents expires at expireAt unless it is 0,
+//it has the metadata unless it is nil, and it is tagged if lumpTag is not empty
+func (journal *JournalRegion) RecordPutExtentsWithAttributes(index *lumpindex.LumpIndex, id lump.LumpId, extents []portion.DataPortion,
+	expireAt uint64, metadata []byte, lumpTag string) error {
+	if len(extents) == 0 || len(extents) > MAX_EXTENTS_COUNT {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid count of extents %d", len(extents))
+	}
+	if len(metadata) > lump.MAX_METADATA_SIZE || len(lumpTag) > lump.MAX_TAG_SIZE {
+		return internalerror.InvalidInput
+	}
+	record := PutExtentsRecord{
+		LumpID:   id,
+		Extents:  extents,
+		ExpireAt: expireAt,
+		Metadata: metadata,
+		LumpTag:  lumpTag,
+	}
+	return journal.appendWithGC(index, record)
+}
+
+//WARNING: this will update the INDEX
+//All the puts are written as one journal entry, so they are restored all or nothing
+func (journal *JournalRegion) RecordPutBatch(index *lumpindex.LumpIndex, ids []lump.LumpId, data []portion.DataPortion) error {
+	if len(ids) != len(data) || len(ids) == 0 || len(ids) > MAX_PUT_BATCH_COUNT {
+		return internalerror.InvalidInput
+	}
+	puts := make([]PutRecord, len(ids))
+	for i := range ids {
+		puts[i] = PutRecord{
+			LumpID:      ids[i],
+			DataPortion: data[i],
+		}
+	}
+	return journal.appendWithGC(index, PutBatchRecord{Puts: puts})
+}
+
+//WARNING: this will update the INDEX
+//The puts and the deletes are written as one journal entry, so they are restored all or nothing
+func (journal *JournalRegion) RecordTransaction(index *lumpindex.LumpIndex, puts []PutRecord, deletes []lump.LumpId) error {
+	if len(puts)+len(deletes) == 0 || len(puts) > MAX_TRANSACTION_COUNT || len(deletes) > MAX_TRANSACTION_COUNT {
+		return internalerror.InvalidInput
+	}
+	return journal.appendWithGC(index, TransactionRecord{Puts: puts, Deletes: deletes})
+}
+
 //WARNING: this will update the INDEX
 func (journal *JournalRegion) RecordEmbed(index *lumpindex.LumpIndex, id lump.LumpId, data []byte) error {
 	if len(data) > lump.MAX_EMBEDDED_SIZE {
@@ -286,6 +1104,37 @@ func (journal *JournalRegion) RecordEmbed(index *lumpindex.LumpIndex, id lump.Lu
 	return journal.appendWithGC(index, record)
 }
 
+//RecordEmbedRelaxed is the same as RecordEmbed, but it never syncs the ring, the record may be lost on crash
+func (journal *JournalRegion) RecordEmbedRelaxed(index *lumpindex.LumpIndex, id lump.LumpId, data []byte) error {
+	if len(data) > lump.MAX_EMBEDDED_SIZE {
+		return internalerror.InvalidInput
+	}
+	record := EmbedRecord{
+		LumpID: id,
+		Data:   data,
+	}
+	return journal.appendWithGCAndSync(index, record, false)
+}
+
+//WARNING: this will update the INDEX
+func (journal *JournalRegion) RecordEmbedWithMetadata(index *lumpindex.LumpIndex, id lump.LumpId, data []byte, metadata []byte) error {
+	return journal.RecordEmbedWithTag(index, id, data, metadata, "")
+}
+
+//WARNING: this will update the INDEX, the lump is tagged if lumpTag is not empty
+func (journal *JournalRegion) RecordEmbedWithTag(index *lumpindex.LumpIndex, id lump.LumpId, data []byte, metadata []byte, lumpTag string) error {
+	if len(data) > lump.MAX_EMBEDDED_SIZE || len(metadata) > lump.MAX_METADATA_SIZE || len(lumpTag) > lump.MAX_TAG_SIZE {
+		return internalerror.InvalidInput
+	}
+	record := EmbedWithMetadataRecord{
+		LumpID:   id,
+		Data:     data,
+		Metadata: metadata,
+		LumpTag:  lumpTag,
+	}
+	return journal.appendWithGC(index, record)
+}
+
 func (journal *JournalRegion) RecordDelete(index *lumpindex.LumpIndex, id lump.LumpId) error {
 	record := DeleteRecord{
 		LumpID: id,
@@ -293,6 +1142,20 @@ func (journal *JournalRegion) RecordDelete(index *lumpindex.LumpIndex, id lump.L
 	return journal.appendWithGC(index, record)
 }
 
+//WARNING: this will update the INDEX
+//The marker is kept in the journal until RecordReleaseMarker
+func (journal *JournalRegion) RecordMarker(index *lumpindex.LumpIndex, id uint64, data []byte) error {
+	if len(data) > lump.MAX_EMBEDDED_SIZE {
+		return internalerror.InvalidInput
+	}
+	return journal.appendWithGC(index, MarkerRecord{ID: id, Data: data})
+}
+
+//WARNING: this will update the INDEX
+func (journal *JournalRegion) RecordReleaseMarker(index *lumpindex.LumpIndex, id uint64) error {
+	return journal.appendWithGC(index, ReleaseMarkerRecord{ID: id})
+}
+
 func (journal *JournalRegion) RecordDeleteRange(index *lumpindex.LumpIndex, start, end lump.LumpId) error {
 	record := DeleteRange{
 		Start: start,
@@ -301,14 +1164,19 @@ func (journal *JournalRegion) RecordDeleteRange(index *lumpindex.LumpIndex, star
 	return journal.appendWithGC(index, record)
 }
 
+//RunSideJobOnce fills the gc queue, syncs the journal or collects some entries, the reads and
+//writes of the gc are skipped if the limiter is not ready, see SetLimiter
 func (journal *JournalRegion) RunSideJobOnce(index *lumpindex.LumpIndex) {
 	if journal.gcQueue.Len() == 0 {
-		journal.fillGCQueue()
-	} else if journal.syncCountDown != SYNC_INTERVAL {
+		if journal.ready() {
+			journal.charge(journal.fillGCQueue())
+		}
+	} else if journal.syncCountDown != journal.options.SyncInterval {
 		journal.Sync()
 	} else {
-		for i := 0; i < GC_COUNT_IN_SIDE_JOB; i++ {
-			journal.gcOnce(index)
+		for i := 0; i < GC_COUNT_IN_SIDE_JOB && journal.ready(); i++ {
+			journal.charge(journal.gcOnce(index))
+			journal.yieldGC()
 		}
 		journal.trySync()
 	}
@@ -325,9 +1193,15 @@ func (journal *JournalRegion) GetEmbededData(embeded portion.JournalPortion) (bu
 func (journal *JournalRegion) gcAllEntriesInQueue(index *lumpindex.LumpIndex) {
 	for journal.gcQueue.Len() != 0 {
 		journal.gcOnce(index)
+		journal.yieldGC()
 	}
 }
 
+//Usage returns the bytes used in the ring, including the garbage not collected yet
+func (journal *JournalRegion) Usage() uint64 {
+	return journal.ring.Usage()
+}
+
 func (journal *JournalRegion) JournalEntries() (uint64, uint64, uint64, []JournalEntry) {
 	entries := make([]JournalEntry, 0, 100)
 	iter := journal.ring.ReadIter()
@@ -344,6 +1218,40 @@ func (journal *JournalRegion) JournalEntries() (uint64, uint64, uint64, []Journa
 	return journal.ring.unreleasedHead, journal.ring.head, journal.ring.tail, entries
 }
 
+/*
+Verify reads all the records in the ring like JournalEntries, and checks the embedded
+data is in the ring. It returns the number of records and the first error instead of panicking
+*/
+func (journal *JournalRegion) Verify() (records int, err error) {
+	ring := journal.ring
+	capacity := ring.Capacity()
+	if ring.unreleasedHead >= capacity || ring.head >= capacity || ring.tail >= capacity {
+		return 0, errors.Wrapf(internalerror.StorageCorrupted, "journal position out of range: head %d, %d, tail %d, capacity %d",
+			ring.unreleasedHead, ring.head, ring.tail, capacity)
+	}
+	iter := ring.ReadIter()
+	for {
+		_, err = iter.PopFront()
+		if err == internalerror.NoEntries {
+			return records, nil
+		}
+		if err != nil {
+			return records, errors.Wrapf(err, "failed to read the journal record after %d records", records)
+		}
+		records++
+	}
+}
+
+//VerifyEmbedded checks the embedded data is in the ring and could be read
+func (journal *JournalRegion) VerifyEmbedded(embeded portion.JournalPortion) error {
+	if embeded.Start.AsU64()+uint64(embeded.Len) > journal.ring.Capacity() {
+		return errors.Wrapf(internalerror.StorageCorrupted, "embedded data %d+%d is out of the journal",
+			embeded.Start.AsU64(), embeded.Len)
+	}
+	_, err := journal.GetEmbededData(embeded)
+	return err
+}
+
 //maybe sync
 func (journal *JournalRegion) GcAllEntries(index *lumpindex.LumpIndex) {
 	tail := journal.ring.Tail()
@@ -6,6 +6,7 @@ import (
 	"io"
 
 	"github.com/klauspost/readahead"
+	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/address"
 	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/nvm"
@@ -20,6 +21,17 @@ type JournalRingBuffer struct {
 	unreleasedHead uint64
 	head           uint64
 	tail           uint64
+	//how many times the tail and the unreleasedHead go back to front since open,
+	//they make the positions monotonic for JournalCursor
+	tailLaps     uint64
+	headLaps     uint64
+	releasedLaps uint64
+	//the records of a stamped ring are stamped with their sequence, which is increased
+	//after GoToFront and after a torn tail is truncated, see readStampedRecordFrom
+	stamped     bool
+	tailSeq     uint32
+	headSeq     uint32
+	releasedSeq uint32
 }
 
 func (ring *JournalRingBuffer) Head() uint64 {
@@ -40,17 +52,67 @@ func NewJournalRingBuffer(nvm *JournalNvmBuffer, head uint64) *JournalRingBuffer
 	}
 }
 
+//setSeq is called when the ring is opened, seq is the sequence of the record at head
+func (ring *JournalRingBuffer) setSeq(stamped bool, seq uint32) {
+	ring.stamped = stamped
+	ring.tailSeq = seq
+	ring.headSeq = seq
+	ring.releasedSeq = seq
+}
+
+func (ring *JournalRingBuffer) stamp(seq uint32) uint32 {
+	if !ring.stamped {
+		return 0
+	}
+	return seq
+}
+
+//readRecord reads a record between the unreleased head and the tail, its stamp must be in the range of them
+func (ring *JournalRingBuffer) readRecord(reader io.Reader) (JournalRecord, uint32, error) {
+	record, stamp, err := readStampedRecordFrom(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ring.stamped {
+		if stamp != 0 {
+			return nil, 0, errors.Wrapf(internalerror.StorageCorrupted, "checksum mismatch, tag %d", record.Tag())
+		}
+		return record, 0, nil
+	}
+	if stamp-ring.releasedSeq > ring.tailSeq-ring.releasedSeq {
+		return nil, 0, errors.Wrapf(internalerror.StorageCorrupted,
+			"stamp %d of tag %d is not in [%d, %d]", stamp, record.Tag(), ring.releasedSeq, ring.tailSeq)
+	}
+	return record, stamp, nil
+}
+
+/*
+checkRestoredStamp checks the record after the tail while the index is restored, it must be
+stamped with the sequence of the tail, or the next one if the tail was truncated before.
+The stale records of the previous laps, and the records left after a truncated tail are rejected.
+*/
+func (ring *JournalRingBuffer) checkRestoredStamp(record JournalRecord, stamp uint32) error {
+	if stamp != ring.stamp(ring.tailSeq) && (!ring.stamped || stamp != ring.tailSeq+1) {
+		return errors.Wrapf(internalerror.StorageCorrupted,
+			"stamp %d of tag %d at %d, expected %d", stamp, record.Tag(), ring.tail, ring.stamp(ring.tailSeq))
+	}
+	return nil
+}
+
+//truncateTail is called if the record at tail is torn, the records after it are written with the next sequence
+func (ring *JournalRingBuffer) truncateTail() {
+	if ring.stamped {
+		ring.tailSeq++
+	}
+}
+
 func (ring *JournalRingBuffer) isEmpty() bool {
 	return ring.head == ring.tail
 }
 
+//ReadEmbededBuffer does not move the cursor of the nvm, so it could be called while the ring is iterated
 func (ring *JournalRingBuffer) ReadEmbededBuffer(position uint64, data []byte) (err error) {
-	if _, err = ring.nvm.Seek(int64(position), io.SeekStart); err != nil {
-		return err
-	}
-	if _, err = ring.nvm.Read(data); err != nil {
-		return err
-	}
+	_, err = ring.nvm.ReadAt(data, int64(position))
 	return
 }
 
@@ -74,6 +136,12 @@ func (ring *JournalRingBuffer) Flush() error {
 	return ring.nvm.Flush()
 }
 
+//SyncFlushed syncs the records flushed before without touching the write buffer,
+//so it could run in another goroutine
+func (ring *JournalRingBuffer) SyncFlushed() error {
+	return ring.nvm.nvm.Sync()
+}
+
 //only return embeded JournalPortion
 func (ring *JournalRingBuffer) Enqueue(record JournalRecord) (jportion portion.JournalPortion, err error) {
 	jportion = portion.JournalPortion{}
@@ -90,12 +158,14 @@ func (ring *JournalRingBuffer) Enqueue(record JournalRecord) (jportion portion.J
 			return
 		}
 		r := GoToFront{}
-		if err = r.WriteTo(ring.nvm); err != nil {
+		if err = writeStampedRecord(r, ring.nvm, ring.stamp(ring.tailSeq)); err != nil {
 			return
 		}
 
 		//Jump to front
 		ring.tail = 0
+		ring.tailLaps++
+		ring.tailSeq++
 		return ring.Enqueue(record)
 	}
 
@@ -104,20 +174,22 @@ func (ring *JournalRingBuffer) Enqueue(record JournalRecord) (jportion portion.J
 	if _, err = ring.nvm.Seek(int64(ring.tail), io.SeekStart); err != nil {
 		return
 	}
-	if err = record.WriteTo(ring.nvm); err != nil {
+	if err = writeStampedRecord(record, ring.nvm, ring.stamp(ring.tailSeq)); err != nil {
 		return
 	}
 	ring.tail = ring.nvm.Position()
 
 	//4. write End OF Record
 	endRecord := EndOfRecords{}
-	if err = endRecord.WriteTo(ring.nvm); err != nil {
+	if err = writeStampedRecord(endRecord, ring.nvm, ring.stamp(ring.tailSeq)); err != nil {
 		return
 	}
 
 	switch r := record.(type) {
 	case EmbedRecord:
 		jportion = portion.NewJournalPortion(preTail+EMBEDDED_DATA_OFFSET, uint16(len(r.Data)))
+	case EmbedWithMetadataRecord:
+		jportion = portion.NewJournalPortion(preTail+EMBEDDED_DATA_OFFSET, uint16(len(r.Data)))
 	}
 	return
 }
@@ -150,7 +222,15 @@ func (ring *JournalRingBuffer) isOverFlow(record JournalRecord) bool {
 }
 
 func (ring *JournalRingBuffer) ReleaseBytesUntil(head uint64) {
+	ring.releaseBytesUntil(head, ring.headSeq)
+}
+
+func (ring *JournalRingBuffer) releaseBytesUntil(head uint64, seq uint32) {
+	if head < ring.unreleasedHead {
+		ring.releasedLaps++
+	}
 	ring.unreleasedHead = head
+	ring.releasedSeq = seq
 }
 
 /*No buffer and update head*/
@@ -161,7 +241,7 @@ type DequeueIter struct {
 }
 
 func (iter DequeueIter) PopFront() (entry JournalEntry, err error) {
-	record, err := ReadRecordFrom(iter.readBuf)
+	record, stamp, err := iter.ring.readRecord(iter.readBuf)
 	if err != nil {
 		return JournalEntry{}, err
 	}
@@ -171,6 +251,8 @@ func (iter DequeueIter) PopFront() (entry JournalEntry, err error) {
 			panic("has two GoToFront in journal")
 		}
 		iter.ring.head = 0
+		iter.ring.headLaps++
+		iter.ring.headSeq = stamp + 1
 		iter.readBuf.Seek(0, io.SeekStart)
 		iter.isSecondLoop = true
 		return iter.PopFront()
@@ -183,6 +265,7 @@ func (iter DequeueIter) PopFront() (entry JournalEntry, err error) {
 			Record: record,
 		}
 		iter.ring.head = entry.End()
+		iter.ring.headSeq = stamp
 		return entry, nil
 	}
 
@@ -196,13 +279,18 @@ type BufferedIter struct {
 
 //Update the ring.tail
 func (iter BufferedIter) PopFront() (entry JournalEntry, err error) {
-	record, err := ReadRecordFrom(iter.fastReader)
+	record, stamp, err := readStampedRecordFrom(iter.fastReader)
 	if err != nil {
 		return JournalEntry{}, err
 	}
+	if err = iter.ring.checkRestoredStamp(record, stamp); err != nil {
+		return JournalEntry{}, err
+	}
 	switch record.(type) {
 	case GoToFront:
 		iter.ring.tail = 0
+		iter.ring.tailLaps++
+		iter.ring.tailSeq = stamp + 1
 		iter.fastReader.Seek(0, io.SeekStart)
 		return iter.PopFront()
 	case EndOfRecords:
@@ -214,6 +302,7 @@ func (iter BufferedIter) PopFront() (entry JournalEntry, err error) {
 			Record: record,
 		}
 		iter.ring.tail = entry.End()
+		iter.ring.tailSeq = stamp
 		return entry, nil
 	}
 }
@@ -229,7 +318,8 @@ type ReadIter struct {
 
 /* No buffer and update nothing */
 func (iter ReadIter) PopFront() (entry JournalEntry, err error) {
-	record, err := ReadRecordFrom(iter.ring.nvm)
+	start := iter.ring.nvm.Position()
+	record, _, err := iter.ring.readRecord(iter.ring.nvm)
 	if err != nil {
 		return JournalEntry{}, err
 	}
@@ -242,22 +332,26 @@ func (iter ReadIter) PopFront() (entry JournalEntry, err error) {
 		return JournalEntry{}, internalerror.NoEntries
 	default:
 		entry = JournalEntry{
-			Start:  address.AddressFromU64(iter.ring.head),
+			Start:  address.AddressFromU64(start),
 			Record: record,
 		}
-		//current = entry.End()
 		return entry, nil
 	}
 }
 
 /*Use Buffer and update tail*/
 func (ring *JournalRingBuffer) BufferedIter() BufferedIter {
+	return ring.bufferedIterFrom(ring.head)
+}
+
+//bufferedIterFrom reads the records from the position instead of the head, the tail must be set to it
+func (ring *JournalRingBuffer) bufferedIterFrom(position uint64) BufferedIter {
 	ra, err := readahead.NewReadSeekerSize(ring.nvm, 4, 1<<20)
 	if err != nil {
 		panic("should not happen in create readahead buf")
 	}
 
-	if _, err := ra.Seek(int64(ring.head), 0); err != nil {
+	if _, err := ra.Seek(int64(position), 0); err != nil {
 		panic(fmt.Sprintf("panic in new DequeueIter %+v", err))
 	}
 	return BufferedIter{
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/thesues/cannyls-go/block"
 	"github.com/thesues/cannyls-go/internalerror"
@@ -175,3 +176,45 @@ func recordDeleteRange(start string, end string) JournalRecord {
 		End:   l1,
 	}
 }
+
+func TestRingBufferStaleLap(t *testing.T) {
+	f, _ := nvm.New(1024)
+	ring := NewJournalRingBuffer(NewJournalNvmBuffer(f), 0)
+	ring.setSeq(true, 0)
+	enqueue := func(i int) {
+		//everything is released, so the ring never gets full
+		ring.unreleasedHead = ring.tail
+		_, err := ring.Enqueue(recordPut(fmt.Sprintf("%04d", i), 100, 1))
+		assert.Nil(t, err)
+	}
+
+	//the puts have the same size, 50 of them fill the first lap
+	for i := 0; i < 55; i++ {
+		enqueue(i)
+	}
+	assert.Equal(t, uint64(1), ring.tailLaps)
+	assert.Nil(t, ring.Flush())
+	before := append([]byte{}, f.AsBytes()...)
+	enqueue(55)
+	assert.Nil(t, ring.Flush())
+
+	//the crash loses the END after the last put, a put of the first lap follows it
+	tail := ring.Tail()
+	putSize := tail / 6
+	crashed := append([]byte{}, before...)
+	copy(crashed[tail-putSize:tail], f.AsBytes()[tail-putSize:tail])
+
+	restored, _ := nvm.NewFromVec(crashed)
+	ring = NewJournalRingBuffer(NewJournalNvmBuffer(restored), 0)
+	ring.setSeq(true, 1)
+	iter := ring.BufferedIter()
+	defer iter.Close()
+	for i := 50; i < 56; i++ {
+		entry, err := iter.PopFront()
+		assert.Nil(t, err)
+		assert.Equal(t, recordPut(fmt.Sprintf("%04d", i), 100, 1), entry.Record)
+	}
+	_, err := iter.PopFront()
+	assert.Equal(t, internalerror.StorageCorrupted, errors.Cause(err))
+	assert.Equal(t, tail, ring.Tail())
+}
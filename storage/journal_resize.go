@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/address"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+const (
+	//the new header and journal region are written to path + JOURNAL_RESIZE_SUFFIX before they are copied
+	JOURNAL_RESIZE_SUFFIX = ".resize"
+	//the size of the buffer to copy the new journal region
+	JOURNAL_RESIZE_COPY_SIZE = 1 << 20
+)
+
+/*
+ResizeJournal changes the size of the journal region of a closed storage to journalSize bytes,
+the size of the file is not changed, so the data region is shrunk or grown at its front.
+
+The lumps in front of the new data region are moved behind it, then a new journal region which
+only has the records of the live lumps is written to path + JOURNAL_RESIZE_SUFFIX, and the
+addresses of the data portions are rebased on the new data region. At last the new journal
+region and header are copied into the storage, the header is the last one.
+
+The storage could not be opened if it crashes during the copy, running ResizeJournal again
+finishes the copy before anything else. It returns JournalStorageFull if the new journal region
+is too small for the live lumps, and StorageFull if the lumps could not be moved.
+*/
+func ResizeJournal(path string, journalSize uint64) error {
+	if err := finishJournalResize(path); err != nil {
+		return err
+	}
+	store, err := OpenCannylsStorage(path)
+	if err != nil {
+		return err
+	}
+	header, err := store.resizedJournalHeader(journalSize)
+	if err != nil || header.JournalRegionSize == store.storageHeader.JournalRegionSize {
+		store.Close()
+		return err
+	}
+	if err = store.moveOutOfJournal(header); err != nil {
+		store.Close()
+		return err
+	}
+	//the moves must be durable before the image is written
+	if err = store.journalRegion.SyncChecked(); err != nil {
+		store.Close()
+		return err
+	}
+	if err = store.writeJournalImage(path+JOURNAL_RESIZE_SUFFIX, header); err != nil {
+		store.Close()
+		return err
+	}
+	//the old journal region must not be written any more
+	store.innerNVM.Close()
+	return finishJournalResize(path)
+}
+
+func (store *Storage) resizedJournalHeader(journalSize uint64) (*nvm.StorageHeader, error) {
+	blockSize := store.innerNVM.BlockSize()
+	header := *store.storageHeader
+	total := header.JournalRegionSize + header.DataRegionSize
+	if !blockSize.IsAligned(journalSize) || journalSize < uint64(blockSize.AsU16())*2 ||
+		journalSize > MAX_JOURNAL_REGION_SIZE || journalSize+uint64(blockSize.AsU16()) > total {
+		return nil, errors.Wrapf(internalerror.InvalidInput,
+			"invalid journal size %d, the journal and data regions have %d bytes", journalSize, total)
+	}
+	header.JournalRegionSize = journalSize
+	header.DataRegionSize = total - journalSize
+	if header.DataRegionSize > MAX_DATA_REGION_SIZE {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "data size is too big: %d", header.DataRegionSize)
+	}
+	return &header, nil
+}
+
+//journalShift returns the number of blocks the data region starts later in the header, it is negative if earlier
+func (store *Storage) journalShift(header *nvm.StorageHeader) int64 {
+	blockSize := uint64(store.innerNVM.BlockSize().AsU16())
+	return int64(header.JournalRegionSize/blockSize) - int64(store.storageHeader.JournalRegionSize/blockSize)
+}
+
+//moveOutOfJournal moves the lumps in front of the new data region behind it, and journals the moves
+func (store *Storage) moveOutOfJournal(header *nvm.StorageHeader) error {
+	shift := store.journalShift(header)
+	if shift <= 0 {
+		return nil
+	}
+	front := uint64(shift)
+	//the portions in front of the new data region are held until all the lumps are moved
+	var held []portion.DataPortion
+	defer func() {
+		for _, p := range held {
+			store.alloc.Release(p)
+		}
+	}()
+
+	for _, l := range store.lumpsByPortion() {
+		if l.Portion.Start.AsU64() >= front {
+			continue
+		}
+		var newPortion portion.DataPortion
+		for {
+			p, err := store.alloc.Allocate(l.Portion.Len)
+			if err != nil {
+				return errors.Wrapf(internalerror.StorageFull, "no space to move %s out of the journal region", l.Id)
+			}
+			store.dataRegion.allocated(p)
+			if p.Start.AsU64() >= front {
+				newPortion = p
+				break
+			}
+			held = append(held, p)
+		}
+		if err := store.dataRegion.copyPortion(l.Portion, newPortion); err != nil {
+			store.alloc.Release(newPortion)
+			return err
+		}
+		if err := store.recordMoves(l.Id, l.Portion, newPortion); err != nil {
+			if store.index.Refs(newPortion) == 0 {
+				store.alloc.Release(newPortion)
+			}
+			return err
+		}
+		held = append(held, l.Portion)
+	}
+	return nil
+}
+
+//writeJournalImage writes the header and a journal region of the live lumps into a new file at path
+func (store *Storage) writeJournalImage(path string, header *nvm.StorageHeader) (err error) {
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	file, err := nvm.CreateIfAbsent(tmpPath, header.RegionSize()+header.JournalRegionSize)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+	if err = formatNVM(file, header); err != nil {
+		file.Close()
+		return err
+	}
+	_, journalNVM, err := file.Split(header.RegionSize())
+	if err != nil {
+		file.Close()
+		return err
+	}
+	journalRegion, err := journal.OpenJournalRegion(journalNVM)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	shift := store.journalShift(header)
+	index := lumpindex.NewIndex()
+	iter := store.index.Iterator()
+	for id, p, ok := iter.Next(); ok && err == nil; id, p, ok = iter.Next() {
+		err = store.recordLive(journalRegion, index, id, p, shift)
+	}
+	iter.Close()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err = journalRegion.SyncChecked(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+//recordLive journals the lump into the new journal region, its data portion is rebased on the new data region
+func (store *Storage) recordLive(journalRegion *journal.JournalRegion, index *lumpindex.LumpIndex,
+	id lump.LumpId, p portion.Portion, shift int64) error {
+	metadata, hasMetadata := store.index.Metadata(id)
+	tag, _ := store.index.Tag(id)
+	switch v := p.(type) {
+	case portion.DataPortion:
+		if extents, ok := store.index.Extents(id); ok {
+			rebased := make([]portion.DataPortion, len(extents))
+			for i, extent := range extents {
+				extent.Start = address.AddressFromU64(uint64(int64(extent.Start.AsU64()) - shift))
+				rebased[i] = extent
+			}
+			expireAt, metadata, tag := store.attributesOf(id)
+			return journalRegion.RecordPutExtentsWithAttributes(index, id, rebased, expireAt, metadata, tag)
+		}
+		v.Start = address.AddressFromU64(uint64(int64(v.Start.AsU64()) - shift))
+		if expireAt, ok := store.index.ExpireAt(id); ok {
+			return journalRegion.RecordPutWithTTL(index, id, v, expireAt)
+		}
+		if hasMetadata {
+			return journalRegion.RecordPutWithTag(index, id, v, metadata, tag)
+		}
+		if err := journalRegion.RecordPut(index, id, v); err != nil {
+			return err
+		}
+		index.InsertDataPortion(id, v)
+		return nil
+	case portion.JournalPortion:
+		data, err := store.journalRegion.GetEmbededData(v)
+		if err != nil {
+			return err
+		}
+		if hasMetadata {
+			return journalRegion.RecordEmbedWithTag(index, id, data, metadata, tag)
+		}
+		return journalRegion.RecordEmbed(index, id, data)
+	default:
+		panic("never here")
+	}
+}
+
+//finishJournalResize copies the image written by ResizeJournal into the storage and removes it
+func finishJournalResize(path string) error {
+	imagePath := path + JOURNAL_RESIZE_SUFFIX
+	image, err := os.Open(imagePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	header, err := nvm.ReadFromFile(image)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the header of journal image")
+	}
+
+	file, _, err := nvm.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	regionSize := header.RegionSize()
+	//the header is the last one, so the storage is not opened with a half written journal region
+	if err = copyImage(image, file, regionSize, header.JournalRegionSize); err != nil {
+		return err
+	}
+	if err = copyImage(image, file, 0, regionSize); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(imagePath)
+}
+
+func copyImage(image *os.File, file nvm.NonVolatileMemory, offset uint64, size uint64) error {
+	buf := block.NewAlignedBytes(JOURNAL_RESIZE_COPY_SIZE, file.BlockSize())
+	for size > 0 {
+		n := uint64(JOURNAL_RESIZE_COPY_SIZE)
+		if n > size {
+			n = size
+		}
+		chunk := buf.AsBytes()[:n]
+		//the image is not extended beyond the last written block
+		read, err := image.ReadAt(chunk, int64(offset))
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "failed to read journal image")
+		}
+		for i := read; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		if _, err := file.WriteAt(chunk, int64(offset)); err != nil {
+			return err
+		}
+		offset += n
+		size -= n
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func filledData(size int, c byte) lump.LumpData {
+	data := lump.NewLumpDataAligned(size, block.Min())
+	buf := data.AsBytes()
+	for i := range buf {
+		buf[i] = c
+	}
+	return data
+}
+
+func TestStorageResizeJournal(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp30.lusf", 4*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp30.lusf")
+
+	for i := 0; i < 16; i++ {
+		_, err = store.Put(lumpidnum(i), filledData(10*1024, byte('a'+i)))
+		assert.Nil(t, err)
+	}
+	_, err = store.PutWithMetadata(lumpidnum(100), filledData(1000, 'x'), []byte("meta"))
+	assert.Nil(t, err)
+	_, err = store.PutEmbed(lumpidnum(200), []byte("embedded"))
+	assert.Nil(t, err)
+	oldHeader := store.Header()
+	store.Close()
+
+	err = ResizeJournal("tmp30.lusf", 1000)
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+	err = ResizeJournal("tmp30.lusf", oldHeader.JournalRegionSize+oldHeader.DataRegionSize)
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	check := func(journalSize uint64) {
+		store, err := OpenCannylsStorage("tmp30.lusf")
+		assert.Nil(t, err)
+		defer store.Close()
+		header := store.Header()
+		assert.Equal(t, journalSize, header.JournalRegionSize)
+		assert.Equal(t, oldHeader.StorageSize(), header.StorageSize())
+		assert.Equal(t, 18, len(store.List()))
+		for i := 0; i < 16; i++ {
+			data, err := store.Get(lumpidnum(i))
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(filledData(10*1024, byte('a'+i)).AsBytes(), data))
+		}
+		metadata, err := store.GetMetadata(lumpidnum(100))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("meta"), metadata)
+		data, err := store.Get(lumpidnum(200))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("embedded"), data)
+	}
+
+	//the lumps at the front of the data region are moved
+	assert.Nil(t, ResizeJournal("tmp30.lusf", 512*1024))
+	check(512 * 1024)
+	_, err = os.Stat("tmp30.lusf" + JOURNAL_RESIZE_SUFFIX)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, ResizeJournal("tmp30.lusf", 64*1024))
+	check(64 * 1024)
+
+	//an unfinished resizing is finished before the storage is opened
+	assert.Nil(t, ResizeJournal("tmp30.lusf", 64*1024))
+	store, err = OpenCannylsStorage("tmp30.lusf")
+	assert.Nil(t, err)
+	header := store.Header()
+	header.JournalRegionSize = 256 * 1024
+	header.DataRegionSize = oldHeader.JournalRegionSize + oldHeader.DataRegionSize - 256*1024
+	assert.Nil(t, store.moveOutOfJournal(&header))
+	store.journalRegion.Sync()
+	assert.Nil(t, store.writeJournalImage("tmp30.lusf"+JOURNAL_RESIZE_SUFFIX, &header))
+	store.innerNVM.Close()
+	_, err = OpenCannylsStorage("tmp30.lusf")
+	assert.Equal(t, internalerror.InconsistentState, errors.Cause(err))
+	assert.Nil(t, ResizeJournal("tmp30.lusf", 256*1024))
+	check(256 * 1024)
+}
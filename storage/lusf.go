@@ -0,0 +1,512 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/journal"
+	"github.com/thesues/cannyls-go/storage/migrate"
+	"github.com/thesues/cannyls-go/util"
+)
+
+/*
+The lusf files of the original cannyls in Rust, version 1.1
+
+The storage header, the journal header and the data trailer are the same as ours, but:
+the journal header only has the head(8 bytes), the records are never stamped,
+the lumpids in the records are 128 bit,
+the only records are END_OF_RECORDS, GO_TO_FRONT, PUT, EMBED, DELETE and DELETE_RANGE,
+the trailer of a data portion only has the padding size, there is no checksum and no compression.
+
+| checksum(4 bytes) | tag(1 byte) | lumpid(16 bytes) | length(2 bytes) | offset(5 bytes) |	PUT
+| checksum(4 bytes) | tag(1 byte) | lumpid(16 bytes) | length(2 bytes) | data |		EMBED
+| checksum(4 bytes) | tag(1 byte) | lumpid(16 bytes) |					DELETE
+| checksum(4 bytes) | tag(1 byte) | start(16 bytes) | end(16 bytes) |			DELETE_RANGE
+
+The checksum is the adler32 of the tag and the bytes after it, as our records.
+
+A Rust file is opened by OpenCannylsStorage directly, it is upgraded in place by the migration
+registered here: the live lumps are written as our records into the free space of the ring, then
+the journal header points to them with RUST_CONVERTED_MAGIC after the head, and the version is
+set to 2.1. The data region is not touched, its trailers are read as ours. The file is not
+converted if a lumpid does not fit in 64 bit, if a padding looks like the flags of our trailer, or
+if the ring has no room for the records, such a file could still be imported by ImportLusf.
+*/
+
+const (
+	RUST_LUMPID_SIZE = 16
+)
+
+var (
+	RUST_CONVERTED_MAGIC = [4]byte{'r', 's', 'g', 'o'}
+)
+
+func init() {
+	migrate.Register(migrate.Migration{
+		From:        migrate.Version{Major: nvm.RUST_MAJOR_VERSION, Minor: nvm.RUST_MINOR_VERSION},
+		To:          migrate.Version{Major: 2, Minor: 1},
+		Description: "the lusf file of the original cannyls in Rust",
+		Apply:       convertRustLusf,
+	})
+}
+
+//rustLumpId is the 128 bit lumpid of the Rust files
+type rustLumpId struct {
+	hi uint64
+	lo uint64
+}
+
+func (id rustLumpId) less(other rustLumpId) bool {
+	return id.hi < other.hi || (id.hi == other.hi && id.lo < other.lo)
+}
+
+//rustLump is a live lump of the Rust file, data is set if it is embedded
+type rustLump struct {
+	portion  portion.DataPortion
+	embedded bool
+	data     []byte
+}
+
+/*
+ExportLusf writes all the lumps into a new file at path, which could be opened by the original
+cannyls in Rust, or by OpenCannylsStorage, which converts it back. The lumps are laid out from
+the start of the data region, the journal region and the data region are grown if the Rust
+records or the Rust trailers do not fit in them. The metadata, the tags and the TTLs of the
+lumps are dropped, the expired lumps are not exported. It fails with InvalidInput if a lump is
+too large for a portion, see extent.go. The file must not exist.
+*/
+func (store *Storage) ExportLusf(path string) (err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	header := store.Header()
+	header.MajorVersion = nvm.RUST_MAJOR_VERSION
+	header.MinorVersion = nvm.RUST_MINOR_VERSION
+	bs := header.BlockSize
+	blockSize := uint64(bs.AsU16())
+
+	ids := store.index.List()
+	//the journal header, one block left for the GO_TO_FRONT of the next append in Rust
+	journalSize := 2*blockSize + journal.END_OF_RECORDS_SIZE
+	for _, id := range ids {
+		p, err := store.index.Get(id)
+		if err != nil {
+			return err
+		}
+		if v, ok := p.(portion.JournalPortion); ok {
+			journalSize += journal.RECORD_HEADER_SIZE + RUST_LUMPID_SIZE + journal.LENGTH_SIZE + uint64(v.Len)
+		} else {
+			journalSize += journal.RECORD_HEADER_SIZE + RUST_LUMPID_SIZE + journal.LENGTH_SIZE + journal.PORTION_SIZE
+		}
+	}
+	journalSize = bs.CeilAlign(journalSize)
+	if journalSize > header.JournalRegionSize {
+		header.JournalRegionSize = journalSize
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", path)
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	dataStart := header.RegionSize() + header.JournalRegionSize
+	records := new(bytes.Buffer)
+	var next uint64
+	for _, id := range ids {
+		if store.isExpired(id) {
+			continue
+		}
+		p, err := store.index.Get(id)
+		if err != nil {
+			return err
+		}
+		if store.background != nil {
+			store.background.Wait(uint64(p.SizeOnDisk(bs)))
+		}
+		rustId := rustLumpId{lo: id.U64()}
+		switch v := p.(type) {
+		case portion.DataPortion:
+			data, err := store.getData(id, v)
+			if err != nil {
+				return err
+			}
+			size := bs.CeilAlign(uint64(len(data)) + LUMP_DATA_TRAILER_SIZE)
+			if size/blockSize > 0xFFFF {
+				return errors.Wrapf(internalerror.InvalidInput, "lump %s of %d bytes does not fit in a portion", id.String(), len(data))
+			}
+			buf := make([]byte, size)
+			copy(buf, data)
+			util.PutUINT16(buf[size-LUMP_DATA_TRAILER_SIZE:], uint16(size-uint64(len(data))-LUMP_DATA_TRAILER_SIZE))
+			if _, err = file.WriteAt(buf, int64(dataStart+next*blockSize)); err != nil {
+				return errors.Wrapf(err, "failed to export lump %s", id.String())
+			}
+			writeRustPut(records, rustId, portion.NewDataPortion(next, uint16(size/blockSize)))
+			next += size / blockSize
+		case portion.JournalPortion:
+			data, err := store.getEmbedded(id, v)
+			if err != nil {
+				return err
+			}
+			writeRustEmbed(records, rustId, data)
+		default:
+			panic("never here")
+		}
+	}
+	writeRustRecord(records, journal.TAG_END_OF_RECORDS, nil)
+	if next*blockSize > header.DataRegionSize {
+		header.DataRegionSize = next * blockSize
+	}
+
+	//the journal header with the head at the start of the ring, the records follow it
+	journalBuf := make([]byte, blockSize+uint64(records.Len()))
+	copy(journalBuf[blockSize:], records.Bytes())
+	if _, err = file.WriteAt(journalBuf, int64(header.RegionSize())); err != nil {
+		return errors.Wrap(err, "failed to export journal region")
+	}
+	headBuf := new(bytes.Buffer)
+	if err = header.WriteHeaderRegionTo(headBuf); err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(headBuf.Bytes(), 0); err != nil {
+		return errors.Wrap(err, "failed to export storage header")
+	}
+	if err = file.Truncate(int64(header.StorageSize())); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+/*
+ImportLusf puts all the lumps of the file at path, which is written by the original cannyls in Rust,
+into store. The journal of the file is replayed from its head, as Rust opens the file. The lumps with
+the same ids are overwritten, other lumps in store are kept. The lumpids of the file must fit in 64 bit,
+or nothing is imported. If a put fails, the lumps before it are already imported.
+*/
+func ImportLusf(store *Storage, path string) (imported uint64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	header, err := nvm.ReadRustFrom(file)
+	if err != nil {
+		return 0, err
+	}
+	blockSize := uint64(header.BlockSize.AsU16())
+	if header.JournalRegionSize < 2*blockSize {
+		return 0, errors.Wrapf(internalerror.StorageCorrupted, "journal region of %d bytes is too small", header.JournalRegionSize)
+	}
+	var head [8]byte
+	if _, err = file.ReadAt(head[:], int64(header.RegionSize())); err != nil {
+		return 0, errors.Wrap(err, "failed to read journal header")
+	}
+	ring := io.NewSectionReader(file, int64(header.RegionSize()+blockSize), int64(header.JournalRegionSize-blockSize))
+	lumps, _, err := replayRustJournal(ring, util.GetUINT64(head[:]))
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make([]rustLumpId, 0, len(lumps))
+	for id := range lumps {
+		if id.hi != 0 {
+			return 0, errors.Wrapf(internalerror.InvalidInput, "lumpid %016x%016x does not fit in 64 bit", id.hi, id.lo)
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+
+	data := io.NewSectionReader(file, int64(header.RegionSize()+header.JournalRegionSize), int64(header.DataRegionSize))
+	for _, rustId := range ids {
+		l := lumps[rustId]
+		id := lump.FromU64(0, rustId.lo)
+		if l.embedded {
+			_, err = store.PutEmbed(id, l.data)
+		} else {
+			var buf []byte
+			if buf, err = readRustPortion(data, l.portion, blockSize); err != nil {
+				return imported, errors.Wrapf(err, "failed to read lump %s", id.String())
+			}
+			lumpdata := lump.NewLumpDataAligned(len(buf), block.Min())
+			copy(lumpdata.AsBytes(), buf)
+			_, err = store.Put(id, lumpdata)
+		}
+		if err != nil {
+			return imported, errors.Wrapf(err, "failed to import lump %s", id.String())
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+/*
+convertRustLusf rewrites the journal of a Rust file as ours, see the document of this file. The
+Rust journal is intact until the journal header is written, so an interrupted conversion is done
+again, and it is skipped if the journal header is already written.
+*/
+func convertRustLusf(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error {
+	blockSize := uint64(header.BlockSize.AsU16())
+	if header.JournalRegionSize < 2*blockSize {
+		return errors.Wrapf(internalerror.StorageCorrupted, "journal region of %d bytes is too small", header.JournalRegionSize)
+	}
+	reader := alignedReader{file}
+	journalStart := header.RegionSize()
+	headBlock := block.NewAlignedBytes(int(blockSize), header.BlockSize)
+	if _, err := file.ReadAt(headBlock.AsBytes(), int64(journalStart)); err != nil {
+		return errors.Wrap(err, "failed to read journal header")
+	}
+	headBuf := headBlock.AsBytes()
+	if string(headBuf[8:12]) == string(RUST_CONVERTED_MAGIC[:]) {
+		return nil
+	}
+	ringSize := header.JournalRegionSize - blockSize
+	ring := io.NewSectionReader(reader, int64(journalStart+blockSize), int64(ringSize))
+	head := util.GetUINT64(headBuf[:8])
+	lumps, tail, err := replayRustJournal(ring, head)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]rustLumpId, 0, len(lumps))
+	for id := range lumps {
+		if id.hi != 0 {
+			return errors.Wrapf(internalerror.InvalidInput, "lumpid %016x%016x does not fit in 64 bit", id.hi, id.lo)
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	dataStart := journalStart + header.JournalRegionSize
+	records := new(bytes.Buffer)
+	for _, rustId := range ids {
+		l := lumps[rustId]
+		id := lump.FromU64(0, rustId.lo)
+		if l.embedded {
+			err = journal.EmbedRecord{LumpID: id, Data: l.data}.WriteTo(records)
+		} else {
+			var trailer [LUMP_DATA_TRAILER_SIZE]byte
+			end := dataStart + (l.portion.Start.AsU64()+uint64(l.portion.Len))*blockSize
+			if l.portion.Len == 0 || end > header.StorageSize() {
+				return errors.Wrapf(internalerror.StorageCorrupted, "data portion of lump %s is out of the data region", id.String())
+			}
+			if _, err = reader.ReadAt(trailer[:], int64(end-LUMP_DATA_TRAILER_SIZE)); err != nil {
+				return errors.Wrapf(err, "failed to read lump %s", id.String())
+			}
+			padding := util.GetUINT16(trailer[:])
+			if padding&(CHECKSUM_FLAG|COMPRESSED_FLAG) != 0 || padding == PADDING_EXTENDED {
+				return errors.Wrapf(internalerror.InvalidInput, "padding %d of lump %s could not be read as ours", padding, id.String())
+			}
+			err = journal.PutRecord{LumpID: id, DataPortion: l.portion}.WriteTo(records)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = (journal.EndOfRecords{}).WriteTo(records); err != nil {
+		return err
+	}
+
+	//the records are written after the END_OF_RECORDS of Rust, or before its head
+	size := uint64(records.Len())
+	start := tail + journal.END_OF_RECORDS_SIZE
+	switch {
+	case head > tail && start+size <= head:
+	case head <= tail && start+size <= ringSize:
+	case head <= tail && size <= head:
+		start = 0
+	default:
+		return errors.Wrapf(internalerror.InvalidInput, "journal region has no room for the %d bytes of records", size)
+	}
+	if err = writeUnaligned(file, records.Bytes(), journalStart+blockSize+start); err != nil {
+		return errors.Wrap(err, "failed to write journal records")
+	}
+	util.PutUINT64(headBuf[:8], start)
+	copy(headBuf[8:12], RUST_CONVERTED_MAGIC[:])
+	if _, err = file.WriteAt(headBuf, int64(journalStart)); err != nil {
+		return errors.Wrap(err, "failed to write journal header")
+	}
+	return file.Sync()
+}
+
+//alignedReader reads any range of nvm by the aligned blocks around it
+type alignedReader struct {
+	nvm nvm.NonVolatileMemory
+}
+
+func (reader alignedReader) ReadAt(p []byte, offset int64) (int, error) {
+	bs := reader.nvm.BlockSize()
+	start := bs.FloorAlign(uint64(offset))
+	buf := block.NewAlignedBytes(int(bs.CeilAlign(uint64(offset)+uint64(len(p)))-start), bs)
+	if _, err := reader.nvm.ReadAt(buf.AsBytes(), int64(start)); err != nil {
+		return 0, err
+	}
+	return copy(p, buf.AsBytes()[uint64(offset)-start:]), nil
+}
+
+//writeUnaligned writes data at offset of nvm, the blocks around it are read and written back, and synced
+func writeUnaligned(file nvm.NonVolatileMemory, data []byte, offset uint64) error {
+	bs := file.BlockSize()
+	start := bs.FloorAlign(offset)
+	buf := block.NewAlignedBytes(int(bs.CeilAlign(offset+uint64(len(data)))-start), bs)
+	if _, err := file.ReadAt(buf.AsBytes(), int64(start)); err != nil {
+		return err
+	}
+	copy(buf.AsBytes()[offset-start:], data)
+	if _, err := file.WriteAt(buf.AsBytes(), int64(start)); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+//replayRustJournal reads the records from head to END_OF_RECORDS, and returns the live lumps and
+//the position of END_OF_RECORDS
+func replayRustJournal(ring *io.SectionReader, head uint64) (map[rustLumpId]rustLump, uint64, error) {
+	lumps := make(map[rustLumpId]rustLump)
+	if head >= uint64(ring.Size()) {
+		return nil, 0, errors.Wrapf(internalerror.StorageCorrupted, "journal head %d is out of the ring", head)
+	}
+	if _, err := ring.Seek(int64(head), io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	//the records are read until END_OF_RECORDS, a broken journal could loop forever
+	var read uint64
+	for read <= uint64(ring.Size()) {
+		var recordHeader [journal.RECORD_HEADER_SIZE]byte
+		if _, err := io.ReadFull(ring, recordHeader[:]); err != nil {
+			return nil, 0, errors.Wrap(err, "failed to read journal record")
+		}
+		checksum := binary.BigEndian.Uint32(recordHeader[:4])
+		tag := recordHeader[4]
+		var size int
+		switch tag {
+		case journal.TAG_END_OF_RECORDS, journal.TAG_GO_TO_FRONT:
+		case journal.TAG_PUT:
+			size = RUST_LUMPID_SIZE + journal.LENGTH_SIZE + journal.PORTION_SIZE
+		case journal.TAG_EMBED:
+			size = RUST_LUMPID_SIZE + journal.LENGTH_SIZE
+		case journal.TAG_DELETE:
+			size = RUST_LUMPID_SIZE
+		case journal.TAG_DELETE_RANGE:
+			size = 2 * RUST_LUMPID_SIZE
+		default:
+			return nil, 0, errors.Wrapf(internalerror.StorageCorrupted, "unknown record tag %d of Rust journal", tag)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(ring, payload); err != nil {
+			return nil, 0, errors.Wrap(err, "failed to read journal record")
+		}
+		if tag == journal.TAG_EMBED {
+			embedded := make([]byte, util.GetUINT16(payload[RUST_LUMPID_SIZE:]))
+			if _, err := io.ReadFull(ring, embedded); err != nil {
+				return nil, 0, errors.Wrap(err, "failed to read embedded data")
+			}
+			payload = append(payload, embedded...)
+		}
+		if rustChecksum(tag, payload) != checksum {
+			return nil, 0, errors.Wrapf(internalerror.StorageCorrupted, "checksum of record tag %d mismatch", tag)
+		}
+		read += uint64(journal.RECORD_HEADER_SIZE + len(payload))
+
+		switch tag {
+		case journal.TAG_END_OF_RECORDS:
+			tail, err := ring.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, 0, err
+			}
+			return lumps, uint64(tail) - journal.END_OF_RECORDS_SIZE, nil
+		case journal.TAG_GO_TO_FRONT:
+			if _, err := ring.Seek(0, io.SeekStart); err != nil {
+				return nil, 0, err
+			}
+		case journal.TAG_PUT:
+			p := portion.NewDataPortion(util.GetUINT40(payload[RUST_LUMPID_SIZE+journal.LENGTH_SIZE:]),
+				util.GetUINT16(payload[RUST_LUMPID_SIZE:RUST_LUMPID_SIZE+journal.LENGTH_SIZE]))
+			lumps[getRustLumpId(payload)] = rustLump{portion: p}
+		case journal.TAG_EMBED:
+			lumps[getRustLumpId(payload)] = rustLump{embedded: true, data: payload[RUST_LUMPID_SIZE+journal.LENGTH_SIZE:]}
+		case journal.TAG_DELETE:
+			delete(lumps, getRustLumpId(payload))
+		case journal.TAG_DELETE_RANGE:
+			start, end := getRustLumpId(payload), getRustLumpId(payload[RUST_LUMPID_SIZE:])
+			for id := range lumps {
+				if !id.less(start) && id.less(end) {
+					delete(lumps, id)
+				}
+			}
+		}
+	}
+	return nil, 0, errors.Wrap(internalerror.StorageCorrupted, "END_OF_RECORDS of Rust journal is not found")
+}
+
+//readRustPortion returns the lump data of the portion, whose trailer only has the padding size
+func readRustPortion(data io.ReaderAt, p portion.DataPortion, blockSize uint64) ([]byte, error) {
+	size := uint64(p.Len) * blockSize
+	if size == 0 {
+		return nil, errors.Wrap(internalerror.StorageCorrupted, "empty data portion")
+	}
+	buf := make([]byte, size)
+	if _, err := data.ReadAt(buf, int64(p.Start.AsU64()*blockSize)); err != nil {
+		return nil, err
+	}
+	padding := uint64(util.GetUINT16(buf[size-LUMP_DATA_TRAILER_SIZE:]))
+	if padding+LUMP_DATA_TRAILER_SIZE > size {
+		return nil, errors.Wrapf(internalerror.StorageCorrupted, "padding %d is larger than the portion", padding)
+	}
+	return buf[:size-LUMP_DATA_TRAILER_SIZE-padding], nil
+}
+
+func getRustLumpId(buf []byte) rustLumpId {
+	return rustLumpId{hi: util.GetUINT64(buf[:8]), lo: util.GetUINT64(buf[8:16])}
+}
+
+func putRustLumpId(buf []byte, id rustLumpId) {
+	util.PutUINT64(buf[:8], id.hi)
+	util.PutUINT64(buf[8:16], id.lo)
+}
+
+func rustChecksum(tag byte, payload []byte) uint32 {
+	hash := adler32.New()
+	hash.Write([]byte{tag})
+	hash.Write(payload)
+	return hash.Sum32()
+}
+
+func writeRustRecord(w *bytes.Buffer, tag byte, payload []byte) {
+	var buf [journal.RECORD_HEADER_SIZE]byte
+	binary.BigEndian.PutUint32(buf[:4], rustChecksum(tag, payload))
+	buf[4] = tag
+	w.Write(buf[:])
+	w.Write(payload)
+}
+
+func writeRustPut(w *bytes.Buffer, id rustLumpId, p portion.DataPortion) {
+	offset, len := p.AsInts()
+	var payload [RUST_LUMPID_SIZE + journal.LENGTH_SIZE + journal.PORTION_SIZE]byte
+	putRustLumpId(payload[:], id)
+	util.PutUINT16(payload[RUST_LUMPID_SIZE:RUST_LUMPID_SIZE+journal.LENGTH_SIZE], len)
+	util.PutUINT40(payload[RUST_LUMPID_SIZE+journal.LENGTH_SIZE:], offset)
+	writeRustRecord(w, journal.TAG_PUT, payload[:])
+}
+
+func writeRustEmbed(w *bytes.Buffer, id rustLumpId, data []byte) {
+	payload := make([]byte, RUST_LUMPID_SIZE+journal.LENGTH_SIZE, RUST_LUMPID_SIZE+journal.LENGTH_SIZE+len(data))
+	putRustLumpId(payload, id)
+	util.PutUINT16(payload[RUST_LUMPID_SIZE:], uint16(len(data)))
+	writeRustRecord(w, journal.TAG_EMBED, append(payload, data...))
+}
@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+//rustFixture is a file written as cannyls in Rust does, block size 512, a journal region of 4 blocks
+//and a data region of 4 blocks. The records are encoded here by hand, not by lusf.go
+type rustFixture struct {
+	file []byte
+}
+
+const (
+	fixtureJournalStart = 512
+	fixtureRingStart    = 1024
+	fixtureDataStart    = 2560
+)
+
+func newRustFixture(head uint64) *rustFixture {
+	f := &rustFixture{file: make([]byte, 512+4*512+4*512)}
+	header := []byte{
+		'l', 'u', 's', 'f',
+		0x00, 0x26, //header size
+		0x00, 0x01, //major version
+		0x00, 0x01, //minor version
+		0x02, 0x00, //block size
+		0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8, //uuid
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, //journal region size
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, //data region size
+	}
+	copy(f.file, header)
+	binary.BigEndian.PutUint64(f.file[fixtureJournalStart:], head)
+	return f
+}
+
+//record writes the record at the position of the ring, and returns the position after it
+func (f *rustFixture) record(pos int, tag byte, payload ...byte) int {
+	body := append([]byte{tag}, payload...)
+	binary.BigEndian.PutUint32(f.file[fixtureRingStart+pos:], adler32.Checksum(body))
+	copy(f.file[fixtureRingStart+pos+4:], body)
+	return pos + 4 + len(body)
+}
+
+func rustId(hi, lo uint64) []byte {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], hi)
+	binary.BigEndian.PutUint64(buf[8:], lo)
+	return buf[:]
+}
+
+func rustPut(hi, lo uint64, blocks uint16, offset byte) []byte {
+	return append(rustId(hi, lo), byte(blocks>>8), byte(blocks), 0, 0, 0, 0, offset)
+}
+
+func (f *rustFixture) block(offset int, data string) {
+	start := fixtureDataStart + offset*512
+	copy(f.file[start:], data)
+	binary.BigEndian.PutUint16(f.file[start+510:], uint16(510-len(data)))
+}
+
+func (f *rustFixture) save(t *testing.T, path string) {
+	assert.Nil(t, ioutil.WriteFile(path, f.file, 0644))
+}
+
+func TestImportRustLusf(t *testing.T) {
+	f := newRustFixture(1000)
+	//a stale record before the head
+	f.record(500, 3, rustPut(0, 9, 1, 3)...)
+	pos := f.record(1000, 3, rustPut(0, 1, 1, 0)...)
+	pos = f.record(pos, 3, rustPut(0, 3, 1, 1)...)
+	f.record(pos, 1)
+	pos = f.record(0, 4, append(rustId(0, 2), 0, 3, 'f', 'o', 'o')...)
+	pos = f.record(pos, 5, rustId(0, 3)...)
+	pos = f.record(pos, 3, rustPut(0, 4, 1, 2)...)
+	pos = f.record(pos, 6, append(rustId(0, 3), rustId(0, 5)...)...)
+	pos = f.record(pos, 3, rustPut(0, 5, 1, 2)...)
+	f.record(pos, 0)
+	f.block(0, "hello rust")
+	f.block(1, "deleted")
+	f.block(2, "lump five")
+	f.block(3, "stale")
+	f.save(t, "tmp73.lusf")
+	defer os.Remove("tmp73.lusf")
+
+	store, err := CreateCannylsStorage("tmp74.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp74.lusf")
+	defer store.Close()
+
+	imported, err := ImportLusf(store, "tmp73.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), imported)
+	assert.Equal(t, []lump.LumpId{lump.FromU64(0, 1), lump.FromU64(0, 2), lump.FromU64(0, 5)}, store.List())
+	data, err := store.Get(lump.FromU64(0, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello rust"), data)
+	data, err = store.Get(lump.FromU64(0, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), data)
+	data, err = store.Get(lump.FromU64(0, 5))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("lump five"), data)
+
+	//a broken record
+	f.file[fixtureRingStart+10] ^= 0xFF
+	f.save(t, "tmp73.lusf")
+	_, err = ImportLusf(store, "tmp73.lusf")
+	assert.True(t, internalerror.Is(err, internalerror.StorageCorrupted))
+
+	//our own files are not Rust files
+	_, err = ImportLusf(store, "tmp74.lusf")
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+}
+
+func TestImportRustLusf128BitId(t *testing.T) {
+	f := newRustFixture(0)
+	pos := f.record(0, 3, rustPut(0, 1, 1, 0)...)
+	pos = f.record(pos, 3, rustPut(1, 2, 1, 1)...)
+	f.record(pos, 0)
+	f.block(0, "fits")
+	f.block(1, "too long")
+	f.save(t, "tmp73.lusf")
+	defer os.Remove("tmp73.lusf")
+
+	store, err := CreateCannylsStorage("tmp74.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp74.lusf")
+	defer store.Close()
+
+	_, err = ImportLusf(store, "tmp73.lusf")
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+	assert.Equal(t, 0, len(store.List()))
+}
+
+func TestExportLusf(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp74.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp74.lusf")
+	defer store.Close()
+	assert.Nil(t, store.SetDataChecksum(true))
+	assert.Nil(t, store.SetCompression(COMPRESSION_LZ4))
+
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i % 7)
+	}
+	data := zeroedData(3000)
+	copy(data.AsBytes(), payload)
+	_, err = store.Put(lumpid("0000"), data)
+	assert.Nil(t, err)
+	_, err = store.PutEmbed(lumpid("0001"), []byte("foo"))
+	assert.Nil(t, err)
+	_, err = store.Put(lumpid("0002"), zeroedData(3))
+	assert.Nil(t, err)
+	_, err = store.Delete(lumpid("0002"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.ExportLusf("tmp73.lusf"))
+	defer os.Remove("tmp73.lusf")
+	//the file exists
+	assert.Error(t, store.ExportLusf("tmp73.lusf"))
+
+	file, err := ioutil.ReadFile("tmp73.lusf")
+	assert.Nil(t, err)
+	header := store.Header()
+	assert.Equal(t, []byte{'l', 'u', 's', 'f', 0x00, 0x26, 0x00, 0x01, 0x00, 0x01, 0x02, 0x00}, file[:12])
+	assert.Equal(t, header.UUID.Bytes(), file[12:28])
+	assert.Equal(t, header.JournalRegionSize, binary.BigEndian.Uint64(file[28:36]))
+	assert.Equal(t, header.DataRegionSize, binary.BigEndian.Uint64(file[36:44]))
+	assert.Equal(t, int(header.StorageSize()), len(file))
+	//the head, and the PUT of 0000 at the start of the ring with a 128 bit lumpid
+	assert.Equal(t, uint64(0), binary.BigEndian.Uint64(file[512:520]))
+	ring := file[1024:]
+	assert.Equal(t, byte(3), ring[4])
+	assert.Equal(t, rustId(0, 0), ring[5:21])
+	assert.Equal(t, adler32.Checksum(ring[4:28]), binary.BigEndian.Uint32(ring[:4]))
+	//the lump data at the start of the data region, the trailer only has the padding
+	dataStart := header.RegionSize() + header.JournalRegionSize
+	assert.Equal(t, payload, file[dataStart:dataStart+3000])
+	assert.Equal(t, uint16(6*512-3000-2), binary.BigEndian.Uint16(file[dataStart+6*512-2:]))
+
+	imported, err := CreateCannylsStorage("tmp75.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp75.lusf")
+	defer imported.Close()
+	n, err := ImportLusf(imported, "tmp73.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), n)
+	assert.Equal(t, []lump.LumpId{lumpid("0000"), lumpid("0001")}, imported.List())
+	got, err := imported.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, payload, got)
+	got, err = imported.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), got)
+}
+
+func TestOpenRustLusf(t *testing.T) {
+	//the ring wraps, the records of our journal are written between the tail and the head
+	f := newRustFixture(1000)
+	pos := f.record(1000, 3, rustPut(0, 1, 1, 0)...)
+	pos = f.record(pos, 3, rustPut(0, 3, 1, 1)...)
+	f.record(pos, 1)
+	pos = f.record(0, 4, append(rustId(0, 2), 0, 3, 'f', 'o', 'o')...)
+	pos = f.record(pos, 5, rustId(0, 3)...)
+	pos = f.record(pos, 3, rustPut(0, 5, 1, 2)...)
+	f.record(pos, 0)
+	f.block(0, "hello rust")
+	f.block(1, "deleted")
+	f.block(2, "lump five")
+	defer os.Remove("tmp73.lusf")
+
+	check := func(store *Storage) {
+		assert.Equal(t, []lump.LumpId{lump.FromU64(0, 1), lump.FromU64(0, 2), lump.FromU64(0, 5)}, store.List())
+		for id, expected := range map[uint64]string{1: "hello rust", 2: "foo", 5: "lump five"} {
+			data, err := store.Get(lump.FromU64(0, id))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(expected), data)
+		}
+	}
+	//an interrupted conversion is skipped after the journal header is written
+	for _, interrupted := range []bool{false, true} {
+		f.save(t, "tmp73.lusf")
+		if interrupted {
+			file, header, err := nvm.Open("tmp73.lusf")
+			assert.Nil(t, err)
+			assert.Nil(t, convertRustLusf(file, header))
+			assert.Equal(t, nvm.RUST_MAJOR_VERSION, header.MajorVersion)
+			assert.Nil(t, file.Close())
+		}
+		store, err := OpenCannylsStorage("tmp73.lusf")
+		assert.Nil(t, err)
+		header := store.Header()
+		assert.True(t, header.IsCurrentVersion())
+		check(store)
+		assert.Nil(t, store.Close())
+	}
+
+	//the converted file is our storage
+	store, err := OpenCannylsStorage("tmp73.lusf")
+	assert.Nil(t, err)
+	check(store)
+	_, err = store.PutEmbed(lump.FromU64(0, 6), []byte("go"))
+	assert.Nil(t, err)
+	_, err = store.Delete(lump.FromU64(0, 1))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+	store, err = OpenCannylsStorage("tmp73.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Equal(t, []lump.LumpId{lump.FromU64(0, 2), lump.FromU64(0, 5), lump.FromU64(0, 6)}, store.List())
+	report, err := store.Verify(VerifyOptions{Deep: true})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean(), "%v", report.Problems)
+}
+
+func TestOpenRustLusfNotConverted(t *testing.T) {
+	defer os.Remove("tmp73.lusf")
+	//a 128 bit lumpid
+	f := newRustFixture(0)
+	pos := f.record(0, 3, rustPut(1, 2, 1, 0)...)
+	f.record(pos, 0)
+	f.block(0, "too long")
+	f.save(t, "tmp73.lusf")
+	_, err := OpenCannylsStorage("tmp73.lusf")
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+
+	//a padding with the flags of our trailer
+	f = newRustFixture(0)
+	pos = f.record(0, 3, rustPut(0, 1, 1, 0)...)
+	f.record(pos, 0)
+	f.block(0, "flags")
+	binary.BigEndian.PutUint16(f.file[fixtureDataStart+510:], CHECKSUM_FLAG|505)
+	f.save(t, "tmp73.lusf")
+	_, err = OpenCannylsStorage("tmp73.lusf")
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+
+	//nothing is written, the file is still a Rust file
+	file, err := ioutil.ReadFile("tmp73.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, f.file, file)
+}
+
+func TestLusfRoundTrip(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp74.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp74.lusf")
+	for i := 0; i < 20; i++ {
+		_, err = store.Put(lumpidnum(i), thumbnailData(100+i*300, byte(i)))
+		assert.Nil(t, err)
+	}
+	_, err = store.PutEmbed(lumpidnum(100), []byte("embedded"))
+	assert.Nil(t, err)
+	assert.Nil(t, store.ExportLusf("tmp73.lusf"))
+	defer os.Remove("tmp73.lusf")
+	assert.Nil(t, store.Close())
+
+	//the exported file is opened directly, and exported again byte for byte
+	exported, err := OpenCannylsStorage("tmp73.lusf")
+	assert.Nil(t, err)
+	defer exported.Close()
+	for i := 0; i < 20; i++ {
+		data, err := exported.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		assert.Equal(t, thumbnailData(100+i*300, byte(i)).AsBytes(), data)
+	}
+	assert.Nil(t, exported.ExportLusf("tmp75.lusf"))
+	defer os.Remove("tmp75.lusf")
+	store, err = OpenCannylsStorage("tmp74.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Nil(t, store.ExportLusf("tmp76.lusf"))
+	defer os.Remove("tmp76.lusf")
+	first, err := ioutil.ReadFile("tmp76.lusf")
+	assert.Nil(t, err)
+	second, err := ioutil.ReadFile("tmp75.lusf")
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(first, second))
+}
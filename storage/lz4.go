@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+/*
+The LZ4 block format, https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+
+Every sequence is a token, the literals and a match. The high 4 bits of the token are the number
+of literals and the low 4 bits are the length of the match minus LZ4_MIN_MATCH, 15 means more
+bytes follow. The match is a 2 bytes little endian offset back into the decompressed data.
+The last sequence only has literals.
+*/
+const (
+	LZ4_MIN_MATCH = 4
+	//the last LZ4_LAST_LITERALS bytes are always literals
+	LZ4_LAST_LITERALS = 5
+	//a match must start LZ4_MATCH_LIMIT bytes before the end
+	LZ4_MATCH_LIMIT = 12
+	LZ4_MAX_OFFSET  = 0xFFFF
+	LZ4_HASH_BITS   = 16
+)
+
+//lz4Compress compresses src greedily with a hash table of the last position of every 4 bytes
+func lz4Compress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)+len(src)/255+16)
+	if len(src) <= LZ4_MATCH_LIMIT {
+		return lz4AppendSequence(dst, src, 0, 0)
+	}
+	//the positions are stored plus one, 0 means empty
+	table := make([]int32, 1<<LZ4_HASH_BITS)
+	anchor := 0
+	end := len(src) - LZ4_LAST_LITERALS
+	for i := 0; i < len(src)-LZ4_MATCH_LIMIT; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - LZ4_HASH_BITS)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > LZ4_MAX_OFFSET || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+			i--
+			ref--
+		}
+		n := LZ4_MIN_MATCH
+		for i+n < end && src[i+n] == src[ref+n] {
+			n++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+//lz4AppendSequence appends the literals and the match, the match is omitted if its length is 0
+func lz4AppendSequence(dst []byte, literals []byte, offset int, match int) []byte {
+	token := byte(minInt(len(literals), 15)) << 4
+	if match > 0 {
+		token |= byte(minInt(match-LZ4_MIN_MATCH, 15))
+	}
+	dst = append(dst, token)
+	dst = lz4AppendLength(dst, len(literals))
+	dst = append(dst, literals...)
+	if match > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		dst = lz4AppendLength(dst, match-LZ4_MIN_MATCH)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+//lz4Decompress decompresses src into dst, dst must be exactly the size of the decompressed data
+func lz4Decompress(src []byte, dst []byte) error {
+	corrupted := errors.Wrap(internalerror.StorageCorrupted, "corrupted lz4 block")
+	var si, di int
+	readLength := func(n int) (int, bool) {
+		if n != 15 {
+			return n, true
+		}
+		for si < len(src) {
+			b := src[si]
+			si++
+			n += int(b)
+			if b != 255 {
+				return n, true
+			}
+		}
+		return 0, false
+	}
+	for si < len(src) {
+		token := src[si]
+		si++
+		literals, ok := readLength(int(token >> 4))
+		if !ok || si+literals > len(src) || di+literals > len(dst) {
+			return corrupted
+		}
+		di += copy(dst[di:], src[si:si+literals])
+		si += literals
+		if si == len(src) {
+			break
+		}
+
+		if si+2 > len(src) {
+			return corrupted
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		match, ok := readLength(int(token & 15))
+		match += LZ4_MIN_MATCH
+		if !ok || offset == 0 || offset > di || di+match > len(dst) {
+			return corrupted
+		}
+		//the match may overlap itself, so it is copied byte by byte
+		for k := 0; k < match; k++ {
+			dst[di+k] = dst[di-offset+k]
+		}
+		di += match
+	}
+	if di != len(dst) {
+		return corrupted
+	}
+	return nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+/*
+WriteMarker appends an opaque marker of at most lump.MAX_EMBEDDED_SIZE bytes to the journal,
+such as a replication checkpoint, and returns its id. The marker is returned by ReadJournalSince
+as a journal.MarkerRecord, and it survives journal GC and reopening until ReleaseMarker.
+A marker may be read again by ReadJournalSince after GC moves it.
+*/
+func (store *Storage) WriteMarker(data []byte) (id uint64, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	id = 1
+	if ids := store.index.Markers(); len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+	if err = store.writeMarker(id, data); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (store *Storage) writeMarker(id uint64, data []byte) error {
+	if err := store.checkWritable(); err != nil {
+		return err
+	}
+	if len(data) > lump.MAX_EMBEDDED_SIZE {
+		return errors.Wrapf(internalerror.InvalidInput, "marker is too large: %d", len(data))
+	}
+	//the index is updated by journal
+	return store.journalRegion.RecordMarker(store.index, id, append([]byte{}, data...))
+}
+
+//ReleaseMarker lets journal GC collect the marker, released is false if it does not exist
+func (store *Storage) ReleaseMarker(id uint64) (released bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	if _, ok := store.index.Marker(id); !ok {
+		return false, nil
+	}
+	if err = store.journalRegion.RecordReleaseMarker(store.index, id); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//Marker returns the data of the marker, ok is false if it is not written or already released
+func (store *Storage) Marker(id uint64) (data []byte, ok bool) {
+	store.view(func() {
+		data, ok = store.index.Marker(id)
+	})
+	return
+}
+
+//Markers returns the ids of the markers which are not released in ascending order
+func (store *Storage) Markers() (ids []uint64) {
+	store.view(func() {
+		ids = store.index.Markers()
+	})
+	return
+}
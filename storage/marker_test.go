@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+func TestStorageMarker(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp35.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp35.lusf")
+	defer os.Remove("tmp35.ckpt")
+
+	cursor, err := store.JournalCursor()
+	assert.Nil(t, err)
+	id, err := store.WriteMarker([]byte("first"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), id)
+	id, err = store.WriteMarker([]byte("second"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), id)
+	_, err = store.WriteMarker(make([]byte, lump.MAX_EMBEDDED_SIZE+1))
+	assert.Error(t, err)
+
+	entries, _, err := store.ReadJournalSince(cursor, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, journal.MarkerRecord{ID: 1, Data: []byte("first")}, entries[0].Record)
+	assert.Nil(t, store.StopJournalTailing())
+
+	//the markers survive GC
+	for i := 0; i < 100; i++ {
+		_, err = store.Put(lumpidnum(i%10), zeroedData(100))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, store.JournalGC())
+	assert.Nil(t, store.JournalGC())
+	assert.Equal(t, []uint64{1, 2}, store.Markers())
+
+	released, err := store.ReleaseMarker(1)
+	assert.Nil(t, err)
+	assert.True(t, released)
+	released, err = store.ReleaseMarker(1)
+	assert.Nil(t, err)
+	assert.False(t, released)
+	assert.Nil(t, store.JournalGC())
+	assert.Nil(t, store.JournalGC())
+	store.Close()
+
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp35.ckpt"
+	for i := 0; i < 2; i++ {
+		//the first open replays the journal, the second one loads the checkpoint
+		store, err = OpenCannylsStorageWithOptions("tmp35.lusf", options)
+		assert.Nil(t, err)
+		assert.Equal(t, []uint64{2}, store.Markers())
+		data, ok := store.Marker(2)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("second"), data)
+		_, ok = store.Marker(1)
+		assert.False(t, ok)
+		store.Close()
+	}
+
+	store, err = OpenCannylsStorage("tmp35.lusf")
+	assert.Nil(t, err)
+	applied, err := store.ApplyJournalRecord(ReplicatedRecord{Record: journal.MarkerRecord{ID: 2, Data: []byte("second")}})
+	assert.Nil(t, err)
+	assert.False(t, applied)
+	applied, err = store.ApplyJournalRecord(ReplicatedRecord{Record: journal.MarkerRecord{ID: 7, Data: []byte("backup")}})
+	assert.Nil(t, err)
+	assert.True(t, applied)
+	applied, err = store.ApplyJournalRecord(ReplicatedRecord{Record: journal.ReleaseMarkerRecord{ID: 2}})
+	assert.Nil(t, err)
+	assert.True(t, applied)
+	assert.Equal(t, []uint64{7}, store.Markers())
+	id, err = store.WriteMarker(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8), id)
+	store.Close()
+}
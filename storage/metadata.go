@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+/*
+PutWithMetadata is the same as Put, but at most lump.MAX_METADATA_SIZE bytes of user metadata
+are attached to the lump. The metadata is written in the journal record and kept in the index,
+so GetMetadata does not read the data region.
+Put or PutEmbed on the same lumpid again clears the metadata, PutWithTTL also clears it.
+*/
+func (store *Storage) PutWithMetadata(lumpid lump.LumpId, lumpdata lump.LumpData, metadata []byte) (updated bool, err error) {
+	return store.PutWithTag(lumpid, lumpdata, metadata, "")
+}
+
+//PutEmbedWithMetadata is the same as PutEmbed, the metadata is written after the data in the journal
+func (store *Storage) PutEmbedWithMetadata(lumpid lump.LumpId, data []byte, metadata []byte) (updated bool, err error) {
+	return store.PutEmbedWithTag(lumpid, data, metadata, "")
+}
+
+//GetMetadata returns the user metadata of the lump, it is empty if the lump is put without metadata
+func (store *Storage) GetMetadata(lumpid lump.LumpId) ([]byte, error) {
+	if err := store.checkOpen(); err != nil {
+		return nil, err
+	}
+	if store.isExpired(lumpid) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "lump %s is expired", lumpid.String())
+	}
+	if _, err := store.index.Get(lumpid); err != nil {
+		return nil, err
+	}
+	metadata, _ := store.index.Metadata(lumpid)
+	return append([]byte{}, metadata...), nil
+}
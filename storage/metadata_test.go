@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func TestStoragePutWithMetadata(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp12.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp12.lusf")
+
+	hello := lump.NewLumpDataAligned(5, block.Min())
+	copy(hello.AsBytes(), "hello")
+
+	_, err = storage.PutWithMetadata(lumpid("0000"), zeroedData(100), make([]byte, lump.MAX_METADATA_SIZE+1))
+	assert.Error(t, err)
+
+	_, err = storage.PutWithMetadata(lumpid("0000"), hello, []byte("text/plain"))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbedWithMetadata(lumpid("0001"), []byte("world"), []byte("v1"))
+	assert.Nil(t, err)
+	_, err = storage.PutWithMetadata(lumpid("0002"), zeroedData(100), []byte("v2"))
+	assert.Nil(t, err)
+	//put again clears the metadata
+	_, err = storage.Put(lumpid("0002"), zeroedData(100))
+	assert.Nil(t, err)
+
+	metadata, err := storage.GetMetadata(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("text/plain"), metadata)
+	metadata, err = storage.GetMetadata(lumpid("0002"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(metadata))
+	_, err = storage.GetMetadata(lumpid("0003"))
+	assert.Error(t, err)
+
+	data, err := storage.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("world"), data)
+
+	assert.Nil(t, storage.JournalGC())
+	_, err = storage.CompactDataRegion(10)
+	assert.Nil(t, err)
+	storage.Close()
+
+	//metadata is restored from journal
+	storage, err = OpenCannylsStorage("tmp12.lusf")
+	assert.Nil(t, err)
+	metadata, err = storage.GetMetadata(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("text/plain"), metadata)
+	metadata, err = storage.GetMetadata(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), metadata)
+	data, err = storage.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("world"), data)
+	data, err = storage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	storage.Close()
+}
@@ -0,0 +1,184 @@
+/*
+Package migrate upgrades the storage files written by the older versions of cannyls-go in place.
+
+A change of the on disk format bumps nvm.MINOR_VERSION, and registers a Migration from the
+previous version in the init of this package:
+
+	func init() {
+		Register(Migration{
+			From:        Version{2, 4},
+			To:          Version{2, 5},
+			Description: "stamp the journal records",
+			Apply:       stampJournal,
+		})
+	}
+
+storage.OpenCannylsStorage applies the migrations one by one when an older file is opened,
+the header is rewritten with the new version after every migration, so an interrupted
+upgrade continues from the last finished migration. The files of the original cannyls in Rust
+are upgraded by the migration registered in storage/lusf.go.
+*/
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+type Version struct {
+	Major uint16
+	Minor uint16
+}
+
+//Current is the version written by this code
+func Current() Version {
+	return Version{nvm.MAJOR_VERSION, nvm.MINOR_VERSION}
+}
+
+func VersionOf(header *nvm.StorageHeader) Version {
+	return Version{header.MajorVersion, header.MinorVersion}
+}
+
+func (v Version) Less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	return v.Minor < other.Minor
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+/*
+Migration upgrades a file from From to To. Apply is called with the whole file, such as
+nvm.FileNVM, and its header, it could change the header except the version, which is
+set to To and written after Apply returns. Apply must be idempotent, it is called again
+if the upgrade is interrupted
+*/
+type Migration struct {
+	From        Version
+	To          Version
+	Description string
+	Apply       func(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error
+}
+
+//Registry holds the migrations, the storage uses DefaultRegistry
+type Registry struct {
+	mutex      sync.RWMutex
+	migrations map[Version]Migration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{migrations: make(map[Version]Migration)}
+}
+
+var DefaultRegistry = NewRegistry()
+
+//Register panics if the migration is invalid or there is a migration from the same version
+func Register(m Migration) {
+	DefaultRegistry.Register(m)
+}
+
+func (r *Registry) Register(m Migration) {
+	if !m.From.Less(m.To) || m.Apply == nil {
+		panic(fmt.Sprintf("migrate: invalid migration from %s to %s", m.From, m.To))
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.migrations[m.From]; ok {
+		panic(fmt.Sprintf("migrate: migration from %s is registered twice", m.From))
+	}
+	r.migrations[m.From] = m
+}
+
+//Migrations returns all the registered migrations ordered by From
+func (r *Registry) Migrations() []Migration {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	migrations := make([]Migration, 0, len(r.migrations))
+	for _, m := range r.migrations {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].From.Less(migrations[j].From)
+	})
+	return migrations
+}
+
+//Plan returns the migrations from the version to the current one, it is empty if the version is current
+func (r *Registry) Plan(from Version) ([]Migration, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	current := Current()
+	if current.Less(from) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "version %s is newer than %s", from, current)
+	}
+	var plan []Migration
+	for v := from; v != current; {
+		m, ok := r.migrations[v]
+		if !ok || current.Less(m.To) {
+			return nil, errors.Wrapf(internalerror.InvalidInput, "no migration from version %s to %s", v, current)
+		}
+		plan = append(plan, m)
+		v = m.To
+	}
+	return plan, nil
+}
+
+//Required returns true if the file must be upgraded before it is used
+func Required(header *nvm.StorageHeader) bool {
+	return !header.IsCurrentVersion()
+}
+
+//Upgrade applies the migrations of DefaultRegistry, see Registry.Upgrade
+func Upgrade(file nvm.NonVolatileMemory, header *nvm.StorageHeader) ([]Migration, error) {
+	return DefaultRegistry.Upgrade(file, header)
+}
+
+/*
+Upgrade applies the migrations from the version of the header to the current one, and
+rewrites the header after every migration. The header is updated in place, the applied
+migrations are returned. Nothing is written if no migration is found
+*/
+func (r *Registry) Upgrade(file nvm.NonVolatileMemory, header *nvm.StorageHeader) ([]Migration, error) {
+	plan, err := r.Plan(VersionOf(header))
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range plan {
+		if err = m.Apply(file, header); err != nil {
+			return plan[:i], errors.Wrapf(err, "failed to migrate from %s to %s", m.From, m.To)
+		}
+		header.MajorVersion, header.MinorVersion = m.To.Major, m.To.Minor
+		if err = writeHeader(file, header); err != nil {
+			return plan[:i], err
+		}
+	}
+	return plan, nil
+}
+
+func writeHeader(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error {
+	headBuf := new(bytes.Buffer)
+	if err := header.WriteHeaderRegionTo(headBuf); err != nil {
+		return err
+	}
+	alignedBufHead := block.FromBytes(headBuf.Bytes(), file.BlockSize())
+	alignedBufHead.Align()
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := file.Write(alignedBufHead.AsBytes()); err != nil {
+		return errors.Wrap(err, "failed to rewrite the storage header")
+	}
+	return file.Sync()
+}
@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+func TestMigratePlan(t *testing.T) {
+	current := Current()
+	older := Version{current.Major, current.Minor - 1}
+	oldest := Version{current.Major - 1, 7}
+
+	r := NewRegistry()
+	plan, err := r.Plan(current)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(plan))
+	_, err = r.Plan(older)
+	assert.Error(t, err)
+	_, err = r.Plan(Version{current.Major, current.Minor + 1})
+	assert.Error(t, err)
+
+	noop := func(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error { return nil }
+	r.Register(Migration{From: older, To: current, Apply: noop})
+	r.Register(Migration{From: oldest, To: older, Apply: noop})
+	assert.Panics(t, func() { r.Register(Migration{From: older, To: current, Apply: noop}) })
+	assert.Panics(t, func() { r.Register(Migration{From: current, To: older, Apply: noop}) })
+
+	plan, err = r.Plan(oldest)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(plan))
+	assert.Equal(t, older, plan[0].To)
+	assert.Equal(t, current, plan[1].To)
+	assert.Equal(t, oldest, r.Migrations()[0].From)
+}
+
+func TestMigrateUpgrade(t *testing.T) {
+	current := Current()
+	older := Version{current.Major, current.Minor - 1}
+	oldest := Version{current.Major - 1, 3}
+
+	file, err := nvm.New(4096)
+	assert.Nil(t, err)
+	header := nvm.DefaultStorageHeader()
+	header.MajorVersion, header.MinorVersion = oldest.Major, oldest.Minor
+	assert.Nil(t, writeHeader(file, header))
+
+	var applied []Version
+	r := NewRegistry()
+	r.Register(Migration{From: oldest, To: older, Apply: func(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error {
+		applied = append(applied, VersionOf(header))
+		header.JournalRegionSize = 2048
+		return nil
+	}})
+	failed := true
+	r.Register(Migration{From: older, To: current, Apply: func(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error {
+		applied = append(applied, VersionOf(header))
+		if failed {
+			return errors.New("interrupted")
+		}
+		return nil
+	}})
+
+	//the first migration is written
+	done, err := r.Upgrade(file, header)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(done))
+	file.Seek(0, 0)
+	written, err := nvm.ReadFrom(file)
+	assert.Nil(t, err)
+	assert.Equal(t, older, VersionOf(written))
+	assert.Equal(t, uint64(2048), written.JournalRegionSize)
+
+	//continue from the last finished migration
+	failed = false
+	done, err = r.Upgrade(file, written)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(done))
+	assert.Equal(t, []Version{oldest, older, older}, applied)
+	file.Seek(0, 0)
+	written, err = nvm.ReadFrom(file)
+	assert.Nil(t, err)
+	assert.Equal(t, current, VersionOf(written))
+	assert.False(t, Required(written))
+}
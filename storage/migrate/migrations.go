@@ -0,0 +1,31 @@
+package migrate
+
+import (
+	"github.com/thesues/cannyls-go/nvm"
+)
+
+func init() {
+	Register(Migration{
+		From:        Version{2, 1},
+		To:          Version{2, 2},
+		Description: "the journal records with the user tags of lumps",
+		Apply:       noop,
+	})
+	Register(Migration{
+		From:        Version{2, 2},
+		To:          Version{2, 3},
+		Description: "the journal records of the lumps overwritten in place",
+		Apply:       noop,
+	})
+	Register(Migration{
+		From:        Version{2, 3},
+		To:          Version{2, 4},
+		Description: "the extended padding of the lump data with reserved space",
+		Apply:       noop,
+	})
+}
+
+//noop is for the versions adding new journal records or data trailers, the older ones are still valid
+func noop(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error {
+	return nil
+}
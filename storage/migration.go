@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+The checkpoint of Migrate is a marker in the destination storage
+
+| "mgrt" | UUID of the source storage(16 bytes) | the last migrated lumpid(8 bytes) |
+*/
+
+var (
+	MIGRATE_MARKER_MAGIC = [4]byte{'m', 'g', 'r', 't'}
+)
+
+const (
+	MIGRATE_MARKER_SIZE                 = 4 + 16 + 8
+	DEFAULT_MIGRATE_CHECKPOINT_INTERVAL = 1024
+)
+
+type MigrateOptions struct {
+	//CheckpointInterval is the number of lumps migrated between the checkpoints, 0 means
+	//DEFAULT_MIGRATE_CHECKPOINT_INTERVAL
+	CheckpointInterval int
+	//OnProgress is called after every checkpoint and when the migration is done, nil means no
+	//progress is reported. If it returns an error, the migration stops with the error after the
+	//checkpoint, and it could be resumed later
+	OnProgress func(MigrateProgress) error
+}
+
+func DefaultMigrateOptions() MigrateOptions {
+	return MigrateOptions{CheckpointInterval: DEFAULT_MIGRATE_CHECKPOINT_INTERVAL}
+}
+
+//MigrateProgress is reported by MigrateOptions.OnProgress
+type MigrateProgress struct {
+	//Migrated is the number of lumps migrated by this call, and Bytes is their size
+	Migrated uint64
+	Bytes    uint64
+	//Skipped is the number of lumps migrated by the interrupted calls before, see Migrate
+	Skipped uint64
+	//Total is the number of lumps in the source storage
+	Total uint64
+	//Last is the last migrated lumpid
+	Last lump.LumpId
+	Done bool
+}
+
+/*
+Migrate copies all the lumps of src into dst in lumpid order, dst could have another block size,
+capacity or journal ratio, so a storage is rebuilt with a new layout by creating dst and migrating
+into it. The metadata, the tags and the TTLs are kept, the expired lumps are not migrated, and the
+lumps with the same ids in dst are overwritten.
+
+The last migrated lumpid is saved in a marker of dst after every opts.CheckpointInterval lumps, the
+journal of dst is synced then. If Migrate is interrupted, such as by an error or a crash, calling it
+again with the same src continues after the checkpoint, the lumps before it are skipped. The marker
+is released when the migration is done. src must not be changed until the migration is done.
+*/
+func Migrate(src, dst *Storage, opts MigrateOptions) (progress MigrateProgress, err error) {
+	if err = src.checkOpen(); err != nil {
+		return
+	}
+	if err = dst.checkOpen(); err != nil {
+		return
+	}
+	if src == dst {
+		return progress, errors.Wrap(internalerror.InvalidInput, "could not migrate a storage into itself")
+	}
+	if opts.CheckpointInterval < 0 {
+		return progress, errors.Wrapf(internalerror.InvalidInput, "invalid checkpoint interval %d", opts.CheckpointInterval)
+	}
+	interval := opts.CheckpointInterval
+	if interval == 0 {
+		interval = DEFAULT_MIGRATE_CHECKPOINT_INTERVAL
+	}
+
+	ids := src.index.List()
+	progress.Total = uint64(len(ids))
+	srcUUID := src.storageHeader.UUID.Bytes()
+	marker, last, resumed := findMigrateMarker(dst, srcUUID)
+	if resumed {
+		//the lumps up to last are migrated
+		start := sort.Search(len(ids), func(i int) bool { return ids[i].Compare(last) > 0 })
+		progress.Skipped = uint64(start)
+		progress.Last = last
+		ids = ids[start:]
+	}
+
+	for i, id := range ids {
+		if !src.isExpired(id) {
+			size, err := migrateLump(src, dst, id)
+			if err != nil {
+				return progress, errors.Wrapf(err, "failed to migrate lump %s", id.String())
+			}
+			progress.Migrated++
+			progress.Bytes += size
+		}
+		progress.Last = id
+		if (i+1)%interval != 0 || i+1 == len(ids) {
+			continue
+		}
+		if marker, err = writeMigrateMarker(dst, marker, srcUUID, id); err != nil {
+			return progress, err
+		}
+		if opts.OnProgress != nil {
+			if err = opts.OnProgress(progress); err != nil {
+				return progress, err
+			}
+		}
+	}
+
+	if marker != 0 {
+		if _, err = dst.ReleaseMarker(marker); err != nil {
+			return progress, err
+		}
+	}
+	if err = dst.JournalSync(); err != nil {
+		return progress, err
+	}
+	progress.Done = true
+	if opts.OnProgress != nil {
+		err = opts.OnProgress(progress)
+	}
+	return progress, err
+}
+
+//migrateLump puts the lump of src into dst, and returns the size of the lump data
+func migrateLump(src, dst *Storage, id lump.LumpId) (uint64, error) {
+	p, err := src.index.Get(id)
+	if err != nil {
+		return 0, err
+	}
+	if src.background != nil {
+		src.background.Wait(uint64(p.SizeOnDisk(src.dataRegion.block_size)))
+	}
+	data, err := src.Get(id)
+	if err != nil {
+		return 0, err
+	}
+	//a lump without metadata is not put with the empty metadata, which would disable the
+	//overwrite in place of it in dst
+	metadata, hasMetadata := src.index.Metadata(id)
+	tag, _ := src.index.Tag(id)
+	expireAt, hasTTL := src.index.ExpireAt(id)
+
+	if _, embedded := p.(portion.JournalPortion); embedded {
+		if hasMetadata {
+			_, err = dst.PutEmbedWithTag(id, data, metadata, tag)
+		} else {
+			_, err = dst.PutEmbed(id, data)
+		}
+		return uint64(len(data)), err
+	}
+	lumpdata := lump.NewLumpDataAligned(len(data), dst.dataRegion.block_size)
+	copy(lumpdata.AsBytes(), data)
+	//a lump which does not fit in a portion of dst, e.g. from a larger block size, is put into
+	//extents with its TTL or metadata and tag
+	switch {
+	case hasTTL:
+		//a lump with TTL has no metadata and no tag, see PutWithTTL
+		_, err = dst.putWithExpire(id, lumpdata, expireAt)
+	case hasMetadata:
+		_, err = dst.PutWithTag(id, lumpdata, metadata, tag)
+	default:
+		_, err = dst.Put(id, lumpdata)
+	}
+	return uint64(len(data)), err
+}
+
+//findMigrateMarker returns the checkpoint of the migration from src in dst, ok is false if there is none
+func findMigrateMarker(dst *Storage, srcUUID []byte) (marker uint64, last lump.LumpId, ok bool) {
+	for _, id := range dst.index.Markers() {
+		data, _ := dst.index.Marker(id)
+		if len(data) != MIGRATE_MARKER_SIZE || !bytes.Equal(data[:4], MIGRATE_MARKER_MAGIC[:]) ||
+			!bytes.Equal(data[4:20], srcUUID) {
+			continue
+		}
+		last, _ = lump.FromBytes(data[20:])
+		return id, last, true
+	}
+	return 0, last, false
+}
+
+//writeMigrateMarker saves the checkpoint, and releases the previous one
+func writeMigrateMarker(dst *Storage, previous uint64, srcUUID []byte, last lump.LumpId) (uint64, error) {
+	data := make([]byte, 0, MIGRATE_MARKER_SIZE)
+	data = append(data, MIGRATE_MARKER_MAGIC[:]...)
+	data = append(data, srcUUID...)
+	data = append(data, last.GetBytes()...)
+	marker, err := dst.WriteMarker(data)
+	if err != nil {
+		return previous, errors.Wrap(err, "failed to write the migration checkpoint")
+	}
+	if previous != 0 {
+		if _, err = dst.ReleaseMarker(previous); err != nil {
+			return marker, err
+		}
+	}
+	if err = dst.JournalSync(); err != nil {
+		return marker, err
+	}
+	return marker, nil
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func TestMigrateResume(t *testing.T) {
+	src, err := CreateCannylsStorage("tmp76.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp76.lusf")
+	defer src.Close()
+	for i := 0; i < 50; i++ {
+		data := zeroedData(100 + i*97)
+		for j := range data.AsBytes() {
+			data.AsBytes()[j] = byte(i + j)
+		}
+		switch i % 5 {
+		case 0:
+			_, err = src.PutEmbedWithTag(lumpidnum(i), data.AsBytes()[:100], []byte("meta"), "embedded")
+		case 1:
+			_, err = src.PutWithTag(lumpidnum(i), data, []byte("meta"), "data")
+		case 2:
+			_, err = src.PutWithTTL(lumpidnum(i), data, time.Hour)
+		default:
+			_, err = src.Put(lumpidnum(i), data)
+		}
+		assert.Nil(t, err)
+	}
+
+	options := DefaultStorageOptions()
+	options.File.BlockSize, _ = block.NewBlockSize(4096)
+	dst, err := CreateCannylsStorageWithOptions("tmp77.lusf", 4*1024*1024, 0.1, options)
+	assert.Nil(t, err)
+	defer os.Remove("tmp77.lusf")
+
+	//the first call stops after the second checkpoint
+	stop := errors.New("stop")
+	interrupt := true
+	var reports []MigrateProgress
+	opts := MigrateOptions{
+		CheckpointInterval: 10,
+		OnProgress: func(progress MigrateProgress) error {
+			reports = append(reports, progress)
+			if interrupt && len(reports) == 2 {
+				return stop
+			}
+			return nil
+		},
+	}
+	progress, err := Migrate(src, dst, opts)
+	assert.Equal(t, stop, err)
+	assert.Equal(t, uint64(20), progress.Migrated)
+	assert.Equal(t, lumpidnum(19), progress.Last)
+	assert.False(t, progress.Done)
+	assert.Equal(t, uint64(10), reports[0].Migrated)
+	assert.Equal(t, uint64(50), reports[0].Total)
+	assert.Equal(t, 20, len(dst.List()))
+	assert.Nil(t, dst.Close())
+
+	//the checkpoint survives reopening
+	dst, err = OpenCannylsStorage("tmp77.lusf")
+	assert.Nil(t, err)
+	defer dst.Close()
+	assert.Equal(t, 1, len(dst.Markers()))
+	interrupt, reports = false, nil
+	progress, err = Migrate(src, dst, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(20), progress.Skipped)
+	assert.Equal(t, uint64(30), progress.Migrated)
+	assert.True(t, progress.Done)
+	assert.True(t, reports[len(reports)-1].Done)
+	assert.Equal(t, 0, len(dst.Markers()))
+
+	assert.Equal(t, src.List(), dst.List())
+	for _, id := range src.List() {
+		expected, err := src.Get(id)
+		assert.Nil(t, err)
+		data, err := dst.Get(id)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data)
+		expectedStat, _ := src.Stat(id)
+		stat, _ := dst.Stat(id)
+		assert.Equal(t, expectedStat.Embedded, stat.Embedded)
+		expectedMeta, expectedOk := src.index.Metadata(id)
+		meta, ok := dst.index.Metadata(id)
+		assert.Equal(t, expectedOk, ok)
+		assert.Equal(t, expectedMeta, meta)
+		expectedTag, _ := src.GetTag(id)
+		tag, _ := dst.GetTag(id)
+		assert.Equal(t, expectedTag, tag)
+		expectedExpire, _ := src.ExpireAt(id)
+		expire, _ := dst.ExpireAt(id)
+		assert.Equal(t, expectedExpire, expire)
+	}
+
+	_, err = Migrate(src, src, DefaultMigrateOptions())
+	assert.Error(t, err)
+}
+
+func TestMigrateIntoExtents(t *testing.T) {
+	options := DefaultStorageOptions()
+	options.File.BlockSize, _ = block.NewBlockSize(4096)
+	src, err := CreateCannylsStorageWithOptions("tmp94.lusf", 256*1024*1024, 0.01, options)
+	assert.Nil(t, err)
+	defer os.Remove("tmp94.lusf")
+	defer src.Close()
+
+	//every lump is in one portion of 4096 bytes blocks, but not of 512 bytes blocks
+	size := 0xFFFF*512 + 5000
+	lumps := make(map[int][]byte)
+	for i := 0; i < 3; i++ {
+		data := lump.NewLumpDataAligned(size+i*4096, src.dataRegion.block_size)
+		for j := range data.AsBytes() {
+			data.AsBytes()[j] = byte(i + j)
+		}
+		lumps[i] = data.AsBytes()
+		switch i {
+		case 0:
+			_, err = src.PutWithTag(lumpidnum(i), data, []byte("meta"), "shard-1")
+		case 1:
+			_, err = src.PutWithTTL(lumpidnum(i), data, time.Hour)
+		default:
+			_, err = src.Put(lumpidnum(i), data)
+		}
+		assert.Nil(t, err)
+		_, inExtents := src.index.Extents(lumpidnum(i))
+		assert.False(t, inExtents)
+	}
+
+	dst, err := CreateCannylsStorage("tmp95.lusf", 256*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp95.lusf")
+	defer dst.Close()
+	progress, err := Migrate(src, dst, DefaultMigrateOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), progress.Migrated)
+
+	for i, expected := range lumps {
+		id := lumpidnum(i)
+		extents, inExtents := dst.index.Extents(id)
+		assert.True(t, inExtents)
+		assert.Equal(t, 2, len(extents))
+		data, err := dst.Get(id)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(expected, data))
+		expectedMeta, expectedOk := src.index.Metadata(id)
+		meta, ok := dst.index.Metadata(id)
+		assert.Equal(t, expectedOk, ok)
+		assert.Equal(t, expectedMeta, meta)
+		expectedTag, _ := src.GetTag(id)
+		tag, _ := dst.GetTag(id)
+		assert.Equal(t, expectedTag, tag)
+		expectedExpire, _ := src.ExpireAt(id)
+		expire, _ := dst.ExpireAt(id)
+		assert.Equal(t, expectedExpire, expire)
+	}
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+const (
+	OP_GET       = "get"
+	OP_PUT       = "put"
+	OP_PUT_EMBED = "put_embed"
+	OP_DELETE    = "delete"
+)
+
+/*
+Observer is notified of the operations of storage, such as metrics.StorageMetrics.
+It is called in the goroutine of the operation, so it must be cheap. The Gets of AsyncStorage are
+observed by its readers in parallel, so it must be safe for concurrent use too.
+*/
+type Observer interface {
+	journal.Observer
+	//ObserveOperation is called after Get, Put, PutEmbed and Delete, err is the returned error
+	ObserveOperation(op string, duration time.Duration, err error)
+}
+
+//SetObserver sets the observer of the storage and its journal, nil means no observer.
+//If the stats is enabled, the observer is called after the stats is counted
+func (store *Storage) SetObserver(observer Observer) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.observer = observer
+	if store.stats != nil {
+		store.stats.next = observer
+		observer = store.stats
+	}
+	if observer == nil {
+		store.journalRegion.SetObserver(nil)
+	} else {
+		store.journalRegion.SetObserver(observer)
+	}
+	return nil
+}
+
+func (store *Storage) observe(op string, start time.Time, err *error) {
+	if store.stats != nil {
+		store.stats.ObserveOperation(op, time.Since(start), *err)
+	} else if store.observer != nil {
+		store.observer.ObserveOperation(op, time.Since(start), *err)
+	}
+}
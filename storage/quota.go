@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+//NamespaceUsage is the bytes used by the lumps of a namespace, and its quota, 0 means no quota
+type NamespaceUsage struct {
+	Used  uint64
+	Quota uint64
+}
+
+/*
+SetNamespaceQuota limits the bytes used by the lumps of the namespace, StorageOptions.NamespaceBits
+must be set. A put fails with internalerror.QuotaExceeded if the namespace would use more than
+limit bytes after it. 0 removes the quota.
+
+The quota is soft: a put into the data region is checked with the size of its uncompressed lump
+data, so a compressible lump could be refused; a lowered quota does not remove any lump, and the
+deletes, the moves of CompactDataRegion and the overwrites in place are never refused.
+The quotas are kept in memory only, they are set again after the storage is opened.
+*/
+func (store *Storage) SetNamespaceQuota(namespace uint32, limit uint64) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	bits := store.index.NamespaceBits()
+	if bits == 0 {
+		return errors.Wrap(internalerror.InvalidInput, "namespaces are not tracked")
+	}
+	if bits < 32 && namespace>>bits != 0 {
+		return errors.Wrapf(internalerror.InvalidInput, "namespace %d does not fit %d bits", namespace, bits)
+	}
+	if limit == 0 {
+		delete(store.quotas, namespace)
+		return nil
+	}
+	if store.quotas == nil {
+		store.quotas = make(map[uint32]uint64)
+	}
+	store.quotas[namespace] = limit
+	return nil
+}
+
+//NamespaceUsage returns the usage of each namespace which has lumps or a quota
+func (store *Storage) NamespaceUsage() (usage map[uint32]NamespaceUsage) {
+	store.view(func() {
+		usage = store.namespaceUsage()
+	})
+	return
+}
+
+func (store *Storage) namespaceUsage() map[uint32]NamespaceUsage {
+	usage := make(map[uint32]NamespaceUsage)
+	for namespace, used := range store.index.NamespaceUsage() {
+		usage[namespace] = NamespaceUsage{Used: used, Quota: store.quotas[namespace]}
+	}
+	for namespace, limit := range store.quotas {
+		usage[namespace] = NamespaceUsage{Used: usage[namespace].Used, Quota: limit}
+	}
+	return usage
+}
+
+//checkQuota returns an error if the lump of size bytes would exceed the quota of its namespace
+func (store *Storage) checkQuota(lumpid lump.LumpId, size uint64) error {
+	return store.checkQuotas([]lump.LumpId{lumpid}, []uint64{size})
+}
+
+//checkQuotas is the same as checkQuota for all the lumps, which replace the old lumps at once
+func (store *Storage) checkQuotas(lumpids []lump.LumpId, sizes []uint64) error {
+	if len(store.quotas) == 0 {
+		return nil
+	}
+	used := make(map[uint32]uint64)
+	for i, id := range lumpids {
+		namespace := store.index.NamespaceOf(id)
+		if _, ok := store.quotas[namespace]; !ok {
+			continue
+		}
+		if _, ok := used[namespace]; !ok {
+			used[namespace] = store.index.NamespaceBytes(namespace)
+		}
+		//the old lump is released by the put
+		used[namespace] = used[namespace] - store.index.LumpBytes(id) + sizes[i]
+	}
+	for namespace, bytes := range used {
+		if limit := store.quotas[namespace]; bytes > limit {
+			return errors.Wrapf(internalerror.QuotaExceeded, "namespace %d would use %d bytes, the quota is %d",
+				namespace, bytes, limit)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func TestStorageNamespaceQuota(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp50.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp50.lusf")
+	assert.Error(t, store.SetNamespaceQuota(1, 1024))
+	store.Close()
+
+	options := DefaultStorageOptions()
+	options.NamespaceBits = 33
+	_, err = OpenCannylsStorageWithOptions("tmp50.lusf", options)
+	assert.Error(t, err)
+	options.NamespaceBits = 16
+	store, err = OpenCannylsStorageWithOptions("tmp50.lusf", options)
+	assert.Nil(t, err)
+
+	inNamespace := func(namespace uint64, n uint64) lump.LumpId {
+		return lump.FromU64(0, namespace<<48|n)
+	}
+	assert.Error(t, store.SetNamespaceQuota(1<<16, 1024))
+	assert.Nil(t, store.SetNamespaceQuota(1, 2048))
+
+	//a lump of 1000 bytes takes 2 blocks
+	for i := uint64(0); i < 2; i++ {
+		_, err = store.Put(inNamespace(1, i), zeroedData(1000))
+		assert.Nil(t, err)
+	}
+	_, err = store.Put(inNamespace(1, 2), zeroedData(1000))
+	assert.Equal(t, internalerror.QuotaExceeded, errors.Cause(err))
+	_, err = store.PutEmbed(inNamespace(1, 2), make([]byte, 100))
+	assert.Equal(t, internalerror.QuotaExceeded, errors.Cause(err))
+	//the old lump is replaced, and the other namespaces are not limited
+	_, err = store.Put(inNamespace(1, 1), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = store.Put(inNamespace(2, 0), zeroedData(3000))
+	assert.Nil(t, err)
+
+	_, err = store.Delete(inNamespace(1, 1))
+	assert.Nil(t, err)
+	_, err = store.PutEmbed(inNamespace(1, 2), make([]byte, 100))
+	assert.Nil(t, err)
+
+	//none of the batch is stored
+	assert.Nil(t, store.SetNamespaceQuota(3, 1024))
+	err = store.PutBatch([]lump.LumpId{inNamespace(3, 0), inNamespace(3, 1)}, []lump.LumpData{zeroedData(600), zeroedData(600)})
+	assert.Equal(t, internalerror.QuotaExceeded, errors.Cause(err))
+	_, err = store.Get(inNamespace(3, 0))
+	assert.Error(t, err)
+
+	expected := map[uint32]NamespaceUsage{
+		1: {Used: 1124, Quota: 2048},
+		2: {Used: 3072},
+		3: {Quota: 1024},
+	}
+	assert.Equal(t, expected, store.NamespaceUsage())
+	assert.Nil(t, store.SetNamespaceQuota(3, 0))
+	store.Close()
+
+	//the usage is restored, the quotas are not
+	store, err = OpenCannylsStorageWithOptions("tmp50.lusf", options)
+	assert.Nil(t, err)
+	expected = map[uint32]NamespaceUsage{
+		1: {Used: 1124},
+		2: {Used: 3072},
+	}
+	assert.Equal(t, expected, store.NamespaceUsage())
+	store.Close()
+}
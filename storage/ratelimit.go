@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"time"
+)
+
+/*
+tokenBucket limits the bandwidth of the background work, it gets rate bytes per second, and
+keeps at most a second of them. The bucket could be in debt: a job runs if there is any token,
+and charges the bytes it has read and written, so a job is never split, and the next jobs wait
+until the debt is paid.
+*/
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	clock  func() time.Time
+	sleep  func(time.Duration)
+}
+
+func newTokenBucket(rate uint64, clock func() time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   clock(),
+		clock:  clock,
+		sleep:  time.Sleep,
+	}
+}
+
+func (bucket *tokenBucket) refill() {
+	now := bucket.clock()
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * bucket.rate
+		if bucket.tokens > bucket.rate {
+			bucket.tokens = bucket.rate
+		}
+	}
+	bucket.last = now
+}
+
+//Ready returns true if there is any token
+func (bucket *tokenBucket) Ready() bool {
+	bucket.refill()
+	return bucket.tokens > 0
+}
+
+//Charge takes n tokens, the bucket is in debt if there are not enough tokens
+func (bucket *tokenBucket) Charge(n uint64) {
+	bucket.refill()
+	bucket.tokens -= float64(n)
+}
+
+//Delay returns how long to wait for any token, it is 0 if there is any
+func (bucket *tokenBucket) Delay() time.Duration {
+	if bucket.Ready() {
+		return 0
+	}
+	return time.Duration(-bucket.tokens/bucket.rate*float64(time.Second)) + time.Millisecond
+}
+
+//Wait sleeps until there is any token, and takes n tokens, it is for the jobs which could not be skipped
+func (bucket *tokenBucket) Wait(n uint64) {
+	for delay := bucket.Delay(); delay > 0; delay = bucket.Delay() {
+		bucket.sleep(delay)
+	}
+	bucket.Charge(n)
+}
+
+/*
+SetBackgroundBandwidth limits the bytes per second read and written by the background work:
+the journal gc, the data region compaction and the checkpoint of RunSideJobOnce skip their work
+until the bandwidth is available, and a Snapshot sleeps for it between its chunks. The foreground
+Put and Get, and the gc after append which keeps the journal from being full, are never throttled.
+0 means no limit.
+*/
+func (store *Storage) SetBackgroundBandwidth(bytesPerSecond uint64) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	if bytesPerSecond == 0 {
+		store.background = nil
+		store.journalRegion.SetLimiter(nil)
+		return nil
+	}
+	//the clock of the storage could be changed by the tests
+	store.background = newTokenBucket(bytesPerSecond, func() time.Time { return store.clock() })
+	store.journalRegion.SetLimiter(store.background)
+	return nil
+}
+
+//backgroundReady returns true if the background work could run now
+func (store *Storage) backgroundReady() bool {
+	return store.background == nil || store.background.Ready()
+}
+
+//backgroundDelay returns how long the background work should wait, see tokenBucket.Delay
+func (store *Storage) backgroundDelay() time.Duration {
+	if store.background == nil {
+		return 0
+	}
+	return store.background.Delay()
+}
+
+func (store *Storage) chargeBackground(n uint64) {
+	if store.background != nil {
+		store.background.Charge(n)
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	bucket := newTokenBucket(1000, func() time.Time { return now })
+	assert.True(t, bucket.Ready())
+	bucket.Charge(3000)
+	assert.False(t, bucket.Ready())
+	now = now.Add(time.Second)
+	assert.False(t, bucket.Ready())
+	now = now.Add(1500 * time.Millisecond)
+	assert.True(t, bucket.Ready())
+
+	//at most a second of tokens are kept
+	now = now.Add(time.Hour)
+	bucket.Charge(1000)
+	assert.False(t, bucket.Ready())
+
+	var slept time.Duration
+	bucket.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	bucket.Charge(2000)
+	bucket.Wait(100)
+	assert.True(t, slept >= 2*time.Second && slept < 3*time.Second)
+}
+
+func TestStorageBackgroundBandwidth(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp51.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp51.lusf")
+	now := time.Unix(1000, 0)
+	storage.clock = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		_, err = storage.Put(lumpidnum(i), zeroedData(1000))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10; i += 2 {
+		storage.Delete(lumpidnum(i))
+	}
+
+	//a move reads and writes 1024 bytes
+	assert.Nil(t, storage.SetBackgroundBandwidth(2048))
+	moved, err := storage.compactDataRegion(100, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, moved)
+	moved, err = storage.compactDataRegion(100, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, moved)
+	now = now.Add(time.Second)
+	moved, err = storage.compactDataRegion(100, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, moved)
+
+	//CompactDataRegion is not throttled
+	moved, err = storage.CompactDataRegion(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, moved)
+
+	assert.Nil(t, storage.SetBackgroundBandwidth(0))
+	assert.True(t, storage.backgroundReady())
+	storage.Close()
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/storage/migrate"
+)
+
+/*
+OpenReadOnly opens the storage without the exclusive file lock, so backup and
+inspection tools could read a storage which is opened by another process.
+The index is restored from the synced journal when it is opened, the lumps written
+after that are not visible, and the data of a lump deleted or overwritten later
+may be reused by the writer, so use the checksum of the data region to detect it.
+All the writes fail with ReadOnly, GC and other side jobs are not run.
+A file of an older version is not migrated, it fails to open.
+*/
+func OpenReadOnly(path string) (*Storage, error) {
+	file, header, err := nvm.OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	if migrate.Required(header) {
+		file.Close()
+		return nil, errors.Wrapf(internalerror.InvalidInput, "version %d.%d of %s must be migrated, open it writable first",
+			header.MajorVersion, header.MinorVersion, path)
+	}
+	options := DefaultStorageOptions()
+	store, err := OpenCannylsStorageOnNVM(file, header, options)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	store.readOnly = true
+	store.journalRegion.SetAutomaticGcMode(false)
+	return store, nil
+}
+
+//ReadOnly returns true if the storage is opened by OpenReadOnly
+func (store *Storage) ReadOnly() bool {
+	return store.readOnly
+}
+
+/*
+checkOpen returns the error of checkOwner, or the DeviceError of the index if it is broken by
+its spill file, see LumpIndex.Err. The storage must be opened again after that.
+*/
+func (store *Storage) checkOpen() error {
+	if err := store.checkOwner(); err != nil {
+		return err
+	}
+	if err := store.index.Err(); err != nil {
+		return errors.Wrap(err, "lump index is broken, the storage must be opened again")
+	}
+	return nil
+}
+
+/*
+checkOwner returns DeviceTerminated after the storage is closed, and DeviceBusy if the storage is
+owned by an AsyncStorage and it is not called by the worker. It is best effort, a call out of the
+worker is not detected while the worker is running
+*/
+func (store *Storage) checkOwner() error {
+	if atomic.LoadInt32(&store.closed) == 1 {
+		return errors.Wrap(internalerror.DeviceTerminated, "storage is closed")
+	}
+	if atomic.LoadInt32(&store.owned) == 1 && atomic.LoadInt32(&store.executing) == 0 {
+		return errors.Wrap(internalerror.DeviceBusy, "storage is owned by an AsyncStorage, the call must be submitted to it")
+	}
+	return nil
+}
+
+/*
+view guards the getters without an error result, f is their body which only reads the memory. A
+call out of the worker of the AsyncStorage owning the storage is submitted to it like Do, instead of
+failing with DeviceBusy. f is not run after the storage is closed, the getter returns the zero value.
+Like checkOwner it is best effort, and a broken index is not checked, its memory is still readable.
+*/
+func (store *Storage) view(f func()) {
+	if owner, _ := store.owner.Load().(*AsyncStorage); owner != nil && atomic.LoadInt32(&store.executing) == 0 {
+		owner.Do(context.Background(), false, func(*Storage) AsyncResult {
+			f()
+			return AsyncResult{}
+		})
+		return
+	}
+	if atomic.LoadInt32(&store.closed) == 1 {
+		return
+	}
+	f()
+}
+
+func (store *Storage) checkWritable() error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	if store.readOnly {
+		return errors.Wrap(internalerror.ReadOnly, "storage is opened read only")
+	}
+	return nil
+}
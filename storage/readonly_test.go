@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+func TestStorageOpenReadOnly(t *testing.T) {
+	writer, err := CreateCannylsStorage("tmp23.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp23.lusf")
+
+	_, err = writer.Put(lumpid("0000"), zeroedData(100))
+	assert.Nil(t, err)
+	_, err = writer.PutEmbed(lumpid("0001"), []byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.JournalSync())
+
+	//the writer holds the exclusive lock
+	_, err = OpenCannylsStorage("tmp23.lusf")
+	assert.Error(t, err)
+
+	reader, err := OpenReadOnly("tmp23.lusf")
+	assert.Nil(t, err)
+	assert.True(t, reader.ReadOnly())
+	assert.Equal(t, 2, len(reader.List()))
+	data, err := reader.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	data, err = reader.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(data))
+
+	_, err = reader.Put(lumpid("0002"), zeroedData(100))
+	assert.Equal(t, internalerror.ReadOnly, errors.Cause(err))
+	_, err = reader.Delete(lumpid("0000"))
+	assert.Equal(t, internalerror.ReadOnly, errors.Cause(err))
+	_, err = reader.PutWithMetadata(lumpid("0000"), zeroedData(100), []byte("v1"))
+	assert.Equal(t, internalerror.ReadOnly, errors.Cause(err))
+	//nothing is changed by the failed writes
+	_, err = reader.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	reader.RunSideJobOnce()
+	reader.Close()
+
+	//the writer is not affected
+	_, err = writer.Put(lumpid("0002"), zeroedData(100))
+	assert.Nil(t, err)
+	writer.Close()
+}
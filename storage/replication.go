@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+/*
+ReplicatedRecord is a journal record of the primary which could be sent to a backup.
+The PutRecord only has the DataPortion of the primary, so its lump data is in Data.
+A PutExtentsRecord is sent as a PutRecord of its first extent with all of its lump data, or as
+a PutWithTTLRecord or a PutWithMetadataRecord if the lump has TTL or metadata.
+*/
+type ReplicatedRecord struct {
+	Record journal.JournalRecord
+	Data   []byte
+}
+
+/*
+ReplicateJournalSince is the same as ReadJournalSince, but the lump data of the
+put records are read. A PutBatchRecord is split into PutRecords, and the puts which
+are already overwritten or deleted are skipped, because a newer record follows them.
+A TransactionRecord is split into PutRecords and DeleteRecords too, so it is not
+atomic on the backup.
+*/
+func (store *Storage) ReplicateJournalSince(cursor journal.JournalCursor, max int) ([]ReplicatedRecord, journal.JournalCursor, error) {
+	if err := store.checkOpen(); err != nil {
+		return nil, cursor, err
+	}
+	entries, next, err := store.ReadJournalSince(cursor, max)
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	records := make([]ReplicatedRecord, 0, len(entries))
+	for _, entry := range entries {
+		switch v := entry.Record.(type) {
+		case journal.PutRecord:
+			record, live, err := store.replicatePut(v)
+			if err != nil {
+				return nil, cursor, err
+			}
+			if live {
+				records = append(records, record)
+			}
+		case journal.PutWithTTLRecord:
+			record, live, err := store.replicatePut(journal.PutRecord{LumpID: v.LumpID, DataPortion: v.DataPortion})
+			if err != nil {
+				return nil, cursor, err
+			}
+			if expireAt, _ := store.index.ExpireAt(v.LumpID); live && expireAt == v.ExpireAt {
+				record.Record = v
+				records = append(records, record)
+			}
+		case journal.PutWithMetadataRecord:
+			record, live, err := store.replicatePut(journal.PutRecord{LumpID: v.LumpID, DataPortion: v.DataPortion})
+			if err != nil {
+				return nil, cursor, err
+			}
+			if live && store.hasSameMetadataAndTag(v.LumpID, v.Metadata, v.LumpTag) {
+				record.Record = v
+				records = append(records, record)
+			}
+		case journal.PutDedupRecord:
+			record, live, err := store.replicatePut(journal.PutRecord{LumpID: v.LumpID, DataPortion: v.DataPortion})
+			if err != nil {
+				return nil, cursor, err
+			}
+			if hash, _ := store.index.ContentHash(v.LumpID); live && hash == v.Hash {
+				record.Record = v
+				records = append(records, record)
+			}
+		case journal.PutExtentsRecord:
+			//the backup splits the lump into its own extents
+			record, live, err := store.replicatePut(journal.PutRecord{LumpID: v.LumpID, DataPortion: v.Extents[0]})
+			if err != nil {
+				return nil, cursor, err
+			}
+			if extents, _ := store.index.Extents(v.LumpID); !live || !sameExtents(extents, v.Extents) {
+				continue
+			}
+			if v.ExpireAt != 0 {
+				if expireAt, _ := store.index.ExpireAt(v.LumpID); expireAt != v.ExpireAt {
+					continue
+				}
+				record.Record = journal.PutWithTTLRecord{LumpID: v.LumpID, DataPortion: v.Extents[0], ExpireAt: v.ExpireAt}
+			} else if v.Metadata != nil {
+				if !store.hasSameMetadataAndTag(v.LumpID, v.Metadata, v.LumpTag) {
+					continue
+				}
+				record.Record = journal.PutWithMetadataRecord{LumpID: v.LumpID, DataPortion: v.Extents[0],
+					Metadata: v.Metadata, LumpTag: v.LumpTag}
+			}
+			records = append(records, record)
+		case journal.PutBatchRecord:
+			for _, put := range v.Puts {
+				record, live, err := store.replicatePut(put)
+				if err != nil {
+					return nil, cursor, err
+				}
+				if live {
+					records = append(records, record)
+				}
+			}
+		case journal.OverwriteRecord:
+			//the backup puts the new data as a PutRecord
+			record, live, err := store.replicatePut(journal.PutRecord{LumpID: v.LumpID, DataPortion: v.DataPortion})
+			if err != nil {
+				return nil, cursor, err
+			}
+			if live {
+				records = append(records, record)
+			}
+		case journal.TransactionRecord:
+			for _, put := range v.Puts {
+				record, live, err := store.replicatePut(put)
+				if err != nil {
+					return nil, cursor, err
+				}
+				if live {
+					records = append(records, record)
+				}
+			}
+			for _, id := range v.Deletes {
+				records = append(records, ReplicatedRecord{Record: journal.DeleteRecord{LumpID: id}})
+			}
+		default:
+			records = append(records, ReplicatedRecord{Record: entry.Record})
+		}
+	}
+	return records, next, nil
+}
+
+func (store *Storage) replicatePut(put journal.PutRecord) (ReplicatedRecord, bool, error) {
+	p, err := store.index.Get(put.LumpID)
+	if err != nil {
+		return ReplicatedRecord{}, false, nil
+	}
+	if dataPortion, ok := p.(portion.DataPortion); !ok || dataPortion != put.DataPortion {
+		return ReplicatedRecord{}, false, nil
+	}
+	data, err := store.getData(put.LumpID, put.DataPortion)
+	if err != nil {
+		return ReplicatedRecord{}, false, err
+	}
+	return ReplicatedRecord{Record: put, Data: data}, true, nil
+}
+
+func sameExtents(extents, other []portion.DataPortion) bool {
+	if len(extents) != len(other) {
+		return false
+	}
+	for i := range extents {
+		if extents[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ApplyJournalRecord replays a record of the primary on this storage.
+It is idempotent, if the index already has the same lump or the lump is already deleted,
+nothing is written and applied is false. So the records could be applied more than once.
+*/
+func (store *Storage) ApplyJournalRecord(record ReplicatedRecord) (applied bool, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	switch v := record.Record.(type) {
+	case journal.PutRecord:
+		if record.Data == nil {
+			return false, errors.Wrapf(internalerror.InvalidInput, "no data for put record of %s", v.LumpID.String())
+		}
+		if !store.hasAttributes(v.LumpID) && store.hasSameData(v.LumpID, record.Data) {
+			return false, nil
+		}
+		lumpdata := lump.NewLumpDataAligned(len(record.Data), store.dataRegion.block_size)
+		copy(lumpdata.AsBytes(), record.Data)
+		if _, err = store.Put(v.LumpID, lumpdata); err != nil {
+			return false, err
+		}
+		return true, nil
+	case journal.PutWithTTLRecord:
+		if record.Data == nil {
+			return false, errors.Wrapf(internalerror.InvalidInput, "no data for put record of %s", v.LumpID.String())
+		}
+		if expireAt, ok := store.index.ExpireAt(v.LumpID); ok && expireAt == v.ExpireAt && store.hasSameData(v.LumpID, record.Data) {
+			return false, nil
+		}
+		lumpdata := lump.NewLumpDataAligned(len(record.Data), store.dataRegion.block_size)
+		copy(lumpdata.AsBytes(), record.Data)
+		if _, err = store.putWithExpire(v.LumpID, lumpdata, v.ExpireAt); err != nil {
+			return false, err
+		}
+		return true, nil
+	case journal.PutDedupRecord:
+		if record.Data == nil {
+			return false, errors.Wrapf(internalerror.InvalidInput, "no data for put record of %s", v.LumpID.String())
+		}
+		if hash, ok := store.index.ContentHash(v.LumpID); ok && hash == v.Hash {
+			return false, nil
+		}
+		if err = store.checkWritable(); err != nil {
+			return false, err
+		}
+		//the lump shares the portion of the same data on the backup too
+		lumpdata := lump.NewLumpDataAligned(len(record.Data), store.dataRegion.block_size)
+		copy(lumpdata.AsBytes(), record.Data)
+		if _, err = store.putDedup(v.LumpID, lumpdata, &PutTiming{}, DefaultPutOptions()); err != nil {
+			return false, err
+		}
+		return true, nil
+	case journal.PutWithMetadataRecord:
+		if record.Data == nil {
+			return false, errors.Wrapf(internalerror.InvalidInput, "no data for put record of %s", v.LumpID.String())
+		}
+		if store.hasSameMetadataAndTag(v.LumpID, v.Metadata, v.LumpTag) && store.hasSameData(v.LumpID, record.Data) {
+			return false, nil
+		}
+		lumpdata := lump.NewLumpDataAligned(len(record.Data), store.dataRegion.block_size)
+		copy(lumpdata.AsBytes(), record.Data)
+		if _, err = store.PutWithTag(v.LumpID, lumpdata, v.Metadata, v.LumpTag); err != nil {
+			return false, err
+		}
+		return true, nil
+	case journal.EmbedRecord:
+		if !store.hasAttributes(v.LumpID) && store.hasSameData(v.LumpID, v.Data) {
+			return false, nil
+		}
+		if _, err = store.PutEmbed(v.LumpID, v.Data); err != nil {
+			return false, err
+		}
+		return true, nil
+	case journal.EmbedWithMetadataRecord:
+		if store.hasSameMetadataAndTag(v.LumpID, v.Metadata, v.LumpTag) && store.hasSameData(v.LumpID, v.Data) {
+			return false, nil
+		}
+		if _, err = store.PutEmbedWithTag(v.LumpID, v.Data, v.Metadata, v.LumpTag); err != nil {
+			return false, err
+		}
+		return true, nil
+	case journal.DeleteRecord:
+		return store.Delete(v.LumpID)
+	case journal.DeleteRange:
+		deleted, err := store.DeleteRange(v.Start, v.End)
+		if err != nil {
+			return false, err
+		}
+		return len(deleted) > 0, nil
+	case journal.MarkerRecord:
+		if data, ok := store.index.Marker(v.ID); ok && bytes.Equal(data, v.Data) {
+			return false, nil
+		}
+		if err = store.writeMarker(v.ID, v.Data); err != nil {
+			return false, err
+		}
+		return true, nil
+	case journal.ReleaseMarkerRecord:
+		return store.ReleaseMarker(v.ID)
+	case journal.PutBatchRecord, journal.TransactionRecord:
+		return false, errors.Wrap(internalerror.InvalidInput, "put batch record should be split by ReplicateJournalSince")
+	default:
+		return false, errors.Wrapf(internalerror.InvalidInput, "unknown journal record %d", record.Record.Tag())
+	}
+}
+
+//hasAttributes checks the lump has TTL or metadata, which a plain put would clear
+func (store *Storage) hasAttributes(lumpid lump.LumpId) bool {
+	if _, ok := store.index.ExpireAt(lumpid); ok {
+		return true
+	}
+	_, ok := store.index.Metadata(lumpid)
+	return ok
+}
+
+//hasSameMetadataAndTag checks the lump is put with the same metadata and tag
+func (store *Storage) hasSameMetadataAndTag(lumpid lump.LumpId, metadata []byte, tag string) bool {
+	current, ok := store.index.Metadata(lumpid)
+	currentTag, _ := store.index.Tag(lumpid)
+	return ok && bytes.Equal(current, metadata) && currentTag == tag
+}
+
+//hasSameData checks the lump is stored with the same data
+func (store *Storage) hasSameData(lumpid lump.LumpId, data []byte) bool {
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return false
+	}
+	var stored []byte
+	switch v := p.(type) {
+	case portion.DataPortion:
+		if stored, err = store.getData(lumpid, v); err != nil {
+			return false
+		}
+	case portion.JournalPortion:
+		if stored, err = store.journalRegion.GetEmbededData(v); err != nil {
+			return false
+		}
+	}
+	return bytes.Equal(stored, data)
+}
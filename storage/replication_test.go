@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+func TestStorageApplyJournalRecord(t *testing.T) {
+	primary, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	backup, err := CreateCannylsStorage("tmp12.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp12.lusf")
+
+	cursor, err := primary.JournalCursor()
+	assert.Nil(t, err)
+	_, err = primary.Put(lumpid("0000"), zeroedData(1000))
+	assert.Nil(t, err)
+	//overwritten put is skipped
+	_, err = primary.Put(lumpid("0001"), zeroedData(10))
+	assert.Nil(t, err)
+	_, err = primary.PutEmbed(lumpid("0001"), []byte("foo"))
+	assert.Nil(t, err)
+	err = primary.PutBatch([]lump.LumpId{lumpid("0002"), lumpid("0003")}, []lump.LumpData{zeroedData(600), zeroedData(20)})
+	assert.Nil(t, err)
+	_, err = primary.Delete(lumpid("0003"))
+	assert.Nil(t, err)
+
+	records, cursor, err := primary.ReplicateJournalSince(cursor, 100)
+	assert.Nil(t, err)
+	//put 0000, embed 0001, put 0002 and delete 0003
+	assert.Equal(t, 4, len(records))
+
+	for _, record := range records[:3] {
+		applied, err := backup.ApplyJournalRecord(record)
+		assert.Nil(t, err)
+		assert.True(t, applied)
+	}
+	//0003 is never put on backup
+	applied, err := backup.ApplyJournalRecord(records[3])
+	assert.Nil(t, err)
+	assert.False(t, applied)
+	//apply twice
+	for _, record := range records {
+		applied, err := backup.ApplyJournalRecord(record)
+		assert.Nil(t, err)
+		assert.False(t, applied)
+	}
+	assert.Equal(t, primary.List(), backup.List())
+	data, err := backup.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), data)
+	data, err = backup.Get(lumpid("0002"))
+	assert.Nil(t, err)
+	assert.Equal(t, 600, len(data))
+
+	_, err = primary.DeleteRange(lumpid("0000"), lumpid("0002"))
+	assert.Nil(t, err)
+	records, _, err = primary.ReplicateJournalSince(cursor, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	_, err = backup.ApplyJournalRecord(records[0])
+	assert.Nil(t, err)
+	assert.Equal(t, primary.List(), backup.List())
+
+	//put record without data
+	_, err = backup.ApplyJournalRecord(ReplicatedRecord{Record: journal.PutRecord{LumpID: lumpid("0005")}})
+	assert.Error(t, err)
+
+	primary.Close()
+	backup.Close()
+}
+
+func TestStorageReplicateMetadata(t *testing.T) {
+	primary, err := CreateCannylsStorage("tmp84.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp84.lusf")
+	defer primary.Close()
+	backup, err := CreateCannylsStorage("tmp85.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp85.lusf")
+	defer backup.Close()
+
+	cursor, err := primary.JournalCursor()
+	assert.Nil(t, err)
+	_, err = primary.PutWithMetadata(lumpid("0000"), zeroedData(1000), []byte("foo"))
+	assert.Nil(t, err)
+	_, err = primary.PutWithTag(lumpid("0001"), zeroedData(2000), []byte("bar"), "photo")
+	assert.Nil(t, err)
+	//the metadata is changed by a later put
+	_, err = primary.PutWithTag(lumpid("0002"), zeroedData(3000), []byte("old"), "photo")
+	assert.Nil(t, err)
+	_, err = primary.PutWithMetadata(lumpid("0002"), zeroedData(3000), []byte("new"))
+	assert.Nil(t, err)
+
+	records, _, err := primary.ReplicateJournalSince(cursor, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(records))
+	for _, record := range records {
+		applied, err := backup.ApplyJournalRecord(record)
+		assert.Nil(t, err)
+		assert.True(t, applied)
+		applied, err = backup.ApplyJournalRecord(record)
+		assert.Nil(t, err)
+		assert.False(t, applied)
+	}
+	assert.Equal(t, primary.List(), backup.List())
+	for _, id := range []string{"0000", "0001", "0002"} {
+		expected, err := primary.GetMetadata(lumpid(id))
+		assert.Nil(t, err)
+		metadata, err := backup.GetMetadata(lumpid(id))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, metadata)
+		data, err := backup.Get(lumpid(id))
+		assert.Nil(t, err)
+		expected, err = primary.Get(lumpid(id))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data)
+	}
+	tag, err := backup.GetTag(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, "photo", tag)
+	assert.Equal(t, []lump.LumpId{lumpid("0001")}, backup.ListByTag("photo", 10))
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+/*
+Resize grows the storage to newCapacity bytes without reopening it. The journal region
+is not changed, the new space is appended to the data region.
+The file is extended and the header is rewritten and synced before the allocator is grown,
+so the new space is never used if the storage crashes before the header is persisted.
+The NonVolatileMemory must implement nvm.Resizer, such as nvm.FileNVM
+*/
+func (store *Storage) Resize(newCapacity uint64) error {
+	if err := store.checkWritable(); err != nil {
+		return err
+	}
+	blockSize := store.innerNVM.BlockSize()
+	header := *store.storageHeader
+	if !blockSize.IsAligned(newCapacity) || newCapacity <= header.StorageSize() {
+		return errors.Wrapf(internalerror.InvalidInput,
+			"invalid capacity %d, the storage size is %d", newCapacity, header.StorageSize())
+	}
+	header.DataRegionSize = newCapacity - header.RegionSize() - header.JournalRegionSize
+	if header.DataRegionSize > MAX_DATA_REGION_SIZE {
+		return errors.Wrapf(internalerror.InvalidInput, "data size is too big: %d", header.DataRegionSize)
+	}
+
+	innerNVM, ok := store.innerNVM.(nvm.Resizer)
+	if !ok {
+		return errors.Wrap(internalerror.InvalidInput, "the nvm could not be resized")
+	}
+	dataNVM, ok := store.dataRegion.nvm.(nvm.Resizer)
+	if !ok {
+		return errors.Wrap(internalerror.InvalidInput, "the nvm of data region could not be resized")
+	}
+
+	if newCapacity > store.innerNVM.Capacity() {
+		if err := innerNVM.Resize(newCapacity); err != nil {
+			return err
+		}
+	}
+	if err := store.writeHeader(&header); err != nil {
+		return err
+	}
+	if err := dataNVM.Resize(header.DataRegionSize); err != nil {
+		return err
+	}
+	store.alloc.Grow(blockSize, store.storageHeader.DataRegionSize, header.DataRegionSize)
+	store.storageHeader = &header
+	return nil
+}
+
+/*
+Shrink truncates the storage to newCapacity bytes without reopening it. The lumps beyond
+the new end of the data region are moved to the free space in front of it, and every move
+is journaled like CompactDataRegion. The moved data and the journal are synced and the header
+is rewritten before the file is truncated, so the old layout is still valid if the storage crashes.
+It returns StorageFull if the lumps could not be moved, the moved lumps are kept.
+*/
+func (store *Storage) Shrink(newCapacity uint64) (moved int, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	blockSize := store.innerNVM.BlockSize()
+	header := *store.storageHeader
+	dataStart := header.RegionSize() + header.JournalRegionSize
+	if !blockSize.IsAligned(newCapacity) || newCapacity >= header.StorageSize() ||
+		newCapacity < dataStart+uint64(blockSize.AsU16()) {
+		return 0, errors.Wrapf(internalerror.InvalidInput,
+			"invalid capacity %d, the storage size is %d", newCapacity, header.StorageSize())
+	}
+	header.DataRegionSize = newCapacity - dataStart
+	//the portions pinned by a snapshot could not be moved
+	if store.dataRegion.Pinned() {
+		return 0, errors.Wrap(internalerror.DeviceBusy, "a snapshot is open")
+	}
+
+	innerNVM, ok := store.innerNVM.(nvm.Resizer)
+	if !ok {
+		return 0, errors.Wrap(internalerror.InvalidInput, "the nvm could not be resized")
+	}
+	dataNVM, ok := store.dataRegion.nvm.(nvm.Resizer)
+	if !ok {
+		return 0, errors.Wrap(internalerror.InvalidInput, "the nvm of data region could not be resized")
+	}
+
+	//the moved lumps must not be allocated beyond the new end
+	end := header.DataRegionSize / uint64(blockSize.AsU16())
+	store.alloc.Shrink(blockSize, header.DataRegionSize)
+
+	var beyond []lumpindex.LumpDataPortion
+	for _, l := range store.lumpsByPortion() {
+		if l.Portion.End() > end {
+			beyond = append(beyond, l)
+		}
+	}
+	//move the larger lumps first, they are harder to fit
+	sort.Slice(beyond, func(i, j int) bool {
+		return beyond[i].Portion.Len > beyond[j].Portion.Len
+	})
+	var crossing []portion.DataPortion
+	for _, l := range beyond {
+		newPortion, ok, err := store.dataRegion.MoveForward(l.Portion)
+		if err == nil && !ok {
+			err = errors.Wrapf(internalerror.StorageFull, "no space to move %s in shrink", l.Id)
+		}
+		if err != nil {
+			store.restoreAllocator()
+			return moved, err
+		}
+		if err = store.recordMoves(l.Id, l.Portion, newPortion); err != nil {
+			store.releasePortion(newPortion)
+			store.restoreAllocator()
+			return moved, err
+		}
+		//the old portions beyond the end are dropped with the file, except the part in front of the end
+		if l.Portion.Start.AsU64() < end {
+			crossing = append(crossing, portion.DataPortion{
+				Start: l.Portion.Start,
+				Len:   uint16(end - l.Portion.Start.AsU64()),
+			})
+		}
+		moved++
+	}
+
+	//the moves must be durable before the old data is truncated, the moved data before the records.
+	//The allocator is not restored if the moved data may be lost, the old portions are free after reopen
+	if err = store.dataRegion.Sync(); err != nil {
+		return moved, errors.Wrap(err, "failed to sync data region")
+	}
+	if err = store.journalRegion.SyncChecked(); err != nil {
+		return moved, errors.Wrap(err, "failed to sync journal region")
+	}
+	if err = store.writeHeader(&header); err != nil {
+		store.restoreAllocator()
+		return moved, err
+	}
+	store.storageHeader = &header
+	for _, p := range crossing {
+		store.dataRegion.Release(p)
+	}
+	if err = dataNVM.Resize(header.DataRegionSize); err != nil {
+		return moved, err
+	}
+	if err = innerNVM.Resize(newCapacity); err != nil {
+		return moved, err
+	}
+	return moved, nil
+}
+
+//restoreAllocator rebuilds the allocator from the index after a failed Shrink
+func (store *Storage) restoreAllocator() {
+	//the allocator is created successfully when the storage is opened
+	alloc, _ := newAllocator(store.allocatorName, store.allocPolicy)
+	alloc.RestoreFromIndex(store.innerNVM.BlockSize(), store.storageHeader.DataRegionSize, store.index.DataPortions())
+	store.alloc = alloc
+	store.dataRegion.allocator = alloc
+}
+
+func (store *Storage) writeHeader(header *nvm.StorageHeader) error {
+	headBuf := new(bytes.Buffer)
+	if err := header.WriteHeaderRegionTo(headBuf); err != nil {
+		return err
+	}
+	alignedBufHead := block.FromBytes(headBuf.Bytes(), store.innerNVM.BlockSize())
+	alignedBufHead.Align()
+
+	if _, err := store.innerNVM.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := store.innerNVM.Write(alignedBufHead.AsBytes()); err != nil {
+		return errors.Wrap(err, "failed to rewrite the storage header")
+	}
+	return store.innerNVM.Sync()
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+func TestStorageResize(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp24.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp24.lusf")
+
+	//fill the data region
+	n := 0
+	for ; ; n++ {
+		if _, err = store.Put(lumpidnum(n), zeroedData(64*1024)); err != nil {
+			break
+		}
+	}
+	assert.True(t, n > 0)
+
+	err = store.Resize(512 * 1024)
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+	err = store.Resize(1024*1024*2 + 1)
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	oldHeader := store.Header()
+	assert.Nil(t, store.Resize(1024*1024*2))
+	header := store.Header()
+	assert.Equal(t, uint64(1024*1024*2), header.StorageSize())
+	assert.Equal(t, oldHeader.JournalRegionSize, header.JournalRegionSize)
+	assert.Equal(t, oldHeader.DataRegionSize+1024*1024, header.DataRegionSize)
+
+	//the new space is usable without reopening
+	for i := n; i < n+8; i++ {
+		_, err = store.Put(lumpidnum(i), zeroedData(64*1024))
+		assert.Nil(t, err)
+	}
+	store.Close()
+
+	store, err = OpenCannylsStorage("tmp24.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Equal(t, header, store.Header())
+	assert.Equal(t, n+8, len(store.List()))
+	data, err := store.Get(lumpidnum(n + 7))
+	assert.Nil(t, err)
+	assert.Equal(t, 64*1024, len(data))
+}
+
+func TestStorageShrink(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp25.lusf", 2*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp25.lusf")
+
+	for i := 0; i < 16; i++ {
+		_, err = store.Put(lumpidnum(i), zeroedData(64*1024))
+		assert.Nil(t, err)
+	}
+	_, err = store.PutWithTTL(lumpidnum(100), zeroedData(1000), time.Hour)
+	assert.Nil(t, err)
+	//free the front of the data region
+	for i := 0; i < 12; i++ {
+		_, err = store.Delete(lumpidnum(i))
+		assert.Nil(t, err)
+	}
+
+	//the lumps could not fit
+	oldHeader := store.Header()
+	_, err = store.Shrink(oldHeader.StorageSize() - oldHeader.DataRegionSize + 128*1024)
+	assert.Equal(t, internalerror.StorageFull, errors.Cause(err))
+
+	newCapacity := oldHeader.StorageSize() - 1024*1024
+	_, err = store.Shrink(oldHeader.StorageSize())
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+	moved, err := store.Shrink(newCapacity)
+	assert.Nil(t, err)
+	assert.True(t, moved > 0)
+	header := store.Header()
+	assert.Equal(t, newCapacity, header.StorageSize())
+	assert.Equal(t, int64(newCapacity), store.innerNVM.RawSize())
+	_, ok := store.index.ExpireAt(lumpidnum(100))
+	assert.True(t, ok)
+
+	//the free space is still usable
+	_, err = store.Put(lumpidnum(200), zeroedData(64*1024))
+	assert.Nil(t, err)
+	store.Close()
+
+	store, err = OpenCannylsStorage("tmp25.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Equal(t, header, store.Header())
+	for _, n := range []int{12, 13, 14, 15, 100, 200} {
+		_, err = store.Get(lumpidnum(n))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 6, len(store.List()))
+}
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+const (
+	//performance related
+	SCRUB_LUMPS_IN_SIDE_JOB = 16
+	//the last SCRUB_RECORDS corrupt lumps found are kept in ScrubStats
+	SCRUB_RECORDS = 64
+)
+
+//ScrubStats is the progress of the scrubber, see SetScrub
+type ScrubStats struct {
+	//Passes is the number of the finished walks over all the lumps
+	Passes uint64 `json:"passes"`
+	//Scanned and ScannedBytes are the lumps and the bytes verified since the storage is opened
+	Scanned      uint64 `json:"scanned"`
+	ScannedBytes uint64 `json:"scannedbytes"`
+	//PassScanned is the lumps verified in the current pass, PassTotal is the lumps when it started
+	PassScanned uint64 `json:"passscanned"`
+	PassTotal   uint64 `json:"passtotal"`
+	//Corrupt is the number of the corrupt lumps found, see CorruptLumps
+	Corrupt uint64 `json:"corrupt"`
+	//Repaired is the number of the corrupt lumps rewritten by the Repairer, see SetRepairer
+	Repaired uint64 `json:"repaired"`
+	//RepairFailures is the number of the copies of the Repairer which failed to be rewritten
+	RepairFailures uint64 `json:"repairfailures"`
+	//Records is the last SCRUB_RECORDS corrupt lumps found, the oldest first
+	Records []ScrubRecord `json:"records"`
+}
+
+//ScrubRecord is a corrupt lump found by the scrubber, and the outcome of its repair
+type ScrubRecord struct {
+	At    time.Time `json:"at"`
+	Id    string    `json:"id"`
+	Kind  string    `json:"kind"`
+	Error string    `json:"error"`
+	//Repaired is true if the lump is rewritten with the copy of the Repairer
+	Repaired bool `json:"repaired"`
+	//RepairError is set if the copy failed to be rewritten
+	RepairError string `json:"repairerror,omitempty"`
+}
+
+/*
+Repairer supplies a good copy of a corrupt lump found by the scrubber, for example from a replica.
+ok is false if there is no copy, the lump is kept in CorruptLumps then. It is called in the
+goroutine of RunSideJobOnce or ScrubOnce, and must not use the storage.
+*/
+type Repairer interface {
+	Repair(id lump.LumpId, problem VerifyProblem) (data []byte, ok bool)
+}
+
+/*
+scrubber walks the lumps ordered by lumpid, a few of them in each RunSideJobOnce, and reads
+them to verify their trailers and checksums as Verify with Deep does.
+The lumps put without checksum are only checked for their trailers and compression.
+*/
+type scrubber struct {
+	enabled bool
+	//cursor is the next lumpid to verify
+	cursor  lump.LumpId
+	stats   ScrubStats
+	corrupt map[lump.LumpId]VerifyProblem
+	//repairer is nil if the corrupt lumps are only reported
+	repairer Repairer
+}
+
+/*
+SetScrub enables the scrubber of RunSideJobOnce, it verifies SCRUB_LUMPS_IN_SIDE_JOB lumps each
+time, and starts over after all the lumps are verified. Its reads are charged to the background
+bandwidth, see SetBackgroundBandwidth. The corrupt lumps are kept in CorruptLumps, and the last
+of them are recorded with the outcomes of their repairs in ScrubStats, which is served by the
+stats socket too. They are not deleted, use Verify with Repair for that.
+*/
+func (store *Storage) SetScrub(enable bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.scrub.enabled = enable
+	return nil
+}
+
+/*
+SetRepairer lets the scrubber rewrite the corrupt lumps with the copies supplied by repairer, nil
+means the corrupt lumps are only reported. A lump in the data region is overwritten in its own
+portion if the copy fits, or it is put again as Update does, and the rewrite is journaled and
+synced. The lumps out of range are never repaired, and nothing is repaired on a read only storage.
+*/
+func (store *Storage) SetRepairer(repairer Repairer) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.scrub.repairer = repairer
+	return nil
+}
+
+//ScrubStats returns the progress of the scrubber
+func (store *Storage) ScrubStats() (stats ScrubStats) {
+	store.view(func() {
+		stats = store.scrub.copyStats()
+	})
+	return
+}
+
+//copyStats returns the stats with their own records
+func (scrub *scrubber) copyStats() ScrubStats {
+	stats := scrub.stats
+	stats.Records = append([]ScrubRecord(nil), scrub.stats.Records...)
+	return stats
+}
+
+//record keeps the corrupt lump in the stats, the oldest record is dropped if there are too many
+func (scrub *scrubber) record(record ScrubRecord) {
+	if len(scrub.stats.Records) >= SCRUB_RECORDS {
+		scrub.stats.Records = append(scrub.stats.Records[:0], scrub.stats.Records[1:]...)
+	}
+	scrub.stats.Records = append(scrub.stats.Records, record)
+}
+
+/*
+CorruptLumps returns the problems found by the scrubber ordered by lumpid. The lumps are verified
+again, those which are deleted, put again or fine now are dropped from them.
+*/
+func (store *Storage) CorruptLumps() (problems []VerifyProblem) {
+	store.view(func() {
+		problems = store.corruptLumps()
+	})
+	return
+}
+
+func (store *Storage) corruptLumps() []VerifyProblem {
+	var problems []VerifyProblem
+	for id := range store.scrub.corrupt {
+		p, err := store.index.Get(id)
+		if err != nil {
+			delete(store.scrub.corrupt, id)
+			continue
+		}
+		if kind, err := store.verifyLump(id, p); err != nil {
+			problem := VerifyProblem{Kind: kind, Id: id, Err: err}
+			store.scrub.corrupt[id] = problem
+			problems = append(problems, problem)
+		} else {
+			delete(store.scrub.corrupt, id)
+		}
+	}
+	store.scrub.stats.Corrupt = uint64(len(store.scrub.corrupt))
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Id.U64() < problems[j].Id.U64()
+	})
+	return problems
+}
+
+//ScrubOnce verifies at most max lumps from where the scrubber stopped, it is not throttled
+func (store *Storage) ScrubOnce(max int) (scanned int, problems []VerifyProblem, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	scanned, problems = store.scrubLumps(max, false)
+	return
+}
+
+//scrubLumps stops before the background bandwidth is used up if throttled
+func (store *Storage) scrubLumps(max int, throttled bool) (scanned int, problems []VerifyProblem) {
+	scrub := &store.scrub
+	if scrub.corrupt == nil {
+		scrub.corrupt = make(map[lump.LumpId]VerifyProblem)
+	}
+	for scanned < max {
+		if throttled && !store.backgroundReady() {
+			return
+		}
+		if scrub.stats.PassScanned == 0 {
+			scrub.stats.PassTotal = store.index.Count()
+		}
+		ids := store.index.ListRangeLimit(scrub.cursor, lump.FromU64(0, math.MaxUint64), 1)
+		if len(ids) == 0 {
+			//the pass is finished
+			scrub.cursor = lump.FromU64(0, 0)
+			scrub.stats.Passes++
+			scrub.stats.PassScanned = 0
+			if scrub.stats.PassTotal == 0 {
+				return
+			}
+			continue
+		}
+		id := ids[0]
+		scrub.cursor = id.Inc()
+		p, err := store.index.Get(id)
+		if err != nil {
+			continue
+		}
+
+		var size uint64
+		switch v := p.(type) {
+		case portion.DataPortion:
+			for _, extent := range store.extentsOf(id, v) {
+				_, length := extent.ShiftBlockToBytes(store.dataRegion.block_size)
+				size += uint64(length)
+			}
+		case portion.JournalPortion:
+			size = uint64(v.Len)
+		}
+		kind, err := store.verifyLump(id, p)
+		if throttled {
+			store.chargeBackground(size)
+		}
+		scanned++
+		scrub.stats.Scanned++
+		scrub.stats.ScannedBytes += size
+		scrub.stats.PassScanned++
+
+		if err != nil {
+			problem := VerifyProblem{Kind: kind, Id: id, Err: err}
+			record := ScrubRecord{At: store.clock(), Id: id.String(), Kind: kind.String(), Error: err.Error()}
+			var repairErr error
+			problem.Repaired, repairErr = store.repair(id, p, problem)
+			record.Repaired = problem.Repaired
+			if repairErr != nil {
+				record.RepairError = repairErr.Error()
+				scrub.stats.RepairFailures++
+			}
+			scrub.record(record)
+			if problem.Repaired {
+				scrub.stats.Repaired++
+				delete(scrub.corrupt, id)
+			} else {
+				scrub.corrupt[id] = problem
+			}
+			problems = append(problems, problem)
+		} else {
+			delete(scrub.corrupt, id)
+		}
+		scrub.stats.Corrupt = uint64(len(scrub.corrupt))
+	}
+	return
+}
+
+//verifyLump reads the whole lump to verify it
+func (store *Storage) verifyLump(id lump.LumpId, p portion.Portion) (VerifyProblemKind, error) {
+	switch v := p.(type) {
+	case portion.DataPortion:
+		capacity := store.storageHeader.DataRegionSize / uint64(store.dataRegion.block_size.AsU16())
+		for _, extent := range store.extentsOf(id, v) {
+			if kind, err := store.verifyDataPortion(extent, capacity, true); err != nil {
+				return kind, err
+			}
+		}
+		return 0, nil
+	case portion.JournalPortion:
+		return VERIFY_BAD_EMBEDDED, store.journalRegion.VerifyEmbedded(v)
+	}
+	return 0, nil
+}
+
+//repair rewrites the corrupt lump with the copy from the repairer, err is set if the copy failed to be rewritten
+func (store *Storage) repair(id lump.LumpId, p portion.Portion, problem VerifyProblem) (repaired bool, err error) {
+	if store.scrub.repairer == nil || store.readOnly || problem.Kind == VERIFY_OUT_OF_RANGE {
+		return false, nil
+	}
+	data, ok := store.scrub.repairer.Repair(id, problem)
+	if !ok {
+		return false, nil
+	}
+	lumpdata := lump.NewLumpDataAligned(len(data), store.dataRegion.block_size)
+	copy(lumpdata.AsBytes(), data)
+	//the index is not changed by the overwrite, so the TTL, the metadata and the tag are kept,
+	//a lump in several extents is put again into new extents with them
+	_, extended := store.index.Extents(id)
+	if extended && !store.dataRegion.FitsPortion(uint64(len(data))) {
+		expireAt, metadata, tag := store.attributesOf(id)
+		if _, err = store.putExtentsWithAttributes(id, lumpdata, expireAt, metadata, tag); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if old, isDataPortion := p.(portion.DataPortion); isDataPortion && !extended {
+		overwritten, err := store.dataRegion.Overwrite(old, lumpdata)
+		if err == nil && overwritten {
+			err = store.journalRegion.RecordOverwrite(store.index, id, old, true)
+		}
+		if err != nil {
+			return false, err
+		}
+		if overwritten {
+			return true, nil
+		}
+	}
+	if _, err = store.Update(id, lumpdata); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *Storage) runScrub() {
+	if !store.scrub.enabled {
+		return
+	}
+	//the problems are recorded in the stats
+	store.scrubLumps(SCRUB_LUMPS_IN_SIDE_JOB, true)
+}
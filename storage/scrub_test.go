@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func TestStorageScrub(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp53.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp53.lusf")
+	assert.Nil(t, store.SetDataChecksum(true))
+
+	for i := 0; i < 4; i++ {
+		_, err = store.Put(lumpidnum(i), filledData(1000, byte('a'+i)))
+		assert.Nil(t, err)
+	}
+	_, err = store.PutEmbed(lumpidnum(10), []byte("embedded"))
+	assert.Nil(t, err)
+
+	scanned, problems, err := store.ScrubOnce(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, scanned)
+	assert.Equal(t, 0, len(problems))
+	stats := store.ScrubStats()
+	assert.Equal(t, uint64(2), stats.PassScanned)
+	assert.Equal(t, uint64(5), stats.PassTotal)
+	assert.Equal(t, uint64(2048), stats.ScannedBytes)
+
+	//break lump 3, which is not scanned yet in this pass
+	p, err := store.index.Get(lumpidnum(3))
+	assert.Nil(t, err)
+	blockSize := int64(store.dataRegion.block_size.AsU16())
+	_, err = store.dataRegion.nvm.WriteAt(make([]byte, blockSize), int64(p.(portion.DataPortion).Start.AsU64())*blockSize)
+	assert.Nil(t, err)
+
+	//the pass is finished, and the next one starts from lump 0
+	scanned, problems, err = store.ScrubOnce(4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, scanned)
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, VERIFY_BAD_DATA, problems[0].Kind)
+	assert.Equal(t, lumpidnum(3), problems[0].Id)
+	stats = store.ScrubStats()
+	assert.Equal(t, uint64(1), stats.Passes)
+	assert.Equal(t, uint64(1), stats.PassScanned)
+	assert.Equal(t, uint64(6), stats.Scanned)
+	assert.Equal(t, uint64(1), stats.Corrupt)
+	assert.Equal(t, 1, len(stats.Records))
+	assert.Equal(t, lumpidnum(3).String(), stats.Records[0].Id)
+	assert.Equal(t, VERIFY_BAD_DATA.String(), stats.Records[0].Kind)
+	assert.False(t, stats.Records[0].Repaired)
+	//the lump is verified again, so only the kind and id are compared
+	corrupt := store.CorruptLumps()
+	assert.Equal(t, 1, len(corrupt))
+	assert.Equal(t, VERIFY_BAD_DATA, corrupt[0].Kind)
+	assert.Equal(t, lumpidnum(3), corrupt[0].Id)
+
+	//the corrupt lump is put again
+	_, err = store.Put(lumpidnum(3), filledData(1000, 'x'))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(store.CorruptLumps()))
+	assert.Equal(t, uint64(0), store.ScrubStats().Corrupt)
+}
+
+func TestStorageScrubInSideJob(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp54.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp54.lusf")
+	now := time.Unix(1000, 0)
+	store.clock = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		_, err = store.Put(lumpidnum(i), zeroedData(1000))
+		assert.Nil(t, err)
+	}
+
+	//the scrubber is disabled by default
+	store.RunSideJobOnce()
+	assert.Equal(t, uint64(0), store.ScrubStats().Scanned)
+
+	//a lump reads 1024 bytes, the scrubber stops when the bucket is in debt
+	assert.Nil(t, store.SetScrub(true))
+	assert.Nil(t, store.SetBackgroundBandwidth(2048))
+	store.RunSideJobOnce()
+	assert.Equal(t, uint64(2), store.ScrubStats().Scanned)
+	store.RunSideJobOnce()
+	assert.Equal(t, uint64(2), store.ScrubStats().Scanned)
+
+	assert.Nil(t, store.SetBackgroundBandwidth(0))
+	store.RunSideJobOnce()
+	stats := store.ScrubStats()
+	assert.Equal(t, uint64(1), stats.Passes)
+	assert.Equal(t, uint64(18), stats.Scanned)
+	assert.Equal(t, uint64(0), stats.Corrupt)
+}
+
+type mapRepairer map[lump.LumpId][]byte
+
+func (r mapRepairer) Repair(id lump.LumpId, problem VerifyProblem) ([]byte, bool) {
+	data, ok := r[id]
+	return data, ok
+}
+
+func TestStorageScrubRepair(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp55.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp55.lusf")
+	assert.Nil(t, store.SetDataChecksum(true))
+
+	for i := 0; i < 4; i += 2 {
+		_, err = store.Put(lumpidnum(i), filledData(1000, byte('a'+i)))
+		assert.Nil(t, err)
+	}
+	_, err = store.PutWithTag(lumpidnum(1), filledData(1000, 'b'), nil, "tagged")
+	assert.Nil(t, err)
+	old, err := store.index.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	blockSize := int64(store.dataRegion.block_size.AsU16())
+	_, err = store.Put(lumpidnum(3), filledData(1000, 'd'))
+	assert.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		p, err := store.index.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		_, err = store.dataRegion.nvm.WriteAt(make([]byte, blockSize), int64(p.(portion.DataPortion).Start.AsU64())*blockSize)
+		assert.Nil(t, err)
+	}
+
+	//lump 0 has no copy, lump 1 is overwritten in place, lump 2 is bigger and moved,
+	//the copy of lump 3 does not fit in the storage
+	store.SetRepairer(mapRepairer{
+		lumpidnum(1): filledData(1000, 'b').AsBytes(),
+		lumpidnum(2): filledData(3000, 'z').AsBytes(),
+		lumpidnum(3): filledData(2*1024*1024, 'd').AsBytes(),
+	})
+	_, problems, err := store.ScrubOnce(4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(problems))
+	assert.False(t, problems[0].Repaired)
+	assert.True(t, problems[1].Repaired)
+	assert.True(t, problems[2].Repaired)
+	assert.False(t, problems[3].Repaired)
+	stats := store.ScrubStats()
+	assert.Equal(t, uint64(2), stats.Repaired)
+	assert.Equal(t, uint64(1), stats.RepairFailures)
+	assert.Equal(t, 4, len(stats.Records))
+	for i, record := range stats.Records {
+		assert.Equal(t, lumpidnum(i).String(), record.Id)
+		assert.Equal(t, problems[i].Repaired, record.Repaired)
+	}
+	assert.Equal(t, "", stats.Records[0].RepairError)
+	assert.NotEqual(t, "", stats.Records[3].RepairError)
+	assert.Equal(t, uint64(2), store.ScrubStats().Repaired)
+	assert.Equal(t, 1, len(store.CorruptLumps()))
+
+	p, err := store.index.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, old, p)
+	tag, err := store.GetTag(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, "tagged", tag)
+	data, err := store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, filledData(1000, 'b').AsBytes(), data)
+	data, err = store.Get(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.Equal(t, 3000, len(data))
+
+	//the repairs are journaled
+	store.Close()
+	store, err = OpenCannylsStorage("tmp55.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	data, err = store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, filledData(1000, 'b').AsBytes(), data)
+	data, err = store.Get(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.Equal(t, byte('z'), data[0])
+}
@@ -0,0 +1,473 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/util"
+)
+
+/*
+Snapshot format, all the integers are big endian
+
+| "lsnp" | version(2 bytes) |
+| SNAPSHOT_TAG_EXPIRE | lumpid(8 bytes) | expire_at(8 bytes) |
+| SNAPSHOT_TAG_METADATA | lumpid(8 bytes) | length(4 bytes) | metadata |
+| SNAPSHOT_TAG_LUMP_TAG | lumpid(8 bytes) | length(4 bytes) | tag |
+| tag(1 byte) | lumpid(8 bytes) | length(4 bytes) | data | ...
+| SNAPSHOT_TAG_MARKER | id(8 bytes) | length(4 bytes) | data | ...
+| SNAPSHOT_TAG_END | count(8 bytes) | crc32c of all the bytes above(4 bytes) |
+
+The TTL, the metadata and the user tag of a lump are written before it, only if it has them.
+The count of SNAPSHOT_TAG_END is the number of the lumps. The snapshots of version 1 have
+neither the attributes of the lumps nor the markers.
+*/
+
+var (
+	SNAPSHOT_MAGIC = [4]byte{'l', 's', 'n', 'p'}
+)
+
+const (
+	SNAPSHOT_VERSION uint16 = 2
+
+	SNAPSHOT_TAG_END      = 0
+	SNAPSHOT_TAG_DATA     = 1
+	SNAPSHOT_TAG_EMBED    = 2
+	SNAPSHOT_TAG_EXPIRE   = 3
+	SNAPSHOT_TAG_METADATA = 4
+	SNAPSHOT_TAG_LUMP_TAG = 5
+	SNAPSHOT_TAG_MARKER   = 6
+)
+
+/*
+Snapshot is the point-in-time view of the storage when it is opened by OpenSnapshot, the Puts and
+Deletes after that are not seen. The lump data stays in the data region until the snapshot is
+closed, see DataRegion.Pin, so the space of the lumps deleted or overwritten while the snapshot is
+open is freed by Close, and Shrink fails until then. The snapshot must be closed.
+*/
+type Snapshot struct {
+	store *Storage
+	iter  *lumpindex.IndexIterator
+	//now is when the snapshot is opened in seconds, the lumps expired at now are skipped
+	now     uint64
+	markers []snapshotMarker
+	//run runs f as the owner of the storage, see AsyncStorage.CreateSnapshot
+	run    func(f func()) error
+	sleep  func(time.Duration)
+	closed bool
+}
+
+type snapshotMarker struct {
+	id   uint64
+	data []byte
+}
+
+//OpenSnapshot captures the lumps and the markers in the storage, the lump data is read by WriteTo
+func (store *Storage) OpenSnapshot() (*Snapshot, error) {
+	if err := store.checkOpen(); err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{
+		store: store,
+		now:   store.unixNow(),
+		run: func(f func()) error {
+			f()
+			return nil
+		},
+		sleep: time.Sleep,
+	}
+	//the embedded data of a lump is read before its record in the journal is released
+	snapshot.iter = store.index.SnapshotIterator(store.journalRegion.GetEmbededData)
+	for _, id := range store.index.Markers() {
+		data, _ := store.index.Marker(id)
+		snapshot.markers = append(snapshot.markers, snapshotMarker{id: id, data: append([]byte{}, data...)})
+	}
+	store.dataRegion.Pin()
+	return snapshot, nil
+}
+
+//Close releases the lump data pinned by the snapshot, it must be called by the owner of the storage
+func (snapshot *Snapshot) Close() {
+	if snapshot.closed {
+		return
+	}
+	snapshot.closed = true
+	snapshot.iter.Close()
+	snapshot.store.dataRegion.Unpin()
+}
+
+/*
+CreateSnapshot streams all the lumps into w, see OpenSnapshot and Snapshot.WriteTo.
+The Puts and Deletes could not run in parallel with it, because Storage is not thread safe,
+see AsyncStorage.CreateSnapshot which runs them between the chunks of the snapshot.
+*/
+func (store *Storage) CreateSnapshot(w io.Writer) (err error) {
+	snapshot, err := store.OpenSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	_, err = snapshot.WriteTo(w)
+	return err
+}
+
+/*
+WriteTo streams the lumps which are not expired into w with their TTLs, metadata and tags, and
+the markers at last. The lump data is read chunk by chunk, at most STREAM_CHUNK_SIZE bytes each
+time, and the chunks are charged to the background bandwidth, see SetBackgroundBandwidth.
+Only the reads run as the owner of the storage, w is written and the bandwidth is waited for
+between them. WriteTo could only be called once.
+*/
+func (snapshot *Snapshot) WriteTo(w io.Writer) (n int64, err error) {
+	if snapshot.closed {
+		return 0, errors.Wrap(internalerror.InvalidInput, "snapshot is closed")
+	}
+	var written countingWriter
+	writer := bufio.NewWriter(io.MultiWriter(w, &written))
+	hash := crc32.New(castagnoliTable)
+	out := io.MultiWriter(writer, hash)
+	defer func() {
+		n = int64(written)
+	}()
+
+	if err = writeAll(out, SNAPSHOT_MAGIC, SNAPSHOT_VERSION); err != nil {
+		return
+	}
+	var count uint64
+	var buf []byte
+	for {
+		var entry lumpindex.IndexEntry
+		var ok bool
+		if err = snapshot.run(func() { entry, ok = snapshot.iter.NextEntry() }); err != nil {
+			return
+		}
+		if !ok {
+			break
+		}
+		if entry.ExpireAt != 0 && entry.ExpireAt <= snapshot.now {
+			continue
+		}
+		if err = writeSnapshotAttributes(out, entry); err != nil {
+			return
+		}
+		switch v := entry.Portion.(type) {
+		case portion.DataPortion:
+			if buf == nil {
+				buf = make([]byte, STREAM_CHUNK_SIZE)
+			}
+			err = snapshot.writeData(out, entry, v, buf)
+		case portion.JournalPortion:
+			err = snapshot.writeEmbedded(out, entry, v)
+		default:
+			panic("never here")
+		}
+		if err != nil {
+			return
+		}
+		count++
+	}
+
+	for _, marker := range snapshot.markers {
+		if err = writeAll(out, uint8(SNAPSHOT_TAG_MARKER), marker.id, uint32(len(marker.data)), marker.data); err != nil {
+			return
+		}
+	}
+	if err = writeAll(out, uint8(SNAPSHOT_TAG_END), count); err != nil {
+		return
+	}
+	//the checksum itself is not a part of the checksum
+	if err = binary.Write(writer, binary.BigEndian, hash.Sum32()); err != nil {
+		return
+	}
+	err = writer.Flush()
+	return
+}
+
+func writeSnapshotAttributes(out io.Writer, entry lumpindex.IndexEntry) (err error) {
+	id := entry.Id.U64()
+	if entry.ExpireAt != 0 {
+		if err = writeAll(out, uint8(SNAPSHOT_TAG_EXPIRE), id, entry.ExpireAt); err != nil {
+			return
+		}
+	}
+	if entry.Metadata != nil {
+		if err = writeAll(out, uint8(SNAPSHOT_TAG_METADATA), id, uint32(len(entry.Metadata)), entry.Metadata); err != nil {
+			return
+		}
+	}
+	if entry.Tag != "" {
+		err = writeAll(out, uint8(SNAPSHOT_TAG_LUMP_TAG), id, uint32(len(entry.Tag)), []byte(entry.Tag))
+	}
+	return
+}
+
+func (snapshot *Snapshot) writeEmbedded(out io.Writer, entry lumpindex.IndexEntry, p portion.JournalPortion) (err error) {
+	data, err := entry.Embedded, entry.EmbeddedErr
+	if data == nil && err == nil {
+		//the lump is not changed after the snapshot is opened
+		if runErr := snapshot.run(func() {
+			data, err = snapshot.store.journalRegion.GetEmbededData(p)
+		}); runErr != nil {
+			return runErr
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to read lump %s", entry.Id.String())
+	}
+	return writeSnapshotEntry(out, SNAPSHOT_TAG_EMBED, entry.Id, data)
+}
+
+//writeData streams the lump data of the data portion or the extents of the entry, buf is the chunk
+func (snapshot *Snapshot) writeData(out io.Writer, entry lumpindex.IndexEntry, p portion.DataPortion, buf []byte) (err error) {
+	store := snapshot.store
+	extents := entry.Extents
+	if extents == nil {
+		extents = []portion.DataPortion{p}
+	}
+	var size uint64
+	var reader io.ReadCloser
+	if runErr := snapshot.run(func() {
+		for _, extent := range extents {
+			var extentSize uint32
+			if extentSize, err = store.dataRegion.Size(extent); err != nil {
+				return
+			}
+			size += uint64(extentSize)
+		}
+		reader = store.dataRegion.GetExtentsReader(extents)
+	}); runErr != nil {
+		return runErr
+	}
+	if err != nil {
+		return corruptLump(entry.Id, p, err)
+	}
+	defer snapshot.run(func() { reader.Close() })
+
+	if err = writeAll(out, uint8(SNAPSHOT_TAG_DATA), entry.Id.U64(), uint32(size)); err != nil {
+		return err
+	}
+	for remaining := size; ; {
+		chunk := buf[:util.Min(remaining, uint64(len(buf)))]
+		var read int
+		var delay time.Duration
+		if runErr := snapshot.run(func() {
+			if delay = store.backgroundDelay(); delay > 0 {
+				return
+			}
+			if len(chunk) > 0 {
+				read, err = io.ReadFull(reader, chunk)
+				store.chargeBackground(uint64(read))
+				return
+			}
+			//the checksum is verified when the reader reaches the end
+			if _, err = reader.Read(buf[:1]); err == io.EOF {
+				err = nil
+			} else if err == nil {
+				err = errors.Wrapf(internalerror.StorageCorrupted, "lump %s is larger than %d", entry.Id.String(), size)
+			}
+		}); runErr != nil {
+			return runErr
+		}
+		if err != nil {
+			return corruptLump(entry.Id, p, err)
+		}
+		if delay > 0 {
+			snapshot.sleep(delay)
+			continue
+		}
+		if len(chunk) == 0 {
+			return nil
+		}
+		if _, err = out.Write(chunk); err != nil {
+			return errors.Wrapf(err, "failed to write lump %s", entry.Id.String())
+		}
+		remaining -= uint64(read)
+	}
+}
+
+func writeSnapshotEntry(out io.Writer, tag uint8, id lump.LumpId, data []byte) (err error) {
+	if err = writeAll(out, tag, id.U64(), uint32(len(data))); err != nil {
+		return err
+	}
+	if _, err = out.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to write lump %s", id.String())
+	}
+	return nil
+}
+
+/*
+RestoreSnapshot puts all the lumps in the snapshot into store with their TTLs, metadata and tags,
+and writes the markers, the lumps and the markers with the same ids are overwritten, the others
+in store are kept. The lumps expired when they are restored are skipped, they are still counted
+in restored. If the snapshot is corrupted, the lumps before the corruption are already restored.
+*/
+func RestoreSnapshot(store *Storage, r io.Reader) (restored uint64, err error) {
+	hash := crc32.New(castagnoliTable)
+	in := io.TeeReader(bufio.NewReader(r), hash)
+
+	var magic [4]byte
+	if _, err = io.ReadFull(in, magic[:]); err != nil {
+		return 0, errors.Wrap(err, "failed to read snapshot magic")
+	}
+	if magic != SNAPSHOT_MAGIC {
+		return 0, errors.Wrap(internalerror.InvalidInput, "not a snapshot")
+	}
+	var version uint16
+	if err = binary.Read(in, binary.BigEndian, &version); err != nil {
+		return 0, err
+	}
+	if version == 0 || version > SNAPSHOT_VERSION {
+		return 0, errors.Wrapf(internalerror.InvalidInput, "unknown snapshot version %d", version)
+	}
+
+	//attributes are the attributes of the next lump
+	var attributes lumpindex.IndexEntry
+	hasAttributes := false
+	for {
+		var tag uint8
+		if err = binary.Read(in, binary.BigEndian, &tag); err != nil {
+			return restored, errors.Wrap(err, "failed to read snapshot entry")
+		}
+		if tag == SNAPSHOT_TAG_END {
+			if hasAttributes {
+				return restored, errors.Wrapf(internalerror.StorageCorrupted, "lump %s has no data", attributes.Id.String())
+			}
+			return restored, checkSnapshotTrailer(in, hash, restored)
+		}
+
+		var id uint64
+		if err = binary.Read(in, binary.BigEndian, &id); err != nil {
+			return restored, err
+		}
+		lumpid := lump.FromU64(0, id)
+		if hasAttributes && attributes.Id != lumpid && tag != SNAPSHOT_TAG_MARKER {
+			return restored, errors.Wrapf(internalerror.StorageCorrupted, "lump %s has no data", attributes.Id.String())
+		}
+		if !hasAttributes {
+			attributes = lumpindex.IndexEntry{Id: lumpid}
+		}
+
+		switch tag {
+		case SNAPSHOT_TAG_EXPIRE:
+			err = binary.Read(in, binary.BigEndian, &attributes.ExpireAt)
+			hasAttributes = true
+		case SNAPSHOT_TAG_METADATA:
+			attributes.Metadata, err = readSnapshotBytes(in, lump.MAX_METADATA_SIZE)
+			hasAttributes = true
+		case SNAPSHOT_TAG_LUMP_TAG:
+			var lumpTag []byte
+			lumpTag, err = readSnapshotBytes(in, lump.MAX_TAG_SIZE)
+			attributes.Tag = string(lumpTag)
+			hasAttributes = true
+		case SNAPSHOT_TAG_MARKER:
+			var data []byte
+			if data, err = readSnapshotBytes(in, lump.MAX_EMBEDDED_SIZE); err == nil {
+				err = store.writeMarker(id, data)
+			}
+		case SNAPSHOT_TAG_DATA, SNAPSHOT_TAG_EMBED:
+			err = restoreSnapshotLump(store, in, tag, attributes)
+			if err == nil {
+				restored++
+			}
+			hasAttributes = false
+		default:
+			return restored, errors.Wrapf(internalerror.StorageCorrupted, "unknown snapshot tag %d", tag)
+		}
+		if err != nil {
+			return restored, errors.Wrapf(err, "failed to restore %s", lumpid.String())
+		}
+	}
+}
+
+//readSnapshotBytes reads the length and the bytes following it, which are at most max bytes
+func readSnapshotBytes(in io.Reader, max int) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(in, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > uint32(max) {
+		return nil, errors.Wrapf(internalerror.StorageCorrupted, "%d bytes are too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//restoreSnapshotLump puts the lump of entry, whose id and attributes are in entry
+func restoreSnapshotLump(store *Storage, in io.Reader, tag uint8, entry lumpindex.IndexEntry) (err error) {
+	var length uint32
+	if err = binary.Read(in, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if tag == SNAPSHOT_TAG_EMBED && length > lump.MAX_EMBEDDED_SIZE {
+		return errors.Wrapf(internalerror.StorageCorrupted, "embedded lump is too large: %d", length)
+	}
+	if uint64(length) > lump.LARGE_LUMP_MAX_SIZE {
+		return errors.Wrapf(internalerror.StorageCorrupted, "lump is too large: %d", length)
+	}
+	if entry.ExpireAt != 0 && entry.ExpireAt <= store.unixNow() {
+		_, err = io.CopyN(ioutil.Discard, in, int64(length))
+		return err
+	}
+	if entry.ExpireAt == 0 && entry.Metadata == nil && entry.Tag == "" {
+		if tag == SNAPSHOT_TAG_EMBED {
+			data := make([]byte, length)
+			if _, err = io.ReadFull(in, data); err != nil {
+				return err
+			}
+			_, err = store.PutEmbed(entry.Id, data)
+			return err
+		}
+		//a lump larger than a portion is streamed into extents
+		_, err = store.PutReader(entry.Id, in, uint64(length))
+		return err
+	}
+
+	lumpdata := lump.NewLumpDataAligned(int(length), store.dataRegion.block_size)
+	if _, err = io.ReadFull(in, lumpdata.AsBytes()); err != nil {
+		return err
+	}
+	switch {
+	case entry.ExpireAt != 0:
+		if err = store.checkOpen(); err == nil {
+			_, err = store.putWithExpire(entry.Id, lumpdata, entry.ExpireAt)
+		}
+	case tag == SNAPSHOT_TAG_EMBED:
+		_, err = store.PutEmbedWithTag(entry.Id, lumpdata.AsBytes(), entry.Metadata, entry.Tag)
+	default:
+		_, err = store.PutWithTag(entry.Id, lumpdata, entry.Metadata, entry.Tag)
+	}
+	return err
+}
+
+func checkSnapshotTrailer(in io.Reader, hash hash.Hash32, restored uint64) error {
+	var count uint64
+	if err := binary.Read(in, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if count != restored {
+		return errors.Wrapf(internalerror.StorageCorrupted, "snapshot has %d lumps, but %d are restored", count, restored)
+	}
+	//the checksum itself is not a part of the checksum
+	expected := hash.Sum32()
+	var sum uint32
+	if err := binary.Read(in, binary.BigEndian, &sum); err != nil {
+		return err
+	}
+	if sum != expected {
+		return errors.Wrap(internalerror.StorageCorrupted, "snapshot checksum mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func TestStorageSnapshot(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	data := zeroedData(3000)
+	copy(data.AsBytes(), payload)
+	_, err = storage.Put(lumpid("0000"), data)
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("0001"), []byte("foo"))
+	assert.Nil(t, err)
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, storage.CreateSnapshot(buf))
+	snapshot := buf.Bytes()
+
+	//changes after the snapshot are not in it
+	_, err = storage.Delete(lumpid("0000"))
+	assert.Nil(t, err)
+	storage.Close()
+
+	restoredStorage, err := CreateCannylsStorage("tmp12.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp12.lusf")
+
+	restored, err := RestoreSnapshot(restoredStorage, bytes.NewReader(snapshot))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), restored)
+	get_data, err := restoredStorage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, payload, get_data)
+	get_data, err = restoredStorage.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), get_data)
+
+	//corrupted snapshot
+	snapshot[100] ^= 0xFF
+	_, err = RestoreSnapshot(restoredStorage, bytes.NewReader(snapshot))
+	assert.Error(t, err)
+	_, err = RestoreSnapshot(restoredStorage, bytes.NewReader([]byte("foo")))
+	assert.Error(t, err)
+	restoredStorage.Close()
+}
+
+func TestStorageSnapshotAttributes(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp89.lusf", 128*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp89.lusf")
+	now := time.Unix(1000, 0)
+	storage.clock = func() time.Time { return now }
+	free := storage.Usage().FreeBytes
+
+	_, err = storage.PutWithTag(lumpid("0000"), thumbnailData(3000, 1), []byte("meta"), "a")
+	assert.Nil(t, err)
+	_, err = storage.PutEmbedWithTag(lumpid("0001"), []byte("foo"), nil, "b")
+	assert.Nil(t, err)
+	_, err = storage.PutWithTTL(lumpid("0002"), thumbnailData(3000, 2), 10*time.Second)
+	assert.Nil(t, err)
+	_, err = storage.PutWithTTL(lumpid("0003"), thumbnailData(3000, 3), time.Second)
+	assert.Nil(t, err)
+	large := thumbnailData(int(storage.dataRegion.ExtentSize())+5000, 4)
+	_, err = storage.Put(lumpid("0004"), large)
+	assert.Nil(t, err)
+	_, err = storage.WriteMarker([]byte("marker"))
+	assert.Nil(t, err)
+
+	//0003 is expired when the snapshot is opened
+	now = now.Add(time.Second)
+	snapshot, err := storage.OpenSnapshot()
+	assert.Nil(t, err)
+
+	//the changes after the snapshot is opened are not in it, and the old data is kept
+	for _, id := range []string{"0000", "0002", "0004"} {
+		_, err = storage.Delete(lumpid(id))
+		assert.Nil(t, err)
+	}
+	_, err = storage.PutEmbed(lumpid("0001"), []byte("bar"))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("0005"), thumbnailData(3000, 5))
+	assert.Nil(t, err)
+	header := storage.Header()
+	_, err = storage.Shrink(header.StorageSize() - 1024*1024)
+	assert.Equal(t, internalerror.DeviceBusy, errors.Cause(err))
+	report, err := storage.Verify(VerifyOptions{Deep: true})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean(), "%v", report.Problems)
+
+	buf := new(bytes.Buffer)
+	n, err := snapshot.WriteTo(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	snapshot.Close()
+
+	//the space of the deleted lumps is freed by Close
+	_, err = storage.Delete(lumpid("0005"))
+	assert.Nil(t, err)
+	_, err = storage.Delete(lumpid("0003"))
+	assert.Nil(t, err)
+	assert.Equal(t, free, storage.Usage().FreeBytes)
+	storage.Close()
+
+	restoredStorage, err := CreateCannylsStorage("tmp90.lusf", 128*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp90.lusf")
+	defer restoredStorage.Close()
+	restoredStorage.clock = func() time.Time { return now }
+	restored, err := RestoreSnapshot(restoredStorage, bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), restored)
+	assert.Equal(t, []lump.LumpId{lumpid("0000"), lumpid("0001"), lumpid("0002"), lumpid("0004")}, restoredStorage.List())
+
+	data, err := restoredStorage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, thumbnailData(3000, 1).AsBytes(), data)
+	metadata, err := restoredStorage.GetMetadata(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("meta"), metadata)
+	tag, err := restoredStorage.GetTag(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a", tag)
+	data, err = restoredStorage.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), data)
+	tag, err = restoredStorage.GetTag(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, "b", tag)
+	expireAt, ok := restoredStorage.ExpireAt(lumpid("0002"))
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1010, 0), expireAt)
+	data, err = restoredStorage.Get(lumpid("0004"))
+	assert.Nil(t, err)
+	assert.Equal(t, large.AsBytes(), data)
+	marker, ok := restoredStorage.Marker(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("marker"), marker)
+}
+
+//blockingWriter runs write before its first Write
+type blockingWriter struct {
+	bytes.Buffer
+	write func()
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if w.write != nil {
+		w.write()
+		w.write = nil
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestAsyncStorageSnapshot(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp89.lusf", 128*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp89.lusf")
+	for i := 0; i < 4; i++ {
+		_, err = storage.Put(lumpidnum(i), thumbnailData(2*STREAM_CHUNK_SIZE, byte(i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, storage.SetBackgroundBandwidth(64*1024*1024))
+	async, err := NewAsyncStorage(storage, 16)
+	assert.Nil(t, err)
+	defer async.Close()
+
+	//the worker runs the requests while the snapshot is written
+	w := &blockingWriter{}
+	w.write = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := async.DeleteContext(ctx, lumpidnum(0))
+		assert.Nil(t, err)
+		_, err = async.PutContext(ctx, lumpidnum(1), thumbnailData(3000, 9))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, async.CreateSnapshot(context.Background(), w))
+
+	restoredStorage, err := CreateCannylsStorage("tmp90.lusf", 128*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp90.lusf")
+	defer restoredStorage.Close()
+	restored, err := RestoreSnapshot(restoredStorage, bytes.NewReader(w.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), restored)
+	for i := 0; i < 4; i++ {
+		data, err := restoredStorage.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		assert.Equal(t, thumbnailData(2*STREAM_CHUNK_SIZE, byte(i)).AsBytes(), data)
+	}
+
+	//the pinned portions are freed after the snapshot is closed
+	result := async.Do(context.Background(), false, func(store *Storage) AsyncResult {
+		report, err := store.Verify(VerifyOptions{})
+		assert.True(t, report.Clean(), "%v", report.Problems)
+		assert.False(t, store.dataRegion.Pinned())
+		return AsyncResult{Err: err}
+	})
+	assert.Nil(t, result.Err)
+}
+
+func TestStorageSnapshotThrottle(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp89.lusf", 128*1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp89.lusf")
+	defer storage.Close()
+	now := time.Unix(1000, 0)
+	storage.clock = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		_, err = storage.Put(lumpidnum(i), thumbnailData(2*STREAM_CHUNK_SIZE, byte(i)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, storage.SetBackgroundBandwidth(STREAM_CHUNK_SIZE))
+
+	//the snapshot sleeps for the bandwidth without holding the storage
+	snapshot, err := storage.OpenSnapshot()
+	assert.Nil(t, err)
+	defer snapshot.Close()
+	running := false
+	run := snapshot.run
+	snapshot.run = func(f func()) error {
+		running = true
+		defer func() { running = false }()
+		return run(f)
+	}
+	var slept time.Duration
+	snapshot.sleep = func(d time.Duration) {
+		assert.False(t, running)
+		slept += d
+		now = now.Add(d)
+	}
+	_, err = snapshot.WriteTo(ioutil.Discard)
+	assert.Nil(t, err)
+	assert.True(t, slept >= 3*time.Second, "%v", slept)
+}
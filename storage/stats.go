@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+)
+
+//OpStats counts an operation since EnableStats
+type OpStats struct {
+	Count    uint64 `json:"count"`
+	Failures uint64 `json:"failures"`
+	//TotalNanoseconds is the sum of the latency, it is divided by Count for the average
+	TotalNanoseconds uint64 `json:"totalnanoseconds"`
+}
+
+//StatsSnapshot is served by the stats socket, see EnableStats and ReadStats
+type StatsSnapshot struct {
+	//UpdatedAt is the time Usage is updated, the counters are always up to date
+	UpdatedAt    time.Time          `json:"updatedat"`
+	Usage        StorageUsage       `json:"usage"`
+	Ops          map[string]OpStats `json:"ops"`
+	JournalSyncs uint64             `json:"journalsyncs"`
+	JournalGCs   uint64             `json:"journalgcs"`
+	//JournalThrottles is the number of the appends throttled, see SetJournalThrottle
+	JournalThrottles           uint64 `json:"journalthrottles"`
+	JournalThrottleRejections  uint64 `json:"journalthrottlerejections"`
+	JournalThrottleNanoseconds uint64 `json:"journalthrottlenanoseconds"`
+	//Scrub is updated with Usage, see SetScrub
+	Scrub ScrubStats `json:"scrub"`
+	//SideJobs is updated with Usage, see RunSideJobOnce
+	SideJobs SideJobStats `json:"sidejobs"`
+}
+
+//SideJobStats counts the failures of the jobs of RunSideJobOnce, see Storage.SideJobStats
+type SideJobStats struct {
+	ReapFailures       uint64 `json:"reapfailures"`
+	CompactionFailures uint64 `json:"compactionfailures"`
+	CheckpointFailures uint64 `json:"checkpointfailures"`
+	PunchFailures      uint64 `json:"punchfailures"`
+	//LastError is the error of the last failed job, it is empty if no job has failed
+	LastError string `json:"lasterror"`
+}
+
+//statsCollector counts the operations as an Observer, and forwards them to the observer set by SetObserver
+type statsCollector struct {
+	next     Observer
+	listener net.Listener
+	path     string
+
+	mu       sync.Mutex
+	snapshot StatsSnapshot
+}
+
+func (c *statsCollector) ObserveOperation(op string, duration time.Duration, err error) {
+	c.mu.Lock()
+	stats := c.snapshot.Ops[op]
+	stats.Count++
+	stats.TotalNanoseconds += uint64(duration)
+	if err != nil {
+		stats.Failures++
+	}
+	c.snapshot.Ops[op] = stats
+	c.mu.Unlock()
+	if c.next != nil {
+		c.next.ObserveOperation(op, duration, err)
+	}
+}
+
+func (c *statsCollector) ObserveGC() {
+	c.mu.Lock()
+	c.snapshot.JournalGCs++
+	c.mu.Unlock()
+	if c.next != nil {
+		c.next.ObserveGC()
+	}
+}
+
+func (c *statsCollector) ObserveSync() {
+	c.mu.Lock()
+	c.snapshot.JournalSyncs++
+	c.mu.Unlock()
+	if c.next != nil {
+		c.next.ObserveSync()
+	}
+}
+
+func (c *statsCollector) ObserveThrottle(duration time.Duration, rejected bool) {
+	c.mu.Lock()
+	c.snapshot.JournalThrottles++
+	if rejected {
+		c.snapshot.JournalThrottleRejections++
+	}
+	c.snapshot.JournalThrottleNanoseconds += uint64(duration)
+	c.mu.Unlock()
+	if c.next != nil {
+		c.next.ObserveThrottle(duration, rejected)
+	}
+}
+
+func (c *statsCollector) setUsage(usage StorageUsage, scrub ScrubStats, sideJobs SideJobStats, now time.Time) {
+	c.mu.Lock()
+	c.snapshot.Usage = usage
+	c.snapshot.Scrub = scrub
+	c.snapshot.SideJobs = sideJobs
+	c.snapshot.UpdatedAt = now
+	c.mu.Unlock()
+}
+
+func (c *statsCollector) copySnapshot() StatsSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := c.snapshot
+	snapshot.Ops = make(map[string]OpStats, len(c.snapshot.Ops))
+	for op, stats := range c.snapshot.Ops {
+		snapshot.Ops[op] = stats
+	}
+	return snapshot
+}
+
+//serve writes a snapshot to every connection, until the listener is closed
+func (c *statsCollector) serve() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		json.NewEncoder(conn).Encode(c.copySnapshot())
+		conn.Close()
+	}
+}
+
+func (c *statsCollector) close() {
+	c.listener.Close()
+	os.Remove(c.path)
+}
+
+/*
+EnableStats serves the usage and the operation counters of the storage on the unix socket,
+so tools like "cannyls top" could watch a running storage without opening it.
+The usage is updated by RunSideJobOnce, because the storage is not thread safe.
+The socket is removed when the storage is closed
+*/
+func (store *Storage) EnableStats(socket string) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	if store.stats != nil {
+		return errors.Wrapf(internalerror.InvalidInput, "stats is served on %s already", store.stats.path)
+	}
+	//a socket left by a crashed process is removed, a live one is not
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return errors.Wrapf(internalerror.DeviceBusy, "stats socket %s is in use", socket)
+	}
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", socket)
+	}
+	collector := &statsCollector{
+		next:     store.observer,
+		listener: listener,
+		path:     socket,
+		snapshot: StatsSnapshot{Ops: make(map[string]OpStats)},
+	}
+	store.stats = collector
+	if err := store.SetObserver(store.observer); err != nil {
+		return err
+	}
+	store.updateStats()
+	go collector.serve()
+	return nil
+}
+
+func (store *Storage) updateStats() {
+	if store.stats != nil {
+		store.stats.setUsage(store.Usage(), store.scrub.copyStats(), store.sideJobs, store.clock())
+	}
+}
+
+//ReadStats reads a snapshot from the stats socket of a running storage, see EnableStats
+func ReadStats(socket string) (snapshot StatsSnapshot, err error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return snapshot, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	err = json.NewDecoder(conn).Decode(&snapshot)
+	return snapshot, err
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingObserver struct {
+	ops        int
+	throttles  int
+	rejections int
+}
+
+func (o *countingObserver) ObserveOperation(op string, duration time.Duration, err error) {
+	o.ops++
+}
+
+func (o *countingObserver) ObserveGC() {}
+
+func (o *countingObserver) ObserveSync() {}
+
+func (o *countingObserver) ObserveThrottle(duration time.Duration, rejected bool) {
+	o.throttles++
+	if rejected {
+		o.rejections++
+	}
+}
+
+func TestStorageStats(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp39.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp39.lusf")
+
+	_, err = ReadStats("tmp39.stats")
+	assert.Error(t, err)
+
+	assert.Nil(t, store.EnableStats("tmp39.stats"))
+	assert.Error(t, store.EnableStats("tmp39.stats"))
+	//the observer is still called
+	observer := &countingObserver{}
+	assert.Nil(t, store.SetObserver(observer))
+
+	_, err = store.Put(lumpidnum(1), zeroedData(100))
+	assert.Nil(t, err)
+	_, err = store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	_, err = store.Get(lumpidnum(2))
+	assert.Error(t, err)
+	assert.Nil(t, store.JournalSync())
+	assert.Equal(t, 3, observer.ops)
+
+	snapshot, err := ReadStats("tmp39.stats")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), snapshot.Ops[OP_PUT].Count)
+	assert.Equal(t, OpStats{Count: 2, Failures: 1, TotalNanoseconds: snapshot.Ops[OP_GET].TotalNanoseconds}, snapshot.Ops[OP_GET])
+	assert.Equal(t, uint64(1), snapshot.JournalSyncs)
+	//the usage is updated by RunSideJobOnce
+	assert.Equal(t, uint64(0), snapshot.Usage.FileCounts)
+
+	store.RunSideJobOnce()
+	snapshot, err = ReadStats("tmp39.stats")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), snapshot.Usage.FileCounts)
+	assert.NotEqual(t, uint64(0), snapshot.Usage.AllocatedBytes)
+
+	store.Close()
+	_, err = os.Stat("tmp39.stats")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -3,16 +3,24 @@ package storage
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync/atomic"
 
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/lump"
 	"github.com/thesues/cannyls-go/lumpindex"
 	"github.com/thesues/cannyls-go/nvm"
 	"github.com/thesues/cannyls-go/portion"
 	"github.com/thesues/cannyls-go/storage/allocator"
 	"github.com/thesues/cannyls-go/storage/journal"
+	"github.com/thesues/cannyls-go/storage/migrate"
 )
 
 var _ = fmt.Println
@@ -27,13 +35,175 @@ const (
 	MAX_DATA_REGION_SIZE    uint64 = MAX_JOURNAL_REGION_SIZE * uint64(block.MIN)
 )
 
+const (
+	//performance related
+	COMPACTION_MOVES_IN_SIDE_JOB = 16
+	EXPIRE_REAPS_IN_SIDE_JOB     = 64
+)
+
+/*
+Storage is not thread safe, its methods must be called by one goroutine at a time. To share it
+between goroutines, hand it to an AsyncStorage, which is the single writer of the storage: the
+calls are submitted to its queue by any goroutine, and run one by one in its worker goroutine.
+No external mutex is needed, and the storage must not be called directly until the AsyncStorage
+is closed, such calls fail with DeviceBusy.
+After Close the calls fail with DeviceTerminated, the setters return these errors too. The getters
+without an error result, such as List, are submitted to the AsyncStorage when they are called out of
+its worker, and return the zero value after Close, see view. Header, ReadOnly and Recovery could be
+called at any time.
+*/
 type Storage struct {
-	storageHeader *nvm.StorageHeader
-	dataRegion    *DataRegion
-	journalRegion *journal.JournalRegion
-	index         *lumpindex.LumpIndex
-	innerNVM      nvm.NonVolatileMemory
-	alloc         allocator.DataPortionAlloc
+	storageHeader       *nvm.StorageHeader
+	dataRegion          *DataRegion
+	journalRegion       *journal.JournalRegion
+	index               *lumpindex.LumpIndex
+	innerNVM            nvm.NonVolatileMemory
+	alloc               allocator.DataPortionAlloc
+	allocatorName       string
+	allocPolicy         allocator.AllocationPolicy
+	checkpointPath      string
+	checkpointInterval  time.Duration
+	lastCheckpoint      time.Time
+	checkpointJob       *checkpointJob
+	automaticCompaction bool
+	compaction          compactionPass
+	clock               func() time.Time
+	embedThreshold      int
+	embedCache          *readCache
+	embedCachePolicy    EmbedCachePolicy
+	observer            Observer
+	hooks               Hooks
+	readOnly            bool
+	//stats is served on a unix socket, see EnableStats
+	stats *statsCollector
+	//Put overwrites the lump data in its own portion if possible, see SetOverwriteInPlace
+	overwriteInPlace bool
+	//Put shares the portion of the lumps with the same data, see SetDedup
+	dedup bool
+	//the quotas of the namespaces, see SetNamespaceQuota
+	quotas map[uint32]uint64
+	//the bandwidth of the background work, see SetBackgroundBandwidth
+	background *tokenBucket
+	//the scrubber of RunSideJobOnce, see SetScrub
+	scrub scrubber
+	//the failures of the jobs of RunSideJobOnce
+	sideJobs SideJobStats
+	//how the index is restored when it is opened
+	recovery Recovery
+	//closed is set by Close, the operations fail after it. owned is set while an AsyncStorage owns
+	//the storage, executing is set while its worker runs. They are read by checkOwner out of the worker
+	closed    int32
+	owned     int32
+	executing int32
+	//owner is the *AsyncStorage owning the storage, the getters are submitted to it, see view
+	owner atomic.Value
+}
+
+type StorageOptions struct {
+	Journal journal.JournalRegionOptions
+	//File is used by OpenCannylsStorageWithOptions to open the file
+	File nvm.FileOptions
+	//Put embeds the lumps not larger than EmbedThreshold into the journal region, 0 means never
+	EmbedThreshold int
+	//RehomeOnOpen moves the lumps on the wrong side of EmbedThreshold when the storage is opened
+	RehomeOnOpen bool
+	//PunchHoles deallocates the released data portions in the file, see DataRegion.SetPunchHoles
+	PunchHoles bool
+	//PanicFree makes the reads of a broken portion return StorageCorrupted, see SetPanicFree
+	PanicFree bool
+	//OverwriteInPlace is set by SetOverwriteInPlace when the storage is opened
+	OverwriteInPlace bool
+	//Dedup is set by SetDedup when the storage is opened
+	Dedup bool
+	//Allocator is the name of a registered allocator, see allocator.Register, empty means the default
+	Allocator string
+	//AllocationPolicy is set if it is not the default, the allocator must be an allocator.PolicyAllocator
+	AllocationPolicy allocator.AllocationPolicy
+	//Checkpoint is the path of the checkpoint file, see WriteCheckpoint, empty means disabled
+	Checkpoint string
+	//CheckpointInterval is the minimum interval of the checkpoints written by RunSideJobOnce,
+	//they are written a part each time and throttled, see SetBackgroundBandwidth,
+	//0 means the checkpoint is only written by Close and WriteCheckpoint
+	CheckpointInterval time.Duration
+	//CacheSize is the max bytes of lump data cached by Get, see DataRegion.SetCache, 0 means disabled
+	CacheSize   uint64
+	CachePolicy CachePolicy
+	//EmbedCacheSize is the max bytes of embedded lumps cached in memory, see Storage.SetEmbedCache, 0 means disabled
+	EmbedCacheSize   uint64
+	EmbedCachePolicy EmbedCachePolicy
+	//Compression is the codec of the lumps put into the data region, see DataRegion.SetCompression
+	Compression CompressionCodec
+	//IndexTree is the tree of the lump index, lumpindex.TREE_PACKED takes less memory for the dense lumpids
+	IndexTree lumpindex.TreeKind
+	//IndexSpill is the path of the file which the lump index is spilled to when it takes more than
+	//IndexMemoryLimit bytes, the tree is always lumpindex.TREE_PACKED then. Empty means disabled.
+	//A spilled Get could read the file, so it is slower, but a huge storage could be opened with
+	//a small memory. The file is rebuilt on open and removed on close.
+	IndexSpill       string
+	IndexMemoryLimit uint64
+	//BloomFalsePositiveRate enables the bloom filter of the lump index, which answers Get and
+	//Delete of the absent lumps without searching the index, see LumpIndex.EnableBloomFilter.
+	//0 means disabled
+	BloomFalsePositiveRate float64
+	//NamespaceBits is the high bits of a lumpid which are its namespace, as lump.IdLayout, the bytes
+	//used by each namespace are tracked, see SetNamespaceQuota. 0 means disabled
+	NamespaceBits uint
+	//BackgroundBandwidth is the bytes per second of the background work, see SetBackgroundBandwidth.
+	//0 means no limit
+	BackgroundBandwidth uint64
+	//Scrub enables the scrubber of RunSideJobOnce, see SetScrub
+	Scrub bool
+}
+
+//PutOptions changes the behavior of a single PutWithOptions
+type PutOptions struct {
+	//SyncJournal counts the put for Journal.SyncInterval as Put does. If it is false, the put
+	//never syncs the journal, it is lost on crash unless the journal is synced later by other
+	//puts, JournalSync or RunSideJobOnce. It is for the data which could be rebuilt, such as a cache
+	SyncJournal bool
+}
+
+func DefaultPutOptions() PutOptions {
+	return PutOptions{SyncJournal: true}
+}
+
+func DefaultStorageOptions() StorageOptions {
+	return StorageOptions{
+		Journal: journal.DefaultJournalRegionOptions(),
+		File:    nvm.DefaultFileOptions(),
+	}
+}
+
+func (options StorageOptions) newIndex() (*lumpindex.LumpIndex, error) {
+	if options.IndexSpill != "" {
+		return lumpindex.NewSpilledIndex(options.IndexSpill, options.IndexMemoryLimit)
+	}
+	return lumpindex.NewIndexWithTree(options.IndexTree)
+}
+
+func (options StorageOptions) validate() error {
+	if options.EmbedThreshold < 0 || options.EmbedThreshold > lump.MAX_EMBEDDED_SIZE {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid embed threshold %d", options.EmbedThreshold)
+	}
+	if err := options.CachePolicy.validate(); err != nil {
+		return err
+	}
+	if err := options.Compression.validate(); err != nil {
+		return err
+	}
+	if err := options.IndexTree.Validate(); err != nil {
+		return err
+	}
+	if options.BloomFalsePositiveRate < 0 || options.BloomFalsePositiveRate >= 1 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid bloom false positive rate %f", options.BloomFalsePositiveRate)
+	}
+	if options.NamespaceBits > 32 {
+		return errors.Wrapf(internalerror.InvalidInput, "invalid namespace bits %d", options.NamespaceBits)
+	}
+	if options.IndexSpill != "" && options.IndexSpill == options.Checkpoint {
+		return errors.Wrap(internalerror.InvalidInput, "index spill file is the checkpoint")
+	}
+	return options.EmbedCachePolicy.validate()
 }
 
 type StorageUsage struct {
@@ -44,37 +214,100 @@ type StorageUsage struct {
 	MaxIndex        int64  `json:"maxindex"`
 	FreeBytes       uint64 `json:"freebytes"`
 	CurrentFileSize uint64 `json:"currentfilesize"`
+	AllocatedBytes  uint64 `json:"allocatedbytes"`
+	//the size of the largest free portion in data region
+	LargestFreeBytes uint64 `json:"largestfreebytes"`
+	//1 - LargestFreeBytes / FreeBytes, 0 means the free space is contiguous
+	Fragmentation float64 `json:"fragmentation"`
+	JournalUsage  uint64  `json:"journalusage"`
+	EmbeddedBytes uint64  `json:"embeddedbytes"`
 }
 
 func OpenCannylsStorage(path string) (*Storage, error) {
-	file, header, err := nvm.Open(path)
+	return OpenCannylsStorageWithOptions(path, DefaultStorageOptions())
+}
+
+func OpenCannylsStorageWithOptions(path string, options StorageOptions) (*Storage, error) {
+	if _, err := os.Stat(path + JOURNAL_RESIZE_SUFFIX); err == nil {
+		return nil, errors.Wrapf(internalerror.InconsistentState,
+			"journal resizing of %s is not finished, run ResizeJournal again", path)
+	}
+	file, header, err := nvm.OpenWithOptions(path, options.File)
+	if err != nil {
+		return nil, err
+	}
+	if file.Degraded() {
+		fmt.Printf("%s is on a network filesystem, every write is synced and verified\n", path)
+	}
+	store, err := OpenCannylsStorageOnNVM(file, header, options)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
+	return store, nil
+}
 
-	index := lumpindex.NewIndex()
+//OpenCannylsStorageOnNVM opens the storage on any NonVolatileMemory, such as nvm.UringNVM,
+//the header is already read from the file
+func OpenCannylsStorageOnNVM(file nvm.NonVolatileMemory, header *nvm.StorageHeader, options StorageOptions) (*Storage, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	//the portions are addressed in the blocks of the header
+	if header.BlockSize != file.BlockSize() {
+		return nil, errors.Wrapf(internalerror.InvalidInput,
+			"block size %d of the storage does not match the block size %d of the nvm", header.BlockSize, file.BlockSize())
+	}
+	alloc, err := newAllocator(options.Allocator, options.AllocationPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if migrate.Required(header) {
+		applied, err := migrate.Upgrade(file, header)
+		for _, m := range applied {
+			fmt.Printf("Storage is migrated from %s to %s: %s\n", m.From, m.To, m.Description)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 	journalNVM, dataNVM := header.SplitRegion(file)
 
-	journalRegion, err := journal.OpenJournalRegion(journalNVM)
+	journalRegion, err := journal.OpenJournalRegionWithOptions(journalNVM, options.Journal)
 	if err != nil {
 		return nil, err
 	}
 
 	fmt.Printf("%v Start to restore index\n", time.Now())
-	journalRegion.RestoreIndex(index)
+	index, free, recovery, err := restoreIndex(journalRegion, header, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.BloomFalsePositiveRate > 0 {
+		//the rate is validated with the options
+		index.EnableBloomFilter(options.BloomFalsePositiveRate)
+	}
+	//the bits are validated with the options
+	index.TrackNamespaces(options.NamespaceBits, header.BlockSize)
 	fmt.Printf("%v End to restore index\n", time.Now())
+	fmt.Printf("Index is restored in %v, clean: %v, checkpoint: %v, fast path: %v, %d records are replayed\n",
+		recovery.Duration, recovery.Clean, recovery.Checkpoint, recovery.FastPath, recovery.Replayed)
 	fmt.Printf("Index's mem is %d\n", index.MemoryUsed())
 	id, _ := index.Min()
 	fmt.Printf("Min index is %d\n", id.U64())
 	id, _ = index.Max()
 	fmt.Printf("Max index is %d\n", id.U64())
 
-	//use JudyAlloc as default
-	alloc := allocator.NewJudyAlloc()
 	fmt.Printf("%v :Start to restore allocator\n", time.Now())
 
 	//  use RestoreFromIndex as default
-	alloc.RestoreFromIndex(file.BlockSize(), header.DataRegionSize, index.DataPortions())
+	if freeList, ok := alloc.(allocator.FreeListAllocator); ok && len(free) > 0 {
+		for _, r := range free {
+			freeList.AddFree(r.start, r.length)
+		}
+	} else {
+		alloc.RestoreFromIndex(file.BlockSize(), header.DataRegionSize, index.DataPortions())
+	}
 	/*
 	alloc.RestoreFromIndexWithJudy(file.BlockSize(), header.DataRegionSize, index.JudyDataPortions())
 
@@ -84,31 +317,114 @@ func OpenCannylsStorage(path string) (*Storage, error) {
 
 	fmt.Printf("%v :End to restore allocator\n", time.Now())
 	dataRegion := NewDataRegion(alloc, dataNVM)
+	dataRegion.SetPunchHoles(options.PunchHoles, journalRegion.Syncs)
+	dataRegion.SetPanicFree(options.PanicFree)
+	dataRegion.SetCache(options.CacheSize, options.CachePolicy)
+	if err = dataRegion.SetCompression(options.Compression); err != nil {
+		index.Close()
+		return nil, err
+	}
 
-	return &Storage{
-		storageHeader: header,
-		dataRegion:    dataRegion,
-		journalRegion: journalRegion,
-		index:         index,
-		innerNVM:      file,
-		alloc:         alloc,
-	}, nil
+	store := &Storage{
+		storageHeader:      header,
+		dataRegion:         dataRegion,
+		journalRegion:      journalRegion,
+		index:              index,
+		innerNVM:           file,
+		alloc:              alloc,
+		allocatorName:      options.Allocator,
+		allocPolicy:        options.AllocationPolicy,
+		checkpointPath:     options.Checkpoint,
+		checkpointInterval: options.CheckpointInterval,
+		clock:              time.Now,
+		embedThreshold:     options.EmbedThreshold,
+		overwriteInPlace:   options.OverwriteInPlace,
+		dedup:              options.Dedup,
+		recovery:           recovery,
+		scrub:              scrubber{enabled: options.Scrub},
+	}
+	store.SetEmbedCache(options.EmbedCacheSize, options.EmbedCachePolicy)
+	if err = store.SetBackgroundBandwidth(options.BackgroundBandwidth); err != nil {
+		index.Close()
+		return nil, err
+	}
+
+	if options.RehomeOnOpen {
+		moved, err := store.RehomeLumps()
+		if err != nil {
+			index.Close()
+			return nil, err
+		}
+		fmt.Printf("%d lumps are rehomed\n", moved)
+	}
+	return store, nil
+
+}
 
+func newAllocator(name string, policy allocator.AllocationPolicy) (allocator.DataPortionAlloc, error) {
+	alloc, err := allocator.New(name)
+	if err != nil {
+		return nil, err
+	}
+	if policy == allocator.POLICY_BEST_FIT {
+		return alloc, nil
+	}
+	policyAlloc, ok := alloc.(allocator.PolicyAllocator)
+	if !ok {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "allocator %s does not support %s", name, policy)
+	}
+	if err = policyAlloc.SetPolicy(policy); err != nil {
+		return nil, err
+	}
+	return alloc, nil
 }
 
 func CreateCannylsStorage(path string, capacity uint64, journal_ratio float64) (*Storage, error) {
+	return CreateCannylsStorageWithOptions(path, capacity, journal_ratio, DefaultStorageOptions())
+}
 
-	file, err := nvm.CreateIfAbsent(path, capacity)
+/*
+CreateCannylsStorageWithOptions creates the storage, and opens it with the options.
+The block size is chosen by options.File.BlockSize and saved in the header, such as 4096 for
+the drives preferring 4K writes, the capacity must be aligned to it
+*/
+func CreateCannylsStorageWithOptions(path string, capacity uint64, journal_ratio float64, options StorageOptions) (*Storage, error) {
+
+	file, err := nvm.CreateIfAbsentWithOptions(path, capacity, options.File)
 	if err != nil {
 		return nil, err
 	}
 
-	headBuf := new(bytes.Buffer)
-	header := makeHeader(file, journal_ratio)
+	if _, err = initializeNVM(file, journal_ratio); err != nil {
+		file.Close()
+		return nil, err
+	}
+	file.Close()
+
+	return OpenCannylsStorageWithOptions(path, options)
+}
 
-	if err = header.WriteHeaderRegionTo(headBuf); err != nil {
+//CreateCannylsStorageOnNVM formats the NonVolatileMemory, such as nvm.StripedNVM, and opens the storage on it
+func CreateCannylsStorageOnNVM(file nvm.NonVolatileMemory, journal_ratio float64) (*Storage, error) {
+	header, err := initializeNVM(file, journal_ratio)
+	if err != nil {
 		return nil, err
 	}
+	return OpenCannylsStorageOnNVM(file, &header, DefaultStorageOptions())
+}
+
+//initializeNVM writes the storage header and an empty journal region
+func initializeNVM(file nvm.NonVolatileMemory, journal_ratio float64) (nvm.StorageHeader, error) {
+	header := makeHeader(file, journal_ratio)
+	return header, formatNVM(file, &header)
+}
+
+//formatNVM writes the header and an empty journal region at the start of the NonVolatileMemory
+func formatNVM(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error {
+	headBuf := new(bytes.Buffer)
+	if err := header.WriteHeaderRegionTo(headBuf); err != nil {
+		return err
+	}
 	//now headBuf's len should be at least 512
 
 	journal.InitialJournalRegion(headBuf, file.BlockSize())
@@ -118,12 +434,7 @@ func CreateCannylsStorage(path string, capacity uint64, journal_ratio float64) (
 	alignedBufHead.Align()
 	file.Write(alignedBufHead.AsBytes())
 
-	if err = file.Sync(); err != nil {
-		return nil, err
-	}
-	file.Close()
-
-	return OpenCannylsStorage(path)
+	return file.Sync()
 }
 
 func makeHeader(file nvm.NonVolatileMemory, journal_ratio float64) nvm.StorageHeader {
@@ -133,7 +444,8 @@ func makeHeader(file nvm.NonVolatileMemory, journal_ratio float64) nvm.StorageHe
 	headerSize := file.BlockSize().CeilAlign(uint64(nvm.FULL_HEADER_SIZE))
 
 	//check capacity
-	if totalSize < headerSize+uint64(file.BlockSize().AsU16()*3) {
+	blockSize := uint64(file.BlockSize().AsU16())
+	if totalSize < headerSize+blockSize*3 {
 		panic("file size is too small")
 	}
 
@@ -144,8 +456,8 @@ func makeHeader(file nvm.NonVolatileMemory, journal_ratio float64) nvm.StorageHe
 		panic("journal size is too big")
 	}
 
-	if journalSize < uint64(file.BlockSize().AsU16()*2) {
-		journalSize = uint64(file.BlockSize().AsU16() * 2)
+	if journalSize < blockSize*2 {
+		journalSize = blockSize * 2
 	}
 
 	dataSize := totalSize - journalSize - headerSize
@@ -154,8 +466,8 @@ func makeHeader(file nvm.NonVolatileMemory, journal_ratio float64) nvm.StorageHe
 		panic(fmt.Sprintf("data size is too big: %d", dataSize))
 	}
 
-	if dataSize < uint64(file.BlockSize().AsU16()) {
-		dataSize = uint64(file.BlockSize().AsU16())
+	if dataSize < blockSize {
+		dataSize = blockSize
 	}
 
 	header := nvm.DefaultStorageHeader()
@@ -169,16 +481,159 @@ func (store *Storage) Header() nvm.StorageHeader {
 	return *store.storageHeader
 }
 
-func (store *Storage) SetAutomaticGcMode(gc bool) {
+func (store *Storage) SetAutomaticGcMode(gc bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
 	store.journalRegion.SetAutomaticGcMode(gc)
+	return nil
+}
+
+func (store *Storage) JournalRegionOptions() (options journal.JournalRegionOptions) {
+	store.view(func() {
+		options = store.journalRegion.Options()
+	})
+	return
+}
+
+func (store *Storage) SetJournalGcBatchSize(size int) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	return store.journalRegion.SetGcBatchSize(size)
+}
+
+func (store *Storage) SetJournalGcTriggerRatio(ratio float64) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	return store.journalRegion.SetGcTriggerRatio(ratio)
+}
+
+func (store *Storage) SetJournalSyncInterval(interval int) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	return store.journalRegion.SetSyncInterval(interval)
+}
+
+//SetJournalThrottle throttles the puts and deletes when the journal is nearly full, see JournalRegion.SetThrottle
+func (store *Storage) SetJournalThrottle(highWatermark float64, failFast bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	return store.journalRegion.SetThrottle(highWatermark, failFast)
+}
+
+//SetJournalGcPacing paces the gc after append to keep the free ratio of the journal, see JournalRegion.SetGcPacing
+func (store *Storage) SetJournalGcPacing(targetFreeRatio float64) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	return store.journalRegion.SetGcPacing(targetFreeRatio)
+}
+
+//SetPunchHoles makes the released data portions deallocated in the file, after the journal
+//records releasing them are synced, see DataRegion.PunchReleased
+func (store *Storage) SetPunchHoles(punch bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.dataRegion.SetPunchHoles(punch, store.journalRegion.Syncs)
+	return nil
+}
+
+/*
+SetPanicFree makes Get, GetPooled, GetReader and the other reads of the data region return a
+CorruptLumpError instead of panicking on a broken portion, see DataRegion.SetPanicFree
+*/
+func (store *Storage) SetPanicFree(enable bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.dataRegion.SetPanicFree(enable)
+	return nil
+}
+
+/*
+SetOverwriteInPlace makes Put overwrite the lump data in the portion of the old lump data if the
+new data fits in it, and the lump has no TTL, metadata, tag or content hash, see SetDedup. The portion is not shrunk. Only a small
+OverwriteRecord is journaled, instead of allocating a portion and releasing the old one.
+The overwrite is not atomic: if it crashes during the write, the lump could be torn, which is
+found by VerifyLumps if SetDataChecksum is enabled.
+*/
+func (store *Storage) SetOverwriteInPlace(overwrite bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.overwriteInPlace = overwrite
+	return nil
+}
+
+//CacheStats returns the hits and misses of the read cache, see StorageOptions.CacheSize
+func (store *Storage) CacheStats() (stats CacheStats) {
+	store.view(func() {
+		stats = store.dataRegion.CacheStats()
+	})
+	return
+}
+
+//SetDataChecksum makes the following Puts append a CRC32C of lump data on disk
+func (store *Storage) SetDataChecksum(checksum bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.dataRegion.SetChecksum(checksum)
+	return nil
 }
 
-func (store *Storage) List() []lump.LumpId {
-	return store.index.List()
+//SetCompression compresses the lump data of the following Puts with codec
+func (store *Storage) SetCompression(codec CompressionCodec) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	return store.dataRegion.SetCompression(codec)
+}
+
+//List returns the lumpids ordered by lumpid, the expired lumps are skipped
+func (store *Storage) List() (ids []lump.LumpId) {
+	store.view(func() {
+		ids = store.index.ListLive(store.unixNow())
+	})
+	return
+}
+
+//BloomStats returns the statistics of the bloom filter of the index, ok is false if it is disabled
+func (store *Storage) BloomStats() (stats lumpindex.BloomStats, ok bool) {
+	store.view(func() {
+		stats, ok = store.index.BloomStats()
+	})
+	return
+}
+
+/*
+DumpFreeList returns the free portions of the data region sorted by the offset, and the capacity
+of the data region in blocks, see allocator.OccupancyHistogram to render them
+*/
+func (store *Storage) DumpFreeList() (extents []allocator.FreeExtent, capacityInBlocks uint64, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	extents, err = allocator.DumpFreeList(store.alloc)
+	if err != nil {
+		return nil, 0, err
+	}
+	return extents, store.Header().DataRegionSize / uint64(store.Header().BlockSize.AsU16()), nil
 }
 
-func (store *Storage) Usage() StorageUsage {
+func (store *Storage) Usage() (usage StorageUsage) {
+	store.view(func() {
+		usage = store.usage()
+	})
+	return
+}
 
+func (store *Storage) usage() StorageUsage {
 	var min, max int64
 
 	if id, have := store.index.Min(); have {
@@ -193,27 +648,53 @@ func (store *Storage) Usage() StorageUsage {
 		max = -1
 	}
 
+	blockSize := uint64(store.Header().BlockSize.AsU16())
+	free := store.alloc.FreeCount() * blockSize
+	largest := store.alloc.LargestFree() * blockSize
+	var fragmentation float64
+	if free > 0 {
+		fragmentation = 1 - float64(largest)/float64(free)
+	}
+
 	return StorageUsage{
-		JournalCapacity: store.Header().JournalRegionSize,
-		DataCapacity:    store.Header().DataRegionSize,
-		FileCounts:      store.index.Count(),
-		MinIndex:        min,
-		MaxIndex:        max,
-		FreeBytes:       store.alloc.FreeCount() * uint64(store.Header().BlockSize.AsU16()),
-		CurrentFileSize: uint64(store.innerNVM.RawSize()),
+		JournalCapacity:  store.Header().JournalRegionSize,
+		DataCapacity:     store.Header().DataRegionSize,
+		FileCounts:       store.index.Count(),
+		MinIndex:         min,
+		MaxIndex:         max,
+		FreeBytes:        free,
+		CurrentFileSize:  uint64(store.innerNVM.RawSize()),
+		AllocatedBytes:   store.Header().DataRegionSize - free,
+		LargestFreeBytes: largest,
+		Fragmentation:    fragmentation,
+		JournalUsage:     store.journalRegion.Usage(),
+		EmbeddedBytes:    store.index.EmbeddedBytes(),
 	}
 }
 
-func (store *Storage) MinId() (lump.LumpId, bool) {
-	return store.index.Min()
+func (store *Storage) MinId() (id lump.LumpId, have bool) {
+	store.view(func() {
+		id, have = store.index.Min()
+	})
+	return
 }
 
-func (store *Storage) MaxId() (lump.LumpId, bool) {
-	return store.index.Max()
+func (store *Storage) MaxId() (id lump.LumpId, have bool) {
+	store.view(func() {
+		id, have = store.index.Max()
+	})
+	return
 }
 
 func (store *Storage) GenerateEmptyId() (id lump.LumpId, have bool) {
-	id, have = store.MaxId()
+	store.view(func() {
+		id, have = store.generateEmptyId()
+	})
+	return
+}
+
+func (store *Storage) generateEmptyId() (id lump.LumpId, have bool) {
+	id, have = store.index.Max()
 	if have == false {
 		//the store is empty, use 0 as the first id
 		id = lump.FromU64(0, 0)
@@ -231,8 +712,24 @@ func (store *Storage) GenerateEmptyId() (id lump.LumpId, have bool) {
 	}
 }
 
-func (store *Storage) JournalGC() {
+//SetJournalGcYield sets f which is called between the steps of the journal gc, see JournalRegion.SetGcYield
+func (store *Storage) SetJournalGcYield(f func()) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.journalRegion.SetGcYield(f)
+	return nil
+}
+
+func (store *Storage) JournalGC() error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	if store.readOnly {
+		return nil
+	}
 	store.journalRegion.GcAllEntries(store.index)
+	return nil
 }
 
 type JournalSnapshot struct {
@@ -242,7 +739,14 @@ type JournalSnapshot struct {
 	Entries        []journal.JournalEntry
 }
 
-func (store *Storage) JournalSnapshot() JournalSnapshot {
+func (store *Storage) JournalSnapshot() (snapshot JournalSnapshot) {
+	store.view(func() {
+		snapshot = store.journalSnapshot()
+	})
+	return
+}
+
+func (store *Storage) journalSnapshot() JournalSnapshot {
 	unreleasedhead, head, tail, entries := store.journalRegion.JournalEntries()
 	return JournalSnapshot{
 		UnreleasedHead: unreleasedhead,
@@ -252,45 +756,418 @@ func (store *Storage) JournalSnapshot() JournalSnapshot {
 	}
 }
 
-func (store *Storage) ListRange(start, end lump.LumpId) []lump.LumpId {
-	return store.index.ListRange(start, end)
+//JournalCursor returns the current end of journal, which is used by ReadJournalSince.
+//It starts tailing, the journal keeps the records which are not shipped until StopJournalTailing
+func (store *Storage) JournalCursor() (journal.JournalCursor, error) {
+	if err := store.checkOpen(); err != nil {
+		return journal.JournalCursor{}, err
+	}
+	return store.journalRegion.Cursor(), nil
+}
+
+func (store *Storage) StopJournalTailing() error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.journalRegion.StopTailing()
+	return nil
+}
+
+/*
+ReadJournalSince returns at most max journal entries after cursor and the next cursor,
+an agent could ship them to a replica. The data of PutRecord is in the data region,
+read it with Get before the lump is changed again.
+*/
+func (store *Storage) ReadJournalSince(cursor journal.JournalCursor, max int) ([]journal.JournalEntry, journal.JournalCursor, error) {
+	if err := store.checkOpen(); err != nil {
+		return nil, cursor, err
+	}
+	return store.journalRegion.ReadSince(cursor, max)
+}
+
+/*
+ListRange returns at most limit lumpids in [start, end) ordered by lumpid, limit <= 0 means no limit.
+The expired lumps are skipped, though they are in the index until they are reaped.
+To page through the index, call it again with the last returned lumpid.Inc() as start
+*/
+func (store *Storage) ListRange(start, end lump.LumpId, limit int) (ids []lump.LumpId) {
+	store.view(func() {
+		ids = store.index.ListRangeLive(start, end, limit, store.unixNow())
+	})
+	return
+}
+
+//ListPrefix returns at most limit lumpids, whose high bits are the same as prefix
+func (store *Storage) ListPrefix(prefix lump.LumpId, bits uint, limit int) (ids []lump.LumpId) {
+	store.view(func() {
+		ids = store.index.ListPrefixLive(prefix, bits, limit, store.unixNow())
+	})
+	return
+}
+
+func (store *Storage) Get(lumpid lump.LumpId) (data []byte, err error) {
+	defer store.observe(OP_GET, time.Now(), &err)
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	if store.isExpired(lumpid) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "lump %s is expired", lumpid.String())
+	}
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return nil, err
+	}
+	switch v := p.(type) {
+	case portion.DataPortion:
+		return store.getData(lumpid, v)
+	case portion.JournalPortion:
+		data, err := store.getEmbedded(lumpid, v)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, data...), nil
+	default:
+		panic("never here")
+	}
+}
+
+/*
+getLater is Get for the readers of AsyncStorage: the lump is looked up now, and the returned read
+gets its data. The read of a lump in the data region only reads the data region, so it could run
+out of the worker in parallel with the other reads, but not with the writes.
+*/
+func (store *Storage) getLater(lumpid lump.LumpId) func() ([]byte, error) {
+	start := time.Now()
+	if err := store.checkOpen(); err == nil && !store.isExpired(lumpid) {
+		if p, err := store.index.Get(lumpid); err == nil {
+			if v, ok := p.(portion.DataPortion); ok {
+				read := store.dataReader(lumpid, v)
+				return func() (data []byte, err error) {
+					defer store.observe(OP_GET, start, &err)
+					return read()
+				}
+			}
+		}
+	}
+	//the errors and the embedded lumps are done now
+	data, err := store.Get(lumpid)
+	return func() ([]byte, error) {
+		return data, err
+	}
 }
 
-func (store *Storage) Get(lumpid lump.LumpId) ([]byte, error) {
+//GetPooled is the same as Get, but the lump data is returned in a PooledBuffer to save the allocation,
+//the caller must call Release after the data is used
+func (store *Storage) GetPooled(lumpid lump.LumpId) (buf *PooledBuffer, err error) {
+	defer store.observe(OP_GET, time.Now(), &err)
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	if store.isExpired(lumpid) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "lump %s is expired", lumpid.String())
+	}
 	p, err := store.index.Get(lumpid)
 	if err != nil {
 		return nil, err
 	}
 	switch v := p.(type) {
 	case portion.DataPortion:
-		lumpdata, err := store.dataRegion.Get(v)
+		if extents, ok := store.index.Extents(lumpid); ok {
+			buf, err = store.dataRegion.GetPooledExtents(extents)
+		} else {
+			buf, err = store.dataRegion.GetPooled(v)
+		}
+		if err != nil {
+			return nil, corruptLump(lumpid, v, err)
+		}
+		return buf, nil
+	case portion.JournalPortion:
+		data, err := store.getEmbedded(lumpid, v)
 		if err != nil {
 			return nil, err
 		}
-		return lumpdata.AsBytes(), nil
+		buf = newPooledBuffer(uint32(len(data)), store.dataRegion.block_size)
+		copy(buf.AsBytes(), data)
+		return buf, nil
+	default:
+		panic("never here")
+	}
+}
+
+type LumpStat struct {
+	//the size of lump data
+	Size uint32
+	//the size on disk, the data portion is aligned to blocks
+	SizeOnDisk uint32
+	//Embedded is true if the lump is stored in the journal region
+	Embedded bool
+	//the block offset in the data region, or the byte offset in the journal region if Embedded,
+	//it is the offset of the first extent if the lump is stored in several portions
+	Offset uint64
+}
+
+//Stat returns the size and the location of the lump without reading the lump data.
+//For a lump in the data region, only the last block is read to find the size.
+func (store *Storage) Stat(lumpid lump.LumpId) (stat LumpStat, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	if store.isExpired(lumpid) {
+		return stat, errors.Wrapf(internalerror.InvalidInput, "lump %s is expired", lumpid.String())
+	}
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return stat, err
+	}
+	return store.statPortion(lumpid, p)
+}
+
+func (store *Storage) statPortion(lumpid lump.LumpId, p portion.Portion) (stat LumpStat, err error) {
+	stat.SizeOnDisk = p.SizeOnDisk(store.dataRegion.block_size)
+	switch v := p.(type) {
+	case portion.DataPortion:
+		stat.Offset = v.Start.AsU64()
+		if extents, ok := store.index.Extents(lumpid); ok {
+			stat.SizeOnDisk = 0
+			for _, extent := range extents {
+				size, err := store.dataRegion.Size(extent)
+				if err != nil {
+					return stat, err
+				}
+				stat.Size += size
+				stat.SizeOnDisk += extent.SizeOnDisk(store.dataRegion.block_size)
+			}
+			return stat, nil
+		}
+		stat.Size, err = store.dataRegion.Size(v)
 	case portion.JournalPortion:
-		data, err := store.journalRegion.GetEmbededData(v)
+		stat.Embedded = true
+		stat.Offset = v.Start.AsU64()
+		stat.Size = uint32(v.Len)
+	default:
+		panic("never here")
+	}
+	return
+}
+
+//GetReader returns a reader over the lump, the data portion is read lazily.
+//The reader must not be used after the storage is modified or closed.
+func (store *Storage) GetReader(lumpid lump.LumpId) (io.ReadCloser, error) {
+	if err := store.checkOpen(); err != nil {
+		return nil, err
+	}
+	if store.isExpired(lumpid) {
+		return nil, errors.Wrapf(internalerror.InvalidInput, "lump %s is expired", lumpid.String())
+	}
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return nil, err
+	}
+	switch v := p.(type) {
+	case portion.DataPortion:
+		if extents, ok := store.index.Extents(lumpid); ok {
+			return store.dataRegion.GetExtentsReader(extents), nil
+		}
+		reader, err := store.dataRegion.GetReader(v)
+		if err != nil {
+			return nil, corruptLump(lumpid, v, err)
+		}
+		return reader, nil
+	case portion.JournalPortion:
+		data, err := store.getEmbedded(lumpid, v)
 		if err != nil {
 			return nil, err
 		}
-		return data, nil
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
 	default:
 		panic("never here")
 	}
 }
 
+/*
+GetMulti returns the lump data of ids in the same order, the data of a missing or expired lump is
+nil. The data portions are read in the order of their offsets, and the adjacent ones are read at
+once, see DataRegion.GetMulti. err is not nil if any lump could not be read.
+*/
+func (store *Storage) GetMulti(ids []lump.LumpId) (data [][]byte, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	defer store.observe(OP_GET, time.Now(), &err)
+	data = make([][]byte, len(ids))
+	var portions []portion.DataPortion
+	var positions []int
+	for i, id := range ids {
+		if store.isExpired(id) {
+			continue
+		}
+		p, err := store.index.Get(id)
+		if err != nil {
+			continue
+		}
+		switch v := p.(type) {
+		case portion.DataPortion:
+			//the extents are read one by one
+			if extents, ok := store.index.Extents(id); ok {
+				lumpdata, err := store.dataRegion.GetExtents(extents)
+				if err != nil {
+					return nil, err
+				}
+				data[i] = lumpdata.AsBytes()
+				continue
+			}
+			portions = append(portions, v)
+			positions = append(positions, i)
+		case portion.JournalPortion:
+			if data[i], err = store.getEmbedded(id, v); err != nil {
+				return nil, err
+			}
+		default:
+			panic("never here")
+		}
+	}
+	lumps, err := store.dataRegion.GetMulti(portions)
+	if err != nil {
+		return nil, err
+	}
+	for i, lumpData := range lumps {
+		data[positions[i]] = lumpData
+	}
+	return data, nil
+}
+
+/*
+Prefetch hints that the lumps would be read soon, the missing or expired lumps are ignored. The lump
+data is read into the block cache if it is enabled, otherwise the data region is read ahead by
+posix_fadvise(WILLNEED) if it is not opened with direct I/O. The embedded lumps are read into the
+embed cache if it is enabled.
+*/
+func (store *Storage) Prefetch(ids []lump.LumpId) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	var portions []portion.DataPortion
+	for _, id := range ids {
+		if store.isExpired(id) {
+			continue
+		}
+		p, err := store.index.Get(id)
+		if err != nil {
+			continue
+		}
+		switch v := p.(type) {
+		case portion.DataPortion:
+			portions = append(portions, store.extentsOf(id, v)...)
+		case portion.JournalPortion:
+			if store.embedCache != nil {
+				if _, err := store.getEmbedded(id, v); err != nil {
+					return err
+				}
+			}
+		default:
+			panic("never here")
+		}
+	}
+	return store.dataRegion.Prefetch(portions)
+}
+
 func (store *Storage) Put(lumpid lump.LumpId, lumpdata lump.LumpData) (updated bool, err error) {
+	return store.PutWithOptions(lumpid, lumpdata, DefaultPutOptions())
+}
+
+//PutWithOptions is the same as Put, options.SyncJournal false allows the put to be lost on crash
+func (store *Storage) PutWithOptions(lumpid lump.LumpId, lumpdata lump.LumpData, options PutOptions) (updated bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	defer store.observe(OP_PUT, time.Now(), &err)
+	var timing PutTiming
+	defer store.tracePut(lumpid, len(lumpdata.AsBytes()), &timing, &err)()
+	if store.shouldEmbed(uint64(len(lumpdata.AsBytes()))) {
+		return store.putEmbed(lumpid, lumpdata.AsBytes(), &timing, options)
+	}
+	if !store.dataRegion.FitsPortion(uint64(len(lumpdata.AsBytes()))) {
+		return store.putExtents(lumpid, lumpdata, &timing, options)
+	}
+	if store.dedup {
+		return store.putDedup(lumpid, lumpdata, &timing, options)
+	}
 
 	err = nil
+	if store.overwriteInPlace {
+		if updated, err = store.overwrite(lumpid, lumpdata, &timing, options); updated || err != nil {
+			return
+		}
+	}
+	return store.putData(lumpid, lumpdata, 0, &timing, options)
+}
+
+/*
+PutWithCapacity is the same as Put, but at least reserve bytes are allocated after the lump data,
+so Update could overwrite the lump by a bigger one in place, until the reserved space is used up.
+The lump is never embedded.
+*/
+func (store *Storage) PutWithCapacity(lumpid lump.LumpId, lumpdata lump.LumpData, reserve uint32) (updated bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	defer store.observe(OP_PUT, time.Now(), &err)
+	var timing PutTiming
+	defer store.tracePut(lumpid, len(lumpdata.AsBytes()), &timing, &err)()
+	return store.putData(lumpid, lumpdata, reserve, &timing, DefaultPutOptions())
+}
+
+/*
+Update overwrites the lump in place if the new lump data fits in its data portion, such as the
+portion allocated by PutWithCapacity, as SetOverwriteInPlace does for Put. Otherwise it is the
+same as Put, and the lump is moved to a new portion.
+*/
+func (store *Storage) Update(lumpid lump.LumpId, lumpdata lump.LumpData) (updated bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	defer store.observe(OP_PUT, time.Now(), &err)
+	var timing PutTiming
+	defer store.tracePut(lumpid, len(lumpdata.AsBytes()), &timing, &err)()
+	if updated, err = store.overwrite(lumpid, lumpdata, &timing, DefaultPutOptions()); updated || err != nil {
+		return
+	}
+	if store.shouldEmbed(uint64(len(lumpdata.AsBytes()))) {
+		return store.putEmbed(lumpid, lumpdata.AsBytes(), &timing, DefaultPutOptions())
+	}
+	if !store.dataRegion.FitsPortion(uint64(len(lumpdata.AsBytes()))) {
+		return store.putExtents(lumpid, lumpdata, &timing, DefaultPutOptions())
+	}
+	if store.dedup {
+		return store.putDedup(lumpid, lumpdata, &timing, DefaultPutOptions())
+	}
+	return store.putData(lumpid, lumpdata, 0, &timing, DefaultPutOptions())
+}
+
+//putData puts the lump into a new data portion with reserve more bytes, and releases the old one
+func (store *Storage) putData(lumpid lump.LumpId, lumpdata lump.LumpData, reserve uint32, timing *PutTiming,
+	options PutOptions) (updated bool, err error) {
+	if err = store.checkQuota(lumpid, store.dataRegion.EstimateSize(uint64(len(lumpdata.AsBytes())), reserve)); err != nil {
+		return
+	}
 	if updated, err = store.deleteIfExist(lumpid, false); err != nil {
 		return updated, err
 	}
 
-	dataPortion, err := store.dataRegion.Put(lumpdata)
+	start := time.Now()
+	dataPortion, err := store.dataRegion.PutWithCapacity(lumpdata, reserve)
+	timing.DataWrite = time.Since(start)
 	if err != nil {
 		return
 	}
-	if err = store.journalRegion.RecordPut(store.index, lumpid, dataPortion); err != nil {
+	start = time.Now()
+	if options.SyncJournal {
+		err = store.journalRegion.RecordPut(store.index, lumpid, dataPortion)
+	} else {
+		err = store.journalRegion.RecordPutRelaxed(store.index, lumpid, dataPortion)
+	}
+	timing.JournalAppend = time.Since(start)
+	if err != nil {
 		//revert the dataPortion
 		store.dataRegion.Release(dataPortion)
 		return
@@ -300,19 +1177,256 @@ func (store *Storage) Put(lumpid lump.LumpId, lumpdata lump.LumpData) (updated b
 	return
 }
 
+//overwrite writes the lump data in place of the old lump data, ok is false if it could not
+func (store *Storage) overwrite(lumpid lump.LumpId, lumpdata lump.LumpData, timing *PutTiming, options PutOptions) (ok bool, err error) {
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return false, nil
+	}
+	old, isDataPortion := p.(portion.DataPortion)
+	if !isDataPortion {
+		return false, nil
+	}
+	//the index is not changed by the overwrite, so the TTL, the metadata and the tag would be kept
+	if _, ok = store.index.ExpireAt(lumpid); ok {
+		return false, nil
+	}
+	if _, ok = store.index.Metadata(lumpid); ok {
+		return false, nil
+	}
+	if _, ok = store.index.Tag(lumpid); ok {
+		return false, nil
+	}
+	//the portion may be shared by the lumps with the same data
+	if _, ok = store.index.ContentHash(lumpid); ok {
+		return false, nil
+	}
+	//only the first extent would be overwritten
+	if _, ok = store.index.Extents(lumpid); ok {
+		return false, nil
+	}
+
+	start := time.Now()
+	ok, err = store.dataRegion.Overwrite(old, lumpdata)
+	timing.DataWrite = time.Since(start)
+	if !ok || err != nil {
+		return false, err
+	}
+	start = time.Now()
+	err = store.journalRegion.RecordOverwrite(store.index, lumpid, old, options.SyncJournal)
+	timing.JournalAppend = time.Since(start)
+	return err == nil, err
+}
+
+//PutReader is the same as Put, but the lump data is streamed from reader, a lump which does not
+//fit in a portion is streamed into extents. The old lump is kept if the lump data could not be read
+func (store *Storage) PutReader(lumpid lump.LumpId, reader io.Reader, size uint64) (updated bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	var timing PutTiming
+	defer store.tracePut(lumpid, int(size), &timing, &err)()
+	if store.shouldEmbed(size) {
+		data := make([]byte, size)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return false, err
+		}
+		return store.putEmbed(lumpid, data, &timing, DefaultPutOptions())
+	}
+
+	if err = store.checkQuota(lumpid, store.dataRegion.EstimateSize(size, 0)); err != nil {
+		return
+	}
+	start := time.Now()
+	extents, err := store.dataRegion.PutReaderExtents(reader, size)
+	timing.DataWrite = time.Since(start)
+	if err != nil {
+		return
+	}
+	//the old lump is deleted after the new data is written
+	if updated, err = store.deleteIfExist(lumpid, false); err != nil {
+		store.releasePortions(extents)
+		return
+	}
+
+	start = time.Now()
+	if len(extents) == 1 {
+		err = store.journalRegion.RecordPut(store.index, lumpid, extents[0])
+	} else {
+		//the index is updated by journal
+		err = store.journalRegion.RecordPutExtents(store.index, lumpid, extents, true)
+	}
+	timing.JournalAppend = time.Since(start)
+	if err != nil {
+		//revert the extents
+		for _, p := range extents {
+			store.dataRegion.Release(p)
+		}
+		return
+	}
+	if len(extents) == 1 {
+		store.index.InsertDataPortion(lumpid, extents[0])
+	}
+	return
+}
+
+//PutBatch writes all the lumps into data region, and commits them with one journal entry.
+//If any of them fails, none of the lumps is stored.
+func (store *Storage) PutBatch(lumpids []lump.LumpId, lumpdatas []lump.LumpData) (err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	if len(lumpids) != len(lumpdatas) || len(lumpids) == 0 || len(lumpids) > journal.MAX_PUT_BATCH_COUNT {
+		return errors.Wrap(internalerror.InvalidInput, "lumpids and lumpdatas do not match")
+	}
+
+	//the same lump can not be put twice in one batch, the first portion would leak
+	seen := make(map[lump.LumpId]bool, len(lumpids))
+	for _, id := range lumpids {
+		if seen[id] {
+			return errors.Wrapf(internalerror.InvalidInput, "duplicated lumpid %s in batch", id.String())
+		}
+		seen[id] = true
+	}
+	sizes := make([]uint64, len(lumpdatas))
+	for i, data := range lumpdatas {
+		sizes[i] = store.dataRegion.EstimateSize(uint64(len(data.AsBytes())), 0)
+	}
+	if err = store.checkQuotas(lumpids, sizes); err != nil {
+		return
+	}
+
+	dataPortions := make([]portion.DataPortion, 0, len(lumpids))
+	releaseAll := func() {
+		for _, p := range dataPortions {
+			store.dataRegion.Release(p)
+		}
+	}
+
+	for _, data := range lumpdatas {
+		var p portion.DataPortion
+		if p, err = store.dataRegion.Put(data); err != nil {
+			releaseAll()
+			return
+		}
+		dataPortions = append(dataPortions, p)
+	}
+
+	//remember the old portions, they will be released after the batch is committed
+	oldPortions := make([]portion.DataPortion, 0)
+	for _, id := range lumpids {
+		if p, err := store.index.Get(id); err == nil {
+			if v, ok := p.(portion.DataPortion); ok {
+				oldPortions = append(oldPortions, store.extentsOf(id, v)...)
+			}
+		}
+	}
+
+	//RecordPutBatch updates the index
+	if err = store.journalRegion.RecordPutBatch(store.index, lumpids, dataPortions); err != nil {
+		releaseAll()
+		return
+	}
+
+	store.releasePortions(oldPortions)
+	return nil
+}
+
 func (store *Storage) PutEmbed(lumpid lump.LumpId, data []byte) (updated bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	defer store.observe(OP_PUT_EMBED, time.Now(), &err)
+	var timing PutTiming
+	defer store.tracePut(lumpid, len(data), &timing, &err)()
+	return store.putEmbed(lumpid, data, &timing, DefaultPutOptions())
+}
+
+func (store *Storage) putEmbed(lumpid lump.LumpId, data []byte, timing *PutTiming, options PutOptions) (updated bool, err error) {
+	if err = store.checkQuota(lumpid, uint64(len(data))); err != nil {
+		return
+	}
 	if updated, err = store.deleteIfExist(lumpid, false); err != nil {
 		return
 	}
-	err = store.journalRegion.RecordEmbed(store.index, lumpid, data)
+	start := time.Now()
+	if options.SyncJournal {
+		err = store.journalRegion.RecordEmbed(store.index, lumpid, data)
+	} else {
+		err = store.journalRegion.RecordEmbedRelaxed(store.index, lumpid, data)
+	}
+	timing.JournalAppend = time.Since(start)
+	if err == nil {
+		store.cacheEmbedded(lumpid, data)
+	}
 	return
 }
 
 func (store *Storage) Delete(lumpid lump.LumpId) (updated bool, err error) {
+	defer store.observe(OP_DELETE, time.Now(), &err)
+	if err = store.checkWritable(); err != nil {
+		return
+	}
 	updated, err = store.deleteIfExist(lumpid, true)
 	return
 }
 
+/*
+DeleteAndStat deletes the lump as Delete, and returns the size and the location of the released
+portion as Stat, so the caller does not need a Stat before the Delete. The stat is zero if the
+lump does not exist. An expired lump is deleted and its stat is returned too.
+*/
+func (store *Storage) DeleteAndStat(lumpid lump.LumpId) (stat LumpStat, deleted bool, err error) {
+	defer store.observe(OP_DELETE, time.Now(), &err)
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	p, err := store.index.Get(lumpid)
+	if err != nil {
+		return stat, false, nil
+	}
+	//the size of a data portion is read before it is released
+	if stat, err = store.statPortion(lumpid, p); err != nil {
+		return LumpStat{}, false, err
+	}
+	deleted, err = store.deleteIfExist(lumpid, true)
+	return
+}
+
+//DeleteRange deletes all the lumps in [start, end), It is journaled as one DeleteRange record.
+//It returns the deleted lumpids
+func (store *Storage) DeleteRange(start, end lump.LumpId) (deleted []lump.LumpId, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	deleted = store.index.ListRange(start, end)
+	if len(deleted) == 0 {
+		return
+	}
+
+	dataPortions := make([]portion.DataPortion, 0, len(deleted))
+	for _, id := range deleted {
+		p, err := store.index.Get(id)
+		if err != nil {
+			panic("Get after ListRange failed, something bad happend")
+		}
+		if v, ok := p.(portion.DataPortion); ok {
+			dataPortions = append(dataPortions, store.extentsOf(id, v)...)
+		}
+	}
+
+	if err = store.journalRegion.RecordDeleteRange(store.index, start, end); err != nil {
+		return nil, err
+	}
+
+	store.index.DeleteRange(start, end)
+	for _, id := range deleted {
+		store.uncacheEmbedded(id)
+	}
+	store.releasePortions(dataPortions)
+	return
+}
+
 func (store *Storage) deleteIfExist(lumpid lump.LumpId, doRecord bool) (bool, error) {
 	p, err := store.index.Get(lumpid)
 
@@ -320,6 +1434,16 @@ func (store *Storage) deleteIfExist(lumpid lump.LumpId, doRecord bool) (bool, er
 	if err != nil {
 		return false, nil
 	}
+	//the lump is removed from the index before the record of the put or the delete is appended,
+	//which must not be rejected then
+	if err = store.journalRegion.Admit(); err != nil {
+		return false, err
+	}
+	//the extents are removed from the index with the lump
+	var extents []portion.DataPortion
+	if v, ok := p.(portion.DataPortion); ok {
+		extents = store.extentsOf(lumpid, v)
+	}
 
 	//Becase previous Get is ok, this Delete will surely success
 	if ok := store.index.Delete(lumpid); ok == false {
@@ -327,11 +1451,16 @@ func (store *Storage) deleteIfExist(lumpid lump.LumpId, doRecord bool) (bool, er
 	}
 
 	if doRecord {
-		store.journalRegion.RecordDelete(store.index, lumpid)
+		//the portions are kept, the lump is restored from the journal after reopen
+		if err = store.journalRegion.RecordDelete(store.index, lumpid); err != nil {
+			return false, err
+		}
 	}
-	switch v := p.(type) {
+	switch p.(type) {
 	case portion.DataPortion:
-		store.dataRegion.Release(v)
+		store.releasePortions(extents)
+	case portion.JournalPortion:
+		store.uncacheEmbedded(lumpid)
 	}
 
 	/*
@@ -347,15 +1476,309 @@ func (store *Storage) deleteIfExist(lumpid lump.LumpId, doRecord bool) (bool, er
 	return true, nil
 }
 
-func (store *Storage) JournalSync() {
-	store.journalRegion.Sync()
+//SetAutomaticCompactionMode makes RunSideJobOnce compact the data region
+func (store *Storage) SetAutomaticCompactionMode(compaction bool) error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	store.automaticCompaction = compaction
+	return nil
+}
+
+//CompactDataRegion moves at most maxMoves lumps from the end of data region
+//to the free space in front of them, so the free space is merged into bigger portions.
+//Every move is journaled as a Put record of the new portion, and the old portions are released
+//after the moved data and the records are synced.
+//It returns the number of moved lumps
+func (store *Storage) CompactDataRegion(maxMoves int) (moved int, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	return store.compactDataRegion(maxMoves, false)
+}
+
+/*
+compactionPass is the lumps to move ordered from the end of the data region, the compaction
+of RunSideJobOnce moves a few of them each time, so the index is not sorted in every side job.
+The lumps changed after the pass is started are skipped. A new pass is started after the last one
+is done, if it moved any lump or the free space is changed since it was started.
+*/
+type compactionPass struct {
+	lumps []lumpindex.LumpDataPortion
+	next  int
+	moved int
+	free  uint64
+}
+
+func (store *Storage) startCompactionPass() {
+	lumps := store.lumpsByPortion()
+	//move the last portions first
+	sort.Slice(lumps, func(i, j int) bool {
+		return lumps[i].Portion.Start > lumps[j].Portion.Start
+	})
+	store.compaction = compactionPass{lumps: lumps, free: store.alloc.FreeCount()}
+}
+
+//compactDataRegion continues the pass and stops when the background bandwidth is used up if
+//throttled is true, or starts a new pass otherwise
+func (store *Storage) compactDataRegion(maxMoves int, throttled bool) (moved int, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	pass := &store.compaction
+	if !throttled {
+		store.startCompactionPass()
+	} else if pass.next >= len(pass.lumps) && (pass.moved > 0 || pass.free != store.alloc.FreeCount()) {
+		store.startCompactionPass()
+	}
+
+	var released []portion.DataPortion
+	defer func() {
+		if releaseErr := store.releaseMoved(released); err == nil {
+			err = releaseErr
+		}
+	}()
+	for moved < maxMoves && pass.next < len(pass.lumps) {
+		if throttled && !store.backgroundReady() {
+			break
+		}
+		l := pass.lumps[pass.next]
+		pass.next++
+		if !store.index.HasDataPortion(l.Id, l.Portion) {
+			continue
+		}
+		newPortion, ok, err := store.dataRegion.MoveForward(l.Portion)
+		if err != nil {
+			return moved, err
+		}
+		if !ok {
+			continue
+		}
+		if err = store.recordMoves(l.Id, l.Portion, newPortion); err != nil {
+			store.releasePortion(newPortion)
+			return moved, err
+		}
+		released = append(released, l.Portion)
+		if throttled {
+			//the portion is read and written
+			store.chargeBackground(2 * uint64(l.Portion.SizeOnDisk(store.dataRegion.block_size)))
+		}
+		moved++
+		pass.moved++
+	}
+	return moved, nil
+}
+
+//releaseMoved releases the old portions of the moved lumps, the moves must be durable before
+//the portions are reused, or the lumps are restored to the overwritten portions after a crash
+func (store *Storage) releaseMoved(portions []portion.DataPortion) error {
+	if len(portions) == 0 {
+		return nil
+	}
+	//the old portions are not released if the moved data may be lost, they are free after reopen
+	if err := store.dataRegion.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync data region")
+	}
+	if err := store.journalRegion.SyncChecked(); err != nil {
+		return errors.Wrap(err, "failed to sync journal region")
+	}
+	for _, p := range portions {
+		store.releasePortion(p)
+	}
+	return nil
+}
+
+//recordMove journals the new portion of a moved lump, its TTL, metadata, tag or content hash is kept
+func (store *Storage) recordMove(lumpid lump.LumpId, newPortion portion.DataPortion) error {
+	if expireAt, ok := store.index.ExpireAt(lumpid); ok {
+		return store.journalRegion.RecordPutWithTTL(store.index, lumpid, newPortion, expireAt)
+	}
+	if hash, ok := store.index.ContentHash(lumpid); ok {
+		return store.journalRegion.RecordPutDedup(store.index, lumpid, newPortion, hash, true)
+	}
+	if metadata, ok := store.index.Metadata(lumpid); ok {
+		tag, _ := store.index.Tag(lumpid)
+		return store.journalRegion.RecordPutWithTag(store.index, lumpid, newPortion, metadata, tag)
+	}
+	if err := store.journalRegion.RecordPut(store.index, lumpid, newPortion); err != nil {
+		return err
+	}
+	store.index.InsertDataPortion(lumpid, newPortion)
+	return nil
+}
+
+func (store *Storage) JournalSync() error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	if store.readOnly {
+		return nil
+	}
+	if err := store.journalRegion.SyncChecked(); err != nil {
+		return errors.Wrap(err, "failed to sync journal region")
+	}
+	return nil
+}
+
+/*
+Sync returns after everything written before it is durable, including the lumps put with
+PutOptions.SyncJournal false. The data region is synced before the journal region, so the
+journal never refers to the data lost on crash. The holes of the released portions are punched
+then, see SetPunchHoles.
+*/
+func (store *Storage) Sync() error {
+	if err := store.checkOpen(); err != nil {
+		return err
+	}
+	if store.readOnly {
+		return nil
+	}
+	if err := store.dataRegion.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync data region")
+	}
+	if err := store.journalRegion.SyncChecked(); err != nil {
+		return errors.Wrap(err, "failed to sync journal region")
+	}
+	return store.dataRegion.PunchReleased()
+}
+
+/*
+SyncAsync is the same as Sync, but only the journal buffer is flushed here, the regions are
+synced in another goroutine. The returned channel receives the result once everything written
+before SyncAsync is durable, the storage could be written in the meantime.
+*/
+func (store *Storage) SyncAsync() <-chan error {
+	done := make(chan error, 1)
+	if err := store.checkOpen(); err != nil {
+		done <- err
+		return done
+	}
+	if store.readOnly {
+		done <- nil
+		return done
+	}
+	syncJournal, err := store.journalRegion.Flush()
+	if err != nil {
+		done <- errors.Wrap(err, "failed to flush journal region")
+		return done
+	}
+	go func() {
+		if err := store.dataRegion.Sync(); err != nil {
+			done <- errors.Wrap(err, "failed to sync data region")
+			return
+		}
+		if err := syncJournal(); err != nil {
+			done <- errors.Wrap(err, "failed to sync journal region")
+			return
+		}
+		done <- nil
+	}()
+	return done
+}
+
+/*
+Close syncs the data region and the journal, writes the checkpoint if it is enabled, and marks
+the journal clean, so the next open from the checkpoint does not read the journal. The operations
+fail with DeviceTerminated after Close, and Close again does nothing. The storage is closed even
+if an error is returned, the error is the first one of the final writes, the index and the nvm,
+the next open replays the journal if the final writes fail.
+*/
+func (store *Storage) Close() (err error) {
+	if atomic.LoadInt32(&store.closed) == 1 {
+		return nil
+	}
+	//a storage with a broken index is closed too
+	if err = store.checkOwner(); err != nil {
+		return
+	}
+	if !store.readOnly {
+		err = store.finalize()
+	}
+	store.abortCheckpoint()
+	atomic.StoreInt32(&store.closed, 1)
+	if store.stats != nil {
+		store.stats.close()
+	}
+	if closeErr := store.index.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := store.innerNVM.Close(); err == nil {
+		err = closeErr
+	}
+	return
 }
 
-func (store *Storage) Close() {
-	store.journalRegion.Sync()
-	store.innerNVM.Close()
+//finalize makes everything durable before the storage is closed
+func (store *Storage) finalize() error {
+	if err := store.dataRegion.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync data region")
+	}
+	if err := store.journalRegion.SyncChecked(); err != nil {
+		return errors.Wrap(err, "failed to sync journal region")
+	}
+	if err := store.dataRegion.PunchReleased(); err != nil {
+		return err
+	}
+	//a broken index is not saved in the checkpoint, it is restored from the journal when it is opened
+	if err := store.index.Err(); err != nil {
+		return errors.Wrap(err, "lump index is broken")
+	}
+	if store.checkpointPath != "" {
+		if err := store.WriteCheckpoint(); err != nil {
+			return err
+		}
+	}
+	return store.journalRegion.MarkClean()
 }
 
-func (store *Storage) RunSideJobOnce() {
+/*
+RunSideJobOnce runs a step of the background jobs: the scrubber, the journal gc, the reaper of
+the expired lumps, the data region compaction, the checkpoint and the punching of the released
+portions, see SetPunchHoles. A failed job does not stop the
+others, the first error is returned, and every failure is counted in SideJobStats.
+*/
+func (store *Storage) RunSideJobOnce() (err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	store.updateStats()
+	//the scrubber only reads, it runs on a read only storage too
+	store.runScrub()
+	if store.readOnly {
+		return nil
+	}
 	store.journalRegion.RunSideJobOnce(store.index)
+	if _, reapErr := store.ReapExpired(EXPIRE_REAPS_IN_SIDE_JOB); reapErr != nil {
+		err = store.sideJobFailed(&store.sideJobs.ReapFailures, errors.Wrap(reapErr, "failed to reap expired lumps"), err)
+	}
+	if store.automaticCompaction {
+		if _, compactErr := store.compactDataRegion(COMPACTION_MOVES_IN_SIDE_JOB, true); compactErr != nil {
+			err = store.sideJobFailed(&store.sideJobs.CompactionFailures, errors.Wrap(compactErr, "data region compaction failed"), err)
+		}
+	}
+	if checkpointErr := store.runCheckpoint(); checkpointErr != nil {
+		err = store.sideJobFailed(&store.sideJobs.CheckpointFailures, checkpointErr, err)
+	}
+	if punchErr := store.dataRegion.PunchReleased(); punchErr != nil {
+		err = store.sideJobFailed(&store.sideJobs.PunchFailures, punchErr, err)
+	}
+	return err
+}
+
+//sideJobFailed counts the failure of a side job, and returns the first error of RunSideJobOnce
+func (store *Storage) sideJobFailed(failures *uint64, err error, first error) error {
+	*failures++
+	store.sideJobs.LastError = err.Error()
+	if first != nil {
+		return first
+	}
+	return err
+}
+
+//SideJobStats returns the failures of the jobs of RunSideJobOnce since the storage is opened
+func (store *Storage) SideJobStats() (stats SideJobStats) {
+	store.view(func() {
+		stats = store.sideJobs
+	})
+	return
 }
@@ -2,13 +2,21 @@ package storage
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/thesues/cannyls-go/block"
+	"github.com/thesues/cannyls-go/internalerror"
 	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/lumpindex"
+	"github.com/thesues/cannyls-go/nvm"
+	"github.com/thesues/cannyls-go/storage/allocator"
 	"github.com/thesues/cannyls-go/storage/journal"
+	"github.com/thesues/cannyls-go/storage/migrate"
 )
 
 var _ = fmt.Print
@@ -95,184 +103,1553 @@ func TestCreateCannylsStorageFull(t *testing.T) {
 
 }
 
-func TestCreateCannylsStorageFullGC(t *testing.T) {
-
+func TestStorageGetReader(t *testing.T) {
 	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
 	assert.Nil(t, err)
 	defer os.Remove("tmp11.lusf")
 
-	storage.SetAutomaticGcMode(false)
-
-	storage.Put(lumpid("0000"), zeroedData(42))
-	storage.Put(lumpid("0010"), zeroedData(42))
+	_, err = storage.PutEmbed(lumpid("00"), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("11"), zeroedData(1500))
+	assert.Nil(t, err)
 
-	entries := storage.JournalSnapshot().Entries
+	reader, err := storage.GetReader(lumpid("00"))
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	reader.Close()
 
-	assert.Equal(t, 2, len(entries))
-	assert.True(t, isPut(entries[0], lumpid("0000")))
-	assert.True(t, isPut(entries[1], lumpid("0010")))
+	reader, err = storage.GetReader(lumpid("11"))
+	assert.Nil(t, err)
+	data, err = ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 1500), data)
+	reader.Close()
 
-	storage.JournalGC()
+	_, err = storage.GetReader(lumpid("22"))
+	assert.Error(t, err)
+}
 
-	storage.Delete(lumpid("0000"))
-	storage.Delete(lumpid("0010"))
+func TestStorageGetPooled(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp32.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp32.lusf")
+	defer storage.Close()
 
-	entries = storage.JournalSnapshot().Entries
-	assert.Equal(t, 4, len(entries))
-	//fmt.Printf("%+v\n", entries)
-	assert.True(t, isPut(entries[0], lumpid("0000")))
-	assert.True(t, isPut(entries[1], lumpid("0010")))
-	assert.True(t, isDelete(entries[2], lumpid("0000")))
-	assert.True(t, isDelete(entries[3], lumpid("0010")))
+	_, err = storage.PutEmbed(lumpid("00"), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("11"), zeroedData(1500))
+	assert.Nil(t, err)
 
-	storage.JournalGC()
+	buf, err := storage.GetPooled(lumpid("00"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), buf.AsBytes())
+	buf.Release()
 
-	entries = storage.JournalSnapshot().Entries
-	assert.Equal(t, 0, len(entries))
+	for i := 0; i < 3; i++ {
+		buf, err = storage.GetPooled(lumpid("11"))
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, 1500), buf.AsBytes())
+		buf.Release()
+	}
 
+	_, err = storage.GetPooled(lumpid("22"))
+	assert.Error(t, err)
 }
 
-//FIXME
-func TestCreateCannylsNoOverflow(t *testing.T) {
-	storage, err := CreateCannylsStorage("tmp11.lusf", 400*1024, 0.01)
+func TestStorageDeleteRange(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
 	assert.Nil(t, err)
 	defer os.Remove("tmp11.lusf")
 
-	storage.SetAutomaticGcMode(false)
+	free := storage.Usage().FreeBytes
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			_, err = storage.Put(lumpidnum(i), zeroedData(100))
+		} else {
+			_, err = storage.PutEmbed(lumpidnum(i), []byte("foo"))
+		}
+		assert.Nil(t, err)
+	}
 
-	assert.Equal(t, uint64(4096), storage.storageHeader.JournalRegionSize)
+	deleted, err := storage.DeleteRange(lumpidnum(2), lumpidnum(8))
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(deleted))
+	assert.Equal(t, lumpidnum(2), deleted[0])
+	assert.Equal(t, lumpidnum(7), deleted[5])
 
-	for i := 0; i < 60; i++ {
-		storage.Put(lumpidnum(i), zeroedData(42))
+	//nothing in the range
+	deleted, err = storage.DeleteRange(lumpidnum(2), lumpidnum(8))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(deleted))
+
+	expected := []lump.LumpId{lumpidnum(0), lumpidnum(1), lumpidnum(8), lumpidnum(9)}
+	assert.Equal(t, expected, storage.List())
+	storage.Close()
+
+	storage, err = OpenCannylsStorage("tmp11.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, storage.List())
+
+	storage.DeleteRange(lumpidnum(0), lumpidnum(10))
+	assert.Equal(t, free, storage.Usage().FreeBytes)
+	storage.Close()
+}
+
+func TestStorageCompactDataRegion(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+
+	for i := 0; i < 10; i++ {
+		data := zeroedData(1000)
+		data.AsBytes()[0] = byte(i)
+		_, err = storage.Put(lumpidnum(i), data)
+		assert.Nil(t, err)
 	}
-	for i := 0; i < 20; i++ {
+	for i := 0; i < 10; i += 2 {
 		storage.Delete(lumpidnum(i))
 	}
 
-	// (5+8+2+5)*60 + (5+8) * 20 == 1460
-	snapshot := storage.JournalSnapshot()
-	assert.Equal(t, uint64(0), snapshot.UnreleasedHead)
-	assert.Equal(t, uint64(0), snapshot.Head)
-	assert.Equal(t, uint64(1460), snapshot.Tail)
-
-	storage.JournalGC()
+	moved, err := storage.CompactDataRegion(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, moved)
 
-	// (60-20) * (5 + 8 + 2 + 5) + 2100 == 2260
-	snapshot = storage.JournalSnapshot()
-	assert.Equal(t, uint64(1460), snapshot.UnreleasedHead)
-	assert.Equal(t, uint64(1460), snapshot.Head)
-	assert.Equal(t, uint64(2260), snapshot.Tail)
+	//all the live lumps are in the front of data region
+	for _, l := range storage.index.LumpDataPortions() {
+		assert.True(t, l.Portion.End() <= 10)
+	}
 
-	// 2260 + 40 * PUTRECORDSIZE
-	storage.JournalGC()
-	snapshot = storage.JournalSnapshot()
-	assert.Equal(t, uint64(2260), snapshot.UnreleasedHead)
-	assert.Equal(t, uint64(2260), snapshot.Head)
-	assert.Equal(t, uint64(3060), snapshot.Tail)
+	//nothing to move
+	moved, err = storage.CompactDataRegion(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, moved)
+	storage.Close()
 
+	storage, err = OpenCannylsStorage("tmp11.lusf")
+	assert.Nil(t, err)
+	for i := 1; i < 10; i += 2 {
+		data, err := storage.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		assert.Equal(t, byte(i), data[0])
+		assert.Equal(t, 1000, len(data))
+	}
+	storage.Close()
 }
 
-func TestStorageLoopForEver1024(t *testing.T) {
-	var err error
-	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.8)
+func TestStorageCompactionPass(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp87.lusf", 1024*1024, 0.01)
 	assert.Nil(t, err)
-	//storage, err := CreateCannylsStorage("tmp11.lusf", 10*1024, 0.8) test case
-	fmt.Printf("Journal Region Size is %d\n", storage.storageHeader.JournalRegionSize)
-	defer os.Remove("tmp11.lusf")
-	for i := 0; i < 50000; i++ {
-		if _, err = storage.PutEmbed(lumpidnum(i), []byte("foo")); err != nil {
-			fmt.Printf("%+v", err)
-			break
-		}
+	defer os.Remove("tmp87.lusf")
+	defer storage.Close()
 
-		if _, err = storage.Delete(lumpidnum(i)); err != nil {
-			fmt.Printf("%+v", err)
-			break
+	for i := 0; i < 10; i++ {
+		_, err = storage.Put(lumpidnum(i), zeroedData(1000))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10; i += 2 {
+		storage.Delete(lumpidnum(i))
+	}
 
-		}
+	//the side job starts a pass of the 5 lumps, and moves the last one
+	moved, err := storage.compactDataRegion(1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, moved)
+	assert.Equal(t, 5, len(storage.compaction.lumps))
+	assert.Equal(t, lumpidnum(9), storage.compaction.lumps[0].Id)
+
+	//the pass is continued, the deleted lump is skipped
+	storage.Delete(lumpidnum(7))
+	moved, err = storage.compactDataRegion(1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, moved)
+	assert.Equal(t, 3, storage.compaction.next)
+	assert.Equal(t, 5, len(storage.compaction.lumps))
+
+	//a new pass is started after the pass which moved lumps, but not after a pass which moved nothing
+	for i := 0; i < 3; i++ {
+		_, err = storage.compactDataRegion(10, true)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 0, storage.compaction.moved)
+	assert.Equal(t, 4, len(storage.compaction.lumps))
+	assert.Equal(t, 4, storage.compaction.next)
+	for _, id := range []int{1, 3, 5, 9} {
+		_, err = storage.Get(lumpidnum(id))
+		assert.Nil(t, err)
 	}
+	report, err := storage.Verify(VerifyOptions{})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean(), "%v", report.Problems)
 }
 
-//slow
-func TestStorageLoopForEver32(t *testing.T) {
-	var err error
-	storage, err := CreateCannylsStorage("tmp11.lusf", 32*1024, 0.8)
+func TestStoragePutBatch(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
 	assert.Nil(t, err)
 	defer os.Remove("tmp11.lusf")
-	for i := 0; i < 50000; i++ {
-		if _, err = storage.PutEmbed(lumpidnum(i), []byte("foo")); err != nil {
-			fmt.Printf("%+v", err)
-			break
-		}
 
-		if _, err = storage.Delete(lumpidnum(i)); err != nil {
-			fmt.Printf("%+v", err)
-			break
+	assert.Nil(t, storage.SetAutomaticGcMode(false))
 
-		}
-	}
-}
+	_, err = storage.Put(lumpid("0000"), zeroedData(42))
+	assert.Nil(t, err)
 
-func BenchmarkStoragePutEmbeded(b *testing.B) {
-	var err error
-	storage, err := CreateCannylsStorage("bench.lusf", 1024*1024*1024, 0.9)
-	if err != nil {
-		panic("failed to create bench.lusf")
-	}
-	defer os.Remove("bench.lusf")
-	data := []byte("foo")
-	for i := 0; i < b.N; i++ {
-		if _, err = storage.PutEmbed(lumpidnum(i), data); err != nil {
-			fmt.Printf("ERR is %+v\n", err)
-			break
-		}
-	}
+	ids := []lump.LumpId{lumpid("0000"), lumpid("0001"), lumpid("0002")}
+	datas := []lump.LumpData{zeroedData(10), zeroedData(600), zeroedData(1024)}
+	err = storage.PutBatch(ids, datas)
+	assert.Nil(t, err)
+
+	//the batch is one journal entry
+	entries := storage.JournalSnapshot().Entries
+	assert.Equal(t, 2, len(entries))
+
+	//duplicated ids and mismatched length are rejected
+	err = storage.PutBatch([]lump.LumpId{lumpid("0003"), lumpid("0003")}, []lump.LumpData{zeroedData(1), zeroedData(1)})
+	assert.Error(t, err)
+	err = storage.PutBatch([]lump.LumpId{lumpid("0003")}, []lump.LumpData{})
+	assert.Error(t, err)
+
+	//a failed batch stores nothing
+	err = storage.PutBatch([]lump.LumpId{lumpid("0004"), lumpid("0005")}, []lump.LumpData{zeroedData(10), zeroedData(1024 * 1024)})
+	assert.Error(t, err)
+	_, err = storage.Get(lumpid("0004"))
+	assert.Error(t, err)
+
+	assert.Nil(t, storage.JournalGC())
+	storage.Close()
+
+	storage, err = OpenCannylsStorage("tmp11.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, ids, storage.List())
+	data, err := storage.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, 600, len(data))
+	storage.Close()
 }
 
-func BenchmarkStoragePutData(b *testing.B) {
-	storage, _ := CreateCannylsStorage("bench.lusf", 1024*1024*1024, 0.5)
-	defer os.Remove("bench.lusf")
-	for i := 0; i < b.N; i++ {
-		d := zeroedData(42)
-		storage.Put(lumpidnum(i), d)
-		d.Inner.Resize(42)
+func TestStorageOnStripedNVM(t *testing.T) {
+	paths := []string{"tmp11-0.lusf", "tmp11-1.lusf"}
+	file, err := nvm.CreateStripedIfAbsent(paths, 512*1024, 64*1024)
+	assert.Nil(t, err)
+	for _, path := range paths {
+		defer os.Remove(path)
 	}
+
+	storage, err := CreateCannylsStorageOnNVM(file, 0.01)
+	assert.Nil(t, err)
+	//bigger than one stripe
+	_, err = storage.Put(lumpid("0000"), zeroedData(100*1024))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("0001"), []byte("foo"))
+	assert.Nil(t, err)
+	storage.Close()
+
+	file, header, err := nvm.OpenStriped(paths, 64*1024)
+	assert.Nil(t, err)
+	storage, err = OpenCannylsStorageOnNVM(file, header, DefaultStorageOptions())
+	assert.Nil(t, err)
+	data, err := storage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, 100*1024, len(data))
+	data, err = storage.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), data)
+	storage.Close()
 }
 
-func lumpid(s string) lump.LumpId {
-	l, err := lump.FromString(s)
-	if err != nil {
-		panic("failed to create lumpid")
+func TestStorageOnObjectNVM(t *testing.T) {
+	store := nvm.NewMemoryObjectStore()
+	options := nvm.DefaultObjectNVMOptions()
+	options.ObjectSize = 64 * 1024
+	options.CacheObjects = 4
+	file, err := nvm.CreateObjectNVM(store, "cannyls", 1024*1024, options)
+	assert.Nil(t, err)
+
+	storage, err := CreateCannylsStorageOnNVM(file, 0.01)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = storage.Put(lumpidnum(i), zeroedData(30*1024))
+		assert.Nil(t, err)
 	}
-	return l
-}
+	storage.Close()
 
-func lumpidnum(n int) lump.LumpId {
-	l := lump.FromU64(0, uint64(n))
-	return l
+	file, header, err := nvm.OpenObjectNVM(store, "cannyls", options)
+	assert.Nil(t, err)
+	storage, err = OpenCannylsStorageOnNVM(file, header, DefaultStorageOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(storage.List()))
+	data, err := storage.Get(lumpidnum(9))
+	assert.Nil(t, err)
+	assert.Equal(t, 30*1024, len(data))
+	storage.Close()
 }
 
-func zeroedData(size int) lump.LumpData {
-	lumpData := lump.NewLumpDataAligned(size, block.Min())
-	buf := lumpData.AsBytes()
-	for i := 0; i < len(buf); i++ {
-		buf[i] = 0
-	}
-	return lumpData
+func TestStorageOnEncryptedNVM(t *testing.T) {
+	memory, err := nvm.New(1024 * 1024)
+	assert.Nil(t, err)
+	key := nvm.StaticKey([]byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ01"))
+	file, err := nvm.NewEncryptedNVM(memory, key)
+	assert.Nil(t, err)
+
+	storage, err := CreateCannylsStorageOnNVM(file, 0.01)
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("0000"), zeroedData(10*1024))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("0001"), []byte("foo"))
+	assert.Nil(t, err)
+	storage.Close()
+
+	_, _, err = nvm.OpenEncryptedNVM(memory, nvm.StaticKey([]byte("10ZYXWVUTSRQPONMLKJIHGFEDCBAzyxwvutsrqponmlkjihgfedcba9876543210")))
+	assert.Error(t, err)
+
+	file, header, err := nvm.OpenEncryptedNVM(memory, key)
+	assert.Nil(t, err)
+	storage, err = OpenCannylsStorageOnNVM(file, header, DefaultStorageOptions())
+	assert.Nil(t, err)
+	data, err := storage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 10*1024), data)
+	data, err = storage.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), data)
+	storage.Close()
 }
 
-func isPut(entry journal.JournalEntry, id lump.LumpId) bool {
-	r, ok := entry.Record.(journal.PutRecord)
-	if ok {
-		return r.LumpID == id
+func TestStorageJournalRegionOptions(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	storage.Close()
+
+	options := DefaultStorageOptions()
+	options.Journal.GcTriggerRatio = 0
+	_, err = OpenCannylsStorageWithOptions("tmp11.lusf", options)
+	assert.Error(t, err)
+
+	options.Journal.GcTriggerRatio = 0.8
+	options.Journal.GcBatchSize = 16
+	storage, err = OpenCannylsStorageWithOptions("tmp11.lusf", options)
+	assert.Nil(t, err)
+	assert.Equal(t, options.Journal, storage.JournalRegionOptions())
+
+	assert.Error(t, storage.SetJournalGcBatchSize(0))
+	assert.Error(t, storage.SetJournalGcTriggerRatio(1.5))
+	assert.Nil(t, storage.SetJournalSyncInterval(0))
+	assert.Equal(t, 0, storage.JournalRegionOptions().SyncInterval)
+	assert.Equal(t, 16, storage.JournalRegionOptions().GcBatchSize)
+
+	for i := 0; i < 1000; i++ {
+		_, err = storage.PutEmbed(lumpidnum(i%10), []byte("foo"))
+		assert.Nil(t, err)
 	}
-	return false
+	storage.Close()
+
+	storage, err = OpenCannylsStorage("tmp11.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(storage.List()))
+	storage.Close()
 }
 
-func isDelete(entry journal.JournalEntry, id lump.LumpId) bool {
-	r, ok := entry.Record.(journal.DeleteRecord)
-	if ok {
-		return r.LumpID == id
-	}
-	return false
+func TestStorageReadJournalSince(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+
+	_, err = storage.PutEmbed(lumpid("0000"), []byte("foo"))
+	assert.Nil(t, err)
+	cursor, err := storage.JournalCursor()
+	assert.Nil(t, err)
+
+	entries, next, err := storage.ReadJournalSince(cursor, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	assert.Equal(t, cursor, next)
+
+	_, err = storage.Put(lumpid("0001"), zeroedData(100))
+	assert.Nil(t, err)
+	_, err = storage.Delete(lumpid("0000"))
+	assert.Nil(t, err)
+
+	entries, cursor, err = storage.ReadJournalSince(cursor, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, lumpid("0001"), entries[0].Record.(journal.PutRecord).LumpID)
+	entries, cursor, err = storage.ReadJournalSince(cursor, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, lumpid("0000"), entries[0].Record.(journal.DeleteRecord).LumpID)
+
+	//the ring goes round many times, GC keeps the records which are not read
+	deletes := 0
+	for i := 0; i < 2000; i++ {
+		_, err = storage.PutEmbed(lumpidnum(i%10), []byte("foo"))
+		assert.Nil(t, err)
+		_, err = storage.Delete(lumpidnum(i % 10))
+		assert.Nil(t, err)
+		if i%20 == 0 {
+			entries, cursor, err = storage.ReadJournalSince(cursor, 1000)
+			assert.Nil(t, err)
+			for _, entry := range entries {
+				if _, ok := entry.Record.(journal.DeleteRecord); ok {
+					deletes++
+				}
+			}
+		}
+	}
+	entries, cursor, err = storage.ReadJournalSince(cursor, 1000)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if _, ok := entry.Record.(journal.DeleteRecord); ok {
+			deletes++
+		}
+	}
+	assert.Equal(t, 2000, deletes)
+	assert.Nil(t, storage.StopJournalTailing())
+	storage.Close()
+
+	//the cursor is still valid after reopen
+	storage, err = OpenCannylsStorage("tmp11.lusf")
+	assert.Nil(t, err)
+	reopened, err := storage.JournalCursor()
+	assert.Nil(t, err)
+	assert.Equal(t, cursor.Epoch, reopened.Epoch)
+	entries, cursor, err = storage.ReadJournalSince(cursor, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	_, err = storage.PutEmbed(lumpid("0000"), []byte("bar"))
+	assert.Nil(t, err)
+	entries, _, err = storage.ReadJournalSince(cursor, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, lumpid("0000"), entries[0].Record.(journal.EmbedRecord).LumpID)
+	storage.Close()
+
+	//the cursor of another storage is invalid
+	other, err := CreateCannylsStorage("tmp11b.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11b.lusf")
+	_, _, err = other.ReadJournalSince(cursor, 10)
+	assert.Error(t, err)
+	other.Close()
+}
+
+func TestCreateCannylsStorageFullGC(t *testing.T) {
+
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+
+	assert.Nil(t, storage.SetAutomaticGcMode(false))
+
+	storage.Put(lumpid("0000"), zeroedData(42))
+	storage.Put(lumpid("0010"), zeroedData(42))
+
+	entries := storage.JournalSnapshot().Entries
+
+	assert.Equal(t, 2, len(entries))
+	assert.True(t, isPut(entries[0], lumpid("0000")))
+	assert.True(t, isPut(entries[1], lumpid("0010")))
+
+	assert.Nil(t, storage.JournalGC())
+
+	storage.Delete(lumpid("0000"))
+	storage.Delete(lumpid("0010"))
+
+	entries = storage.JournalSnapshot().Entries
+	assert.Equal(t, 4, len(entries))
+	//fmt.Printf("%+v\n", entries)
+	assert.True(t, isPut(entries[0], lumpid("0000")))
+	assert.True(t, isPut(entries[1], lumpid("0010")))
+	assert.True(t, isDelete(entries[2], lumpid("0000")))
+	assert.True(t, isDelete(entries[3], lumpid("0010")))
+
+	assert.Nil(t, storage.JournalGC())
+
+	entries = storage.JournalSnapshot().Entries
+	assert.Equal(t, 0, len(entries))
+
+}
+
+func TestStorageJournalThrottle(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp60.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp60.lusf")
+	assert.Nil(t, store.SetAutomaticGcMode(false))
+	observer := &countingObserver{}
+	assert.Nil(t, store.SetObserver(observer))
+	assert.Error(t, store.SetJournalThrottle(1.5, false))
+	assert.Nil(t, store.SetJournalThrottle(0.5, false))
+	capacity := store.Usage().JournalCapacity
+
+	//all the records but the last are garbage, the throttled puts collect them
+	for i := 0; i < 1000; i++ {
+		_, err = store.Put(lumpidnum(1), zeroedData(42))
+		if !assert.Nil(t, err) {
+			break
+		}
+	}
+	assert.True(t, store.Usage().JournalUsage < capacity/2+512)
+	assert.True(t, observer.throttles > 0)
+	assert.Equal(t, 0, observer.rejections)
+
+	//the live records could not be collected, the puts fail fast over the watermark
+	assert.Nil(t, store.SetJournalThrottle(0.5, true))
+	puts := 0
+	for ; puts < 1000; puts++ {
+		if _, err = store.Put(lumpidnum(puts+2), zeroedData(42)); err != nil {
+			break
+		}
+	}
+	assert.True(t, internalerror.Is(err, internalerror.JournalFull))
+	assert.Equal(t, 1, observer.rejections)
+	assert.True(t, puts > 10 && puts < 1000)
+	//waiting stops when the gc frees nothing
+	assert.Nil(t, store.SetJournalThrottle(0.5, false))
+	_, err = store.Put(lumpidnum(1000), zeroedData(42))
+	assert.Nil(t, err)
+	data, err := store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 42, len(data))
+}
+
+func TestStorageJournalThrottleKeepsLumps(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp92.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp92.lusf")
+	assert.Nil(t, store.SetAutomaticGcMode(false))
+	assert.Nil(t, store.SetJournalThrottle(0.5, true))
+
+	byteData := func(b byte) lump.LumpData {
+		data := zeroedData(42)
+		data.AsBytes()[0] = b
+		return data
+	}
+	//the live records fill the journal over the watermark
+	puts := 0
+	for ; puts < 1000; puts++ {
+		if _, err = store.Put(lumpidnum(puts), byteData(byte(puts))); err != nil {
+			break
+		}
+	}
+	assert.True(t, internalerror.Is(err, internalerror.JournalFull))
+	assert.True(t, puts > 10 && puts < 1000)
+
+	//the rejected delete and put do not change the lumps
+	_, err = store.Delete(lumpidnum(0))
+	assert.True(t, internalerror.Is(err, internalerror.JournalFull))
+	_, _, err = store.DeleteAndStat(lumpidnum(1))
+	assert.True(t, internalerror.Is(err, internalerror.JournalFull))
+	_, err = store.Put(lumpidnum(2), byteData(0xFF))
+	assert.True(t, internalerror.Is(err, internalerror.JournalFull))
+	data, err := store.Get(lumpidnum(0))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0), data[0])
+	assert.Nil(t, store.Close())
+
+	store, err = OpenCannylsStorage("tmp92.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	for i := 0; i < puts; i++ {
+		data, err = store.Get(lumpidnum(i))
+		if !assert.Nil(t, err) {
+			break
+		}
+		assert.Equal(t, byte(i), data[0])
+	}
+}
+
+func TestStorageJournalGcPacing(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp61.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp61.lusf")
+	assert.Error(t, store.SetJournalGcPacing(1))
+	assert.Nil(t, store.SetJournalGcPacing(0.3))
+	assert.Equal(t, 0.3, store.JournalRegionOptions().GcTargetFreeRatio)
+	capacity := store.Usage().JournalCapacity
+
+	//a window of 20 live lumps slides forward, the usage settles around the target
+	//instead of GcTriggerRatio
+	var maxUsage uint64
+	for i := 0; i < 2000; i++ {
+		_, err = store.Put(lumpidnum(i), zeroedData(42))
+		if err == nil && i >= 20 {
+			_, err = store.Delete(lumpidnum(i - 20))
+		}
+		if !assert.Nil(t, err) {
+			break
+		}
+		if usage := store.Usage().JournalUsage; usage > maxUsage {
+			maxUsage = usage
+		}
+	}
+	assert.True(t, maxUsage > capacity*3/5)
+	assert.True(t, maxUsage < capacity*4/5)
+	for i := 1980; i < 2000; i++ {
+		data, err := store.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		assert.Equal(t, 42, len(data))
+	}
+}
+
+func TestStorageJournalGcYield(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp62.lusf", 1024*1024, 0.05)
+	assert.Nil(t, err)
+	defer os.Remove("tmp62.lusf")
+	assert.Nil(t, store.SetAutomaticGcMode(false))
+	for i := 0; i < 400; i++ {
+		_, err = store.PutEmbed(lumpidnum(i%100), []byte(fmt.Sprintf("embedded %d", i)))
+		assert.Nil(t, err)
+	}
+
+	//the embedded lumps are read while they are relocated by the gc
+	yields := 0
+	err = store.SetJournalGcYield(func() {
+		yields++
+		for i := 0; i < 100; i += 7 {
+			data, err := store.Get(lumpidnum(i))
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("embedded %d", i+300), string(data))
+		}
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, store.JournalGC())
+	assert.True(t, yields > 0)
+	assert.Nil(t, store.SetJournalGcYield(nil))
+	for i := 0; i < 100; i++ {
+		data, err := store.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("embedded %d", i+300), string(data))
+	}
+}
+
+//FIXME
+func TestCreateCannylsNoOverflow(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 400*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+
+	assert.Nil(t, storage.SetAutomaticGcMode(false))
+
+	assert.Equal(t, uint64(4096), storage.storageHeader.JournalRegionSize)
+
+	for i := 0; i < 60; i++ {
+		storage.Put(lumpidnum(i), zeroedData(42))
+	}
+	for i := 0; i < 20; i++ {
+		storage.Delete(lumpidnum(i))
+	}
+
+	// (5+8+2+5)*60 + (5+8) * 20 == 1460
+	snapshot := storage.JournalSnapshot()
+	assert.Equal(t, uint64(0), snapshot.UnreleasedHead)
+	assert.Equal(t, uint64(0), snapshot.Head)
+	assert.Equal(t, uint64(1460), snapshot.Tail)
+	//every entry has its own position
+	assert.Equal(t, uint64(0), snapshot.Entries[0].Start.AsU64())
+	assert.Equal(t, uint64(20), snapshot.Entries[1].Start.AsU64())
+	assert.Equal(t, snapshot.Tail, snapshot.Entries[len(snapshot.Entries)-1].End())
+
+	assert.Nil(t, storage.JournalGC())
+
+	// (60-20) * (5 + 8 + 2 + 5) + 2100 == 2260
+	snapshot = storage.JournalSnapshot()
+	assert.Equal(t, uint64(1460), snapshot.UnreleasedHead)
+	assert.Equal(t, uint64(1460), snapshot.Head)
+	assert.Equal(t, uint64(2260), snapshot.Tail)
+	assert.Equal(t, uint64(1460), snapshot.Entries[0].Start.AsU64())
+
+	// 2260 + 40 * PUTRECORDSIZE
+	assert.Nil(t, storage.JournalGC())
+	snapshot = storage.JournalSnapshot()
+	assert.Equal(t, uint64(2260), snapshot.UnreleasedHead)
+	assert.Equal(t, uint64(2260), snapshot.Head)
+	assert.Equal(t, uint64(3060), snapshot.Tail)
+
+}
+
+func TestStorageLoopForEver1024(t *testing.T) {
+	var err error
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.8)
+	assert.Nil(t, err)
+	//storage, err := CreateCannylsStorage("tmp11.lusf", 10*1024, 0.8) test case
+	fmt.Printf("Journal Region Size is %d\n", storage.storageHeader.JournalRegionSize)
+	defer os.Remove("tmp11.lusf")
+	for i := 0; i < 50000; i++ {
+		if _, err = storage.PutEmbed(lumpidnum(i), []byte("foo")); err != nil {
+			fmt.Printf("%+v", err)
+			break
+		}
+
+		if _, err = storage.Delete(lumpidnum(i)); err != nil {
+			fmt.Printf("%+v", err)
+			break
+
+		}
+	}
+}
+
+//slow
+func TestStorageLoopForEver32(t *testing.T) {
+	var err error
+	storage, err := CreateCannylsStorage("tmp11.lusf", 32*1024, 0.8)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+	for i := 0; i < 50000; i++ {
+		if _, err = storage.PutEmbed(lumpidnum(i), []byte("foo")); err != nil {
+			fmt.Printf("%+v", err)
+			break
+		}
+
+		if _, err = storage.Delete(lumpidnum(i)); err != nil {
+			fmt.Printf("%+v", err)
+			break
+
+		}
+	}
+}
+
+func BenchmarkStoragePutEmbeded(b *testing.B) {
+	var err error
+	storage, err := CreateCannylsStorage("bench.lusf", 1024*1024*1024, 0.9)
+	if err != nil {
+		panic("failed to create bench.lusf")
+	}
+	defer os.Remove("bench.lusf")
+	data := []byte("foo")
+	for i := 0; i < b.N; i++ {
+		if _, err = storage.PutEmbed(lumpidnum(i), data); err != nil {
+			fmt.Printf("ERR is %+v\n", err)
+			break
+		}
+	}
+}
+
+func BenchmarkStoragePutData(b *testing.B) {
+	storage, _ := CreateCannylsStorage("bench.lusf", 1024*1024*1024, 0.5)
+	defer os.Remove("bench.lusf")
+	for i := 0; i < b.N; i++ {
+		d := zeroedData(42)
+		storage.Put(lumpidnum(i), d)
+		d.Inner.Resize(42)
+	}
+}
+
+func lumpid(s string) lump.LumpId {
+	l, err := lump.FromString(s)
+	if err != nil {
+		panic("failed to create lumpid")
+	}
+	return l
+}
+
+func lumpidnum(n int) lump.LumpId {
+	l := lump.FromU64(0, uint64(n))
+	return l
+}
+
+func zeroedData(size int) lump.LumpData {
+	lumpData := lump.NewLumpDataAligned(size, block.Min())
+	buf := lumpData.AsBytes()
+	for i := 0; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return lumpData
+}
+
+func isPut(entry journal.JournalEntry, id lump.LumpId) bool {
+	r, ok := entry.Record.(journal.PutRecord)
+	if ok {
+		return r.LumpID == id
+	}
+	return false
+}
+
+func isDelete(entry journal.JournalEntry, id lump.LumpId) bool {
+	r, ok := entry.Record.(journal.DeleteRecord)
+	if ok {
+		return r.LumpID == id
+	}
+	return false
+}
+
+func TestStorageIterator(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp13.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp13.lusf")
+	defer storage.Close()
+
+	_, err = storage.Put(lumpid("0000"), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("0001"), []byte("hello"))
+	assert.Nil(t, err)
+
+	iter, err := storage.Iterator()
+	assert.Nil(t, err)
+	defer iter.Close()
+	_, err = storage.Delete(lumpid("0000"))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("0002"), zeroedData(100))
+	assert.Nil(t, err)
+
+	entries := []LumpEntry{}
+	for entry, ok := iter.Next(); ok; entry, ok = iter.Next() {
+		entries = append(entries, entry)
+	}
+	assert.Equal(t, []LumpEntry{
+		{Id: lumpid("0000"), Size: 1024, Embedded: false},
+		{Id: lumpid("0001"), Size: 5, Embedded: true},
+	}, entries)
+}
+
+func TestStorageStat(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp14.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp14.lusf")
+	defer storage.Close()
+
+	_, err = storage.Put(lumpid("0000"), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("0001"), []byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.SetDataChecksum(true))
+	_, err = storage.Put(lumpid("0002"), zeroedData(1020))
+	assert.Nil(t, err)
+
+	stat, err := storage.Stat(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1000), stat.Size)
+	assert.Equal(t, uint32(1024), stat.SizeOnDisk)
+	assert.False(t, stat.Embedded)
+
+	stat, err = storage.Stat(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, LumpStat{Size: 5, SizeOnDisk: 5, Embedded: true, Offset: stat.Offset}, stat)
+
+	//the checksum does not fit in 1024 bytes
+	stat, err = storage.Stat(lumpid("0002"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1020), stat.Size)
+	assert.Equal(t, uint32(1536), stat.SizeOnDisk)
+
+	_, err = storage.Stat(lumpid("0003"))
+	assert.Error(t, err)
+
+	free := storage.Usage().FreeBytes
+	stat, deleted, err := storage.DeleteAndStat(lumpid("0002"))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, uint32(1020), stat.Size)
+	assert.Equal(t, uint32(1536), stat.SizeOnDisk)
+	assert.Equal(t, free+1536, storage.Usage().FreeBytes)
+	stat, deleted, err = storage.DeleteAndStat(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, uint32(5), stat.Size)
+	assert.True(t, stat.Embedded)
+	stat, deleted, err = storage.DeleteAndStat(lumpid("0002"))
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+	assert.Equal(t, LumpStat{}, stat)
+	assert.Equal(t, 1, len(storage.List()))
+}
+
+func TestStorageConditionalPut(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp16.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp16.lusf")
+	defer storage.Close()
+
+	stored, err := storage.PutIfAbsent(lumpid("0000"), zeroedData(100))
+	assert.Nil(t, err)
+	assert.True(t, stored)
+	stored, err = storage.PutIfAbsent(lumpid("0000"), zeroedData(200))
+	assert.Nil(t, err)
+	assert.False(t, stored)
+
+	data, err := storage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(data))
+
+	//the lump is not changed by others
+	crc := LumpCRC(data)
+	swapped, err := storage.CompareAndSwap(lumpid("0000"), crc, zeroedData(200))
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	//the lump is changed
+	swapped, err = storage.CompareAndSwap(lumpid("0000"), crc, zeroedData(300))
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	//the lump does not exist
+	swapped, err = storage.CompareAndSwap(lumpid("0001"), crc, zeroedData(300))
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+
+	data, err = storage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(data))
+}
+
+func TestStorageEmbedThreshold(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp19.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp19.lusf")
+
+	_, err = storage.Put(lumpid("0000"), zeroedData(100))
+	assert.Nil(t, err)
+	_, err = storage.PutWithMetadata(lumpid("0001"), zeroedData(1000), []byte("meta"))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpid("0002"), make([]byte, 3000))
+	assert.Nil(t, err)
+	_, err = storage.PutWithTTL(lumpid("0003"), zeroedData(100), time.Hour)
+	assert.Nil(t, err)
+	storage.Close()
+
+	options := DefaultStorageOptions()
+	options.EmbedThreshold = lump.MAX_EMBEDDED_SIZE + 1
+	_, err = OpenCannylsStorageWithOptions("tmp19.lusf", options)
+	assert.Error(t, err)
+
+	options.EmbedThreshold = 2048
+	options.RehomeOnOpen = true
+	storage, err = OpenCannylsStorageWithOptions("tmp19.lusf", options)
+	assert.Nil(t, err)
+
+	embedded := func(id string) bool {
+		stat, err := storage.Stat(lumpid(id))
+		assert.Nil(t, err)
+		return stat.Embedded
+	}
+	assert.True(t, embedded("0000"))
+	assert.True(t, embedded("0001"))
+	assert.False(t, embedded("0002"))
+	//the lump with TTL is not moved
+	assert.False(t, embedded("0003"))
+
+	metadata, err := storage.GetMetadata(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("meta"), metadata)
+	data, err := storage.Get(lumpid("0002"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3000, len(data))
+
+	//new lumps are embedded by Put
+	_, err = storage.Put(lumpid("0004"), zeroedData(2048))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("0005"), zeroedData(2049))
+	assert.Nil(t, err)
+	assert.True(t, embedded("0004"))
+	assert.False(t, embedded("0005"))
+
+	//rewrites move the lumps across the threshold
+	_, err = storage.Put(lumpid("0004"), zeroedData(3000))
+	assert.Nil(t, err)
+	assert.False(t, embedded("0004"))
+	_, err = storage.Put(lumpid("0005"), zeroedData(100))
+	assert.Nil(t, err)
+	assert.True(t, embedded("0005"))
+
+	//PutBatch never embeds, Rehome moves the small lump
+	err = storage.PutBatch([]lump.LumpId{lumpid("0006")}, []lump.LumpData{zeroedData(100)})
+	assert.Nil(t, err)
+	assert.False(t, embedded("0006"))
+	moved, err := storage.Rehome(lumpid("0006"))
+	assert.Nil(t, err)
+	assert.True(t, moved)
+	assert.True(t, embedded("0006"))
+	data, err = storage.Get(lumpid("0006"))
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(data))
+	moved, err = storage.Rehome(lumpid("0006"))
+	assert.Nil(t, err)
+	assert.False(t, moved)
+	moved, err = storage.Rehome(lumpid("0007"))
+	assert.Nil(t, err)
+	assert.False(t, moved)
+	storage.Close()
+}
+
+func TestStorageAllocatorOption(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp26.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp26.lusf")
+	_, err = storage.Put(lumpid("0000"), zeroedData(10000))
+	assert.Nil(t, err)
+	storage.Close()
+
+	options := DefaultStorageOptions()
+	options.Allocator = "nonexistent"
+	_, err = OpenCannylsStorageWithOptions("tmp26.lusf", options)
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	//the buddy allocator has no policy
+	options.Allocator = allocator.ALLOCATOR_BUDDY
+	options.AllocationPolicy = allocator.POLICY_FIRST_FIT
+	_, err = OpenCannylsStorageWithOptions("tmp26.lusf", options)
+	assert.Equal(t, internalerror.InvalidInput, errors.Cause(err))
+
+	options.AllocationPolicy = allocator.POLICY_BEST_FIT
+	for _, name := range []string{allocator.ALLOCATOR_BTREE, allocator.ALLOCATOR_BUDDY} {
+		options.Allocator = name
+		storage, err = OpenCannylsStorageWithOptions("tmp26.lusf", options)
+		assert.Nil(t, err)
+		//the used portion is restored
+		assert.Equal(t, storage.Header().DataRegionSize-uint64(20*512), storage.Usage().FreeBytes)
+		_, err = storage.Put(lumpid("0001"), zeroedData(10000))
+		assert.Nil(t, err)
+		data, err := storage.Get(lumpid("0000"))
+		assert.Nil(t, err)
+		assert.Equal(t, 10000, len(data))
+		_, err = storage.Delete(lumpid("0001"))
+		assert.Nil(t, err)
+		storage.Close()
+	}
+}
+
+func TestStorageRestoreManyRecords(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp29.lusf", 4*1024*1024, 0.5)
+	assert.Nil(t, err)
+	defer os.Remove("tmp29.lusf")
+	//more records than a restore batch
+	for i := 0; i < 3000; i++ {
+		_, err = storage.PutEmbed(lumpidnum(i), []byte(fmt.Sprintf("%d", i)))
+		assert.Nil(t, err)
+		if i%3 == 0 {
+			_, err = storage.Delete(lumpidnum(i))
+			assert.Nil(t, err)
+		}
+	}
+	storage.Close()
+
+	storage, err = OpenCannylsStorage("tmp29.lusf")
+	assert.Nil(t, err)
+	defer storage.Close()
+	assert.Equal(t, 2000, len(storage.List()))
+	data, err := storage.Get(lumpidnum(2999))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2999"), data)
+	_, err = storage.Get(lumpidnum(2997))
+	assert.Error(t, err)
+}
+
+func TestStoragePunchHoles(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp20.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	storage.Close()
+	defer os.Remove("tmp20.lusf")
+
+	options := DefaultStorageOptions()
+	options.PunchHoles = true
+	storage, err = OpenCannylsStorageWithOptions("tmp20.lusf", options)
+	assert.Nil(t, err)
+	defer storage.Close()
+
+	_, err = storage.Put(lumpid("0000"), zeroedData(100000))
+	assert.Nil(t, err)
+	_, err = storage.Put(lumpid("0001"), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = storage.Delete(lumpid("0000"))
+	assert.Nil(t, err)
+	//the hole is punched after the delete is synced
+	assert.Equal(t, 1, len(storage.dataRegion.punches))
+	assert.Nil(t, storage.Sync())
+	assert.Equal(t, 0, len(storage.dataRegion.punches))
+
+	//the released space could be used again
+	_, err = storage.Put(lumpid("0002"), zeroedData(1000))
+	assert.Nil(t, err)
+	assert.Nil(t, storage.Sync())
+	for _, id := range []string{"0001", "0002"} {
+		data, err := storage.Get(lumpid(id))
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, len(data))
+	}
+}
+
+func TestStorageUsage(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp21.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp21.lusf")
+
+	usage := storage.Usage()
+	assert.Equal(t, usage.FreeBytes, usage.LargestFreeBytes)
+	assert.Equal(t, float64(0), usage.Fragmentation)
+	assert.Equal(t, uint64(0), usage.AllocatedBytes)
+
+	for i := 0; i < 4; i++ {
+		_, err = storage.Put(lumpidnum(i), zeroedData(1000))
+		assert.Nil(t, err)
+	}
+	_, err = storage.PutEmbed(lumpidnum(4), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = storage.PutEmbed(lumpidnum(5), []byte("world"))
+	assert.Nil(t, err)
+	//overwrite an embedded lump
+	_, err = storage.PutEmbed(lumpidnum(5), []byte("foo"))
+	assert.Nil(t, err)
+	_, err = storage.Delete(lumpidnum(1))
+	assert.Nil(t, err)
+
+	usage = storage.Usage()
+	assert.Equal(t, uint64(3*1024), usage.AllocatedBytes)
+	assert.Equal(t, usage.FreeBytes-1024, usage.LargestFreeBytes)
+	assert.True(t, usage.Fragmentation > 0)
+	assert.True(t, usage.JournalUsage > 0)
+	assert.Equal(t, uint64(8), usage.EmbeddedBytes)
+	storage.Close()
+
+	//restored from journal
+	storage, err = OpenCannylsStorage("tmp21.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8), storage.Usage().EmbeddedBytes)
+	storage.DeleteRange(lumpidnum(0), lumpidnum(10))
+	assert.Equal(t, uint64(0), storage.Usage().EmbeddedBytes)
+	storage.Close()
+}
+
+func TestStorageMigrateOnOpen(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp40.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp40.lusf")
+	_, err = store.Put(lumpidnum(1), zeroedData(100))
+	assert.Nil(t, err)
+	header := store.Header()
+	//2.0 has no migration
+	header.MinorVersion = 0
+	assert.Nil(t, store.writeHeader(&header))
+	store.Close()
+
+	//no migration
+	_, err = OpenCannylsStorage("tmp40.lusf")
+	assert.Error(t, err)
+
+	migrated := false
+	migrate.Register(migrate.Migration{
+		From:        migrate.Version{Major: nvm.MAJOR_VERSION, Minor: 0},
+		To:          migrate.Version{Major: nvm.MAJOR_VERSION, Minor: 1},
+		Description: "test",
+		Apply: func(file nvm.NonVolatileMemory, header *nvm.StorageHeader) error {
+			migrated = true
+			return nil
+		},
+	})
+	//read only does not migrate
+	_, err = OpenReadOnly("tmp40.lusf")
+	assert.Error(t, err)
+	assert.False(t, migrated)
+
+	store, err = OpenCannylsStorage("tmp40.lusf")
+	assert.Nil(t, err)
+	assert.True(t, migrated)
+	header = store.Header()
+	assert.True(t, header.IsCurrentVersion())
+	_, err = store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	store.Close()
+
+	_, header2, err := nvm.Open("tmp40.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, nvm.MINOR_VERSION, header2.MinorVersion)
+}
+
+func TestStorageBlockSize(t *testing.T) {
+	options := DefaultStorageOptions()
+	options.File.BlockSize = block.BlockSize(1536)
+	_, err := CreateCannylsStorageWithOptions("tmp41.lusf", 1024*1024, 0.1, options)
+	assert.Error(t, err)
+	_, err = os.Stat("tmp41.lusf")
+	assert.True(t, os.IsNotExist(err))
+
+	options.File.BlockSize, _ = block.NewBlockSize(4096)
+	//the capacity is not aligned to the block size
+	_, err = CreateCannylsStorageWithOptions("tmp41.lusf", 1024*1024+512, 0.1, options)
+	assert.Error(t, err)
+	os.Remove("tmp41.lusf")
+
+	store, err := CreateCannylsStorageWithOptions("tmp41.lusf", 1024*1024, 0.1, options)
+	assert.Nil(t, err)
+	defer os.Remove("tmp41.lusf")
+	header := store.Header()
+	assert.Equal(t, uint16(4096), header.BlockSize.AsU16())
+	assert.Equal(t, uint64(4096), header.RegionSize())
+	assert.True(t, header.BlockSize.IsAligned(header.JournalRegionSize))
+
+	_, err = store.Put(lumpidnum(1), filledData(100, 'a'))
+	assert.Nil(t, err)
+	_, err = store.Put(lumpidnum(2), filledData(5000, 'b'))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4096*3), store.Usage().AllocatedBytes)
+	store.Close()
+
+	//the block size is read from the header
+	store, err = OpenCannylsStorage("tmp41.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(4096), store.Header().BlockSize.AsU16())
+	data, err := store.Get(lumpidnum(1))
+	assert.Nil(t, err)
+	assert.Equal(t, filledData(100, 'a').AsBytes(), data)
+	data, err = store.Get(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.Equal(t, filledData(5000, 'b').AsBytes(), data)
+	store.Close()
+
+	//the mapping uses the block size of the header too
+	file, fileHeader, err := nvm.OpenMmap("tmp41.lusf", nvm.MMAP_FLUSH_ON_SYNC)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(4096), file.BlockSize().AsU16())
+	store, err = OpenCannylsStorageOnNVM(file, fileHeader, DefaultStorageOptions())
+	assert.Nil(t, err)
+	data, err = store.Get(lumpidnum(2))
+	assert.Nil(t, err)
+	assert.Equal(t, filledData(5000, 'b').AsBytes(), data)
+	store.Close()
+
+	//the nvm of another block size is rejected
+	file, fileHeader, err = nvm.OpenMmap("tmp41.lusf", nvm.MMAP_FLUSH_ON_SYNC)
+	assert.Nil(t, err)
+	fileHeader.BlockSize = block.Min()
+	_, err = OpenCannylsStorageOnNVM(file, fileHeader, DefaultStorageOptions())
+	assert.True(t, internalerror.Is(err, internalerror.InvalidInput))
+	file.Close()
+}
+
+func TestStorageIndexTree(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp43.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp43.lusf")
+	store.Close()
+
+	options := DefaultStorageOptions()
+	options.IndexTree = lumpindex.TreeKind(100)
+	_, err = OpenCannylsStorageWithOptions("tmp43.lusf", options)
+	assert.Error(t, err)
+
+	options.IndexTree = lumpindex.TREE_PACKED
+	store, err = OpenCannylsStorageWithOptions("tmp43.lusf", options)
+	assert.Nil(t, err)
+	for i := 0; i < 600; i++ {
+		_, err = store.PutEmbed(lumpidnum(i), []byte("hello"))
+		assert.Nil(t, err)
+	}
+	_, err = store.Put(lumpidnum(1000), zeroedData(100))
+	assert.Nil(t, err)
+	_, err = store.DeleteRange(lumpidnum(100), lumpidnum(200))
+	assert.Nil(t, err)
+	store.Close()
+
+	store, err = OpenCannylsStorageWithOptions("tmp43.lusf", options)
+	assert.Nil(t, err)
+	assert.Equal(t, lumpindex.TREE_PACKED, store.index.TreeKind())
+	assert.Equal(t, 501, len(store.List()))
+	_, err = store.Get(lumpidnum(150))
+	assert.Error(t, err)
+	data, err := store.Get(lumpidnum(599))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	_, err = store.Get(lumpidnum(1000))
+	assert.Nil(t, err)
+	store.Close()
+}
+
+func TestStorageIndexSpill(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp44.lusf", 4*1024*1024, 0.5)
+	assert.Nil(t, err)
+	defer os.Remove("tmp44.lusf")
+	defer os.Remove("tmp44.ckpt")
+	store.Close()
+
+	options := DefaultStorageOptions()
+	options.IndexSpill = "tmp44.index"
+	options.IndexMemoryLimit = 1024
+	options.Checkpoint = "tmp44.ckpt"
+	for round := 0; round < 2; round++ {
+		store, err = OpenCannylsStorageWithOptions("tmp44.lusf", options)
+		assert.Nil(t, err)
+		for i := 0; i < 2000; i++ {
+			_, err = store.PutEmbed(lumpidnum(i*7+round), []byte("hello"))
+			assert.Nil(t, err)
+		}
+		assert.True(t, store.index.MemoryUsed() < 4096)
+		store.Close()
+		_, err = os.Stat("tmp44.index")
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	//the checkpoint is restored into the spilled index
+	store, err = OpenCannylsStorageWithOptions("tmp44.lusf", options)
+	assert.Nil(t, err)
+	assert.Equal(t, 4000, len(store.List()))
+	data, err := store.Get(lumpidnum(1999*7 + 1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	_, err = store.Get(lumpidnum(2))
+	assert.Error(t, err)
+	store.Close()
+
+	//the storage fails with DeviceError if the spill file is broken
+	store, err = OpenCannylsStorageWithOptions("tmp44.lusf", options)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate("tmp44.index", 0))
+	for i := 0; i < 2000 && err == nil; i++ {
+		_, err = store.Get(lumpidnum(i * 7))
+	}
+	assert.True(t, internalerror.Is(err, internalerror.DeviceError))
+	_, err = store.PutEmbed(lumpidnum(1), []byte("hello"))
+	assert.True(t, internalerror.Is(err, internalerror.DeviceError))
+	assert.True(t, internalerror.Is(store.Close(), internalerror.DeviceError))
+	store, err = OpenCannylsStorageWithOptions("tmp44.lusf", options)
+	assert.Nil(t, err)
+	assert.Equal(t, 4000, len(store.List()))
+	store.Close()
+
+	options.IndexSpill = options.Checkpoint
+	_, err = OpenCannylsStorageWithOptions("tmp44.lusf", options)
+	assert.Error(t, err)
+}
+
+func TestStorageBloomFilter(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp45.lusf", 1024*1024, 0.5)
+	assert.Nil(t, err)
+	defer os.Remove("tmp45.lusf")
+	for i := 0; i < 100; i++ {
+		_, err = store.PutEmbed(lumpidnum(i), []byte("hello"))
+		assert.Nil(t, err)
+	}
+	_, ok := store.BloomStats()
+	assert.False(t, ok)
+	store.Close()
+
+	options := DefaultStorageOptions()
+	options.BloomFalsePositiveRate = 1.5
+	_, err = OpenCannylsStorageWithOptions("tmp45.lusf", options)
+	assert.Error(t, err)
+
+	options.BloomFalsePositiveRate = 0.001
+	store, err = OpenCannylsStorageWithOptions("tmp45.lusf", options)
+	assert.Nil(t, err)
+	defer store.Close()
+	data, err := store.Get(lumpidnum(99))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	for i := 100; i < 1100; i++ {
+		_, err = store.Get(lumpidnum(i))
+		assert.Error(t, err)
+		updated, err := store.Delete(lumpidnum(i))
+		assert.Nil(t, err)
+		assert.False(t, updated)
+	}
+	updated, err := store.Delete(lumpidnum(0))
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	stats, ok := store.BloomStats()
+	assert.True(t, ok)
+	assert.True(t, stats.Skipped > 1900)
+}
+
+func TestStorageOverwriteInPlace(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp46.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp46.lusf")
+	backup, err := CreateCannylsStorage("tmp47.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp47.lusf")
+	defer backup.Close()
+
+	assert.Nil(t, store.SetOverwriteInPlace(true))
+	assert.Nil(t, store.dataRegion.SetCache(1024*1024, CACHE_LRU))
+	_, err = store.Put(lumpid("0000"), zeroedData(1000))
+	assert.Nil(t, err)
+	_, err = store.PutWithMetadata(lumpid("0001"), zeroedData(1000), []byte("meta"))
+	assert.Nil(t, err)
+	stat, err := store.Stat(lumpid("0000"))
+	assert.Nil(t, err)
+	_, err = store.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	free := store.Usage().FreeBytes
+
+	cursor, err := store.JournalCursor()
+	assert.Nil(t, err)
+	data := zeroedData(900)
+	data.AsBytes()[0] = 'x'
+	updated, err := store.Put(lumpid("0000"), data)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	newStat, err := store.Stat(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, stat.Offset, newStat.Offset)
+	assert.Equal(t, uint32(900), newStat.Size)
+	assert.Equal(t, free, store.Usage().FreeBytes)
+	//the cached data is dropped
+	got, err := store.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, data.AsBytes(), got)
+
+	entries, _, err := store.ReadJournalSince(cursor, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	overwrite, ok := entries[0].Record.(journal.OverwriteRecord)
+	assert.True(t, ok)
+	assert.Equal(t, lumpid("0000"), overwrite.LumpID)
+	records, _, err := store.ReplicateJournalSince(cursor, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	applied, err := backup.ApplyJournalRecord(records[0])
+	assert.Nil(t, err)
+	assert.True(t, applied)
+	got, err = backup.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, data.AsBytes(), got)
+
+	//a bigger lump, or a lump with metadata, is put into a new portion
+	_, err = store.Put(lumpid("0000"), zeroedData(3000))
+	assert.Nil(t, err)
+	newStat, err = store.Stat(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, stat.Offset, newStat.Offset)
+	metaStat, err := store.Stat(lumpid("0001"))
+	assert.Nil(t, err)
+	_, err = store.Put(lumpid("0001"), zeroedData(1000))
+	assert.Nil(t, err)
+	newStat, err = store.Stat(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, metaStat.Offset, newStat.Offset)
+	metadata, err := store.GetMetadata(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(metadata))
+
+	_, err = store.Put(lumpid("0001"), data)
+	assert.Nil(t, err)
+	store.Close()
+
+	store, err = OpenCannylsStorage("tmp46.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	got, err = store.Get(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.Equal(t, data.AsBytes(), got)
+	got, err = store.Get(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3000, len(got))
+}
+
+func TestStoragePutWithCapacity(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp48.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp48.lusf")
+	store.embedThreshold = 1000
+
+	_, err = store.PutWithCapacity(lumpid("0000"), zeroedData(10), 4000)
+	assert.Nil(t, err)
+	stat, err := store.Stat(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.False(t, stat.Embedded)
+	assert.Equal(t, uint32(10), stat.Size)
+	assert.Equal(t, uint32(4096), stat.SizeOnDisk)
+
+	//Update uses the reserved space
+	data := zeroedData(3000)
+	data.AsBytes()[2999] = 'x'
+	updated, err := store.Update(lumpid("0000"), data)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	newStat, err := store.Stat(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, stat.Offset, newStat.Offset)
+	assert.Equal(t, uint32(3000), newStat.Size)
+
+	//Update moves the lump if it does not fit
+	_, err = store.Update(lumpid("0000"), zeroedData(5000))
+	assert.Nil(t, err)
+	newStat, err = store.Stat(lumpid("0000"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5120), newStat.SizeOnDisk)
+	//a new small lump is embedded
+	updated, err = store.Update(lumpid("0001"), zeroedData(10))
+	assert.Nil(t, err)
+	assert.False(t, updated)
+	stat, err = store.Stat(lumpid("0001"))
+	assert.Nil(t, err)
+	assert.True(t, stat.Embedded)
+
+	_, err = store.PutWithCapacity(lumpid("0002"), zeroedData(10), 4000)
+	assert.Nil(t, err)
+	_, err = store.Update(lumpid("0002"), data)
+	assert.Nil(t, err)
+	store.Close()
+
+	store, err = OpenCannylsStorage("tmp48.lusf")
+	assert.Nil(t, err)
+	defer store.Close()
+	got, err := store.Get(lumpid("0002"))
+	assert.Nil(t, err)
+	assert.Equal(t, data.AsBytes(), got)
+	report, err := store.Verify(VerifyOptions{Deep: true})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean())
+}
+
+func TestStorageGetMulti(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp49.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp49.lusf")
+	defer store.Close()
+
+	for i := 0; i < 20; i++ {
+		data := zeroedData(600)
+		data.AsBytes()[0] = byte(i)
+		_, err = store.Put(lumpidnum(i), data)
+		assert.Nil(t, err)
+	}
+	_, err = store.PutEmbed(lumpidnum(100), []byte("hello"))
+	assert.Nil(t, err)
+	_, err = store.Delete(lumpidnum(3))
+	assert.Nil(t, err)
+
+	ids := []lump.LumpId{lumpidnum(100), lumpidnum(19), lumpidnum(3), lumpidnum(0), lumpidnum(200), lumpidnum(7)}
+	data, err := store.GetMulti(ids)
+	assert.Nil(t, err)
+	assert.Equal(t, len(ids), len(data))
+	assert.Equal(t, []byte("hello"), data[0])
+	assert.Nil(t, data[2])
+	assert.Nil(t, data[4])
+	for _, i := range []int{1, 3, 5} {
+		expected, err := store.Get(ids[i])
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data[i])
+	}
+}
+
+func TestStorageRestoreProgress(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp56.lusf", 4*1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp56.lusf")
+	for i := 0; i < 2500; i++ {
+		_, err = store.Put(lumpidnum(i), zeroedData(3))
+		assert.Nil(t, err)
+	}
+	store.Close()
+
+	var events []journal.RestoreProgress
+	options := DefaultStorageOptions()
+	options.Journal.OnRestoreProgress = func(progress journal.RestoreProgress) {
+		events = append(events, progress)
+	}
+	store, err = OpenCannylsStorageWithOptions("tmp56.lusf", options)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	//a batch of 1024 records, another one, the rest, and done
+	assert.Equal(t, 4, len(events))
+	total := events[0].TotalBytes
+	//the records end before the end of the ring
+	assert.True(t, events[2].ReplayedBytes < total)
+	for i := 1; i < len(events); i++ {
+		assert.Equal(t, total, events[i].TotalBytes)
+		assert.True(t, events[i].ReplayedBytes > events[i-1].ReplayedBytes)
+	}
+	assert.Equal(t, 1024, events[0].Entries)
+	last := events[len(events)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, total, last.ReplayedBytes)
+	assert.Equal(t, events[2].Entries, last.Entries)
+	assert.True(t, last.Entries >= 2500)
 }
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+/*
+PutWithTag is the same as PutWithMetadata, and the lump is tagged by at most lump.MAX_TAG_SIZE
+bytes, such as the shard or the tenant of the lump, an empty tag means no tag.
+The tag is written in the journal record, and kept in an index of the tags in memory,
+so the lumps of a tag are listed by ListByTag without scanning all the lumpids.
+Put or PutEmbed on the same lumpid again clears the tag as the metadata.
+*/
+func (store *Storage) PutWithTag(lumpid lump.LumpId, lumpdata lump.LumpData, metadata []byte, tag string) (updated bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	if err = checkMetadataAndTag(metadata, tag); err != nil {
+		return
+	}
+	if store.shouldEmbed(uint64(len(lumpdata.AsBytes()))) {
+		return store.PutEmbedWithTag(lumpid, lumpdata.AsBytes(), metadata, tag)
+	}
+	metadata = append([]byte{}, metadata...)
+	if !store.dataRegion.FitsPortion(uint64(len(lumpdata.AsBytes()))) {
+		return store.putExtentsWithAttributes(lumpid, lumpdata, 0, metadata, tag)
+	}
+	if err = store.checkQuota(lumpid, store.dataRegion.EstimateSize(uint64(len(lumpdata.AsBytes())), 0)); err != nil {
+		return
+	}
+	if updated, err = store.deleteIfExist(lumpid, false); err != nil {
+		return
+	}
+
+	dataPortion, err := store.dataRegion.Put(lumpdata)
+	if err != nil {
+		return
+	}
+	//the index is updated by journal
+	if err = store.journalRegion.RecordPutWithTag(store.index, lumpid, dataPortion, metadata, tag); err != nil {
+		store.dataRegion.Release(dataPortion)
+		return
+	}
+	return
+}
+
+//PutEmbedWithTag is the same as PutEmbedWithMetadata, the tag is written after the metadata in the journal
+func (store *Storage) PutEmbedWithTag(lumpid lump.LumpId, data []byte, metadata []byte, tag string) (updated bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	if err = checkMetadataAndTag(metadata, tag); err != nil {
+		return
+	}
+	metadata = append([]byte{}, metadata...)
+	if err = store.checkQuota(lumpid, uint64(len(data))); err != nil {
+		return
+	}
+	if updated, err = store.deleteIfExist(lumpid, false); err != nil {
+		return
+	}
+	if err = store.journalRegion.RecordEmbedWithTag(store.index, lumpid, data, metadata, tag); err == nil {
+		store.cacheEmbedded(lumpid, data)
+	}
+	return
+}
+
+func checkMetadataAndTag(metadata []byte, tag string) error {
+	if len(metadata) > lump.MAX_METADATA_SIZE {
+		return errors.Wrapf(internalerror.InvalidInput, "metadata is too large: %d", len(metadata))
+	}
+	if len(tag) > lump.MAX_TAG_SIZE {
+		return errors.Wrapf(internalerror.InvalidInput, "tag is too large: %d", len(tag))
+	}
+	return nil
+}
+
+//GetTag returns the tag of the lump, it is empty if the lump is put without tag
+func (store *Storage) GetTag(lumpid lump.LumpId) (string, error) {
+	if err := store.checkOpen(); err != nil {
+		return "", err
+	}
+	if store.isExpired(lumpid) {
+		return "", errors.Wrapf(internalerror.InvalidInput, "lump %s is expired", lumpid.String())
+	}
+	if _, err := store.index.Get(lumpid); err != nil {
+		return "", err
+	}
+	tag, _ := store.index.Tag(lumpid)
+	return tag, nil
+}
+
+//ListByTag returns at most limit lumpids with the tag ordered by lumpid, limit <= 0 means no limit
+func (store *Storage) ListByTag(tag string, limit int) (ids []lump.LumpId) {
+	store.view(func() {
+		ids = store.index.ListByTagLive(tag, limit, store.unixNow())
+	})
+	return
+}
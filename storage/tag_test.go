@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func TestStoragePutWithTag(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp42.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp42.lusf")
+	defer os.Remove("tmp42.ckpt")
+
+	_, err = store.PutWithTag(lumpidnum(0), zeroedData(100), nil, string(make([]byte, lump.MAX_TAG_SIZE+1)))
+	assert.Error(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err = store.PutWithTag(lumpidnum(i), zeroedData(100), nil, "shard-1")
+		assert.Nil(t, err)
+	}
+	_, err = store.PutEmbedWithTag(lumpidnum(4), []byte("hello"), []byte("meta"), "shard-2")
+	assert.Nil(t, err)
+	//put again clears the tag, put with another tag moves it
+	_, err = store.Put(lumpidnum(1), zeroedData(100))
+	assert.Nil(t, err)
+	_, err = store.PutWithTag(lumpidnum(2), zeroedData(100), nil, "shard-2")
+	assert.Nil(t, err)
+	_, err = store.Delete(lumpidnum(3))
+	assert.Nil(t, err)
+
+	check := func(store *Storage) {
+		assert.Equal(t, []lump.LumpId{lumpidnum(0)}, store.ListByTag("shard-1", 0))
+		assert.Equal(t, []lump.LumpId{lumpidnum(2), lumpidnum(4)}, store.ListByTag("shard-2", 0))
+		tag, err := store.GetTag(lumpidnum(4))
+		assert.Nil(t, err)
+		assert.Equal(t, "shard-2", tag)
+		metadata, err := store.GetMetadata(lumpidnum(4))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("meta"), metadata)
+		tag, err = store.GetTag(lumpidnum(1))
+		assert.Nil(t, err)
+		assert.Equal(t, "", tag)
+		_, err = store.GetTag(lumpidnum(3))
+		assert.Error(t, err)
+	}
+	check(store)
+
+	//the tags are kept by the journal GC
+	assert.Nil(t, store.JournalGC())
+	store.Close()
+	store, err = OpenCannylsStorage("tmp42.lusf")
+	assert.Nil(t, err)
+	check(store)
+	store.Close()
+
+	//and by the checkpoint
+	options := DefaultStorageOptions()
+	options.Checkpoint = "tmp42.ckpt"
+	store, err = OpenCannylsStorageWithOptions("tmp42.lusf", options)
+	assert.Nil(t, err)
+	store.Close()
+	store, err = OpenCannylsStorageWithOptions("tmp42.lusf", options)
+	assert.Nil(t, err)
+	check(store)
+	store.Close()
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+/*
+Transaction collects the puts and the deletes of several lumps, they are committed atomically
+with one journal record by Commit. Nothing is written before Commit, so Rollback only drops them.
+The lump data must not be changed until Commit, and the storage must not be used in parallel.
+The lumps put in a transaction are never embedded.
+*/
+type Transaction struct {
+	store *Storage
+	ids   []lump.LumpId
+	//the data of each id in ids, nil means the lump is deleted
+	data map[lump.LumpId]*lump.LumpData
+	done bool
+}
+
+//Begin starts a transaction, it is finished by Commit or Rollback
+func (store *Storage) Begin() (*Transaction, error) {
+	if err := store.checkOpen(); err != nil {
+		return nil, err
+	}
+	return &Transaction{
+		store: store,
+		data:  make(map[lump.LumpId]*lump.LumpData),
+	}, nil
+}
+
+func (tx *Transaction) add(lumpid lump.LumpId, data *lump.LumpData) error {
+	if tx.done {
+		return errors.Wrap(internalerror.InvalidInput, "transaction is already finished")
+	}
+	if _, ok := tx.data[lumpid]; !ok {
+		if len(tx.ids) >= journal.MAX_TRANSACTION_COUNT {
+			return errors.Wrap(internalerror.InvalidInput, "too many lumps in transaction")
+		}
+		tx.ids = append(tx.ids, lumpid)
+	}
+	//the last operation on the same lump wins
+	tx.data[lumpid] = data
+	return nil
+}
+
+func (tx *Transaction) Put(lumpid lump.LumpId, lumpdata lump.LumpData) error {
+	return tx.add(lumpid, &lumpdata)
+}
+
+func (tx *Transaction) Delete(lumpid lump.LumpId) error {
+	return tx.add(lumpid, nil)
+}
+
+//Rollback drops the transaction, it does nothing if the transaction is already finished
+func (tx *Transaction) Rollback() {
+	tx.done = true
+	tx.ids = nil
+	tx.data = nil
+}
+
+/*
+Commit writes the lump data into the data region, and commits all the puts and the deletes
+with one journal record. If it fails, the transaction is rolled back and none of them is stored.
+*/
+func (tx *Transaction) Commit() (err error) {
+	if tx.done {
+		return errors.Wrap(internalerror.InvalidInput, "transaction is already finished")
+	}
+	defer tx.Rollback()
+	store := tx.store
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	if len(tx.ids) == 0 {
+		return nil
+	}
+	//a deleted lump takes 0 bytes
+	sizes := make([]uint64, len(tx.ids))
+	for i, id := range tx.ids {
+		if data := tx.data[id]; data != nil {
+			sizes[i] = store.dataRegion.EstimateSize(uint64(len(data.AsBytes())), 0)
+		}
+	}
+	if err = store.checkQuotas(tx.ids, sizes); err != nil {
+		return
+	}
+
+	puts := make([]journal.PutRecord, 0, len(tx.ids))
+	deletes := make([]lump.LumpId, 0)
+	releaseAll := func() {
+		for _, put := range puts {
+			store.dataRegion.Release(put.DataPortion)
+		}
+	}
+	for _, id := range tx.ids {
+		data := tx.data[id]
+		if data == nil {
+			deletes = append(deletes, id)
+			continue
+		}
+		var p portion.DataPortion
+		if p, err = store.dataRegion.Put(*data); err != nil {
+			releaseAll()
+			return
+		}
+		puts = append(puts, journal.PutRecord{LumpID: id, DataPortion: p})
+	}
+
+	//remember the old portions, they will be released after the transaction is committed
+	released := make([]portion.DataPortion, 0, len(tx.ids))
+	var embedded []lump.LumpId
+	for _, id := range tx.ids {
+		if p, err := store.index.Get(id); err == nil {
+			switch v := p.(type) {
+			case portion.DataPortion:
+				released = append(released, store.extentsOf(id, v)...)
+			case portion.JournalPortion:
+				embedded = append(embedded, id)
+			}
+		}
+	}
+
+	//RecordTransaction updates the index
+	if err = store.journalRegion.RecordTransaction(store.index, puts, deletes); err != nil {
+		releaseAll()
+		return
+	}
+
+	for _, id := range embedded {
+		store.uncacheEmbedded(id)
+	}
+	store.releasePortions(released)
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/storage/journal"
+)
+
+func TestStorageTransaction(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp36.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp36.lusf")
+
+	_, err = store.Put(lumpid("0000"), zeroedData(100))
+	assert.Nil(t, err)
+	_, err = store.PutEmbed(lumpid("0001"), []byte("embedded"))
+	assert.Nil(t, err)
+	usage := store.Usage()
+
+	//nothing is written before commit
+	tx, err := store.Begin()
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Put(lumpid("0002"), zeroedData(100)))
+	assert.Nil(t, tx.Delete(lumpid("0000")))
+	tx.Rollback()
+	assert.Error(t, tx.Commit())
+	assert.Equal(t, 2, len(store.List()))
+	assert.Equal(t, usage.FreeBytes, store.Usage().FreeBytes)
+
+	tx, err = store.Begin()
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Put(lumpid("0002"), zeroedData(100)))
+	assert.Nil(t, tx.Put(lumpid("0003"), zeroedData(3000)))
+	assert.Nil(t, tx.Delete(lumpid("0000")))
+	assert.Nil(t, tx.Delete(lumpid("0001")))
+	//the last operation wins
+	assert.Nil(t, tx.Put(lumpid("0004"), zeroedData(100)))
+	assert.Nil(t, tx.Delete(lumpid("0004")))
+	assert.Nil(t, tx.Delete(lumpid("0005")))
+	assert.Nil(t, tx.Put(lumpid("0005"), zeroedData(200)))
+	assert.Nil(t, tx.Commit())
+	assert.Error(t, tx.Put(lumpid("0006"), zeroedData(100)))
+
+	check := func(store *Storage) {
+		assert.Equal(t, []lump.LumpId{lumpid("0002"), lumpid("0003"), lumpid("0005")}, store.List())
+		data, err := store.Get(lumpid("0005"))
+		assert.Nil(t, err)
+		assert.Equal(t, 200, len(data))
+	}
+	check(store)
+
+	//the transaction is one journal record
+	snapshot := store.JournalSnapshot()
+	_, ok := snapshot.Entries[len(snapshot.Entries)-1].Record.(journal.TransactionRecord)
+	assert.True(t, ok)
+
+	//the live puts survive GC
+	assert.Nil(t, store.JournalGC())
+	assert.Nil(t, store.JournalGC())
+	check(store)
+	store.Close()
+
+	store, err = OpenCannylsStorage("tmp36.lusf")
+	assert.Nil(t, err)
+	check(store)
+	//the portion of 0000 is released, 0002, 0003 and 0005 take 1 + 6 + 1 blocks
+	assert.Equal(t, usage.FreeBytes+512-8*512, store.Usage().FreeBytes)
+	store.Close()
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+/*
+PutWithTTL is the same as Put, but the lump expires after ttl, which is rounded up to seconds.
+The expired lump could not be read, it is deleted by ReapExpired, which is called in RunSideJobOnce.
+Put or PutEmbed on the same lumpid again clears the TTL.
+*/
+func (store *Storage) PutWithTTL(lumpid lump.LumpId, lumpdata lump.LumpData, ttl time.Duration) (updated bool, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	if ttl <= 0 {
+		return false, errors.Wrapf(internalerror.InvalidInput, "invalid ttl %v", ttl)
+	}
+	seconds := uint64((ttl + time.Second - 1) / time.Second)
+	return store.putWithExpire(lumpid, lumpdata, uint64(store.clock().Unix())+seconds)
+}
+
+func (store *Storage) putWithExpire(lumpid lump.LumpId, lumpdata lump.LumpData, expireAt uint64) (updated bool, err error) {
+	if err = store.checkWritable(); err != nil {
+		return
+	}
+	if !store.dataRegion.FitsPortion(uint64(len(lumpdata.AsBytes()))) {
+		return store.putExtentsWithAttributes(lumpid, lumpdata, expireAt, nil, "")
+	}
+	if err = store.checkQuota(lumpid, store.dataRegion.EstimateSize(uint64(len(lumpdata.AsBytes())), 0)); err != nil {
+		return
+	}
+	if updated, err = store.deleteIfExist(lumpid, false); err != nil {
+		return
+	}
+
+	dataPortion, err := store.dataRegion.Put(lumpdata)
+	if err != nil {
+		return
+	}
+	//the index is updated by journal
+	if err = store.journalRegion.RecordPutWithTTL(store.index, lumpid, dataPortion, expireAt); err != nil {
+		store.dataRegion.Release(dataPortion)
+		return
+	}
+	return
+}
+
+//ExpireAt returns when the lump expires, ok is false if the lump has no TTL
+func (store *Storage) ExpireAt(lumpid lump.LumpId) (expireAt time.Time, ok bool) {
+	store.view(func() {
+		expireAt, ok = store.expireAt(lumpid)
+	})
+	return
+}
+
+func (store *Storage) expireAt(lumpid lump.LumpId) (expireAt time.Time, ok bool) {
+	seconds, ok := store.index.ExpireAt(lumpid)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+func (store *Storage) isExpired(lumpid lump.LumpId) bool {
+	expireAt, ok := store.index.ExpireAt(lumpid)
+	return ok && expireAt <= store.unixNow()
+}
+
+//unixNow is the time in seconds the expire times are compared with
+func (store *Storage) unixNow() uint64 {
+	return uint64(store.clock().Unix())
+}
+
+//ReapExpired deletes at most max expired lumps, and returns how many are deleted
+func (store *Storage) ReapExpired(max int) (reaped int, err error) {
+	if err = store.checkOpen(); err != nil {
+		return
+	}
+	for _, id := range store.index.Expired(store.unixNow(), max) {
+		if _, err = store.Delete(id); err != nil {
+			return reaped, err
+		}
+		reaped++
+	}
+	return reaped, nil
+}
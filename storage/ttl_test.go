@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/lump"
+)
+
+func TestStoragePutWithTTL(t *testing.T) {
+	storage, err := CreateCannylsStorage("tmp11.lusf", 1024*1024, 0.01)
+	assert.Nil(t, err)
+	defer os.Remove("tmp11.lusf")
+
+	now := time.Unix(1000, 0)
+	storage.clock = func() time.Time { return now }
+
+	_, err = storage.PutWithTTL(lumpid("0000"), zeroedData(100), 0)
+	assert.Error(t, err)
+
+	_, err = storage.PutWithTTL(lumpid("0000"), zeroedData(100), 10*time.Second)
+	assert.Nil(t, err)
+	_, err = storage.PutWithTTL(lumpid("0001"), zeroedData(100), 1500*time.Millisecond)
+	assert.Nil(t, err)
+	_, err = storage.PutWithTTL(lumpid("0002"), zeroedData(100), time.Second)
+	assert.Nil(t, err)
+	//put again clears the ttl
+	_, err = storage.Put(lumpid("0002"), zeroedData(100))
+	assert.Nil(t, err)
+
+	expireAt, ok := storage.ExpireAt(lumpid("0001"))
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1002, 0), expireAt)
+	_, ok = storage.ExpireAt(lumpid("0002"))
+	assert.False(t, ok)
+
+	now = time.Unix(1005, 0)
+	_, err = storage.Get(lumpid("0001"))
+	assert.Error(t, err)
+	_, err = storage.GetTag(lumpid("0001"))
+	assert.Error(t, err)
+	_, err = storage.Get(lumpid("0000"))
+	assert.Nil(t, err)
+
+	//the expired lump is not listed before it is reaped
+	live := []lump.LumpId{lumpid("0000"), lumpid("0002")}
+	assert.Equal(t, live, storage.List())
+	assert.Equal(t, live[:1], storage.ListRange(lumpid("0000"), lumpid("0002"), 0))
+	assert.Equal(t, live, storage.ListPrefix(lumpid("0000"), 32, 0))
+	assert.Equal(t, 3, len(storage.index.List()))
+
+	reaped, err := storage.ReapExpired(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, reaped)
+	assert.Equal(t, 2, len(storage.List()))
+
+	assert.Nil(t, storage.JournalGC())
+	storage.Close()
+
+	//ttl is restored from journal
+	storage, err = OpenCannylsStorage("tmp11.lusf")
+	assert.Nil(t, err)
+	expireAt, ok = storage.ExpireAt(lumpid("0000"))
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1010, 0), expireAt)
+	storage.clock = func() time.Time { return time.Unix(1010, 0) }
+	assert.Nil(t, storage.RunSideJobOnce())
+	assert.Equal(t, 1, len(storage.index.List()))
+	assert.Equal(t, SideJobStats{}, storage.SideJobStats())
+	storage.Close()
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/thesues/cannyls-go/internalerror"
+	"github.com/thesues/cannyls-go/lump"
+	"github.com/thesues/cannyls-go/portion"
+	"github.com/thesues/cannyls-go/storage/allocator"
+)
+
+type VerifyProblemKind int
+
+const (
+	//the journal records could not be read
+	VERIFY_BAD_JOURNAL VerifyProblemKind = iota
+	//the data portion is beyond the data region
+	VERIFY_OUT_OF_RANGE
+	//the data portion overlaps the data portion of another lump
+	VERIFY_OVERLAP
+	//the trailer of the data portion is broken
+	VERIFY_BAD_TRAILER
+	//the lump data could not be read, decompressed, or its checksum mismatches
+	VERIFY_BAD_DATA
+	//the embedded data is beyond the journal region or could not be read
+	VERIFY_BAD_EMBEDDED
+	//the free space of the allocator does not match the data portions in use
+	VERIFY_BAD_FREE_SPACE
+)
+
+func (kind VerifyProblemKind) String() string {
+	switch kind {
+	case VERIFY_BAD_JOURNAL:
+		return "bad journal"
+	case VERIFY_OUT_OF_RANGE:
+		return "out of range"
+	case VERIFY_OVERLAP:
+		return "overlap"
+	case VERIFY_BAD_TRAILER:
+		return "bad trailer"
+	case VERIFY_BAD_DATA:
+		return "bad data"
+	case VERIFY_BAD_EMBEDDED:
+		return "bad embedded data"
+	case VERIFY_BAD_FREE_SPACE:
+		return "bad free space"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(kind))
+	}
+}
+
+type VerifyProblem struct {
+	Kind VerifyProblemKind
+	//Id is the broken lump, it is not set for VERIFY_BAD_JOURNAL and VERIFY_BAD_FREE_SPACE
+	Id  lump.LumpId
+	Err error
+	//Repaired is true if the lump is deleted or the allocator is rebuilt by Repair, or the lump
+	//is rewritten by the Repairer of the scrubber
+	Repaired bool
+}
+
+func (problem VerifyProblem) String() string {
+	switch problem.Kind {
+	case VERIFY_BAD_JOURNAL, VERIFY_BAD_FREE_SPACE:
+		return fmt.Sprintf("%s: %v", problem.Kind, problem.Err)
+	default:
+		return fmt.Sprintf("lump %s %s: %v", problem.Id.String(), problem.Kind, problem.Err)
+	}
+}
+
+type VerifyOptions struct {
+	//Deep reads the whole data portions to verify the checksums, otherwise only the trailers are read
+	Deep bool
+	/*
+		Repair deletes the lumps which are out of range, or whose trailer or data is broken,
+		and rebuilds the allocator from the index. The overlapping lumps are only reported
+		if their data is fine, because it is not known which one is overwritten
+	*/
+	Repair bool
+}
+
+type VerifyReport struct {
+	JournalRecords int
+	DataLumps      int
+	EmbeddedLumps  int
+	Problems       []VerifyProblem
+}
+
+//Clean returns true if no problem is found
+func (report VerifyReport) Clean() bool {
+	return len(report.Problems) == 0
+}
+
+/*
+Verify walks the journal, the index and the data region, and cross checks the portion bounds,
+the trailer padding, the overlapping data portions and the free space of the allocator.
+The problems are reported instead of returned as error, the error is only returned if Repair
+fails. The storage must be opened writable to Repair
+*/
+func (store *Storage) Verify(options VerifyOptions) (report VerifyReport, err error) {
+	if options.Repair {
+		if err = store.checkWritable(); err != nil {
+			return
+		}
+		//the allocator rebuilt from the index would free the portions pinned by a snapshot
+		if store.dataRegion.Pinned() {
+			return report, errors.Wrap(internalerror.DeviceBusy, "a snapshot is open")
+		}
+	}
+
+	if report.JournalRecords, err = store.journalRegion.Verify(); err != nil {
+		report.Problems = append(report.Problems, VerifyProblem{Kind: VERIFY_BAD_JOURNAL, Err: err})
+		err = nil
+	}
+
+	broken := make(map[lump.LumpId]bool)
+	report.Problems = append(report.Problems, store.verifyEmbedded(&report, broken)...)
+	report.Problems = append(report.Problems, store.verifyDataPortions(&report, options.Deep, broken)...)
+	if problem, ok := store.verifyFreeSpace(); !ok {
+		report.Problems = append(report.Problems, problem)
+	}
+
+	if !options.Repair || len(report.Problems) == 0 {
+		return
+	}
+	for id := range broken {
+		if err = store.dropLump(id); err != nil {
+			return
+		}
+	}
+	store.restoreAllocator()
+	if err = store.JournalSync(); err != nil {
+		return
+	}
+	for i := range report.Problems {
+		problem := &report.Problems[i]
+		switch problem.Kind {
+		case VERIFY_BAD_JOURNAL:
+		case VERIFY_BAD_FREE_SPACE:
+			problem.Repaired = true
+		default:
+			problem.Repaired = broken[problem.Id]
+		}
+	}
+	return
+}
+
+func (store *Storage) verifyEmbedded(report *VerifyReport, broken map[lump.LumpId]bool) (problems []VerifyProblem) {
+	for _, l := range store.index.LumpJournalPortions() {
+		report.EmbeddedLumps++
+		if err := store.journalRegion.VerifyEmbedded(l.Portion); err != nil {
+			problems = append(problems, VerifyProblem{Kind: VERIFY_BAD_EMBEDDED, Id: l.Id, Err: err})
+			broken[l.Id] = true
+		}
+	}
+	return
+}
+
+func (store *Storage) verifyDataPortions(report *VerifyReport, deep bool, broken map[lump.LumpId]bool) (problems []VerifyProblem) {
+	lumps := store.index.LumpDataPortions()
+	capacity := store.storageHeader.DataRegionSize / uint64(store.dataRegion.block_size.AsU16())
+	for i, l := range lumps {
+		//the extents of a lump follow its first portion
+		if i == 0 || l.Id != lumps[i-1].Id {
+			report.DataLumps++
+		}
+		if kind, err := store.verifyDataPortion(l.Portion, capacity, deep); err != nil {
+			problems = append(problems, VerifyProblem{Kind: kind, Id: l.Id, Err: err})
+			broken[l.Id] = true
+		}
+	}
+
+	sort.Slice(lumps, func(i, j int) bool {
+		return lumps[i].Portion.Start < lumps[j].Portion.Start
+	})
+	//prev is the lump with the largest end so far
+	prev := -1
+	for i, l := range lumps {
+		//the lumps with the same data share the portion, see SetDedup
+		shared := prev >= 0 && l.Portion == lumps[prev].Portion && store.index.Refs(l.Portion) > 1
+		if prev >= 0 && !shared && l.Portion.Start.AsU64() < lumps[prev].Portion.End() {
+			err := errors.Wrapf(internalerror.StorageCorrupted, "%s overlaps %s of lump %s", l.Portion.Display(),
+				lumps[prev].Portion.Display(), lumps[prev].Id.String())
+			problems = append(problems, VerifyProblem{Kind: VERIFY_OVERLAP, Id: l.Id, Err: err})
+		}
+		if prev < 0 || l.Portion.End() > lumps[prev].Portion.End() {
+			prev = i
+		}
+	}
+	return
+}
+
+//verifyDataPortion checks the bounds and the trailer of the portion, and its data if deep
+func (store *Storage) verifyDataPortion(p portion.DataPortion, capacity uint64, deep bool) (VerifyProblemKind, error) {
+	if p.Len == 0 || p.End() > capacity {
+		return VERIFY_OUT_OF_RANGE, errors.Wrapf(internalerror.StorageCorrupted, "%s is beyond %d blocks", p.Display(), capacity)
+	}
+	if err := store.dataRegion.Verify(p, false); err != nil {
+		return VERIFY_BAD_TRAILER, err
+	}
+	if deep {
+		if err := store.dataRegion.Verify(p, true); err != nil {
+			return VERIFY_BAD_DATA, err
+		}
+	}
+	return 0, nil
+}
+
+//verifyFreeSpace checks the free blocks and the blocks in use add up to the data region
+func (store *Storage) verifyFreeSpace() (VerifyProblem, bool) {
+	capacity := store.storageHeader.DataRegionSize / uint64(store.dataRegion.block_size.AsU16())
+	lumps := store.index.LumpDataPortions()
+	sort.Slice(lumps, func(i, j int) bool {
+		return lumps[i].Portion.Start < lumps[j].Portion.Start
+	})
+	//count the overlapping blocks once, or the leaked blocks may be hidden by them
+	var used, end uint64
+	for _, l := range lumps {
+		start := l.Portion.Start.AsU64()
+		if start < end {
+			start = end
+		}
+		if l.Portion.End() > start {
+			used += l.Portion.End() - start
+			end = l.Portion.End()
+		}
+	}
+	//the portions released while a snapshot is open are still allocated
+	used += store.dataRegion.pinnedBlocks()
+	if used+store.alloc.FreeCount() != capacity {
+		return VerifyProblem{Kind: VERIFY_BAD_FREE_SPACE, Err: errors.Wrapf(internalerror.StorageCorrupted, "%d blocks in use and %d blocks free, the data region has %d blocks",
+			used, store.alloc.FreeCount(), capacity)}, false
+	}
+	freeList, ok := store.alloc.(allocator.FreeListAllocator)
+	if !ok {
+		return VerifyProblem{}, true
+	}
+	//the free portions are sorted and never overlap, so a portion in use overlaps a free one
+	//if it ends after the start of the first free portion which ends after its start
+	var free [][2]uint64
+	freeList.ForEachFree(func(start uint64, length uint64) {
+		free = append(free, [2]uint64{start, start + length})
+	})
+	sort.Slice(free, func(i, j int) bool {
+		return free[i][0] < free[j][0]
+	})
+	for _, l := range lumps {
+		i := sort.Search(len(free), func(i int) bool {
+			return free[i][1] > l.Portion.Start.AsU64()
+		})
+		if i < len(free) && free[i][0] < l.Portion.End() {
+			return VerifyProblem{Kind: VERIFY_BAD_FREE_SPACE, Err: errors.Wrapf(internalerror.StorageCorrupted, "free blocks [%d, %d) overlap %s of lump %s",
+				free[i][0], free[i][1], l.Portion.Display(), l.Id.String())}, false
+		}
+	}
+	return VerifyProblem{}, true
+}
+
+//dropLump deletes the broken lump from the index and the journal, its portion is not released
+//because it may be out of range or used by another lump, the allocator is rebuilt later
+func (store *Storage) dropLump(id lump.LumpId) error {
+	p, err := store.index.Get(id)
+	if err != nil {
+		return nil
+	}
+	var extents []portion.DataPortion
+	if v, ok := p.(portion.DataPortion); ok {
+		extents = store.extentsOf(id, v)
+	}
+	store.index.Delete(id)
+	switch p.(type) {
+	case portion.DataPortion:
+		if store.dataRegion.cache != nil {
+			for _, extent := range extents {
+				store.dataRegion.cache.remove(extent.Start.AsU64())
+			}
+		}
+	case portion.JournalPortion:
+		store.uncacheEmbedded(id)
+	}
+	return store.journalRegion.RecordDelete(store.index, id)
+}
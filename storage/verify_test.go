@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thesues/cannyls-go/portion"
+)
+
+func TestStorageVerify(t *testing.T) {
+	store, err := CreateCannylsStorage("tmp38.lusf", 1024*1024, 0.1)
+	assert.Nil(t, err)
+	defer os.Remove("tmp38.lusf")
+	assert.Nil(t, store.SetDataChecksum(true))
+
+	for i := 0; i < 4; i++ {
+		_, err = store.Put(lumpidnum(i), filledData(1000, byte('a'+i)))
+		assert.Nil(t, err)
+	}
+	_, err = store.PutEmbed(lumpidnum(10), []byte("embedded"))
+	assert.Nil(t, err)
+
+	report, err := store.Verify(VerifyOptions{Deep: true})
+	assert.Nil(t, err)
+	assert.True(t, report.Clean())
+	assert.Equal(t, 4, report.DataLumps)
+	assert.Equal(t, 1, report.EmbeddedLumps)
+	assert.Equal(t, 5, report.JournalRecords)
+
+	portionOf := func(i int) portion.DataPortion {
+		p, err := store.index.Get(lumpidnum(i))
+		assert.Nil(t, err)
+		return p.(portion.DataPortion)
+	}
+	blockSize := int64(store.dataRegion.block_size.AsU16())
+
+	//break the padding of lump 0
+	p := portionOf(0)
+	last := make([]byte, blockSize)
+	last[blockSize-2], last[blockSize-1] = 0x8f, 0xff
+	_, err = store.dataRegion.nvm.WriteAt(last, int64(p.End())*blockSize-blockSize)
+	assert.Nil(t, err)
+
+	//flip the first byte of lump 1, only the deep verify reads it
+	p = portionOf(1)
+	_, err = store.dataRegion.nvm.WriteAt(make([]byte, blockSize), int64(p.Start.AsU64())*blockSize)
+	assert.Nil(t, err)
+
+	report, err = store.Verify(VerifyOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Problems))
+	assert.Equal(t, VERIFY_BAD_TRAILER, report.Problems[0].Kind)
+	assert.Equal(t, lumpidnum(0), report.Problems[0].Id)
+
+	//lump 3 overlaps lump 2, the allocator does not know the blocks of lump 3 are used
+	store.index.InsertDataPortion(lumpidnum(3), portionOf(2))
+	report, err = store.Verify(VerifyOptions{Deep: true, Repair: true})
+	assert.Nil(t, err)
+	kinds := make(map[VerifyProblemKind]VerifyProblem)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind] = problem
+	}
+	assert.Equal(t, 4, len(report.Problems))
+	assert.True(t, kinds[VERIFY_BAD_TRAILER].Repaired)
+	assert.Equal(t, lumpidnum(1), kinds[VERIFY_BAD_DATA].Id)
+	assert.True(t, kinds[VERIFY_BAD_DATA].Repaired)
+	assert.False(t, kinds[VERIFY_OVERLAP].Repaired)
+	assert.True(t, kinds[VERIFY_BAD_FREE_SPACE].Repaired)
+
+	_, err = store.Get(lumpidnum(0))
+	assert.Error(t, err)
+	_, err = store.Get(lumpidnum(1))
+	assert.Error(t, err)
+	data, err := store.Get(lumpidnum(3))
+	assert.Nil(t, err)
+	assert.Equal(t, byte('c'), data[0])
+
+	//only the overlap is left
+	report, err = store.Verify(VerifyOptions{Deep: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Problems))
+	assert.Equal(t, VERIFY_OVERLAP, report.Problems[0].Kind)
+
+	//the repair is journaled
+	store.Close()
+	store, err = OpenCannylsStorage("tmp38.lusf")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(store.List()))
+	store.Close()
+}